@@ -0,0 +1,423 @@
+// Package fakedevice implements the HTTP API of a gokrazy device in memory,
+// so that tools which update or query gokrazy devices (gok update, the fleet
+// commands, programs using the updateclient package or your own automation)
+// can be tested hermetically, without hardware:
+//
+//	dev := fakedevice.New("scanner")
+//	srv := httptest.NewServer(dev)
+//	defer srv.Close()
+//	// … point the tool at srv.URL, then inspect the device:
+//	if got, want := dev.ActiveRoot(), 3; got != want {
+//		t.Errorf("device boots from partition %d, want %d", got, want)
+//	}
+//
+// The device models the boot partition, the MBR, the two root partitions
+// (2 and 3, of which one is active) and device-specific files. Switching and
+// rebooting flip the active root partition like on a real device. After a
+// test boot (POST /update/testboot), the device boots the updated root
+// partition once and falls back to the previous one on the reboot after that,
+// unless the test boot is confirmed by switching (POST /update/switch) while
+// running from the updated root partition.
+package fakedevice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EEPROM holds the signatures of the Raspberry Pi EEPROM files which the
+// device reports (see updater.EEPROMVersion).
+type EEPROM struct {
+	PieepromSHA256 string
+	VL805SHA256    string
+}
+
+// Device is a fake gokrazy device. Configure its exported fields before
+// serving the first request; use the methods to inspect its state.
+type Device struct {
+	// Hostname, Model and Kernel are reported in the status JSON.
+	Hostname string
+	Model    string
+	Kernel   string
+
+	// BuildTimestamp and SBOMHash identify the running image, as reported in
+	// the status JSON.
+	BuildTimestamp string
+	SBOMHash       string
+
+	// RootBuildTimestamp, if non-nil, returns the build timestamp of the root
+	// file system image root, which the device reports after booting it (a
+	// real device reports the timestamp compiled into init). Otherwise, the
+	// device keeps reporting BuildTimestamp.
+	RootBuildTimestamp func(root []byte) string
+
+	// Features are the update protocol features of the device (see
+	// updater.ProtocolFeature). New devices support partuuid, updatehash and
+	// gpt.
+	Features []string
+
+	// Unsupported lists update destinations (e.g. mbr or
+	// device-specific/u-boot.bin) which the device does not implement, like
+	// older gokrazy versions.
+	Unsupported []string
+
+	// EEPROM is reported in the update features.
+	EEPROM EEPROM
+
+	// Password, if non-empty, is required via HTTP basic authentication
+	// (user gokrazy), like on a real device.
+	Password string
+
+	// RebootDelay is how long the device is unavailable (responding with
+	// HTTP 503) after a reboot.
+	RebootDelay time.Duration
+
+	mu          sync.Mutex
+	boot        []byte
+	mbr         []byte
+	roots       map[int][]byte
+	deviceFiles map[string][]byte
+	uploads     map[string][]byte
+	diversions  map[string]string
+	active      int
+	permanent   int // root partition booted by default
+	testboot    int // root partition booted once, on the next reboot
+	builds      map[int]string
+	reboots     int
+	poweredOff  bool
+	downUntil   time.Time
+	requests    []string
+}
+
+// New returns a device with the hostname, which boots from root partition 2
+// and supports all update protocol features.
+func New(hostname string) *Device {
+	return &Device{
+		Hostname:       hostname,
+		Model:          "Raspberry Pi 4 Model B Rev 1.4",
+		Kernel:         "6.1.21",
+		BuildTimestamp: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339),
+		Features:       []string{"partuuid", "updatehash", "gpt"},
+		roots:          make(map[int][]byte),
+		deviceFiles:    make(map[string][]byte),
+		uploads:        make(map[string][]byte),
+		diversions:     make(map[string]string),
+		builds:         make(map[int]string),
+		active:         2,
+		permanent:      2,
+	}
+}
+
+// inactive returns the root partition which updates write to.
+func (d *Device) inactive() int {
+	if d.active == 2 {
+		return 3
+	}
+	return 2
+}
+
+// Boot returns the contents of the boot partition.
+func (d *Device) Boot() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.boot
+}
+
+// MBR returns the MBR written by the last update, if any.
+func (d *Device) MBR() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mbr
+}
+
+// Root returns the contents of root partition 2 or 3.
+func (d *Device) Root(partition int) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.roots[partition]
+}
+
+// DeviceFile returns the contents of the device-specific file name (e.g.
+// u-boot.bin), if it was updated.
+func (d *Device) DeviceFile(name string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deviceFiles[name]
+}
+
+// Upload returns the contents of the file uploaded to /uploadtemp/path.
+func (d *Device) Upload(path string) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.uploads[path]
+}
+
+// Diversion returns the path to which the program at path was diverted (see
+// gok run).
+func (d *Device) Diversion(path string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.diversions[path]
+}
+
+// ActiveRoot returns the root partition (2 or 3) which the device runs from.
+func (d *Device) ActiveRoot() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// NextRoot returns the root partition (2 or 3) which the device boots from
+// after the next reboot.
+func (d *Device) NextRoot() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nextRoot()
+}
+
+func (d *Device) nextRoot() int {
+	if d.testboot != 0 {
+		return d.testboot
+	}
+	return d.permanent
+}
+
+// Reboots returns how often the device was rebooted.
+func (d *Device) Reboots() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reboots
+}
+
+// PoweredOff returns whether the device was powered off.
+func (d *Device) PoweredOff() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.poweredOff
+}
+
+// Requests returns the requests served so far, as method and path, e.g.
+// "POST /update/switch".
+func (d *Device) Requests() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.requests...)
+}
+
+func (d *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = append(d.requests, r.Method+" "+r.URL.Path)
+	if d.poweredOff || time.Now().Before(d.downUntil) {
+		http.Error(w, "device unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if d.Password != "" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "gokrazy" || pass != d.Password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gokrazy"`)
+			http.Error(w, "authorization required", http.StatusUnauthorized)
+			return
+		}
+	}
+	if err := d.serve(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (d *Device) serve(w http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+	switch {
+	case path == "/update/features":
+		return d.serveFeatures(w)
+
+	case path == "/update/switch" || path == "/update/testboot":
+		if r.Method != http.MethodPost {
+			return fmt.Errorf("expected POST, got %s", r.Method)
+		}
+		switch {
+		case path == "/update/testboot":
+			d.testboot = d.inactive()
+		case d.active != d.permanent:
+			// Confirm the test boot of the running root partition.
+			d.permanent = d.active
+			d.testboot = 0
+		default:
+			d.permanent = d.inactive()
+			d.testboot = 0
+		}
+		return nil
+
+	case strings.HasPrefix(path, "/update/"):
+		if r.Method != http.MethodPut {
+			return fmt.Errorf("expected PUT, got %s", r.Method)
+		}
+		return d.serveUpdate(w, r, strings.TrimPrefix(path, "/update/"))
+
+	case path == "/reboot" || path == "/poweroff":
+		if r.Method != http.MethodPost {
+			return fmt.Errorf("expected POST, got %s", r.Method)
+		}
+		if path == "/poweroff" {
+			d.poweredOff = true
+			return nil
+		}
+		d.reboot()
+		return nil
+
+	case strings.HasPrefix(path, "/uploadtemp/"):
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		d.uploads[strings.TrimPrefix(path, "/uploadtemp/")] = b
+		return nil
+
+	case path == "/divert":
+		if r.Header.Get("Content-Type") != "application/json" {
+			// Older gokrazy versions take query parameters.
+			d.diversions[r.FormValue("path")] = r.FormValue("diversion")
+			return nil
+		}
+		var div struct {
+			Path      string
+			Diversion string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&div); err != nil {
+			return err
+		}
+		d.diversions[div.Path] = div.Diversion
+		return nil
+
+	case path == "/":
+		return d.serveStatus(w, r)
+	}
+	http.NotFound(w, r)
+	return nil
+}
+
+func (d *Device) serveFeatures(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(struct {
+		Features string `json:"features"`
+		EEPROM   EEPROM `json:"EEPROM"`
+	}{
+		Features: strings.Join(d.Features, ","),
+		EEPROM:   d.EEPROM,
+	})
+}
+
+func (d *Device) supports(feature string) bool {
+	for _, f := range d.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUpdate writes the request body to dest and responds with its hash,
+// which the updater verifies.
+func (d *Device) serveUpdate(w http.ResponseWriter, r *http.Request, dest string) error {
+	for _, u := range d.Unsupported {
+		if u == dest {
+			// Older devices serve their index page for unknown handlers.
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<!DOCTYPE html>\n<title>gokrazy</title>\n")
+			return nil
+		}
+	}
+	var h hash.Hash = sha256.New()
+	if r.Header.Get("X-Gokrazy-Update-Hash") == "crc32" && d.supports("updatehash") {
+		h = crc32.NewIEEE()
+	}
+	b, err := io.ReadAll(io.TeeReader(r.Body, h))
+	if err != nil {
+		return err
+	}
+	switch {
+	case dest == "root":
+		d.roots[d.inactive()] = b
+	case dest == "boot" || dest == "bootonly":
+		d.boot = b
+		if dest == "bootonly" {
+			d.permanent = d.active
+			d.testboot = 0
+		}
+	case dest == "mbr":
+		d.mbr = b
+	case strings.HasPrefix(dest, "device-specific/"):
+		d.deviceFiles[strings.TrimPrefix(dest, "device-specific/")] = b
+	default:
+		return fmt.Errorf("unknown update destination %q", dest)
+	}
+	_, err = io.WriteString(w, hex.EncodeToString(h.Sum(nil)))
+	return err
+}
+
+func (d *Device) reboot() {
+	d.reboots++
+	d.downUntil = time.Now().Add(d.RebootDelay)
+	next := d.nextRoot()
+	d.testboot = 0 // test boots only last for one boot
+	if next == d.active {
+		return
+	}
+	d.builds[d.active] = d.BuildTimestamp
+	d.active = next
+	if d.RootBuildTimestamp != nil && d.roots[d.active] != nil {
+		d.BuildTimestamp = d.RootBuildTimestamp(d.roots[d.active])
+	} else if build, ok := d.builds[d.active]; ok {
+		d.BuildTimestamp = build
+	}
+}
+
+// Status is the status JSON which the device serves at / for requests which
+// accept application/json.
+type Status struct {
+	Hostname       string
+	Model          string
+	Kernel         string
+	BuildTimestamp string
+	SBOMHash       string
+	Uptime         string
+	EEPROM         EEPROM
+
+	// ActiveRoot is the root partition which the device runs from.
+	// PendingRoot is the root partition which it boots from after the next
+	// reboot, if different.
+	ActiveRoot  int
+	PendingRoot int `json:",omitempty"`
+}
+
+func (d *Device) serveStatus(w http.ResponseWriter, r *http.Request) error {
+	st := Status{
+		Hostname:       d.Hostname,
+		Model:          d.Model,
+		Kernel:         d.Kernel,
+		BuildTimestamp: d.BuildTimestamp,
+		SBOMHash:       d.SBOMHash,
+		Uptime:         "1m",
+		EEPROM:         d.EEPROM,
+		ActiveRoot:     d.active,
+	}
+	if next := d.nextRoot(); next != d.active {
+		st.PendingRoot = next
+	}
+	if r.Header.Get("Content-Type") == "application/json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(st)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	_, err := fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s – gokrazy</title>\n<p>fake gokrazy device, build %s, root partition %d</p>\n",
+		d.Hostname, d.BuildTimestamp, d.active)
+	return err
+}
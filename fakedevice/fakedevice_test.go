@@ -0,0 +1,204 @@
+package fakedevice_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gokrazy/tools/fakedevice"
+	"github.com/gokrazy/updater"
+)
+
+func TestUpdateFlow(t *testing.T) {
+	for _, features := range [][]string{
+		{"partuuid", "updatehash", "gpt"}, // crc32 hashes
+		{"partuuid"},                      // sha256 hashes
+	} {
+		dev := fakedevice.New("test")
+		dev.Features = features
+		dev.RootBuildTimestamp = func(root []byte) string { return string(root) }
+		srv := httptest.NewServer(dev)
+		defer srv.Close()
+
+		target, err := updater.NewTarget(srv.URL+"/", srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := target.StreamTo("root", bytes.NewReader([]byte("2023-06-01"))); err != nil {
+			t.Fatalf("%v: StreamTo(root): %v", features, err)
+		}
+		if err := target.StreamTo("boot", bytes.NewReader([]byte("boot"))); err != nil {
+			t.Fatalf("%v: StreamTo(boot): %v", features, err)
+		}
+		if err := target.Testboot(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := dev.ActiveRoot(), 2; got != want {
+			t.Errorf("before reboot: ActiveRoot() = %d, want %d", got, want)
+		}
+		if err := target.Reboot(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := dev.ActiveRoot(), 3; got != want {
+			t.Errorf("after reboot: ActiveRoot() = %d, want %d", got, want)
+		}
+		if got, want := dev.BuildTimestamp, "2023-06-01"; got != want {
+			t.Errorf("BuildTimestamp = %q, want %q", got, want)
+		}
+		if got, want := string(dev.Boot()), "boot"; got != want {
+			t.Errorf("Boot() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestTestboot(t *testing.T) {
+	dev := fakedevice.New("test")
+	dev.RootBuildTimestamp = func(root []byte) string { return string(root) }
+	previous := dev.BuildTimestamp
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	target, err := updater.NewTarget(srv.URL+"/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.StreamTo("root", bytes.NewReader([]byte("2023-06-01"))); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string, active, next int, build string) {
+		t.Helper()
+		if got := dev.ActiveRoot(); got != active {
+			t.Errorf("%s: ActiveRoot() = %d, want %d", when, got, active)
+		}
+		if got := dev.NextRoot(); got != next {
+			t.Errorf("%s: NextRoot() = %d, want %d", when, got, next)
+		}
+		if got := dev.BuildTimestamp; got != build {
+			t.Errorf("%s: BuildTimestamp = %q, want %q", when, got, build)
+		}
+	}
+	reboot := func() {
+		t.Helper()
+		if err := target.Reboot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without confirmation, the device falls back to the previous root
+	// partition on the reboot after the test boot.
+	if err := target.Testboot(); err != nil {
+		t.Fatal(err)
+	}
+	check("after testboot", 2, 3, previous)
+	reboot()
+	check("test boot", 3, 2, "2023-06-01")
+	reboot()
+	check("reboot after test boot", 2, 2, previous)
+
+	// Switching while running the test boot confirms it.
+	if err := target.Testboot(); err != nil {
+		t.Fatal(err)
+	}
+	reboot()
+	check("second test boot", 3, 2, "2023-06-01")
+	if err := target.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	check("after confirming", 3, 3, "2023-06-01")
+	reboot()
+	check("reboot after confirming", 3, 3, "2023-06-01")
+}
+
+func TestUnsupported(t *testing.T) {
+	dev := fakedevice.New("test")
+	dev.Unsupported = []string{"mbr"}
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	target, err := updater.NewTarget(srv.URL+"/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.StreamTo("mbr", bytes.NewReader([]byte("mbr"))); err != updater.ErrUpdateHandlerNotImplemented {
+		t.Errorf("StreamTo(mbr) = %v, want ErrUpdateHandlerNotImplemented", err)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	dev := fakedevice.New("test")
+	dev.Password = "secret"
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		password string
+		want     int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", srv.URL+"/update/features", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.password != "" {
+			req.SetBasicAuth("gokrazy", tt.password)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.StatusCode; got != tt.want {
+			t.Errorf("password %q: status = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestPoweroff(t *testing.T) {
+	dev := fakedevice.New("test")
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/poweroff", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !dev.PoweredOff() {
+		t.Errorf("PoweredOff() = false, want true")
+	}
+	resp, err = srv.Client().Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("status after poweroff = %d, want %d", got, want)
+	}
+}
+
+func TestDivert(t *testing.T) {
+	dev := fakedevice.New("test")
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	target, err := updater.NewTarget(srv.URL+"/", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Put("uploadtemp/gok-run/hello", bytes.NewReader([]byte("binary"))); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(dev.Upload("gok-run/hello")), "binary"; got != want {
+		t.Errorf("Upload() = %q, want %q", got, want)
+	}
+	if err := target.Divert("/user/hello", "gok-run/hello", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dev.Diversion("/user/hello"), "gok-run/hello"; got != want {
+		t.Errorf("Diversion() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,272 @@
+// Package exfat creates empty exFAT file systems, as specified in
+// https://learn.microsoft.com/en-us/windows/win32/fileio/exfat-specification
+package exfat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	sectorShift = 9
+	sectorSize  = 1 << sectorShift
+
+	// bootRegionSectors is the size of the main (and backup) boot region.
+	bootRegionSectors = 12
+
+	dirEntrySize = 32
+
+	entryTypeAllocationBitmap = 0x81
+	entryTypeUpcaseTable      = 0x82
+	entryTypeVolumeLabel      = 0x83
+	entryTypeNoVolumeLabel    = 0x03
+
+	// maxLabelLength is the maximum number of UTF-16 code units of a volume
+	// label.
+	maxLabelLength = 11
+)
+
+// clusterShift returns the cluster size (as sectors per cluster shift) which
+// Windows uses by default for volumes of size bytes.
+func clusterShift(size int64) uint8 {
+	switch {
+	case size <= 256*1024*1024:
+		return 12 - sectorShift // 4 KB
+	case size <= 32*1024*1024*1024:
+		return 15 - sectorShift // 32 KB
+	default:
+		return 17 - sectorShift // 128 KB
+	}
+}
+
+func checksum(sum uint32, b byte) uint32 {
+	if sum&1 != 0 {
+		return 0x80000000 + (sum >> 1) + uint32(b)
+	}
+	return (sum >> 1) + uint32(b)
+}
+
+// upcaseTable returns a compressed up-case table which maps the ASCII and
+// Latin-1 lower case letters to upper case and all other characters to
+// themselves.
+func upcaseTable() []byte {
+	var table []uint16
+	identity := func(from, to int) {
+		// a run of identity mappings is compressed to 0xFFFF, <count>
+		table = append(table, 0xFFFF, uint16(to-from))
+	}
+	identity(0, 'a')
+	for c := 'a'; c <= 'z'; c++ {
+		table = append(table, uint16(c-'a'+'A'))
+	}
+	identity('z'+1, 0xE0)
+	for c := 0xE0; c <= 0xFE; c++ {
+		if c == 0xF7 { // division sign
+			table = append(table, uint16(c))
+			continue
+		}
+		table = append(table, uint16(c-0x20))
+	}
+	table = append(table, 0x178) // ÿ → Ÿ
+	identity(0x100, 0x10000)
+	b := make([]byte, 2*len(table))
+	for i, c := range table {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+type bootSector struct {
+	JumpBoot                    [3]byte
+	FileSystemName              [8]byte
+	MustBeZero                  [53]byte
+	PartitionOffset             uint64
+	VolumeLength                uint64
+	FATOffset                   uint32
+	FATLength                   uint32
+	ClusterHeapOffset           uint32
+	ClusterCount                uint32
+	FirstClusterOfRootDirectory uint32
+	VolumeSerialNumber          uint32
+	FileSystemRevision          uint16
+	VolumeFlags                 uint16
+	BytesPerSectorShift         uint8
+	SectorsPerClusterShift      uint8
+	NumberOfFATs                uint8
+	DriveSelect                 uint8
+	PercentInUse                uint8
+	Reserved                    [7]byte
+	BootCode                    [390]byte
+	BootSignature               uint16
+}
+
+// Format writes an empty exFAT file system with the specified volume label
+// (at most 11 characters) and serial number of size bytes to w, starting at
+// offset. Only the file system metadata is written; the cluster heap is left
+// as-is.
+func Format(w io.WriterAt, offset, size int64, label string, serial uint32) error {
+	if offset%sectorSize != 0 {
+		return fmt.Errorf("offset %d is not a multiple of the sector size (%d)", offset, sectorSize)
+	}
+	if size < 1024*1024 {
+		return fmt.Errorf("exFAT file systems must be at least 1 MB, got %d bytes", size)
+	}
+	labelUTF16 := utf16.Encode([]rune(label))
+	if len(labelUTF16) > maxLabelLength {
+		return fmt.Errorf("exFAT volume label %q too long: at most %d characters", label, maxLabelLength)
+	}
+
+	spcShift := clusterShift(size)
+	spc := uint32(1) << spcShift // sectors per cluster
+	clusterSize := int64(spc) * sectorSize
+	volumeLength := uint64(size / sectorSize)
+
+	// The FAT is aligned to 1 MB (or the cluster size, if larger), the
+	// cluster heap to the cluster size.
+	fatOffset := uint32(1024 * 1024 / sectorSize)
+	if spc > fatOffset {
+		fatOffset = spc
+	}
+	maxClusters := uint32(volumeLength/uint64(spc)) + 2
+	fatLength := (maxClusters*4 + sectorSize - 1) / sectorSize
+	heapOffset := fatOffset + fatLength
+	if rem := heapOffset % spc; rem != 0 {
+		heapOffset += spc - rem
+	}
+	if uint64(heapOffset) >= volumeLength {
+		return fmt.Errorf("exFAT file system of %d bytes is too small", size)
+	}
+	clusterCount := uint32((volumeLength - uint64(heapOffset)) / uint64(spc))
+
+	clustersFor := func(n int64) uint32 {
+		return uint32((n + clusterSize - 1) / clusterSize)
+	}
+	upcase := upcaseTable()
+	bitmapLength := int64(clusterCount+7) / 8
+
+	// Cluster numbering starts at 2.
+	bitmapCluster := uint32(2)
+	upcaseCluster := bitmapCluster + clustersFor(bitmapLength)
+	rootCluster := upcaseCluster + clustersFor(int64(len(upcase)))
+	usedClusters := rootCluster + 1 - 2
+	if usedClusters > clusterCount {
+		return fmt.Errorf("exFAT file system of %d bytes is too small", size)
+	}
+
+	// Boot region: boot sector, 8 extended boot sectors, OEM parameters,
+	// reserved sector and boot checksum sector.
+	bs := bootSector{
+		JumpBoot:                    [3]byte{0xEB, 0x76, 0x90},
+		FileSystemName:              [8]byte{'E', 'X', 'F', 'A', 'T', ' ', ' ', ' '},
+		PartitionOffset:             uint64(offset / sectorSize),
+		VolumeLength:                volumeLength,
+		FATOffset:                   fatOffset,
+		FATLength:                   fatLength,
+		ClusterHeapOffset:           heapOffset,
+		ClusterCount:                clusterCount,
+		FirstClusterOfRootDirectory: rootCluster,
+		VolumeSerialNumber:          serial,
+		FileSystemRevision:          0x0100,
+		BytesPerSectorShift:         sectorShift,
+		SectorsPerClusterShift:      spcShift,
+		NumberOfFATs:                1,
+		DriveSelect:                 0x80,
+		PercentInUse:                uint8(uint64(usedClusters) * 100 / uint64(clusterCount)),
+		BootSignature:               0xAA55,
+	}
+	var boot bytes.Buffer
+	if err := binary.Write(&boot, binary.LittleEndian, bs); err != nil {
+		return err
+	}
+	for i := 0; i < 8; i++ {
+		ext := make([]byte, sectorSize)
+		binary.LittleEndian.PutUint32(ext[sectorSize-4:], 0xAA550000)
+		boot.Write(ext)
+	}
+	boot.Write(make([]byte, 2*sectorSize)) // OEM parameters, reserved
+	var sum uint32
+	for i, b := range boot.Bytes() {
+		if i == 106 || i == 107 || i == 112 {
+			continue // VolumeFlags and PercentInUse
+		}
+		sum = checksum(sum, b)
+	}
+	for i := 0; i < sectorSize/4; i++ {
+		binary.Write(&boot, binary.LittleEndian, sum)
+	}
+	if _, err := w.WriteAt(boot.Bytes(), offset); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(boot.Bytes(), offset+bootRegionSectors*sectorSize); err != nil {
+		return err
+	}
+
+	// FAT: media descriptor, reserved entry and the cluster chains of the
+	// allocation bitmap, up-case table and root directory.
+	fat := make([]byte, int64(fatLength)*sectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], 0xFFFFFFF8)
+	binary.LittleEndian.PutUint32(fat[4:], 0xFFFFFFFF)
+	chain := func(first, last uint32) {
+		for c := first; c < last; c++ {
+			binary.LittleEndian.PutUint32(fat[4*c:], c+1)
+		}
+		binary.LittleEndian.PutUint32(fat[4*last:], 0xFFFFFFFF)
+	}
+	chain(bitmapCluster, upcaseCluster-1)
+	chain(upcaseCluster, rootCluster-1)
+	chain(rootCluster, rootCluster)
+	if _, err := w.WriteAt(fat, offset+int64(fatOffset)*sectorSize); err != nil {
+		return err
+	}
+
+	clusterOffset := func(cluster uint32) int64 {
+		return offset + (int64(heapOffset)+int64(cluster-2)*int64(spc))*sectorSize
+	}
+
+	bitmap := make([]byte, int64(clustersFor(bitmapLength))*clusterSize)
+	for c := uint32(0); c < usedClusters; c++ {
+		bitmap[c/8] |= 1 << (c % 8)
+	}
+	if _, err := w.WriteAt(bitmap, clusterOffset(bitmapCluster)); err != nil {
+		return err
+	}
+
+	if _, err := w.WriteAt(upcase, clusterOffset(upcaseCluster)); err != nil {
+		return err
+	}
+
+	root := make([]byte, clusterSize)
+	// volume label
+	label0 := root[0*dirEntrySize:]
+	label0[0] = entryTypeVolumeLabel
+	if label == "" {
+		label0[0] = entryTypeNoVolumeLabel
+	}
+	label0[1] = byte(len(labelUTF16))
+	for i, c := range labelUTF16 {
+		binary.LittleEndian.PutUint16(label0[2+2*i:], c)
+	}
+	// allocation bitmap
+	bitmap0 := root[1*dirEntrySize:]
+	bitmap0[0] = entryTypeAllocationBitmap
+	binary.LittleEndian.PutUint32(bitmap0[20:], bitmapCluster)
+	binary.LittleEndian.PutUint64(bitmap0[24:], uint64(bitmapLength))
+	// up-case table
+	var upcaseSum uint32
+	for _, b := range upcase {
+		upcaseSum = checksum(upcaseSum, b)
+	}
+	upcase0 := root[2*dirEntrySize:]
+	upcase0[0] = entryTypeUpcaseTable
+	binary.LittleEndian.PutUint32(upcase0[4:], upcaseSum)
+	binary.LittleEndian.PutUint32(upcase0[20:], upcaseCluster)
+	binary.LittleEndian.PutUint64(upcase0[24:], uint64(len(upcase)))
+	if _, err := w.WriteAt(root, clusterOffset(rootCluster)); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	const (
+		offset = 1024 * 1024
+		size   = 300 * 1024 * 1024
+	)
+	fn := filepath.Join(t.TempDir(), "exfat.img")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(offset + size); err != nil {
+		t.Fatal(err)
+	}
+	if err := Format(f, offset, size, "GOKRAZY", 0x12345678); err != nil {
+		t.Fatal(err)
+	}
+
+	boot := make([]byte, 12*sectorSize)
+	if _, err := f.ReadAt(boot, offset); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(boot[3:11]), "EXFAT   "; got != want {
+		t.Errorf("file system name = %q, want %q", got, want)
+	}
+	var sum uint32
+	for i, b := range boot[:11*sectorSize] {
+		if i == 106 || i == 107 || i == 112 {
+			continue
+		}
+		sum = checksum(sum, b)
+	}
+	if got := binary.LittleEndian.Uint32(boot[11*sectorSize:]); got != sum {
+		t.Errorf("boot checksum = %#x, want %#x", got, sum)
+	}
+	backup := make([]byte, len(boot))
+	if _, err := f.ReadAt(backup, offset+12*sectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != string(boot) {
+		t.Errorf("backup boot region differs from main boot region")
+	}
+
+	if err := Format(f, offset, size, "TOO LONG A LABEL", 0); err == nil {
+		t.Errorf("Format with a too long label succeeded unexpectedly")
+	}
+}
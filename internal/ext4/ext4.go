@@ -0,0 +1,884 @@
+// Package ext4 creates read-only ext4 file systems from a tree of files, for
+// root file systems which preserve file modes, and formats empty ext4 file
+// systems, e.g. for the perm partition. See
+// https://www.kernel.org/doc/html/latest/filesystems/ext4/index.html
+//
+// The file systems use the ext2 layout with 4 KB blocks and extents, but no
+// directory index and no metadata checksums. Write creates file systems
+// without a journal: they are written once and mounted read-only. Format
+// creates file systems with a journal (see Format).
+package ext4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	blockSize      = 4096
+	logBlockSize   = 2 // blockSize = 1024 << logBlockSize
+	blocksPerGroup = 8 * blockSize
+	inodeSize      = 256
+	inodesPerBlock = blockSize / inodeSize
+	groupDescSize  = 32
+
+	// firstIno is the first inode which is not reserved. It is used for
+	// lost+found, like mke2fs does.
+	firstIno = 11
+	rootIno  = 2
+
+	superblockMagic = 0xEF53
+	extentMagic     = 0xF30A
+
+	// maxExtentLen is the maximum number of blocks of an initialized extent.
+	maxExtentLen = 32768
+	// inodeExtents is the number of extents which fit into the inode.
+	inodeExtents = 4
+
+	featureIncompatFiletype  = 0x2
+	featureIncompatExtents   = 0x40
+	featureROCompatSparseSup = 0x1
+	featureROCompatLargeFile = 0x2
+	featureROCompatGDTCsum   = 0x10
+	featureCompatHasJournal  = 0x4
+
+	bgInodeUninit  = 0x1
+	bgItableZeroed = 0x4
+
+	inodeFlagExtents = 0x80000
+	extraInodeSize   = 32 // bytes used beyond the 128 byte ext2 inode
+
+	// fastSymlinkMax is the length limit of symlink targets stored in the
+	// inode instead of a data block.
+	fastSymlinkMax = 60
+
+	modeTypeRegular = 0x8000
+	modeTypeDir     = 0x4000
+	modeTypeSymlink = 0xA000
+
+	// directory entry file types
+	ftypeReg = 1
+	ftypeDir = 2
+	ftypeLnk = 7
+)
+
+// File is a regular file, directory or symlink of the file system.
+type File struct {
+	Name    string
+	Mode    os.FileMode // permission bits, setuid, setgid and sticky
+	ModTime time.Time   // defaults to the mkfsTime passed to Write
+
+	// Open returns the contents of a regular file, which needs to be Size
+	// bytes long.
+	Open func() (io.ReadCloser, error)
+	Size int64
+
+	// Target is the destination of a symlink.
+	Target string
+
+	// Dir marks a directory, containing Entries.
+	Dir     bool
+	Entries []*File
+}
+
+type extent struct {
+	logical uint32
+	start   uint32
+	length  uint32
+}
+
+// node is a File with its inode number and location on disk.
+type node struct {
+	f      *File
+	ino    uint32
+	parent *node
+	links  uint16
+
+	// data is the content of directories and of symlinks which do not fit
+	// into the inode.
+	data []byte
+
+	mtime   time.Time
+	size    int64
+	extents []extent
+	leaf    uint32 // block holding the extents if there are more than inodeExtents
+}
+
+func (n *node) isDir() bool { return n.f.Dir }
+
+func (n *node) isFastSymlink() bool {
+	return !n.f.Dir && n.f.Open == nil && len(n.f.Target) < fastSymlinkMax
+}
+
+func (n *node) fileType() byte {
+	switch {
+	case n.f.Dir:
+		return ftypeDir
+	case n.f.Open != nil:
+		return ftypeReg
+	default:
+		return ftypeLnk
+	}
+}
+
+func (n *node) mode() uint16 {
+	m := uint16(n.f.Mode.Perm())
+	if n.f.Mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if n.f.Mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if n.f.Mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	switch n.fileType() {
+	case ftypeDir:
+		return m | modeTypeDir
+	case ftypeReg:
+		return m | modeTypeRegular
+	default:
+		return 0o777 | modeTypeSymlink
+	}
+}
+
+// blocks returns the number of blocks used by n, including the extent leaf.
+func (n *node) blocks() uint32 {
+	var blocks uint32
+	for _, e := range n.extents {
+		blocks += e.length
+	}
+	if n.leaf != 0 {
+		blocks++
+	}
+	return blocks
+}
+
+// fs is the layout of the file system being written.
+type fs struct {
+	nodes   []*node // by inode number, starting at firstIno
+	root    *node
+	journal *node // only for Format
+	label   string
+	// lazyItables leaves the inode tables of all groups but the first
+	// uninitialized (uninit_bg), see Format.
+	lazyItables  bool
+	groups       uint32
+	inodesPerGrp uint32
+	gdtBlocks    uint32
+	itableBlocks uint32
+	blocksCount  uint32
+	mkfsTime     time.Time
+	blockBitmaps [][]byte
+	inodeBitmaps [][]byte
+	freeBlocks   []uint32
+	usedDirs     []uint32
+}
+
+// allNodes returns the nodes of all inodes in use.
+func (fs *fs) allNodes() []*node {
+	all := []*node{fs.root}
+	if fs.journal != nil {
+		all = append(all, fs.journal)
+	}
+	return append(all, fs.nodes...)
+}
+
+// hasSuper returns whether group g contains a copy of the superblock and the
+// group descriptors (sparse_super: groups 0, 1 and powers of 3, 5 and 7).
+func hasSuper(g uint32) bool {
+	if g <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// metaBlocks returns the number of metadata blocks at the start of group g:
+// superblock and group descriptors (if any), bitmaps and inode table.
+func (fs *fs) metaBlocks(g uint32) uint32 {
+	n := 2 + fs.itableBlocks
+	if hasSuper(g) {
+		n += 1 + fs.gdtBlocks
+	}
+	return n
+}
+
+func (fs *fs) groupStart(g uint32) uint32 { return g * blocksPerGroup }
+
+// addTree assigns inode numbers to the tree in breadth-first order.
+func (fs *fs) addTree(root *File) error {
+	fs.root = &node{f: root, ino: rootIno}
+	lostFound := &node{
+		f:   &File{Name: "lost+found", Mode: 0700, ModTime: root.ModTime, Dir: true},
+		ino: firstIno,
+	}
+	fs.nodes = append(fs.nodes, lostFound)
+	children := map[*node][]*node{fs.root: {lostFound}}
+	lostFound.parent = fs.root
+	queue := []*node{fs.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		entries := append([]*File(nil), dir.f.Entries...)
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		for i, f := range entries {
+			if f.Name == "" || f.Name == "." || f.Name == ".." || strings.Contains(f.Name, "/") || len(f.Name) > 255 {
+				return fmt.Errorf("invalid file name %q", f.Name)
+			}
+			if (i > 0 && entries[i-1].Name == f.Name) || (dir == fs.root && f.Name == "lost+found") {
+				return fmt.Errorf("%q: duplicate file name", f.Name)
+			}
+			if f.Dir && (f.Open != nil || f.Target != "") || !f.Dir && (f.Open == nil) == (f.Target == "") {
+				return fmt.Errorf("%q: needs to be either a directory, a regular file or a symlink", f.Name)
+			}
+			n := &node{f: f, ino: firstIno + uint32(len(fs.nodes)), parent: dir}
+			fs.nodes = append(fs.nodes, n)
+			children[dir] = append(children[dir], n)
+			if f.Dir {
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	for _, n := range append([]*node{fs.root}, fs.nodes...) {
+		n.mtime = n.f.ModTime
+		if n.mtime.IsZero() {
+			n.mtime = fs.mkfsTime
+		}
+		switch {
+		case n.isDir():
+			n.links = 2
+			for _, c := range children[n] {
+				if c.isDir() {
+					n.links++
+				}
+			}
+			n.data = dirBlocks(n, children[n])
+			n.size = int64(len(n.data))
+		case n.f.Open != nil:
+			n.links = 1
+			n.size = n.f.Size
+		default:
+			n.links = 1
+			n.size = int64(len(n.f.Target))
+			if !n.isFastSymlink() {
+				n.data = []byte(n.f.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// dirBlocks returns the directory blocks of dir, containing the linear
+// directory entries for ., .. and the children.
+func dirBlocks(dir *node, children []*node) []byte {
+	type dirent struct {
+		ino   uint32
+		name  string
+		ftype byte
+	}
+	parent := dir.parent
+	if parent == nil {
+		parent = dir // the root directory is its own parent
+	}
+	ents := []dirent{
+		{dir.ino, ".", ftypeDir},
+		{parent.ino, "..", ftypeDir},
+	}
+	for _, c := range children {
+		ents = append(ents, dirent{c.ino, c.f.Name, c.fileType()})
+	}
+	var (
+		buf   bytes.Buffer
+		block []byte
+		last  int // offset of the last entry in block
+	)
+	flush := func() {
+		// The last entry of a block spans the rest of the block.
+		binary.LittleEndian.PutUint16(block[last+4:], uint16(blockSize-last))
+		block = append(block, make([]byte, blockSize-len(block))...)
+		buf.Write(block)
+		block = nil
+	}
+	for _, e := range ents {
+		recLen := (8 + len(e.name) + 3) &^ 3
+		if len(block)+recLen > blockSize {
+			flush()
+		}
+		last = len(block)
+		ent := make([]byte, recLen)
+		binary.LittleEndian.PutUint32(ent[0:], e.ino)
+		binary.LittleEndian.PutUint16(ent[4:], uint16(recLen))
+		ent[6] = byte(len(e.name))
+		ent[7] = e.ftype
+		copy(ent[8:], e.name)
+		block = append(block, ent...)
+	}
+	flush()
+	return buf.Bytes()
+}
+
+// allocator hands out data blocks in ascending order, skipping the metadata
+// at the start of each group.
+type allocator struct {
+	fs   *fs
+	next uint32
+}
+
+// alloc returns extents covering count blocks, or false if the groups are
+// full.
+func (a *allocator) alloc(count uint32) ([]extent, bool) {
+	var extents []extent
+	var logical uint32
+	for count > 0 {
+		g := a.next / blocksPerGroup
+		if g >= a.fs.groups {
+			return nil, false
+		}
+		if meta := a.fs.groupStart(g) + a.fs.metaBlocks(g); a.next < meta {
+			a.next = meta
+		}
+		end := a.fs.groupStart(g + 1)
+		n := end - a.next
+		if n > count {
+			n = count
+		}
+		if n > maxExtentLen {
+			n = maxExtentLen
+		}
+		if n == 0 {
+			a.next = end
+			continue
+		}
+		if l := len(extents); l > 0 && extents[l-1].start+extents[l-1].length == a.next && extents[l-1].length+n <= maxExtentLen {
+			extents[l-1].length += n
+		} else {
+			extents = append(extents, extent{logical: logical, start: a.next, length: n})
+		}
+		logical += n
+		a.next += n
+		count -= n
+	}
+	return extents, true
+}
+
+// layout determines the number of groups and allocates the data blocks.
+func (fs *fs) layout() error {
+	totalInodes := uint32(firstIno - 1 + len(fs.nodes))
+	var dataBlocks uint64
+	for _, n := range fs.allNodes() {
+		dataBlocks += uint64((n.size + blockSize - 1) / blockSize)
+	}
+	fs.groups = uint32(dataBlocks/blocksPerGroup) + 1
+	for ; ; fs.groups++ {
+		if uint64(fs.groups)*blocksPerGroup > 1<<32 {
+			return fmt.Errorf("file system too large (%d data blocks)", dataBlocks)
+		}
+		fs.inodesPerGrp = (totalInodes + fs.groups - 1) / fs.groups
+		fs.inodesPerGrp = (fs.inodesPerGrp + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+		fs.itableBlocks = fs.inodesPerGrp / inodesPerBlock
+		fs.gdtBlocks = (fs.groups*groupDescSize + blockSize - 1) / blockSize
+		if fs.metaBlocks(0) >= blocksPerGroup {
+			continue
+		}
+		if fs.allocate() {
+			break
+		}
+	}
+	return nil
+}
+
+// allocate allocates the data blocks of all nodes, returning false if they do
+// not fit into fs.groups.
+func (fs *fs) allocate() bool {
+	a := &allocator{fs: fs}
+	for _, n := range fs.allNodes() {
+		n.extents, n.leaf = nil, 0
+		if n.isFastSymlink() || n.size == 0 {
+			continue
+		}
+		var ok bool
+		n.extents, ok = a.alloc(uint32((n.size + blockSize - 1) / blockSize))
+		if !ok {
+			return false
+		}
+		if len(n.extents) > inodeExtents {
+			if len(n.extents) > (blockSize-12)/12 {
+				return false
+			}
+			leaf, ok := a.alloc(1)
+			if !ok {
+				return false
+			}
+			n.leaf = leaf[0].start
+		}
+	}
+	fs.blocksCount = a.next
+	lastGroup := fs.groups - 1
+	if min := fs.groupStart(lastGroup) + fs.metaBlocks(lastGroup); fs.blocksCount < min {
+		if lastGroup > 0 && a.next <= fs.groupStart(lastGroup) {
+			return false // the data fits into fewer groups
+		}
+		fs.blocksCount = min
+	}
+	return true
+}
+
+func setBits(bitmap []byte, from, to uint32) {
+	for i := from; i < to; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+}
+
+// computeBitmaps fills the bitmaps and counters of the groups.
+func (fs *fs) computeBitmaps() {
+	fs.blockBitmaps = make([][]byte, fs.groups)
+	fs.inodeBitmaps = make([][]byte, fs.groups)
+	fs.freeBlocks = make([]uint32, fs.groups)
+	fs.usedDirs = make([]uint32, fs.groups)
+	for g := uint32(0); g < fs.groups; g++ {
+		bb := make([]byte, blockSize)
+		setBits(bb, 0, fs.metaBlocks(g))
+		if end := fs.blocksCount - fs.groupStart(g); end < blocksPerGroup {
+			// blocks beyond the end of the file system are marked as used
+			setBits(bb, end, blocksPerGroup)
+		}
+		fs.blockBitmaps[g] = bb
+
+		ib := make([]byte, blockSize)
+		setBits(ib, fs.inodesPerGrp, 8*blockSize)
+		fs.inodeBitmaps[g] = ib
+	}
+	// reserved inodes
+	setBits(fs.inodeBitmaps[0], 0, firstIno-1)
+	for _, n := range fs.allNodes() {
+		for _, e := range n.extents {
+			for b := e.start; b < e.start+e.length; b++ {
+				setBits(fs.blockBitmaps[b/blocksPerGroup], b%blocksPerGroup, b%blocksPerGroup+1)
+			}
+		}
+		if n.leaf != 0 {
+			setBits(fs.blockBitmaps[n.leaf/blocksPerGroup], n.leaf%blocksPerGroup, n.leaf%blocksPerGroup+1)
+		}
+		idx := n.ino - 1
+		g := idx / fs.inodesPerGrp
+		setBits(fs.inodeBitmaps[g], idx%fs.inodesPerGrp, idx%fs.inodesPerGrp+1)
+		if n.isDir() {
+			fs.usedDirs[g]++
+		}
+	}
+	for g, bb := range fs.blockBitmaps {
+		var used uint32
+		for _, b := range bb {
+			for ; b != 0; b &= b - 1 {
+				used++
+			}
+		}
+		fs.freeBlocks[g] = blocksPerGroup - used
+	}
+}
+
+func (fs *fs) freeInodes(g uint32) uint32 {
+	var used uint32
+	for _, b := range fs.inodeBitmaps[g][:fs.inodesPerGrp/8] {
+		for ; b != 0; b &= b - 1 {
+			used++
+		}
+	}
+	return fs.inodesPerGrp - used
+}
+
+func (fs *fs) uuid() [16]byte {
+	sum := sha256.Sum256([]byte(fs.mkfsTime.UTC().Format(time.RFC3339Nano)))
+	var uuid [16]byte
+	copy(uuid[:], sum[:])
+	uuid[6] = uuid[6]&0x0f | 0x40 // version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // RFC 4122 variant
+	return uuid
+}
+
+type superblock struct {
+	InodesCount       uint32
+	BlocksCount       uint32
+	RBlocksCount      uint32
+	FreeBlocksCount   uint32
+	FreeInodesCount   uint32
+	FirstDataBlock    uint32
+	LogBlockSize      uint32
+	LogClusterSize    uint32
+	BlocksPerGroup    uint32
+	ClustersPerGroup  uint32
+	InodesPerGroup    uint32
+	Mtime             uint32
+	Wtime             uint32
+	MntCount          uint16
+	MaxMntCount       uint16
+	Magic             uint16
+	State             uint16
+	Errors            uint16
+	MinorRevLevel     uint16
+	Lastcheck         uint32
+	Checkinterval     uint32
+	CreatorOS         uint32
+	RevLevel          uint32
+	DefResuid         uint16
+	DefResgid         uint16
+	FirstIno          uint32
+	InodeSize         uint16
+	BlockGroupNr      uint16
+	FeatureCompat     uint32
+	FeatureIncompat   uint32
+	FeatureROCompat   uint32
+	UUID              [16]byte
+	VolumeName        [16]byte
+	LastMounted       [64]byte
+	AlgorithmBitmap   uint32
+	PreallocBlocks    uint8
+	PreallocDirBlocks uint8
+	ReservedGDTBlocks uint16
+	JournalUUID       [16]byte
+	JournalInum       uint32
+	JournalDev        uint32
+	LastOrphan        uint32
+	HashSeed          [4]uint32
+	DefHashVersion    uint8
+	JnlBackupType     uint8
+	DescSize          uint16
+	DefaultMountOpts  uint32
+	FirstMetaBg       uint32
+	MkfsTime          uint32
+	JnlBlocks         [17]uint32
+	BlocksCountHi     uint32
+	RBlocksCountHi    uint32
+	FreeBlocksHi      uint32
+	MinExtraIsize     uint16
+	WantExtraIsize    uint16
+}
+
+func (fs *fs) superblock(group uint32) []byte {
+	var freeBlocks, freeInodes uint32
+	for g := uint32(0); g < fs.groups; g++ {
+		freeBlocks += fs.freeBlocks[g]
+		freeInodes += fs.freeInodes(g)
+	}
+	t := uint32(fs.mkfsTime.Unix())
+	sb := superblock{
+		InodesCount:      fs.inodesPerGrp * fs.groups,
+		BlocksCount:      fs.blocksCount,
+		FreeBlocksCount:  freeBlocks,
+		FreeInodesCount:  freeInodes,
+		LogBlockSize:     logBlockSize,
+		LogClusterSize:   logBlockSize,
+		BlocksPerGroup:   blocksPerGroup,
+		ClustersPerGroup: blocksPerGroup,
+		InodesPerGroup:   fs.inodesPerGrp,
+		Wtime:            t,
+		MaxMntCount:      0xFFFF,
+		Magic:            superblockMagic,
+		State:            1, // cleanly unmounted
+		Errors:           1, // continue
+		Lastcheck:        t,
+		RevLevel:         1, // dynamic inode sizes
+		FirstIno:         firstIno,
+		InodeSize:        inodeSize,
+		BlockGroupNr:     uint16(group),
+		FeatureIncompat:  featureIncompatFiletype | featureIncompatExtents,
+		FeatureROCompat:  featureROCompatSparseSup | featureROCompatLargeFile,
+		UUID:             fs.uuid(),
+		MkfsTime:         t,
+		MinExtraIsize:    extraInodeSize,
+		WantExtraIsize:   extraInodeSize,
+	}
+	copy(sb.VolumeName[:], fs.label)
+	if fs.lazyItables {
+		sb.FeatureROCompat |= featureROCompatGDTCsum
+	}
+	if j := fs.journal; j != nil {
+		sb.FeatureCompat |= featureCompatHasJournal
+		sb.JournalInum = j.ino
+		sb.JnlBackupType = 1 // s_jnl_blocks contains a copy of the i_block array and i_size
+		iblock, _ := j.extentTree()
+		for i := 0; i < 15; i++ {
+			sb.JnlBlocks[i] = binary.LittleEndian.Uint32(iblock[4*i:])
+		}
+		sb.JnlBlocks[15] = uint32(j.size >> 32)
+		sb.JnlBlocks[16] = uint32(j.size)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &sb)
+	return append(buf.Bytes(), make([]byte, 1024-buf.Len())...)
+}
+
+type groupDesc struct {
+	BlockBitmap     uint32
+	InodeBitmap     uint32
+	InodeTable      uint32
+	FreeBlocksCount uint16
+	FreeInodesCount uint16
+	UsedDirsCount   uint16
+	Flags           uint16
+	ExcludeBitmap   uint32
+	BlockBitmapCsum uint16
+	InodeBitmapCsum uint16
+	ItableUnused    uint16
+	Checksum        uint16
+}
+
+func (fs *fs) groupDescs() []byte {
+	var buf bytes.Buffer
+	for g := uint32(0); g < fs.groups; g++ {
+		bitmaps := fs.groupStart(g) + fs.metaBlocks(g) - fs.itableBlocks - 2
+		desc := groupDesc{
+			BlockBitmap:     bitmaps,
+			InodeBitmap:     bitmaps + 1,
+			InodeTable:      bitmaps + 2,
+			FreeBlocksCount: uint16(fs.freeBlocks[g]),
+			FreeInodesCount: uint16(fs.freeInodes(g)),
+			UsedDirsCount:   uint16(fs.usedDirs[g]),
+		}
+		if fs.lazyItables {
+			fs.uninitItable(g, &desc)
+		}
+		binary.Write(&buf, binary.LittleEndian, &desc)
+	}
+	return append(buf.Bytes(), make([]byte, int(fs.gdtBlocks)*blockSize-buf.Len())...)
+}
+
+// extentTree returns the i_block contents of n (and the contents of its leaf
+// block, if any).
+func (n *node) extentTree() (iblock [60]byte, leaf []byte) {
+	putHeader := func(b []byte, entries, max, depth uint16) {
+		binary.LittleEndian.PutUint16(b[0:], extentMagic)
+		binary.LittleEndian.PutUint16(b[2:], entries)
+		binary.LittleEndian.PutUint16(b[4:], max)
+		binary.LittleEndian.PutUint16(b[6:], depth)
+	}
+	putExtents := func(b []byte) {
+		for i, e := range n.extents {
+			ent := b[12+12*i:]
+			binary.LittleEndian.PutUint32(ent[0:], e.logical)
+			binary.LittleEndian.PutUint16(ent[4:], uint16(e.length))
+			binary.LittleEndian.PutUint32(ent[8:], e.start)
+		}
+	}
+	if n.leaf == 0 {
+		putHeader(iblock[:], uint16(len(n.extents)), inodeExtents, 0)
+		putExtents(iblock[:])
+		return iblock, nil
+	}
+	putHeader(iblock[:], 1, inodeExtents, 1)
+	binary.LittleEndian.PutUint32(iblock[16:], n.leaf)
+	leaf = make([]byte, blockSize)
+	putHeader(leaf, uint16(len(n.extents)), (blockSize-12)/12, 0)
+	putExtents(leaf)
+	return iblock, leaf
+}
+
+func (n *node) inode() []byte {
+	b := make([]byte, inodeSize)
+	t := uint32(n.mtime.Unix())
+	binary.LittleEndian.PutUint16(b[0:], n.mode())
+	binary.LittleEndian.PutUint32(b[4:], uint32(n.size))
+	binary.LittleEndian.PutUint32(b[8:], t)  // atime
+	binary.LittleEndian.PutUint32(b[12:], t) // ctime
+	binary.LittleEndian.PutUint32(b[16:], t) // mtime
+	binary.LittleEndian.PutUint16(b[26:], n.links)
+	binary.LittleEndian.PutUint32(b[28:], n.blocks()*blockSize/512)
+	if n.isFastSymlink() {
+		copy(b[40:100], n.f.Target)
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], inodeFlagExtents)
+		iblock, _ := n.extentTree()
+		copy(b[40:100], iblock[:])
+	}
+	binary.LittleEndian.PutUint32(b[108:], uint32(n.size>>32))
+	binary.LittleEndian.PutUint16(b[128:], extraInodeSize)
+	return b
+}
+
+// inodeTable returns the inode table of group g.
+func (fs *fs) inodeTable(g uint32) []byte {
+	table := make([]byte, fs.itableBlocks*blockSize)
+	first := g*fs.inodesPerGrp + 1
+	for _, n := range fs.allNodes() {
+		if n.ino < first || n.ino >= first+fs.inodesPerGrp {
+			continue
+		}
+		copy(table[(n.ino-first)*inodeSize:], n.inode())
+	}
+	return table
+}
+
+// chunk is a run of blocks which write writes in ascending block order.
+type chunk struct {
+	start, length uint32
+	write         func(w io.Writer) error
+}
+
+// dataWriter writes the extents of a node, which may be interrupted by the
+// metadata of the next group.
+type dataWriter struct {
+	n  *node
+	r  io.Reader
+	rc io.ReadCloser
+}
+
+func (d *dataWriter) writeExtent(w io.Writer, e extent, last bool) error {
+	if d.r == nil {
+		if d.n.f.Open != nil {
+			rc, err := d.n.f.Open()
+			if err != nil {
+				return err
+			}
+			d.rc = rc
+			d.r = rc
+		} else {
+			d.r = bytes.NewReader(d.n.data)
+		}
+	}
+	size := int64(e.length) * blockSize
+	remaining := d.n.size - int64(e.logical)*blockSize
+	if remaining < size {
+		size = remaining
+	}
+	if n, err := io.CopyN(w, d.r, size); err != nil {
+		return fmt.Errorf("%s: %v (expected %d bytes, got %d)", d.n.f.Name, err, d.n.size, int64(e.logical)*blockSize+n)
+	}
+	if pad := int64(e.length)*blockSize - size; pad > 0 {
+		if _, err := w.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+	if !last {
+		return nil
+	}
+	if d.rc == nil {
+		return nil
+	}
+	defer d.rc.Close()
+	if n, _ := io.CopyN(io.Discard, d.rc, 1); n > 0 {
+		return fmt.Errorf("%s: file is larger than %d bytes (modified while packing?)", d.n.f.Name, d.n.size)
+	}
+	return d.rc.Close()
+}
+
+// chunks returns all blocks of the file system in ascending order.
+func (fs *fs) chunks() []chunk {
+	var chunks []chunk
+	for g := uint32(0); g < fs.groups; g++ {
+		g := g // for the closures
+		start := fs.groupStart(g)
+		if hasSuper(g) {
+			chunks = append(chunks, chunk{start, 1 + fs.gdtBlocks, func(w io.Writer) error {
+				block := make([]byte, blockSize)
+				off := 0
+				if g == 0 {
+					off = 1024 // the first 1024 bytes are reserved for boot code
+				}
+				copy(block[off:], fs.superblock(g))
+				if _, err := w.Write(block); err != nil {
+					return err
+				}
+				_, err := w.Write(fs.groupDescs())
+				return err
+			}})
+			start += 1 + fs.gdtBlocks
+		}
+		chunks = append(chunks, chunk{start, 2, func(w io.Writer) error {
+			for _, b := range [][]byte{fs.blockBitmaps[g], fs.inodeBitmaps[g]} {
+				if _, err := w.Write(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+		if g > 0 && fs.lazyItables {
+			continue
+		}
+		chunks = append(chunks, chunk{start + 2, fs.itableBlocks, func(w io.Writer) error {
+			_, err := w.Write(fs.inodeTable(g))
+			return err
+		}})
+	}
+	for _, n := range fs.allNodes() {
+		d := &dataWriter{n: n}
+		for i, e := range n.extents {
+			e, last := e, i == len(n.extents)-1
+			chunks = append(chunks, chunk{e.start, e.length, func(w io.Writer) error {
+				return d.writeExtent(w, e, last)
+			}})
+		}
+		if n.leaf != 0 {
+			_, leaf := n.extentTree()
+			chunks = append(chunks, chunk{n.leaf, 1, func(w io.Writer) error {
+				_, err := w.Write(leaf)
+				return err
+			}})
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].start < chunks[j].start })
+	return chunks
+}
+
+// Write writes an ext4 file system containing the tree of the directory root
+// sequentially to w and returns its size in bytes. All files are owned by
+// root. mkfsTime is used as the file system creation time and to derive the
+// file system UUID.
+func Write(w io.Writer, root *File, mkfsTime time.Time) (int64, error) {
+	if !root.Dir {
+		return 0, fmt.Errorf("root needs to be a directory")
+	}
+	fs := &fs{mkfsTime: mkfsTime}
+	if err := fs.addTree(root); err != nil {
+		return 0, err
+	}
+	if err := fs.layout(); err != nil {
+		return 0, err
+	}
+	fs.computeBitmaps()
+
+	var pos uint32
+	for _, c := range fs.chunks() {
+		if c.start < pos {
+			return 0, fmt.Errorf("BUG: overlapping blocks at %d", c.start)
+		}
+		if err := writeZeros(w, c.start-pos); err != nil {
+			return 0, err
+		}
+		if err := c.write(w); err != nil {
+			return 0, err
+		}
+		pos = c.start + c.length
+	}
+	if err := writeZeros(w, fs.blocksCount-pos); err != nil {
+		return 0, err
+	}
+	return int64(fs.blocksCount) * blockSize, nil
+}
+
+// writeZeros writes blocks zero blocks to w.
+func writeZeros(w io.Writer, blocks uint32) error {
+	zero := make([]byte, blockSize)
+	for i := uint32(0); i < blocks; i++ {
+		if _, err := w.Write(zero); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package ext4
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func literal(name, content string, mode os.FileMode) *File {
+	return &File{
+		Name: name,
+		Mode: mode,
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		},
+		Size: int64(len(content)),
+	}
+}
+
+func TestWrite(t *testing.T) {
+	for _, tool := range []string{"e2fsck", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found: %v", tool, err)
+		}
+	}
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var many []*File
+	for i := 0; i < 300; i++ {
+		many = append(many, literal(fmt.Sprintf("file-with-a-long-name-%03d", i), "x", 0644))
+	}
+	// big spans several groups.
+	const bigSize = 300 * 1024 * 1024
+	root := &File{
+		Mode:    0755,
+		ModTime: mtime,
+		Dir:     true,
+		Entries: []*File{
+			{Name: "etc", Mode: 0755, ModTime: mtime, Dir: true, Entries: []*File{
+				literal("hostname", "gokrazy\n", 0644),
+				{Name: "localtime", Target: "/usr/share/zoneinfo/Europe/Zurich"},
+				{Name: "resolv.conf", Target: "/tmp/" + strings.Repeat("long/", 20) + "resolv.conf"},
+			}},
+			{Name: "user", Mode: 0755, ModTime: mtime, Dir: true, Entries: []*File{
+				literal("suid", "#!/bin/sh\n", os.ModeSetuid|0755),
+				{
+					Name: "big",
+					Mode: 0755,
+					Open: func() (io.ReadCloser, error) {
+						return io.NopCloser(io.LimitReader(zeroReader{}, bigSize)), nil
+					},
+					Size: bigSize,
+				},
+			}},
+			{Name: "many", Mode: 0755, ModTime: mtime, Dir: true, Entries: many},
+			{Name: "empty", Mode: 0444, ModTime: mtime, Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("")), nil
+			}},
+		},
+	}
+
+	fn := filepath.Join(t.TempDir(), "root.ext4")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	size, err := Write(f, root, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != size {
+		t.Errorf("Write() = %d, but wrote %d bytes", size, st.Size())
+	}
+
+	out, err := exec.Command("e2fsck", "-fn", fn).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck: %v\n%s", err, out)
+	}
+
+	debugfs := func(request string) string {
+		t.Helper()
+		out, err := exec.Command("debugfs", "-R", request, fn).Output()
+		if err != nil {
+			t.Fatalf("debugfs -R %q: %v", request, err)
+		}
+		return string(out)
+	}
+	if got, want := debugfs("cat /etc/hostname"), "gokrazy\n"; got != want {
+		t.Errorf("/etc/hostname = %q, want %q", got, want)
+	}
+	if got := debugfs("stat /etc/localtime"); !strings.Contains(got, `Fast link dest: "/usr/share/zoneinfo/Europe/Zurich"`) {
+		t.Errorf("/etc/localtime is not the expected fast symlink:\n%s", got)
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/user/suid", "Mode:  04755"},
+		{"/user/big", fmt.Sprintf("Size: %d", bigSize)},
+		{"/many", "Links: 2"},
+		{"/", "Links: 6"}, // ., .., lost+found, etc, user, many
+	} {
+		if got := debugfs("stat " + tt.path); !strings.Contains(got, tt.want) {
+			t.Errorf("stat %s does not contain %q:\n%s", tt.path, tt.want, got)
+		}
+	}
+	if got := debugfs("ls -l /many"); !strings.Contains(got, "file-with-a-long-name-299") {
+		t.Errorf("/many does not contain all files:\n%s", got)
+	}
+	if got := debugfs("dump /user/big /dev/stdout"); len(got) != bigSize || !bytes.Equal([]byte(got[bigSize-4096:]), make([]byte, 4096)) {
+		t.Errorf("/user/big has unexpected contents (%d bytes)", len(got))
+	}
+}
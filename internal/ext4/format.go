@@ -0,0 +1,187 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	journalIno = 8
+
+	journalMagic        = 0xC03B3998
+	journalSuperblockV2 = 4
+)
+
+// journalBlocks returns the size of the journal for a file system of blocks
+// blocks, following the defaults of mke2fs (capped at 128 MB).
+func journalBlocks(blocks uint32) uint32 {
+	switch {
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	default:
+		return 32768
+	}
+}
+
+// journalSuperblock returns the first block of an empty jbd2 journal of
+// blocks blocks.
+func (fs *fs) journalSuperblock(blocks uint32) []byte {
+	b := make([]byte, blockSize)
+	be := binary.BigEndian
+	be.PutUint32(b[0:], journalMagic)
+	be.PutUint32(b[4:], journalSuperblockV2)
+	be.PutUint32(b[12:], blockSize)
+	be.PutUint32(b[16:], blocks) // s_maxlen
+	be.PutUint32(b[20:], 1)      // s_first: the first block of the log
+	be.PutUint32(b[24:], 1)      // s_sequence: the first expected commit ID
+	uuid := fs.uuid()
+	copy(b[48:], uuid[:])
+	be.PutUint32(b[64:], 1) // s_nr_users
+	return b
+}
+
+// uninitItable marks the inode table of group g as uninitialized (except for
+// group 0, which contains all used inodes) and sets the group descriptor
+// checksum which the uninit_bg feature requires.
+func (fs *fs) uninitItable(g uint32, desc *groupDesc) {
+	if g == 0 {
+		used := uint32(firstIno - 1 + len(fs.nodes))
+		desc.Flags = bgItableZeroed
+		desc.ItableUnused = uint16(fs.inodesPerGrp - used)
+	} else {
+		desc.Flags = bgInodeUninit
+		desc.ItableUnused = uint16(fs.inodesPerGrp)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, desc)
+	uuid := fs.uuid()
+	crc := crc16(0xFFFF, uuid[:])
+	crc = crc16(crc, binary.LittleEndian.AppendUint32(nil, g))
+	crc = crc16(crc, buf.Bytes()[:30]) // up to the checksum field
+	desc.Checksum = crc
+}
+
+// crc16 updates crc with the CRC-16 (polynomial 0x8005, reflected) of b, as
+// used for ext4 group descriptor checksums.
+func crc16(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// offsetWriter writes sequentially to w, starting at off.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// Format writes an empty ext4 file system (containing only lost+found) with
+// the specified volume label (at most 16 bytes) of size bytes to w, starting
+// at offset, e.g. for the perm partition. mkfsTime is used as the file system
+// creation time and to derive the file system UUID.
+//
+// Unlike the file systems created by Write, it is meant to be mounted
+// read-write, so it has a journal. Formatting only writes the metadata: the
+// inode tables of all groups but the first are left uninitialized (uninit_bg)
+// and are zeroed by the kernel in the background after mounting, so that
+// formatting a large SD card only writes the journal and a few MB.
+func Format(w io.WriterAt, offset, size int64, label string, mkfsTime time.Time) error {
+	if len(label) > 16 {
+		return fmt.Errorf("volume label %q too long: at most 16 bytes", label)
+	}
+	blocks := size / blockSize
+	if blocks >= 1<<32 {
+		return fmt.Errorf("file system too large (%d blocks, at most %d)", blocks, uint32(1<<32-1))
+	}
+	fs := &fs{
+		mkfsTime:    mkfsTime,
+		label:       label,
+		lazyItables: true,
+		blocksCount: uint32(blocks),
+		// One inode per 16 KB, like mke2fs.
+		inodesPerGrp: blocksPerGroup * blockSize / 16384,
+	}
+	fs.itableBlocks = fs.inodesPerGrp / inodesPerBlock
+	if err := fs.addTree(&File{Mode: 0755, ModTime: mkfsTime, Dir: true}); err != nil {
+		return err
+	}
+	fs.groups = (fs.blocksCount + blocksPerGroup - 1) / blocksPerGroup
+	fs.gdtBlocks = (fs.groups*groupDescSize + blockSize - 1) / blockSize
+	// Like mke2fs, drop a last group which would have barely any room for
+	// data.
+	last := fs.groups - 1
+	if fs.blocksCount-fs.groupStart(last) < fs.metaBlocks(last)+50 && last > 0 {
+		fs.groups--
+		fs.blocksCount = fs.groups * blocksPerGroup
+	}
+	if fs.blocksCount < fs.metaBlocks(0)+50 {
+		return fmt.Errorf("file system too small (%d bytes)", size)
+	}
+
+	jblocks := journalBlocks(fs.blocksCount)
+	jsize := int64(jblocks) * blockSize
+	jsb := fs.journalSuperblock(jblocks)
+	fs.journal = &node{
+		f: &File{
+			Name: "journal",
+			Mode: 0600,
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.MultiReader(bytes.NewReader(jsb), io.LimitReader(zeroReader{}, jsize-blockSize))), nil
+			},
+			Size: jsize,
+		},
+		ino:   journalIno,
+		links: 1,
+		mtime: mkfsTime,
+		size:  jsize,
+	}
+
+	a := &allocator{fs: fs}
+	for _, n := range fs.allNodes() {
+		var ok bool
+		n.extents, ok = a.alloc(uint32((n.size + blockSize - 1) / blockSize))
+		if !ok || len(n.extents) > inodeExtents || a.next > fs.blocksCount {
+			return fmt.Errorf("file system too small for a %d MB journal (%d bytes)", jsize>>20, size)
+		}
+	}
+	fs.computeBitmaps()
+
+	for _, c := range fs.chunks() {
+		if err := c.write(&offsetWriter{w: w, off: offset + int64(c.start)*blockSize}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package ext4
+
+import (
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	for _, tool := range []string{"e2fsck", "dumpe2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found: %v", tool, err)
+		}
+	}
+	const (
+		offset = 1 << 20
+		size   = 300<<20 + 12345 // not a multiple of the group size
+	)
+	fn := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Fill the disk with garbage: Format must not rely on zeroed blocks.
+	garbage := make([]byte, offset+size)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	if _, err := f.Write(garbage); err != nil {
+		t.Fatal(err)
+	}
+	if err := Format(f, offset, size, "perm", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Extract the file system for the tools.
+	fsImg := filepath.Join(t.TempDir(), "perm.ext4")
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fsImg, b[offset:], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("e2fsck", "-fn", fsImg).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck: %v\n%s", err, out)
+	}
+	out, err = exec.Command("dumpe2fs", "-h", fsImg).CombinedOutput()
+	if err != nil {
+		t.Fatalf("dumpe2fs: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"Filesystem volume name:   perm",
+		"has_journal",
+		"uninit_bg",
+		"Total journal size:       16M",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("dumpe2fs -h output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	if err := Format(f, 0, 1<<20, "", time.Now()); err == nil {
+		t.Errorf("Format(1 MB) = nil, want error")
+	}
+	if err := Format(f, 0, size, strings.Repeat("x", 17), time.Now()); err == nil {
+		t.Errorf("Format with a 17 byte label = nil, want error")
+	}
+}
@@ -0,0 +1,530 @@
+// Package fat32 writes FAT32 file system images, for boot partitions whose
+// contents do not fit into the FAT16 file systems of
+// github.com/gokrazy/internal/fat (at most 128 MB of data), e.g. custom
+// kernels with many device tree overlays. The layout follows
+// https://download.microsoft.com/download/1/6/1/161ba512-40e2-4cc9-843a-923143f3456c/fatgen103.doc
+//
+// Like fat.Writer, the Writer places the data of each file in consecutive
+// clusters (the gokrazy MBR loads the kernel by LBA), and it keeps the case of
+// short file names, which the gokrazy FAT readers rely on.
+package fat32
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 512
+
+	// reservedSectors holds the boot sector (0), the FSInfo sector (1) and
+	// their backups (6 and 7).
+	reservedSectors  = 32
+	fsInfoSector     = 1
+	backupBootSector = 6
+
+	numFATs = 2
+
+	// minClusters is the smallest number of clusters of a FAT32 file system;
+	// file systems with fewer clusters are FAT16 by definition.
+	minClusters = 65525
+	maxClusters = 0x0FFFFFF5
+
+	endOfChain = 0x0FFFFFFF
+
+	hardDisk = 0xF8 // media descriptor
+
+	dirEntrySize = 32
+
+	attrReadOnly  = 0x01
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrLongName  = 0x0F
+
+	// volumeID is fixed (like in fat.Writer) so that images are reproducible.
+	volumeID = 0xf3f37b84
+)
+
+var volumeLabel = [11]byte{'g', 'o', 'k', 'r', 'a', 'z', 'y', ' ', ' ', ' ', ' '}
+
+// clusterSectors returns the number of sectors per cluster which Windows uses
+// by default for FAT32 volumes of size bytes.
+func clusterSectors(size int64) uint32 {
+	switch {
+	case size <= 260<<20:
+		return 1
+	case size <= 8<<30:
+		return 8
+	case size <= 16<<30:
+		return 16
+	case size <= 32<<30:
+		return 32
+	default:
+		return 64
+	}
+}
+
+// MinSize is the size in bytes of the smallest FAT32 file system.
+const MinSize = 33 << 20
+
+type entry struct {
+	name         string
+	dir          bool
+	modTime      time.Time
+	size         uint32
+	firstCluster uint32
+
+	// directories only
+	parent   *entry
+	entries  []*entry
+	byName   map[string]*entry
+	clusters uint32
+}
+
+// A Writer writes a FAT32 file system of a fixed size. The file data is
+// buffered in a temporary file until Flush, because it follows the FATs, which
+// are only known once all files were written.
+type Writer struct {
+	w       io.Writer
+	dataTmp *os.File
+
+	totalSectors   uint32
+	sectorsPerClus uint32
+	fatSectors     uint32
+	clusters       uint32 // number of data clusters
+
+	// fat holds the FAT entries of the allocated clusters, starting at
+	// cluster 2.
+	fat []uint32
+
+	root    *entry
+	pending *fileWriter
+}
+
+// NewWriter returns a Writer which writes a FAT32 file system spanning size
+// bytes (e.g. the boot partition) to w once Flush is called. Only the used
+// part of the file system is written: w ends after the last used cluster.
+func NewWriter(w io.Writer, size int64) (*Writer, error) {
+	if size < MinSize {
+		return nil, fmt.Errorf("FAT32 file systems need at least %d MB, got %d MB", MinSize>>20, size>>20)
+	}
+	totalSectors := size / sectorSize
+	if totalSectors > 0xFFFFFFFF {
+		return nil, fmt.Errorf("FAT32 file systems can be at most 2 TB, got %d MB", size>>20)
+	}
+	fw := &Writer{
+		w:              w,
+		totalSectors:   uint32(totalSectors),
+		sectorsPerClus: clusterSectors(size),
+		root:           &entry{dir: true, byName: make(map[string]*entry)},
+	}
+	// Size the FAT for all sectors (an upper bound of the number of
+	// clusters), then determine the clusters which fit next to it.
+	fw.fatSectors = uint32((uint64(fw.totalSectors/fw.sectorsPerClus)+2)*4+sectorSize-1) / sectorSize
+	fw.clusters = (fw.totalSectors - reservedSectors - numFATs*fw.fatSectors) / fw.sectorsPerClus
+	if fw.clusters < minClusters || fw.clusters > maxClusters {
+		return nil, fmt.Errorf("%d MB results in %d clusters, which is not a valid FAT32 file system", size>>20, fw.clusters)
+	}
+	f, err := os.CreateTemp("", "writefat32")
+	if err != nil {
+		return nil, err
+	}
+	fw.dataTmp = f
+	return fw, nil
+}
+
+func (fw *Writer) clusterSize() int64 {
+	return int64(fw.sectorsPerClus) * sectorSize
+}
+
+// nextCluster returns the number of the next cluster to be allocated.
+func (fw *Writer) nextCluster() uint32 {
+	return 2 + uint32(len(fw.fat))
+}
+
+// allocate allocates a chain of n consecutive clusters and returns the number
+// of its first cluster.
+func (fw *Writer) allocate(n uint32) (uint32, error) {
+	first := fw.nextCluster()
+	if uint64(len(fw.fat))+uint64(n) > uint64(fw.clusters) {
+		return 0, fmt.Errorf("file system full (%d clusters of %d bytes)", fw.clusters, fw.clusterSize())
+	}
+	for i := uint32(1); i < n; i++ {
+		fw.fat = append(fw.fat, first+i)
+	}
+	fw.fat = append(fw.fat, endOfChain)
+	return first, nil
+}
+
+func (fw *Writer) closePending() error {
+	if fw.pending == nil {
+		return nil
+	}
+	err := fw.pending.close()
+	fw.pending = nil
+	return err
+}
+
+func (fw *Writer) dir(path string) (*entry, error) {
+	cur := fw.root
+	for _, component := range strings.Split(path, "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		next, ok := cur.byName[component]
+		if !ok {
+			next = &entry{
+				name:   component,
+				dir:    true,
+				parent: cur,
+				byName: make(map[string]*entry),
+			}
+			cur.entries = append(cur.entries, next)
+			cur.byName[component] = next
+		}
+		if !next.dir {
+			return nil, fmt.Errorf("path %q invalid: component %q identifies a file", path, component)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// Mkdir creates an empty directory with the given full path,
+// e.g. Mkdir("overlays").
+func (fw *Writer) Mkdir(path string, modTime time.Time) error {
+	if err := fw.closePending(); err != nil {
+		return err
+	}
+	d, err := fw.dir(path)
+	if err != nil {
+		return err
+	}
+	d.modTime = modTime.UTC()
+	return nil
+}
+
+type fileWriter struct {
+	fw    *Writer
+	f     *entry
+	count int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.count+int64(len(p)) > 0xFFFFFFFF {
+		return 0, fmt.Errorf("%s: FAT32 files can be at most 4 GB", w.f.name)
+	}
+	n, err := w.fw.dataTmp.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+func (w *fileWriter) close() error {
+	if w.count == 0 {
+		return nil
+	}
+	cs := w.fw.clusterSize()
+	clusters := (w.count + cs - 1) / cs
+	if pad := clusters*cs - w.count; pad > 0 {
+		if _, err := w.fw.dataTmp.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+	first, err := w.fw.allocate(uint32(clusters))
+	if err != nil {
+		return fmt.Errorf("%s: %v", w.f.name, err)
+	}
+	w.f.firstCluster = first
+	w.f.size = uint32(w.count)
+	return nil
+}
+
+// File creates a file with the specified path and modTime. The returned
+// io.Writer stays valid until the next call to File, Mkdir or Flush.
+func (fw *Writer) File(path string, modTime time.Time) (io.Writer, error) {
+	if err := fw.closePending(); err != nil {
+		return nil, err
+	}
+	dir, err := fw.dir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	if _, ok := dir.byName[name]; ok {
+		return nil, fmt.Errorf("%s: file exists", path)
+	}
+	f := &entry{name: name, modTime: modTime.UTC()}
+	dir.entries = append(dir.entries, f)
+	dir.byName[name] = f
+	// File data is appended to dataTmp, so it starts at the next cluster.
+	fw.pending = &fileWriter{fw: fw, f: f}
+	return fw.pending, nil
+}
+
+// dirEntries returns the number of directory entries of d.
+func dirEntries(d *entry) int {
+	count := 2 // . and .., or volume label and end marker for the root
+	for _, e := range d.entries {
+		count += 1 + (len(utf16.Encode([]rune(e.name)))+12)/13 // short + long entries
+	}
+	return count + 1 // end of directory marker
+}
+
+// allocateDirs allocates the clusters of d and its subdirectories. Parents are
+// allocated before their children, so that the .. entries can refer to them.
+func (fw *Writer) allocateDirs(d *entry) error {
+	cs := fw.clusterSize()
+	d.clusters = uint32((int64(dirEntries(d))*dirEntrySize + cs - 1) / cs)
+	first, err := fw.allocate(d.clusters)
+	if err != nil {
+		return err
+	}
+	d.firstCluster = first
+	for _, e := range d.entries {
+		if e.dir {
+			if err := fw.allocateDirs(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeDirs writes the directory entries of d and its subdirectories into
+// their clusters.
+func (fw *Writer) writeDirs(d *entry) error {
+	var buf bytes.Buffer
+	writeDirEntries(&buf, d, fw.root)
+	buf.Write(make([]byte, int64(d.clusters)*fw.clusterSize()-int64(buf.Len())))
+	off := int64(d.firstCluster-2) * fw.clusterSize()
+	if _, err := fw.dataTmp.WriteAt(buf.Bytes(), off); err != nil {
+		return err
+	}
+	for _, e := range d.entries {
+		if e.dir {
+			if err := fw.writeDirs(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fatTime(t time.Time) (tim, date uint16) {
+	if t.Year() < 1980 {
+		return 0, 1<<5 | 1 // 1980-01-01
+	}
+	tim = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	return tim, date
+}
+
+// shortName returns the 8.3 name of name which is unique among seen. The case
+// is preserved, like in fat.Writer.
+func shortName(name string, seen map[string]bool) [11]byte {
+	var sn [11]byte
+	copy(sn[:], "           ")
+	if name == "." || name == ".." {
+		copy(sn[:], name)
+		return sn
+	}
+	basis := strings.TrimLeft(strings.ReplaceAll(name, " ", ""), ".")
+	primary, ext := basis, ""
+	if idx := strings.LastIndex(basis, "."); idx > -1 {
+		primary, ext = basis[:idx], basis[idx+1:]
+	}
+	fit := len(primary) <= 8 && len(ext) <= 3 && !seen[primary+"."+ext]
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if !fit {
+		for n := 1; n <= 999999; n++ {
+			tail := "~" + strconv.Itoa(n)
+			p := primary
+			if len(p)+len(tail) > 8 {
+				p = p[:8-len(tail)]
+			}
+			if !seen[p+tail+"."+ext] {
+				primary = p + tail
+				break
+			}
+		}
+	}
+	seen[primary+"."+ext] = true
+	copy(sn[0:8], primary)
+	copy(sn[8:11], ext)
+	return sn
+}
+
+func shortEntry(w *bytes.Buffer, name [11]byte, attr uint8, modTime time.Time, firstCluster, size uint32) {
+	tim, date := fatTime(modTime)
+	w.Write(name[:])
+	for _, v := range []interface{}{
+		attr,
+		uint8(0),                      // reserved
+		uint8(0),                      // creation time, tenths of a second
+		tim,                           // creation time
+		date,                          // creation date
+		date,                          // last access date
+		uint16(firstCluster >> 16),    // first cluster, high word
+		tim,                           // modification time
+		date,                          // modification date
+		uint16(firstCluster & 0xFFFF), // first cluster, low word
+		size,
+	} {
+		binary.Write(w, binary.LittleEndian, v)
+	}
+}
+
+func writeDirEntries(w *bytes.Buffer, d, root *entry) {
+	if d == root {
+		shortEntry(w, volumeLabel, attrVolumeID, time.Time{}, 0, 0)
+	} else {
+		shortEntry(w, shortName(".", nil), attrDirectory, d.modTime, d.firstCluster, 0)
+		parent := d.parent.firstCluster
+		if d.parent == root {
+			parent = 0 // .. refers to the root directory as cluster 0
+		}
+		shortEntry(w, shortName("..", nil), attrDirectory, d.modTime, parent, 0)
+	}
+	seen := make(map[string]bool)
+	for _, e := range d.entries {
+		sn := shortName(e.name, seen)
+		var checksum uint8
+		for _, ch := range sn {
+			checksum = (checksum&1)<<7 + checksum>>1 + ch
+		}
+		name := utf16.Encode([]rune(e.name))
+		chunks := (len(name) + 12) / 13
+		padded := make([]uint16, chunks*13)
+		for i := range padded {
+			switch {
+			case i < len(name):
+				padded[i] = name[i]
+			case i == len(name):
+				padded[i] = 0
+			default:
+				padded[i] = 0xFFFF
+			}
+		}
+		for i := chunks - 1; i >= 0; i-- {
+			order := uint8(i + 1)
+			if i == chunks-1 {
+				order |= 0x40 // last long entry
+			}
+			chars := padded[i*13 : i*13+13]
+			w.WriteByte(order)
+			binary.Write(w, binary.LittleEndian, chars[0:5])
+			w.WriteByte(attrLongName)
+			w.WriteByte(0) // type
+			w.WriteByte(checksum)
+			binary.Write(w, binary.LittleEndian, chars[5:11])
+			binary.Write(w, binary.LittleEndian, uint16(0)) // first cluster
+			binary.Write(w, binary.LittleEndian, chars[11:13])
+		}
+		attr := uint8(attrReadOnly)
+		if e.dir {
+			attr = attrDirectory
+		}
+		shortEntry(w, sn, attr, e.modTime, e.firstCluster, e.size)
+	}
+}
+
+func (fw *Writer) bootSector(rootCluster uint32) []byte {
+	var buf bytes.Buffer
+	for _, v := range []interface{}{
+		[3]byte{0xEB, 0x58, 0x90},                       // jump code
+		[8]byte{'g', 'o', 'k', 'r', 'a', 'z', 'y', '!'}, // OEM
+		uint16(sectorSize),
+		uint8(fw.sectorsPerClus),
+		uint16(reservedSectors),
+		uint8(numFATs),
+		uint16(0),       // root directory entries (0 for FAT32)
+		uint16(0),       // 0 = use the 32-bit number of sectors
+		uint8(hardDisk), // media descriptor
+		uint16(0),       // sectors per FAT (0 for FAT32)
+		uint16(32),      // (only for boot code) sectors per track
+		uint16(4),       // (only for boot code) number of heads
+		uint32(0),       // hidden sectors
+		fw.totalSectors,
+		fw.fatSectors,            // sectors per FAT
+		uint16(0),                // flags: FATs are mirrored
+		uint16(0),                // version 0.0
+		rootCluster,              // first cluster of the root directory
+		uint16(fsInfoSector),     // sector of the FSInfo structure
+		uint16(backupBootSector), // sector of the backup boot sector
+		[12]byte{},               // reserved
+		uint8(0x80),              // (only for boot code) drive number
+		uint8(0),                 // reserved
+		uint8(0x29),              // extended boot signature
+		uint32(volumeID),
+		volumeLabel,
+		[8]byte{'F', 'A', 'T', '3', '2', ' ', ' ', ' '},
+		[420]byte{}, // boot code
+		[2]byte{0x55, 0xAA},
+	} {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+func fsInfo() []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(b[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:], 0xFFFFFFFF) // free clusters unknown
+	binary.LittleEndian.PutUint32(b[492:], 0xFFFFFFFF) // next free cluster unknown
+	binary.LittleEndian.PutUint32(b[508:], 0xAA550000)
+	return b
+}
+
+// Flush writes the image. The Writer must not be used after calling Flush.
+func (fw *Writer) Flush() error {
+	defer os.Remove(fw.dataTmp.Name())
+	defer fw.dataTmp.Close()
+	if err := fw.closePending(); err != nil {
+		return err
+	}
+	if err := fw.allocateDirs(fw.root); err != nil {
+		return err
+	}
+	if err := fw.writeDirs(fw.root); err != nil {
+		return err
+	}
+
+	reserved := make([]byte, reservedSectors*sectorSize)
+	boot := fw.bootSector(fw.root.firstCluster)
+	copy(reserved[0:], boot)
+	copy(reserved[fsInfoSector*sectorSize:], fsInfo())
+	copy(reserved[backupBootSector*sectorSize:], boot)
+	copy(reserved[(backupBootSector+fsInfoSector)*sectorSize:], fsInfo())
+	if _, err := fw.w.Write(reserved); err != nil {
+		return err
+	}
+
+	fat := make([]byte, int(fw.fatSectors)*sectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], 0x0FFFFF00|hardDisk)
+	binary.LittleEndian.PutUint32(fat[4:], endOfChain)
+	for i, next := range fw.fat {
+		binary.LittleEndian.PutUint32(fat[(2+i)*4:], next)
+	}
+	for i := 0; i < numFATs; i++ {
+		if _, err := fw.w.Write(fat); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fw.dataTmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(fw.w, fw.dataTmp)
+	return err
+}
@@ -0,0 +1,105 @@
+package fat32
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	const size = 64 << 20
+	var buf bytes.Buffer
+	fw, err := NewWriter(&buf, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := fw.File("/vmlinuz", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel := strings.Repeat("k", 3000)
+	if _, err := w.Write([]byte(kernel)); err != nil {
+		t.Fatal(err)
+	}
+	// Enough files for the directory entries to span several clusters.
+	for i := 0; i < 100; i++ {
+		w, err := fw.File(fmt.Sprintf("/overlays/overlay-%d.dtbo", i), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "overlay %d", i)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	le := binary.LittleEndian
+	if got, want := string(b[82:90]), "FAT32   "; got != want {
+		t.Errorf("file system type = %q, want %q", got, want)
+	}
+	if b[510] != 0x55 || b[511] != 0xAA {
+		t.Errorf("boot sector signature missing")
+	}
+	if got, want := le.Uint32(b[32:]), uint32(size/sectorSize); got != want {
+		t.Errorf("total sectors = %d, want %d", got, want)
+	}
+	if !bytes.Equal(b[:sectorSize], b[backupBootSector*sectorSize:(backupBootSector+1)*sectorSize]) {
+		t.Errorf("backup boot sector differs from the boot sector")
+	}
+	if got, want := le.Uint32(b[sectorSize+484:]), uint32(0x61417272); got != want {
+		t.Errorf("FSInfo signature = %#x, want %#x", got, want)
+	}
+
+	fatSectors := int(le.Uint32(b[36:]))
+	fatStart := reservedSectors * sectorSize
+	fat := b[fatStart : fatStart+fatSectors*sectorSize]
+	if !bytes.Equal(fat, b[fatStart+len(fat):fatStart+2*len(fat)]) {
+		t.Errorf("the FAT copies differ")
+	}
+	dataSectors := int(le.Uint32(b[32:])) - reservedSectors - numFATs*fatSectors
+	if clusters := dataSectors / int(b[13]); clusters < minClusters {
+		t.Errorf("%d clusters, want at least %d (FAT32)", clusters, minClusters)
+	}
+
+	// The kernel is the first file: 6 consecutive clusters starting at 2.
+	for cluster := uint32(2); cluster < 7; cluster++ {
+		if got, want := le.Uint32(fat[cluster*4:]), cluster+1; got != want {
+			t.Errorf("FAT[%d] = %d, want %d", cluster, got, want)
+		}
+	}
+	if got := le.Uint32(fat[7*4:]); got != endOfChain {
+		t.Errorf("FAT[7] = %#x, want end of chain", got)
+	}
+	dataStart := fatStart + numFATs*len(fat)
+	if got := string(b[dataStart : dataStart+len(kernel)]); got != kernel {
+		t.Errorf("kernel contents differ")
+	}
+
+	// The overlays directory needs 100 * 3 entries of 32 bytes.
+	// Subdirectories are allocated after the root directory.
+	rootCluster := le.Uint32(b[44:])
+	clusters := 1
+	for cluster := rootCluster + 1; le.Uint32(fat[cluster*4:]) != endOfChain; cluster = le.Uint32(fat[cluster*4:]) {
+		clusters++
+	}
+	if want := (100*3*32 + sectorSize - 1) / sectorSize; clusters < want {
+		t.Errorf("overlays directory spans %d clusters, want at least %d", clusters, want)
+	}
+}
+
+func TestNewWriterSize(t *testing.T) {
+	if _, err := NewWriter(&bytes.Buffer{}, 16<<20); err == nil {
+		t.Errorf("NewWriter(16 MB) = nil, want error")
+	}
+	fw, err := NewWriter(&bytes.Buffer{}, MinSize)
+	if err != nil {
+		t.Fatalf("NewWriter(MinSize) = %v", err)
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,296 @@
+package fleet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+)
+
+// ApproversFile is the name of the file in the parent directory which lists
+// the operators whose signatures count for approving update plans, one
+// "<name> <public key>" line per operator (see ApprovalPublicKey).
+const ApproversFile = "approvers.txt"
+
+// RequiredSignatures is the number of distinct approvers who need to sign a
+// plan before it is executed: the author and a second operator.
+const RequiredSignatures = 2
+
+// PlanInstance is one instance to be updated by a Plan.
+type PlanInstance struct {
+	Instance string
+	// ConfigSHA256 is the hash of the config.json of the instance when the
+	// plan was created, so that the approval does not cover later changes.
+	ConfigSHA256 string
+
+	// Running and SBOMHash are the SBOM hashes of the build the instance ran
+	// when the plan was created and of the build the plan installs (see gok
+	// fleet plan). Empty for plans of gok fleet update --require_approval.
+	Running  string `json:",omitempty"`
+	SBOMHash string `json:",omitempty"`
+}
+
+// Signature is the signature of one approver over a Plan.
+type Signature struct {
+	Signer    string // name from ApproversFile, informational
+	PublicKey string // base64-encoded ed25519 public key
+	Signature string // base64-encoded ed25519 signature of Plan.payload
+	Signed    time.Time
+}
+
+// Plan is a saved fleet update: either one which needs to be signed by
+// RequiredSignatures approvers before gok fleet update executes it, or one
+// created by gok fleet plan for gok fleet apply.
+type Plan struct {
+	Target     string
+	Canary     int
+	CanarySoak string `json:",omitempty"`
+	Instances  []PlanInstance
+	Created    time.Time
+	Signatures []Signature `json:",omitempty"`
+}
+
+func configSHA256(dev *Device) (string, error) {
+	b, err := os.ReadFile(dev.Config.Meta.Path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// NewPlan returns an (unsigned) plan for updating devices in order.
+func NewPlan(target string, devices []*Device, canary int, canarySoak time.Duration) (*Plan, error) {
+	p := &Plan{
+		Target:  target,
+		Canary:  canary,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if canarySoak > 0 {
+		p.CanarySoak = canarySoak.String()
+	}
+	for _, dev := range devices {
+		sum, err := configSHA256(dev)
+		if err != nil {
+			return nil, err
+		}
+		p.Instances = append(p.Instances, PlanInstance{
+			Instance:     dev.Instance,
+			ConfigSHA256: sum,
+		})
+	}
+	return p, nil
+}
+
+// ReadPlan reads a plan written by WritePlan.
+func ReadPlan(path string) (*Plan, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &p, nil
+}
+
+// WritePlan writes p to path as JSON.
+func WritePlan(path string, p *Plan) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// payload returns the signed bytes of the plan: everything but the
+// signatures.
+func (p *Plan) payload() ([]byte, error) {
+	unsigned := *p
+	unsigned.Signatures = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign adds the signature of key (of the approver signer) to the plan.
+func (p *Plan) Sign(signer string, key ed25519.PrivateKey) error {
+	pub := ApprovalPublicKey(key)
+	for _, sig := range p.Signatures {
+		if sig.PublicKey == pub {
+			return fmt.Errorf("the plan is already signed with your key (as %s); a second operator needs to approve it", sig.Signer)
+		}
+	}
+	payload, err := p.payload()
+	if err != nil {
+		return err
+	}
+	p.Signatures = append(p.Signatures, Signature{
+		Signer:    signer,
+		PublicKey: pub,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+		Signed:    time.Now().UTC().Truncate(time.Second),
+	})
+	return nil
+}
+
+// Approvers returns the names of the approvers (see ReadApprovers) whose
+// signatures of the plan are valid, one per key.
+func (p *Plan) Approvers(approvers map[string]string) ([]string, error) {
+	payload, err := p.payload()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, sig := range p.Signatures {
+		name, ok := approvers[sig.PublicKey]
+		if !ok {
+			return nil, fmt.Errorf("plan signed by %s with a key which is not in %s", sig.Signer, ApproversFile)
+		}
+		pub, err := base64.StdEncoding.DecodeString(sig.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key of %s", name)
+		}
+		s, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), payload, s) {
+			return nil, fmt.Errorf("invalid signature of %s (was the plan modified after signing?)", name)
+		}
+		if seen[sig.PublicKey] {
+			continue
+		}
+		seen[sig.PublicKey] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Verify returns an error unless the plan is signed by RequiredSignatures
+// distinct approvers and the config.json files of the devices (in the plan's
+// order) are unchanged since the plan was created.
+func (p *Plan) Verify(approvers map[string]string, devices []*Device) error {
+	names, err := p.Approvers(approvers)
+	if err != nil {
+		return err
+	}
+	if len(names) < RequiredSignatures {
+		return fmt.Errorf("plan approved by %v, but %d approvers are required (see gok fleet approve)", names, RequiredSignatures)
+	}
+	return p.CheckConfigs(devices)
+}
+
+// CheckConfigs returns an error unless the config.json files of the devices
+// (in the plan's order) are unchanged since the plan was created.
+func (p *Plan) CheckConfigs(devices []*Device) error {
+	if len(devices) != len(p.Instances) {
+		return fmt.Errorf("plan covers %d instances, but %d were found", len(p.Instances), len(devices))
+	}
+	for idx, inst := range p.Instances {
+		dev := devices[idx]
+		if dev.Instance != inst.Instance {
+			return fmt.Errorf("plan instance %d is %s, but found %s", idx+1, inst.Instance, dev.Instance)
+		}
+		sum, err := configSHA256(dev)
+		if err != nil {
+			return err
+		}
+		if sum != inst.ConfigSHA256 {
+			return fmt.Errorf("the config of %s changed after the plan was created; create and approve a new plan", inst.Instance)
+		}
+	}
+	return nil
+}
+
+// Devices returns the devices of the plan, in the plan's order, from the
+// inventory in parentDir.
+func (p *Plan) Devices(parentDir string) ([]*Device, error) {
+	all, err := Inventory(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	byInstance := make(map[string]*Device)
+	for _, dev := range all {
+		byInstance[dev.Instance] = dev
+	}
+	var devices []*Device
+	for _, inst := range p.Instances {
+		dev, ok := byInstance[inst.Instance]
+		if !ok {
+			return nil, fmt.Errorf("plan instance %s not found in %s", inst.Instance, parentDir)
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// ReadApprovers reads the ApproversFile of parentDir and returns the approver
+// names by base64-encoded public key.
+func ReadApprovers(parentDir string) (map[string]string, error) {
+	path := filepath.Join(parentDir, ApproversFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	approvers := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <name> <public key>", path, lineNum)
+		}
+		approvers[fields[1]] = fields[0]
+	}
+	return approvers, sc.Err()
+}
+
+// approvalKeyPath is the private key of the operator for signing plans.
+func approvalKeyPath() string {
+	return filepath.Join(config.Gokrazy(), "fleet-approval.key")
+}
+
+// ApprovalKey returns the operator's private key for signing plans, which is
+// generated on first use.
+func ApprovalKey() (ed25519.PrivateKey, error) {
+	path := approvalKeyPath()
+	b, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: invalid key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ApprovalPublicKey returns the base64-encoded public key of key, as listed in
+// the ApproversFile.
+func ApprovalPublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
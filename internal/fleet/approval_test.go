@@ -0,0 +1,69 @@
+package fleet
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+)
+
+func TestPlanApproval(t *testing.T) {
+	configJSON := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configJSON, []byte(`{"Hostname":"kitchen-pi"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Struct{Hostname: "kitchen-pi"}
+	cfg.Meta.Path = configJSON
+	devices := []*Device{{Instance: "kitchen-pi", Config: cfg}}
+
+	var keys []ed25519.PrivateKey
+	approvers := make(map[string]string)
+	for _, name := range []string{"alice", "bob"} {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		approvers[ApprovalPublicKey(key)] = name
+	}
+
+	plan, err := NewPlan("tag:kitchen", devices, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Sign("alice", keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Verify(approvers, devices); err == nil {
+		t.Fatalf("Verify with only the author's signature unexpectedly succeeded")
+	}
+	if err := plan.Sign("alice", keys[0]); err == nil {
+		t.Fatalf("second Sign with the author's key unexpectedly succeeded")
+	}
+	if err := plan.Sign("bob", keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Verify(approvers, devices); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	t.Run("Modified", func(t *testing.T) {
+		modified := *plan
+		modified.Canary = 2
+		if err := modified.Verify(approvers, devices); err == nil {
+			t.Fatalf("Verify of a modified plan unexpectedly succeeded")
+		}
+	})
+
+	t.Run("ConfigChanged", func(t *testing.T) {
+		if err := os.WriteFile(configJSON, []byte(`{"Hostname":"kitchen"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := plan.Verify(approvers, devices); err == nil {
+			t.Fatalf("Verify after changing config.json unexpectedly succeeded")
+		}
+	})
+}
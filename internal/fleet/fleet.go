@@ -0,0 +1,152 @@
+// Package fleet implements the inventory of gokrazy instances (one
+// subdirectory with a config.json per instance in the parent directory) and
+// selecting a subset of them for fleet commands.
+package fleet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/healthcheck"
+)
+
+// Device is one gokrazy instance of the inventory.
+type Device struct {
+	// Instance is the name of the instance directory.
+	Instance string
+
+	// Config is the instance configuration loaded from config.json.
+	Config *config.Struct
+
+	// Tags are read from the tags.txt file in the instance directory (one tag
+	// per line), if present.
+	Tags []string
+
+	// HealthChecks are read from the healthcheck.File in the instance
+	// directory, if present.
+	HealthChecks map[string][]healthcheck.Check
+}
+
+// Model returns the configured device type of the instance (e.g. odroidhc1),
+// or the empty string for the default (Raspberry Pi) device type.
+func (d *Device) Model() string {
+	return d.Config.DeviceType
+}
+
+func readConfig(instanceDir string) (*config.Struct, error) {
+	configJSON := filepath.Join(instanceDir, "config.json")
+	f, err := os.Open(configJSON)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var cfg config.Struct
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", configJSON, err)
+	}
+	if cfg.Update == nil {
+		cfg.Update = &config.UpdateStruct{}
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	cfg.Meta.Instance = filepath.Base(instanceDir)
+	cfg.Meta.Path = configJSON
+	cfg.Meta.LastModified = st.ModTime()
+	return &cfg, nil
+}
+
+func readTags(instanceDir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(instanceDir, "tags.txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // no tags.txt file found
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var tags []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		tag := strings.TrimSpace(sc.Text())
+		if tag == "" || strings.HasPrefix(tag, "#") {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Inventory returns all gokrazy instances in parentDir, sorted by instance
+// name. Subdirectories without a config.json file are skipped.
+func Inventory(parentDir string) ([]*Device, error) {
+	entries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	var devices []*Device
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		instanceDir := filepath.Join(parentDir, entry.Name())
+		cfg, err := readConfig(instanceDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // not a gokrazy instance
+			}
+			return nil, err
+		}
+		tags, err := readTags(instanceDir)
+		if err != nil {
+			return nil, err
+		}
+		checks, err := healthcheck.ReadFile(filepath.Join(instanceDir, healthcheck.File))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		devices = append(devices, &Device{
+			Instance:     entry.Name(),
+			Config:       cfg,
+			Tags:         tags,
+			HealthChecks: checks,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Instance < devices[j].Instance
+	})
+	return devices, nil
+}
+
+// Select returns the devices of the inventory in parentDir which match the
+// target selector expression (see ParseSelector).
+func Select(parentDir, target string) ([]*Device, error) {
+	sel, err := ParseSelector(target)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := Inventory(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	var selected []*Device
+	for _, dev := range devices {
+		if sel.Match(dev) {
+			selected = append(selected, dev)
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,69 @@
+package fleet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInventory(t *testing.T) {
+	parentDir := t.TempDir()
+	for instance, files := range map[string]map[string]string{
+		"scanner": {
+			"config.json":    `{"Hostname": "scanner"}`,
+			"tags.txt":       "kitchen\n# comment\n",
+			healthcheck.File: `{"scan2drive": [{"Type": "tcp", "Port": 80}]}`,
+		},
+		"router": {
+			"config.json": `{"Hostname": "router"}`,
+		},
+		"notes": {}, // not an instance
+	} {
+		dir := filepath.Join(parentDir, instance)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	devices, err := Inventory(parentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, dev := range devices {
+		got = append(got, dev.Instance)
+	}
+	if diff := cmp.Diff([]string{"router", "scanner"}, got); diff != "" {
+		t.Fatalf("Inventory: unexpected instances (-want +got):\n%s", diff)
+	}
+	router, scanner := devices[0], devices[1]
+	if router.HealthChecks != nil {
+		t.Errorf("router: HealthChecks = %v, want none", router.HealthChecks)
+	}
+	wantChecks := map[string][]healthcheck.Check{
+		"scan2drive": {{Type: "tcp", Port: 80}},
+	}
+	if diff := cmp.Diff(wantChecks, scanner.HealthChecks); diff != "" {
+		t.Errorf("scanner: unexpected HealthChecks (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"kitchen"}, scanner.Tags); diff != "" {
+		t.Errorf("scanner: unexpected Tags (-want +got):\n%s", diff)
+	}
+
+	// Invalid health checks are reported instead of being skipped.
+	bad := filepath.Join(parentDir, "router", healthcheck.File)
+	if err := os.WriteFile(bad, []byte(`{"router7": [{"Type": "ping"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Inventory(parentDir); err == nil {
+		t.Errorf("Inventory unexpectedly succeeded despite invalid %s", bad)
+	}
+}
@@ -0,0 +1,217 @@
+package fleet
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Selector matches devices of the inventory.
+type Selector interface {
+	Match(dev *Device) bool
+	String() string
+}
+
+type matchAll struct{}
+
+func (matchAll) Match(*Device) bool { return true }
+func (matchAll) String() string     { return "all" }
+
+type andSelector struct{ l, r Selector }
+
+func (s andSelector) Match(dev *Device) bool { return s.l.Match(dev) && s.r.Match(dev) }
+func (s andSelector) String() string         { return "(" + s.l.String() + " and " + s.r.String() + ")" }
+
+type orSelector struct{ l, r Selector }
+
+func (s orSelector) Match(dev *Device) bool { return s.l.Match(dev) || s.r.Match(dev) }
+func (s orSelector) String() string         { return "(" + s.l.String() + " or " + s.r.String() + ")" }
+
+type notSelector struct{ s Selector }
+
+func (s notSelector) Match(dev *Device) bool { return !s.s.Match(dev) }
+func (s notSelector) String() string         { return "not " + s.s.String() }
+
+// termSelector matches one property of a device against a glob pattern (see
+// path.Match).
+type termSelector struct {
+	key     string
+	pattern string
+}
+
+func (s termSelector) String() string { return s.key + ":" + s.pattern }
+
+func (s termSelector) matches(value string) bool {
+	matched, _ := path.Match(s.pattern, value) // pattern validated in parse
+	return matched
+}
+
+func (s termSelector) Match(dev *Device) bool {
+	switch s.key {
+	case "tag":
+		for _, tag := range dev.Tags {
+			if s.matches(tag) {
+				return true
+			}
+		}
+		return false
+	case "host":
+		return s.matches(dev.Config.Hostname)
+	case "instance":
+		return s.matches(dev.Instance)
+	case "model":
+		return s.matches(dev.Model())
+	}
+	return false
+}
+
+func tokenize(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range expr {
+		switch {
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type parser struct {
+	expr   string
+	tokens []string
+}
+
+func (p *parser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (Selector, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orSelector{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (Selector, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = andSelector{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (Selector, error) {
+	if p.peek() == "not" {
+		p.next()
+		s, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notSelector{s}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Selector, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("selector %q: unexpected end of expression", p.expr)
+	case "(":
+		s, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok != ")" {
+			return nil, fmt.Errorf("selector %q: expected ), got %q", p.expr, tok)
+		}
+		return s, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("selector %q: unexpected %q", p.expr, tok)
+	}
+	key, pattern, ok := strings.Cut(tok, ":")
+	if !ok {
+		// A bare word selects an instance by name.
+		key, pattern = "instance", tok
+	}
+	switch key {
+	case "tag", "host", "instance", "model":
+	default:
+		return nil, fmt.Errorf("selector %q: unknown key %q (expected one of tag, host, instance, model)", p.expr, key)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("selector %q: invalid pattern %q: %v", p.expr, pattern, err)
+	}
+	return termSelector{key: key, pattern: pattern}, nil
+}
+
+// ParseSelector parses a target selector expression like:
+//
+//	tag:kitchen and (model:odroidhc1 or not host:scan*)
+//
+// Terms are of the form key:pattern, where key is one of tag (matches any tag
+// from tags.txt), host (the configured hostname), instance (the instance
+// directory name) or model (the configured device type). Patterns may contain
+// glob wildcards (see path.Match). A term without key selects an instance by
+// name. Terms are combined with not, and, or (in decreasing order of
+// precedence) and parentheses.
+//
+// The empty expression matches all devices.
+func ParseSelector(expr string) (Selector, error) {
+	p := &parser{
+		expr:   expr,
+		tokens: tokenize(expr),
+	}
+	if len(p.tokens) == 0 {
+		return matchAll{}, nil
+	}
+	s, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tokens) > 0 {
+		return nil, fmt.Errorf("selector %q: unexpected %q", expr, p.peek())
+	}
+	return s, nil
+}
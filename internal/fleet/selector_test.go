@@ -0,0 +1,73 @@
+package fleet
+
+import (
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+)
+
+func TestSelector(t *testing.T) {
+	devices := []*Device{
+		{
+			Instance: "kitchen-pi",
+			Config:   &config.Struct{Hostname: "kitchen-pi"},
+			Tags:     []string{"kitchen", "sensors"},
+		},
+		{
+			Instance: "kitchen-nas",
+			Config:   &config.Struct{Hostname: "nas", DeviceType: "odroidhc1"},
+			Tags:     []string{"kitchen"},
+		},
+		{
+			Instance: "scanner",
+			Config:   &config.Struct{Hostname: "scanner"},
+		},
+	}
+
+	for _, tt := range []struct {
+		expr string
+		want []string
+	}{
+		{"", []string{"kitchen-pi", "kitchen-nas", "scanner"}},
+		{"scanner", []string{"scanner"}},
+		{"tag:kitchen", []string{"kitchen-pi", "kitchen-nas"}},
+		{"tag:kitchen and model:odroidhc1", []string{"kitchen-nas"}},
+		{"tag:kitchen and not model:odroidhc1", []string{"kitchen-pi"}},
+		{"host:kitchen-* or host:scan*", []string{"kitchen-pi", "scanner"}},
+		{"not (tag:sensors or instance:scanner)", []string{"kitchen-nas"}},
+		{"tag:sensors or tag:kitchen and model:odroidhc1", []string{"kitchen-pi", "kitchen-nas"}},
+	} {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := ParseSelector(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, dev := range devices {
+				if sel.Match(dev) {
+					got = append(got, dev.Instance)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseSelector(%q) = %s, matched %v, want %v", tt.expr, sel, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("ParseSelector(%q) = %s, matched %v, want %v", tt.expr, sel, got, tt.want)
+				}
+			}
+		})
+	}
+
+	for _, expr := range []string{
+		"tag:kitchen and",
+		"(tag:kitchen",
+		"tag:kitchen)",
+		"color:red",
+		"host:[",
+	} {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Errorf("ParseSelector(%q) unexpectedly succeeded", expr)
+		}
+	}
+}
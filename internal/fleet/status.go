@@ -0,0 +1,149 @@
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/tlsflag"
+	"github.com/gokrazy/tools/internal/healthcheck"
+)
+
+// baseURL returns the URL of the device's web interface, including the stored
+// password, like httpclient.For does for the global --update flag. The
+// fleet commands query many devices (concurrently), so baseURL only uses the
+// fields of the device and leaves the global --update flag alone.
+func (d *Device) baseURL() (*url.URL, error) {
+	schema := "http"
+	certPath, _, err := tlsflag.CertificatePathsFor(d.Config.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	if certPath != "" {
+		schema = "https"
+	}
+	update, err := d.Config.Update.WithFallbackToHostSpecific(d.Config.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	host := update.Hostname
+	if host == "" {
+		host = d.Config.Hostname
+	}
+	if update.HTTPPort != "" && update.HTTPPort != "80" {
+		host = net.JoinHostPort(host, update.HTTPPort)
+	}
+	return &url.URL{
+		Scheme: schema,
+		User:   url.UserPassword("gokrazy", update.HTTPPassword),
+		Host:   host,
+		Path:   "/",
+	}, nil
+}
+
+// HTTPClient returns an HTTP client and the base URL for talking to the
+// device, using the stored password and the hostname of the instance config.
+func (d *Device) HTTPClient() (*http.Client, *url.URL, error) {
+	baseURL, err := d.baseURL()
+	if err != nil {
+		return nil, nil, err
+	}
+	hc, _, err := httpclient.GetTLSHttpClientByTLSFlag(tlsflag.GetUseTLS(), tlsflag.GetInsecure(), baseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting http client by tls flag: %v", err)
+	}
+	return hc, baseURL, nil
+}
+
+// Status is the subset of the status JSON served by a gokrazy device which the
+// fleet commands use. Fields which the device does not report remain empty.
+type Status struct {
+	Hostname       string `json:"Hostname"`
+	Model          string `json:"Model"`
+	Kernel         string `json:"Kernel"`
+	BuildTimestamp string `json:"BuildTimestamp"`
+	SBOMHash       string `json:"SBOMHash"`
+	Uptime         string `json:"Uptime"`
+
+	// ActiveRoot is the root partition (e.g. 2 or 3) which the device runs
+	// from. PendingRoot is the root partition which the device boots from
+	// after its next reboot, if it differs from ActiveRoot (e.g. after an
+	// update without reboot, or to fall back after a test boot).
+	ActiveRoot  int `json:"ActiveRoot"`
+	PendingRoot int `json:"PendingRoot"`
+}
+
+// FetchStatus requests the status JSON from the device at baseURL.
+func FetchStatus(ctx context.Context, hc *http.Client, baseURL *url.URL) (*Status, error) {
+	// Cap each individual status request to 5 seconds.
+	ctx, canc := context.WithTimeout(ctx, 5*time.Second)
+	defer canc()
+	req, err := http.NewRequest("GET", baseURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err := json.Unmarshal(b, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// DeviceStatus is the result of polling one device.
+type DeviceStatus struct {
+	Device *Device
+	Status *Status // nil if Err != nil
+	Err    error
+
+	// Health are the results of the health checks of the device (see
+	// Device.HealthChecks), which are only run if the device responded.
+	Health []healthcheck.Result
+}
+
+// PollAll fetches the status of all devices concurrently and runs their
+// health checks. The results are in the same order as devices.
+func PollAll(ctx context.Context, devices []*Device) []DeviceStatus {
+	results := make([]DeviceStatus, len(devices))
+	var wg sync.WaitGroup
+	for idx, dev := range devices {
+		idx, dev := idx, dev // copy
+		results[idx].Device = dev
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc, baseURL, err := dev.HTTPClient()
+			if err != nil {
+				results[idx].Err = err
+				return
+			}
+			results[idx].Status, results[idx].Err = FetchStatus(ctx, hc, baseURL)
+			if results[idx].Err != nil {
+				return
+			}
+			results[idx].Health = healthcheck.RunAll(ctx, baseURL.Hostname(), dev.HealthChecks)
+		}()
+	}
+	wg.Wait()
+	return results
+}
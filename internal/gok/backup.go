@@ -0,0 +1,62 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd is gok backup.
+var backupCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "backup -o <dir>",
+	Short:   "Download the partitions of a running gokrazy instance",
+	Long: `gok backup downloads the boot and root partitions which a running gokrazy
+instance currently boots from (and with --perm, the contents of /perm as tar
+archive) into a local directory, e.g. before an update, so that a botched
+update can be undone exactly.
+
+This requires packing the instance with --remote_exec. The partitions are
+authenticated with the gokrazy password, sent encrypted if the instance uses
+TLS, and verified against the digest which the instance sends.
+
+To restore the backup, update the instance with the downloaded partitions:
+  % gokr-updater -update=http://gokrazy:<password>@<hostname>/ \
+      -boot=<dir>/` + packer.BackupBoot + ` -root=<dir>/` + packer.BackupRoot + `
+
+Examples:
+  % gok -i scanner backup -o backup/scanner-$(date +%F)
+  % gok -i scanner backup --perm -o backup/scanner-$(date +%F)
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backupImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type backupImplConfig struct {
+	output string
+	perm   bool
+}
+
+var backupImpl backupImplConfig
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupImpl.output, "output", "o", "", "directory to download the backup into (created if needed)")
+	backupCmd.Flags().BoolVarP(&backupImpl.perm, "perm", "", false, "also download the contents of /perm, as "+packer.BackupPermFile)
+	instanceflag.RegisterPflags(backupCmd.Flags())
+}
+
+func (r *backupImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if r.output == "" {
+		return fmt.Errorf("the -o flag is empty, but required")
+	}
+	cfg, err := readConfigForDevice()
+	if err != nil {
+		return err
+	}
+	return packer.Backup(ctx, cfg, r.output, r.perm, stdout)
+}
@@ -0,0 +1,119 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// githubAPI is the base URL of the GitHub REST API, which tests override.
+var githubAPI = "https://api.github.com"
+
+// githubRepo returns the GitHub repository (owner/name) hosting the module
+// modPath and the tag prefix of the module (its directory within the
+// repository, e.g. "cmd/foo/" for github.com/owner/name/cmd/foo). ok is false
+// for modules which are not hosted on GitHub.
+func githubRepo(modPath string) (repo, tagPrefix string, ok bool) {
+	prefix, _, _ := module.SplitPathVersion(modPath)
+	parts := strings.Split(prefix, "/")
+	if len(parts) < 3 || parts[0] != "github.com" {
+		return "", "", false
+	}
+	repo = parts[1] + "/" + parts[2]
+	if dir := strings.Join(parts[3:], "/"); dir != "" {
+		tagPrefix = dir + "/"
+	}
+	return repo, tagPrefix, true
+}
+
+// gitRevision returns the git revision of the module version: the commit of
+// a pseudo-version, otherwise the tag.
+func gitRevision(tagPrefix, version string) string {
+	if module.IsPseudoVersion(version) {
+		if rev, err := module.PseudoVersionRev(version); err == nil {
+			return rev
+		}
+	}
+	return tagPrefix + strings.TrimSuffix(version, "+incompatible")
+}
+
+// changelog returns the commits (abbreviated hash and subject) between the
+// old and new version of the bumped module c, as listed by the GitHub compare
+// API, and the total number of commits (GitHub lists at most 250).
+func changelog(ctx context.Context, c modChange) (commits []string, total int, _ error) {
+	repo, tagPrefix, ok := githubRepo(c.Path)
+	if !ok {
+		return nil, 0, fmt.Errorf("not hosted on GitHub")
+	}
+	u := githubAPI + "/repos/" + repo + "/compare/" + gitRevision(tagPrefix, c.Old) + "..." + gitRevision(tagPrefix, c.New)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		// Unauthenticated requests are limited to 60 per hour.
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("unexpected HTTP status: %v: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var compare struct {
+		TotalCommits int `json:"total_commits"`
+		Commits      []struct {
+			SHA    string `json:"sha"`
+			Commit struct {
+				Message string `json:"message"`
+			} `json:"commit"`
+		} `json:"commits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&compare); err != nil {
+		return nil, 0, err
+	}
+	for _, c := range compare.Commits {
+		sha := c.SHA
+		if len(sha) > 12 {
+			sha = sha[:12]
+		}
+		subject, _, _ := strings.Cut(c.Commit.Message, "\n")
+		commits = append(commits, sha+" "+subject)
+	}
+	return commits, compare.TotalCommits, nil
+}
+
+// printChangelogs prints the changelog of each bumped module in changes (see
+// changelog) to w. Modules whose changelog is not available (e.g. because
+// they are not hosted on GitHub) are listed without one.
+func printChangelogs(ctx context.Context, w io.Writer, changes []modChange) {
+	seen := make(map[modChange]bool)
+	for _, c := range changes {
+		if c.Old == "" || c.New == "" || seen[c] {
+			continue // added or removed, or already printed for another build directory
+		}
+		seen[c] = true
+		fmt.Fprintf(w, "\n%s:\n", c)
+		commits, total, err := changelog(ctx, c)
+		if err != nil {
+			fmt.Fprintf(w, "  (changelog unavailable: %v)\n", err)
+			continue
+		}
+		for _, commit := range commits {
+			fmt.Fprintf(w, "  %s\n", commit)
+		}
+		if more := total - len(commits); more > 0 {
+			fmt.Fprintf(w, "  (%d more not listed by GitHub)\n", more)
+		}
+	}
+}
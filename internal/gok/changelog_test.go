@@ -0,0 +1,109 @@
+package gok
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGitRevision(t *testing.T) {
+	for _, tt := range []struct {
+		modPath string
+		version string
+		wantOK  bool
+		want    string // repo@revision
+	}{
+		{
+			modPath: "github.com/stapelberg/scan2drive",
+			version: "v0.1.1",
+			wantOK:  true,
+			want:    "stapelberg/scan2drive@v0.1.1",
+		},
+		{
+			modPath: "github.com/gokrazy/kernel",
+			version: "v0.0.0-20230315061500-5a3b1c6b1d1e",
+			wantOK:  true,
+			want:    "gokrazy/kernel@5a3b1c6b1d1e",
+		},
+		{
+			// The major version suffix is not part of the tag prefix.
+			modPath: "github.com/example/tools/cmd/foo/v2",
+			version: "v2.0.1",
+			wantOK:  true,
+			want:    "example/tools@cmd/foo/v2.0.1",
+		},
+		{
+			modPath: "github.com/example/legacy",
+			version: "v3.1.0+incompatible",
+			wantOK:  true,
+			want:    "example/legacy@v3.1.0",
+		},
+		{
+			modPath: "golang.org/x/sys",
+			version: "v0.7.0",
+		},
+	} {
+		t.Run(tt.modPath, func(t *testing.T) {
+			repo, tagPrefix, ok := githubRepo(tt.modPath)
+			if ok != tt.wantOK {
+				t.Fatalf("githubRepo(%s) = %v, want %v", tt.modPath, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := repo + "@" + gitRevision(tagPrefix, tt.version); got != tt.want {
+				t.Errorf("%s@%s: got %s, want %s", tt.modPath, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintChangelogs(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path != "/repos/stapelberg/scan2drive/compare/v0.1.0...v0.1.1" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{
+  "total_commits": 3,
+  "commits": [
+    {"sha": "1a2b3c4d5e6f7a8b9c0d", "commit": {"message": "fix scanning\n\nDetails."}},
+    {"sha": "0d9c8b7a6f5e4d3c2b1a", "commit": {"message": "update dependencies"}}
+  ]
+}`)
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPI = orig }(githubAPI)
+	githubAPI = srv.URL
+
+	changes := []modChange{
+		{Path: "github.com/stapelberg/scan2drive", Old: "v0.1.0", New: "v0.1.1"},
+		{Path: "github.com/stapelberg/scan2drive", Old: "v0.1.0", New: "v0.1.1"}, // another build directory
+		{Path: "golang.org/x/sys", Old: "v0.6.0", New: "v0.7.0"},
+		{Path: "golang.org/x/text", New: "v0.9.0"},
+	}
+	var buf bytes.Buffer
+	printChangelogs(context.Background(), &buf, changes)
+	want := `
+github.com/stapelberg/scan2drive v0.1.0 → v0.1.1:
+  1a2b3c4d5e6f fix scanning
+  0d9c8b7a6f5e update dependencies
+  (1 more not listed by GitHub)
+
+golang.org/x/sys v0.6.0 → v0.7.0:
+  (changelog unavailable: not hosted on GitHub)
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("printChangelogs: unexpected output (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"/repos/stapelberg/scan2drive/compare/v0.1.0...v0.1.1"}, requests); diff != "" {
+		t.Errorf("printChangelogs: unexpected requests (-want +got):\n%s", diff)
+	}
+}
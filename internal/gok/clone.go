@@ -0,0 +1,74 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// cloneCmd is gok clone.
+var cloneCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "clone <device> -o <image>",
+	Short:   "Copy a gokrazy storage device into an image and recover its instance config",
+	Long: `gok clone copies a storage device with a gokrazy installation (e.g. an SD card
+in a card reader) into an image file, which can be written to other devices
+with gok flash or dd(1), and recovers as much of the instance config as
+possible from it: the hostname, the update ports, password and certificate,
+the serial console and the packages (from the Go build information of the
+binaries). This helps to re-create instances whose config was lost.
+
+The kernel and firmware packages and the package config (command-line flags,
+environment variables, extra files) cannot be recovered; gok clone lists what
+to check manually, and the module versions the packages were built from.
+
+Examples:
+  % gok clone /dev/sdx -o scanner.img
+  % gok clone /dev/sdx -o scanner.img --config_out=$HOME/gokrazy/scanner/config.json
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cloneImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type cloneImplConfig struct {
+	output    string
+	configOut string
+	sudo      string
+}
+
+var cloneImpl cloneImplConfig
+
+func init() {
+	cloneCmd.Flags().StringVarP(&cloneImpl.output, "output", "o", "", "image file to copy the device into")
+	cloneCmd.Flags().StringVarP(&cloneImpl.configOut, "config_out", "", "", "file to write the recovered instance config (config.json format) to. By default, it is printed")
+	cloneCmd.Flags().StringVarP(&cloneImpl.sudo, "sudo", "", "", "Whether to elevate privileges using sudo when required (one of auto, always, never, default auto)")
+}
+
+func (r *cloneImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if r.output == "" {
+		return fmt.Errorf("the -o flag is empty, but required")
+	}
+	cfg, err := packer.Clone(args[0], r.output, r.sudo, stdout)
+	if err != nil {
+		return err
+	}
+	b, err := cfg.FormatForFile()
+	if err != nil {
+		return err
+	}
+	if r.configOut == "" {
+		_, err := stdout.Write(b)
+		return err
+	}
+	if err := os.WriteFile(r.configOut, b, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote the recovered instance config to %s\n", r.configOut)
+	return nil
+}
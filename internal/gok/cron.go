@@ -0,0 +1,104 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// cronCmd is gok cron.
+var cronCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "cron",
+	Short:   "Update to the latest patch versions and deploy if anything changed",
+	Long: `gok cron is meant to be run periodically (e.g. from cron or a systemd timer) to
+pick up security fixes. It:
+
+1. Updates all packages to their latest patch versions (go get -u=patch),
+2. compares the resulting SBOM hash (see gok sbom) with the SBOM hash of the
+   last update that gok cron deployed, and
+3. runs gok update only if the SBOM hash changed.
+
+The SBOM hash of the last deployed update is stored in cron-sbom-hash.txt in
+the instance directory.
+
+Examples:
+  % gok -i scanner cron
+
+  # systemd service for use with a timer unit (OnCalendar=daily):
+  [Service]
+  Type=oneshot
+  ExecStart=/usr/local/bin/gok -i scanner cron
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cronImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type cronImplConfig struct {
+	skipGet bool
+	force   bool
+}
+
+var cronImpl cronImplConfig
+
+func init() {
+	cronCmd.Flags().BoolVarP(&cronImpl.skipGet, "skip_get", "", false, "do not update packages, only deploy if the SBOM changed since the last deployment")
+	cronCmd.Flags().BoolVarP(&cronImpl.force, "force", "", false, "deploy an update even if the SBOM did not change")
+	instanceflag.RegisterPflags(cronCmd.Flags())
+}
+
+func (r *cronImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+
+	updateflag.SetUpdate("yes")
+
+	if !r.skipGet {
+		packages := append(getGokrazySystemPackages(cfg), cfg.Packages...)
+		if _, err := goGet(ctx, packages, "-u=patch"); err != nil {
+			return err
+		}
+	}
+
+	_, sbomWithHash, err := packer.GenerateSBOM(cfg)
+	if err != nil {
+		return err
+	}
+
+	hashPath := filepath.Join(config.InstancePath(), "cron-sbom-hash.txt")
+	b, err := os.ReadFile(hashPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if last := strings.TrimSpace(string(b)); last == sbomWithHash.SBOMHash && !r.force {
+		log.Printf("SBOM hash %s unchanged since the last deployment, not updating", last)
+		return nil
+	}
+
+	log.Printf("SBOM hash changed to %s, updating", sbomWithHash.SBOMHash)
+	if err := updateImpl.run(ctx, nil, stdout, stderr); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(hashPath, []byte(sbomWithHash.SBOMHash+"\n"), 0644); err != nil {
+		return fmt.Errorf("recording deployed SBOM hash: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package gok
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	internalpacker "github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/packer"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// doctorCmd is gok doctor.
+var doctorCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "doctor",
+	Short:   "Check the local environment for common problems",
+	Long: `gok doctor checks the local environment for common problems and prints how
+to fix them:
+
+- the Go toolchain version,
+- whether the packages of the instance are available in their build directories,
+- the CA certificate bundle which is included in the image,
+- permissions of the storage device (with --device),
+- available disk space, and
+- connectivity to the gokrazy instance (the update target).
+
+Examples:
+  % gok -i scanner doctor
+  % gok -i scanner doctor --device=/dev/sdx
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doctorImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type doctorImplConfig struct {
+	device string
+	sudo   string
+}
+
+var doctorImpl doctorImplConfig
+
+func init() {
+	doctorCmd.Flags().StringVarP(&doctorImpl.device, "device", "", "", "storage device (e.g. /dev/sdx) to check for write permissions")
+	doctorCmd.Flags().StringVarP(&doctorImpl.sudo, "sudo", "", "auto", "whether gok overwrite will be allowed to use sudo (one of auto, always, never)")
+	instanceflag.RegisterPflags(doctorCmd.Flags())
+}
+
+// minGoMinor is the oldest Go version (go1.<minGoMinor>) which gok supports
+// for building gokrazy instances.
+const minGoMinor = 19
+
+// minFreeSpace is the free disk space (in bytes) which building and writing
+// a full gokrazy image needs.
+const minFreeSpace = 2 * 1024 * 1024 * 1024
+
+type doctor struct {
+	w        io.Writer
+	problems int
+}
+
+func (d *doctor) ok(check, format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "[ ok ] %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(check, format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "[warn] %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// fail reports a problem. The fix (if any) is printed indented below the
+// problem.
+func (d *doctor) fail(check, problem, fix string) {
+	d.problems++
+	fmt.Fprintf(d.w, "[FAIL] %s: %s\n", check, problem)
+	if fix == "" {
+		return
+	}
+	for _, line := range strings.Split(fix, "\n") {
+		fmt.Fprintf(d.w, "         %s\n", line)
+	}
+}
+
+func (d *doctor) checkGo() {
+	out, err := exec.Command("go", "env", "GOVERSION").Output()
+	if err != nil {
+		d.fail("go", fmt.Sprintf("running go failed: %v", err),
+			"install Go from https://go.dev/dl/ and make sure it is in your $PATH")
+		return
+	}
+	version := strings.TrimSpace(string(out))
+	minor := -1
+	if rest := strings.TrimPrefix(version, "go1."); rest != version {
+		num := rest
+		if idx := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' }); idx > -1 {
+			num = rest[:idx]
+		}
+		minor, _ = strconv.Atoi(num)
+	}
+	if minor == -1 {
+		d.warn("go", "could not parse Go version %q", version)
+		return
+	}
+	if minor < minGoMinor {
+		d.fail("go", fmt.Sprintf("%s is too old", version),
+			fmt.Sprintf("install go1.%d or newer from https://go.dev/dl/", minGoMinor))
+		return
+	}
+	d.ok("go", "%s", version)
+}
+
+func (d *doctor) checkPackages(cfg *config.Struct) {
+	packages := append(getGokrazySystemPackages(cfg), cfg.Packages...)
+	var missing, notFetched int
+	for _, pkg := range packages {
+		buildDir := packer.BuildDir(pkg)
+		if _, err := os.Stat(filepath.Join(buildDir, "go.mod")); err != nil {
+			// gok overwrite and gok update create the build directory
+			notFetched++
+			continue
+		}
+		cmd := exec.Command("go", "list", "-e", "-f", "{{if .Error}}{{.Error}}{{end}}", pkg)
+		cmd.Dir = buildDir
+		cmd.Env = append(packer.Env(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+		out, err := cmd.Output()
+		if msg := strings.TrimSpace(string(out)); err != nil || msg != "" {
+			if msg == "" {
+				msg = err.Error()
+			}
+			missing++
+			d.fail("packages", fmt.Sprintf("%s: %s", pkg, msg),
+				fmt.Sprintf("run: gok -i %s get %s", instanceflag.Instance(), pkg))
+		}
+	}
+	if notFetched > 0 {
+		d.warn("packages", "%d of %d packages have no build directory yet, they will be downloaded on the first build (requires network access)", notFetched, len(packages))
+	}
+	if missing == 0 && notFetched == 0 {
+		d.ok("packages", "all %d packages are available", len(packages))
+	}
+}
+
+func (d *doctor) checkCerts() {
+	source, pem, err := internalpacker.SystemCerts()
+	if err != nil {
+		d.fail("ca-certificates", err.Error(),
+			"install your distribution’s ca-certificates package, or place a bundle in ~/.config/gokrazy/cacert.pem")
+		return
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(pem)) {
+		d.fail("ca-certificates", fmt.Sprintf("%s contains no certificates", source),
+			"install your distribution’s ca-certificates package, or place a bundle in ~/.config/gokrazy/cacert.pem")
+		return
+	}
+	d.ok("ca-certificates", "%s", source)
+}
+
+func (d *doctor) checkDevice(dev, sudo string) {
+	if err := internalpacker.CheckDeviceWritable(dev, "never"); err != nil {
+		if sudo != "never" && !errors.Is(err, internalpacker.ErrWriteProtected) {
+			d.warn("device", "%s is not writable by your user, gok overwrite will use sudo", dev)
+			return
+		}
+		d.fail("device", err.Error(), "")
+		return
+	}
+	d.ok("device", "%s is writable", dev)
+}
+
+func (d *doctor) checkDiskSpace(dirs ...string) {
+	for _, dir := range dirs {
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err != nil {
+			d.warn("disk space", "%s: %v", dir, err)
+			continue
+		}
+		free := uint64(st.Bavail) * uint64(st.Bsize)
+		if free < minFreeSpace {
+			d.fail("disk space", fmt.Sprintf("%s: only %d MB available", dir, free/1024/1024),
+				fmt.Sprintf("free up disk space (at least %d MB are needed for building and writing images)", minFreeSpace/1024/1024))
+			continue
+		}
+		d.ok("disk space", "%s: %d MB available", dir, free/1024/1024)
+	}
+}
+
+func (d *doctor) checkConnectivity(ctx context.Context, cfg *config.Struct) {
+	dev := &fleet.Device{Instance: instanceflag.Instance(), Config: cfg}
+	hc, baseURL, err := dev.HTTPClient()
+	if err != nil {
+		d.fail("update target", err.Error(), "check the Update section of your config.json (gok edit)")
+		return
+	}
+	st, err := fleet.FetchStatus(ctx, hc, baseURL)
+	if err != nil {
+		d.warn("update target", "%s: %v (only needed for gok update; is the device on and in the same network?)", cfg.Hostname, err)
+		return
+	}
+	d.ok("update target", "%s is reachable (model %q, uptime %s)", cfg.Hostname, st.Model, st.Uptime)
+}
+
+func (r *doctorImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	d := &doctor{w: stdout}
+	d.checkGo()
+	d.checkCerts()
+
+	dirs := []string{os.TempDir()}
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		d.warn("instance", "%v (skipping instance checks)", err)
+	} else {
+		if cfg.InternalCompatibilityFlags == nil {
+			cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+		}
+		dirs = append(dirs, config.InstancePath())
+		if err := os.Chdir(config.InstancePath()); err != nil {
+			return err
+		}
+		d.ok("instance", "%s", config.InstancePath())
+		if gopath := packer.IsolatedGOPATHDir(); gopath != "" {
+			d.ok("gopath", "using isolated GOPATH %s", gopath)
+		}
+		d.checkPackages(cfg)
+		d.checkConnectivity(ctx, cfg)
+	}
+	d.checkDiskSpace(dirs...)
+
+	if r.device != "" {
+		d.checkDevice(r.device, r.sudo)
+	}
+
+	if d.problems > 0 {
+		return fmt.Errorf("found %d problem(s)", d.problems)
+	}
+	return nil
+}
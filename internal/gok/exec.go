@@ -0,0 +1,104 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// execCmd is gok exec.
+var execCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "exec -- <command> [args...]",
+	Short:   "Run one command on a running gokrazy instance (recovery)",
+	Long: `gok exec runs one command on a running gokrazy instance and displays its
+output and exit status, for emergency diagnostics on devices where nothing else
+(e.g. breakglass) is reachable.
+
+This requires packing the instance with --remote_exec. Commands are
+authenticated with the gokrazy password and, if the instance uses TLS, sent
+encrypted with the same certificate as updates.
+
+Examples:
+  % gok -i scanner exec -- /user/dmesg
+  % gok -i scanner exec --timeout=5m -- /user/busybox df -h
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return execImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type execImplConfig struct {
+	timeout time.Duration
+}
+
+var execImpl execImplConfig
+
+func init() {
+	execCmd.Flags().DurationVarP(&execImpl.timeout, "timeout", "", time.Minute, "kill the command on the device after this duration")
+	instanceflag.RegisterPflags(execCmd.Flags())
+}
+
+func (r *execImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// best-effort compatibility for old setups
+			cfg = config.NewStruct(instanceflag.Instance())
+		} else {
+			return err
+		}
+	}
+
+	updateflag.SetUpdate("yes")
+
+	httpClient, _, baseUrl, err := httpclient.For(cfg)
+	if err != nil {
+		return err
+	}
+	execUrl := packer.RemoteExecURL(baseUrl, "/exec")
+	form := url.Values{
+		"arg":     args,
+		"timeout": []string{r.timeout.String()},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", execUrl.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%v (was the instance packed with --remote_exec?)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status: %v: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if _, err := io.Copy(stdout, resp.Body); err != nil {
+		return err
+	}
+	// The trailer is only available once the body was read.
+	status, err := strconv.Atoi(resp.Trailer.Get(packer.RemoteExecStatusTrailer))
+	if err != nil {
+		return fmt.Errorf("no exit status received (connection lost?)")
+	}
+	if status != 0 {
+		return fmt.Errorf("%q exited with status %d", args, status)
+	}
+	return nil
+}
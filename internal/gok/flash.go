@@ -0,0 +1,72 @@
+package gok
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/i18n"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// flashCmd is gok flash.
+var flashCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "flash <image> <device>",
+	Short:   "Write an image created with gok overwrite --shrink to a storage device",
+	Long: `Write an image created with gok overwrite --shrink to a storage device.
+
+Shrunk images only contain the partition table, the boot file system and the
+root file system, which makes them small to store and distribute. gok flash
+creates the partition table for the size of the storage device, so that the
+perm partition fills the rest of the device.
+
+Before writing, gok flash verifies the files of the boot file system (kernel,
+cmdline.txt, …) against the boot manifest (/boot.sha256) in the image.
+
+The device usbboot: selects the eMMC of a Raspberry Pi Compute Module (e.g. a
+CM4) in usbboot mode: gok flash waits for it, runs rpiboot (from
+https://github.com/raspberrypi/usbboot, usbboot:<dir> passes rpiboot -d <dir>)
+and writes to its eMMC once it appears as mass storage device.
+
+Examples:
+  % gok -i scan2drive overwrite --full=/tmp/scan2drive.img --shrink
+  % gok flash /tmp/scan2drive.img /dev/sdx
+  % gok flash /tmp/scan2drive.img usbboot:
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return flashImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type flashImplConfig struct {
+	sudo          string
+	deviceSync    string
+	deviceRetries int
+	hints         bool
+}
+
+var flashImpl flashImplConfig
+
+func init() {
+	flashCmd.Flags().StringVarP(&flashImpl.sudo, "sudo", "", "", "Whether to elevate privileges using sudo when required (one of auto, always, never, default auto)")
+	flashCmd.Flags().StringVarP(&flashImpl.deviceSync, "device_sync", "", "", "sync policy when writing to a storage device, one of "+strings.Join(packer.DeviceSyncPolicies(), ", ")+": end (default) syncs once all data is written, so that the device can be unplugged right away; buffer also calls fdatasync after each write buffer, which keeps the progress accurate and the final sync short; none leaves flushing to the kernel")
+	flashCmd.Flags().BoolVarP(&flashImpl.hints, "hints", "", true, "print instructions for the next steps (e.g. how to boot the device). Disable for quiet output in scripts")
+	flashCmd.Flags().IntVarP(&flashImpl.deviceRetries, "device_retries", "", 3, "how often to retry a write to a storage device which failed with an I/O error (with exponential backoff, starting at 100ms) before giving up. Cheap card readers sporadically fail writes")
+}
+
+func (r *flashImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	image, dev := args[0], args[1]
+	err := packer.Flash(image, dev, r.sudo, r.deviceSync, r.deviceRetries, !r.hints)
+	packer.RecordFlash(image, dev, err)
+	if err != nil {
+		return err
+	}
+	if !r.hints {
+		return nil
+	}
+	i18n.Fprintf(stdout, "To boot gokrazy, plug the SD card into a supported device (see https://gokrazy.org/platforms/)\n")
+	return nil
+}
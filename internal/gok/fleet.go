@@ -0,0 +1,332 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// fleetCmd is gok fleet.
+var fleetCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "fleet",
+	Short:   "Work with multiple gokrazy instances at once",
+	Long: `The fleet subcommands operate on all gokrazy instances in the parent
+directory (see --parent_dir), or the subset selected by --target.
+
+Instances can be tagged by listing one tag per line in a tags.txt file in the
+instance directory.
+
+--target accepts selector expressions, combining terms with not, and, or and
+parentheses. Terms are of the form:
+
+  tag:<pattern>       matches instances with a matching tag (from tags.txt)
+  host:<pattern>      matches the configured hostname
+  instance:<pattern>  matches the instance name (the key can be omitted)
+  model:<pattern>     matches the configured device type (e.g. odroidhc1)
+
+Patterns may contain glob wildcards like *.
+
+Examples:
+  # list all instances tagged kitchen that run on an ODROID-HC1
+  % gok fleet list --target='tag:kitchen and model:odroidhc1'
+
+  # update all instances tagged kitchen, one after the other, stopping when
+  # the health checks of the first (canary) instance fail
+  % gok fleet update --target=tag:kitchen
+
+  # review which instances an update would change, then execute exactly that
+  % gok fleet plan --target=tag:kitchen --out=kitchen.plan.json
+  % gok fleet apply kitchen.plan.json
+`,
+}
+
+// fleetTarget is the --target selector expression shared by all gok fleet
+// subcommands.
+var fleetTarget string
+
+func selectFleet() ([]*fleet.Device, error) {
+	return fleet.Select(instanceflag.ParentDir(), fleetTarget)
+}
+
+// fleetListCmd is gok fleet list.
+var fleetListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the gokrazy instances selected by --target",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetListImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetListImplConfig struct {
+	names bool
+}
+
+var fleetListImpl fleetListImplConfig
+
+func init() {
+	fleetCmd.PersistentFlags().StringVarP(&fleetTarget, "target", "", "", "selector expression, e.g. 'tag:kitchen and not host:scan*' (default: all instances)")
+	instanceflag.RegisterPflags(fleetCmd.PersistentFlags())
+
+	fleetListCmd.Flags().BoolVarP(&fleetListImpl.names, "names", "", false, "print only the instance names, one per line (for use in shell scripts)")
+	fleetCmd.AddCommand(fleetListCmd)
+}
+
+func (r *fleetListImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	devices, err := selectFleet()
+	if err != nil {
+		return err
+	}
+	if r.names {
+		for _, dev := range devices {
+			fmt.Fprintln(stdout, dev.Instance)
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tHOSTNAME\tMODEL\tTAGS\n")
+	for _, dev := range devices {
+		model := dev.Model()
+		if model == "" {
+			model = "(default)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			dev.Instance,
+			dev.Config.Hostname,
+			model,
+			strings.Join(dev.Tags, ","))
+	}
+	return tw.Flush()
+}
+
+// fleetStatusCmd is gok fleet status.
+var fleetStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Poll the gokrazy instances selected by --target and display their status",
+	Long: `gok fleet status concurrently requests the status of all selected gokrazy
+instances and prints one line per instance.
+
+The ROOT column shows the root partition which the instance runs from, and
+PENDING the root partition it boots from after its next reboot, if different
+(e.g. after gok update --testboot). The HEALTH column shows the results of the
+health checks declared in the ` + healthcheck.File + ` file of each instance
+directory (see gok update --health_checks), or - if there is none.
+
+Examples:
+  # display the status of all instances tagged kitchen
+  % gok fleet status --target=tag:kitchen
+
+  # refresh the display every 10 seconds until interrupted
+  % gok fleet status --watch=10s
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetStatusImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetStatusImplConfig struct {
+	watch time.Duration
+}
+
+var fleetStatusImpl fleetStatusImplConfig
+
+func init() {
+	fleetStatusCmd.Flags().DurationVarP(&fleetStatusImpl.watch, "watch", "", 0, "if non-zero, poll continuously in this interval (e.g. 10s) and refresh the display")
+	fleetCmd.AddCommand(fleetStatusCmd)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// partition formats a root partition number of the status JSON.
+func partition(num int) string {
+	if num == 0 {
+		return "-"
+	}
+	return strconv.Itoa(num)
+}
+
+// healthSummary formats the results of the health checks of an instance.
+func healthSummary(results []healthcheck.Result) string {
+	if len(results) == 0 {
+		return "-"
+	}
+	var failed []string
+	for _, res := range results {
+		if res.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s: %v", res.Service, res.Check, res.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return "ok"
+	}
+	return fmt.Sprintf("%d of %d failing: %s", len(failed), len(results), strings.Join(failed, "; "))
+}
+
+func printFleetStatus(w io.Writer, results []fleet.DeviceStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tHOSTNAME\tMODEL\tBUILD\tUPTIME\tROOT\tPENDING\tHEALTH\n")
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\tunreachable: %v\n",
+				res.Device.Instance,
+				res.Device.Config.Hostname,
+				res.Err)
+			continue
+		}
+		st := res.Status
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			res.Device.Instance,
+			res.Device.Config.Hostname,
+			orDash(st.Model),
+			orDash(st.BuildTimestamp),
+			orDash(st.Uptime),
+			partition(st.ActiveRoot),
+			partition(st.PendingRoot),
+			healthSummary(res.Health))
+	}
+	return tw.Flush()
+}
+
+func (r *fleetStatusImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	devices, err := selectFleet()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no instances match --target=%q in %s", fleetTarget, instanceflag.ParentDir())
+	}
+	for {
+		results := fleet.PollAll(ctx, devices)
+		if r.watch > 0 {
+			// Clear the terminal and move the cursor to the top left.
+			fmt.Fprintf(stdout, "\033[H\033[2J")
+			fmt.Fprintf(stdout, "%s (every %v)\n\n", time.Now().Format(time.RFC3339), r.watch)
+		}
+		if err := printFleetStatus(stdout, results); err != nil {
+			return err
+		}
+		if r.watch == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.watch):
+		}
+	}
+}
+
+// fleetDriftCmd is gok fleet drift.
+var fleetDriftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Report gokrazy instances whose running build differs from their config",
+	Long: `gok fleet drift compares the SBOM hash reported by each selected gokrazy
+instance with the SBOM hash that gok update would produce from the current
+instance config (see gok sbom).
+
+Instances reporting a different hash need an update. gok fleet drift exits
+with an error if any instance drifted or could not be checked.
+
+Examples:
+  # which instances tagged kitchen need an update after a config change?
+  % gok fleet drift --target=tag:kitchen
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetDriftImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetDriftImplConfig struct{}
+
+var fleetDriftImpl fleetDriftImplConfig
+
+func init() {
+	fleetCmd.AddCommand(fleetDriftCmd)
+}
+
+// wantSBOMHash returns the SBOM hash that building dev, an instance in
+// parentDir, would result in.
+func wantSBOMHash(parentDir string, dev *fleet.Device) (string, error) {
+	_, sbomWithHash, err := packer.GenerateInstanceSBOM(parentDir, dev.Instance, dev.Config)
+	if err != nil {
+		return "", err
+	}
+	return sbomWithHash.SBOMHash, nil
+}
+
+func (r *fleetDriftImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	devices, err := selectFleet()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no instances match --target=%q in %s", fleetTarget, instanceflag.ParentDir())
+	}
+	want := make([]string, len(devices))
+	wantErr := make([]error, len(devices))
+	for idx, dev := range devices {
+		want[idx], wantErr[idx] = wantSBOMHash(instanceflag.ParentDir(), dev)
+	}
+	results := fleet.PollAll(ctx, devices)
+	drifted, failed, err := printFleetDrift(stdout, results, want, wantErr)
+	if err != nil {
+		return err
+	}
+	if drifted > 0 || failed > 0 {
+		return fmt.Errorf("%d of %d instances drifted, %d could not be checked", drifted, len(devices), failed)
+	}
+	return nil
+}
+
+// printFleetDrift prints the SBOM hash which each device reports next to the
+// SBOM hash of its config (want, or the error in wantErr) and returns how many
+// devices drifted and how many could not be checked.
+func printFleetDrift(w io.Writer, results []fleet.DeviceStatus, want []string, wantErr []error) (drifted, failed int, _ error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tHOSTNAME\tRUNNING\tCONFIG\tSTATE\n")
+	for idx, res := range results {
+		var state string
+		have := "-"
+		if res.Status != nil {
+			have = orDash(res.Status.SBOMHash)
+		}
+		switch {
+		case wantErr[idx] != nil:
+			failed++
+			state = fmt.Sprintf("error: %v", wantErr[idx])
+		case res.Err != nil:
+			failed++
+			state = fmt.Sprintf("unreachable: %v", res.Err)
+		case res.Status.SBOMHash == "":
+			failed++
+			state = "unknown (device does not report its SBOM hash)"
+		case res.Status.SBOMHash != want[idx]:
+			drifted++
+			state = "drifted"
+		default:
+			state = "up to date"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			res.Device.Instance,
+			res.Device.Config.Hostname,
+			have,
+			orDash(want[idx]),
+			state)
+	}
+	return drifted, failed, tw.Flush()
+}
@@ -0,0 +1,151 @@
+package gok
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/fakedevice"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/google/go-cmp/cmp"
+)
+
+// pollFakeFleet serves each fake device via HTTP and polls them like gok fleet
+// status does, with the health checks (by hostname). The instance of the last
+// device is offline.
+func pollFakeFleet(t *testing.T, checks map[string]map[string][]healthcheck.Check, devs ...*fakedevice.Device) []fleet.DeviceStatus {
+	// Keep the stored passwords and certificates of the user out of the test.
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	var devices []*fleet.Device
+	for idx, dev := range devs {
+		srv := httptest.NewServer(dev)
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := u.Port()
+		if idx == len(devs)-1 {
+			port = "1" // nothing listens on port 1
+		}
+		devices = append(devices, &fleet.Device{
+			Instance: dev.Hostname,
+			Config: &config.Struct{
+				Hostname: dev.Hostname,
+				Update: &config.UpdateStruct{
+					Hostname:     u.Hostname(),
+					HTTPPort:     port,
+					HTTPPassword: dev.Password,
+				},
+			},
+			HealthChecks: checks[dev.Hostname],
+		})
+	}
+	return fleet.PollAll(context.Background(), devices)
+}
+
+// tableRows splits the output of a tabwriter table into rows of fields. Only
+// the first word of the last column is kept, as error messages vary.
+func tableRows(out string) [][]string {
+	var rows [][]string
+	var columns int
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if columns == 0 {
+			columns = len(fields) // header
+		}
+		if len(fields) > columns {
+			fields = fields[:columns]
+		}
+		rows = append(rows, fields)
+	}
+	return rows
+}
+
+func TestFleetStatus(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	listening := healthcheck.Check{Type: "tcp", Port: ln.Addr().(*net.TCPAddr).Port}
+	failing := healthcheck.Check{Type: "command", Command: []string{"false"}}
+
+	scanner := fakedevice.New("scanner")
+	scanner.Password = "scannerpw"
+	scanner.Model = "rpi4"
+	scanner.BuildTimestamp = "2023-06-01T12:00:00Z"
+	// router was updated, but not yet rebooted.
+	router := fakedevice.New("router")
+	router.Model = "rpi4"
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	if _, err := srv.Client().Post(srv.URL+"/update/switch", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	old := fakedevice.New("old")
+	old.Model = "rpi3"
+	results := pollFakeFleet(t, map[string]map[string][]healthcheck.Check{
+		"scanner": {"scan2drive": {listening}},
+		"router":  {"router7": {listening, failing}},
+	}, scanner, router, old, fakedevice.New("offline"))
+
+	var out strings.Builder
+	if err := printFleetStatus(&out, results); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"INSTANCE", "HOSTNAME", "MODEL", "BUILD", "UPTIME", "ROOT", "PENDING", "HEALTH"},
+		{"scanner", "scanner", "rpi4", "2023-06-01T12:00:00Z", "1m", "2", "-", "ok"},
+		{"router", "router", "rpi4", router.BuildTimestamp, "1m", "2", "3", "1"},
+		{"old", "old", "rpi3", old.BuildTimestamp, "1m", "2", "-", "-"},
+		{"offline", "offline", "-", "-", "-", "-", "-", "unreachable:"},
+	}
+	if diff := cmp.Diff(want, tableRows(out.String())); diff != "" {
+		t.Errorf("printFleetStatus: unexpected output (-want +got):\n%s", diff)
+	}
+	if want := "1 of 2 failing: router7: command:false: "; !strings.Contains(out.String(), want) {
+		t.Errorf("printFleetStatus: output does not contain %q:\n%s", want, out.String())
+	}
+}
+
+func TestFleetDrift(t *testing.T) {
+	current := fakedevice.New("current")
+	current.SBOMHash = "aaa"
+	outdated := fakedevice.New("outdated")
+	outdated.SBOMHash = "bbb"
+	old := fakedevice.New("old") // does not report its SBOM hash
+	broken := fakedevice.New("broken")
+	broken.SBOMHash = "ccc"
+	results := pollFakeFleet(t, nil, current, outdated, old, broken, fakedevice.New("offline"))
+
+	want := []string{"aaa", "aaa", "aaa", "", "aaa"}
+	wantErr := []error{nil, nil, nil, errors.New("no go.mod"), nil}
+	var out strings.Builder
+	drifted, failed, err := printFleetDrift(&out, results, want, wantErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifted != 1 || failed != 3 {
+		t.Errorf("printFleetDrift = %d drifted, %d failed, want 1 drifted, 3 failed", drifted, failed)
+	}
+	wantRows := [][]string{
+		{"INSTANCE", "HOSTNAME", "RUNNING", "CONFIG", "STATE"},
+		{"current", "current", "aaa", "aaa", "up"},
+		{"outdated", "outdated", "bbb", "aaa", "drifted"},
+		{"old", "old", "-", "aaa", "unknown"},
+		{"broken", "broken", "ccc", "-", "error:"},
+		{"offline", "offline", "-", "aaa", "unreachable:"},
+	}
+	if diff := cmp.Diff(wantRows, tableRows(out.String())); diff != "" {
+		t.Errorf("printFleetDrift: unexpected output (-want +got):\n%s", diff)
+	}
+}
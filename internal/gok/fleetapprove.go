@@ -0,0 +1,131 @@
+package gok
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/spf13/cobra"
+)
+
+// approvalSigner returns the operator's approval key and their name in the
+// approvers.txt file of the parent directory.
+func approvalSigner() (ed25519.PrivateKey, string, error) {
+	key, err := fleet.ApprovalKey()
+	if err != nil {
+		return nil, "", err
+	}
+	approvers, err := fleet.ReadApprovers(instanceflag.ParentDir())
+	if err != nil {
+		return nil, "", err
+	}
+	pub := fleet.ApprovalPublicKey(key)
+	signer, ok := approvers[pub]
+	if !ok {
+		return nil, "", fmt.Errorf("your approval key %s is not listed in %s (see gok fleet key)", pub, fleet.ApproversFile)
+	}
+	return key, signer, nil
+}
+
+// fleetApproveCmd is gok fleet approve.
+var fleetApproveCmd = &cobra.Command{
+	Use:   "approve <plan file>",
+	Short: "Countersign a fleet update plan created with gok fleet update --require_approval",
+	Long: `gok fleet approve prints the rollout of a fleet update plan (see gok fleet
+update --require_approval) and signs it with your approval key, so that it can
+be executed with gok fleet update --plan=<file>. Review the plan (and the
+changes to the instance configs) before approving it: the plan's author cannot
+approve it a second time.
+
+Examples:
+  % gok fleet approve kitchen.plan.json
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetApproveImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetApproveImplConfig struct{}
+
+var fleetApproveImpl fleetApproveImplConfig
+
+func init() {
+	fleetCmd.AddCommand(fleetApproveCmd)
+}
+
+func (r *fleetApproveImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	path := args[0]
+	plan, err := fleet.ReadPlan(path)
+	if err != nil {
+		return err
+	}
+	key, signer, err := approvalSigner()
+	if err != nil {
+		return err
+	}
+	approvers, err := fleet.ReadApprovers(instanceflag.ParentDir())
+	if err != nil {
+		return err
+	}
+	names, err := plan.Approvers(approvers)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%s is not signed by its author", path)
+	}
+	var instances []string
+	for _, inst := range plan.Instances {
+		instances = append(instances, inst.Instance)
+	}
+	fmt.Fprintf(stdout, "Plan %s by %s, created %s:\n", path, strings.Join(names, ", "), plan.Created.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(stdout, "  --target=%q, %d canaries, canary soak %s\n", plan.Target, plan.Canary, orDash(plan.CanarySoak))
+	fmt.Fprintf(stdout, "  instances: %s\n", strings.Join(instances, ", "))
+	if err := plan.Sign(signer, key); err != nil {
+		return err
+	}
+	if err := fleet.WritePlan(path, plan); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Approved as %s\n", signer)
+	return nil
+}
+
+// fleetKeyCmd is gok fleet key.
+var fleetKeyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Print your approval key for the approvers.txt file",
+	Long: `gok fleet key prints a line for the approvers.txt file in the parent
+directory with the public part of your approval key (which is generated on
+first use), so that your signatures count for gok fleet update
+--require_approval and gok fleet approve.
+
+Examples:
+  % gok fleet key >> ~/gokrazy/approvers.txt
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := fleet.ApprovalKey()
+		if err != nil {
+			return err
+		}
+		name := os.Getenv("USER")
+		if name == "" {
+			name = "operator"
+		}
+		if hostname, err := os.Hostname(); err == nil {
+			name += "@" + hostname
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s %s\n", name, fleet.ApprovalPublicKey(key))
+		return nil
+	},
+}
+
+func init() {
+	fleetCmd.AddCommand(fleetKeyCmd)
+}
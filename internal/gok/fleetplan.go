@@ -0,0 +1,218 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/spf13/cobra"
+)
+
+// fleetPlanCmd is gok fleet plan.
+var fleetPlanCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Save which gokrazy instances selected by --target a fleet update would change",
+	Long: `gok fleet plan compares the build that each selected gokrazy instance runs
+with the build that gok update would produce from the current instance config
+(see gok fleet drift), prints the differences and saves the instances which
+need an update, in order, into the --out plan file.
+
+The plan can be reviewed (it is JSON) and is executed with gok fleet apply.
+Applying a plan updates exactly the planned instances to exactly the planned
+builds: gok fleet apply refuses to run if an instance config or the resulting
+build changed since the plan was created. Instances which already run their
+planned build are skipped, so a plan can be applied again after fixing a
+failed rollout.
+
+Examples:
+  % gok fleet plan --target=tag:kitchen --canary_soak=10m --out=kitchen.plan.json
+  % gok fleet apply kitchen.plan.json
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetPlanImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetPlanImplConfig struct {
+	out        string
+	canary     int
+	canarySoak time.Duration
+}
+
+var fleetPlanImpl fleetPlanImplConfig
+
+func init() {
+	fleetPlanCmd.Flags().StringVarP(&fleetPlanImpl.out, "out", "", "", "plan file to write (e.g. kitchen.plan.json)")
+	fleetPlanCmd.Flags().IntVarP(&fleetPlanImpl.canary, "canary", "", 1, "number of instances to update first, as canaries")
+	fleetPlanCmd.Flags().DurationVarP(&fleetPlanImpl.canarySoak, "canary_soak", "", 0, "how long the canaries need to stay healthy (e.g. 10m) before updating the remaining instances")
+	fleetCmd.AddCommand(fleetPlanCmd)
+}
+
+func (r *fleetPlanImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if r.out == "" {
+		return fmt.Errorf("--out is required")
+	}
+	devices, err := selectFleet()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no instances match --target=%q in %s", fleetTarget, instanceflag.ParentDir())
+	}
+	want := make([]string, len(devices))
+	for idx, dev := range devices {
+		want[idx], err = wantSBOMHash(instanceflag.ParentDir(), dev)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dev.Instance, err)
+		}
+	}
+	results := fleet.PollAll(ctx, devices)
+
+	var (
+		planned  []*fleet.Device
+		running  []string
+		sbomHash []string
+		failed   int
+	)
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INSTANCE\tHOSTNAME\tRUNNING\tPLANNED\tACTION\n")
+	for idx, res := range results {
+		var action string
+		have := "-"
+		if res.Status != nil {
+			have = orDash(res.Status.SBOMHash)
+		}
+		switch {
+		case res.Err != nil:
+			failed++
+			action = fmt.Sprintf("unreachable: %v", res.Err)
+		case res.Status.SBOMHash == want[idx]:
+			action = "none (up to date)"
+		default:
+			action = "update"
+			if res.Status.SBOMHash == "" {
+				action = "update (device does not report its SBOM hash)"
+			}
+			planned = append(planned, res.Device)
+			running = append(running, res.Status.SBOMHash)
+			sbomHash = append(sbomHash, want[idx])
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			res.Device.Instance,
+			res.Device.Config.Hostname,
+			have,
+			want[idx],
+			action)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d instances could not be reached; bring them online or exclude them with --target", failed, len(devices))
+	}
+	if len(planned) == 0 {
+		fmt.Fprintf(stdout, "\nAll %d instances are up to date, not writing a plan\n", len(devices))
+		return nil
+	}
+
+	plan, err := fleet.NewPlan(fleetTarget, planned, r.canary, r.canarySoak)
+	if err != nil {
+		return err
+	}
+	for idx := range plan.Instances {
+		plan.Instances[idx].Running = running[idx]
+		plan.Instances[idx].SBOMHash = sbomHash[idx]
+	}
+	if err := fleet.WritePlan(r.out, plan); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "\nPlan: %d to update, %d up to date. Saved to %s\n", len(planned), len(devices)-len(planned), r.out)
+	fmt.Fprintf(stdout, "Apply it with: gok fleet apply %s\n", r.out)
+	return nil
+}
+
+// fleetApplyCmd is gok fleet apply.
+var fleetApplyCmd = &cobra.Command{
+	Use:   "apply <plan file>",
+	Short: "Execute a fleet update plan created with gok fleet plan",
+	Long: `gok fleet apply updates the instances of a plan created with gok fleet plan,
+in the plan's order and with the plan's canary settings (see gok fleet update).
+
+Examples:
+  % gok fleet apply kitchen.plan.json
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetApplyImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetApplyImplConfig struct {
+	healthCheckTimeout time.Duration
+}
+
+var fleetApplyImpl fleetApplyImplConfig
+
+func init() {
+	fleetApplyCmd.Flags().DurationVarP(&fleetApplyImpl.healthCheckTimeout, "health_check_timeout", "", 2*time.Minute, "how long to wait for the health checks to pass")
+	fleetCmd.AddCommand(fleetApplyCmd)
+}
+
+func (r *fleetApplyImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	path := args[0]
+	plan, err := fleet.ReadPlan(path)
+	if err != nil {
+		return err
+	}
+	devices, err := plan.Devices(instanceflag.ParentDir())
+	if err != nil {
+		return err
+	}
+	if err := plan.CheckConfigs(devices); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for idx, inst := range plan.Instances {
+		if inst.SBOMHash == "" {
+			return fmt.Errorf("%s was not created by gok fleet plan (use gok fleet update --plan)", path)
+		}
+		got, err := wantSBOMHash(instanceflag.ParentDir(), devices[idx])
+		if err != nil {
+			return fmt.Errorf("%s: %v", inst.Instance, err)
+		}
+		if got != inst.SBOMHash {
+			return fmt.Errorf("the build of %s changed after the plan was created (SBOM hash %s, planned %s); create a new plan", inst.Instance, got, inst.SBOMHash)
+		}
+	}
+
+	// Skip the instances which already run their planned build, e.g. when
+	// applying a plan again after a failed rollout.
+	var pending []*fleet.Device
+	for idx, res := range fleet.PollAll(ctx, devices) {
+		if res.Err == nil && res.Status.SBOMHash == plan.Instances[idx].SBOMHash {
+			fmt.Fprintf(stdout, "%s already runs its planned build, skipping\n", res.Device.Instance)
+			continue
+		}
+		pending = append(pending, res.Device)
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(stdout, "All %d planned instances are up to date\n", len(devices))
+		return nil
+	}
+
+	update := fleetUpdateImplConfig{
+		canary:             plan.Canary,
+		healthCheckTimeout: r.healthCheckTimeout,
+	}
+	if plan.CanarySoak != "" {
+		update.canarySoak, err = time.ParseDuration(plan.CanarySoak)
+		if err != nil {
+			return fmt.Errorf("%s: CanarySoak: %v", path, err)
+		}
+	}
+	fmt.Fprintf(stdout, "Applying plan %s (--target=%q): updating %d of %d instances\n", path, plan.Target, len(pending), len(devices))
+	return update.rollout(ctx, pending, stdout, stderr)
+}
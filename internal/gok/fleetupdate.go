@@ -0,0 +1,263 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/fleet"
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/spf13/cobra"
+)
+
+// fleetUpdateCmd is gok fleet update.
+var fleetUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update the gokrazy instances selected by --target, canaries first",
+	Long: `gok fleet update runs gok update for each selected gokrazy instance, one
+after the other.
+
+The first --canary instances are canaries: after updating them (and waiting
+--canary_soak), their health checks (see gok update --health_checks) need to
+pass again before the remaining instances are updated. The rollout stops at
+the first instance whose update or health checks fail.
+
+For change control, --require_approval only writes the rollout (the selected
+instances, in order, with the hash of their config.json, and the canary
+settings) into a plan file signed by you. A second operator countersigns it
+with gok fleet approve, after which --plan=<file> executes it. Both need to be
+listed in approvers.txt in the parent directory (see gok fleet key).
+
+With --artifact_cache, the updates store the root file system files in a
+shared content-addressed directory, so that files which are identical across
+instances (e.g. binaries of the same packages) are stored only once.
+
+Examples:
+  # update all instances tagged kitchen, starting with one canary which
+  # needs to stay healthy for 10 minutes
+  % gok fleet update --target=tag:kitchen --canary=1 --canary_soak=10m
+
+  # the same, with approval by a second operator
+  % gok fleet update --target=tag:kitchen --canary_soak=10m --require_approval --plan=kitchen.plan.json
+  % gok fleet approve kitchen.plan.json   # second operator
+  % gok fleet update --plan=kitchen.plan.json
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fleetUpdateImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type fleetUpdateImplConfig struct {
+	canary             int
+	canarySoak         time.Duration
+	healthCheckTimeout time.Duration
+	requireApproval    bool
+	plan               string
+	artifactCache      string
+}
+
+var fleetUpdateImpl fleetUpdateImplConfig
+
+func init() {
+	fleetUpdateCmd.Flags().IntVarP(&fleetUpdateImpl.canary, "canary", "", 1, "number of instances to update first, as canaries")
+	fleetUpdateCmd.Flags().DurationVarP(&fleetUpdateImpl.canarySoak, "canary_soak", "", 0, "how long the canaries need to stay healthy (e.g. 10m) before updating the remaining instances")
+	fleetUpdateCmd.Flags().DurationVarP(&fleetUpdateImpl.healthCheckTimeout, "health_check_timeout", "", 2*time.Minute, "how long to wait for the health checks to pass")
+	fleetUpdateCmd.Flags().BoolVarP(&fleetUpdateImpl.requireApproval, "require_approval", "", false, "instead of updating, write the rollout into the --plan file, signed by you, for approval by a second operator (see gok fleet approve)")
+	fleetUpdateCmd.Flags().StringVarP(&fleetUpdateImpl.plan, "plan", "", "", "plan file to write (with --require_approval) or to execute once approved. When executing a plan, --target, --canary and --canary_soak are taken from the plan")
+	fleetUpdateCmd.Flags().StringVarP(&fleetUpdateImpl.artifactCache, "artifact_cache", "", "", "directory in which the updates of all instances store the root file system files content-addressed (see gok update --artifact_cache), so that identical build artifacts are stored only once")
+	fleetCmd.AddCommand(fleetUpdateCmd)
+}
+
+// updateHost returns the host name under which gok update reaches dev.
+func updateHost(dev *fleet.Device) string {
+	if dev.Config.Update != nil && dev.Config.Update.Hostname != "" {
+		return dev.Config.Update.Hostname
+	}
+	return dev.Config.Hostname
+}
+
+// readHealthChecks reads the health checks of dev, if it declares any.
+func readHealthChecks(dev *fleet.Device) (map[string][]healthcheck.Check, error) {
+	checks, err := healthcheck.ReadFile(filepath.Join(instanceflag.ParentDir(), dev.Instance, healthcheck.File))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return checks, err
+}
+
+// updateDevice runs gok update for dev in a child process, which fails if the
+// health checks of dev do not pass after the update.
+func (r *fleetUpdateImplConfig) updateDevice(ctx context.Context, dev *fleet.Device, stdout, stderr io.Writer) error {
+	gok, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--parent_dir=" + instanceflag.ParentDir(),
+		"-i", dev.Instance,
+		"update",
+		"--health_check_timeout=" + r.healthCheckTimeout.String(),
+	}
+	if r.artifactCache != "" {
+		args = append(args, "--artifact_cache="+r.artifactCache)
+	}
+	update := exec.CommandContext(ctx, gok, args...)
+	update.Stdout = stdout
+	update.Stderr = stderr
+	if err := update.Run(); err != nil {
+		return fmt.Errorf("%v: %v", update.Args, err)
+	}
+	return nil
+}
+
+// writePlan writes the rollout of devices into the --plan file, signed by the
+// operator, for gok fleet approve.
+func (r *fleetUpdateImplConfig) writePlan(devices []*fleet.Device, stdout io.Writer) error {
+	if r.plan == "" {
+		return fmt.Errorf("--require_approval needs a --plan file to write")
+	}
+	key, signer, err := approvalSigner()
+	if err != nil {
+		return err
+	}
+	plan, err := fleet.NewPlan(fleetTarget, devices, r.canary, r.canarySoak)
+	if err != nil {
+		return err
+	}
+	if err := plan.Sign(signer, key); err != nil {
+		return err
+	}
+	if err := fleet.WritePlan(r.plan, plan); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote plan for updating %d instances to %s, signed by %s\n", len(devices), r.plan, signer)
+	fmt.Fprintf(stdout, "A second operator needs to approve it with: gok fleet approve %s\n", r.plan)
+	fmt.Fprintf(stdout, "Then execute it with: gok fleet update --plan=%s\n", r.plan)
+	return nil
+}
+
+// planDevices returns the devices of the approved --plan file and applies its
+// rollout settings.
+func (r *fleetUpdateImplConfig) planDevices(stdout io.Writer) ([]*fleet.Device, error) {
+	plan, err := fleet.ReadPlan(r.plan)
+	if err != nil {
+		return nil, err
+	}
+	parentDir := instanceflag.ParentDir()
+	approvers, err := fleet.ReadApprovers(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := plan.Devices(parentDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.Verify(approvers, devices); err != nil {
+		return nil, fmt.Errorf("%s: %v", r.plan, err)
+	}
+	names, err := plan.Approvers(approvers)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(stdout, "Executing plan %s (--target=%q), approved by %s\n", r.plan, plan.Target, strings.Join(names, ", "))
+	r.canary = plan.Canary
+	r.canarySoak = 0
+	if plan.CanarySoak != "" {
+		r.canarySoak, err = time.ParseDuration(plan.CanarySoak)
+		if err != nil {
+			return nil, fmt.Errorf("%s: CanarySoak: %v", r.plan, err)
+		}
+	}
+	return devices, nil
+}
+
+func (r *fleetUpdateImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var devices []*fleet.Device
+	var err error
+	if r.artifactCache != "" {
+		// The updates run in the instance directories.
+		r.artifactCache, err = filepath.Abs(r.artifactCache)
+		if err != nil {
+			return err
+		}
+	}
+	if r.plan != "" && !r.requireApproval {
+		devices, err = r.planDevices(stdout)
+	} else {
+		devices, err = selectFleet()
+	}
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no instances match --target=%q in %s", fleetTarget, instanceflag.ParentDir())
+	}
+	if r.requireApproval {
+		return r.writePlan(devices, stdout)
+	}
+	return r.rollout(ctx, devices, stdout, stderr)
+}
+
+// rollout updates devices in order, starting with the --canary instances, and
+// stops at the first instance whose update or health checks fail.
+func (r *fleetUpdateImplConfig) rollout(ctx context.Context, devices []*fleet.Device, stdout, stderr io.Writer) error {
+	canaries := r.canary
+	if canaries > len(devices) {
+		canaries = len(devices)
+	}
+
+	var updated []string
+	summary := func() {
+		fmt.Fprintf(stdout, "Updated %d of %d instances: %v\n", len(updated), len(devices), updated)
+	}
+	for idx, dev := range devices {
+		role := "instance"
+		if idx < canaries {
+			role = "canary"
+		}
+		fmt.Fprintf(stdout, "\n=== Updating %s %s (%d of %d)\n", role, dev.Instance, idx+1, len(devices))
+		if err := r.updateDevice(ctx, dev, stdout, stderr); err != nil {
+			summary()
+			return fmt.Errorf("%s %s: %v; stopping the rollout", role, dev.Instance, err)
+		}
+		updated = append(updated, dev.Instance)
+
+		if idx != canaries-1 || canaries == len(devices) {
+			continue
+		}
+		// All canaries are updated: verify that they stay healthy before
+		// continuing with the remaining instances.
+		if r.canarySoak > 0 {
+			fmt.Fprintf(stdout, "\nCanaries updated, waiting %v before checking their health again\n", r.canarySoak)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(r.canarySoak):
+			}
+		}
+		for _, canary := range devices[:canaries] {
+			checks, err := readHealthChecks(canary)
+			if err != nil {
+				return err
+			}
+			if len(checks) == 0 {
+				log.Printf("canary %s has no health checks (%s), relying on the update succeeding", canary.Instance, healthcheck.File)
+				continue
+			}
+			if _, err := healthcheck.WaitHealthy(ctx, updateHost(canary), checks, r.healthCheckTimeout, log.Printf); err != nil {
+				summary()
+				return fmt.Errorf("canary %s unhealthy: %v; stopping the rollout", canary.Instance, err)
+			}
+		}
+		fmt.Fprintf(stdout, "\nCanaries healthy, updating the remaining %d instances\n", len(devices)-canaries)
+	}
+	summary()
+	return nil
+}
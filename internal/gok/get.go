@@ -2,18 +2,23 @@ package gok
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
 	"github.com/gokrazy/internal/updateflag"
+	internalpacker "github.com/gokrazy/tools/internal/packer"
 	"github.com/gokrazy/tools/packer"
 	"github.com/spf13/cobra"
+	"golang.org/x/mod/modfile"
 )
 
 // getCmd is gok get.
@@ -33,6 +38,21 @@ Examples:
 
   # Update only gokrazy system packages
   % gok -i scanner get gokrazy
+
+  # Update all packages and their dependencies, but only to newer patch
+  # versions (e.g. v1.2.3 to v1.2.4, but not to v1.3.0)
+  % gok -i scanner get -u --patch
+
+  # Update all packages to newer patch versions, show the commits between
+  # the old and new versions and verify that everything still builds
+  % gok -i scanner get -u --patch --changelog --build
+
+After updating, gok get prints which module versions changed in each build
+directory. With --changelog, it also prints the commits between the old and
+new version of each updated module hosted on GitHub (set GITHUB_TOKEN to avoid
+the rate limit for unauthenticated requests). With --build, it builds all
+packages of the instance afterwards. Use gok update to build and deploy the new
+versions.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return getImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
@@ -41,12 +61,18 @@ Examples:
 
 type getImplConfig struct {
 	updateAll bool
+	patch     bool
+	changelog bool
+	build     bool
 }
 
 var getImpl getImplConfig
 
 func init() {
 	getCmd.Flags().BoolVarP(&getImpl.updateAll, "update_all", "u", false, "update all installed packages and gokrazy system packages")
+	getCmd.Flags().BoolVarP(&getImpl.patch, "patch", "", false, "only update to newer patch versions (go get -u=patch), including dependencies")
+	getCmd.Flags().BoolVarP(&getImpl.changelog, "changelog", "", false, "print the commits between the old and new version of each updated module hosted on GitHub")
+	getCmd.Flags().BoolVarP(&getImpl.build, "build", "", false, "build all packages of the instance after updating, to verify that the new versions compile")
 	instanceflag.RegisterPflags(getCmd.Flags())
 }
 
@@ -100,6 +126,41 @@ func (r *getImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		packages = filtered
 	}
 
+	var getFlags []string
+	if r.patch {
+		getFlags = append(getFlags, "-u=patch")
+	}
+	changes, err := goGet(ctx, packages, getFlags...)
+	if err != nil {
+		if err == errBuildDirMissing {
+			return nil // message already logged
+		}
+		return err
+	}
+
+	if r.changelog {
+		printChangelogs(ctx, stdout, changes)
+	}
+
+	if r.build {
+		log.Printf("building all packages to verify the updated versions")
+		if err := internalpacker.BuildPackages(cfg); err != nil {
+			return err
+		}
+		log.Printf("all packages built successfully, use gok update to deploy them")
+	}
+
+	return nil
+}
+
+var errBuildDirMissing = errors.New("build directory does not exist")
+
+// goGet runs go get (with the specified flags, e.g. -u=patch) for each of the
+// specified packages in its build directory and returns the changed module
+// requirements of all build directories. It must be called from within the
+// instance directory.
+func goGet(ctx context.Context, packages []string, getFlags ...string) ([]modChange, error) {
+	var all []modChange
 	for idx, pkgAndVersion := range packages {
 		pkg := pkgAndVersion
 		if idx := strings.IndexByte(pkg, '@'); idx > -1 {
@@ -114,23 +175,99 @@ func (r *getImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 			log.Printf("Error: build directory %q does not exist in %q", buildDir, wd)
 			log.Printf("Try 'gok -i %s add %s' followed by an update.", instanceflag.Instance(), pkg)
 			log.Printf("Afterwards, your 'gok get' command should work")
-			return nil
+			return nil, errBuildDirMissing
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		get := exec.CommandContext(ctx, "go", "get", pkgAndVersion)
+		getArgs := append([]string{"get"}, getFlags...)
+		getArgs = append(getArgs, pkgAndVersion)
+		get := exec.CommandContext(ctx, "go", getArgs...)
 		get.Env = packer.Env()
 		get.Dir = buildDir
 		get.Stdout = os.Stdout
 		get.Stderr = os.Stderr
 		log.Printf("updating package %d of %d: %s", idx+1, len(packages), get.Args)
 		log.Printf("  in %s", buildDir)
+		before, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
 		if err := get.Run(); err != nil {
-			return fmt.Errorf("%v: %v", get.Args, err)
+			return nil, fmt.Errorf("%v: %v", get.Args, err)
+		}
+		after, err := os.ReadFile(filepath.Join(buildDir, "go.mod"))
+		if err != nil {
+			return nil, err
 		}
+		changes, err := goModChanges(before, after)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			log.Printf("  %s", change)
+		}
+		all = append(all, changes...)
 	}
 
-	return nil
+	return all, nil
+}
+
+// modChange is a module requirement which differs between two go.mod files.
+// Old is empty for added modules, New is empty for removed modules.
+type modChange struct {
+	Path string
+	Old  string
+	New  string
+}
+
+func (c modChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%s added at %s", c.Path, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%s removed (was %s)", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("%s %s → %s", c.Path, c.Old, c.New)
+	}
+}
+
+// goModChanges returns the modules whose required version differs between
+// the before and after go.mod contents.
+func goModChanges(before, after []byte) ([]modChange, error) {
+	requires := func(b []byte) (map[string]string, error) {
+		f, err := modfile.Parse("go.mod", b, nil)
+		if err != nil {
+			return nil, err
+		}
+		versions := make(map[string]string, len(f.Require))
+		for _, r := range f.Require {
+			versions[r.Mod.Path] = r.Mod.Version
+		}
+		return versions, nil
+	}
+	old, err := requires(before)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := requires(after)
+	if err != nil {
+		return nil, err
+	}
+	var changes []modChange
+	for path, version := range cur {
+		if prev := old[path]; prev != version {
+			changes = append(changes, modChange{Path: path, Old: prev, New: version})
+		}
+	}
+	for path, version := range old {
+		if _, ok := cur[path]; !ok {
+			changes = append(changes, modChange{Path: path, Old: version})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
 }
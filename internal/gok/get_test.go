@@ -0,0 +1,111 @@
+package gok
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// changeStrings returns the changes as gok get prints them.
+func changeStrings(changes []modChange) []string {
+	var s []string
+	for _, c := range changes {
+		s = append(s, c.String())
+	}
+	return s
+}
+
+func TestGoModChanges(t *testing.T) {
+	const before = `module gokrazy/build/scan2drive
+
+go 1.19
+
+require (
+	github.com/stapelberg/scan2drive v0.1.0
+	golang.org/x/net v0.8.0
+	golang.org/x/sys v0.6.0 // indirect
+)
+`
+	for _, tt := range []struct {
+		desc  string
+		after string
+		want  []string
+	}{
+		{
+			desc:  "unchanged",
+			after: before,
+		},
+
+		{
+			desc: "bumped",
+			after: `module gokrazy/build/scan2drive
+
+go 1.19
+
+require (
+	github.com/stapelberg/scan2drive v0.1.1
+	golang.org/x/net v0.8.0
+	golang.org/x/sys v0.7.0 // indirect
+)
+`,
+			want: []string{
+				"github.com/stapelberg/scan2drive v0.1.0 → v0.1.1",
+				"golang.org/x/sys v0.6.0 → v0.7.0",
+			},
+		},
+
+		{
+			desc: "added and removed",
+			after: `module gokrazy/build/scan2drive
+
+go 1.19
+
+require (
+	github.com/stapelberg/scan2drive v0.1.0
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+)
+`,
+			want: []string{
+				"golang.org/x/net removed (was v0.8.0)",
+				"golang.org/x/text added at v0.9.0",
+			},
+		},
+
+		{
+			desc: "removed",
+			after: `module gokrazy/build/scan2drive
+
+require github.com/stapelberg/scan2drive v0.1.0
+`,
+			want: []string{
+				"golang.org/x/net removed (was v0.8.0)",
+				"golang.org/x/sys removed (was v0.6.0)",
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := goModChanges([]byte(before), []byte(tt.after))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, changeStrings(got)); diff != "" {
+				t.Errorf("goModChanges: unexpected changes (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// goGet passes nil if the build directory had no go.mod yet.
+	got, err := goModChanges(nil, []byte(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"github.com/stapelberg/scan2drive added at v0.1.0",
+		"golang.org/x/net added at v0.8.0",
+		"golang.org/x/sys added at v0.6.0",
+	}
+	if diff := cmp.Diff(want, changeStrings(got)); diff != "" {
+		t.Errorf("goModChanges(nil, …): unexpected changes (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,157 @@
+package gok
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd is gok history.
+var historyCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "history",
+	Short:   "Show the audit log of builds, flashes and updates",
+	Long: `gok history shows who built, flashed or updated which gokrazy instance when,
+with the SBOM hash of the build and the SHA256 hashes of the written images.
+
+The audit log is only recorded after opting in with gok history --enable. It
+is stored in a local file which gok only ever appends to. With --endpoint,
+each event is additionally posted as JSON to the specified URL, e.g. for
+collecting the audit logs of all operators centrally.
+
+Examples:
+  % gok history --enable --endpoint=https://audit.example.net/gokrazy
+  % gok history --instance=scanner --since=720h
+  % gok history --failed --json
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return historyImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type historyImplConfig struct {
+	enable    bool
+	endpoint  string
+	instance  string
+	operation string
+	since     time.Duration
+	failed    bool
+	last      int
+	json      bool
+}
+
+var historyImpl historyImplConfig
+
+func init() {
+	historyCmd.Flags().BoolVarP(&historyImpl.enable, "enable", "", false, "start recording the audit log (stored locally, see --endpoint)")
+	historyCmd.Flags().StringVarP(&historyImpl.endpoint, "endpoint", "", "", "with --enable: URL to which each audit event is additionally posted as JSON")
+	historyCmd.Flags().StringVarP(&historyImpl.instance, "instance", "i", "", "only show events of this instance (default: all instances)")
+	historyCmd.Flags().StringVarP(&historyImpl.operation, "operation", "", "", "only show events of this operation, one of build, flash or update")
+	historyCmd.Flags().DurationVarP(&historyImpl.since, "since", "", 0, "only show events of this recent period (e.g. 24h)")
+	historyCmd.Flags().BoolVarP(&historyImpl.failed, "failed", "", false, "only show failed operations")
+	historyCmd.Flags().IntVarP(&historyImpl.last, "last", "", 50, "number of most recent events to show (0 for all)")
+	historyCmd.Flags().BoolVarP(&historyImpl.json, "json", "", false, "print the events as JSON, one per line")
+}
+
+func (r *historyImplConfig) enableLog(stdout io.Writer) error {
+	path := packer.AuditLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Recording the audit log to %s\n", path)
+	if r.endpoint != "" {
+		if err := os.WriteFile(packer.AuditEndpointPath(), []byte(r.endpoint+"\n"), 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Posting audit events to %s (configured in %s)\n", r.endpoint, packer.AuditEndpointPath())
+	}
+	return nil
+}
+
+func (r *historyImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if r.enable {
+		return r.enableLog(stdout)
+	}
+	if r.endpoint != "" {
+		return fmt.Errorf("--endpoint requires --enable")
+	}
+	switch r.operation {
+	case "", "build", "flash", "update":
+	default:
+		return fmt.Errorf("unknown --operation=%s, expected one of build, flash or update", r.operation)
+	}
+
+	all, err := packer.ReadAuditLog()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("recording the audit log is not enabled, enable it with: gok history --enable")
+		}
+		return err
+	}
+	var events []*packer.AuditEvent
+	for _, ev := range all {
+		if r.instance != "" && ev.Instance != r.instance {
+			continue
+		}
+		if r.operation != "" && ev.Operation != r.operation {
+			continue
+		}
+		if r.since > 0 && time.Since(ev.Time) > r.since {
+			continue
+		}
+		if r.failed && ev.Error == "" {
+			continue
+		}
+		events = append(events, ev)
+	}
+	if r.last > 0 && len(events) > r.last {
+		events = events[len(events)-r.last:]
+	}
+
+	if r.json {
+		enc := json.NewEncoder(stdout)
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(events) == 0 {
+		fmt.Fprintf(stdout, "No matching events recorded in %s\n", packer.AuditLogPath())
+		return nil
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TIME\tOPERATOR\tOPERATION\tINSTANCE\tHOST\tTARGET\tSBOM\tRESULT\n")
+	for _, ev := range events {
+		result := "ok"
+		if ev.Error != "" {
+			result = "failed: " + ev.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			ev.Time.Local().Format("2006-01-02 15:04"),
+			ev.Operator,
+			ev.Operation,
+			orDash(ev.Instance),
+			orDash(ev.Hostname),
+			orDash(ev.Target),
+			orDash(ev.SBOMHash),
+			result)
+	}
+	return tw.Flush()
+}
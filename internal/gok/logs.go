@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/gokrazy/internal/httpclient"
 	"github.com/gokrazy/internal/instanceflag"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/packer"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -25,7 +28,17 @@ var logsCmd = &cobra.Command{
 	Use:     "logs",
 	Short:   "Stream logs from a running gokrazy service",
 	Long: `Display the most recent 100 log lines from stdout and stderr each,
-and any new lines the gokrazy service produces (cancel any time with Ctrl-C)`,
+and any new lines the gokrazy service produces (cancel any time with Ctrl-C)
+
+With --crashes, display the exits (including the stderr output of crashes,
+e.g. Go panics) which were recorded in /perm/crashes on the device, which
+requires packing with --crash_log_size. The records survive reboots.
+
+Examples:
+  % gok -i scanner logs -s scan2drive
+  % gok -i scanner logs --crashes
+  % gok -i scanner logs --crashes -s scan2drive
+`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return logsImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
 	},
@@ -33,12 +46,14 @@ and any new lines the gokrazy service produces (cancel any time with Ctrl-C)`,
 
 type logsImplConfig struct {
 	service string
+	crashes bool
 }
 
 var logsImpl logsImplConfig
 
 func init() {
 	logsCmd.Flags().StringVarP(&logsImpl.service, "service", "s", "", "gokrazy service to fetch logs for")
+	logsCmd.Flags().BoolVarP(&logsImpl.crashes, "crashes", "", false, "display the recorded exits and crashes (of all services, unless -service is specified) instead of streaming logs")
 	instanceflag.RegisterPflags(logsCmd.Flags())
 }
 
@@ -55,6 +70,10 @@ func (l *logsImplConfig) run(ctx context.Context, args []string, stdout, stderr
 
 	updateflag.SetUpdate("yes")
 
+	if l.crashes {
+		return l.crashLogs(ctx, cfg, stdout)
+	}
+
 	if l.service == "" {
 		return fmt.Errorf("the -service flag is empty, but required")
 	}
@@ -121,3 +140,44 @@ func (r *logsImplConfig) streamLog(ctx context.Context, w io.Writer, url string,
 		}
 	}
 }
+
+// crashLogs prints the crash logs served by the crash-logs program (see gok
+// overwrite --crash_log_size).
+func (l *logsImplConfig) crashLogs(ctx context.Context, cfg *config.Struct, stdout io.Writer) error {
+	httpClient, _, baseUrl, err := httpclient.For(cfg)
+	if err != nil {
+		return err
+	}
+	// crash-logs serves on its own port, using the same scheme (and
+	// certificate) as the gokrazy web interface.
+	crashesUrl := &url.URL{
+		Scheme: baseUrl.Scheme,
+		User:   baseUrl.User,
+		Host:   net.JoinHostPort(baseUrl.Hostname(), packer.CrashLogsPort),
+		Path:   "/crashes",
+	}
+	if l.service != "" {
+		crashesUrl.RawQuery = url.Values{"service": []string{l.service}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", crashesUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%v (was the instance packed with --crash_log_size?)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status: %v: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	n, err := io.Copy(stdout, resp.Body)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		log.Printf("no exits recorded on gokrazy instance %q yet", cfg.Hostname)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package gok
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// microvmTestCmd is gok microvm-test.
+var microvmTestCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "microvm-test",
+	Short:   "Boot a gokrazy instance in a Firecracker microVM and run smoke tests",
+	Long: `Build a gokrazy instance for direct kernel boot (see gok overwrite --direct_boot),
+boot it in a Firecracker microVM, run the smoke tests against the ports of its
+services and tear the microVM down again.
+
+The microVM is connected to the host via an existing tap device, which needs to
+be created once (as root):
+
+  % sudo ip tuntap add dev tap0 mode tap user $USER
+  % sudo ip addr add 172.16.0.1/24 dev tap0
+  % sudo ip link set tap0 up
+
+The guest address is configured with the ip= kernel parameter, which requires
+a kernel built with CONFIG_IP_PNP.
+
+The smoke tests are the health checks of the instance (see --health_checks)
+and those specified with --smoke, one of:
+  tcp:<port>          succeeds once the port accepts connections
+  http:<port>[<path>] succeeds once GET http://<guest>:<port><path> returns 2xx
+
+Examples:
+  % gok -i scan2drive microvm-test --tap=tap0 --smoke=http:80/ --smoke=tcp:22
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return microvmTestImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type microvmTestImplConfig struct {
+	firecracker string
+	tap         string
+	guestIP     string
+	hostIP      string
+	netmask     string
+	vcpus       int
+	memMiB      int
+	smoke       []string
+	timeout     time.Duration
+	keep        bool
+
+	packFlags
+}
+
+var microvmTestImpl microvmTestImplConfig
+
+func init() {
+	instanceflag.RegisterPflags(microvmTestCmd.Flags())
+	microvmTestCmd.Flags().StringVarP(&microvmTestImpl.firecracker, "firecracker", "", "firecracker", "path to the firecracker binary")
+	microvmTestCmd.Flags().StringVarP(&microvmTestImpl.tap, "tap", "", "", "tap device (e.g. tap0) to connect the microVM to, required for smoke tests")
+	microvmTestCmd.Flags().StringVarP(&microvmTestImpl.guestIP, "guest_ip", "", "172.16.0.2", "IP address of the microVM")
+	microvmTestCmd.Flags().StringVarP(&microvmTestImpl.hostIP, "host_ip", "", "172.16.0.1", "IP address of the tap device on the host, used as gateway of the microVM")
+	microvmTestCmd.Flags().StringVarP(&microvmTestImpl.netmask, "netmask", "", "255.255.255.0", "netmask of the network between host and microVM")
+	microvmTestCmd.Flags().IntVarP(&microvmTestImpl.vcpus, "vcpus", "", 2, "number of vCPUs of the microVM")
+	microvmTestCmd.Flags().IntVarP(&microvmTestImpl.memMiB, "mem_mib", "", 512, "memory of the microVM in MiB (the initramfs is held in memory, too)")
+	microvmTestCmd.Flags().StringArrayVarP(&microvmTestImpl.smoke, "smoke", "", nil, "smoke test (tcp:<port> or http:<port>[<path>], e.g. http:80/) to run once the microVM booted. Can be specified multiple times")
+	microvmTestCmd.Flags().DurationVarP(&microvmTestImpl.timeout, "timeout", "", 30*time.Second, "how long to wait for the smoke tests to pass after starting the microVM")
+	microvmTestCmd.Flags().BoolVarP(&microvmTestImpl.keep, "keep", "", false, "keep the microVM running after the smoke tests (until interrupted), e.g. for debugging")
+	microvmTestImpl.packFlags.register(microvmTestCmd.Flags())
+}
+
+// firecrackerKernel writes the kernel in the format which Firecracker boots to
+// dest: an uncompressed ELF vmlinux on amd64 (extracted from the bzImage as
+// shipped by gokrazy kernel packages), the Image as-is on arm64.
+func firecrackerKernel(vmlinuz, dest string) error {
+	b, err := os.ReadFile(vmlinuz)
+	if err != nil {
+		return err
+	}
+	// x86 boot protocol, see
+	// https://www.kernel.org/doc/html/latest/arch/x86/boot.html
+	const (
+		setupSectsOffset    = 0x1f1
+		headerMagicOffset   = 0x202
+		payloadOffsetOffset = 0x248
+	)
+	if len(b) < payloadOffsetOffset+8 || string(b[headerMagicOffset:headerMagicOffset+4]) != "HdrS" {
+		// Not a bzImage: ELF vmlinux or arm64 Image, which Firecracker boots
+		// directly.
+		return os.WriteFile(dest, b, 0644)
+	}
+	setupSects := int(b[setupSectsOffset])
+	if setupSects == 0 {
+		setupSects = 4
+	}
+	payloadOffset := int(binary.LittleEndian.Uint32(b[payloadOffsetOffset:]))
+	payloadLength := int(binary.LittleEndian.Uint32(b[payloadOffsetOffset+4:]))
+	start := (setupSects+1)*512 + payloadOffset
+	if payloadLength < 4 || start+payloadLength > len(b) {
+		return fmt.Errorf("%s: bzImage payload (offset %d, length %d) out of bounds", vmlinuz, start, payloadLength)
+	}
+	payload := b[start : start+payloadLength]
+	var r io.Reader
+	switch {
+	case bytes.HasPrefix(payload, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		// The payload is followed by the uncompressed size.
+		zr.Multistream(false)
+		r = zr
+	case bytes.HasPrefix(payload, []byte("BZh")):
+		r = bzip2.NewReader(bytes.NewReader(payload))
+	default:
+		return fmt.Errorf("%s: unsupported kernel compression (magic %x): Firecracker needs an uncompressed vmlinux, which can only be extracted from gzip or bzip2 compressed kernels (CONFIG_KERNEL_GZIP)", vmlinuz, payload[:4])
+	}
+	vmlinux, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("%s: decompressing kernel: %v", vmlinuz, err)
+	}
+	if !bytes.HasPrefix(vmlinux, []byte("\x7fELF")) {
+		return fmt.Errorf("%s: decompressed kernel is not an ELF file", vmlinuz)
+	}
+	return os.WriteFile(dest, vmlinux, 0644)
+}
+
+// firecrackerCmdline adapts the direct boot kernel command line for
+// Firecracker: its serial console is ttyS0 on all architectures, and the
+// guest address is configured by the kernel.
+func (r *microvmTestImplConfig) firecrackerCmdline(cmdline string) string {
+	var fields []string
+	for _, f := range strings.Fields(cmdline) {
+		if f == "console=ttyAMA0" {
+			f = "console=ttyS0"
+		}
+		fields = append(fields, f)
+	}
+	fields = append(fields, "reboot=k", "panic=1", "pci=off")
+	if r.tap != "" {
+		fields = append(fields, fmt.Sprintf("ip=%s::%s:%s::eth0:off", r.guestIP, r.hostIP, r.netmask))
+	}
+	return strings.Join(fields, " ")
+}
+
+func (r *microvmTestImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var smoke []healthcheck.Check
+	for _, spec := range r.smoke {
+		c, err := healthcheck.Parse(spec)
+		if err != nil {
+			return err
+		}
+		smoke = append(smoke, c)
+	}
+	if _, err := exec.LookPath(r.firecracker); err != nil {
+		return fmt.Errorf("firecracker not found (see https://github.com/firecracker-microvm/firecracker/releases): %v", err)
+	}
+
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		return err
+	}
+	if cfg.InternalCompatibilityFlags == nil {
+		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
+	}
+	// gok microvm-test is mutually exclusive with gok update
+	cfg.InternalCompatibilityFlags.Update = ""
+
+	dir, err := os.MkdirTemp("", "gokrazy-microvm-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := r.packFlags.findWorkspace(); err != nil {
+		return err
+	}
+	if err := os.Chdir(config.InstancePath()); err != nil {
+		return err
+	}
+	pack := &packer.Pack{
+		Cfg: cfg,
+		Output: &packer.OutputStruct{
+			Type: packer.OutputTypeDirectBoot,
+			Path: dir,
+		},
+	}
+	if err := r.packFlags.apply(pack); err != nil {
+		return err
+	}
+
+	// The smoke tests run in addition to the declared health checks.
+	checks := make(map[string][]healthcheck.Check)
+	for service, cs := range pack.HealthChecks {
+		checks[service] = cs
+	}
+	if len(smoke) > 0 {
+		checks["(--smoke)"] = smoke
+	}
+	if len(checks) == 0 && !r.keep {
+		return fmt.Errorf("no smoke tests specified (see --smoke and --health_checks), or use --keep to only boot the microVM")
+	}
+	if len(checks) > 0 && r.tap == "" {
+		return fmt.Errorf("smoke tests require a network connection to the microVM, see --tap")
+	}
+
+	pack.Main("gokrazy gok")
+
+	return r.boot(ctx, dir, checks, stdout)
+}
+
+// boot boots the direct boot output in dir in a Firecracker microVM and runs
+// the smoke tests.
+func (r *microvmTestImplConfig) boot(ctx context.Context, dir string, checks map[string][]healthcheck.Check, stdout io.Writer) error {
+	start := time.Now()
+	kernel := filepath.Join(dir, "vmlinux")
+	if err := firecrackerKernel(filepath.Join(dir, "vmlinuz"), kernel); err != nil {
+		return err
+	}
+	cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline.txt"))
+	if err != nil {
+		return err
+	}
+	vmConfig := map[string]any{
+		"boot-source": map[string]any{
+			"kernel_image_path": kernel,
+			"initrd_path":       filepath.Join(dir, "initramfs.cpio"),
+			"boot_args":         r.firecrackerCmdline(string(cmdline)),
+		},
+		"drives": []any{},
+		"machine-config": map[string]any{
+			"vcpu_count":   r.vcpus,
+			"mem_size_mib": r.memMiB,
+		},
+	}
+	if r.tap != "" {
+		vmConfig["network-interfaces"] = []any{
+			map[string]any{
+				"iface_id":      "eth0",
+				"guest_mac":     "06:00:ac:10:00:02",
+				"host_dev_name": r.tap,
+			},
+		}
+	}
+	b, err := json.MarshalIndent(vmConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	vmConfigPath := filepath.Join(dir, "vm.json")
+	if err := os.WriteFile(vmConfigPath, b, 0644); err != nil {
+		return err
+	}
+
+	consoleLog := filepath.Join(dir, "console.log")
+	logFile, err := os.Create(consoleLog)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	fc := exec.CommandContext(ctx, r.firecracker, "--no-api", "--config-file", vmConfigPath)
+	fc.Stdout = logFile
+	fc.Stderr = logFile
+	if err := fc.Start(); err != nil {
+		return fmt.Errorf("%v: %v", fc.Args, err)
+	}
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = fc.Wait()
+		close(exited)
+	}()
+	teardown := func() {
+		fc.Process.Kill()
+		<-exited
+	}
+	fmt.Fprintf(stdout, "Started Firecracker microVM (pid %d), console output in %s\n", fc.Process.Pid, consoleLog)
+
+	failed := func(err error) error {
+		teardown()
+		if b, rerr := os.ReadFile(consoleLog); rerr == nil {
+			fmt.Fprintf(stdout, "\nmicroVM console output:\n%s\n", b)
+		}
+		return err
+	}
+
+	// Stop waiting for the smoke tests when the microVM exits (e.g. panics).
+	vmctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-exited
+		cancel()
+	}()
+	results, err := healthcheck.WaitHealthy(vmctx, r.guestIP, checks, r.timeout, func(format string, v ...any) {
+		fmt.Fprintf(stdout, "%s (after %v)\n", fmt.Sprintf(format, v...), time.Since(start).Round(time.Millisecond))
+	})
+	if err != nil {
+		select {
+		case <-exited:
+			return failed(fmt.Errorf("microVM exited before the smoke tests passed (%v): %v", waitErr, err))
+		default:
+		}
+		return failed(err)
+	}
+
+	if r.keep {
+		fmt.Fprintf(stdout, "Keeping the microVM running, interrupt to stop\n")
+		select {
+		case <-ctx.Done():
+		case <-exited:
+		}
+	}
+	teardown()
+	fmt.Fprintf(stdout, "All %d smoke tests passed in %v\n", len(results), time.Since(start).Round(time.Millisecond))
+	return nil
+}
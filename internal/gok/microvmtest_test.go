@@ -0,0 +1,55 @@
+package gok
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFirecrackerKernel(t *testing.T) {
+	vmlinux := []byte("\x7fELF vmlinux")
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+	zw.Write(vmlinux)
+	zw.Close()
+	binary.Write(&payload, binary.LittleEndian, uint32(len(vmlinux)))
+
+	// A bzImage with 1 setup sector after the boot sector, followed by the
+	// protected-mode code: 16 bytes of decompressor, then the payload.
+	const setupSects = 1
+	bzImage := make([]byte, (setupSects+1)*512+16)
+	bzImage[0x1f1] = setupSects
+	copy(bzImage[0x202:], "HdrS")
+	binary.LittleEndian.PutUint32(bzImage[0x248:], 16)
+	binary.LittleEndian.PutUint32(bzImage[0x24c:], uint32(payload.Len()))
+	bzImage = append(bzImage, payload.Bytes()...)
+
+	dir := t.TempDir()
+	vmlinuz := filepath.Join(dir, "vmlinuz")
+	if err := os.WriteFile(vmlinuz, bzImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "vmlinux")
+	if err := firecrackerKernel(vmlinuz, dest); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, vmlinux) {
+		t.Errorf("extracted kernel = %q, want %q", got, vmlinux)
+	}
+}
+
+func TestFirecrackerCmdline(t *testing.T) {
+	r := microvmTestImplConfig{tap: "tap0", guestIP: "172.16.0.2", hostIP: "172.16.0.1", netmask: "255.255.255.0"}
+	got := r.firecrackerCmdline("console=tty1 console=ttyAMA0 rdinit=/gokrazy/init\n")
+	want := "console=tty1 console=ttyS0 rdinit=/gokrazy/init reboot=k panic=1 pci=off ip=172.16.0.2::172.16.0.1:255.255.255.0::eth0:off"
+	if got != want {
+		t.Errorf("firecrackerCmdline() = %q, want %q", got, want)
+	}
+}
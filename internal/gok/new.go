@@ -11,7 +11,9 @@ import (
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
+	internalpacker "github.com/gokrazy/tools/internal/packer"
 	"github.com/gokrazy/tools/internal/pwgen"
+	"github.com/gokrazy/tools/packer"
 	"github.com/spf13/cobra"
 )
 
@@ -22,6 +24,20 @@ var newCmd = &cobra.Command{
 	Short:   "Create a new gokrazy instance",
 	Long: `Create a new gokrazy instance.
 
+With --isolated_gopath, the instance gets its own GOPATH (and thereby module
+cache) in the gopath directory of the instance. To isolate an existing
+instance, create the gopath directory in its instance directory.
+
+With --from, the instance config is recovered from an existing installation
+instead: a disk image (see gok clone) or the hostname of a running instance
+which was packed with --remote_exec. Installations packed by recent versions
+of gok contain their exact instance config; for older ones, gok new lists
+what could not be recovered.
+
+Examples:
+  % gok -i scanner new --from=scanner
+  % gok -i scanner new --from=scanner.img
+
 If you are unfamiliar with gokrazy, please follow:
 https://gokrazy.org/quickstart/
 `,
@@ -38,7 +54,9 @@ https://gokrazy.org/quickstart/
 }
 
 type newImplConfig struct {
-	empty bool
+	empty          bool
+	isolatedGOPATH bool
+	from           string
 }
 
 var newImpl newImplConfig
@@ -46,6 +64,8 @@ var newImpl newImplConfig
 func init() {
 	instanceflag.RegisterPflags(newCmd.Flags())
 	newCmd.Flags().BoolVarP(&newImpl.empty, "empty", "", false, "create an empty gokrazy instance, without the default packages")
+	newCmd.Flags().StringVarP(&newImpl.from, "from", "", "", "recover the instance config from a disk image, storage device or running instance (hostname) instead of creating a default config")
+	newCmd.Flags().BoolVarP(&newImpl.isolatedGOPATH, "isolated_gopath", "", false, "use a GOPATH (and module cache) which is not shared with other instances or your other Go projects")
 }
 
 func (r *newImplConfig) createBreakglassAuthorizedKeys(authorizedPath string, matches []string) error {
@@ -97,23 +117,10 @@ func (r *newImplConfig) addBreakglassAuthorizedKeys(authorizedPath string, match
 	return nil
 }
 
-func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
-	parentDir := instanceflag.ParentDir()
-	instance := instanceflag.Instance()
-
-	if err := os.MkdirAll(filepath.Join(parentDir, instance), 0755); err != nil {
-		return err
-	}
-
-	configJSON := filepath.Join(parentDir, instance, "config.json")
-	f, err := os.OpenFile(configJSON, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		if os.IsExist(err) {
-			return fmt.Errorf("gokrazy instance already exists! If you want to re-create it, rm '%s' and retry", configJSON)
-		}
-	}
-	defer f.Close()
-
+// defaultConfig returns the instance config of a new instance: the default
+// packages (unless --empty is set), with breakglass if SSH keys are found, and
+// a random update password.
+func (r *newImplConfig) defaultConfig(parentDir, instance string) (*config.Struct, error) {
 	packageConfig := make(map[string]config.PackageConfig)
 	var packages []string
 	if !r.empty {
@@ -125,7 +132,7 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		idPattern := os.Getenv("HOME") + "/.ssh/id_*.pub"
 		matches, err := filepath.Glob(idPattern)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(matches) == 0 {
 			log.Printf("No SSH keys found in %s, not adding breakglass", idPattern)
@@ -134,7 +141,7 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 			packages = append(packages, "github.com/gokrazy/breakglass")
 			authorizedPath := filepath.Join(parentDir, instance, "breakglass.authorized_keys")
 			if err := r.addBreakglassAuthorizedKeys(authorizedPath, matches, packageConfig); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
@@ -142,7 +149,7 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 	// Create a machine-id(5) file to uniquely identify a gokrazy instance
 	machineId, err := randomMachineId(rand.Reader)
 	if err != nil {
-		return fmt.Errorf("generating random machine id: %v", err)
+		return nil, fmt.Errorf("generating random machine id: %v", err)
 	}
 	packageConfig["github.com/gokrazy/gokrazy/cmd/randomd"] = config.PackageConfig{
 		ExtraFileContents: map[string]string{
@@ -152,9 +159,9 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 
 	pw, err := pwgen.RandomPassword(20)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cfg := &config.Struct{
+	return &config.Struct{
 		Hostname: instance,
 		Packages: packages,
 		Update: &config.UpdateStruct{
@@ -162,6 +169,37 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		},
 		PackageConfig: packageConfig,
 		SerialConsole: "disabled",
+	}, nil
+}
+
+func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	parentDir := instanceflag.ParentDir()
+	instance := instanceflag.Instance()
+
+	if err := os.MkdirAll(filepath.Join(parentDir, instance), 0755); err != nil {
+		return err
+	}
+
+	configJSON := filepath.Join(parentDir, instance, "config.json")
+	f, err := os.OpenFile(configJSON, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("gokrazy instance already exists! If you want to re-create it, rm '%s' and retry", configJSON)
+		}
+		return err
+	}
+	defer f.Close()
+
+	var cfg *config.Struct
+	if r.from != "" {
+		cfg, err = internalpacker.ConfigFrom(ctx, r.from, stdout)
+	} else {
+		cfg, err = r.defaultConfig(parentDir, instance)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(configJSON)
+		return err
 	}
 	b, err := cfg.FormatForFile()
 	if err != nil {
@@ -173,12 +211,24 @@ func (r *newImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 		return err
 	}
 
+	if r.isolatedGOPATH {
+		if err := os.MkdirAll(filepath.Join(parentDir, instance, packer.IsolatedGOPATH), 0755); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("gokrazy instance configuration created in %s\n", configJSON)
 	fmt.Printf("(Use 'gok -i %s edit' to edit the configuration interactively.)\n", instance)
 	fmt.Println()
 	fmt.Printf("Use 'gok -i %s add' to add packages to this instance\n", instance)
 	fmt.Println()
 	fmt.Printf("To deploy this gokrazy instance, see 'gok help overwrite'\n")
+	if r.isolatedGOPATH {
+		gopath := filepath.Join(parentDir, instance, packer.IsolatedGOPATH)
+		fmt.Println()
+		fmt.Printf("This instance uses its own GOPATH in %s\n", gopath)
+		fmt.Printf("To prune its module cache, use 'GOPATH=%s go clean -modcache'\n", gopath)
+	}
 
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
@@ -27,6 +28,52 @@ switch to the gok update command instead for updating over the network.
 Examples:
   # Overwrite the contents of the SD card sdx with gokrazy instance scan2drive:
   % gok -i scan2drive overwrite --full=/dev/sdx
+
+  # Create a small image for distribution, to be written using gok flash:
+  % gok -i scan2drive overwrite --full=/tmp/scan2drive.img --shrink
+
+  # Name the image after the instance, its version (see --image_version) and
+  # the build date, e.g. in CI:
+  % gok -i scan2drive overwrite --shrink \
+      --full='build/gokrazy-{{.Hostname}}-{{.Version}}-{{.Date}}.img'
+
+  # Stream the image to stdout, e.g. to compress it without a temporary file:
+  % gok -i scan2drive overwrite --full=- --target_storage_bytes=$((8*1024*1024*1024)) \
+      | xz > /tmp/scan2drive.img.xz
+
+  # Stream the image to an SD card in another machine:
+  % gok -i scan2drive overwrite --full=fd:3 --target_storage_bytes=$((8*1024*1024*1024)) \
+      3>&1 >&2 | ssh flasher dd of=/dev/sdx bs=4M
+
+  # Write the SD card in the card reader of another machine:
+  % gok -i scan2drive overwrite --full=ssh://root@flasher:/dev/sdb
+
+  # Create a disk image for a QEMU/KVM VM or a cloud arm64 instance:
+  % gok -i scan2drive overwrite --full=/tmp/scan2drive.qcow2 --vm_format=qcow2 \
+      --target_storage_bytes=$((2*1024*1024*1024))
+
+  # Create a disk image for a Hyper-V generation 2 VM:
+  % gok -i scan2drive overwrite --full=/tmp/scan2drive.vhdx --vm_format=vhdx \
+      --target_storage_bytes=$((2*1024*1024*1024))
+
+  # Create a disk image for a VMware VM:
+  % gok -i scan2drive overwrite --full=/tmp/scan2drive.vmdk --vm_format=vmdk \
+      --target_storage_bytes=$((2*1024*1024*1024))
+
+  # Boot the packed userland directly in QEMU (no firmware, boot loader or disk):
+  % gok -i scan2drive overwrite --direct_boot=/tmp/scan2drive-vm
+  % qemu-system-x86_64 -m 1G -nographic -kernel /tmp/scan2drive-vm/vmlinuz \
+      -initrd /tmp/scan2drive-vm/initramfs.cpio -append "$(cat /tmp/scan2drive-vm/cmdline.txt)"
+
+  # Write the disk of a VM, served by qemu-nbd:
+  % gok -i scan2drive overwrite --full=nbd://localhost/disk
+
+  # Write the full image, boot.img, root.img, mbr.bin and init.go at once:
+  % gok -i scan2drive overwrite --output_dir=/tmp/scan2drive
+
+Output paths are templates (text/template) with the fields .Hostname,
+.DeviceType, .Arch, .Version, .Date (e.g. 2024-05-01) and .Timestamp
+(e.g. 20240501T142300Z).
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if cmd.Flags().NArg() > 0 {
@@ -41,27 +88,40 @@ Examples:
 }
 
 type overwriteImplConfig struct {
-	full string
-	gaf  string
-	boot string
-	root string
-	mbr  string
+	full       string
+	gaf        string
+	directBoot string
+	outputDir  string
+	boot       string
+	root       string
+	mbr        string
 
 	sudo               string
 	targetStorageBytes int
+	shrink             bool
+	vmFormat           string
+	compress           string
+
+	packFlags
 }
 
 var overwriteImpl overwriteImplConfig
 
 func init() {
 	instanceflag.RegisterPflags(overwriteCmd.Flags())
-	overwriteCmd.Flags().StringVarP(&overwriteImpl.full, "full", "", "", "write a full gokrazy device image to the specified device (e.g. /dev/sdx) or path (e.g. /tmp/gokrazy.img)")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.full, "full", "", "", "write a full gokrazy device image to the specified device (e.g. /dev/sdx), path (e.g. /tmp/gokrazy.img), named pipe, stdout (-, with the progress printed to stderr), already-open file descriptor (e.g. fd:3), device on another machine (e.g. ssh://flasher:/dev/sdb, written and verified via ssh) or network block device export (e.g. nbd://localhost/disk), to which the image is streamed. loop:<file> (e.g. loop:/var/lib/vms/gokrazy.img) writes to a disk image file attached as loop device. usbboot: writes to the eMMC of a Compute Module in usbboot mode, exposed with rpiboot (usbboot:<dir> passes rpiboot -d <dir>)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.gaf, "gaf", "", "", "write a .gaf (gokrazy archive format) file to the specified path (e.g. /tmp/gokrazy.gaf)")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.directBoot, "direct_boot", "", "", "write the kernel (vmlinuz), its command line (cmdline.txt) and the root file system as initramfs (initramfs.cpio) to the specified directory (e.g. /tmp/gokrazy-vm), for booting the packed userland directly in QEMU or Firecracker, without firmware, boot loader or disk")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.outputDir, "output_dir", "", "", "write all artifacts to the specified directory (e.g. /tmp/gokrazy) at once: the full image (disk.img, sized for the smallest device unless --target_storage_bytes is specified), the boot and root file systems (boot.img, root.img), the MBR (mbr.bin) and the generated init source code (init.go)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.boot, "boot", "", "", "write the gokrazy boot file system to the specified partition (e.g. /dev/sdx1) or path (e.g. /tmp/boot.fat)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.root, "root", "", "", "write the gokrazy root file system to the specified partition (e.g. /dev/sdx2) or path (e.g. /tmp/root.squashfs)")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.mbr, "mbr", "", "", "write the gokrazy master boot record (MBR) to the specified device (e.g. /dev/sdx) or path (e.g. /tmp/mbr.img). only effective if -boot is specified, too")
 	overwriteCmd.Flags().StringVarP(&overwriteImpl.sudo, "sudo", "", "", "Whether to elevate privileges using sudo when required (one of auto, always, never, default auto)")
 	overwriteCmd.Flags().IntVarP(&overwriteImpl.targetStorageBytes, "target_storage_bytes", "", 0, "Number of bytes which the target storage device (SD card) has. Required for using -full=<file>")
+	overwriteCmd.Flags().BoolVarP(&overwriteImpl.shrink, "shrink", "", false, "make the --full=<file> image as small as possible (no --target_storage_bytes needed) and write metadata next to it, so that gok flash can create the partitions for the actual SD card size when writing the image")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.vmFormat, "vm_format", "", "", "write the --full=<file> image for running it in a VM, in one of the formats "+strings.Join(packer.VMFormats(), ", ")+" (vhd/vhdx: Hyper-V generation 1/2, vdi: VirtualBox, vmdk: VMware, gce: tarball for Google Compute Engine). The disk size is rounded up to whole GiB")
+	overwriteCmd.Flags().StringVarP(&overwriteImpl.compress, "compress", "", "", "compress the --full=<file> image, in one of the formats "+strings.Join(packer.ImageCompressions(), ", ")+" (name the file accordingly, e.g. gokrazy.img.zst), for distributing it or writing it with the Raspberry Pi Imager. xz and zstd require the xz or zstd command")
+	overwriteImpl.packFlags.register(overwriteCmd.Flags())
 }
 
 func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
@@ -74,8 +134,14 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 		cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{}
 	}
 
-	if r.full != "" && r.gaf != "" {
-		return fmt.Errorf("cannot specify both --full and --gaf")
+	outputs := 0
+	for _, o := range []string{r.full, r.gaf, r.directBoot, r.outputDir} {
+		if o != "" {
+			outputs++
+		}
+	}
+	if outputs > 1 {
+		return fmt.Errorf("cannot specify more than one of --full, --gaf, --direct_boot and --output_dir")
 	}
 
 	// gok overwrite is mutually exclusive with gok update
@@ -83,7 +149,7 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 
 	// Turn all paths into absolute paths so that the output files land in the
 	// current directory despite the os.Chdir() call below.
-	for _, str := range []*string{&r.full, &r.gaf, &r.boot, &r.root, &r.mbr} {
+	for _, str := range []*string{&r.gaf, &r.directBoot, &r.outputDir, &r.boot, &r.root, &r.mbr, &r.provenance, &r.buildManifest, &r.writeRootManifest, &r.artifactCache, &r.cpuProfile, &r.memProfile, &r.trace, &r.sha256Sums, &r.signMinisignKey, &r.tmpDir} {
 		if *str != "" {
 			*str, err = filepath.Abs(*str)
 			if err != nil {
@@ -91,6 +157,13 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 			}
 		}
 	}
+	if r.full != "" {
+		// Targets like fd:3 or ssh://flasher:/dev/sdb are not paths.
+		r.full, err = packer.AbsTarget(r.full)
+		if err != nil {
+			return err
+		}
+	}
 
 	// It's guaranteed that only one is not empty.
 	output := packer.OutputStruct{}
@@ -101,6 +174,9 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 	case r.gaf != "":
 		output.Type = packer.OutputTypeGaf
 		output.Path = r.gaf
+	case r.directBoot != "":
+		output.Type = packer.OutputTypeDirectBoot
+		output.Path = r.directBoot
 	}
 
 	cfg.InternalCompatibilityFlags.Overwrite = r.full
@@ -116,13 +192,24 @@ func (r *overwriteImplConfig) run(ctx context.Context, args []string, stdout, st
 		cfg.InternalCompatibilityFlags.TargetStorageBytes = r.targetStorageBytes
 	}
 
+	if err := r.packFlags.findWorkspace(); err != nil {
+		return err
+	}
+
 	if err := os.Chdir(config.InstancePath()); err != nil {
 		return err
 	}
 
 	pack := &packer.Pack{
-		Cfg:    cfg,
-		Output: &output,
+		Cfg:       cfg,
+		Output:    &output,
+		Shrink:    r.shrink,
+		OutputDir: r.outputDir,
+		VMFormat:  r.vmFormat,
+		Compress:  r.compress,
+	}
+	if err := r.packFlags.apply(pack); err != nil {
+		return err
 	}
 
 	pack.Main("gokrazy gok")
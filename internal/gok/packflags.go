@@ -0,0 +1,349 @@
+package gok
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/manifest"
+	publicpacker "github.com/gokrazy/tools/packer"
+	"github.com/spf13/pflag"
+)
+
+// packFlags are the flags which control how gok overwrite and gok update pack
+// the gokrazy image.
+type packFlags struct {
+	embedLicenseTexts  bool
+	provenance         string
+	signProvenance     bool
+	sha256Sums         string
+	buildManifest      string
+	policy             string
+	signGPGKey         string
+	signMinisignKey    string
+	summary            string
+	hints              bool
+	qrCode             bool
+	compressBinaries   bool
+	dedupFiles         bool
+	integrityCheck     bool
+	initDebug          bool
+	crashLogSize       string
+	remoteExec         bool
+	keepTemp           bool
+	tmpDir             string
+	keepBackup         bool
+	reproducible       bool
+	skipSpaceCheck     bool
+	cpuProfile         string
+	memProfile         string
+	trace              string
+	artifactCache      string
+	runTargetTests     bool
+	etcConfig          string
+	rootManifest       string
+	writeRootManifest  string
+	addHosts           []string
+	dnsSearch          []string
+	volumes            []string
+	model              string
+	models             string
+	arch               string
+	goos               string
+	goarch             string
+	goarm              string
+	board              string
+	extraKernels       []string
+	layout             string
+	extraPartitions    []string
+	exposePartition    string
+	bootSize           string
+	bootFileSystem     string
+	rootSize           string
+	singleSlot         bool
+	partitionTable     string
+	deviceSync         string
+	deviceRetries      int
+	rootFileSystem     string
+	permFileSystem     string
+	preservePerm       bool
+	mkfsPerm           bool
+	permLabel          string
+	imageVersion       string
+	allowDowngrade     bool
+	healthChecks       string
+	healthCheckTimeout time.Duration
+
+	// workspace is the go.work file of the working directory in which gok was
+	// invoked, see findWorkspace.
+	workspace string
+}
+
+func (pf *packFlags) register(fs *pflag.FlagSet) {
+	fs.BoolVarP(&pf.embedLicenseTexts, "embed_license_texts", "", false, "include the license text of each module in /etc/licenses (the /etc/licenses/LICENSES.txt report is always included)")
+	fs.BoolVarP(&pf.compressBinaries, "compress_binaries", "", false, "store the binaries in /user gzip-compressed; they are decompressed into RAM when started (smaller images, slower start)")
+	fs.BoolVarP(&pf.dedupFiles, "dedup_files", "", false, "replace identical copies of large files (e.g. shared libraries) in the root file system with symlinks to the first copy")
+	fs.BoolVarP(&pf.integrityCheck, "integrity_check", "", false, "include an integrity-check program which verifies the root file system files against their hashes on boot and reports corruption in the web interface")
+	fs.BoolVarP(&pf.initDebug, "init_debug", "", false, "make init log mount steps, the services and the starting and exiting of their processes, and network changes to the console and kernel ring buffer (dmesg) during the first minutes after boot, and boot the kernel with verbose logging")
+	fs.StringVarP(&pf.crashLogSize, "crash_log_size", "", "", "<size> (e.g. 1M): record the exit status of each service process and the stderr output of crashes (e.g. Go panics) into log files in /perm/crashes, which are rotated at the specified size. Fetch them with gok logs --crashes")
+	fs.BoolVarP(&pf.remoteExec, "remote_exec", "", false, "include a remote-exec program which runs single commands sent with gok exec (authenticated with the gokrazy password, encrypted if the instance uses TLS), for emergency diagnostics when nothing else is reachable. It also serves the partitions for gok backup")
+	fs.BoolVarP(&pf.keepTemp, "keep_temp", "", false, "keep the temporary files (e.g. the generated init source, the built binaries and the boot and root file system images) instead of deleting them, and print their paths")
+	fs.BoolVarP(&pf.reproducible, "reproducible", "", false, "produce byte-identical images for identical inputs: all timestamps are set to $SOURCE_DATE_EPOCH (default: the git commit time) and the Go binaries are built with -trimpath and without build ID")
+	fs.BoolVarP(&pf.keepBackup, "keep_backup", "", false, "keep the previous image files as <file>.bak when replacing them. Images are written to <file>.partial and only renamed once complete, so that an interrupted build never leaves a truncated image")
+	fs.StringVarP(&pf.tmpDir, "tmpdir", "", "", "directory for the temporary files (e.g. the compiled binaries and the file system images), instead of $TMPDIR, e.g. when /tmp is a small tmpfs. gok checks that it has enough free space before building")
+	fs.BoolVarP(&pf.skipSpaceCheck, "skip_space_check", "", false, "skip checking that the temporary directory and the output destinations have enough free space before building (the check uses upper bounds, e.g. the root partition size)")
+	fs.StringVarP(&pf.cpuProfile, "cpuprofile", "", "", "write a CPU profile of gok (covering the build and imaging phases) to the specified path, for go tool pprof")
+	fs.StringVarP(&pf.memProfile, "memprofile", "", "", "write a memory (heap) profile of gok at the end of the run to the specified path, for go tool pprof")
+	fs.StringVarP(&pf.trace, "trace", "", "", "write an execution trace of gok, in which the build and imaging phases are shown as regions, to the specified path, for go tool trace")
+	fs.StringVarP(&pf.artifactCache, "artifact_cache", "", "", "directory in which to store the root file system files content-addressed, shared between builds for multiple hosts (see gok fleet update --artifact_cache): identical build artifacts are stored (and hardlinked, with --keep_temp) only once")
+	fs.BoolVarP(&pf.runTargetTests, "run_tests_target", "", false, "run the tests of the packages (go test) for the target architecture before creating the image, under qemu-user emulation (qemu-aarch64-static or a binfmt_misc handler, e.g. from the qemu-user-static package) unless the host runs the target architecture, to catch architecture-specific bugs")
+	fs.StringVarP(&pf.etcConfig, "etc_config", "", "", "JSON file which adds, removes or replaces entries in /etc (e.g. hosts or localtime), see the EtcConfig documentation. Defaults to "+packer.EtcConfigFile+" in the instance directory, if present")
+	fs.StringVarP(&pf.rootManifest, "root_manifest", "", "", "JSON root manifest (see package github.com/gokrazy/tools/manifest) whose files are added to the root file system, e.g. generated by other tools. Relative to the instance directory")
+	fs.StringVarP(&pf.writeRootManifest, "write_root_manifest", "", "", "write the JSON manifest of the complete root file system to the specified path, e.g. for comparing images")
+	fs.StringArrayVarP(&pf.addHosts, "add_host", "", nil, "<name>[,<name>...]=<address> (e.g. broker.local=10.0.0.2): add a static entry to /etc/hosts. Can be specified multiple times")
+	fs.StringArrayVarP(&pf.dnsSearch, "dns_search", "", nil, "add a DNS search domain (e.g. lan) to the DNS configuration obtained via DHCP. Can be specified multiple times")
+	fs.StringArrayVarP(&pf.volumes, "volume", "", nil, "<service>=<dir>[:<mode>[:<uid>[:<gid>]]] (e.g. scan2drive=scan2drive:0700:1000): create the persistent directory /perm/<dir> for the service (program name or package) on boot, set its mode and owner, and pass its path in $STATE_DIRECTORY. Can be specified multiple times")
+	fs.StringVarP(&pf.model, "model", "", "", "Raspberry Pi model to build the image for, one of "+strings.Join(packer.Models(), ", ")+": only include the firmware files this model boots (e.g. start4.elf for the pi4) and verify the kernel package supports it. pi0 and pi0w images are built for 32-bit ARM (GOARCH=arm GOARM=6) and need a 32-bit kernel package. By default, the image boots on all models supported by the firmware and kernel packages")
+	fs.StringVarP(&pf.models, "models", "", "", "build one image per Raspberry Pi model in one run, as comma-separated list of <model>[=<kernel package>[:<firmware package>]] (e.g. pi3,pi4,pi5=github.com/gokrazy/kernel.rpi), pinning the kernel and firmware packages per model if specified. The output paths need to contain {{.Model}} (e.g. gokrazy-{{.Model}}.img). The compiled packages are shared between models of the same architecture")
+	fs.StringVarP(&pf.arch, "arch", "", "", "architecture to build the userland (init and packages) for, one of "+strings.Join(packer.Architectures(), ", ")+" (default arm64, for the Raspberry Pi 3 and newer): sets GOARCH, selects the matching default kernel package (github.com/gokrazy/kernel.amd64 for amd64, with no Raspberry Pi firmware; riscv64 needs KernelPackage in the instance config) and verifies that the kernel package is built for it")
+	fs.StringVarP(&pf.goos, "goos", "", "", "GOOS to build init and the packages with, overriding the environment (only linux is supported)")
+	fs.StringVarP(&pf.goarch, "goarch", "", "", "GOARCH to build init and the packages with (e.g. arm64), overriding the environment. Unlike --arch, it does not select a kernel package")
+	fs.StringVarP(&pf.goarm, "goarm", "", "", "GOARM to build init and the packages with (e.g. 7), overriding the environment. Requires GOARCH=arm")
+	fs.StringVarP(&pf.board, "board", "", "", "board profile for a computer other than the Raspberry Pi (amd64 for PCs booting via UEFI, e.g. NUCs and thin clients, qemu-virt for the QEMU virt machine, e.g. in CI, visionfive2 for the StarFive VisionFive 2 RISC-V board): one of "+strings.Join(packer.Boards(), ", ")+" or a .json file (see the Board documentation) specifying the kernel and firmware packages, the bootloader files written before the boot partition (e.g. u-boot), the partition table type, the kernel command line and the U-Boot boot script")
+	fs.StringArrayVarP(&pf.extraKernels, "extra_kernel", "", nil, "<model filter>=<go package> (e.g. pi5=github.com/gokrazy/kernel.rpi): boot the kernel from the specified package on the Raspberry Pi models matching the config.txt model filter. Can be specified multiple times")
+	fs.StringVarP(&pf.layout, "layout", "", "", "JSON file describing the partition layout (BootSize, RootSize, BootFileSystem, SingleSlot, Extra partitions with Name, Size, Type and Source, Expose), e.g. {\"Extra\": [{\"Name\": \"data\", \"Size\": \"2G\", \"Type\": \"linux\"}]}. The partition flags are applied on top of it")
+	fs.StringArrayVarP(&pf.extraPartitions, "extra_partition", "", nil, "<name>:<size>:<type>[:<source image>] (e.g. data:2G:fat): create an additional partition (type fat, exfat, ntfs, linux, raw or a GPT type GUID) at the end of the disk, after the perm partition. Can be specified multiple times")
+	fs.StringVarP(&pf.bootFileSystem, "boot_fs", "", "", "file system of the boot partition: fat16 (default, for at most 128 MB of kernel, firmware and device tree files) or fat32 (spans the whole boot partition, see --boot_size). When updating, --boot_size must match the boot partition of the installation")
+	fs.StringVarP(&pf.bootSize, "boot_size", "", "", "size of the boot partition (e.g. 256M, default 100M), which holds the kernel, the firmware and the device tree files. Only applies when creating the partition table, as updates write into the existing partitions")
+	fs.StringVarP(&pf.rootSize, "root_size", "", "", "size of each of the two root partitions (e.g. 1G, default 500M), which hold the root file system. Only applies when creating the partition table, as updates write into the existing partitions")
+	fs.BoolVarP(&pf.singleSlot, "single_slot", "", false, "create only one root partition instead of two (e.g. for read-only kiosks on small SD cards), which reduces the minimum device size by --root_size. The device can then only be updated by writing a new image, not over the network")
+	fs.StringVarP(&pf.exposePartition, "expose_partition", "", "", "perm or the name of a fat/exfat/ntfs --extra_partition: enter the partition into the hybrid MBR with a Windows partition type so that Windows and macOS mount it automatically (perm then needs to be formatted as exFAT)")
+	fs.StringVarP(&pf.rootFileSystem, "rootfs", "", "", "file system of the root partitions, one of "+strings.Join(packer.RootFileSystems(), ", ")+" (default squashfs): ext4 preserves the file modes of the packed files (e.g. setuid bits), but is not compressed, so it needs to fit into the root partition (see --root_size) uncompressed")
+	fs.StringVarP(&pf.deviceSync, "device_sync", "", "", "sync policy when writing to a storage device, one of "+strings.Join(packer.DeviceSyncPolicies(), ", ")+": end (default) syncs once all data is written, so that the device can be unplugged right away; buffer also calls fdatasync after each write buffer, which keeps the progress accurate and the final sync short; none leaves flushing to the kernel")
+	fs.IntVarP(&pf.deviceRetries, "device_retries", "", 3, "how often to retry a write to a storage device which failed with an I/O error (with exponential backoff, starting at 100ms) before giving up. Cheap card readers sporadically fail writes")
+	fs.StringVarP(&pf.partitionTable, "partition_table", "", "", "partition table of new installations, one of "+strings.Join(packer.PartitionTables(), ", ")+": hybrid (GPT with a hybrid MBR, boots on all Raspberry Pi models), gpt (GPT with a protective MBR, for boot media and boards which require a pure GPT; the Raspberry Pi 4 and newer boot from it) or mbr (MBR only, no extra partitions). Defaults to the partition table of the --board or DeviceType, otherwise hybrid")
+	fs.StringVarP(&pf.permFileSystem, "perm_fs", "", "", "file system to format the perm partition with at pack time, exfat or ext4: exfat (implies --expose_partition=perm) can be read on Windows and macOS, ext4 makes a freshly written SD card immediately usable for persistent data")
+	fs.BoolVarP(&pf.preservePerm, "preserve_perm", "", false, "when overwriting a storage device which holds a gokrazy installation, keep its perm partition (the application state) instead of creating an empty one. The partition layout must be unchanged")
+	fs.BoolVarP(&pf.mkfsPerm, "mkfs_perm", "", false, "format the perm partition as ext4 at pack time (same as --perm_fs=ext4), instead of printing the mkfs.ext4 command to run")
+	fs.StringVarP(&pf.permLabel, "perm_label", "", "GOKRAZY", "volume label of the perm partition when using --perm_fs (at most 11 characters for exFAT, 16 bytes for ext4)")
+	fs.StringVarP(&pf.imageVersion, "image_version", "", "", "version of the image, stored in /etc/os-release, gaf files and the provenance. Defaults to the git describe output of the instance directory (e.g. v1.2.0-3-g1a2b3c4, with a -dirty suffix for uncommitted changes), if it is in a git repository")
+	fs.BoolVarP(&pf.allowDowngrade, "allow_downgrade", "", false, "update the device even if it runs a newer image: a later version (the device's version is only known if it was packed with --remote_exec), one which is not in the git repository of the instance directory (e.g. a stale checkout), or one with a later build timestamp")
+	fs.StringVarP(&pf.healthChecks, "health_checks", "", "", "JSON file which declares health checks (http, tcp or command) per service, which need to pass after the device rebooted into an update, see the healthcheck package documentation. Defaults to "+healthcheck.File+" in the instance directory, if present")
+	fs.DurationVarP(&pf.healthCheckTimeout, "health_check_timeout", "", 2*time.Minute, "how long to wait for the health checks to pass after the update")
+	fs.StringVarP(&pf.provenance, "provenance", "", "", "write an in-toto/SLSA provenance statement (JSON) about the produced image files to the specified path. Use --sign_provenance to turn it into a signed attestation")
+	fs.BoolVarP(&pf.signProvenance, "sign_provenance", "", false, "sign the --provenance statement with Sigstore keyless signing (requires cosign, which asks for your OIDC identity, e.g. in the browser, or uses the identity of the CI job), writing the bundle to <file>.sigstore.json. Verify it with cosign verify-blob --bundle")
+	fs.StringVarP(&pf.buildManifest, "build_manifest", "", "", "write a JSON manifest of the image to the specified path (e.g. manifest.json): every file of the boot and root file systems with its size and SHA256 hash, the Go module versions, the kernel and firmware versions and the partition offsets, so that provisioning systems can track what each device runs")
+	fs.StringVarP(&pf.policy, "policy", "", "", "JSON file with rules which the image needs to satisfy, checked before any image is written: a regular expression for the hostname (Hostname), the maximum size of each file of the root file system (MaxFileSize, e.g. 50M), minimum Go module versions (MinModuleVersions) and forbidden Go modules (ForbiddenModules). Defaults to "+packer.PolicyFile+" in the instance directory, if present")
+	fs.StringVarP(&pf.sha256Sums, "sha256sums", "", "", "write the SHA256 hashes of the produced image files to the specified path (e.g. SHA256SUMS next to the image), in the format of sha256sum, so that they can be verified with sha256sum --check before flashing")
+	fs.StringVarP(&pf.signGPGKey, "sign_gpg_key", "", "", "sign the --sha256sums file with the specified gpg key (e.g. its fingerprint), writing the ASCII-armored detached signature to <file>.asc")
+	fs.StringVarP(&pf.signMinisignKey, "sign_minisign_key", "", "", "sign the --sha256sums file with the specified minisign secret key file, writing the signature to <file>.minisig")
+	fs.StringVarP(&pf.summary, "summary", "", "", "write a JSON summary of the run (instance, target, SHA256 hashes of the written images, the next-step hints and the error, if any) to the specified path, for scripts")
+	fs.BoolVarP(&pf.qrCode, "qr", "", false, "print the URL of the web interface (including the password) as QR code after a successful flash or update, to open it on a phone")
+	fs.BoolVarP(&pf.hints, "hints", "", true, "print instructions for the next steps (e.g. how to boot the image, or how to create a file system on the perm partition). Disable for quiet output in scripts: the hints are still included in the --summary")
+}
+
+// findWorkspace locates the go.work workspace (if any), which needs to happen
+// before changing into the instance directory.
+func (pf *packFlags) findWorkspace() error {
+	workspace, err := publicpacker.FindWorkspace()
+	if err != nil {
+		return err
+	}
+	pf.workspace = workspace
+	return nil
+}
+
+func (pf *packFlags) apply(pack *packer.Pack) error {
+	pack.Workspace = pf.workspace
+	pack.EmbedLicenseTexts = pf.embedLicenseTexts
+	pack.Provenance = pf.provenance
+	pack.SignProvenance = pf.signProvenance
+	pack.SHA256Sums = pf.sha256Sums
+	pack.BuildManifest = pf.buildManifest
+	pack.SignGPGKey = pf.signGPGKey
+	pack.SignMinisignKey = pf.signMinisignKey
+	pack.Summary = pf.summary
+	pack.HideHints = !pf.hints
+	pack.QRCode = pf.qrCode
+	pack.CompressBinaries = pf.compressBinaries
+	pack.DedupFiles = pf.dedupFiles
+	pack.IntegrityCheck = pf.integrityCheck
+	pack.InitDebug = pf.initDebug
+	pack.RemoteExec = pf.remoteExec
+	pack.KeepTemp = pf.keepTemp
+	pack.Version = pf.imageVersion
+	pack.AllowDowngrade = pf.allowDowngrade
+	if pack.Version == "" {
+		// apply is called in the instance directory.
+		version, err := packer.ImageVersion(".")
+		if err != nil {
+			return err
+		}
+		pack.Version = version
+	}
+	etcConfig := pf.etcConfig
+	if etcConfig == "" {
+		// apply is called in the instance directory.
+		if _, err := os.Stat(packer.EtcConfigFile); err == nil {
+			etcConfig = packer.EtcConfigFile
+		}
+	}
+	if etcConfig != "" {
+		ec, err := packer.ReadEtcConfig(etcConfig)
+		if err != nil {
+			return err
+		}
+		pack.Etc = ec
+	}
+	if pf.rootManifest != "" {
+		m, err := manifest.ReadFile(pf.rootManifest)
+		if err != nil {
+			return err
+		}
+		pack.RootManifest = m
+	}
+	pack.WriteRootManifest = pf.writeRootManifest
+	pack.ArtifactCache = pf.artifactCache
+	pack.KeepBackup = pf.keepBackup
+	pack.Reproducible = pf.reproducible
+	pack.TempDir = pf.tmpDir
+	pack.SkipSpaceCheck = pf.skipSpaceCheck
+	pack.CPUProfile = pf.cpuProfile
+	pack.MemProfile = pf.memProfile
+	pack.Trace = pf.trace
+	pack.RunTargetTests = pf.runTargetTests
+	if len(pf.addHosts) > 0 || len(pf.dnsSearch) > 0 {
+		if pack.Etc == nil {
+			pack.Etc = &packer.EtcConfig{}
+		}
+		for _, s := range pf.addHosts {
+			entry, err := packer.ParseHostEntry(s)
+			if err != nil {
+				return err
+			}
+			pack.Etc.Hosts = append(pack.Etc.Hosts, entry)
+		}
+		pack.Etc.SearchDomains = append(pack.Etc.SearchDomains, pf.dnsSearch...)
+		if err := pack.Etc.Validate(); err != nil {
+			return err
+		}
+	}
+	healthChecks := pf.healthChecks
+	if healthChecks == "" {
+		// apply is called in the instance directory.
+		if _, err := os.Stat(healthcheck.File); err == nil {
+			healthChecks = healthcheck.File
+		}
+	}
+	if healthChecks != "" {
+		checks, err := healthcheck.ReadFile(healthChecks)
+		if err != nil {
+			return err
+		}
+		pack.HealthChecks = checks
+	}
+	pack.HealthCheckTimeout = pf.healthCheckTimeout
+	policy := pf.policy
+	if policy == "" {
+		// apply is called in the instance directory.
+		if _, err := os.Stat(packer.PolicyFile); err == nil {
+			policy = packer.PolicyFile
+		}
+	}
+	if policy != "" {
+		pol, err := packer.ReadPolicy(policy)
+		if err != nil {
+			return err
+		}
+		pack.Policy = pol
+	}
+	for _, s := range pf.volumes {
+		v, err := packer.ParseVolume(s)
+		if err != nil {
+			return err
+		}
+		pack.Volumes = append(pack.Volumes, v)
+	}
+	crashLogSize, err := packer.ParseCrashLogSize(pf.crashLogSize)
+	if err != nil {
+		return err
+	}
+	pack.CrashLogSize = crashLogSize
+	pack.Model = pf.model
+	if pf.models != "" {
+		pack.ModelImages, err = packer.ParseModelImages(pf.models)
+		if err != nil {
+			return err
+		}
+	}
+	pack.Arch = pf.arch
+	pack.GOOS = pf.goos
+	pack.GOARCH = pf.goarch
+	pack.GOARM = pf.goarm
+	if pf.board != "" {
+		// apply is called in the instance directory.
+		board, err := packer.ReadBoard(pf.board)
+		if err != nil {
+			return err
+		}
+		pack.Board = board
+	}
+	for _, s := range pf.extraKernels {
+		ek, err := packer.ParseExtraKernel(s)
+		if err != nil {
+			return err
+		}
+		pack.ExtraKernels = append(pack.ExtraKernels, ek)
+	}
+	if pf.layout != "" {
+		if pack.Layout, err = packer.ReadLayout(pf.layout); err != nil {
+			return err
+		}
+	}
+	for _, s := range pf.extraPartitions {
+		e, err := packer.ParseExtraPartition(s)
+		if err != nil {
+			return err
+		}
+		pack.Layout.Extra = append(pack.Layout.Extra, e)
+	}
+	if pf.exposePartition != "" {
+		pack.Layout.Expose = pf.exposePartition
+	}
+	if pf.bootSize != "" {
+		if pack.Layout.BootSize, err = packer.ParsePartitionSize(pf.bootSize); err != nil {
+			return fmt.Errorf("--boot_size: %v", err)
+		}
+	}
+	if pf.bootFileSystem != "" {
+		pack.Layout.BootFileSystem = pf.bootFileSystem
+	}
+	if pf.rootSize != "" {
+		if pack.Layout.RootSize, err = packer.ParsePartitionSize(pf.rootSize); err != nil {
+			return fmt.Errorf("--root_size: %v", err)
+		}
+	}
+	if pf.singleSlot {
+		pack.Layout.SingleSlot = true
+	}
+	pack.PartitionTable = pf.partitionTable
+	pack.RootFileSystem = pf.rootFileSystem
+	pack.DeviceSync = pf.deviceSync
+	pack.DeviceRetries = pf.deviceRetries
+	pack.PermFileSystem = pf.permFileSystem
+	if pf.mkfsPerm {
+		if pf.permFileSystem != "" && pf.permFileSystem != "ext4" {
+			return fmt.Errorf("--mkfs_perm conflicts with --perm_fs=%s", pf.permFileSystem)
+		}
+		pack.PermFileSystem = "ext4"
+	}
+	pack.PermLabel = pf.permLabel
+	pack.PreservePerm = pf.preservePerm
+	if err := pack.SetPermFileSystem(); err != nil {
+		return err
+	}
+	return pack.Layout.Validate()
+}
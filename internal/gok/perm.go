@@ -0,0 +1,99 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// permCmd is gok perm.
+var permCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "perm",
+	Short:   "Back up and restore the perm partition of a running gokrazy instance",
+	Long: `The perm subcommands archive the contents of the persistent data partition
+(/perm) of a running gokrazy instance as tar archive and restore them, e.g.
+before and after reflashing the instance with gok overwrite.
+
+This requires packing the instance with --remote_exec. The archives are
+authenticated with the gokrazy password and sent encrypted if the instance
+uses TLS.
+
+Examples:
+  % gok -i scanner perm backup -o scanner-perm.tar
+  % gok -i scanner overwrite --full=/dev/sdx
+  % gok -i scanner perm restore scanner-perm.tar
+`,
+}
+
+// permBackupCmd is gok perm backup.
+var permBackupCmd = &cobra.Command{
+	Use:   "backup -o <file>",
+	Short: "Download the contents of /perm as tar archive",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return permBackupImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type permBackupImplConfig struct {
+	output string
+}
+
+var permBackupImpl permBackupImplConfig
+
+// permRestoreCmd is gok perm restore.
+var permRestoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Extract a tar archive created with gok perm backup into /perm",
+	Long: `Extract a tar archive created with gok perm backup into /perm, overwriting
+existing files. Files which are not in the archive are kept.
+
+Services might overwrite the restored files while they are running, so restore
+before the services create their state (e.g. right after reflashing), and
+reboot afterwards.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return permRestoreImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type permRestoreImplConfig struct{}
+
+var permRestoreImpl permRestoreImplConfig
+
+func init() {
+	permBackupCmd.Flags().StringVarP(&permBackupImpl.output, "output", "o", "", "path of the tar archive to write")
+	instanceflag.RegisterPflags(permCmd.PersistentFlags())
+	permCmd.AddCommand(permBackupCmd)
+	permCmd.AddCommand(permRestoreCmd)
+}
+
+func (r *permBackupImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if r.output == "" {
+		return fmt.Errorf("the -o flag is empty, but required")
+	}
+	cfg, err := readConfigForDevice()
+	if err != nil {
+		return err
+	}
+	n, err := packer.BackupPerm(ctx, cfg, r.output)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Wrote /perm of %s to %s (%s)\n", cfg.Hostname, r.output, humanize.Bytes(uint64(n)))
+	return nil
+}
+
+func (r *permRestoreImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := readConfigForDevice()
+	if err != nil {
+		return err
+	}
+	return packer.RestorePerm(ctx, cfg, args[0], stdout)
+}
@@ -0,0 +1,131 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// rebootCmd is gok reboot.
+var rebootCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "reboot",
+	Short:   "Reboot a running gokrazy instance",
+	Long: `Reboot a running gokrazy instance, using the same address and credentials
+as gok update.
+
+Examples:
+  % gok -i scanner reboot
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return rebootImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+// poweroffCmd is gok poweroff.
+var poweroffCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "poweroff",
+	Short:   "Shut down a running gokrazy instance",
+	Long: `Shut down a running gokrazy instance, using the same address and
+credentials as gok update. The device stays off until it is power-cycled.
+
+Examples:
+  % gok -i scanner poweroff
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return poweroffImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+// switchCmd is gok switch.
+var switchCmd = &cobra.Command{
+	GroupID: "runtime",
+	Use:     "switch",
+	Short:   "Boot a running gokrazy instance from its other root partition",
+	Long: `Make a running gokrazy instance boot from its inactive root partition (which
+contains the previously installed image) and reboot it, without packing a new
+image. This is useful to roll back a bad update, or to test rolling back and
+forward again.
+
+With --testboot, the instance only boots from the other root partition once:
+if the test boot fails, the next reboot returns to the current image.
+
+Examples:
+  # roll back to the previous image
+  % gok -i scanner switch
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return switchImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type switchImplConfig struct {
+	testboot bool
+}
+
+var switchImpl switchImplConfig
+
+func (r *switchImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := readConfigForDevice()
+	if err != nil {
+		return err
+	}
+	if err := packer.SwitchRoot(ctx, cfg, r.testboot); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: switched root partition, rebooting\n", cfg.Hostname)
+	return nil
+}
+
+type powerImplConfig struct {
+	action packer.PowerAction
+}
+
+var (
+	rebootImpl   = powerImplConfig{action: packer.Reboot}
+	poweroffImpl = powerImplConfig{action: packer.Poweroff}
+)
+
+func init() {
+	instanceflag.RegisterPflags(rebootCmd.Flags())
+	instanceflag.RegisterPflags(poweroffCmd.Flags())
+	switchCmd.Flags().BoolVarP(&switchImpl.testboot, "testboot", "", false, "Trigger a testboot instead of switching to the other root partition permanently")
+	instanceflag.RegisterPflags(switchCmd.Flags())
+}
+
+// readConfigForDevice reads the config of the instance for the commands which
+// talk to the running gokrazy instance.
+func readConfigForDevice() (*config.Struct, error) {
+	cfg, err := config.ReadFromFile()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// best-effort compatibility for old setups
+			cfg = config.NewStruct(instanceflag.Instance())
+		} else {
+			return nil, err
+		}
+	}
+
+	updateflag.SetUpdate("yes")
+	return cfg, nil
+}
+
+func (r *powerImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := readConfigForDevice()
+	if err != nil {
+		return err
+	}
+	if err := packer.Power(ctx, cfg, r.action); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: %s requested\n", cfg.Hostname, r.action)
+	return nil
+}
@@ -2,6 +2,7 @@ package gok
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +12,8 @@ import (
 	"time"
 
 	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/measure"
+	"github.com/gokrazy/tools/internal/packer"
 	"github.com/spf13/cobra"
 )
 
@@ -23,10 +26,25 @@ var pushCmd = &cobra.Command{
 
 When the --json flag is specified, the server response is printed to stdout.
 
+Images built from a git working tree with uncommitted changes (i.e. whose
+version, see gok overwrite --image_version, ends in -dirty) are only pushed with
+--allow_dirty, so that every published version can be reproduced.
+
+With --compare_with, the images (mbr.img, boot.img and root.img) in the gaf file
+are compared against the latest published gaf file of the channel (a path or an
+HTTP(S) URL) first. When they are bit-identical, the gaf file is not pushed
+(unless --push_identical is specified), which avoids storing duplicate artifacts
+and needlessly updating devices. Only images built with gok overwrite
+--reproducible from identical inputs can be bit-identical.
+
 Examples:
   # push gokrazy.gaf to the GUS server at gus.gokrazy.org
   % gok push --gaf /tmp/gokrazy.gaf --server https://gus.gokrazy.org
 
+  # push gokrazy.gaf unless it is identical to the latest published image
+  % gok push --gaf /tmp/gokrazy.gaf --server https://gus.gokrazy.org \
+      --compare_with https://artifacts.example.com/stable/latest.gaf
+
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return pushImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
@@ -37,6 +55,11 @@ type pushConfig struct {
 	gafPath string
 	server  string
 	json    bool
+
+	allowDirty bool
+
+	compareWith   string
+	pushIdentical bool
 }
 
 var pushImpl pushConfig
@@ -45,10 +68,40 @@ func init() {
 	pushCmd.Flags().StringVarP(&pushImpl.gafPath, "gaf", "", "", "path to the .gaf (gokrazy archive format) file to push to GUS (e.g. /tmp/gokrazy.gaf); build using gok overwrite --gaf")
 	pushCmd.Flags().StringVarP(&pushImpl.server, "server", "", "", "HTTP(S) URL to the server to push to")
 	pushCmd.Flags().BoolVarP(&pushImpl.json, "json", "", false, "print server JSON response directly to stdout")
+	pushCmd.Flags().BoolVarP(&pushImpl.allowDirty, "allow_dirty", "", false, "push images built from a git working tree with uncommitted changes")
+	pushCmd.Flags().StringVarP(&pushImpl.compareWith, "compare_with", "", "", "path or HTTP(S) URL of the latest published gaf file of the channel: if the images are bit-identical (see gok overwrite --reproducible), the gaf file is not pushed")
+	pushCmd.Flags().BoolVarP(&pushImpl.pushIdentical, "push_identical", "", false, "push the gaf file even if its images are identical to the --compare_with gaf file")
 	instanceflag.RegisterPflags(pushCmd.Flags())
 }
 
 func (r *pushConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	version, err := packer.GafVersion(r.gafPath)
+	if err != nil {
+		return err
+	}
+	if packer.IsDirtyVersion(version) && !r.allowDirty {
+		return fmt.Errorf("%s was built from a working tree with uncommitted changes (version %s); commit them and rebuild, or use --allow_dirty", r.gafPath, version)
+	}
+
+	if r.compareWith != "" {
+		identical, err := r.identicalToPublished(ctx)
+		if err != nil {
+			return fmt.Errorf("comparing with %s: %v", r.compareWith, err)
+		}
+		if identical && !r.pushIdentical {
+			log.Printf("%s is identical to %s, not pushing (use --push_identical to push anyway)", r.gafPath, r.compareWith)
+			if r.json {
+				return json.NewEncoder(stdout).Encode(struct {
+					IdenticalTo string `json:"identical_to"`
+				}{r.compareWith})
+			}
+			return nil
+		}
+		if identical {
+			log.Printf("%s is identical to %s, pushing anyway", r.gafPath, r.compareWith)
+		}
+	}
+
 	// TODO: use an io.Reader that allows us to indicate progress
 	body, err := os.Open(r.gafPath)
 	if err != nil {
@@ -63,12 +116,18 @@ func (r *pushConfig) run(ctx context.Context, args []string, stdout, stderr io.W
 	// TODO: fall back to the GUS server in the instance config if r.server == ""
 	start := time.Now()
 	url := strings.TrimSuffix(r.server, "/") + "/api/v1/push"
-	req, err := http.NewRequestWithContext(ctx, "PUT", url, body)
+	phase := measure.StartPhase("pushing "+r.gafPath, st.Size())
+	defer phase.End()
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, io.TeeReader(body, phase))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
-	log.Printf("pushing %s (%d bytes) to %s", r.gafPath, st.Size(), url)
+	if version != "" {
+		log.Printf("pushing %s (version %s, %d bytes) to %s", r.gafPath, version, st.Size(), url)
+	} else {
+		log.Printf("pushing %s (%d bytes) to %s", r.gafPath, st.Size(), url)
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -89,3 +148,42 @@ func (r *pushConfig) run(ctx context.Context, args []string, stdout, stderr io.W
 
 	return nil
 }
+
+// identicalToPublished returns whether the images of the gaf file are
+// identical to those of the gaf file r.compareWith, which is downloaded first
+// if it is an HTTP(S) URL.
+func (r *pushConfig) identicalToPublished(ctx context.Context) (bool, error) {
+	published := r.compareWith
+	if strings.HasPrefix(published, "http://") || strings.HasPrefix(published, "https://") {
+		f, err := os.CreateTemp("", "gokrazy-published-*.gaf")
+		if err != nil {
+			return false, err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		req, err := http.NewRequestWithContext(ctx, "GET", published, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			// Nothing was published yet.
+			return false, nil
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			return false, fmt.Errorf("unexpected HTTP status: got %v, want %v", resp.Status, want)
+		}
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			return false, err
+		}
+		if err := f.Close(); err != nil {
+			return false, err
+		}
+		published = f.Name()
+	}
+	return packer.IdenticalGafImages(r.gafPath, published)
+}
@@ -62,8 +62,20 @@ func init() {
 	instanceflag.RegisterPflags(RootCmd.Flags())
 	RootCmd.AddCommand(runCmd)
 	RootCmd.AddCommand(logsCmd)
+	RootCmd.AddCommand(execCmd)
+	RootCmd.AddCommand(rebootCmd)
+	RootCmd.AddCommand(poweroffCmd)
+	RootCmd.AddCommand(switchCmd)
+	RootCmd.AddCommand(backupCmd)
+	RootCmd.AddCommand(permCmd)
 	RootCmd.AddCommand(updateCmd)
 	RootCmd.AddCommand(overwriteCmd)
+	RootCmd.AddCommand(microvmTestCmd)
+	RootCmd.AddCommand(flashCmd)
+	RootCmd.AddCommand(cloneCmd)
+	RootCmd.AddCommand(doctorCmd)
+	RootCmd.AddCommand(statsCmd)
+	RootCmd.AddCommand(historyCmd)
 	RootCmd.AddCommand(versionCmd)
 	RootCmd.AddCommand(newCmd)
 	RootCmd.AddCommand(editCmd)
@@ -71,4 +83,6 @@ func init() {
 	RootCmd.AddCommand(getCmd)
 	RootCmd.AddCommand(sbomCmd)
 	RootCmd.AddCommand(pushCmd)
+	RootCmd.AddCommand(fleetCmd)
+	RootCmd.AddCommand(cronCmd)
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/gokrazy/internal/instanceflag"
 	"github.com/gokrazy/internal/progress"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/measure"
 	"github.com/gokrazy/tools/packer"
 	"github.com/gokrazy/updater"
 	"github.com/spf13/cobra"
@@ -138,13 +139,17 @@ func (r *runImplConfig) run(ctx context.Context, args []string, stdout, stderr i
 	defer f.Close()
 
 	prog.SetStatus("uploading " + basename)
+	var total int64
 	if st, err := f.Stat(); err == nil {
-		prog.SetTotal(uint64(st.Size()))
+		total = st.Size()
+		prog.SetTotal(uint64(total))
 	}
 
 	{
 		start := time.Now()
-		err := target.Put("uploadtemp/gok-run/"+basename, io.TeeReader(f, &progress.Writer{}))
+		phase := measure.StartPhase("uploading "+basename, total)
+		err := target.Put("uploadtemp/gok-run/"+basename, io.TeeReader(f, io.MultiWriter(&progress.Writer{}, phase)))
+		phase.End()
 		if err != nil {
 			return fmt.Errorf("uploading temporary binary: %v", err)
 		}
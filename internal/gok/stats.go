@@ -0,0 +1,170 @@
+package gok
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gokrazy/internal/humanize"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/tools/internal/packer"
+	"github.com/spf13/cobra"
+)
+
+// statsCmd is gok stats.
+var statsCmd = &cobra.Command{
+	GroupID: "deploy",
+	Use:     "stats",
+	Short:   "Show local build statistics of a gokrazy instance",
+	Long: `gok stats shows how build durations, unchanged (cached) programs and image
+sizes of a gokrazy instance developed over time.
+
+Statistics are only recorded after opting in with gok stats --enable, and are
+stored in a local file which is never uploaded anywhere. To stop recording
+(and delete all recorded statistics), delete the file.
+
+Examples:
+  % gok stats --enable
+  % gok -i scanner stats
+  % gok -i scanner stats --last=50
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return statsImpl.run(cmd.Context(), args, cmd.OutOrStdout(), cmd.OutOrStderr())
+	},
+}
+
+type statsImplConfig struct {
+	enable bool
+	last   int
+}
+
+var statsImpl statsImplConfig
+
+func init() {
+	statsCmd.Flags().BoolVarP(&statsImpl.enable, "enable", "", false, "start recording build statistics (stored locally only)")
+	statsCmd.Flags().IntVarP(&statsImpl.last, "last", "", 20, "number of most recent builds to show")
+	instanceflag.RegisterPflags(statsCmd.Flags())
+}
+
+// sparkline renders values as a line of block characters, scaled between the
+// smallest and the largest value.
+func sparkline(values []float64) string {
+	const blocks = "▁▂▃▄▅▆▇█"
+	levels := []rune(blocks)
+	if len(values) == 0 {
+		return ""
+	}
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	line := make([]rune, len(values))
+	for i, v := range values {
+		idx := 0
+		if max > min {
+			idx = int((v - min) / (max - min) * float64(len(levels)-1))
+		}
+		line[i] = levels[idx]
+	}
+	return string(line)
+}
+
+func (r *statsImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	path := packer.StatsPath()
+	if r.enable {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Recording build statistics to %s\n", path)
+		fmt.Fprintf(stdout, "To stop recording, delete the file.\n")
+		return nil
+	}
+
+	all, err := packer.ReadStats()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("recording statistics is not enabled, enable it with: gok stats --enable")
+		}
+		return err
+	}
+	instance := instanceflag.Instance()
+	var stats []*packer.BuildStats
+	for _, s := range all {
+		if s.Instance == instance {
+			stats = append(stats, s)
+		}
+	}
+	if len(stats) == 0 {
+		fmt.Fprintf(stdout, "No builds of instance %q recorded yet in %s\n", instance, path)
+		return nil
+	}
+
+	// prev[i] is the previous build of stats[i], if any.
+	prev := make([]*packer.BuildStats, len(stats))
+	for i := 1; i < len(stats); i++ {
+		prev[i] = stats[i-1]
+	}
+	if r.last > 0 && len(stats) > r.last {
+		stats = stats[len(stats)-r.last:]
+		prev = prev[len(prev)-r.last:]
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TIME\tTARGET\tBUILD\tTOTAL\tUNCHANGED\tROOT\tBOOT\n")
+	var (
+		buildDurations []float64
+		rootSizes      []float64
+	)
+	for i, s := range stats {
+		unchanged := "-"
+		if prev[i] != nil && len(s.Binaries) > 0 {
+			unchanged = fmt.Sprintf("%d/%d", s.Unchanged(prev[i]), len(s.Binaries))
+		}
+		root, boot := "-", "-"
+		if s.RootBytes > 0 {
+			root = humanize.Bytes(uint64(s.RootBytes))
+			rootSizes = append(rootSizes, float64(s.RootBytes))
+		}
+		if s.BootBytes > 0 {
+			boot = humanize.Bytes(uint64(s.BootBytes))
+		}
+		buildDurations = append(buildDurations, s.BuildDuration.Seconds())
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%v\t%s\t%s\t%s\n",
+			s.Time.Local().Format("2006-01-02 15:04"),
+			s.Target,
+			s.BuildDuration.Round(100*time.Millisecond),
+			s.TotalDuration.Round(100*time.Millisecond),
+			unchanged,
+			root,
+			boot)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "\n")
+	fmt.Fprintf(stdout, "build duration: %s\n", sparkline(buildDurations))
+	if len(rootSizes) > 0 {
+		fmt.Fprintf(stdout, "root size:      %s (%+.1f MiB since %s)\n",
+			sparkline(rootSizes),
+			(rootSizes[len(rootSizes)-1]-rootSizes[0])/1024/1024,
+			stats[0].Time.Local().Format("2006-01-02"))
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/instanceflag"
@@ -34,6 +35,8 @@ var updateCmd = &cobra.Command{
 type updateImplConfig struct {
 	insecure bool
 	testboot bool
+
+	packFlags
 }
 
 var updateImpl updateImplConfig
@@ -42,6 +45,7 @@ func init() {
 	instanceflag.RegisterPflags(updateCmd.Flags())
 	updateCmd.Flags().BoolVarP(&updateImpl.insecure, "insecure", "", false, "Disable TLS stripping detection. Should only be used when first enabling TLS, not permanently.")
 	updateCmd.Flags().BoolVarP(&updateImpl.testboot, "testboot", "", false, "Trigger a testboot instead of switching to the new root partition directly")
+	updateImpl.packFlags.register(updateCmd.Flags())
 }
 
 func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
@@ -72,6 +76,21 @@ func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stder
 		cfg.InternalCompatibilityFlags.Testboot = true
 	}
 
+	// Turn the output paths into absolute paths so that the output files
+	// land in the current directory despite the os.Chdir() call below.
+	for _, str := range []*string{&r.provenance, &r.buildManifest, &r.writeRootManifest, &r.artifactCache, &r.cpuProfile, &r.memProfile, &r.trace, &r.sha256Sums, &r.signMinisignKey, &r.tmpDir} {
+		if *str != "" {
+			*str, err = filepath.Abs(*str)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := r.packFlags.findWorkspace(); err != nil {
+		return err
+	}
+
 	if err := os.Chdir(config.InstancePath()); err != nil {
 		return err
 	}
@@ -79,6 +98,9 @@ func (r *updateImplConfig) run(ctx context.Context, args []string, stdout, stder
 	pack := &packer.Pack{
 		Cfg: cfg,
 	}
+	if err := r.packFlags.apply(pack); err != nil {
+		return err
+	}
 
 	pack.Main("gokrazy gok")
 
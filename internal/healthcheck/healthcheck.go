@@ -0,0 +1,290 @@
+// Package healthcheck implements checks which verify that the services of a
+// gokrazy instance work, e.g. after an update. The checks are declared per
+// service in the File of the instance directory. For example:
+//
+//	{
+//	  "github.com/stapelberg/scan2drive/cmd/scan2drive": [
+//	    {"Type": "http", "Port": 80, "Path": "/healthz"},
+//	    {"Type": "tcp", "Port": 22}
+//	  ],
+//	  "mqtt-bridge": [
+//	    {"Type": "command", "Command": ["mosquitto_sub", "-h", "$GOKRAZY_HOST", "-t", "status", "-C", "1"], "Expect": "^online"}
+//	  ]
+//	}
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is the name of the file in the instance directory from which gok reads
+// the health checks, if present.
+const File = "healthchecks.json"
+
+// Check is one health check of a service.
+type Check struct {
+	// Type is one of http (GET returns a 2xx status), tcp (the port accepts
+	// connections) or command (the command succeeds).
+	Type string
+
+	// Port is the port of the http and tcp checks.
+	Port int `json:",omitempty"`
+
+	// Path is the path of the http check, default /.
+	Path string `json:",omitempty"`
+
+	// Command is run on the host for command checks, with $GOKRAZY_HOST
+	// (expanded in the arguments, too) set to the address of the instance.
+	Command []string `json:",omitempty"`
+
+	// Expect is a regular expression which the response body (http) or the
+	// output (command) must match (ignoring surrounding whitespace), if
+	// non-empty.
+	Expect string `json:",omitempty"`
+}
+
+func (c Check) String() string {
+	switch c.Type {
+	case "http":
+		return fmt.Sprintf("http:%d%s", c.Port, c.path())
+	case "tcp":
+		return fmt.Sprintf("tcp:%d", c.Port)
+	case "command":
+		return "command:" + strings.Join(c.Command, " ")
+	}
+	return c.Type
+}
+
+func (c Check) path() string {
+	if c.Path == "" {
+		return "/"
+	}
+	return c.Path
+}
+
+// Validate returns an error if the check is incomplete.
+func (c Check) Validate() error {
+	switch c.Type {
+	case "http", "tcp":
+		if c.Port < 1 || c.Port > 65535 {
+			return fmt.Errorf("%s check: invalid port %d", c.Type, c.Port)
+		}
+		if c.Type == "http" && !strings.HasPrefix(c.path(), "/") {
+			return fmt.Errorf("http check: path %q does not start with /", c.Path)
+		}
+	case "command":
+		if len(c.Command) == 0 {
+			return fmt.Errorf("command check: no command specified")
+		}
+	default:
+		return fmt.Errorf("unknown check type %q, expected http, tcp or command", c.Type)
+	}
+	if c.Type == "tcp" && c.Expect != "" {
+		return fmt.Errorf("tcp check: Expect is not supported")
+	}
+	if _, err := regexp.Compile(c.Expect); err != nil {
+		return fmt.Errorf("%s check: invalid Expect: %v", c.Type, err)
+	}
+	return nil
+}
+
+// Parse parses the short form tcp:<port> or http:<port>[<path>] of a check,
+// as used in command line flags.
+func Parse(spec string) (Check, error) {
+	typ, rest, ok := strings.Cut(spec, ":")
+	if !ok || (typ != "tcp" && typ != "http") {
+		return Check{}, fmt.Errorf("invalid check %q: expected tcp:<port> or http:<port>[<path>]", spec)
+	}
+	port, path := rest, ""
+	if typ == "http" {
+		if idx := strings.IndexByte(rest, '/'); idx > -1 {
+			port, path = rest[:idx], rest[idx:]
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return Check{}, fmt.Errorf("invalid check %q: invalid port %q", spec, port)
+	}
+	return Check{Type: typ, Port: p, Path: path}, nil
+}
+
+// ReadFile reads the health checks per service (program name or package) from
+// the JSON file path.
+func ReadFile(path string) (map[string][]Check, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var checks map[string][]Check
+	if err := json.Unmarshal(b, &checks); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for service, cs := range checks {
+		for _, c := range cs {
+			if err := c.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: service %s: %v", path, service, err)
+			}
+		}
+	}
+	return checks, nil
+}
+
+// matchExpect returns an error if b does not match the Expect expression.
+func (c Check) matchExpect(b []byte) error {
+	if c.Expect == "" {
+		return nil
+	}
+	re, err := regexp.Compile(c.Expect)
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimSpace(b)
+	if !re.Match(b) {
+		const max = 200
+		if len(b) > max {
+			b = append(b[:max:max], "…"...)
+		}
+		return fmt.Errorf("%q does not match %q", b, c.Expect)
+	}
+	return nil
+}
+
+// Run runs the check once against the instance at host.
+func (c Check) Run(ctx context.Context, host string) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(c.Port))
+	switch c.Type {
+	case "tcp":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+c.path(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return c.matchExpect(b)
+
+	case "command":
+		expand := func(s string) string {
+			return strings.ReplaceAll(s, "$GOKRAZY_HOST", host)
+		}
+		args := make([]string, len(c.Command))
+		for i, arg := range c.Command {
+			args[i] = expand(arg)
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), "GOKRAZY_HOST="+host)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %v: %s", cmd.Args, err, bytes.TrimSpace(out))
+		}
+		return c.matchExpect(out)
+	}
+	return fmt.Errorf("unknown check type %q", c.Type)
+}
+
+// Result is the outcome of a check of a service.
+type Result struct {
+	Service string
+	Check   Check
+	Err     error // nil if the check passed
+}
+
+// notYetRun returns a result for each check, sorted by service.
+func notYetRun(checks map[string][]Check) []Result {
+	services := make([]string, 0, len(checks))
+	for service := range checks {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	var results []Result
+	for _, service := range services {
+		for _, c := range checks[service] {
+			results = append(results, Result{Service: service, Check: c, Err: fmt.Errorf("not yet run")})
+		}
+	}
+	return results
+}
+
+// RunAll runs the checks of all services against the instance at host once
+// (e.g. to display the health of an instance) and returns the results, sorted
+// by service.
+func RunAll(ctx context.Context, host string, checks map[string][]Check) []Result {
+	results := notYetRun(checks)
+	for i := range results {
+		cctx, ccancel := context.WithTimeout(ctx, 5*time.Second)
+		results[i].Err = results[i].Check.Run(cctx, host)
+		ccancel()
+	}
+	return results
+}
+
+// WaitHealthy runs the checks of all services against the instance at host
+// until all of them passed, retrying failed checks until the timeout expires.
+// Passing checks are reported via logf. It returns the last results (all
+// passed if the error is nil).
+func WaitHealthy(ctx context.Context, host string, checks map[string][]Check, timeout time.Duration, logf func(format string, v ...any)) ([]Result, error) {
+	results := notYetRun(checks)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		pending := 0
+		for i := range results {
+			r := &results[i]
+			if r.Err == nil {
+				continue
+			}
+			cctx, ccancel := context.WithTimeout(ctx, 5*time.Second)
+			r.Err = r.Check.Run(cctx, host)
+			ccancel()
+			if r.Err == nil {
+				logf("health check passed: %s: %s", r.Service, r.Check)
+			} else {
+				pending++
+			}
+		}
+		if pending == 0 {
+			return results, nil
+		}
+		select {
+		case <-ctx.Done():
+			var failed []string
+			for _, r := range results {
+				if r.Err != nil {
+					failed = append(failed, fmt.Sprintf("%s: %s: %v", r.Service, r.Check, r.Err))
+				}
+			}
+			return results, fmt.Errorf("%d of %d health checks failed:\n  %s", pending, len(results), strings.Join(failed, "\n  "))
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		spec string
+		want Check
+	}{
+		{"tcp:22", Check{Type: "tcp", Port: 22}},
+		{"http:80", Check{Type: "http", Port: 80}},
+		{"http:8080/healthz", Check{Type: "http", Port: 8080, Path: "/healthz"}},
+	} {
+		got, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != tt.want.String() || got.Path != tt.want.Path {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+	for _, spec := range []string{"udp:53", "tcp:", "tcp:ssh", "http:0/"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), File)
+	if err := os.WriteFile(path, []byte(`{"scan2drive": [{"Type": "http", "Port": 80, "Expect": "ok"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checks, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := checks["scan2drive"]; len(got) != 1 || got[0].String() != "http:80/" {
+		t.Errorf("ReadFile() = %+v, want one http:80/ check", checks)
+	}
+
+	for _, invalid := range []string{
+		`{"scan2drive": [{"Type": "udp", "Port": 53}]}`,
+		`{"scan2drive": [{"Type": "tcp"}]}`,
+		`{"scan2drive": [{"Type": "command"}]}`,
+		`{"scan2drive": [{"Type": "http", "Port": 80, "Expect": "("}]}`,
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadFile(path); err == nil {
+			t.Errorf("ReadFile(%s) unexpectedly succeeded", invalid)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "status: ok\n")
+	}))
+	defer srv.Close()
+	_, portStr, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	for _, tt := range []struct {
+		check   Check
+		wantErr bool
+	}{
+		{Check{Type: "tcp", Port: port}, false},
+		{Check{Type: "http", Port: port, Path: "/healthz"}, false},
+		{Check{Type: "http", Port: port, Path: "/healthz", Expect: "status: ok"}, false},
+		{Check{Type: "http", Port: port, Path: "/healthz", Expect: "degraded"}, true},
+		{Check{Type: "http", Port: port, Path: "/missing"}, true},
+		{Check{Type: "command", Command: []string{"sh", "-c", "echo $GOKRAZY_HOST"}, Expect: `^127\.0\.0\.1$`}, false},
+		{Check{Type: "command", Command: []string{"echo", "$GOKRAZY_HOST"}, Expect: `^127\.0\.0\.1`}, false},
+		{Check{Type: "command", Command: []string{"false"}}, true},
+	} {
+		err := tt.check.Run(context.Background(), "127.0.0.1")
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: err = %v, want error: %v", tt.check, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWaitHealthy(t *testing.T) {
+	// The port only starts accepting connections after a while, like a
+	// service after a reboot.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	listening := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Error(err)
+		}
+		listening <- ln
+	}()
+	defer func() {
+		if ln := <-listening; ln != nil {
+			ln.Close()
+		}
+	}()
+
+	checks := map[string][]Check{"svc": {{Type: "tcp", Port: port}}}
+	var passed []string
+	logf := func(format string, v ...any) { passed = append(passed, fmt.Sprintf(format, v...)) }
+	if _, err := WaitHealthy(context.Background(), "127.0.0.1", checks, 10*time.Second, logf); err != nil {
+		t.Fatal(err)
+	}
+	if len(passed) != 1 {
+		t.Errorf("passed = %q, want one entry", passed)
+	}
+
+	checks["svc"] = append(checks["svc"], Check{Type: "command", Command: []string{"false"}})
+	_, err = WaitHealthy(context.Background(), "127.0.0.1", checks, 500*time.Millisecond, logf)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 health checks failed") {
+		t.Errorf("WaitHealthy() = %v, want 1 of 2 health checks failed", err)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	checks := map[string][]Check{
+		"web": {{Type: "command", Command: []string{"false"}}},
+		"db":  {{Type: "command", Command: []string{"true"}}},
+	}
+	results := RunAll(context.Background(), "127.0.0.1", checks)
+	if len(results) != 2 {
+		t.Fatalf("RunAll returned %d results, want 2", len(results))
+	}
+	if got, want := results[0].Service, "db"; got != want {
+		t.Errorf("results[0].Service = %q, want %q", got, want)
+	}
+	if results[0].Err != nil {
+		t.Errorf("db: %v", results[0].Err)
+	}
+	if results[1].Err == nil {
+		t.Errorf("web: unexpectedly passed")
+	}
+}
@@ -0,0 +1,131 @@
+package i18n
+
+// de contains the German translations.
+var de = map[string]string{
+	"To boot gokrazy, plug the SD card into a supported device (see https://gokrazy.org/platforms/)\n": "Um gokrazy zu starten, stecke die SD-Karte in ein unterstütztes Gerät (siehe https://gokrazy.org/platforms/)\n",
+
+	"To boot gokrazy, plug the SD card written from the stream into a supported device (see https://gokrazy.org/platforms/)\n": "Um gokrazy zu starten, stecke die aus dem Datenstrom beschriebene SD-Karte in ein unterstütztes Gerät (siehe https://gokrazy.org/platforms/)\n",
+
+	"To boot gokrazy, copy %s to an SD card and plug it into a supported device (see https://gokrazy.org/platforms/)\n": "Um gokrazy zu starten, kopiere %s auf eine SD-Karte und stecke sie in ein unterstütztes Gerät (siehe https://gokrazy.org/platforms/)\n",
+
+	"To boot gokrazy, import %s into your hypervisor or cloud provider and boot it via UEFI\n": "Um gokrazy zu starten, importiere %s in deinen Hypervisor oder bei deinem Cloud-Anbieter und starte es per UEFI\n",
+
+	"To boot gokrazy, write %s to an SD card (e.g. using the Raspberry Pi Imager) and plug it into a supported device (see https://gokrazy.org/platforms/)\n": "Um gokrazy zu starten, schreibe %s auf eine SD-Karte (z.B. mit dem Raspberry Pi Imager) und stecke sie in ein unterstütztes Gerät (siehe https://gokrazy.org/platforms/)\n",
+
+	"To boot gokrazy, run e.g.:\n  %s\n": "Um gokrazy zu starten, führe z.B. folgendes aus:\n  %s\n",
+
+	"If your applications need to store persistent data, unplug and re-plug the SD card, then create a file system using e.g.:\n": "Falls deine Programme dauerhaft Daten speichern müssen, entferne die SD-Karte, stecke sie wieder ein und erstelle dann ein Dateisystem, z.B. mit:\n",
+
+	"If your applications need to store persistent data, create a file system using e.g.:\n": "Falls deine Programme dauerhaft Daten speichern müssen, erstelle ein Dateisystem, z.B. mit:\n",
+
+	"Scan the QR code to open the web interface:\n": "Scanne den QR-Code, um die Weboberfläche zu öffnen:\n",
+
+	"Wrote shrunk image (%d MB) and %s\n": "Verkleinertes Abbild (%d MB) und %s geschrieben\n",
+
+	"To write the image to an SD card, creating partitions for its size, use:\n": "Um das Abbild auf eine SD-Karte zu schreiben und die Partitionen an ihre Größe anzupassen, verwende:\n",
+
+	`
+gokr-packer packs gokrazy installations into SD card or file system images.
+
+Usage:
+To directly partition and overwrite an SD card:
+gokr-packer -overwrite=<device> <go-package> [<go-package>…]
+
+To create an SD card image on the file system:
+gokr-packer -overwrite=<file> -target_storage_bytes=<bytes> <go-package> [<go-package>…]
+
+To create a file system image of the boot or root file system:
+gokr-packer [-overwrite_boot=<file>|-overwrite_root=<file>] <go-package> [<go-package>…]
+
+To create file system images of both file systems:
+gokr-packer -overwrite_boot=<file> -overwrite_root=<file> <go-package> [<go-package>…]
+
+To create all of the above (the SD card image, both file system images, the MBR
+and the init source code) in a directory at once:
+gokr-packer -output_dir=<dir> <go-package> [<go-package>…]
+
+All of the above commands can be combined with the -update flag, and with
+-from=<image|device|hostname> to default to the instance config (packages,
+hostname, ports, password and certificate) of an existing installation.
+
+To dump the auto-generated init source code (for use with -init_pkg later):
+gokr-packer -overwrite_init=<file> <go-package> [<go-package>…]
+
+To reboot or shut down a running installation (-update defaults to yes):
+gokr-packer [reboot|poweroff] -hostname=<hostname> [-update=<url>]
+
+To boot a running installation from its other root partition, e.g. to roll
+back an update (only for the next boot with -testboot):
+gokr-packer switch [-testboot] -hostname=<hostname> [-update=<url>]
+
+To download the partitions of a running installation packed with -remote_exec
+(and with -backup_perm, the contents of /perm) into a directory:
+gokr-packer backup [-backup_perm] -hostname=<hostname> [-update=<url>] <dir>
+
+To archive /perm of a running installation packed with -remote_exec as tar
+archive, or to extract such an archive into /perm:
+gokr-packer perm [backup|restore] -hostname=<hostname> [-update=<url>] <file>
+
+To copy the storage device of an installation (e.g. an SD card) into an image
+and recover as much of its instance config as possible:
+gokr-packer clone [-config_out=<file>] <device> <image>
+
+To print the graph of the packages of an image, i.e. the Go modules they depend
+on and the image files they produce, without building anything:
+gokr-packer graph [-graph_format=dot|json] <go-package> [<go-package>…]
+
+Flags:
+`: `
+gokr-packer packt gokrazy-Installationen in SD-Karten- oder Dateisystem-Abbilder.
+
+Verwendung:
+Um eine SD-Karte direkt zu partitionieren und zu überschreiben:
+gokr-packer -overwrite=<Gerät> <Go-Paket> [<Go-Paket>…]
+
+Um ein SD-Karten-Abbild im Dateisystem zu erstellen:
+gokr-packer -overwrite=<Datei> -target_storage_bytes=<Bytes> <Go-Paket> [<Go-Paket>…]
+
+Um ein Abbild des Boot- oder Root-Dateisystems zu erstellen:
+gokr-packer [-overwrite_boot=<Datei>|-overwrite_root=<Datei>] <Go-Paket> [<Go-Paket>…]
+
+Um Abbilder beider Dateisysteme zu erstellen:
+gokr-packer -overwrite_boot=<Datei> -overwrite_root=<Datei> <Go-Paket> [<Go-Paket>…]
+
+Um alles obige (das SD-Karten-Abbild, beide Dateisystem-Abbilder, den MBR und
+den init-Quellcode) auf einmal in einem Verzeichnis zu erstellen:
+gokr-packer -output_dir=<Verzeichnis> <Go-Paket> [<Go-Paket>…]
+
+Alle obigen Befehle können mit dem Flag -update kombiniert werden, sowie mit
+-from=<Abbild|Gerät|Hostname>, um die Instanz-Konfiguration (Pakete, Hostname,
+Ports, Passwort und Zertifikat) einer bestehenden Installation zu übernehmen.
+
+Um den automatisch erzeugten init-Quellcode auszugeben (für -init_pkg):
+gokr-packer -overwrite_init=<Datei> <Go-Paket> [<Go-Paket>…]
+
+Um eine laufende Installation neu zu starten oder herunterzufahren (-update
+ist standardmäßig yes):
+gokr-packer [reboot|poweroff] -hostname=<Hostname> [-update=<URL>]
+
+Um eine laufende Installation von ihrer anderen Root-Partition zu starten,
+z.B. um ein Update rückgängig zu machen (mit -testboot nur beim nächsten Start):
+gokr-packer switch [-testboot] -hostname=<Hostname> [-update=<URL>]
+
+Um die Partitionen einer mit -remote_exec gepackten laufenden Installation
+(und mit -backup_perm den Inhalt von /perm) in ein Verzeichnis herunterzuladen:
+gokr-packer backup [-backup_perm] -hostname=<Hostname> [-update=<URL>] <Verzeichnis>
+
+Um /perm einer mit -remote_exec gepackten laufenden Installation als
+tar-Archiv zu sichern oder ein solches Archiv nach /perm zu entpacken:
+gokr-packer perm [backup|restore] -hostname=<Hostname> [-update=<URL>] <Datei>
+
+Um das Speichergerät einer Installation (z.B. eine SD-Karte) in ein Abbild zu
+kopieren und möglichst viel seiner Instanz-Konfiguration wiederherzustellen:
+gokr-packer clone [-config_out=<Datei>] <Gerät> <Abbild>
+
+Um den Graphen der Pakete eines Abbilds auszugeben, d.h. die Go-Module, von denen
+sie abhängen, und die Dateien, die sie im Abbild erzeugen, ohne etwas zu bauen:
+gokr-packer graph [-graph_format=dot|json] <Go-Paket> [<Go-Paket>…]
+
+Flags:
+`,
+}
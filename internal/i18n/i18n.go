@@ -0,0 +1,78 @@
+// Package i18n translates the user-facing output of gok and gokr-packer which
+// is read by people who do not necessarily develop gokrazy appliances
+// themselves (e.g. the next steps after writing an SD card, which the person
+// assembling devices follows).
+//
+// Messages are identified by their English format string, like with gettext:
+// code calls i18n.Printf("To boot gokrazy, …") and the English text is used
+// when there is no translation. The language is selected by the LC_ALL,
+// LC_MESSAGES or LANG environment variables (e.g. LANG=de_CH.UTF-8).
+// Command line flags and error messages are not translated.
+package i18n
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// catalogs maps languages (ISO 639-1 codes) to their translations.
+var catalogs = map[string]map[string]string{
+	"de": de,
+}
+
+var (
+	langOnce sync.Once
+	lang     string
+)
+
+// parseLocale returns the language of a POSIX locale name, e.g. de for
+// de_CH.UTF-8@euro.
+func parseLocale(locale string) string {
+	if i := strings.IndexAny(locale, "_.@"); i > -1 {
+		locale = locale[:i]
+	}
+	return strings.ToLower(locale)
+}
+
+// Language returns the language in which messages are printed, or the empty
+// string for English.
+func Language() string {
+	langOnce.Do(func() {
+		for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			if v := os.Getenv(env); v != "" {
+				if _, ok := catalogs[parseLocale(v)]; ok {
+					lang = parseLocale(v)
+				}
+				return
+			}
+		}
+	})
+	return lang
+}
+
+// translate returns the translation of format into lang, or format if there
+// is none.
+func translate(lang, format string) string {
+	if t, ok := catalogs[lang][format]; ok {
+		return t
+	}
+	return format
+}
+
+// Sprintf is like fmt.Sprintf, but uses the translation of format.
+func Sprintf(format string, args ...interface{}) string {
+	return fmt.Sprintf(translate(Language(), format), args...)
+}
+
+// Printf is like fmt.Printf, but uses the translation of format.
+func Printf(format string, args ...interface{}) (int, error) {
+	return fmt.Printf(translate(Language(), format), args...)
+}
+
+// Fprintf is like fmt.Fprintf, but uses the translation of format.
+func Fprintf(w io.Writer, format string, args ...interface{}) (int, error) {
+	return fmt.Fprintf(w, translate(Language(), format), args...)
+}
@@ -0,0 +1,161 @@
+package i18n
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseLocale(t *testing.T) {
+	for _, tt := range []struct {
+		locale string
+		want   string
+	}{
+		{"de_CH.UTF-8", "de"},
+		{"de_DE@euro", "de"},
+		{"de", "de"},
+		{"DE_de", "de"},
+		{"C.UTF-8", "c"},
+		{"", ""},
+	} {
+		if got := parseLocale(tt.locale); got != tt.want {
+			t.Errorf("parseLocale(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	const msg = "To boot gokrazy, run e.g.:\n  %s\n"
+	if got := translate("", msg); got != msg {
+		t.Errorf("translate(en) = %q, want %q", got, msg)
+	}
+	if got := translate("de", msg); !strings.HasPrefix(got, "Um gokrazy zu starten") {
+		t.Errorf("translate(de) = %q, want a German translation", got)
+	}
+	if got, want := translate("de", "untranslated\n"), "untranslated\n"; got != want {
+		t.Errorf("translate(de) = %q, want %q", got, want)
+	}
+}
+
+// verbRe matches fmt verbs (without flags, which the messages do not use).
+var verbRe = regexp.MustCompile(`%[a-z%]`)
+
+func TestCatalogVerbs(t *testing.T) {
+	for lang, catalog := range catalogs {
+		for msg, translation := range catalog {
+			want := strings.Join(verbRe.FindAllString(msg, -1), " ")
+			got := strings.Join(verbRe.FindAllString(translation, -1), " ")
+			if got != want {
+				t.Errorf("%s translation of %q has verbs %q, want %q", lang, msg, got, want)
+			}
+			if strings.HasSuffix(msg, "\n") != strings.HasSuffix(translation, "\n") {
+				t.Errorf("%s translation of %q differs in its trailing newline", lang, msg)
+			}
+		}
+	}
+}
+
+// messages returns the format strings which the Go files below dir pass to
+// this package, either as string literal or as constant (like the usage of
+// gokr-packer).
+func messages(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	fset := token.NewFileSet()
+	consts := make(map[string]map[string]string) // directory → name → value
+	var calls []*ast.CallExpr
+	var callDirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "testdata" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		pkgDir := filepath.Dir(path)
+		if consts[pkgDir] == nil {
+			consts[pkgDir] = make(map[string]string)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				for i, name := range n.Names {
+					if i >= len(n.Values) {
+						break
+					}
+					if lit, ok := n.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						if v, err := strconv.Unquote(lit.Value); err == nil {
+							consts[pkgDir][name.Name] = v
+						}
+					}
+				}
+			case *ast.CallExpr:
+				sel, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok {
+					break
+				}
+				if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "i18n" {
+					calls = append(calls, n)
+					callDirs = append(callDirs, pkgDir)
+				}
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(map[string]bool)
+	for i, call := range calls {
+		sel := call.Fun.(*ast.SelectorExpr)
+		arg := 0
+		if sel.Sel.Name == "Fprintf" {
+			arg = 1
+		}
+		if arg >= len(call.Args) {
+			continue
+		}
+		switch x := call.Args[arg].(type) {
+		case *ast.BasicLit:
+			if v, err := strconv.Unquote(x.Value); err == nil {
+				msgs[v] = true
+			}
+		case *ast.Ident:
+			if v, ok := consts[callDirs[i]][x.Name]; ok {
+				msgs[v] = true
+			}
+		}
+	}
+	return msgs
+}
+
+// TestCatalogMessages verifies that the catalogs only contain messages which
+// are still printed, as changing the English text of a message (e.g. adding a
+// verb to the gokr-packer usage) silently drops its translations.
+func TestCatalogMessages(t *testing.T) {
+	msgs := messages(t, filepath.Join("..", ".."))
+	if len(msgs) == 0 {
+		t.Fatal("no messages found")
+	}
+	for lang, catalog := range catalogs {
+		for msg := range catalog {
+			if !msgs[msg] {
+				t.Errorf("%s catalog contains %q, which is not printed via i18n (has the English text changed?)", lang, msg)
+			}
+		}
+	}
+}
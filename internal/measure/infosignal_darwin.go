@@ -0,0 +1,9 @@
+package measure
+
+import (
+	"os"
+	"syscall"
+)
+
+// SIGINFO is sent by pressing Ctrl+T in the terminal.
+var infoSignals = []os.Signal{syscall.SIGINFO, syscall.SIGUSR1}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package measure
+
+import "os"
+
+var infoSignals []os.Signal
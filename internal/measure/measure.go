@@ -7,10 +7,12 @@ import (
 )
 
 func Interactively(status string) (done func(fragment string)) {
+	phase := StartPhase(status, 0)
 	status = "[" + status + "]"
 	fmt.Print(status)
 	start := time.Now()
 	return func(fragment string) {
+		phase.End()
 		build := time.Since(start)
 		fmt.Printf("\r[done] in %.2fs%s"+strings.Repeat(" ", len(status))+"\n",
 			build.Seconds(),
@@ -0,0 +1,113 @@
+package measure
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gokrazy/internal/humanize"
+)
+
+// Phase is a long-running operation (e.g. writing an image to an SD card or
+// uploading it), whose progress is printed when the process receives
+// SIGUSR1 (or SIGINFO, i.e. Ctrl+T, on macOS), as there might be no other
+// output for minutes.
+type Phase struct {
+	name  string
+	start time.Time
+	total int64 // 0 if unknown
+	done  atomic.Int64
+	prev  *Phase
+
+	// region shows the phase in execution traces (see gok --trace).
+	region *trace.Region
+}
+
+var (
+	phaseMu sync.Mutex
+	current *Phase
+
+	notifyOnce sync.Once
+)
+
+// StartPhase makes name the current phase until End is called. total is the
+// number of bytes which the phase processes (0 if unknown); the progress is
+// recorded by writing to the Phase (e.g. with an io.TeeReader).
+func StartPhase(name string, total int64) *Phase {
+	notifyOnce.Do(reportOnSignal)
+	phaseMu.Lock()
+	defer phaseMu.Unlock()
+	p := &Phase{
+		name:   name,
+		start:  time.Now(),
+		total:  total,
+		prev:   current,
+		region: trace.StartRegion(context.Background(), name),
+	}
+	current = p
+	return p
+}
+
+// Write records that len(b) bytes were processed.
+func (p *Phase) Write(b []byte) (int, error) {
+	p.done.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// End makes the phase which was current when p started current again.
+func (p *Phase) End() {
+	p.region.End()
+	phaseMu.Lock()
+	defer phaseMu.Unlock()
+	if current == p {
+		current = p.prev
+	}
+}
+
+// String returns the phase, the bytes processed, the rate and the ETA, e.g.
+// “writing /dev/sdb: 120 MiB of 512 MiB (23.4%) in 10s, 12 MiB/s, ETA 33s”.
+func (p *Phase) String() string {
+	elapsed := time.Since(p.start)
+	done := p.done.Load()
+	if done == 0 {
+		return fmt.Sprintf("%s: %v elapsed", p.name, elapsed.Round(time.Second))
+	}
+	rate := float64(done) / elapsed.Seconds()
+	status := fmt.Sprintf("%s: %s", p.name, humanize.Bytes(uint64(done)))
+	if p.total > 0 {
+		status += fmt.Sprintf(" of %s (%.1f%%)", humanize.Bytes(uint64(p.total)), float64(done)/float64(p.total)*100)
+	}
+	status += fmt.Sprintf(" in %v, %s", elapsed.Round(time.Second), humanize.BPS(uint64(rate)))
+	if p.total > done && rate > 0 {
+		eta := time.Duration(float64(p.total-done) / rate * float64(time.Second))
+		status += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return status
+}
+
+// reportOnSignal prints the current phase to stderr whenever the process
+// receives one of infoSignals.
+func reportOnSignal() {
+	if len(infoSignals) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, infoSignals...)
+	go func() {
+		for range c {
+			phaseMu.Lock()
+			p := current
+			phaseMu.Unlock()
+			if p == nil {
+				fmt.Fprintf(os.Stderr, "\n[progress] idle\n")
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "\n[progress] %s\n", p)
+		}
+	}()
+}
@@ -0,0 +1,31 @@
+package measure
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseString(t *testing.T) {
+	outer := StartPhase("creating root file system", 0)
+	p := StartPhase("writing /dev/sdx", 400<<20)
+	p.start = time.Now().Add(-10 * time.Second)
+	if got, want := p.String(), "writing /dev/sdx: 10s elapsed"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	p.Write(make([]byte, 100<<20))
+	got := p.String()
+	for _, want := range []string{"100 MiB of 400 MiB (25.0%)", "in 10s", "10 MiB/s", "ETA 30s"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("String() = %q, want it to contain %q", got, want)
+		}
+	}
+	p.End()
+	if current != outer {
+		t.Errorf("after End, the current phase is %v, want %v", current, outer)
+	}
+	outer.End()
+	if current != nil {
+		t.Errorf("after ending all phases, the current phase is %v, want nil", current)
+	}
+}
@@ -3,6 +3,7 @@
 package oldpacker
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -14,14 +15,16 @@ import (
 	"github.com/gokrazy/internal/config"
 	"github.com/gokrazy/internal/tlsflag"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/i18n"
 	internalpacker "github.com/gokrazy/tools/internal/packer"
+	"github.com/gokrazy/tools/manifest"
 	"github.com/gokrazy/tools/packer"
 )
 
 var (
 	overwrite = flag.String("overwrite",
 		"",
-		"Destination device (e.g. /dev/sdb) or file (e.g. /tmp/gokrazy.img) to overwrite with a full disk image")
+		"Destination device (e.g. /dev/sdb) or file (e.g. /tmp/gokrazy.img) to overwrite with a full disk image, or a named pipe, stdout (-, with the progress printed to stderr), already-open file descriptor (e.g. fd:3), device on another machine (e.g. ssh://flasher:/dev/sdb, written and verified via ssh) or network block device export (e.g. nbd://localhost/disk) to stream the image to, or loop:<file> to write a disk image file attached as loop device, or usbboot: to write to the eMMC of a Compute Module in usbboot mode, exposed with rpiboot (usbboot:<dir> passes rpiboot -d <dir>). Output paths may be templates, e.g. build/gokrazy-{{.Hostname}}-{{.Version}}-{{.Date}}.img (also .DeviceType, .Arch and .Timestamp)")
 
 	overwriteBoot = flag.String("overwrite_boot",
 		"",
@@ -35,9 +38,13 @@ var (
 		"",
 		"Destination device (e.g. /dev/sdb) or file (e.g. /tmp/mbr.img) to overwrite the MBR of (only effective if -overwrite_boot is specified, too)")
 
+	outputDir = flag.String("output_dir",
+		"",
+		"Directory to which all artifacts are written in one run: the full image (disk.img, sized for the smallest device unless -target_storage_bytes is specified), the boot and root file systems (boot.img, root.img), the MBR (mbr.bin) and the generated init source code (init.go)")
+
 	overwriteInit = flag.String("overwrite_init",
 		"",
-		"Destination file (e.g. /tmp/init.go) to overwrite with the generated init source code")
+		"Destination file (e.g. /tmp/init.go) to overwrite with the generated init source code. An unmodified copy (e.g. /tmp/init.go.generated) is written next to it, so that -init_pkg can detect when the generated init changes")
 
 	targetStorageBytes = flag.Int("target_storage_bytes",
 		0,
@@ -45,7 +52,7 @@ var (
 
 	initPkg = flag.String("init_pkg",
 		"",
-		"Go package to install as /gokrazy/init instead of the auto-generated one")
+		"Go package to install as /gokrazy/init instead of the auto-generated one. Packing fails if it uses an older github.com/gokrazy/gokrazy than the rest of the image, or if the generated init changed since it was dumped with -overwrite_init")
 
 	hostname = flag.String("hostname",
 		"gokrazy",
@@ -83,6 +90,34 @@ var (
 e.g. -device_type=odroidhc1 to apply MBR changes and device-specific bootloader files for Odroid XU4/HC1/HC2.
 Defaults to an empty string.`)
 
+	model = flag.String("model",
+		"",
+		"Raspberry Pi model to build the image for, one of "+strings.Join(internalpacker.Models(), ", ")+": only include the firmware files this model boots (e.g. start4.elf for the pi4) and verify the kernel package supports it. pi0 and pi0w images are built for 32-bit ARM (GOARCH=arm GOARM=6) and need a 32-bit kernel package. By default, the image boots on all models supported by the firmware and kernel packages")
+
+	models = flag.String("models",
+		"",
+		"build one image per Raspberry Pi model in one run, as comma-separated list of <model>[=<kernel package>[:<firmware package>]] (e.g. pi3,pi4,pi5=github.com/gokrazy/kernel.rpi), pinning the kernel and firmware packages per model if specified. The output paths need to contain {{.Model}} (e.g. gokrazy-{{.Model}}.img). The compiled packages are shared between models of the same architecture")
+
+	arch = flag.String("arch",
+		"",
+		"architecture to build the userland (init and packages) for, one of "+strings.Join(internalpacker.Architectures(), ", ")+" (default arm64, for the Raspberry Pi 3 and newer): sets GOARCH, selects the matching default kernel package (github.com/gokrazy/kernel.amd64 for amd64, with no Raspberry Pi firmware; riscv64 needs KernelPackage in the instance config) and verifies that the kernel package is built for it")
+
+	goos = flag.String("goos",
+		"",
+		"GOOS to build init and the packages with, overriding the environment (only linux is supported)")
+
+	goarch = flag.String("goarch",
+		"",
+		"GOARCH to build init and the packages with (e.g. arm64), overriding the environment. Unlike -arch, it does not select a kernel package")
+
+	goarm = flag.String("goarm",
+		"",
+		"GOARM to build init and the packages with (e.g. 7), overriding the environment. Requires GOARCH=arm")
+
+	board = flag.String("board",
+		"",
+		"board profile for a computer other than the Raspberry Pi (amd64 for PCs booting via UEFI, e.g. NUCs and thin clients, qemu-virt for the QEMU virt machine, e.g. in CI, visionfive2 for the StarFive VisionFive 2 RISC-V board): one of "+strings.Join(internalpacker.Boards(), ", ")+" or a .json file (see the Board documentation) specifying the kernel and firmware packages, the bootloader files written before the boot partition (e.g. u-boot), the partition table type, the kernel command line and the U-Boot boot script")
+
 	serialConsole = flag.String("serial_console",
 		"serial0,115200",
 		`"serial0,115200" enables UART0 as a serial console, "disabled" allows applications to use UART0 instead, "off" sets enable_uart=0 in config.txt for the Raspberry Pi firmware`)
@@ -102,10 +137,346 @@ Defaults to an empty string.`)
 	writeInstanceConfig = flag.String("write_instance_config",
 		"",
 		"instance, identified by hostname. $INSTANCE/config.json will be written based on the other flags. See https://github.com/gokrazy/gokrazy/issues/147 for more details.")
+
+	embedLicenseTexts = flag.Bool("embed_license_texts",
+		false,
+		"include the license text of each module in /etc/licenses (the /etc/licenses/LICENSES.txt report is always included)")
+
+	compressBinaries = flag.Bool("compress_binaries",
+		false,
+		"store the binaries in /user gzip-compressed; they are decompressed into RAM when started (smaller images, slower start)")
+
+	dedupFiles = flag.Bool("dedup_files",
+		false,
+		"replace identical copies of large files (e.g. shared libraries) in the root file system with symlinks to the first copy")
+
+	integrityCheck = flag.Bool("integrity_check",
+		false,
+		"include an integrity-check program which verifies the root file system files against their hashes on boot and reports corruption in the web interface")
+
+	initDebug = flag.Bool("init_debug",
+		false,
+		"make init log mount steps, the services and the starting and exiting of their processes, and network changes to the console and kernel ring buffer (dmesg) during the first minutes after boot, and boot the kernel with verbose logging")
+
+	etcConfig = flag.String("etc_config",
+		"",
+		"JSON file which adds, removes or replaces entries in /etc (e.g. hosts or localtime), see the EtcConfig documentation")
+
+	rootManifest = flag.String("root_manifest",
+		"",
+		"JSON root manifest (see package github.com/gokrazy/tools/manifest) whose files are added to the root file system, e.g. generated by other tools")
+
+	writeRootManifest = flag.String("write_root_manifest",
+		"",
+		"write the JSON manifest of the complete root file system to the specified path, e.g. for comparing images")
+
+	artifactCache = flag.String("artifact_cache",
+		"",
+		"directory in which to store the root file system files content-addressed, shared between builds for multiple hosts: identical build artifacts are stored (and hardlinked, with -keep_temp) only once")
+
+	runTargetTests = flag.Bool("run_tests_target",
+		false,
+		"run the tests of the packages (go test) for the target architecture before creating the image, under qemu-user emulation unless the host runs the target architecture")
+
+	reproducible = flag.Bool("reproducible",
+		false,
+		"produce byte-identical images for identical inputs: all timestamps are set to $SOURCE_DATE_EPOCH (default: the git commit time) and the Go binaries are built with -trimpath and without build ID")
+
+	keepBackup = flag.Bool("keep_backup",
+		false,
+		"keep the previous image files as <file>.bak when replacing them. Images are written to <file>.partial and only renamed once complete, so that an interrupted build never leaves a truncated image")
+
+	tmpDir = flag.String("tmpdir",
+		"",
+		"directory for the temporary files (e.g. the compiled binaries and the file system images), instead of $TMPDIR, e.g. when /tmp is a small tmpfs. The packer checks that it has enough free space before building")
+
+	skipSpaceCheck = flag.Bool("skip_space_check",
+		false,
+		"skip checking that the temporary directory and the output destinations have enough free space before building (the check uses upper bounds, e.g. the root partition size)")
+
+	cpuProfile = flag.String("cpuprofile",
+		"",
+		"write a CPU profile of the packer (covering the build and imaging phases) to the specified path, for go tool pprof")
+
+	memProfile = flag.String("memprofile",
+		"",
+		"write a memory (heap) profile of the packer at the end of the run to the specified path, for go tool pprof")
+
+	traceFile = flag.String("trace",
+		"",
+		"write an execution trace of the packer, in which the build and imaging phases are shown as regions, to the specified path, for go tool trace")
+
+	keepTemp = flag.Bool("keep_temp",
+		false,
+		"keep the temporary files (e.g. the generated init source, the built binaries and the boot and root file system images) instead of deleting them, and print their paths")
+
+	remoteExec = flag.Bool("remote_exec",
+		false,
+		"include a remote-exec program which runs single commands sent with gok exec (authenticated with the gokrazy password, encrypted if the instance uses TLS), for emergency diagnostics when nothing else is reachable. It also serves the partitions for gok backup")
+
+	backupPerm = flag.Bool("backup_perm",
+		false,
+		"gokr-packer backup: also download the contents of /perm, as "+internalpacker.BackupPermFile)
+
+	configOut = flag.String("config_out",
+		"",
+		"gokr-packer clone: file to write the recovered instance config (config.json format) to. By default, it is printed")
+
+	graphFormat = flag.String("graph_format",
+		"dot",
+		"gokr-packer graph: output format, dot (for Graphviz, e.g. | dot -Tsvg > graph.svg) or json")
+
+	from = flag.String("from",
+		"",
+		"disk image, storage device or hostname (of an installation packed with -remote_exec) to recover the instance config from, for use as defaults of the flags which are not specified")
+
+	crashLogSize = flag.String("crash_log_size",
+		"",
+		"<size> (e.g. 1M): record the exit status of each service process and the stderr output of crashes (e.g. Go panics) into log files in /perm/crashes, which are rotated at the specified size. Fetch them with gok logs --crashes")
+
+	buildManifest = flag.String("build_manifest",
+		"",
+		"write a JSON manifest of the image to the specified path (e.g. manifest.json): every file of the boot and root file systems with its size and SHA256 hash, the Go module versions, the kernel and firmware versions and the partition offsets, so that provisioning systems can track what each device runs")
+
+	policy = flag.String("policy",
+		"",
+		"JSON file with rules which the image needs to satisfy, checked before any image is written: a regular expression for the hostname (Hostname), the maximum size of each file of the root file system (MaxFileSize, e.g. 50M), minimum Go module versions (MinModuleVersions) and forbidden Go modules (ForbiddenModules)")
+
+	sha256Sums = flag.String("sha256sums",
+		"",
+		"write the SHA256 hashes of the produced image files to the specified path (e.g. SHA256SUMS next to the image), in the format of sha256sum, so that they can be verified with sha256sum --check before flashing")
+
+	signGPGKey = flag.String("sign_gpg_key",
+		"",
+		"sign the -sha256sums file with the specified gpg key (e.g. its fingerprint), writing the ASCII-armored detached signature to <file>.asc")
+
+	signMinisignKey = flag.String("sign_minisign_key",
+		"",
+		"sign the -sha256sums file with the specified minisign secret key file, writing the signature to <file>.minisig")
+
+	provenance = flag.String("provenance",
+		"",
+		"write an in-toto/SLSA provenance statement (JSON) about the produced image files to the specified path. Use -sign_provenance to turn it into a signed attestation")
+
+	signProvenance = flag.Bool("sign_provenance",
+		false,
+		"sign the -provenance statement with Sigstore keyless signing (requires cosign, which asks for your OIDC identity, e.g. in the browser, or uses the identity of the CI job), writing the bundle to <file>.sigstore.json. Verify it with cosign verify-blob --bundle")
+
+	summary = flag.String("summary",
+		"",
+		"write a JSON summary of the run (instance, target, SHA256 hashes of the written images, the next-step hints and the error, if any) to the specified path, for scripts")
+
+	qrCode = flag.Bool("qr",
+		false,
+		"print the URL of the web interface (including the password) as QR code after a successful flash or update, to open it on a phone")
+
+	hints = flag.Bool("hints",
+		true,
+		"print instructions for the next steps (e.g. how to boot the image, or how to create a file system on the perm partition). Disable for quiet output in scripts: the hints are still included in the -summary")
 )
 
 var gokrazyPkgs []string
 
+// stringsFlag is a flag which can be specified multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var (
+	extraKernels    stringsFlag
+	extraPartitions stringsFlag
+	addHosts        stringsFlag
+	dnsSearch       stringsFlag
+	volumes         stringsFlag
+
+	shrink = flag.Bool("shrink",
+		false,
+		"make the -overwrite=<file> image as small as possible (no -target_storage_bytes needed) and write metadata next to it, so that gok flash can create the partitions for the actual SD card size when writing the image")
+
+	permFileSystem = flag.String("perm_fs",
+		"",
+		"file system to format the perm partition with at pack time, exfat or ext4: exfat (implies -expose_partition=perm) can be read on Windows and macOS, ext4 makes a freshly written SD card immediately usable for persistent data")
+
+	preservePerm = flag.Bool("preserve_perm",
+		false,
+		"when overwriting a storage device which holds a gokrazy installation, keep its perm partition (the application state) instead of creating an empty one. The partition layout must be unchanged")
+
+	mkfsPerm = flag.Bool("mkfs_perm",
+		false,
+		"format the perm partition as ext4 at pack time (same as -perm_fs=ext4), instead of printing the mkfs.ext4 command to run")
+
+	permLabel = flag.String("perm_label",
+		"GOKRAZY",
+		"volume label of the perm partition when using -perm_fs (at most 11 characters for exFAT, 16 bytes for ext4)")
+
+	vmFormat = flag.String("vm_format",
+		"",
+		"write the -overwrite=<file> image for running it in a VM, in one of the formats "+strings.Join(internalpacker.VMFormats(), ", ")+" (vhd/vhdx: Hyper-V generation 1/2, vdi: VirtualBox, vmdk: VMware, gce: tarball for Google Compute Engine). The disk size is rounded up to whole GiB")
+
+	compressImage = flag.String("compress",
+		"",
+		"compress the -overwrite=<file> image, in one of the formats "+strings.Join(internalpacker.ImageCompressions(), ", ")+" (name the file accordingly, e.g. gokrazy.img.zst), for distributing it or writing it with the Raspberry Pi Imager. xz and zstd require the xz or zstd command")
+
+	imageVersion = flag.String("image_version",
+		"",
+		"version of the image, stored in /etc/os-release, gaf files and the provenance. Defaults to the git describe output of the working directory (e.g. v1.2.0-3-g1a2b3c4, with a -dirty suffix for uncommitted changes), if it is in a git repository")
+
+	allowDowngrade = flag.Bool("allow_downgrade",
+		false,
+		"update the device even if it runs a newer image: a later version (the device's version is only known if it was packed with -remote_exec), one which is not in the git repository of the working directory (e.g. a stale checkout), or one with a later build timestamp")
+
+	layoutFile = flag.String("layout",
+		"",
+		`JSON file describing the partition layout (BootSize, RootSize, BootFileSystem, SingleSlot, Extra partitions with Name, Size, Type and Source, Expose), e.g. {"Extra": [{"Name": "data", "Size": "2G", "Type": "linux"}]}. The partition flags are applied on top of it`)
+
+	bootSize = flag.String("boot_size",
+		"",
+		"size of the boot partition (e.g. 256M, default 100M), which holds the kernel, the firmware and the device tree files. Only applies when creating the partition table, as updates write into the existing partitions")
+
+	bootFileSystem = flag.String("boot_fs",
+		"",
+		"file system of the boot partition: fat16 (default, for at most 128 MB of kernel, firmware and device tree files) or fat32 (spans the whole boot partition, see -boot_size). When updating, -boot_size must match the boot partition of the installation")
+
+	rootSize = flag.String("root_size",
+		"",
+		"size of each of the two root partitions (e.g. 1G, default 500M), which hold the root file system. Only applies when creating the partition table, as updates write into the existing partitions")
+
+	singleSlot = flag.Bool("single_slot",
+		false,
+		"create only one root partition instead of two (e.g. for read-only kiosks on small SD cards), which reduces the minimum device size by -root_size. The device can then only be updated by writing a new image, not over the network")
+
+	exposePartition = flag.String("expose_partition",
+		"",
+		"perm or the name of a fat/exfat/ntfs -extra_partition: enter the partition into the hybrid MBR with a Windows partition type so that Windows and macOS mount it automatically (perm then needs to be formatted as exFAT)")
+
+	rootFileSystem = flag.String("rootfs",
+		"",
+		"file system of the root partitions, one of "+strings.Join(internalpacker.RootFileSystems(), ", ")+" (default squashfs): ext4 preserves the file modes of the packed files (e.g. setuid bits), but is not compressed, so it needs to fit into the root partition (see -root_size) uncompressed")
+
+	deviceSync = flag.String("device_sync",
+		"",
+		"sync policy when writing to a storage device, one of "+strings.Join(internalpacker.DeviceSyncPolicies(), ", ")+": end (default) syncs once all data is written, so that the device can be unplugged right away; buffer also calls fdatasync after each write buffer, which keeps the progress accurate and the final sync short; none leaves flushing to the kernel")
+
+	deviceRetries = flag.Int("device_retries",
+		3,
+		"how often to retry a write to a storage device which failed with an I/O error (with exponential backoff, starting at 100ms) before giving up. Cheap card readers sporadically fail writes")
+
+	partitionTable = flag.String("partition_table",
+		"",
+		"partition table of new installations, one of "+strings.Join(internalpacker.PartitionTables(), ", ")+": hybrid (GPT with a hybrid MBR, boots on all Raspberry Pi models), gpt (GPT with a protective MBR, for boot media and boards which require a pure GPT; the Raspberry Pi 4 and newer boot from it) or mbr (MBR only, no extra partitions). Defaults to the partition table of the -board or -device_type, otherwise hybrid")
+)
+
+func init() {
+	flag.Var(&extraKernels, "extra_kernel", "<model filter>=<go package> (e.g. pi5=github.com/gokrazy/kernel.rpi): boot the kernel from the specified package on the Raspberry Pi models matching the config.txt model filter. Can be specified multiple times")
+	flag.Var(&addHosts, "add_host", "<name>[,<name>...]=<address> (e.g. broker.local=10.0.0.2): add a static entry to /etc/hosts. Can be specified multiple times")
+	flag.Var(&dnsSearch, "dns_search", "add a DNS search domain (e.g. lan) to the DNS configuration obtained via DHCP. Can be specified multiple times")
+	flag.Var(&volumes, "volume", "<service>=<dir>[:<mode>[:<uid>[:<gid>]]] (e.g. scan2drive=scan2drive:0700:1000): create the persistent directory /perm/<dir> for the service (program name or package) on boot, set its mode and owner, and pass its path in $STATE_DIRECTORY. Can be specified multiple times")
+	flag.Var(&extraPartitions, "extra_partition", "<name>:<size>:<type>[:<source image>] (e.g. data:2G:fat): create an additional partition (type fat, exfat, ntfs, linux, raw or a GPT type GUID) at the end of the disk, after the perm partition. Can be specified multiple times")
+}
+
+// seedConfig fills in the fields of cfg whose flags were not specified from
+// seed, the instance config recovered with -from. The update password and
+// certificate are always taken from seed (unless -update is specified), as
+// they have no flags.
+func seedConfig(cfg, seed *config.Struct) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["hostname"] && seed.Hostname != "" {
+		cfg.Hostname = seed.Hostname
+	}
+	if !set["device_type"] && seed.DeviceType != "" {
+		cfg.DeviceType = seed.DeviceType
+	}
+	if len(cfg.Packages) == 0 {
+		cfg.Packages = seed.Packages
+	}
+	if !set["serial_console"] && seed.SerialConsole != "" {
+		cfg.SerialConsole = seed.SerialConsole
+	}
+	if !set["gokrazy_pkgs"] && seed.GokrazyPackages != nil {
+		cfg.GokrazyPackages = seed.GokrazyPackages
+	}
+	if !set["kernel_package"] && seed.KernelPackage != nil {
+		cfg.KernelPackage = seed.KernelPackage
+	}
+	if !set["firmware_package"] && seed.FirmwarePackage != nil {
+		cfg.FirmwarePackage = seed.FirmwarePackage
+	}
+	if !set["eeprom_package"] && seed.EEPROMPackage != nil {
+		cfg.EEPROMPackage = seed.EEPROMPackage
+	}
+	if seed.Update == nil {
+		return
+	}
+	if !set["http_port"] && seed.Update.HTTPPort != "" {
+		cfg.Update.HTTPPort = seed.Update.HTTPPort
+	}
+	if !set["https_port"] && seed.Update.HTTPSPort != "" {
+		cfg.Update.HTTPSPort = seed.Update.HTTPSPort
+	}
+	if !set["update"] {
+		cfg.Update.HTTPPassword = seed.Update.HTTPPassword
+		cfg.Update.CertPEM = seed.Update.CertPEM
+		cfg.Update.KeyPEM = seed.Update.KeyPEM
+	}
+}
+
+// parseLayout returns the partition layout specified by -layout (if any) and
+// the partition flags, which are applied on top of it.
+func parseLayout() (packer.Layout, error) {
+	var layout packer.Layout
+	var err error
+	if *layoutFile != "" {
+		if layout, err = internalpacker.ReadLayout(*layoutFile); err != nil {
+			return packer.Layout{}, err
+		}
+	}
+	for _, s := range extraPartitions {
+		e, err := internalpacker.ParseExtraPartition(s)
+		if err != nil {
+			return packer.Layout{}, err
+		}
+		layout.Extra = append(layout.Extra, e)
+	}
+	if *exposePartition != "" {
+		layout.Expose = *exposePartition
+	}
+	if *bootSize != "" {
+		if layout.BootSize, err = internalpacker.ParsePartitionSize(*bootSize); err != nil {
+			return packer.Layout{}, fmt.Errorf("-boot_size: %v", err)
+		}
+	}
+	if *bootFileSystem != "" {
+		layout.BootFileSystem = *bootFileSystem
+	}
+	if *rootSize != "" {
+		if layout.RootSize, err = internalpacker.ParsePartitionSize(*rootSize); err != nil {
+			return packer.Layout{}, fmt.Errorf("-root_size: %v", err)
+		}
+	}
+	if *singleSlot {
+		layout.SingleSlot = true
+	}
+	return layout, layout.Validate()
+}
+
+// permFS returns the file system to format the perm partition with, as
+// specified by -perm_fs or -mkfs_perm.
+func permFS() (string, error) {
+	if !*mkfsPerm {
+		return *permFileSystem, nil
+	}
+	if *permFileSystem != "" && *permFileSystem != "ext4" {
+		return "", fmt.Errorf("-mkfs_perm conflicts with -perm_fs=%s", *permFileSystem)
+	}
+	return "ext4", nil
+}
+
 const usage = `
 gokr-packer packs gokrazy installations into SD card or file system images.
 
@@ -122,11 +493,40 @@ gokr-packer [-overwrite_boot=<file>|-overwrite_root=<file>] <go-package> [<go-pa
 To create file system images of both file systems:
 gokr-packer -overwrite_boot=<file> -overwrite_root=<file> <go-package> [<go-package>…]
 
-All of the above commands can be combined with the -update flag.
+To create all of the above (the SD card image, both file system images, the MBR
+and the init source code) in a directory at once:
+gokr-packer -output_dir=<dir> <go-package> [<go-package>…]
+
+All of the above commands can be combined with the -update flag, and with
+-from=<image|device|hostname> to default to the instance config (packages,
+hostname, ports, password and certificate) of an existing installation.
 
 To dump the auto-generated init source code (for use with -init_pkg later):
 gokr-packer -overwrite_init=<file> <go-package> [<go-package>…]
 
+To reboot or shut down a running installation (-update defaults to yes):
+gokr-packer [reboot|poweroff] -hostname=<hostname> [-update=<url>]
+
+To boot a running installation from its other root partition, e.g. to roll
+back an update (only for the next boot with -testboot):
+gokr-packer switch [-testboot] -hostname=<hostname> [-update=<url>]
+
+To download the partitions of a running installation packed with -remote_exec
+(and with -backup_perm, the contents of /perm) into a directory:
+gokr-packer backup [-backup_perm] -hostname=<hostname> [-update=<url>] <dir>
+
+To archive /perm of a running installation packed with -remote_exec as tar
+archive, or to extract such an archive into /perm:
+gokr-packer perm [backup|restore] -hostname=<hostname> [-update=<url>] <file>
+
+To copy the storage device of an installation (e.g. an SD card) into an image
+and recover as much of its instance config as possible:
+gokr-packer clone [-config_out=<file>] <device> <image>
+
+To print the graph of the packages of an image, i.e. the Go modules they depend
+on and the image files they produce, without building anything:
+gokr-packer graph [-graph_format=dot|json] <go-package> [<go-package>…]
+
 Flags:
 `
 
@@ -163,18 +563,29 @@ func logic(instanceDir string) error {
 			Insecure:           tlsflag.GetInsecure(),
 		},
 	}
+	var seed *config.Struct
+	if *from != "" {
+		var err error
+		seed, err = internalpacker.ConfigFrom(context.Background(), *from, os.Stdout)
+		if err != nil {
+			return err
+		}
+		seedConfig(&cfg, seed)
+	}
 
 	// Convert common -update URLs (changing the hostname, changing the
 	// password, changing the HTTP port) to their corresponding config.Update
 	// fields.
-	defaultPassword, updateHostname := updateflag.GetUpdateTarget(*hostname)
+	defaultPassword, updateHostname := updateflag.GetUpdateTarget(cfg.Hostname)
 	constructed := "http://gokrazy:" + defaultPassword + "@" + updateHostname + "/"
 	if canonical, err := url.Parse(updateflag.GetUpdate()); err == nil {
 		// Ensure both URLs (constructed and -update) end in a trailing slash.
 		canonical.Path = "/"
 		if constructed == canonical.String() {
-			cfg.Update.HTTPPassword = defaultPassword
-			if updateHostname != *hostname {
+			if cfg.Update.HTTPPassword == "" { // not recovered with -from
+				cfg.Update.HTTPPassword = defaultPassword
+			}
+			if updateHostname != cfg.Hostname {
 				cfg.Update.Hostname = updateHostname
 			}
 			if strings.HasSuffix(cfg.Update.Hostname, ":"+cfg.Update.HTTPPort) {
@@ -191,6 +602,13 @@ func logic(instanceDir string) error {
 		return err
 	}
 	cfg.PackageConfig = packageConfig
+	if seed != nil {
+		for pkg, pc := range seed.PackageConfig {
+			if _, ok := cfg.PackageConfig[pkg]; !ok {
+				cfg.PackageConfig[pkg] = pc
+			}
+		}
+	}
 
 	if *writeInstanceConfig != "" {
 		// default value? empty the flag to exclude it from the config file
@@ -225,16 +643,255 @@ func logic(instanceDir string) error {
 	}
 
 	pack := &internalpacker.Pack{
-		Cfg: &cfg,
+		Cfg:               &cfg,
+		EmbedLicenseTexts: *embedLicenseTexts,
+		Provenance:        *provenance,
+		SignProvenance:    *signProvenance,
+		BuildManifest:     *buildManifest,
+		SHA256Sums:        *sha256Sums,
+		SignGPGKey:        *signGPGKey,
+		SignMinisignKey:   *signMinisignKey,
+		Summary:           *summary,
+		HideHints:         !*hints,
+		QRCode:            *qrCode,
+		CompressBinaries:  *compressBinaries,
+		DedupFiles:        *dedupFiles,
+		IntegrityCheck:    *integrityCheck,
+		InitDebug:         *initDebug,
+		RemoteExec:        *remoteExec,
+		KeepTemp:          *keepTemp,
+		Version:           *imageVersion,
+		AllowDowngrade:    *allowDowngrade,
+		VMFormat:          *vmFormat,
+		Compress:          *compressImage,
+		Model:             *model,
+		Arch:              *arch,
+		GOOS:              *goos,
+		GOARCH:            *goarch,
+		GOARM:             *goarm,
+	}
+	if *board != "" {
+		pack.Board, err = internalpacker.ReadBoard(*board)
+		if err != nil {
+			return err
+		}
+	}
+	if pack.Version == "" {
+		pack.Version, err = internalpacker.ImageVersion(".")
+		if err != nil {
+			return err
+		}
+	}
+	if *etcConfig != "" {
+		pack.Etc, err = internalpacker.ReadEtcConfig(*etcConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if *policy != "" {
+		pack.Policy, err = internalpacker.ReadPolicy(*policy)
+		if err != nil {
+			return err
+		}
+	}
+	if *rootManifest != "" {
+		pack.RootManifest, err = manifest.ReadFile(*rootManifest)
+		if err != nil {
+			return err
+		}
+	}
+	pack.WriteRootManifest = *writeRootManifest
+	pack.ArtifactCache = *artifactCache
+	pack.RunTargetTests = *runTargetTests
+	pack.KeepBackup = *keepBackup
+	pack.Reproducible = *reproducible
+	pack.TempDir = *tmpDir
+	pack.SkipSpaceCheck = *skipSpaceCheck
+	pack.CPUProfile = *cpuProfile
+	pack.MemProfile = *memProfile
+	pack.Trace = *traceFile
+	if len(addHosts) > 0 || len(dnsSearch) > 0 {
+		if pack.Etc == nil {
+			pack.Etc = &internalpacker.EtcConfig{}
+		}
+		for _, s := range addHosts {
+			entry, err := internalpacker.ParseHostEntry(s)
+			if err != nil {
+				return err
+			}
+			pack.Etc.Hosts = append(pack.Etc.Hosts, entry)
+		}
+		pack.Etc.SearchDomains = append(pack.Etc.SearchDomains, dnsSearch...)
+		if err := pack.Etc.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, s := range volumes {
+		v, err := internalpacker.ParseVolume(s)
+		if err != nil {
+			return err
+		}
+		pack.Volumes = append(pack.Volumes, v)
+	}
+	pack.CrashLogSize, err = internalpacker.ParseCrashLogSize(*crashLogSize)
+	if err != nil {
+		return err
+	}
+	if *models != "" {
+		pack.ModelImages, err = internalpacker.ParseModelImages(*models)
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range extraKernels {
+		ek, err := internalpacker.ParseExtraKernel(s)
+		if err != nil {
+			return err
+		}
+		pack.ExtraKernels = append(pack.ExtraKernels, ek)
+	}
+	layout, err := parseLayout()
+	if err != nil {
+		return err
+	}
+	pack.Layout = layout
+	pack.PartitionTable = *partitionTable
+	pack.RootFileSystem = *rootFileSystem
+	pack.DeviceSync = *deviceSync
+	pack.DeviceRetries = *deviceRetries
+	pack.PermFileSystem, err = permFS()
+	if err != nil {
+		return err
+	}
+	pack.PermLabel = *permLabel
+	pack.Shrink = *shrink
+	pack.OutputDir = *outputDir
+	pack.PreservePerm = *preservePerm
+	if err := pack.SetPermFileSystem(); err != nil {
+		return err
+	}
+	pack.Workspace, err = packer.FindWorkspace()
+	if err != nil {
+		return err
 	}
 
 	pack.Main("gokrazy packer")
 	return nil
 }
 
+// device implements the verbs which work with a running installation instead
+// of packing one: reboot, poweroff, switch, backup and perm.
+func device(verb string) error {
+	if updateflag.NewInstallation() {
+		updateflag.SetUpdate("yes")
+	}
+	cfg := config.Struct{
+		Hostname: *hostname,
+		Update: &config.UpdateStruct{
+			HTTPPort:  *httpPort,
+			HTTPSPort: *httpsPort,
+			UseTLS:    tlsflag.GetUseTLS(),
+		},
+	}
+	switch verb {
+	case "perm backup", "perm restore":
+		if flag.NArg() != 1 {
+			return fmt.Errorf("syntax: gokr-packer %s [flags] <file>", verb)
+		}
+		if verb == "perm restore" {
+			return internalpacker.RestorePerm(context.Background(), &cfg, flag.Arg(0), os.Stdout)
+		}
+		_, err := internalpacker.BackupPerm(context.Background(), &cfg, flag.Arg(0))
+		return err
+	case "backup":
+		if flag.NArg() != 1 {
+			return fmt.Errorf("syntax: gokr-packer backup [flags] <dir>")
+		}
+		return internalpacker.Backup(context.Background(), &cfg, flag.Arg(0), *backupPerm, os.Stdout)
+	case "switch":
+		if err := internalpacker.SwitchRoot(context.Background(), &cfg, *testboot); err != nil {
+			return err
+		}
+	default:
+		if err := internalpacker.Power(context.Background(), &cfg, internalpacker.PowerAction(verb)); err != nil {
+			return err
+		}
+	}
+	log.Printf("%s: %s requested", *hostname, verb)
+	return nil
+}
+
+// clone implements the clone verb, which copies the storage device of an
+// installation into an image.
+func clone() error {
+	if flag.NArg() != 2 {
+		return fmt.Errorf("syntax: gokr-packer clone [flags] <device> <image>")
+	}
+	cfg, err := internalpacker.Clone(flag.Arg(0), flag.Arg(1), *sudo, os.Stdout)
+	if err != nil {
+		return err
+	}
+	b, err := cfg.FormatForFile()
+	if err != nil {
+		return err
+	}
+	if *configOut == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	if err := os.WriteFile(*configOut, b, 0600); err != nil {
+		return err
+	}
+	log.Printf("wrote the recovered instance config to %s", *configOut)
+	return nil
+}
+
+// graph implements the graph verb, which prints the BuildGraph of the image
+// for the packages instead of packing it.
+func graph() error {
+	if flag.NArg() == 0 {
+		return fmt.Errorf("syntax: gokr-packer graph [flags] <go-package> [<go-package>…]")
+	}
+	cfg := config.Struct{
+		Packages:        flag.Args(),
+		Hostname:        *hostname,
+		GokrazyPackages: &gokrazyPkgs,
+		KernelPackage:   kernelPackage,
+		FirmwarePackage: firmwarePackage,
+		EEPROMPackage:   eepromPackage,
+		InternalCompatibilityFlags: &config.InternalCompatibilityFlags{
+			InitPkg: *initPkg,
+		},
+	}
+	packageConfig, err := internalpacker.PerPackageConfigForMigration(&cfg)
+	if err != nil {
+		return err
+	}
+	cfg.PackageConfig = packageConfig
+	workspace, err := packer.FindWorkspace()
+	if err != nil {
+		return err
+	}
+	if workspace != "" {
+		packer.UseWorkspace(workspace)
+	}
+	g, err := internalpacker.NewBuildGraph(&cfg)
+	if err != nil {
+		return err
+	}
+	switch *graphFormat {
+	case "dot":
+		return g.WriteDOT(os.Stdout)
+	case "json":
+		return g.WriteJSON(os.Stdout)
+	default:
+		return fmt.Errorf("unknown -graph_format %q (supported: dot, json)", *graphFormat)
+	}
+}
+
 func Main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, usage)
+		i18n.Fprintf(os.Stderr, usage)
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
@@ -255,13 +912,51 @@ func Main() {
 		def,
 		`instance, identified by hostname`)
 
+	var verb string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reboot", "poweroff", "switch", "backup":
+			verb = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "clone", "graph":
+			verb = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "perm":
+			if len(os.Args) < 3 || (os.Args[2] != "backup" && os.Args[2] != "restore") {
+				log.Fatalf("syntax: gokr-packer perm [backup|restore] [flags] <file>")
+			}
+			verb = "perm " + os.Args[2]
+			os.Args = append(os.Args[:1], os.Args[3:]...)
+		}
+	}
+
 	flag.Parse()
 
+	if verb == "clone" {
+		if err := clone(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if verb != "" && verb != "graph" {
+		if err := device(verb); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *gokrazyPkgList != "" {
 		gokrazyPkgs = strings.Split(*gokrazyPkgList, ",")
 	}
 
-	if *overwrite == "" && *overwriteBoot == "" && *overwriteRoot == "" && *overwriteInit == "" && updateflag.NewInstallation() {
+	if verb == "graph" {
+		if err := graph(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *overwrite == "" && *overwriteBoot == "" && *overwriteRoot == "" && *overwriteInit == "" && *outputDir == "" && updateflag.NewInstallation() {
 		flag.Usage()
 	}
 
@@ -269,6 +964,30 @@ func Main() {
 		p := internalpacker.Pack{
 			Pack: packer.NewPackForHost(*hostname),
 		}
+		layout, err := parseLayout()
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Layout = layout
+		p.PartitionTable = *partitionTable
+		if *board != "" {
+			b, err := internalpacker.ReadBoard(*board)
+			if err != nil {
+				log.Fatal(err)
+			}
+			p.Board = b
+		}
+		if err := p.SetPartitionTable(p.Board != nil && p.Board.MBROnly); err != nil {
+			log.Fatal(err)
+		}
+		p.PermFileSystem, err = permFS()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := p.SetPermFileSystem(); err != nil {
+			log.Fatal(err)
+		}
+		p.PreservePerm = *preservePerm
 
 		if _, err := p.SudoPartition(*overwrite); err != nil {
 			log.Fatal(err)
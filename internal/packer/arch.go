@@ -0,0 +1,101 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/packer"
+)
+
+// architectures are the values of Pack.Arch and the kernel package used by
+// default for each, if any.
+var architectures = map[string]string{
+	"arm64": "github.com/gokrazy/kernel",
+	"arm":   "", // e.g. for the Raspberry Pi 2, which needs a 32-bit kernel package
+	"amd64": "github.com/gokrazy/kernel.amd64",
+	// e.g. for the VisionFive 2 (see the visionfive2 board), which needs a
+	// kernel package built for the board
+	"riscv64": "",
+}
+
+// Architectures returns the supported values of Pack.Arch.
+func Architectures() []string {
+	var archs []string
+	for arch := range architectures {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// applyGoEnv sets the GOOS, GOARCH and GOARM environment variables of the go
+// tool to the ones of the Pack (overriding the environment of the packer), so
+// that the -model, -board and -arch defaults are verified against them.
+func (p *Pack) applyGoEnv() error {
+	if p.GOOS != "" && p.GOOS != "linux" {
+		return fmt.Errorf("-goos=%s: gokrazy only runs on linux", p.GOOS)
+	}
+	for _, kv := range []struct{ key, value string }{
+		{"GOOS", p.GOOS},
+		{"GOARCH", p.GOARCH},
+		{"GOARM", p.GOARM},
+	} {
+		if kv.value == "" {
+			continue
+		}
+		if err := os.Setenv(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	if p.GOARM != "" && packer.TargetArch() != "arm" {
+		return fmt.Errorf("-goarm=%s requires GOARCH=arm, but the target architecture is %s", p.GOARM, packer.TargetArch())
+	}
+	return nil
+}
+
+// applyArch makes the go tool build for Arch (by setting GOARCH), defaults
+// the kernel package to the one for Arch and verifies that the firmware and
+// EEPROM packages of the instance config fit Arch: the Raspberry Pi firmware
+// cannot boot PCs or RISC-V boards, so for amd64 and riscv64, they default to
+// none. The kernel package is
+// verified against Arch later, see validateTargetArchMatchesKernel.
+func (p *Pack) applyArch() error {
+	if p.Arch == "" {
+		return nil
+	}
+	kernel, ok := architectures[p.Arch]
+	if !ok {
+		return fmt.Errorf("unknown -arch=%s, expected one of %v", p.Arch, Architectures())
+	}
+	if err := setGoEnv("-arch="+p.Arch, p.Arch, ""); err != nil {
+		return err
+	}
+	cfg := p.Cfg
+	if cfg.KernelPackage == nil && kernel != "" {
+		cfg.KernelPackage = &kernel
+	}
+	if p.Arch != "amd64" && p.Arch != "riscv64" {
+		return nil
+	}
+	none := ""
+	if cfg.FirmwarePackage == nil {
+		cfg.FirmwarePackage = &none
+	}
+	if cfg.EEPROMPackage == nil {
+		cfg.EEPROMPackage = &none
+	}
+	if cfg.KernelPackage == nil {
+		return fmt.Errorf("-arch=%s has no default kernel package: set KernelPackage in the instance config", p.Arch)
+	}
+	// The defaults are the Raspberry Pi packages.
+	defaults := config.NewStruct("")
+	if fw := cfg.FirmwarePackageOrDefault(); fw == defaults.FirmwarePackageOrDefault() {
+		return fmt.Errorf("-arch=%s conflicts with the Raspberry Pi firmware package %s: set FirmwarePackage to \"\" in the instance config", p.Arch, fw)
+	}
+	if eeprom := cfg.EEPROMPackageOrDefault(); eeprom == defaults.EEPROMPackageOrDefault() {
+		return fmt.Errorf("-arch=%s conflicts with the Raspberry Pi EEPROM package %s: set EEPROMPackage to \"\" in the instance config", p.Arch, eeprom)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package packer
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+)
+
+func TestApplyArch(t *testing.T) {
+	t.Setenv("GOARCH", "")
+	p := &Pack{Cfg: config.NewStruct("pc"), Arch: "amd64"}
+	if err := p.applyArch(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := os.Getenv("GOARCH"), "amd64"; got != want {
+		t.Errorf("GOARCH = %q, want %q", got, want)
+	}
+	if got, want := p.Cfg.KernelPackageOrDefault(), "github.com/gokrazy/kernel.amd64"; got != want {
+		t.Errorf("kernel package = %q, want %q", got, want)
+	}
+	if got := p.Cfg.FirmwarePackageOrDefault() + p.Cfg.EEPROMPackageOrDefault(); got != "" {
+		t.Errorf("firmware and EEPROM packages = %q, want none", got)
+	}
+
+	t.Setenv("GOARCH", "")
+	firmware := "github.com/gokrazy/firmware"
+	p = &Pack{Cfg: config.NewStruct("pc"), Arch: "amd64"}
+	p.Cfg.FirmwarePackage = &firmware
+	if err := p.applyArch(); err == nil {
+		t.Errorf("applyArch(amd64) with the Raspberry Pi firmware unexpectedly succeeded")
+	}
+
+	t.Setenv("GOARCH", "arm")
+	p = &Pack{Cfg: config.NewStruct("pi"), Arch: "arm64"}
+	if err := p.applyArch(); err == nil {
+		t.Errorf("applyArch(arm64) unexpectedly succeeded with GOARCH=arm")
+	}
+
+	p = &Pack{Cfg: config.NewStruct("pi"), Arch: "mips64"}
+	if err := p.applyArch(); err == nil {
+		t.Errorf("applyArch(mips64) unexpectedly succeeded")
+	}
+
+	t.Setenv("GOARCH", "")
+	p = &Pack{Cfg: config.NewStruct("vf2"), Arch: "riscv64"}
+	if err := p.applyArch(); err == nil {
+		t.Errorf("applyArch(riscv64) without a kernel package unexpectedly succeeded")
+	}
+	t.Setenv("GOARCH", "")
+	kernel := "example.com/visionfive2/kernel"
+	p = &Pack{Cfg: config.NewStruct("vf2"), Arch: "riscv64"}
+	p.Cfg.KernelPackage = &kernel
+	if err := p.applyArch(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Cfg.FirmwarePackageOrDefault() + p.Cfg.EEPROMPackageOrDefault(); got != "" {
+		t.Errorf("firmware and EEPROM packages = %q, want none", got)
+	}
+}
+
+func TestApplyGoEnv(t *testing.T) {
+	t.Setenv("GOOS", "")
+	t.Setenv("GOARCH", "arm64")
+	t.Setenv("GOARM", "")
+	p := &Pack{GOARCH: "arm", GOARM: "7"}
+	if err := p.applyGoEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("GOARCH") + "/" + os.Getenv("GOARM"); got != "arm/7" {
+		t.Errorf("GOARCH/GOARM = %q, want arm/7", got)
+	}
+	// The model then conflicts with the explicit GOARM.
+	if err := setGoEnv("Raspberry Pi Zero", "arm", "6"); err == nil {
+		t.Errorf("setGoEnv(arm, 6) unexpectedly succeeded with GOARM=7")
+	}
+
+	t.Setenv("GOARCH", "arm64")
+	if err := (&Pack{GOARM: "7"}).applyGoEnv(); err == nil {
+		t.Errorf("applyGoEnv(GOARM=7) unexpectedly succeeded with GOARCH=arm64")
+	}
+	if err := (&Pack{GOOS: "darwin"}).applyGoEnv(); err == nil {
+		t.Errorf("applyGoEnv(GOOS=darwin) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,132 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifactCacheStats counts the root file system files which were already
+// in the artifact cache, i.e. identical to files of previous builds (e.g. of
+// other hosts in a gok fleet update batch).
+type artifactCacheStats struct {
+	files, shared           int
+	sharedBytes, totalBytes int64
+}
+
+// cacheArtifacts stores the regular files of root in the content-addressed
+// artifact cache dir (see Pack.ArtifactCache) and makes root refer to the
+// cached copies. Files within the packer's temporary directories tempDirs,
+// which the packer does not modify after creating them, are hardlinked
+// instead of copied, so that identical build artifacts occupy disk space
+// only once. Other files (e.g. extra files from the instance directory) are
+// copied, because they could be modified in place later on.
+func cacheArtifacts(dir string, root *FileInfo, tempDirs []string) (artifactCacheStats, error) {
+	var stats artifactCacheStats
+	isTemp := func(path string) bool {
+		for _, d := range tempDirs {
+			if strings.HasPrefix(path, d+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+	var walk func(fi *FileInfo) error
+	walk = func(fi *FileInfo) error {
+		for _, ent := range fi.Dirents {
+			if ent.FromHost == "" {
+				if err := walk(ent); err != nil {
+					return err
+				}
+				continue
+			}
+			hash, size, err := hashFileInfo(ent)
+			if err != nil {
+				return err
+			}
+			st, err := os.Stat(ent.FromHost)
+			if err != nil {
+				return err
+			}
+			// The file mode is part of the key, as cached copies share their
+			// mode (and, when hardlinked, their inode).
+			cached := filepath.Join(dir, "sha256", hash[:2], fmt.Sprintf("%s-%o", hash, st.Mode().Perm()))
+			stats.files++
+			stats.totalBytes += size
+			if _, err := os.Stat(cached); err == nil {
+				stats.shared++
+				stats.sharedBytes += size
+				if isTemp(ent.FromHost) {
+					// Replace the temporary copy with a hardlink, which only
+					// matters for --keep_temp.
+					if err := os.Remove(ent.FromHost); err != nil {
+						return err
+					}
+					if err := os.Link(cached, ent.FromHost); err != nil {
+						return err
+					}
+				}
+				ent.FromHost = cached
+				continue
+			}
+			if err := storeArtifact(cached, ent.FromHost, isTemp(ent.FromHost)); err != nil {
+				return err
+			}
+			ent.FromHost = cached
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// storeArtifact adds the file src to the artifact cache as dest, via a
+// hardlink if link is true and the cache is on the same file system.
+func storeArtifact(dest, src string, link bool) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if link {
+		if err := os.Link(src, dest); err == nil || os.IsExist(err) {
+			return nil
+		}
+		// Fall back to copying, e.g. across file systems.
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that concurrent builds (or builds
+	// which are interrupted) never see partial cache entries.
+	out, err := os.CreateTemp(filepath.Dir(dest), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(st.Mode().Perm()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dest)
+}
+
+func (s artifactCacheStats) String() string {
+	return fmt.Sprintf("%d of %d root file system files (%d of %d MB) were identical to files of previous builds",
+		s.shared, s.files, s.sharedBytes/MB, s.totalBytes/MB)
+}
@@ -0,0 +1,89 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheArtifacts(t *testing.T) {
+	cache := t.TempDir()
+	extra := filepath.Join(t.TempDir(), "config.txt")
+	if err := os.WriteFile(extra, []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// build returns the root file system of one host: a binary, built into a
+	// temporary directory, and an extra file.
+	build := func(binary string) (*FileInfo, string) {
+		bindir := t.TempDir()
+		bin := filepath.Join(bindir, "scanner")
+		if err := os.WriteFile(bin, []byte(binary), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return &FileInfo{Dirents: []*FileInfo{
+			{Filename: "user", Dirents: []*FileInfo{{Filename: "scanner", FromHost: bin}}},
+			{Filename: "etc", Dirents: []*FileInfo{{Filename: "config.txt", FromHost: extra}}},
+		}}, bindir
+	}
+
+	root1, bindir1 := build("binary")
+	stats, err := cacheArtifacts(cache, root1, []string{bindir1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.files != 2 || stats.shared != 0 {
+		t.Errorf("first build: %+v, want 2 files, none shared", stats)
+	}
+
+	root2, bindir2 := build("binary")
+	stats, err = cacheArtifacts(cache, root2, []string{bindir2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.files != 2 || stats.shared != 2 {
+		t.Errorf("second build: %+v, want 2 files, both shared", stats)
+	}
+	bin1 := root1.Find("user/scanner").FromHost
+	bin2 := root2.Find("user/scanner").FromHost
+	if bin1 != bin2 {
+		t.Errorf("identical binaries refer to different cache entries: %s, %s", bin1, bin2)
+	}
+	// The temporary binary of the second build is a hardlink to the cache.
+	st1, err := os.Stat(bin1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := os.Stat(filepath.Join(bindir2, "scanner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(st1, st2) {
+		t.Errorf("temporary binary is not hardlinked to the cache entry")
+	}
+	if got, want := st1.Mode().Perm(), os.FileMode(0755); got != want {
+		t.Errorf("cached binary has mode %v, want %v", got, want)
+	}
+
+	// The extra file is copied, not hardlinked, as it might be modified.
+	stExtra, err := os.Stat(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stCached, err := os.Stat(root2.Find("etc/config.txt").FromHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(stExtra, stCached) {
+		t.Errorf("extra file is hardlinked to the cache entry, want a copy")
+	}
+
+	root3, bindir3 := build("changed binary")
+	stats, err = cacheArtifacts(cache, root3, []string{bindir3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.files != 2 || stats.shared != 1 {
+		t.Errorf("third build: %+v, want 2 files, 1 shared", stats)
+	}
+}
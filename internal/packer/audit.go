@@ -0,0 +1,226 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+	"github.com/gokrazy/internal/updateflag"
+)
+
+// AuditEvent is one record of the local audit log of builds, flashes and
+// updates. Events are only recorded when the log file exists (see
+// AuditLogPath), and are additionally posted to the endpoint configured in
+// AuditEndpointPath, if any.
+type AuditEvent struct {
+	Time      time.Time
+	Operator  string // user@host running the packer
+	Operation string // build, flash or update
+	Instance  string `json:",omitempty"`
+
+	// Hostname is the hostname of the device (the update target for
+	// updates), if known.
+	Hostname string `json:",omitempty"`
+
+	// Target is the written file or device, if any.
+	Target string `json:",omitempty"`
+
+	SBOMHash string `json:",omitempty"`
+
+	// Digests maps the written images (e.g. boot.img) to their SHA256 hash.
+	Digests map[string]string `json:",omitempty"`
+
+	// Error is the reason the operation failed, empty if it succeeded.
+	Error string `json:",omitempty"`
+}
+
+// AuditLogPath returns the path of the local audit log. Recording is opt-in:
+// gok history --enable creates the file. The file is only ever appended to.
+func AuditLogPath() string {
+	return filepath.Join(config.Gokrazy(), "audit.jsonl")
+}
+
+// AuditEndpointPath returns the path of the file containing the URL to which
+// audit events are posted as JSON, in addition to the local audit log.
+func AuditEndpointPath() string {
+	return filepath.Join(config.Gokrazy(), "audit-endpoint.txt")
+}
+
+// ReadAuditLog returns all events of the audit log, oldest first.
+func ReadAuditLog() ([]*AuditEvent, error) {
+	f, err := os.Open(AuditLogPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []*AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var ev AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", AuditLogPath(), line, err)
+		}
+		events = append(events, &ev)
+	}
+	return events, scanner.Err()
+}
+
+func auditOperator() string {
+	name := os.Getenv("USER")
+	if name == "" {
+		name = "unknown"
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		name += "@" + hostname
+	}
+	return name
+}
+
+// postAuditEvent posts the JSON-encoded event b to the configured audit
+// endpoint, if any.
+func postAuditEvent(b []byte) error {
+	endpoint, err := os.ReadFile(AuditEndpointPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // no endpoint configured
+		}
+		return err
+	}
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer canc()
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSpace(string(endpoint)), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status from %s: %v", req.URL, resp.Status)
+	}
+	return nil
+}
+
+func auditEnabled() bool {
+	_, err := os.Stat(AuditLogPath())
+	return err == nil
+}
+
+// addDigests adds the SHA256 hashes of the written subjects to ev. Subjects
+// which are not regular files (e.g. block devices) are skipped.
+func (ev *AuditEvent) addDigests(subjects []provenanceSubject) error {
+	digests, err := subjectDigests(subjects)
+	if err != nil {
+		return err
+	}
+	for name, sum := range digests {
+		if ev.Digests == nil {
+			ev.Digests = make(map[string]string)
+		}
+		ev.Digests[name] = sum
+	}
+	return nil
+}
+
+// subjectDigests returns the SHA256 hashes of the written subjects by name,
+// hashing the files which were not hashed while writing them. Subjects which
+// are not regular files (e.g. block devices) are skipped.
+func subjectDigests(subjects []provenanceSubject) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, subj := range subjects {
+		sum := subj.sha256
+		if sum == "" {
+			st, err := os.Stat(subj.path)
+			if err != nil {
+				return nil, err
+			}
+			if !st.Mode().IsRegular() {
+				continue
+			}
+			if sum, err = sha256File(subj.path); err != nil {
+				return nil, err
+			}
+		}
+		digests[subj.name] = sum
+	}
+	return digests, nil
+}
+
+// recordAudit appends ev (with the result err) to the audit log if the user
+// enabled it. Errors are only logged, so that a full disk or an unreachable
+// endpoint does not fail the operation itself.
+func recordAudit(ev *AuditEvent, err error) {
+	f, openErr := os.OpenFile(AuditLogPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if openErr != nil {
+		return // not enabled
+	}
+	defer f.Close()
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Operator = auditOperator()
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	b, marshalErr := json.Marshal(ev)
+	if marshalErr != nil {
+		fmt.Fprintf(os.Stderr, "recording audit event: %v\n", marshalErr)
+		return
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "recording audit event: %v\n", err)
+	}
+	if err := postAuditEvent(b); err != nil {
+		fmt.Fprintf(os.Stderr, "posting audit event: %v\n", err)
+	}
+}
+
+// RecordFlash records writing image to dev with gok flash in the audit log.
+func RecordFlash(image, dev string, err error) {
+	if !auditEnabled() {
+		return
+	}
+	ev := &AuditEvent{
+		Operation: "flash",
+		Target:    dev,
+	}
+	if digestErr := ev.addDigests([]provenanceSubject{{name: filepath.Base(image), path: image}}); digestErr != nil {
+		fmt.Fprintf(os.Stderr, "recording audit event: %v\n", digestErr)
+	}
+	recordAudit(ev, err)
+}
+
+// newAuditEvent returns the audit event for the packer run of the instance,
+// which logic completes as it goes.
+func (pack *Pack) newAuditEvent(start time.Time) *AuditEvent {
+	cfg := pack.Cfg
+	ev := &AuditEvent{
+		Time:      start,
+		Operation: "build",
+		Instance:  instanceflag.Instance(),
+		Hostname:  cfg.Hostname,
+	}
+	if !updateflag.NewInstallation() {
+		ev.Operation = "update"
+		if cfg.Update != nil && cfg.Update.Hostname != "" {
+			ev.Hostname = cfg.Update.Hostname
+		}
+	}
+	return ev
+}
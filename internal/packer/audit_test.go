@@ -0,0 +1,71 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordAudit(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	// Recording is opt-in: without the log file, nothing is recorded.
+	recordAudit(&AuditEvent{Operation: "build"}, nil)
+	if _, err := os.Stat(AuditLogPath()); !os.IsNotExist(err) {
+		t.Fatalf("audit log unexpectedly created: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(AuditLogPath()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(AuditLogPath(), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var posted AuditEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &posted); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+	if err := os.WriteFile(AuditEndpointPath(), []byte(srv.URL+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(t.TempDir(), "scanner.img")
+	if err := os.WriteFile(image, []byte("gokrazy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	RecordFlash(image, "/dev/sdx", nil)
+	recordAudit(&AuditEvent{Operation: "update", Instance: "scanner"}, errors.New("device unhealthy after update"))
+
+	events, err := ReadAuditLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("ReadAuditLog() returned %d events, want 2", len(events))
+	}
+	flash := events[0]
+	if flash.Operation != "flash" || flash.Target != "/dev/sdx" || flash.Error != "" || flash.Operator == "" {
+		t.Errorf("flash event = %+v", flash)
+	}
+	if got, want := flash.Digests["scanner.img"], fmt.Sprintf("%x", sha256.Sum256([]byte("gokrazy"))); got != want {
+		t.Errorf("flash digest = %q, want %q", got, want)
+	}
+	if update := events[1]; update.Instance != "scanner" || update.Error != "device unhealthy after update" {
+		t.Errorf("update event = %+v", update)
+	}
+	if posted.Operation != "update" || posted.Instance != "scanner" {
+		t.Errorf("posted event = %+v, want the update event", posted)
+	}
+}
@@ -0,0 +1,151 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/internal/humanize"
+)
+
+// Backup file names in the backup directory.
+const (
+	BackupBoot     = "boot.img"
+	BackupRoot     = "root.img"
+	BackupPermFile = "perm.tar"
+)
+
+// Backup downloads the boot and root partitions which the running gokrazy
+// instance configured in cfg currently boots from (and, if perm is true, the
+// contents of /perm) into dir, so that a botched update can be undone exactly,
+// e.g. with gokr-updater -boot=<dir>/boot.img -root=<dir>/root.img.
+//
+// This requires packing the instance with RemoteExec.
+func Backup(ctx context.Context, cfg *config.Struct, dir string, perm bool, stdout io.Writer) error {
+	httpClient, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := []struct{ what, fn string }{
+		{"boot", BackupBoot},
+		{"root", BackupRoot},
+	}
+	if perm {
+		files = append(files, struct{ what, fn string }{"perm", BackupPermFile})
+	}
+	for _, f := range files {
+		u := RemoteExecURL(baseURL, RemoteExecBackupPath+f.what)
+		dest := filepath.Join(dir, f.fn)
+		fmt.Fprintf(stdout, "Downloading %s partition to %s\n", f.what, dest)
+		n, err := download(ctx, httpClient, u.String(), dest)
+		if err != nil {
+			return fmt.Errorf("backup of %s: %v", f.what, err)
+		}
+		fmt.Fprintf(stdout, "  %s\n", humanize.Bytes(uint64(n)))
+	}
+	return nil
+}
+
+// download writes the response body of url to dest (via a temporary file, so
+// that dest is only ever complete), verifying that all of it arrived against
+// the digest which remote-exec sends in the RemoteExecDigestTrailer.
+func download(ctx context.Context, httpClient *http.Client, url, dest string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%v (was the instance packed with --remote_exec?)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("unexpected HTTP status: %v: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest))
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.ContentLength > -1 && n != resp.ContentLength {
+		return 0, fmt.Errorf("incomplete download: got %d of %d bytes", n, resp.ContentLength)
+	}
+	// The trailer is only available once the body was read.
+	want := resp.Trailer.Get(RemoteExecDigestTrailer)
+	if want == "" {
+		return 0, fmt.Errorf("no digest received (connection lost, or instance packed with an older remote-exec?)")
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return 0, fmt.Errorf("digest mismatch: got SHA-256 %s, device sent %s", got, want)
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), dest)
+}
+
+// BackupPerm downloads the contents of /perm of the running gokrazy instance
+// configured in cfg as tar archive to dest. This requires packing the
+// instance with RemoteExec.
+func BackupPerm(ctx context.Context, cfg *config.Struct, dest string) (int64, error) {
+	httpClient, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return download(ctx, httpClient, RemoteExecURL(baseURL, RemoteExecBackupPath+"perm").String(), dest)
+}
+
+// RestorePerm extracts the tar archive src (as created by BackupPerm) into
+// /perm of the running gokrazy instance configured in cfg, overwriting
+// existing files. Files which are not in the archive are kept. This requires
+// packing the instance with RemoteExec.
+func RestorePerm(ctx context.Context, cfg *config.Struct, src string, stdout io.Writer) error {
+	httpClient, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", RemoteExecURL(baseURL, RemoteExecRestorePermPath).String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = st.Size()
+	req.Header.Set("Content-Type", "application/x-tar")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%v (was the instance packed with --remote_exec?)", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status: %v: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = stdout.Write(b)
+	return err
+}
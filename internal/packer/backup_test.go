@@ -0,0 +1,74 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		digest := func(s string) string {
+			h := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(h[:])
+		}
+		w.Header().Set("Trailer", RemoteExecDigestTrailer)
+		switch r.URL.Path {
+		case RemoteExecBackupPath + "boot":
+			w.Write([]byte("boot partition"))
+			w.Header().Set(RemoteExecDigestTrailer, digest("boot partition"))
+		case RemoteExecBackupPath + "root":
+			// Announce more bytes than are sent, like when the device aborts
+			// a backup due to a read error.
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("truncated"))
+		case RemoteExecBackupPath + "corrupt":
+			w.Write([]byte("corrupted partition"))
+			w.Header().Set(RemoteExecDigestTrailer, digest("boot partition"))
+		case RemoteExecBackupPath + "old":
+			// remote-exec before digests were introduced
+			w.Write([]byte("boot partition"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, BackupBoot)
+	n, err := download(context.Background(), srv.Client(), srv.URL+RemoteExecBackupPath+"boot", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dest); err != nil || string(got) != "boot partition" || n != int64(len(got)) {
+		t.Errorf("download(boot) = %d, %q (%v), want %q", n, got, err, "boot partition")
+	}
+
+	for _, what := range []string{"root", "corrupt", "old", "perm"} {
+		dest := filepath.Join(dir, what)
+		if _, err := download(context.Background(), srv.Client(), srv.URL+RemoteExecBackupPath+what, dest); err == nil {
+			t.Errorf("download(%s) unexpectedly succeeded", what)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("failed download(%s) left %s behind: %v", what, dest, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got := strings.Join(names, " "); got != BackupBoot {
+		t.Errorf("backup directory contains %q, want only %s", got, BackupBoot)
+	}
+}
@@ -0,0 +1,245 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/deviceconfig"
+	"github.com/gokrazy/tools/packer"
+)
+
+// Board is a profile for a computer other than the Raspberry Pi (e.g. a
+// Rock64, Odroid or NanoPi single-board computer, or a PC), which describes
+// how gokrazy images for it differ. Boards are either built in (see Boards) or read from a JSON file
+// with ReadBoard, for example:
+//
+//	{
+//	  "Name": "NanoPi NEO2",
+//	  "KernelPackage": "example.com/nanopi-neo2/kernel",
+//	  "MBROnly": true,
+//	  "BootloaderFiles": [
+//	    {"Name": "u-boot-sunxi-with-spl.bin", "Offset": 8192, "MaxLength": 1040384}
+//	  ],
+//	  "Cmdline": "console=ttyS0,115200 root=/dev/mmcblk0p2 rootwait panic=10 oops=panic init=/gokrazy/init"
+//	}
+type Board struct {
+	// Name is used in messages, e.g. NanoPi NEO2.
+	Name string
+
+	// GOARCH and GOARM are the architecture of the board's CPU, if it cannot
+	// run the default arm64 (see packer.TargetArch).
+	GOARCH string `json:",omitempty"`
+	GOARM  string `json:",omitempty"`
+
+	// KernelPackage is the Go package containing vmlinuz, the device tree
+	// (*.dtb) and the BootloaderFiles, used unless the instance config
+	// specifies a kernel package.
+	KernelPackage string `json:",omitempty"`
+
+	// FirmwarePackage is the Go package whose files are copied to the boot
+	// file system, used unless the instance config specifies a firmware
+	// package. Empty means none, as the Raspberry Pi firmware is useless on
+	// other boards.
+	FirmwarePackage string `json:",omitempty"`
+
+	// BootloaderFiles are files of the kernel package (e.g. u-boot) which are
+	// written to the raw disk at the specified offset, before the boot
+	// partition. Updates write them via the device-specific update handler.
+	BootloaderFiles []deviceconfig.RootFile `json:",omitempty"`
+
+	// MBROnly makes the partition table MBR-only, for boards whose boot ROM
+	// reads the bootloader from where the GPT would be stored.
+	MBROnly bool `json:",omitempty"`
+
+	// UEFI makes the boot partition an EFI system partition booted via
+	// systemd-boot (which gokrazy always installs to /EFI/BOOT): the disk
+	// gets a protective MBR instead of the hybrid MBR which the Raspberry Pi
+	// bootloader needs. The boot file system is FAT16, which the UEFI
+	// implementations of common PCs read fine.
+	UEFI bool `json:",omitempty"`
+
+	// Cmdline is the kernel command line, used instead of the cmdline.txt of
+	// the kernel package if non-empty. root=/dev/mmcblk0p2 is replaced with
+	// the PARTUUID of the root partition, like for the Raspberry Pi.
+	Cmdline string `json:",omitempty"`
+
+	// SerialConsole is the serial console (e.g. ttyS0,115200), used unless
+	// the instance config specifies one.
+	SerialConsole string `json:",omitempty"`
+
+	// BootScript is a U-Boot script which the packer writes to /boot.scr (as
+	// a legacy uImage, like mkimage -T script), for boards whose U-Boot runs
+	// boot.scr from the boot partition. cmdline.txt then has the form
+	// bootargs=<kernel command line>, so that the script can load it with
+	// env import -t: gokrazy switches root partitions on updates by
+	// modifying the root= of cmdline.txt.
+	BootScript string `json:",omitempty"`
+
+	// QEMUMachine is the QEMU machine type (e.g. virt) which emulates the
+	// board, if any. After writing a full disk image into a file, the packer
+	// prints the QEMU command line to boot it, e.g. for testing images in CI.
+	QEMUMachine string `json:",omitempty"`
+}
+
+// builtinBoards are the boards which are not in the deviceconfig package.
+var builtinBoards = map[string]Board{
+	"amd64": {
+		Name:          "x86-64 UEFI PC",
+		GOARCH:        "amd64",
+		KernelPackage: "github.com/gokrazy/kernel.amd64",
+		UEFI:          true,
+		SerialConsole: "ttyS0,115200",
+	},
+	"qemu-virt": {
+		Name:          "QEMU virt machine",
+		GOARCH:        "arm64",
+		KernelPackage: "github.com/gokrazy/kernel.arm64",
+		UEFI:          true,
+		// The virtio block device is /dev/vda, but root= is replaced with
+		// the PARTUUID of the root partition anyway.
+		Cmdline:       "console=ttyAMA0,115200 root=/dev/mmcblk0p2 rootwait panic=10 oops=panic init=/gokrazy/init",
+		SerialConsole: "ttyAMA0,115200",
+		QEMUMachine:   "virt",
+	},
+	"visionfive2": {
+		Name:   "StarFive VisionFive 2",
+		GOARCH: "riscv64",
+		// There is no gokrazy kernel package for RISC-V: the instance config
+		// needs to specify one with vmlinuz (an uncompressed Image) and the
+		// device tree of the board.
+		Cmdline:       "root=/dev/mmcblk1p2 rootwait panic=10 oops=panic init=/gokrazy/init",
+		SerialConsole: "ttyS0,115200",
+		// The U-Boot in the SPI flash of the board runs boot.scr via distro
+		// boot, which sets devtype, devnum and distro_bootpart.
+		BootScript: `load ${devtype} ${devnum}:${distro_bootpart} ${ramdisk_addr_r} cmdline.txt
+env import -t ${ramdisk_addr_r} ${filesize}
+load ${devtype} ${devnum}:${distro_bootpart} ${kernel_addr_r} vmlinuz
+load ${devtype} ${devnum}:${distro_bootpart} ${fdt_addr_r} jh7110-starfive-visionfive-2-v1.3b.dtb
+booti ${kernel_addr_r} - ${fdt_addr_r}
+`,
+	},
+}
+
+// Boards returns the names of the built-in boards: amd64 (PCs booting via
+// UEFI, e.g. NUCs or thin clients), qemu-virt (the QEMU virt machine, for
+// booting images in CI), visionfive2 (the StarFive VisionFive 2 RISC-V board)
+// and the device types of the deviceconfig package (e.g. odroidhc1).
+func Boards() []string {
+	var boards []string
+	for name := range builtinBoards {
+		boards = append(boards, name)
+	}
+	for _, devcfg := range deviceconfig.DeviceConfigs {
+		boards = append(boards, devcfg.Slug)
+	}
+	sort.Strings(boards)
+	return boards
+}
+
+// ReadBoard returns the built-in board with the specified name (see Boards),
+// or reads the board profile from the JSON file of the specified path (if it
+// ends in .json).
+func ReadBoard(nameOrPath string) (*Board, error) {
+	if board, ok := builtinBoards[nameOrPath]; ok {
+		return &board, nil
+	}
+	if !strings.HasSuffix(nameOrPath, ".json") {
+		devcfg, ok := deviceconfig.GetDeviceConfigBySlug(nameOrPath)
+		if !ok {
+			return nil, fmt.Errorf("unknown board %q, expected a board profile (.json file) or one of %s", nameOrPath, strings.Join(Boards(), ", "))
+		}
+		return &Board{
+			Name:            devcfg.Slug,
+			BootloaderFiles: devcfg.RootDeviceFiles,
+			MBROnly:         devcfg.MBROnlyWithoutGPT,
+		}, nil
+	}
+	b, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	var board Board
+	if err := json.Unmarshal(b, &board); err != nil {
+		return nil, fmt.Errorf("%s: %v", nameOrPath, err)
+	}
+	if board.Name == "" {
+		board.Name = nameOrPath
+	}
+	if err := board.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", nameOrPath, err)
+	}
+	return &board, nil
+}
+
+// Validate returns an error if the bootloader files overlap each other, the
+// partition table or the boot partition.
+func (b *Board) Validate() error {
+	if b.UEFI && b.MBROnly {
+		return fmt.Errorf("UEFI requires a GPT, but MBROnly is set")
+	}
+	files := append([]deviceconfig.RootFile(nil), b.BootloaderFiles...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+	// The MBR occupies the first sector, the GPT the following 33 sectors.
+	end := int64(512)
+	if !b.MBROnly {
+		end = 34 * 512
+	}
+	for _, f := range files {
+		if f.Name == "" || f.MaxLength <= 0 {
+			return fmt.Errorf("bootloader file %+v: Name and MaxLength are required", f)
+		}
+		if f.Offset < end {
+			return fmt.Errorf("bootloader file %s (offset %d) overlaps the partition table or the previous bootloader file (ending at %d), set MBROnly or move it", f.Name, f.Offset, end)
+		}
+		end = f.Offset + f.MaxLength
+	}
+	if bootOffset := (&packer.Pack{}).BootOffset(); end > bootOffset {
+		return fmt.Errorf("bootloader files end at %d, overlapping the boot partition at %d", end, bootOffset)
+	}
+	return nil
+}
+
+// applyDefaults sets the kernel, firmware and EEPROM packages and the serial
+// console of cfg which the instance config leaves unspecified to the ones of
+// the board.
+func (b *Board) applyDefaults(cfg *config.Struct) {
+	if cfg.KernelPackage == nil && b.KernelPackage != "" {
+		kernel := b.KernelPackage
+		cfg.KernelPackage = &kernel
+	}
+	if cfg.FirmwarePackage == nil {
+		firmware := b.FirmwarePackage
+		cfg.FirmwarePackage = &firmware
+	}
+	if cfg.SerialConsole == "" {
+		cfg.SerialConsole = b.SerialConsole
+	}
+	if cfg.EEPROMPackage == nil {
+		// The Raspberry Pi EEPROM update files are useless on other boards.
+		none := ""
+		cfg.EEPROMPackage = &none
+	}
+}
+
+// qemuFirmware is the UEFI firmware of QEMU per architecture, at the path of
+// the Debian packages qemu-efi-aarch64 and ovmf.
+var qemuFirmware = map[string]struct{ qemu, bios string }{
+	"arm64": {"qemu-system-aarch64 -cpu max", "/usr/share/qemu-efi-aarch64/QEMU_EFI.fd"},
+	"amd64": {"qemu-system-x86_64", "/usr/share/ovmf/OVMF.fd"},
+}
+
+// qemuCommand returns a QEMU command line for booting the full disk image
+// (with virtio block and network devices), or the empty string if QEMU does
+// not emulate the board.
+func (b *Board) qemuCommand(image string) string {
+	fw, ok := qemuFirmware[b.GOARCH]
+	if b.QEMUMachine == "" || !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s -machine %s -m 1G -nographic -bios %s -drive file=%s,format=raw,if=virtio -nic user,model=virtio-net-pci",
+		fw.qemu, b.QEMUMachine, fw.bios, image)
+}
@@ -0,0 +1,163 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/deviceconfig"
+)
+
+func TestReadBoard(t *testing.T) {
+	odroid, err := ReadBoard("odroidhc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !odroid.MBROnly || len(odroid.BootloaderFiles) == 0 {
+		t.Errorf("ReadBoard(odroidhc1) = %+v, want MBR-only with bootloader files", odroid)
+	}
+	if err := odroid.Validate(); err != nil {
+		t.Errorf("odroidhc1: Validate() = %v", err)
+	}
+	if _, err := ReadBoard("rock64"); err == nil {
+		t.Errorf("unknown board rock64 unexpectedly accepted")
+	}
+
+	fn := filepath.Join(t.TempDir(), "neo2.json")
+	const profile = `{
+  "KernelPackage": "example.com/nanopi-neo2/kernel",
+  "MBROnly": true,
+  "BootloaderFiles": [
+    {"Name": "u-boot-sunxi-with-spl.bin", "Offset": 8192, "MaxLength": 1040384}
+  ]
+}`
+	if err := os.WriteFile(fn, []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	board, err := ReadBoard(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if board.Name != fn || board.KernelPackage != "example.com/nanopi-neo2/kernel" || len(board.BootloaderFiles) != 1 {
+		t.Errorf("ReadBoard(%s) = %+v", fn, board)
+	}
+}
+
+func TestBoardValidate(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		board   Board
+		wantErr string
+	}{
+		{
+			desc: "valid",
+			board: Board{BootloaderFiles: []deviceconfig.RootFile{
+				{Name: "spl.bin", Offset: 32768, MaxLength: 65536},
+				{Name: "u-boot.bin", Offset: 98304, MaxLength: 1 << 20},
+			}},
+		},
+		{
+			desc: "overlapping GPT",
+			board: Board{BootloaderFiles: []deviceconfig.RootFile{
+				{Name: "bl1.bin", Offset: 512, MaxLength: 15360},
+			}},
+			wantErr: "partition table",
+		},
+		{
+			desc: "MBR only",
+			board: Board{MBROnly: true, BootloaderFiles: []deviceconfig.RootFile{
+				{Name: "bl1.bin", Offset: 512, MaxLength: 15360},
+			}},
+		},
+		{
+			desc: "overlapping each other",
+			board: Board{BootloaderFiles: []deviceconfig.RootFile{
+				{Name: "u-boot.bin", Offset: 65536, MaxLength: 65536},
+				{Name: "spl.bin", Offset: 32768, MaxLength: 65536},
+			}},
+			wantErr: "previous bootloader file",
+		},
+		{
+			desc: "overlapping boot partition",
+			board: Board{BootloaderFiles: []deviceconfig.RootFile{
+				{Name: "u-boot.itb", Offset: 8 << 20, MaxLength: 1 << 20},
+			}},
+			wantErr: "boot partition",
+		},
+	} {
+		err := tt.board.Validate()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: Validate() = %v", tt.desc, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: Validate() = %v, want error containing %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBoardUEFI(t *testing.T) {
+	board, err := ReadBoard("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !board.UEFI || board.GOARCH != "amd64" {
+		t.Errorf("ReadBoard(amd64) = %+v, want UEFI and GOARCH=amd64", board)
+	}
+	cfg := config.NewStruct("pc")
+	board.applyDefaults(cfg)
+	if got, want := cfg.KernelPackageOrDefault(), "github.com/gokrazy/kernel.amd64"; got != want {
+		t.Errorf("kernel package = %q, want %q", got, want)
+	}
+	if got := cfg.FirmwarePackageOrDefault(); got != "" {
+		t.Errorf("firmware package = %q, want none", got)
+	}
+	if got, want := cfg.SerialConsoleOrDefault(), "ttyS0,115200"; got != want {
+		t.Errorf("serial console = %q, want %q", got, want)
+	}
+
+	if err := (&Board{UEFI: true, MBROnly: true}).Validate(); err == nil {
+		t.Errorf("Validate() with UEFI and MBROnly = nil, want error")
+	}
+}
+
+func TestBoardQEMUVirt(t *testing.T) {
+	board, err := ReadBoard("qemu-virt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := board.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := board.qemuCommand("/tmp/ci.img")
+	for _, want := range []string{"qemu-system-aarch64", "-machine virt", "-bios /usr/share/qemu-efi-aarch64/QEMU_EFI.fd", "file=/tmp/ci.img,format=raw,if=virtio"} {
+		if !strings.Contains(cmd, want) {
+			t.Errorf("qemuCommand() = %q, want it to contain %q", cmd, want)
+		}
+	}
+	if cmd := (&Board{GOARCH: "arm64"}).qemuCommand("/tmp/ci.img"); cmd != "" {
+		t.Errorf("qemuCommand() without QEMUMachine = %q, want empty", cmd)
+	}
+}
+
+func TestBoardVisionFive2(t *testing.T) {
+	board, err := ReadBoard("visionfive2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := board.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if board.GOARCH != "riscv64" || board.BootScript == "" {
+		t.Errorf("ReadBoard(visionfive2) = %+v, want GOARCH=riscv64 with a boot script", board)
+	}
+	cfg := config.NewStruct("vf2")
+	board.applyDefaults(cfg)
+	if cfg.KernelPackage != nil {
+		t.Errorf("kernel package = %q, want unset (there is no default)", *cfg.KernelPackage)
+	}
+	if got := cfg.FirmwarePackageOrDefault() + cfg.EEPROMPackageOrDefault(); got != "" {
+		t.Errorf("firmware and EEPROM packages = %q, want none", got)
+	}
+}
@@ -0,0 +1,417 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// bootManifestPath is the path of the manifest on the boot file system, which
+// contains the SHA256 hash of every other file of the boot file system in
+// sha256sum(1) format, so that tampering with e.g. the kernel or cmdline.txt
+// can be detected (see VerifyBootManifest).
+const bootManifestPath = "/boot.sha256"
+
+// fatWriter is implemented by fat.Writer (FAT16) and fat32.Writer, see
+// packer.Layout.BootFileSystem.
+type fatWriter interface {
+	File(path string, modTime time.Time) (io.Writer, error)
+	Flush() error
+}
+
+// bootFS is the FAT writer for the boot file system, which records the SHA256
+// hash (and the size) of each file for the boot manifest.
+type bootFS struct {
+	fatWriter
+	hashes map[string]hash.Hash
+	sizes  map[string]*countingWriter
+
+	// modTime overrides the modification time of all files if non-zero
+	// (see Pack.Reproducible).
+	modTime time.Time
+}
+
+func newBootFS(fw fatWriter) *bootFS {
+	return &bootFS{
+		fatWriter: fw,
+		hashes:    make(map[string]hash.Hash),
+		sizes:     make(map[string]*countingWriter),
+	}
+}
+
+func (b *bootFS) File(path string, modTime time.Time) (io.Writer, error) {
+	if !b.modTime.IsZero() {
+		modTime = b.modTime
+	}
+	w, err := b.fatWriter.File(path, modTime)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	b.hashes[path] = h
+	size := new(countingWriter)
+	b.sizes[path] = size
+	return io.MultiWriter(w, h, size), nil
+}
+
+// files returns the files written so far, sorted by path, for the build
+// manifest (see Pack.BuildManifest).
+func (b *bootFS) files() []ManifestFile {
+	files := make([]ManifestFile, 0, len(b.hashes))
+	for path, h := range b.hashes {
+		files = append(files, ManifestFile{
+			Path:   path,
+			Size:   int64(*b.sizes[path]),
+			SHA256: fmt.Sprintf("%x", h.Sum(nil)),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// writeManifest writes the boot manifest. It must be called after all other
+// files were written.
+func (b *bootFS) writeManifest() error {
+	paths := make([]string, 0, len(b.hashes))
+	for path := range b.hashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var buf bytes.Buffer
+	for _, path := range paths {
+		fmt.Fprintf(&buf, "%x  %s\n", b.hashes[path].Sum(nil), strings.TrimPrefix(path, "/"))
+	}
+	modTime := b.modTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	w, err := b.fatWriter.File(bootManifestPath, modTime)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// fatReader reads the FAT16 file systems created by fat.Writer and the FAT32
+// file systems created by fat32.Writer, including long file names and
+// subdirectories (unlike fat.Reader).
+type fatReader struct {
+	r                 io.ReaderAt
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	fat32             bool
+	fat               []uint32
+	rootOffset        int64  // FAT16 only
+	rootEntries       int64  // FAT16 only
+	rootCluster       uint32 // FAT32 only
+	dataOffset        int64
+}
+
+func newFATReader(r io.ReaderAt) (*fatReader, error) {
+	var bs [512]byte
+	if _, err := r.ReadAt(bs[:], 0); err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xAA {
+		return nil, fmt.Errorf("no FAT boot sector signature found")
+	}
+	le := binary.LittleEndian
+	fr := &fatReader{
+		r:                 r,
+		bytesPerSector:    int64(le.Uint16(bs[11:])),
+		sectorsPerCluster: int64(bs[13]),
+		rootEntries:       int64(le.Uint16(bs[17:])),
+	}
+	if fr.bytesPerSector == 0 || fr.sectorsPerCluster == 0 {
+		return nil, fmt.Errorf("invalid FAT boot sector")
+	}
+	var (
+		reserved   = int64(le.Uint16(bs[14:]))
+		numFATs    = int64(bs[16])
+		fatSectors = int64(le.Uint16(bs[22:]))
+	)
+	if fatSectors == 0 { // FAT32
+		fr.fat32 = true
+		fatSectors = int64(le.Uint32(bs[36:]))
+		fr.rootCluster = le.Uint32(bs[44:])
+	}
+	fatBytes := make([]byte, fatSectors*fr.bytesPerSector)
+	if _, err := r.ReadAt(fatBytes, reserved*fr.bytesPerSector); err != nil {
+		return nil, err
+	}
+	if fr.fat32 {
+		fr.fat = make([]uint32, len(fatBytes)/4)
+		for i := range fr.fat {
+			fr.fat[i] = le.Uint32(fatBytes[i*4:]) & 0x0FFFFFFF
+		}
+	} else {
+		fr.fat = make([]uint32, len(fatBytes)/2)
+		for i := range fr.fat {
+			fr.fat[i] = uint32(le.Uint16(fatBytes[i*2:]))
+		}
+	}
+	fr.rootOffset = (reserved + numFATs*fatSectors) * fr.bytesPerSector
+	rootSectors := (fr.rootEntries*32 + fr.bytesPerSector - 1) / fr.bytesPerSector
+	fr.dataOffset = fr.rootOffset + rootSectors*fr.bytesPerSector
+	return fr, nil
+}
+
+// root returns the entries of the root directory.
+func (fr *fatReader) root() ([]byte, error) {
+	if fr.fat32 {
+		return fr.chain(fr.rootCluster)
+	}
+	root := make([]byte, fr.rootEntries*32)
+	if _, err := fr.r.ReadAt(root, fr.rootOffset); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// endOfChain returns whether cluster marks the end of a cluster chain.
+func (fr *fatReader) endOfChain(cluster uint32) bool {
+	if fr.fat32 {
+		return cluster >= 0x0FFFFFF8
+	}
+	return cluster >= 0xFFF8
+}
+
+func (fr *fatReader) clusterOffset(cluster uint32) int64 {
+	return fr.dataOffset + int64(cluster-2)*fr.sectorsPerCluster*fr.bytesPerSector
+}
+
+// chain returns the contents of the cluster chain starting at cluster first.
+func (fr *fatReader) chain(first uint32) ([]byte, error) {
+	clusterSize := fr.sectorsPerCluster * fr.bytesPerSector
+	var data []byte
+	seen := make(map[uint32]bool)
+	for cluster := first; cluster >= 2 && !fr.endOfChain(cluster); cluster = fr.fat[cluster] {
+		if int(cluster) >= len(fr.fat) || seen[cluster] {
+			return nil, fmt.Errorf("corrupt cluster chain at cluster %d", cluster)
+		}
+		seen[cluster] = true
+		buf := make([]byte, clusterSize)
+		if _, err := fr.r.ReadAt(buf, fr.clusterOffset(cluster)); err != nil {
+			return nil, err
+		}
+		data = append(data, buf...)
+	}
+	return data, nil
+}
+
+// fatDirEntry is a file or subdirectory in a FAT directory.
+type fatDirEntry struct {
+	name         string
+	dir          bool
+	firstCluster uint32
+	size         int64
+}
+
+// dirEntries parses the directory entries in entries, skipping the volume
+// label and the . and .. entries.
+func (fr *fatReader) dirEntries(entries []byte) []fatDirEntry {
+	var result []fatDirEntry
+	var lfn []uint16
+	for off := 0; off+32 <= len(entries); off += 32 {
+		ent := entries[off : off+32]
+		if ent[0] == 0 {
+			break // end of directory
+		}
+		if ent[0] == 0xE5 {
+			lfn = nil
+			continue // deleted
+		}
+		attr := ent[11]
+		if attr == 0x0F { // long file name entry
+			var chars []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					chars = append(chars, binary.LittleEndian.Uint16(ent[i:]))
+				}
+			}
+			// Entries are stored in reverse order.
+			lfn = append(chars, lfn...)
+			continue
+		}
+		name := strings.TrimRight(string(ent[0:8]), " ")
+		if ext := strings.TrimRight(string(ent[8:11]), " "); ext != "" {
+			name += "." + ext
+		}
+		if lfn != nil {
+			for i, c := range lfn {
+				if c == 0 || c == 0xFFFF {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(lfn))
+			lfn = nil
+		}
+		if attr&0x08 != 0 || name == "." || name == ".." {
+			continue // volume label
+		}
+		first := uint32(binary.LittleEndian.Uint16(ent[26:]))
+		if fr.fat32 {
+			first |= uint32(binary.LittleEndian.Uint16(ent[20:])) << 16
+		}
+		result = append(result, fatDirEntry{
+			name:         name,
+			dir:          attr&0x10 != 0,
+			firstCluster: first,
+			size:         int64(binary.LittleEndian.Uint32(ent[28:])),
+		})
+	}
+	return result
+}
+
+// walk calls fn for each file in the directory dir, whose entries are in
+// entries (recursively).
+func (fr *fatReader) walk(dir string, entries []byte, fn func(path string, contents []byte) error) error {
+	for _, ent := range fr.dirEntries(entries) {
+		path := dir + "/" + ent.name
+		data, err := fr.chain(ent.firstCluster)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if ent.dir {
+			if err := fr.walk(path, data, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if ent.size > int64(len(data)) {
+			return fmt.Errorf("%s: size %d exceeds its %d bytes of clusters", path, ent.size, len(data))
+		}
+		if err := fn(path, data[:ent.size]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extents returns the offset and length of the file at path (e.g.
+// /cmdline.txt). Like fat.Reader.Extents, it assumes that the file is stored
+// in consecutive clusters, which fat.Writer and fat32.Writer guarantee.
+func (fr *fatReader) extents(path string) (offset, length int64, _ error) {
+	entries, err := fr.root()
+	if err != nil {
+		return 0, 0, err
+	}
+	components := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, component := range components {
+		var found *fatDirEntry
+		for _, ent := range fr.dirEntries(entries) {
+			if ent.name == component {
+				ent := ent
+				found = &ent
+				break
+			}
+		}
+		if found == nil {
+			return 0, 0, fmt.Errorf("%s: not found", path)
+		}
+		if i < len(components)-1 {
+			if !found.dir {
+				return 0, 0, fmt.Errorf("%s: %s is not a directory", path, component)
+			}
+			if entries, err = fr.chain(found.firstCluster); err != nil {
+				return 0, 0, fmt.Errorf("%s: %v", path, err)
+			}
+			continue
+		}
+		if found.dir {
+			return 0, 0, fmt.Errorf("%s: is a directory", path)
+		}
+		if found.size == 0 {
+			return 0, 0, nil
+		}
+		return fr.clusterOffset(found.firstCluster), found.size, nil
+	}
+	return 0, 0, fmt.Errorf("%s: not found", path)
+}
+
+// seekReaderAt implements io.ReaderAt for readers which can only seek, e.g.
+// the hashing writer of writeHashed.
+type seekReaderAt struct {
+	io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s, b)
+}
+
+// ErrNoBootManifest is returned by VerifyBootManifest for boot file systems
+// created by gokrazy versions which did not write a boot manifest yet.
+var ErrNoBootManifest = errors.New("boot file system contains no " + bootManifestPath + " manifest")
+
+// VerifyBootManifest verifies the files of the boot file system in r against
+// the boot manifest, which gokrazy writes to the boot file system, and returns
+// the number of verified files.
+func VerifyBootManifest(r io.ReaderAt) (verified int, _ error) {
+	fr, err := newFATReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading boot file system: %v", err)
+	}
+	root, err := fr.root()
+	if err != nil {
+		return 0, fmt.Errorf("reading boot file system: %v", err)
+	}
+	hashes := make(map[string]string)
+	var manifest []byte
+	err = fr.walk("", root, func(path string, contents []byte) error {
+		if path == bootManifestPath {
+			manifest = contents
+			return nil
+		}
+		hashes[path] = fmt.Sprintf("%x", sha256.Sum256(contents))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("reading boot file system: %v", err)
+	}
+	if manifest == nil {
+		return 0, ErrNoBootManifest
+	}
+
+	var problems []string
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+		want, path, ok := strings.Cut(line, "  ")
+		if !ok {
+			return 0, fmt.Errorf("%s: malformed line %q", bootManifestPath, line)
+		}
+		path = "/" + path
+		listed[path] = true
+		got, ok := hashes[path]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: missing", path))
+		case got != want:
+			problems = append(problems, fmt.Sprintf("%s: sha256 %s, manifest says %s", path, got, want))
+		default:
+			verified++
+		}
+	}
+	for path := range hashes {
+		if !listed[path] {
+			problems = append(problems, fmt.Sprintf("%s: not in manifest", path))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return verified, fmt.Errorf("boot file system does not match its manifest:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return verified, nil
+}
@@ -0,0 +1,125 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/fat"
+	"github.com/gokrazy/tools/internal/fat32"
+)
+
+func writeTestBootFS(t *testing.T, manifest bool, bootFileSystem string) *os.File {
+	f, err := os.CreateTemp(t.TempDir(), "boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fatw fatWriter
+	if bootFileSystem == "fat32" {
+		fatw, err = fat32.NewWriter(f, 64*MB)
+	} else {
+		fatw, err = fat.NewWriter(f)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := newBootFS(fatw)
+	for path, contents := range map[string]string{
+		"/cmdline.txt":                  "console=tty1",
+		"/bcm2710-rpi-3-b.dtb":          "dtb 1",
+		"/bcm2710-rpi-3-b-plus.dtb":     "dtb 2",
+		"/loader/entries/gokrazy.conf":  "title gokrazy",
+		"/EFI/BOOT/BOOTX64.EFI":         strings.Repeat("x", 20000),
+		"/overlays/a-long-file-name.dt": "overlay",
+	} {
+		w, err := fw.File(path, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if manifest {
+		if err := fw.writeManifest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestVerifyBootManifest(t *testing.T) {
+	for _, fs := range []string{"fat16", "fat32"} {
+		t.Run(fs, func(t *testing.T) {
+			testVerifyBootManifest(t, fs)
+		})
+	}
+}
+
+func testVerifyBootManifest(t *testing.T, bootFileSystem string) {
+	f := writeTestBootFS(t, true, bootFileSystem)
+	verified, err := VerifyBootManifest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := verified, 6; got != want {
+		t.Errorf("VerifyBootManifest: verified %d files, want %d", got, want)
+	}
+
+	// Tamper with cmdline.txt:
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, st.Size())
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	idx := bytes.Index(b, []byte("console=tty1"))
+	if idx == -1 {
+		t.Fatal("cmdline.txt contents not found")
+	}
+	if _, err := f.WriteAt([]byte("console=tty2"), int64(idx)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyBootManifest(f)
+	if err == nil || !strings.Contains(err.Error(), "/cmdline.txt: sha256") {
+		t.Errorf("VerifyBootManifest(tampered) = %v, want cmdline.txt mismatch", err)
+	}
+}
+
+func TestVerifyBootManifestMissing(t *testing.T) {
+	f := writeTestBootFS(t, false, "fat16")
+	if _, err := VerifyBootManifest(f); !errors.Is(err, ErrNoBootManifest) {
+		t.Errorf("VerifyBootManifest = %v, want %v", err, ErrNoBootManifest)
+	}
+}
+
+func TestFATReaderExtents(t *testing.T) {
+	for _, fs := range []string{"fat16", "fat32"} {
+		t.Run(fs, func(t *testing.T) {
+			f := writeTestBootFS(t, false, fs)
+			for path, want := range map[string]string{
+				"/cmdline.txt":                  "console=tty1",
+				"/overlays/a-long-file-name.dt": "overlay",
+			} {
+				got, err := readBootFile(f, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("readBootFile(%s) = %q, want %q", path, got, want)
+				}
+			}
+			if _, err := readBootFile(f, "/vmlinuz"); err == nil {
+				t.Errorf("readBootFile(/vmlinuz) = nil, want error")
+			}
+		})
+	}
+}
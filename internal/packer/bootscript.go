@@ -0,0 +1,71 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// uImage constants, see include/image.h in U-Boot.
+const (
+	uImageMagic      = 0x27051956
+	uImageOSLinux    = 5
+	uImageTypeScript = 6
+	uImageCompNone   = 0
+)
+
+// uImageArch maps GOARCH to the U-Boot architecture of the uImage header.
+var uImageArch = map[string]byte{
+	"arm":     2,
+	"amd64":   24,
+	"arm64":   22,
+	"riscv64": 26,
+}
+
+// uImageScript encodes the U-Boot script as a legacy uImage of type script,
+// like mkimage -A <arch> -T script -C none does, for running with source.
+func uImageScript(script, arch string, modTime time.Time) []byte {
+	// A script image is a multi-file image with one file: the list of file
+	// lengths (terminated by 0) precedes the script.
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(len(script)))
+	binary.Write(&data, binary.BigEndian, uint32(0))
+	data.WriteString(script)
+
+	hdr := make([]byte, 64)
+	binary.BigEndian.PutUint32(hdr[0:], uImageMagic)
+	// hdr[4:8] is the header checksum, filled in below.
+	binary.BigEndian.PutUint32(hdr[8:], uint32(modTime.Unix()))
+	binary.BigEndian.PutUint32(hdr[12:], uint32(data.Len()))
+	// hdr[16:24] are the load address and entry point, unused for scripts.
+	binary.BigEndian.PutUint32(hdr[24:], crc32.ChecksumIEEE(data.Bytes()))
+	hdr[28] = uImageOSLinux
+	hdr[29] = uImageArch[arch]
+	hdr[30] = uImageTypeScript
+	hdr[31] = uImageCompNone
+	copy(hdr[32:], "gokrazy boot script")
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(hdr))
+	return append(hdr, data.Bytes()...)
+}
+
+// writeBootScript writes the U-Boot script of the board (if any) to /boot.scr.
+func (p *Pack) writeBootScript(fw *bootFS) error {
+	if p.Board == nil || p.Board.BootScript == "" {
+		return nil
+	}
+	arch := packer.TargetArch()
+	if _, ok := uImageArch[arch]; !ok {
+		return fmt.Errorf("board %s: boot scripts are not supported for %s", p.Board.Name, arch)
+	}
+	now := p.now()
+	w, err := fw.File("/boot.scr", now)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(uImageScript(p.Board.BootScript, arch, now))
+	return err
+}
@@ -0,0 +1,41 @@
+package packer
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func TestUImageScript(t *testing.T) {
+	const script = "echo hello\n"
+	b := uImageScript(script, "riscv64", time.Unix(1700000000, 0))
+	if len(b) != 64+8+len(script) {
+		t.Fatalf("len = %d, want %d", len(b), 64+8+len(script))
+	}
+	hdr := append([]byte(nil), b[:64]...)
+	if got := binary.BigEndian.Uint32(hdr[0:]); got != uImageMagic {
+		t.Errorf("magic = %#x, want %#x", got, uImageMagic)
+	}
+	hcrc := binary.BigEndian.Uint32(hdr[4:])
+	binary.BigEndian.PutUint32(hdr[4:], 0)
+	if got := crc32.ChecksumIEEE(hdr); got != hcrc {
+		t.Errorf("header checksum = %#x, want %#x", hcrc, got)
+	}
+	data := b[64:]
+	if got, want := binary.BigEndian.Uint32(hdr[12:]), uint32(len(data)); got != want {
+		t.Errorf("data size = %d, want %d", got, want)
+	}
+	if got, want := binary.BigEndian.Uint32(hdr[24:]), crc32.ChecksumIEEE(data); got != want {
+		t.Errorf("data checksum = %#x, want %#x", got, want)
+	}
+	if got := hdr[29:31]; got[0] != 26 || got[1] != uImageTypeScript {
+		t.Errorf("arch, type = %v, want [26 %d]", got, uImageTypeScript)
+	}
+	if got := binary.BigEndian.Uint32(data); got != uint32(len(script)) {
+		t.Errorf("script length = %d, want %d", got, len(script))
+	}
+	if got := string(data[8:]); got != script {
+		t.Errorf("script = %q, want %q", got, script)
+	}
+}
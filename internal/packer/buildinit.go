@@ -6,7 +6,6 @@ import (
 	"go/format"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"text/template"
@@ -22,6 +21,14 @@ import (
 	"log"
 	"os"
 	"os/exec"
+{{- if .Debug }}
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+{{- end }}
 
 	"github.com/gokrazy/gokrazy"
 )
@@ -30,19 +37,164 @@ import (
 // -ldflags "-X main.buildTimestamp=foo" when building.
 var buildTimestamp = {{ printf "%#v" .BuildTimestamp }}
 
+{{- if .Debug }}
+
+// debugLog logs to the console and to the kernel ring buffer (dmesg).
+var debugLog = log.New(os.Stdout, "init debug: ", log.Lmicroseconds)
+
+func enableDebugLog() {
+	if kmsg, err := os.OpenFile("/dev/kmsg", os.O_WRONLY, 0); err == nil {
+		debugLog.SetOutput(io.MultiWriter(os.Stdout, kmsg))
+	}
+}
+
+func debugMounts() {
+	b, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		debugLog.Printf("reading mounts: %v", err)
+		return
+	}
+	perm := false
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		debugLog.Printf("mount: %s", line)
+		if f := strings.Fields(line); len(f) > 1 && f[1] == "/perm" {
+			perm = true
+		}
+	}
+	if !perm {
+		debugLog.Printf("/perm is not mounted: the perm partition is missing or has no file system")
+	}
+}
+
+// debugProcesses returns the pids of all processes by executable path.
+func debugProcesses() map[string][]int {
+	procs := make(map[string][]int)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return procs
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		exe, err := os.Readlink(filepath.Join("/proc", e.Name(), "exe"))
+		if err != nil {
+			continue
+		}
+		procs[exe] = append(procs[exe], pid)
+	}
+	return procs
+}
+
+func debugAddrs() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err.Error()
+	}
+	var parts []string
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		desc := iface.Name + " " + iface.Flags.String()
+		for _, addr := range addrs {
+			desc += " " + addr.String()
+		}
+		parts = append(parts, desc)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// debugSupervision polls for the processes of services starting and exiting
+// (e.g. crash loops), and for changes of the network configuration, during
+// the first minutes after boot.
+func debugSupervision(paths []string) {
+	const duration = 10 * time.Minute
+	debugLog.Printf("logging service processes and network changes for %v", duration)
+	prev := make(map[string][]int)
+	var prevAddrs string
+	for start := time.Now(); time.Since(start) < duration; time.Sleep(1 * time.Second) {
+		procs := debugProcesses()
+		for _, path := range paths {
+			was := make(map[int]bool)
+			for _, pid := range prev[path] {
+				was[pid] = true
+			}
+			is := make(map[int]bool)
+			for _, pid := range procs[path] {
+				is[pid] = true
+				if !was[pid] {
+					debugLog.Printf("service %s: started (pid %d)", path, pid)
+				}
+			}
+			for pid := range was {
+				if !is[pid] {
+					debugLog.Printf("service %s: exited (pid %d)", path, pid)
+				}
+			}
+		}
+		prev = procs
+		if addrs := debugAddrs(); addrs != prevAddrs {
+			debugLog.Printf("network: %s", addrs)
+			prevAddrs = addrs
+		}
+	}
+	debugLog.Printf("stopped debug logging")
+}
+{{- end }}
+
+{{- if .Volumes }}
+
+// setupVolume creates the persistent directory of a service and sets its
+// permissions and owner (uid/gid -1 leaves the owner unchanged).
+func setupVolume(dir string, mode os.FileMode, uid, gid int) {
+	if err := os.MkdirAll(dir, mode); err != nil {
+		log.Printf("volume %s: %v", dir, err)
+		return
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		log.Printf("volume %s: %v", dir, err)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			log.Printf("volume %s: %v", dir, err)
+		}
+	}
+}
+{{- end }}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	fmt.Printf("gokrazy build timestamp %s\n", buildTimestamp)
+{{- if .Debug }}
+	enableDebugLog()
+	debugLog.Printf("calling gokrazy.Boot (mounting file systems, setting up the hostname and loopback interface)")
+{{- end }}
 	if err := gokrazy.Boot(buildTimestamp); err != nil {
+{{- if .Debug }}
+		debugLog.Printf("gokrazy.Boot failed: %v", err)
+{{- end }}
 		log.Fatal(err)
 	}
+{{- if .Debug }}
+	debugLog.Printf("gokrazy.Boot done")
+	debugMounts()
+{{- end }}
 	if host, err := os.Hostname(); err == nil {
 		fmt.Printf("hostname %q\n", host)
 	}
 	if model := gokrazy.Model(); model != "" {
 		fmt.Printf("gokrazy device model %s\n", model)
 	}
+{{- range $idx, $v := .Volumes }}
+	setupVolume({{ printf "%q" $v.Dir }}, {{ printf "%#o" (Perm $v.Mode) }}, {{ $v.UID }}, {{ $v.GID }})
+{{- if $.Debug }}
+	debugLog.Printf("volume %s: set up for %s", {{ printf "%q" $v.Dir }}, {{ printf "%q" $v.Service }})
+{{- end }}
+{{- end }}
 
 	var services []*gokrazy.Service
 {{- range $idx, $path := .Binaries }}
@@ -52,6 +204,9 @@ func main() {
 		cmd.Env = append(os.Environ(),
 {{- range $idx, $env := EnvFor $.Env $path }}
 			{{ printf "%q" $env }},
+{{- end }}
+{{- with StateDirectory $.StateDirectories $path }}
+			{{ printf "%q" (print "STATE_DIRECTORY=" .) }},
 {{- end }}
 		)
 {{ if DontStart $.DontStart $path }}
@@ -62,8 +217,21 @@ func main() {
 		svc := gokrazy.NewService(cmd)
 {{ end }}
 		services = append(services, svc)
+{{- if $.Debug }}
+		debugLog.Printf("service %s: %q{{ if DontStart $.DontStart $path }} (not started){{ else if WaitForClock $.WaitForClock $path }} (waiting for clock){{ end }}", cmd.Path, cmd.Args[1:])
+{{- end }}
 	}
 {{- end }}
+{{- end }}
+{{- if .Debug }}
+	debugLog.Printf("supervising %d services", len(services))
+	go debugSupervision([]string{
+{{- range $idx, $path := .Binaries }}
+{{- if ne $path "/gokrazy/init" }}
+		{{ printf "%q" $path }},
+{{- end }}
+{{- end }}
+	})
 {{- end }}
 	if err := gokrazy.SuperviseServices(services); err != nil {
 		log.Fatal(err)
@@ -96,6 +264,14 @@ var initTmpl = template.Must(template.New("").Funcs(template.FuncMap{
 	"WaitForClock": func(waitForClock map[string]bool, path string) bool {
 		return waitForClock[filepath.Base(path)]
 	},
+
+	"StateDirectory": func(stateDirectories map[string]string, path string) string {
+		return stateDirectories[filepath.Base(path)]
+	},
+
+	"Perm": func(mode os.FileMode) uint32 {
+		return uint32(mode.Perm())
+	},
 }).Parse(initTmplContents))
 
 func flattenFiles(prefix string, root *FileInfo) []string {
@@ -117,6 +293,17 @@ type gokrazyInit struct {
 	dontStart        map[string]bool
 	waitForClock     map[string]bool
 	buildTimestamp   string
+
+	// volumes are the persistent directories which init sets up before
+	// starting the services.
+	volumes []Volume
+
+	// debug makes init log mount steps, services and their processes to
+	// the console and the kernel ring buffer.
+	debug bool
+
+	// keepTemp keeps the generated init source (see Pack.KeepTemp).
+	keepTemp bool
 }
 
 func mapKeyBasename[M ~map[string]V, V any](m M) M {
@@ -130,6 +317,11 @@ func mapKeyBasename[M ~map[string]V, V any](m M) M {
 func (g *gokrazyInit) generate() ([]byte, error) {
 	var buf bytes.Buffer
 
+	stateDirectories := make(map[string]string)
+	for _, v := range g.volumes {
+		stateDirectories[v.programName()] = v.Dir
+	}
+
 	if err := initTmpl.Execute(&buf, struct {
 		Binaries       []string
 		BuildTimestamp string
@@ -137,6 +329,10 @@ func (g *gokrazyInit) generate() ([]byte, error) {
 		Env            map[string][]string
 		DontStart      map[string]bool
 		WaitForClock   map[string]bool
+		Debug          bool
+
+		Volumes          []Volume
+		StateDirectories map[string]string
 	}{
 		Binaries:       flattenFiles("/", g.root),
 		BuildTimestamp: g.buildTimestamp,
@@ -144,6 +340,10 @@ func (g *gokrazyInit) generate() ([]byte, error) {
 		Env:            mapKeyBasename(g.envFileContents),
 		DontStart:      mapKeyBasename(g.dontStart),
 		WaitForClock:   mapKeyBasename(g.waitForClock),
+		Debug:          g.debug,
+
+		Volumes:          g.volumes,
+		StateDirectories: stateDirectories,
 	}); err != nil {
 		return nil, err
 	}
@@ -151,6 +351,8 @@ func (g *gokrazyInit) generate() ([]byte, error) {
 	return format.Source(buf.Bytes())
 }
 
+// dump writes the generated init to path, and an unmodified copy next to it
+// (see checkInitDrift).
 func (g *gokrazyInit) dump(path string) error {
 	f, err := os.Create(path)
 	if err != nil {
@@ -167,6 +369,10 @@ func (g *gokrazyInit) dump(path string) error {
 		return err
 	}
 
+	if err := os.WriteFile(path+initGeneratedSuffix, b, 0644); err != nil {
+		return err
+	}
+
 	return f.Close()
 }
 
@@ -191,18 +397,18 @@ func (g *gokrazyInit) build() (tmpdir string, err error) {
 	if err := ioutil.WriteFile(initGo, b, 0644); err != nil {
 		return "", err
 	}
-	defer os.Remove(initGo)
+	if !g.keepTemp {
+		defer os.Remove(initGo)
+	}
 
 	tags := packer.DefaultTags()
-	cmd := exec.Command("go",
-		"build",
-		"-mod=mod",
+	cmd, err := packer.GoCommand(buildDir, "build",
 		"-o", filepath.Join(tmpdir, "init"),
 		"-tags="+strings.Join(tags, ","),
 		initGo)
-	cmd.Dir = buildDir
-	cmd.Env = packer.Env()
-	cmd.Stderr = os.Stderr
+	if err != nil {
+		return "", err
+	}
 	if err := cmd.Run(); err != nil {
 		return "", fmt.Errorf("%v: %v", cmd.Args, err)
 	}
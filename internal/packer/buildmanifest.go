@@ -0,0 +1,250 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// BuildManifest describes everything an image contains, so that provisioning
+// systems can track exactly what each device runs. It is written to
+// Pack.BuildManifest as JSON after packing.
+type BuildManifest struct {
+	Hostname       string `json:"hostname"`
+	Version        string `json:"version,omitempty"`
+	BuildTimestamp string `json:"build_timestamp"`
+	GoVersion      string `json:"go_version,omitempty"`
+
+	// Kernel, Firmware and EEPROM are the packages from which the kernel,
+	// the firmware and the EEPROM update files were copied.
+	Kernel   ManifestModule  `json:"kernel"`
+	Firmware *ManifestModule `json:"firmware,omitempty"`
+	EEPROM   *ManifestModule `json:"eeprom,omitempty"`
+
+	// Modules are the Go modules compiled into the programs of the root file
+	// system, sorted by path.
+	Modules []ManifestModule `json:"modules"`
+
+	Layout ManifestLayout `json:"layout"`
+
+	// Images maps the written images (e.g. boot.img) to their SHA256 hash.
+	Images map[string]string `json:"images,omitempty"`
+
+	// Boot and Root are the files of the boot and root file systems, sorted
+	// by path. Directories are not listed.
+	Boot []ManifestFile `json:"boot"`
+	Root []ManifestFile `json:"root"`
+}
+
+// ManifestModule is a Go module (or, for the kernel and firmware, a package
+// and the version of its module).
+type ManifestModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+
+	// Sum is the go.sum hash of the module contents, if known.
+	Sum string `json:"sum,omitempty"`
+
+	// Replace is the module which replaced this one (path and version, or
+	// a directory), if any.
+	Replace string `json:"replace,omitempty"`
+}
+
+// ManifestLayout are the offsets and sizes (in bytes) of the partitions in
+// the full image.
+type ManifestLayout struct {
+	BootOffset int64 `json:"boot_offset"`
+	BootSize   int64 `json:"boot_size"`
+	RootOffset int64 `json:"root_offset"`
+	RootSize   int64 `json:"root_size"`
+	PermOffset int64 `json:"perm_offset"`
+}
+
+// ManifestFile is a file of the boot or root file system.
+type ManifestFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Mode string `json:"mode,omitempty"`
+
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Target is the destination of symbolic links.
+	Target string `json:"target,omitempty"`
+
+	// Package and Module are the main package and its module of Go
+	// programs.
+	Package string          `json:"package,omitempty"`
+	Module  *ManifestModule `json:"module,omitempty"`
+}
+
+func manifestModule(mod *debug.Module) ManifestModule {
+	mm := ManifestModule{
+		Path:    mod.Path,
+		Version: mod.Version,
+		Sum:     mod.Sum,
+	}
+	if r := mod.Replace; r != nil {
+		mm.Replace = strings.TrimSpace(r.Path + " " + r.Version)
+		if mm.Sum == "" {
+			mm.Sum = r.Sum
+		}
+	}
+	return mm
+}
+
+// rootManifestFiles returns the files of the root file system root.
+func rootManifestFiles(root *FileInfo) ([]ManifestFile, error) {
+	var files []ManifestFile
+	var walk func(dir string, fi *FileInfo) error
+	walk = func(dir string, fi *FileInfo) error {
+		name := path.Join(dir, fi.Filename)
+		switch {
+		case fi.FromHost != "":
+			st, err := os.Stat(fi.FromHost)
+			if err != nil {
+				return err
+			}
+			sum, err := sha256File(fi.FromHost)
+			if err != nil {
+				return err
+			}
+			mf := ManifestFile{
+				Path:   name,
+				Size:   st.Size(),
+				Mode:   st.Mode().Perm().String(),
+				SHA256: sum,
+			}
+			if info, err := buildinfo.ReadFile(fi.FromHost); err == nil {
+				mf.Package = info.Path
+				mm := manifestModule(&info.Main)
+				mf.Module = &mm
+			}
+			files = append(files, mf)
+
+		case fi.FromLiteral != "":
+			mode := fi.Mode
+			if mode == 0 {
+				mode = 0444
+			}
+			files = append(files, ManifestFile{
+				Path:   name,
+				Size:   int64(len(fi.FromLiteral)),
+				Mode:   mode.String(),
+				SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(fi.FromLiteral))),
+			})
+
+		case fi.SymlinkDest != "":
+			files = append(files, ManifestFile{
+				Path:   name,
+				Target: fi.SymlinkDest,
+			})
+		}
+		for _, ent := range fi.Dirents {
+			if err := walk(name, ent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk("/", root); err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// packageModule returns the module of the package pkg, e.g. of the kernel
+// package.
+func packageModule(pkg string) (ManifestModule, error) {
+	buildDir, err := packer.BuildDirOrMigrate(pkg)
+	if err != nil {
+		return ManifestModule{}, err
+	}
+	cmd, err := packer.GoCommand(buildDir, "list", "-tags", "gokrazy", "-f", "{{with .Module}}{{.Version}}{{end}}", pkg)
+	if err != nil {
+		return ManifestModule{}, err
+	}
+	b, err := cmd.Output()
+	if err != nil {
+		return ManifestModule{}, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return ManifestModule{
+		Path:    pkg,
+		Version: strings.TrimSpace(string(b)),
+	}, nil
+}
+
+// buildManifest returns the BuildManifest of the image with the root file
+// system root. The boot files and the image hashes are only known once the
+// images are written, see writeBuildManifest.
+func (pack *Pack) buildManifest(root *FileInfo, modules []*debug.Module, goVersion, buildTimestamp string) (*BuildManifest, error) {
+	cfg := pack.Cfg
+	m := &BuildManifest{
+		Hostname:       cfg.Hostname,
+		Version:        pack.Version,
+		BuildTimestamp: buildTimestamp,
+		GoVersion:      goVersion,
+		Layout: ManifestLayout{
+			BootOffset: pack.BootOffset(),
+			BootSize:   pack.BootSize(),
+			RootOffset: pack.RootOffset(),
+			RootSize:   pack.RootSize(),
+			PermOffset: pack.PermOffset(),
+		},
+	}
+	var err error
+	if m.Kernel, err = packageModule(cfg.KernelPackageOrDefault()); err != nil {
+		return nil, err
+	}
+	if fw := cfg.FirmwarePackageOrDefault(); fw != "" {
+		mm, err := packageModule(fw)
+		if err != nil {
+			return nil, err
+		}
+		m.Firmware = &mm
+	}
+	if e := cfg.EEPROMPackageOrDefault(); e != "" {
+		mm, err := packageModule(e)
+		if err != nil {
+			return nil, err
+		}
+		m.EEPROM = &mm
+	}
+	for _, mod := range modules {
+		m.Modules = append(m.Modules, manifestModule(mod))
+	}
+	sort.Slice(m.Modules, func(i, j int) bool {
+		if m.Modules[i].Path != m.Modules[j].Path {
+			return m.Modules[i].Path < m.Modules[j].Path
+		}
+		return m.Modules[i].Version < m.Modules[j].Version
+	})
+	if m.Root, err = rootManifestFiles(root); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeBuildManifest completes the BuildManifest m (see buildManifest) with the
+// boot files and the hashes of the written images and writes it to
+// pack.BuildManifest.
+func (pack *Pack) writeBuildManifest(m *BuildManifest, subjects []provenanceSubject) error {
+	m.Boot = pack.bootFiles
+	var err error
+	if m.Images, err = subjectDigests(subjects); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pack.BuildManifest, append(b, '\n'), 0644)
+}
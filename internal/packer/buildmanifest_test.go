@@ -0,0 +1,83 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/fat"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRootManifestFiles(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(bin, []byte("not a Go binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := &FileInfo{
+		Dirents: []*FileInfo{
+			{Filename: "user", Dirents: []*FileInfo{
+				{Filename: "hello", FromHost: bin},
+			}},
+			{Filename: "etc", Dirents: []*FileInfo{
+				{Filename: "hostname", FromLiteral: "gokrazy"},
+				{Filename: "localtime", SymlinkDest: "/tmp/localtime"},
+			}},
+		},
+	}
+	got, err := rootManifestFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ManifestFile{
+		{
+			Path:   "/etc/hostname",
+			Size:   7,
+			Mode:   "-r--r--r--",
+			SHA256: "42351a36a1bad671634694a596a4274ff062f5aa408d75ca85c6638b2a3be2d0",
+		},
+		{
+			Path:   "/etc/localtime",
+			Target: "/tmp/localtime",
+		},
+		{
+			Path:   "/user/hello",
+			Size:   15,
+			Mode:   "-rwxr-xr-x",
+			SHA256: "07c75d0c08d0670882de2ffbce4f6aa4263a657fb80410152ca7bb38db95e2ae",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("rootManifestFiles: unexpected result (-want +got):\n%s", diff)
+	}
+}
+
+func TestBootFSFiles(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fatw, err := fat.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := newBootFS(fatw)
+	for _, path := range []string{"/config.txt", "/cmdline.txt"} {
+		w, err := fw.File(path, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("gokrazy")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []ManifestFile{
+		{Path: "/cmdline.txt", Size: 7, SHA256: "42351a36a1bad671634694a596a4274ff062f5aa408d75ca85c6638b2a3be2d0"},
+		{Path: "/config.txt", Size: 7, SHA256: "42351a36a1bad671634694a596a4274ff062f5aa408d75ca85c6638b2a3be2d0"},
+	}
+	if diff := cmp.Diff(want, fw.files()); diff != "" {
+		t.Errorf("bootFS.files: unexpected result (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,54 @@
+package packer
+
+import (
+	"os"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/packer"
+)
+
+// imagePackages returns the packages which are built for the image for cfg,
+// and the packages which are only downloaded (kernel, firmware and EEPROM).
+func imagePackages(cfg *config.Struct) (pkgs, noBuildPkgs []string) {
+	pkgs = append([]string{}, cfg.GokrazyPackagesOrDefault()...)
+	pkgs = append(pkgs, cfg.Packages...)
+	pkgs = append(pkgs, packer.InitDeps(cfg.InternalCompatibilityFlags.InitPkg)...)
+	noBuildPkgs = []string{
+		cfg.KernelPackageOrDefault(),
+	}
+	if fw := cfg.FirmwarePackageOrDefault(); fw != "" {
+		noBuildPkgs = append(noBuildPkgs, fw)
+	}
+	if e := cfg.EEPROMPackageOrDefault(); e != "" {
+		noBuildPkgs = append(noBuildPkgs, e)
+	}
+	return pkgs, noBuildPkgs
+}
+
+// BuildPackages builds the Go packages of the image for cfg (with their build
+// flags and tags) like an update does, but discards the binaries instead of
+// packing them, e.g. to verify that updated packages still compile. It must be
+// called from within the instance directory.
+func BuildPackages(cfg *config.Struct) error {
+	bindir, err := os.MkdirTemp("", "gokrazy-bins-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bindir)
+
+	packageBuildFlags, err := findBuildFlagsFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	packageBuildTags, err := findBuildTagsFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	pkgs, noBuildPkgs := imagePackages(cfg)
+	buildEnv := &packer.BuildEnv{
+		BuildDir: packer.BuildDirOrMigrate,
+	}
+	return buildEnv.Build(bindir, pkgs, packageBuildFlags, packageBuildTags, noBuildPkgs)
+}
@@ -9,10 +9,17 @@ import (
 )
 
 func systemCertsPEM() (string, error) {
-	var source string
-	defer func() {
-		fmt.Printf("Loading system CA certificates from %s\n", source)
-	}()
+	source, pem, err := SystemCerts()
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Loading system CA certificates from %s\n", source)
+	return pem, nil
+}
+
+// SystemCerts returns the PEM-encoded CA certificates which are included in
+// gokrazy images, and where they were loaded from.
+func SystemCerts() (source, pem string, _ error) {
 	// On Linux, we can copy the operating system’s certificate store.
 	// certFiles is defined in cacerts_linux.go (or defined as empty in
 	// cacertsstub.go on non-Linux):
@@ -21,22 +28,19 @@ func systemCertsPEM() (string, error) {
 		if err != nil {
 			continue
 		}
-		source = fn
-		return string(b), nil
+		return fn, string(b), nil
 	}
 
 	// Perhaps the user arranged for a fallback certificate store:
 	home, err := homedir()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	fallback := filepath.Join(home, ".config", "gokrazy", "cacert.pem")
 	if b, err := os.ReadFile(fallback); err == nil {
-		source = fallback
-		return string(b), nil
+		return fallback, string(b), nil
 	}
 
 	// Fall back to github.com/breml/rootcerts, i.e. the bundled Mozilla CA list:
-	source = "bundled Mozilla CA list"
-	return embedded.MozillaCACertificatesPEM(), nil
+	return "bundled Mozilla CA list", embedded.MozillaCACertificatesPEM(), nil
 }
@@ -0,0 +1,119 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkSigning verifies that the SHA256SUMS file can be signed as requested.
+func (pack *Pack) checkSigning() error {
+	if pack.SignGPGKey == "" && pack.SignMinisignKey == "" {
+		return nil
+	}
+	if pack.SHA256Sums == "" {
+		return fmt.Errorf("signing requires --sha256sums, as the SHA256SUMS file is what gets signed")
+	}
+	if pack.SignGPGKey != "" && pack.SignMinisignKey != "" {
+		return fmt.Errorf("--sign_gpg_key and --sign_minisign_key are mutually exclusive")
+	}
+	command := "gpg"
+	if pack.SignMinisignKey != "" {
+		command = "minisign"
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("signing: %v (install %s)", err, command)
+	}
+	return nil
+}
+
+// sha256SumsName returns the name under which the subject is listed in the
+// SHA256SUMS file in dir: the path relative to dir for files in (or below)
+// dir, so that sha256sum --check verifies them, otherwise the subject name.
+func sha256SumsName(dir string, subj provenanceSubject) string {
+	if subj.path == "" { // streamed
+		return subj.name
+	}
+	rel, err := filepath.Rel(dir, subj.path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return subj.name
+	}
+	return filepath.ToSlash(rel)
+}
+
+// writeSHA256Sums writes the SHA256 hashes of the written subjects to
+// pack.SHA256Sums, in the format of sha256sum (sorted by name, for
+// reproducible output). Subjects which are not regular files (e.g. block
+// devices) are skipped.
+func (pack *Pack) writeSHA256Sums(subjects []provenanceSubject) error {
+	dir := filepath.Dir(pack.SHA256Sums)
+	sums := make(map[string]string)
+	for _, subj := range subjects {
+		if subj.path == "" || subj.sha256 != "" {
+			sums[sha256SumsName(dir, subj)] = subj.sha256
+			continue
+		}
+		st, err := os.Stat(subj.path)
+		if err != nil {
+			return err
+		}
+		if !st.Mode().IsRegular() {
+			continue
+		}
+		sum, err := sha256File(subj.path)
+		if err != nil {
+			return err
+		}
+		sums[sha256SumsName(dir, subj)] = sum
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+	return os.WriteFile(pack.SHA256Sums, []byte(b.String()), 0644)
+}
+
+// signSHA256Sums creates a detached signature of the SHA256SUMS file with
+// gpg (ASCII-armored, SHA256SUMS.asc) or minisign (SHA256SUMS.minisig) and
+// returns its path.
+func (pack *Pack) signSHA256Sums() (string, error) {
+	var cmd *exec.Cmd
+	var sig string
+	switch {
+	case pack.SignGPGKey != "":
+		sig = pack.SHA256Sums + ".asc"
+		cmd = exec.Command("gpg",
+			"--batch",
+			"--yes",
+			"--local-user", pack.SignGPGKey,
+			"--armor",
+			"--output", sig,
+			"--detach-sign", pack.SHA256Sums)
+	case pack.SignMinisignKey != "":
+		sig = pack.SHA256Sums + ".minisig"
+		// minisign prompts for the password of the secret key (if any) on
+		// the terminal.
+		cmd = exec.Command("minisign",
+			"-S",
+			"-s", pack.SignMinisignKey,
+			"-m", pack.SHA256Sums,
+			"-x", sig)
+		cmd.Stdin = os.Stdin
+	default:
+		return "", nil
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return sig, nil
+}
@@ -0,0 +1,80 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteSHA256Sums(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	if err := os.MkdirAll(filepath.Join(out, "vm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(out, "gokrazy.img"):    "full",
+		filepath.Join(out, "vm", "disk.raw"): "disk",
+		filepath.Join(dir, "boot.tmp"):       "boot",
+	}
+	for fn, contents := range files {
+		if err := os.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	p := &Pack{SHA256Sums: filepath.Join(out, "SHA256SUMS")}
+	if err := p.writeSHA256Sums([]provenanceSubject{
+		{name: "gokrazy.img", path: filepath.Join(out, "gokrazy.img")},
+		{name: "disk.raw", path: filepath.Join(out, "vm", "disk.raw"), sha256: sum("disk")},
+		{name: "boot.img", path: filepath.Join(dir, "boot.tmp")},
+		{name: "fd:3", sha256: sum("streamed")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(p.SHA256Sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		sum("boot") + "  boot.img",
+		sum("streamed") + "  fd:3",
+		sum("full") + "  gokrazy.img",
+		sum("disk") + "  vm/disk.raw",
+	}, "\n") + "\n"
+	if got := string(b); got != want {
+		t.Errorf("SHA256SUMS:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCheckSigning(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		pack Pack
+		want string
+	}{
+		{
+			desc: "no sha256sums",
+			pack: Pack{SignGPGKey: "0xDEADBEEF"},
+			want: "requires --sha256sums",
+		},
+		{
+			desc: "both keys",
+			pack: Pack{SHA256Sums: "SHA256SUMS", SignGPGKey: "0xDEADBEEF", SignMinisignKey: "minisign.key"},
+			want: "mutually exclusive",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.pack.checkSigning()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkSigning() = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+	if err := (&Pack{SHA256Sums: "SHA256SUMS"}).checkSigning(); err != nil {
+		t.Errorf("checkSigning() without keys = %v, want nil", err)
+	}
+}
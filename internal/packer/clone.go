@@ -0,0 +1,390 @@
+package packer
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/humanize"
+)
+
+// Clone copies the gokrazy installation on dev (e.g. an SD card in a card
+// reader) to the image file image, and recovers as much of its instance
+// config as possible from the image (see RecoverConfig), for re-creating an
+// instance whose original build inputs were lost. The image can be written to
+// another card with gok overwrite's --full target or dd(1).
+func Clone(dev, image, sudo string, stdout io.Writer) (*config.Struct, error) {
+	if err := verifyNotMounted(dev); err != nil {
+		return nil, fmt.Errorf("%v: unmount it first, so that the clone is consistent", err)
+	}
+	src, err := openDevice(dev, sudo)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(image), "."+filepath.Base(image))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fmt.Fprintf(stdout, "Copying %s to %s\n", dev, image)
+	n, err := io.Copy(f, src)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", dev, err)
+	}
+	if err := src.Close(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", dev, err)
+	}
+	fmt.Fprintf(stdout, "  %s\n", humanize.Bytes(uint64(n)))
+
+	cfg, err := RecoverConfig(f, stdout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v (is it a gokrazy installation?)", dev, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), image); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// openDevice opens dev for reading, via sudo cat(1) if the user lacks read
+// permission and sudo is not never.
+func openDevice(dev, sudo string) (io.ReadCloser, error) {
+	f, err := os.Open(dev)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsPermission(err) || sudo == "never" {
+		return nil, err
+	}
+	cmd := exec.Command("sudo", "cat", dev)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return &cmdReader{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// cmdReader reads the stdout of cmd and waits for cmd to exit when closed.
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	waited bool
+}
+
+func (c *cmdReader) Close() error {
+	if c.waited {
+		return nil
+	}
+	c.waited = true
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %v", c.cmd.Args, err)
+	}
+	return nil
+}
+
+// partitionExtent is the location of a partition in bytes.
+type partitionExtent struct {
+	offset, size int64
+}
+
+// readPartitions returns the partitions of the disk image r (index 0 is
+// partition 1). Unused partition table slots have a zero size.
+func readPartitions(r io.ReaderAt) ([]partitionExtent, error) {
+	mbr := make([]byte, 512)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return nil, fmt.Errorf("no partition table found")
+	}
+	le := binary.LittleEndian
+	var parts []partitionExtent
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+16*i:]
+		if entry[4] == 0xEE { // protective GPT partition, see writePartitionTable
+			return readGPTPartitions(r)
+		}
+		parts = append(parts, partitionExtent{
+			offset: int64(le.Uint32(entry[8:])) * 512,
+			size:   int64(le.Uint32(entry[12:])) * 512,
+		})
+	}
+	return parts, nil
+}
+
+func readGPTPartitions(r io.ReaderAt) ([]partitionExtent, error) {
+	header := make([]byte, 92)
+	if _, err := r.ReadAt(header, 512); err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != "EFI PART" {
+		return nil, fmt.Errorf("invalid GPT header signature %q", header[:8])
+	}
+	le := binary.LittleEndian
+	entriesLBA := int64(le.Uint64(header[72:]))
+	numEntries := int(le.Uint32(header[80:]))
+	entrySize := int(le.Uint32(header[84:]))
+	if entrySize < 48 || numEntries > 1024 {
+		return nil, fmt.Errorf("unsupported GPT: %d entries of %d bytes", numEntries, entrySize)
+	}
+	entries := make([]byte, numEntries*entrySize)
+	if _, err := r.ReadAt(entries, entriesLBA*512); err != nil {
+		return nil, err
+	}
+	var parts []partitionExtent
+	for i := 0; i < numEntries; i++ {
+		entry := entries[i*entrySize:]
+		if bytes.Equal(entry[:16], make([]byte, 16)) { // unused
+			parts = append(parts, partitionExtent{})
+			continue
+		}
+		first, last := int64(le.Uint64(entry[32:])), int64(le.Uint64(entry[40:]))
+		parts = append(parts, partitionExtent{
+			offset: first * 512,
+			size:   (last - first + 1) * 512,
+		})
+	}
+	for len(parts) > 0 && parts[len(parts)-1].size == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	return parts, nil
+}
+
+// activeRootPartition returns the number of the root partition which the
+// kernel command line cmdline boots from (2 or 3).
+func activeRootPartition(cmdline string) (int, error) {
+	for _, f := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(f, "root=") {
+			continue
+		}
+		root := strings.TrimPrefix(f, "root=")
+		// GPT: PARTUUID=<boot partition>/PARTNROFF=<n>
+		if idx := strings.Index(root, "/PARTNROFF="); idx > -1 {
+			off, err := strconv.Atoi(root[idx+len("/PARTNROFF="):])
+			if err != nil {
+				return 0, fmt.Errorf("invalid %s", f)
+			}
+			return 1 + off, nil
+		}
+		// MBR: PARTUUID=<disk>-02, or a device name like /dev/mmcblk0p2
+		digits := len(root)
+		for digits > 0 && root[digits-1] >= '0' && root[digits-1] <= '9' {
+			digits--
+		}
+		if n, err := strconv.Atoi(root[digits:]); err == nil {
+			return n, nil
+		}
+		return 0, fmt.Errorf("cannot determine the root partition from %s", f)
+	}
+	return 0, fmt.Errorf("no root= in the kernel command line")
+}
+
+// generatedPrograms are the programs which the packer generates for packer
+// flags, which RecoverConfig reports.
+var generatedPrograms = map[string]string{
+	"remote-exec":     "--remote_exec",
+	"integrity-check": "--integrity_check",
+	"unpack-exec":     "--compress_binaries",
+	"crash-logs":      "--crash_log_size",
+}
+
+// RecoverConfig reconstructs the instance config of the gokrazy installation
+// in the disk image img: the hostname, the update settings (ports, password
+// and certificate), the serial console and the packages (from the Go build
+// information of the binaries in /user and /gokrazy). It prints what it
+// recovered to stdout, including the module versions of the packages, and
+// what cannot be recovered, e.g. the kernel package and the package config
+// (command-line flags, environment variables, extra files). Images packed by
+// newer versions of the packer contain their instance config, which
+// RecoverConfig returns exactly instead.
+func RecoverConfig(img io.ReaderAt, stdout io.Writer) (*config.Struct, error) {
+	parts, err := readPartitions(img)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) < 3 || parts[0].size == 0 {
+		return nil, fmt.Errorf("unexpected partition table: want at least boot and root partitions, got %d partitions", len(parts))
+	}
+
+	boot := io.NewSectionReader(img, parts[0].offset, parts[0].size)
+	cmdline, err := readBootFile(boot, "/cmdline.txt")
+	if err != nil {
+		return nil, fmt.Errorf("boot partition: %v", err)
+	}
+	rootPart, err := activeRootPartition(cmdline)
+	if err != nil {
+		return nil, err
+	}
+	if rootPart < 1 || rootPart > len(parts) || parts[rootPart-1].size == 0 {
+		return nil, fmt.Errorf("root partition %d not found", rootPart)
+	}
+	fmt.Fprintf(stdout, "Reading root file system of partition %d\n", rootPart)
+	root, err := newSquashfsReader(io.NewSectionReader(img, parts[rootPart-1].offset, parts[rootPart-1].size))
+	if err != nil {
+		return nil, fmt.Errorf("root partition %d: %v", rootPart, err)
+	}
+	cfg, err := recoverConfig(boot, cmdline, root, stdout)
+	if err != nil {
+		return nil, fmt.Errorf("root partition %d: %v", rootPart, err)
+	}
+	return cfg, nil
+}
+
+// recoverConfig implements RecoverConfig for the boot file system boot (with
+// the kernel command line cmdline) and the root file system root.
+func recoverConfig(boot io.ReadSeeker, cmdline string, root *squashfsReader, stdout io.Writer) (*config.Struct, error) {
+	if b, err := root.readFile(embeddedConfigPath); err == nil {
+		var cfg config.Struct
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", embeddedConfigPath, err)
+		}
+		fmt.Fprintf(stdout, "Read the instance config embedded in %s\n", embeddedConfigPath)
+		return &cfg, nil
+	}
+
+	etcFile := func(name string) string {
+		b, err := root.readFile("/etc/" + name)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	}
+	hostname := etcFile("hostname")
+	if hostname == "" {
+		return nil, fmt.Errorf("/etc/hostname not found")
+	}
+	cfg := config.NewStruct(hostname)
+	cfg.InternalCompatibilityFlags = nil
+	cfg.Update.HTTPPassword = etcFile("gokr-pw.txt")
+	if port := etcFile("http-port.txt"); port != "" && port != "80" {
+		cfg.Update.HTTPPort = port
+	}
+	if port := etcFile("https-port.txt"); port != "" && port != "443" {
+		cfg.Update.HTTPSPort = port
+	}
+	cfg.Update.CertPEM = etcFile("ssl/gokrazy-web.pem")
+	cfg.Update.KeyPEM = etcFile("ssl/gokrazy-web.key.pem")
+	fmt.Fprintf(stdout, "Recovered hostname %s, update port(s), password", hostname)
+	if cfg.Update.CertPEM != "" {
+		fmt.Fprintf(stdout, " and TLS certificate")
+	}
+	fmt.Fprintf(stdout, "\n")
+
+	cfg.SerialConsole = "disabled"
+	for _, f := range strings.Fields(cmdline) {
+		if c := strings.TrimPrefix(f, "console="); c != f && c != "tty1" {
+			cfg.SerialConsole = c
+		}
+	}
+	if cfg.SerialConsole == "serial0,115200" {
+		cfg.SerialConsole = "" // default
+	} else if cfg.SerialConsole == "disabled" {
+		if config, err := readBootFile(boot, "/config.txt"); err == nil && strings.Contains(config, "enable_uart=0") {
+			cfg.SerialConsole = "off"
+		}
+	}
+
+	var modules []string
+	seen := make(map[string]bool)
+	recoverPackages := func(dir string) ([]string, error) {
+		entries, err := root.readDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var pkgs []string
+		for _, e := range entries {
+			if e.typ != squashfsFileType && e.typ != squashfsLregType {
+				continue
+			}
+			path := dir + "/" + e.name
+			if flag, ok := generatedPrograms[e.name]; ok {
+				fmt.Fprintf(stdout, "  %s: packed with %s\n", path, flag)
+				continue
+			}
+			b, err := root.readFile(path)
+			if err != nil {
+				return nil, err
+			}
+			bi, err := buildinfo.Read(bytes.NewReader(b))
+			if err != nil {
+				fmt.Fprintf(stdout, "  %s: no Go build information (%v), skipping\n", path, err)
+				continue
+			}
+			// Programs which the packer generates (e.g. init) are built
+			// from temporary directories and have no importable path.
+			if first, _, _ := strings.Cut(bi.Path, "/"); !strings.Contains(first, ".") {
+				continue
+			}
+			pkgs = append(pkgs, bi.Path)
+			if m := bi.Main; m.Path != "" && !seen[m.Path] {
+				seen[m.Path] = true
+				modules = append(modules, m.Path+"@"+m.Version)
+			}
+		}
+		sort.Strings(pkgs)
+		return pkgs, nil
+	}
+	gokrazyPkgs, err := recoverPackages("/gokrazy")
+	if err != nil {
+		return nil, err
+	}
+	defaultPkgs := config.NewStruct("").GokrazyPackagesOrDefault()
+	sort.Strings(defaultPkgs)
+	if strings.Join(gokrazyPkgs, " ") != strings.Join(defaultPkgs, " ") {
+		cfg.GokrazyPackages = &gokrazyPkgs
+	}
+	cfg.Packages, err = recoverPackages("/user")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(stdout, "Recovered %d packages, built from these module versions:\n", len(cfg.Packages)+len(gokrazyPkgs))
+	sort.Strings(modules)
+	for _, m := range modules {
+		fmt.Fprintf(stdout, "  %s\n", m)
+	}
+
+	fmt.Fprintf(stdout, "Not recoverable, please check and add to the config manually:\n")
+	fmt.Fprintf(stdout, "  - the kernel and firmware packages (default: %s, %s)\n", cfg.KernelPackageOrDefault(), cfg.FirmwarePackageOrDefault())
+	fmt.Fprintf(stdout, "  - the PackageConfig (command-line flags, environment variables, extra files), which is compiled into init\n")
+	fmt.Fprintf(stdout, "  - packer flags other than the ones listed above, e.g. --model\n")
+	return cfg, nil
+}
+
+// readBootFile returns the contents of path on the boot file system r.
+func readBootFile(r io.ReadSeeker, path string) (string, error) {
+	ra := seekReaderAt{r}
+	rd, err := newFATReader(ra)
+	if err != nil {
+		return "", err
+	}
+	offset, length, err := rd.extents(path)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, length)
+	if _, err := ra.ReadAt(b, offset); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
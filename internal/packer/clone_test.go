@@ -0,0 +1,288 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/fat"
+	"github.com/gokrazy/internal/squashfs"
+)
+
+// writeTestRootFS writes a SquashFS image with the specified files (and an
+// /etc/resolv.conf symlink) to a temporary file.
+func writeTestRootFS(t *testing.T, files map[string][]byte) *os.File {
+	f, err := os.CreateTemp(t.TempDir(), "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := squashfs.NewWriter(f, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTestDir(w.Root, "", files); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// writeTestDir writes the entries of the directory dir (sorted by name, as
+// SquashFS requires) to d.
+func writeTestDir(d *squashfs.Directory, dir string, files map[string][]byte) error {
+	subdirs := make(map[string]bool)
+	var names []string
+	for path := range files {
+		if !strings.HasPrefix(path, dir+"/") {
+			continue
+		}
+		name, _, isDir := strings.Cut(strings.TrimPrefix(path, dir+"/"), "/")
+		if isDir {
+			if subdirs[name] {
+				continue
+			}
+			subdirs[name] = true
+		}
+		names = append(names, name)
+	}
+	if dir == "/etc" {
+		names = append(names, "resolv.conf")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := dir + "/" + name
+		switch {
+		case subdirs[name]:
+			if err := writeTestDir(d.Directory(name, time.Now()), path, files); err != nil {
+				return err
+			}
+		case path == "/etc/resolv.conf":
+			if err := d.Symlink("/proc/net/pnp", name, time.Now(), 0444); err != nil {
+				return err
+			}
+		default:
+			fw, err := d.File(name, time.Now(), 0755)
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(files[path]); err != nil {
+				return err
+			}
+			if err := fw.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return d.Flush()
+}
+
+func TestSquashfsReader(t *testing.T) {
+	large := bytes.Repeat([]byte("gokrazy "), 50000) // multiple data blocks
+	many := make(map[string][]byte)
+	for i := 0; i < 300; i++ { // more entries than fit a dirInodeHeader
+		many[fmt.Sprintf("/many/file%03d", i)] = []byte(fmt.Sprint(i))
+	}
+	many["/etc/hostname"] = []byte("scanner")
+	many["/etc/empty"] = nil
+	many["/user/large"] = large
+	f := writeTestRootFS(t, many)
+
+	r, err := newSquashfsReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string][]byte{
+		"/etc/hostname":    []byte("scanner"),
+		"/etc/empty":       {},
+		"/user/large":      large,
+		"/many/file299":    []byte("299"),
+		"many/file042":     []byte("42"),
+		"/many/../file000": nil, // not found
+	} {
+		got, err := r.readFile(path)
+		if want == nil {
+			if err == nil {
+				t.Errorf("readFile(%s) unexpectedly succeeded", path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readFile(%s) = %v", path, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("readFile(%s) = %d bytes, want %d bytes", path, len(got), len(want))
+		}
+	}
+	entries, err := r.readDir("/many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 300; got != want {
+		t.Errorf("readDir(/many) = %d entries, want %d", got, want)
+	}
+	ino, err := r.lookup("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ino.target, "/proc/net/pnp"; got != want {
+		t.Errorf("symlink target = %q, want %q", got, want)
+	}
+}
+
+func TestActiveRootPartition(t *testing.T) {
+	for _, tt := range []struct {
+		cmdline string
+		want    int
+	}{
+		{"console=tty1 root=PARTUUID=60c24cc1-f3f9-427a-8199-2e18f0610001/PARTNROFF=1 init=/gokrazy/init", 2},
+		{"console=tty1 root=PARTUUID=60c24cc1-f3f9-427a-8199-2e18f0610001/PARTNROFF=2 init=/gokrazy/init", 3},
+		{"root=PARTUUID=2e18f061-03 rootwait", 3},
+		{"root=/dev/mmcblk0p2 rootwait", 2},
+		{"root=/dev/sda3", 3},
+	} {
+		got, err := activeRootPartition(tt.cmdline)
+		if err != nil {
+			t.Errorf("activeRootPartition(%q) = %v", tt.cmdline, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("activeRootPartition(%q) = %d, want %d", tt.cmdline, got, tt.want)
+		}
+	}
+	if _, err := activeRootPartition("console=tty1"); err == nil {
+		t.Errorf("activeRootPartition without root= unexpectedly succeeded")
+	}
+}
+
+// testImage returns a disk image with an MBR, a boot partition containing
+// cmdline.txt and the root file system root as partition 3.
+func testImage(t *testing.T, root *os.File, cmdline string) []byte {
+	var boot bytes.Buffer
+	fatw, err := fat.NewWriter(&boot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := fatw.File("/cmdline.txt", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, cmdline)
+	if err := fatw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := root.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MBR, boot partition at 1 MiB, (empty) partition 2, partition 3 after
+	// the boot partition.
+	const bootLBA = 2048
+	bootSectors := uint32((boot.Len() + 511) / 512)
+	rootLBA := bootLBA + bootSectors
+	rootSectors := uint32((st.Size() + 511) / 512)
+	img := make([]byte, int64(rootLBA+rootSectors)*512)
+	for i, p := range [][2]uint32{{bootLBA, bootSectors}, {}, {rootLBA, rootSectors}} {
+		entry := img[446+16*i:]
+		entry[4] = 0x83
+		binary.LittleEndian.PutUint32(entry[8:], p[0])
+		binary.LittleEndian.PutUint32(entry[12:], p[1])
+	}
+	img[510], img[511] = 0x55, 0xAA
+	copy(img[bootLBA*512:], boot.Bytes())
+	if _, err := root.ReadAt(img[rootLBA*512:], 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	return img
+}
+
+func TestRecoverConfig(t *testing.T) {
+	// The test binary has Go build information, like gokrazy packages.
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := writeTestRootFS(t, map[string][]byte{
+		"/etc/hostname":      []byte("scanner"),
+		"/etc/gokr-pw.txt":   []byte("secret"),
+		"/etc/http-port.txt": []byte("8080"),
+		"/gokrazy/init":      []byte("not a Go binary"),
+		"/user/packer.test":  bin,
+		"/user/remote-exec":  []byte("not a Go binary"),
+	})
+
+	img := testImage(t, root, "console=tty1 console=ttyAMA0,115200 root=PARTUUID=2e18f061-03 init=/gokrazy/init")
+
+	var stdout bytes.Buffer
+	cfg, err := RecoverConfig(bytes.NewReader(img), &stdout)
+	if err != nil {
+		t.Fatalf("RecoverConfig: %v\n%s", err, stdout.String())
+	}
+	if got, want := cfg.Hostname, "scanner"; got != want {
+		t.Errorf("Hostname = %q, want %q", got, want)
+	}
+	if got, want := cfg.Update.HTTPPassword, "secret"; got != want {
+		t.Errorf("HTTPPassword = %q, want %q", got, want)
+	}
+	if got, want := cfg.Update.HTTPPort, "8080"; got != want {
+		t.Errorf("HTTPPort = %q, want %q", got, want)
+	}
+	if got, want := cfg.SerialConsole, "ttyAMA0,115200"; got != want {
+		t.Errorf("SerialConsole = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(cfg.Packages, " "), "github.com/gokrazy/tools/internal/packer.test"; got != want {
+		t.Errorf("Packages = %q, want %q", got, want)
+	}
+	if cfg.GokrazyPackages == nil || len(*cfg.GokrazyPackages) != 0 {
+		t.Errorf("GokrazyPackages = %v, want none (no Go binaries in /gokrazy)", cfg.GokrazyPackages)
+	}
+	if !strings.Contains(stdout.String(), "--remote_exec") {
+		t.Errorf("RecoverConfig output does not mention --remote_exec:\n%s", stdout.String())
+	}
+}
+
+func TestRecoverEmbeddedConfig(t *testing.T) {
+	want := config.NewStruct("scanner")
+	want.Packages = []string{"github.com/gokrazy/breakglass"}
+	want.Update.HTTPPassword = "secret"
+	want.PackageConfig = map[string]config.PackageConfig{
+		"github.com/gokrazy/breakglass": {CommandLineFlags: []string{"-authorized_keys=/perm/breakglass.authorized_keys"}},
+	}
+	b, err := want.FormatForFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := writeTestRootFS(t, map[string][]byte{
+		"/etc/hostname":            []byte("scanner"),
+		"/etc/gokrazy/config.json": b,
+	})
+	img := testImage(t, root, "console=tty1 root=PARTUUID=2e18f061-03 init=/gokrazy/init")
+
+	var stdout bytes.Buffer
+	cfg, err := RecoverConfig(bytes.NewReader(img), &stdout)
+	if err != nil {
+		t.Fatalf("RecoverConfig: %v\n%s", err, stdout.String())
+	}
+	got, err := cfg.FormatForFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Errorf("RecoverConfig = %s, want %s", got, b)
+	}
+}
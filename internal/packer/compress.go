@@ -0,0 +1,231 @@
+package packer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// compressedDir is the directory in the root file system containing the
+// gzip-compressed binaries, which are started by the unpack-exec shim.
+const compressedDir = "/gokrazy/compressed"
+
+// unpackExecSource is the source of the unpack-exec shim. Compressed binaries
+// are replaced with a symlink to the shim, which decompresses the binary into
+// an anonymous in-memory file and executes it (keeping argv and the
+// environment), trading start-up time and RAM for storage space.
+const unpackExecSource = `package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const compressedDir = %q
+
+func unpackExec() error {
+	name := os.Args[0]
+	if !filepath.IsAbs(name) {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return err
+		}
+		name = path
+	}
+	f, err := os.Open(filepath.Join(compressedDir, name+".gz"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.MemfdCreate(filepath.Base(name), unix.MFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("memfd_create: %%v", err)
+	}
+	mem := os.NewFile(uintptr(fd), filepath.Base(name))
+	if _, err := io.Copy(mem, rd); err != nil {
+		return err
+	}
+	if err := rd.Close(); err != nil {
+		return err
+	}
+	return unix.Exec("/proc/self/fd/"+strconv.Itoa(fd), os.Args, os.Environ())
+}
+
+func main() {
+	if err := unpackExec(); err != nil {
+		fmt.Fprintf(os.Stderr, "unpack-exec %%s: %%v\n", os.Args[0], err)
+		os.Exit(127)
+	}
+}
+`
+
+// xsysModule returns the golang.org/x/sys module (path@version) which this
+// program was built with, so that the unpack-exec shim uses the same version.
+func xsysModule() (string, error) {
+	const path = "golang.org/x/sys"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", fmt.Errorf("build information not available")
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		return dep.Path + " " + dep.Version, nil
+	}
+	return "", fmt.Errorf("%s not found in build information", path)
+}
+
+// buildUnpackExec builds the unpack-exec shim for the target architecture,
+// reading the compressed binaries from dir. Unlike the standalone programs
+// (see buildStandalone), the shim is built as a module requiring
+// golang.org/x/sys for the memfd_create(2) system call.
+func buildUnpackExec(tmpdir, dir string) (string, error) {
+	xsys, err := xsysModule()
+	if err != nil {
+		return "", err
+	}
+	moddir := filepath.Join(tmpdir, "unpack-exec.mod")
+	if err := os.MkdirAll(moddir, 0755); err != nil {
+		return "", err
+	}
+	gomod := "module unpackexec\n\ngo 1.18\n\nrequire " + xsys + "\n"
+	if err := os.WriteFile(filepath.Join(moddir, "go.mod"), []byte(gomod), 0644); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(moddir, "main.go"), []byte(fmt.Sprintf(unpackExecSource, dir)), 0644); err != nil {
+		return "", err
+	}
+	bin := filepath.Join(tmpdir, "unpack-exec")
+	cmd := exec.Command("go",
+		"build",
+		"-mod=mod",
+		"-ldflags=-s -w",
+		"-o", bin,
+		".")
+	cmd.Dir = moddir
+	cmd.Env = append(packer.Env(), "CGO_ENABLED=0", "GOFLAGS=")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return bin, nil
+}
+
+// buildStandalone builds the single-file, standard library only Go program
+// src for the target architecture and returns the path of the binary.
+func buildStandalone(tmpdir, name, src string) (string, error) {
+	fn := filepath.Join(tmpdir, name+".go")
+	if err := os.WriteFile(fn, []byte(src), 0644); err != nil {
+		return "", err
+	}
+	bin := filepath.Join(tmpdir, name)
+	cmd := exec.Command("go",
+		"build",
+		"-ldflags=-s -w",
+		"-o", bin,
+		fn)
+	cmd.Dir = tmpdir
+	cmd.Env = append(packer.Env(), "CGO_ENABLED=0", "GO111MODULE=off")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return bin, nil
+}
+
+func gzipFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// compressBinaries replaces the binaries in /user with symlinks to the
+// unpack-exec shim and places gzip-compressed copies in compressedDir.
+// Binaries which do not get smaller are left as-is.
+func compressBinaries(root *FileInfo, tmpdir string) error {
+	shim, err := buildUnpackExec(tmpdir, compressedDir)
+	if err != nil {
+		return err
+	}
+	gokrazy := mustFindDirent(root, "gokrazy")
+	gokrazy.Dirents = append(gokrazy.Dirents, &FileInfo{
+		Filename: "unpack-exec",
+		FromHost: shim,
+	})
+	compressed := &FileInfo{Filename: filepath.Base(compressedDir)}
+	user := &FileInfo{Filename: "user"}
+	compressed.Dirents = append(compressed.Dirents, user)
+	gokrazy.Dirents = append(gokrazy.Dirents, compressed)
+
+	var before, after int64
+	for _, ent := range mustFindDirent(root, "user").Dirents {
+		if ent.FromHost == "" {
+			continue
+		}
+		st, err := os.Stat(ent.FromHost)
+		if err != nil {
+			return err
+		}
+		gz := filepath.Join(tmpdir, ent.Filename+".gz")
+		if err := gzipFile(gz, ent.FromHost); err != nil {
+			return err
+		}
+		gzst, err := os.Stat(gz)
+		if err != nil {
+			return err
+		}
+		if gzst.Size() >= st.Size() {
+			continue
+		}
+		before += st.Size()
+		after += gzst.Size()
+		user.Dirents = append(user.Dirents, &FileInfo{
+			Filename: ent.Filename + ".gz",
+			FromHost: gz,
+		})
+		ent.FromHost = ""
+		ent.SymlinkDest = "/gokrazy/unpack-exec"
+	}
+	fmt.Printf("Compressed %d binaries in /user: %d MB → %d MB\n",
+		len(user.Dirents), before/MB, after/MB)
+	return nil
+}
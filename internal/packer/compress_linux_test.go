@@ -0,0 +1,67 @@
+package packer
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+const helloSource = `package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	fmt.Printf("%s %s", strings.Join(os.Args[1:], " "), os.Getenv("GREETING"))
+}
+`
+
+func TestUnpackExec(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	t.Setenv("GOOS", "linux")
+	t.Setenv("GOARCH", runtime.GOARCH)
+	t.Setenv("GOARM", "")
+	tmpdir := t.TempDir()
+	compressed := filepath.Join(tmpdir, "compressed")
+
+	shim, err := buildUnpackExec(tmpdir, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, err := buildStandalone(tmpdir, "hello", helloSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like compressBinaries: /user/hello is a symlink to the shim, which
+	// starts compressedDir/user/hello.gz.
+	user := filepath.Join(tmpdir, "user")
+	for _, dir := range []string{user, filepath.Join(compressed, user)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gzipFile(filepath.Join(compressed, user, "hello.gz"), hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(shim, filepath.Join(user, "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(filepath.Join(user, "hello"), "hello,")
+	cmd.Env = append(os.Environ(), "GREETING=world")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %v\n%s", cmd.Args, err, out)
+	}
+	if got, want := string(out), "hello, world"; got != want {
+		t.Errorf("%v: got output %q, want %q", cmd.Args, got, want)
+	}
+}
@@ -0,0 +1,19 @@
+package packer
+
+import (
+	"io"
+	"os"
+)
+
+// copyImage copies the contents of src from its current offset to the current
+// offset of dst (an image file or a device), and returns the number of bytes
+// copied.
+func copyImage(dst, src *os.File) (int64, error) {
+	return io.Copy(dst, src)
+}
+
+// fdatasync flushes the data of f to the storage device. macOS has no
+// fdatasync, so this syncs the metadata as well.
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
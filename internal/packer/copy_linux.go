@@ -0,0 +1,99 @@
+package packer
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyImage copies the contents of src from its current offset to the current
+// offset of dst (an image file or a device), and returns the number of bytes
+// copied. The kernel copies the data without passing it through user space:
+// with copy_file_range(2) between files (which file systems like btrfs or XFS
+// can even implement by sharing the blocks), otherwise with sendfile(2), which
+// also writes to block devices. If neither is supported, copyImage falls back
+// to io.Copy.
+func copyImage(dst, src *os.File) (int64, error) {
+	roff, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	st, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n, err := kernelCopy(dst, src, roff, st.Size()-roff)
+	if _, seekErr := src.Seek(roff+n, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil || n == st.Size()-roff {
+		return n, err
+	}
+	// The kernel copied nothing (or the file grew, which it should not):
+	// copy the rest in user space.
+	rest, err := io.Copy(dst, src)
+	return n + rest, err
+}
+
+// kernelCopy copies size bytes at offset roff of src to the current offset of
+// dst, first trying copy_file_range(2), then sendfile(2). It returns without
+// error if neither system call is supported for dst and src.
+func kernelCopy(dst, src *os.File, roff, size int64) (int64, error) {
+	const chunk = 1 << 30 // limit each call so that it can be interrupted
+	var n int64
+	useSendfile := false
+	for n < size {
+		count := size - n
+		if count > chunk {
+			count = chunk
+		}
+		var (
+			c   int
+			err error
+		)
+		off := roff + n
+		if !useSendfile {
+			// With a nil output offset, copy_file_range uses and advances
+			// the file offset of dst, like sendfile does.
+			c, err = unix.CopyFileRange(int(src.Fd()), &off, int(dst.Fd()), nil, int(count), 0)
+			if n == 0 && unsupported(err) {
+				useSendfile = true
+				continue
+			}
+		} else {
+			c, err = unix.Sendfile(int(dst.Fd()), int(src.Fd()), &off, int(count))
+			if n == 0 && unsupported(err) {
+				return 0, nil
+			}
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if c == 0 {
+			break // unexpected end of src
+		}
+		n += int64(c)
+	}
+	return n, nil
+}
+
+// unsupported returns whether err indicates that the system call cannot copy
+// between the files, e.g. because they are on different file systems.
+func unsupported(err error) bool {
+	return errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.EPERM) // e.g. copy_file_range in some seccomp sandboxes
+}
+
+// fdatasync flushes the data of f to the storage device, without the
+// metadata which is not needed to read the data back.
+func fdatasync(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,55 @@
+package packer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyImage(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("gokrazy"), 100000)
+	src, err := os.Create(filepath.Join(dir, "root.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	// Like overwriteFile, which copies the root file system to its offset.
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Create(filepath.Join(dir, "full.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	const offset = 4096
+	if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	n, err := copyImage(dst, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int64(len(content)); got != want {
+		t.Errorf("copyImage() = %d, want %d", got, want)
+	}
+	if off, err := dst.Seek(0, io.SeekCurrent); err != nil || off != offset+n {
+		t.Errorf("dst offset after copyImage() = %d, %v, want %d", off, err, offset+n)
+	}
+	if off, err := src.Seek(0, io.SeekCurrent); err != nil || off != n {
+		t.Errorf("src offset after copyImage() = %d, %v, want %d", off, err, n)
+	}
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[offset:], content) || !bytes.Equal(got[:offset], make([]byte, offset)) {
+		t.Errorf("copied image differs from the source")
+	}
+}
@@ -0,0 +1,145 @@
+package packer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cpio file types (in the mode field), see
+// https://www.kernel.org/doc/html/latest/driver-api/early-userspace/buffer-format.html
+const (
+	cpioTypeDir     = 0040000
+	cpioTypeRegular = 0100000
+	cpioTypeSymlink = 0120000
+	cpioTypeChar    = 0020000
+)
+
+// cpioWriter writes an initramfs archive in the “new” (newc) cpio format,
+// which the Linux kernel unpacks into its root file system.
+type cpioWriter struct {
+	w     *bufio.Writer
+	ino   uint32
+	mtime int64
+}
+
+func newCPIOWriter(w io.Writer, mtime time.Time) *cpioWriter {
+	return &cpioWriter{w: bufio.NewWriter(w), mtime: mtime.Unix()}
+}
+
+type cpioEntry struct {
+	name   string
+	mode   uint32 // type and permission bits
+	size   int64
+	rdev   [2]uint32 // major, minor of device nodes
+	nlinks uint32
+}
+
+func (c *cpioWriter) pad(n int64) error {
+	if r := n % 4; r != 0 {
+		_, err := c.w.Write(make([]byte, 4-r))
+		return err
+	}
+	return nil
+}
+
+func (c *cpioWriter) header(e cpioEntry) error {
+	c.ino++
+	nlinks := e.nlinks
+	if nlinks == 0 {
+		nlinks = 1
+	}
+	// magic, ino, mode, uid, gid, nlink, mtime, filesize, devmajor, devminor,
+	// rdevmajor, rdevminor, namesize, check
+	if _, err := fmt.Fprintf(c.w, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		c.ino, e.mode, 0, 0, nlinks, c.mtime, e.size, 0, 0, e.rdev[0], e.rdev[1], len(e.name)+1, 0); err != nil {
+		return err
+	}
+	if _, err := c.w.WriteString(e.name + "\x00"); err != nil {
+		return err
+	}
+	return c.pad(110 + int64(len(e.name)) + 1)
+}
+
+// file writes an entry with contents.
+func (c *cpioWriter) file(e cpioEntry, r io.Reader) error {
+	if err := c.header(e); err != nil {
+		return err
+	}
+	n, err := io.Copy(c.w, r)
+	if err != nil {
+		return err
+	}
+	if n != e.size {
+		return fmt.Errorf("%s: wrote %d bytes, expected %d", e.name, n, e.size)
+	}
+	return c.pad(n)
+}
+
+// Close writes the trailer and flushes the archive.
+func (c *cpioWriter) Close() error {
+	if err := c.header(cpioEntry{name: "TRAILER!!!"}); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// writeFileInfoCPIO writes the file tree fi (located at dir) to the cpio
+// archive, like writeFileInfo does for the squashfs root file system.
+func writeFileInfoCPIO(c *cpioWriter, dir string, fi *FileInfo) error {
+	name := path.Join(dir, fi.Filename)
+	if fi.FromHost != "" { // copy a regular file
+		f, err := os.Open(fi.FromHost)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return c.file(cpioEntry{
+			name: name,
+			mode: cpioTypeRegular | uint32(st.Mode()&os.ModePerm),
+			size: st.Size(),
+		}, f)
+	}
+	if fi.FromLiteral != "" { // write a regular file
+		mode := fi.Mode
+		if mode == 0 {
+			mode = 0444
+		}
+		return c.file(cpioEntry{
+			name: name,
+			mode: cpioTypeRegular | uint32(mode&os.ModePerm),
+			size: int64(len(fi.FromLiteral)),
+		}, strings.NewReader(fi.FromLiteral))
+	}
+	if fi.SymlinkDest != "" { // create a symlink
+		return c.file(cpioEntry{
+			name: name,
+			mode: cpioTypeSymlink | 0777,
+			size: int64(len(fi.SymlinkDest)),
+		}, strings.NewReader(fi.SymlinkDest))
+	}
+	// subdir
+	if fi.Filename != "" { // the root directory already exists
+		if err := c.header(cpioEntry{name: name, mode: cpioTypeDir | 0755, nlinks: 2}); err != nil {
+			return err
+		}
+	}
+	sort.Slice(fi.Dirents, func(i, j int) bool {
+		return fi.Dirents[i].Filename < fi.Dirents[j].Filename
+	})
+	for _, ent := range fi.Dirents {
+		if err := writeFileInfoCPIO(c, name, ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
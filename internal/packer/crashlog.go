@@ -0,0 +1,304 @@
+package packer
+
+import (
+	"fmt"
+	"path"
+)
+
+const (
+	// crashLogDir is the directory on the perm partition to which the
+	// crash-capture program writes one log file per service.
+	crashLogDir = "/perm/crashes"
+
+	// crashCaptureBin is the path of the crash-capture program, to which all
+	// services are symlinked.
+	crashCaptureBin = "/gokrazy/crash-capture"
+
+	// crashCaptureRealDir contains the actual service programs, which
+	// crash-capture runs, at their original path (e.g.
+	// /gokrazy/captured/user/hello for /user/hello).
+	crashCaptureRealDir = "/gokrazy/captured"
+
+	// CrashLogsPort is the TCP port on which the crash-logs program serves
+	// the crash logs.
+	CrashLogsPort = "8079"
+)
+
+// ParseCrashLogSize parses the size of the crash logs (e.g. 1M), at which
+// they are rotated. The empty string disables capturing crashes.
+func ParseCrashLogSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid crash log size: %v", err)
+	}
+	if size < 4096 {
+		return 0, fmt.Errorf("invalid crash log size %q: must be at least 4K", s)
+	}
+	return size, nil
+}
+
+// crashCaptureSource is the source of the crash-capture program, which runs
+// the service program of its argv[0] and appends a record of each exit (time,
+// exit status and, for failures, the last part of the stderr output, e.g. a Go
+// panic) to the service log file in crashLogDir. Log files are rotated (to a
+// .1 file) when reaching the configured size, so that at most twice the size
+// is used per service.
+const crashCaptureSource = `package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	realDir = %q
+	logDir  = %q
+	maxSize = %d
+)
+
+// tail keeps the last n bytes written to it.
+type tail struct {
+	mu  sync.Mutex
+	n   int
+	buf []byte
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.n {
+		copy(t.buf, t.buf[len(t.buf)-t.n:])
+		t.buf = t.buf[:t.n]
+	}
+	return len(p), nil
+}
+
+func (t *tail) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.buf...)
+}
+
+func record(name, status string, uptime time.Duration, stderr []byte) error {
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "=== %%s %%s %%s after %%v\n",
+		time.Now().UTC().Format(time.RFC3339),
+		name,
+		status,
+		uptime.Round(time.Millisecond))
+	if len(stderr) > 0 {
+		buf.Write(stderr)
+		if stderr[len(stderr)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	fn := filepath.Join(logDir, filepath.Base(name)+".log")
+	if st, err := os.Stat(fn); err == nil && st.Size()+int64(buf.Len()) > maxSize {
+		if err := os.Rename(fn, fn+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func main() {
+	name := os.Args[0]
+	stderr := &tail{n: maxSize / 4}
+	if stderr.n > 64<<10 {
+		stderr.n = 64 << 10
+	}
+	cmd := &exec.Cmd{
+		Path:   realDir + name,
+		Args:   os.Args,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: io.MultiWriter(os.Stderr, stderr),
+		// Signals from the supervisor are forwarded to the process group of
+		// the service (see below). SIGKILL cannot be forwarded, so the
+		// service is killed when crash-capture dies.
+		SysProcAttr: &syscall.SysProcAttr{
+			Setpgid:   true,
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "crash-capture %%s: %%v\n", name, err)
+		os.Exit(1)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+		}
+	}()
+	err := cmd.Wait()
+	uptime := time.Since(start)
+
+	code := 0
+	status := "exited successfully"
+	if err != nil {
+		status = err.Error()
+		code = 1
+		if ee, ok := err.(*exec.ExitError); ok {
+			ws := ee.Sys().(syscall.WaitStatus)
+			switch {
+			case ws.Exited():
+				code = ws.ExitStatus()
+			case ws.Signaled():
+				code = 128 + int(ws.Signal())
+			}
+		}
+	}
+	var output []byte
+	// Exit status 125 tells the supervisor to not restart the service.
+	if code != 0 && code != 125 {
+		output = stderr.Bytes()
+	}
+	if err := record(name, status, uptime, output); err != nil {
+		fmt.Fprintf(os.Stderr, "crash-capture %%s: recording exit: %%v\n", name, err)
+	}
+	os.Exit(code)
+}
+`
+
+// crashLogsSource is the source of the crash-logs program, which serves the
+// crash logs written by crash-capture via HTTP (protected with the gokrazy
+// password), so that gok logs --crashes can fetch them. Like the gokrazy web
+// interface, it serves HTTPS if the instance uses TLS.
+const crashLogsSource = `package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	logDir   = %q
+	port     = %q
+	certFile = %q
+	keyFile  = %q
+)
+
+func main() {
+	pw, err := os.ReadFile("/etc/gokr-pw.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	password := strings.TrimSpace(string(pw))
+	http.HandleFunc("/crashes", func(w http.ResponseWriter, r *http.Request) {
+		if _, got, ok := r.BasicAuth(); !ok || subtle.ConstantTimeCompare([]byte(got), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"gokrazy\"")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		pattern := "*.log"
+		if service := r.FormValue("service"); service != "" {
+			pattern = filepath.Base(service) + ".log"
+		}
+		files, err := filepath.Glob(filepath.Join(logDir, pattern))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sort.Strings(files)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, fn := range files {
+			// The rotated file contains the older records.
+			for _, fn := range []string{fn + ".1", fn} {
+				f, err := os.Open(fn)
+				if err != nil {
+					continue
+				}
+				io.Copy(w, f)
+				f.Close()
+			}
+		}
+	})
+	if _, err := os.Stat(certFile); err == nil {
+		log.Printf("serving crash logs from %%s on port %%s (TLS)", logDir, port)
+		log.Fatal(http.ListenAndServeTLS(":"+port, certFile, keyFile, nil))
+	}
+	log.Printf("serving crash logs from %%s on port %%s", logDir, port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+`
+
+// addCrashLogsProgram adds the crash-logs program to /user. It needs to be
+// called before generating init, like for all other services.
+func addCrashLogsProgram(root *FileInfo, tmpdir string) error {
+	bin, err := buildStandalone(tmpdir, "crash-logs", fmt.Sprintf(crashLogsSource, crashLogDir, CrashLogsPort, webCertPath, webKeyPath))
+	if err != nil {
+		return err
+	}
+	user := mustFindDirent(root, "user")
+	user.Dirents = append(user.Dirents, &FileInfo{
+		Filename: "crash-logs",
+		FromHost: bin,
+	})
+	return nil
+}
+
+// captureCrashes makes crash-capture run the specified services, by moving
+// the service programs to crashCaptureRealDir and replacing them with
+// symlinks to crash-capture. It needs to be called once the service programs
+// are final (i.e. after compressing binaries).
+func captureCrashes(root *FileInfo, tmpdir string, services []string, maxSize uint64) error {
+	bin, err := buildStandalone(tmpdir, "crash-capture", fmt.Sprintf(crashCaptureSource, crashCaptureRealDir, crashLogDir, maxSize))
+	if err != nil {
+		return err
+	}
+	gokrazy := mustFindDirent(root, "gokrazy")
+	gokrazy.Dirents = append(gokrazy.Dirents, &FileInfo{
+		Filename: path.Base(crashCaptureBin),
+		FromHost: bin,
+	})
+
+	var captured int
+	for _, p := range services {
+		ent := root.Find(p)
+		if ent == nil {
+			continue
+		}
+		moved := *ent
+		dir := root.MkdirAll(path.Join(crashCaptureRealDir, path.Dir(p)))
+		dir.Dirents = append(dir.Dirents, &moved)
+		*ent = FileInfo{
+			Filename:    ent.Filename,
+			SymlinkDest: crashCaptureBin,
+		}
+		captured++
+	}
+	fmt.Printf("Capturing crashes of %d services into %s (rotated at %d bytes)\n", captured, crashLogDir, maxSize)
+	return nil
+}
@@ -0,0 +1,23 @@
+package packer
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestAddCrashLogsProgram(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+	t.Setenv("GOOS", "linux")
+	t.Setenv("GOARCH", runtime.GOARCH)
+	t.Setenv("GOARM", "")
+	root := &FileInfo{Dirents: []*FileInfo{{Filename: "user"}}}
+	if err := addCrashLogsProgram(root, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if root.Find("/user/crash-logs") == nil {
+		t.Errorf("/user/crash-logs not added")
+	}
+}
@@ -0,0 +1,125 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// minDuplicateSize is the minimum size (in bytes) for duplicate files to be
+// reported: duplicates of small files (config files, scripts) are common and
+// not worth reporting.
+const minDuplicateSize = 64 * 1024
+
+type duplicateGroup struct {
+	size  int64
+	paths []string // absolute paths in the root file system
+	files []*FileInfo
+}
+
+func hashFileInfo(fi *FileInfo) (hash string, size int64, _ error) {
+	if fi.FromLiteral != "" {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(fi.FromLiteral))), int64(len(fi.FromLiteral)), nil
+	}
+	f, err := os.Open(fi.FromHost)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// findDuplicates returns groups of identical files (of at least
+// minDuplicateSize bytes) in root, largest waste first.
+func findDuplicates(root *FileInfo) ([]duplicateGroup, error) {
+	groups := make(map[string]*duplicateGroup)
+	var walk func(dir string, fi *FileInfo) error
+	walk = func(dir string, fi *FileInfo) error {
+		for _, ent := range fi.Dirents {
+			p := path.Join(dir, ent.Filename)
+			if !ent.IsFile() {
+				if ent.SymlinkDest != "" {
+					continue
+				}
+				if err := walk(p, ent); err != nil {
+					return err
+				}
+				continue
+			}
+			hash, size, err := hashFileInfo(ent)
+			if err != nil {
+				return err
+			}
+			if size < minDuplicateSize {
+				continue
+			}
+			g, ok := groups[hash]
+			if !ok {
+				g = &duplicateGroup{size: size}
+				groups[hash] = g
+			}
+			g.paths = append(g.paths, p)
+			g.files = append(g.files, ent)
+		}
+		return nil
+	}
+	if err := walk("/", root); err != nil {
+		return nil, err
+	}
+	var dups []duplicateGroup
+	for _, g := range groups {
+		if len(g.paths) < 2 {
+			continue
+		}
+		dups = append(dups, *g)
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		wi := dups[i].size * int64(len(dups[i].paths)-1)
+		wj := dups[j].size * int64(len(dups[j].paths)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return dups[i].paths[0] < dups[j].paths[0]
+	})
+	return dups, nil
+}
+
+// reportDuplicates replaces all but the first copy of each duplicate file of
+// root with a symlink to the first copy and prints the replaced files. Unless
+// dedup is true, root is left as-is (without hashing its files).
+func reportDuplicates(root *FileInfo, dedup bool) error {
+	if !dedup {
+		return nil
+	}
+	dups, err := findDuplicates(root)
+	if err != nil {
+		return err
+	}
+	if len(dups) == 0 {
+		return nil
+	}
+	var saved int64
+	fmt.Printf("\nThe root file system contains identical copies of these files:\n\n")
+	for _, g := range dups {
+		saved += g.size * int64(len(g.paths)-1)
+		fmt.Printf("  %d KB, %d copies:\n", g.size/1024, len(g.paths))
+		for _, p := range g.paths {
+			fmt.Printf("    %s\n", p)
+		}
+		for _, fi := range g.files[1:] {
+			fi.FromHost = ""
+			fi.FromLiteral = ""
+			fi.SymlinkDest = g.paths[0]
+		}
+	}
+	fmt.Printf("\nReplaced the copies with symlinks, saving %d KB\n", saved/1024)
+	return nil
+}
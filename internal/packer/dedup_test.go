@@ -0,0 +1,70 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReportDuplicates(t *testing.T) {
+	lib := strings.Repeat("libc", minDuplicateSize)
+	libc := filepath.Join(t.TempDir(), "libc.so.6")
+	if err := os.WriteFile(libc, []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree := func() *FileInfo {
+		return &FileInfo{
+			Dirents: []*FileInfo{
+				{Filename: "lib", Dirents: []*FileInfo{
+					{Filename: "libc.so.6", FromHost: libc},
+				}},
+				{Filename: "usr", Dirents: []*FileInfo{
+					{Filename: "lib", Dirents: []*FileInfo{
+						{Filename: "libc.so.6", FromLiteral: lib},
+						{Filename: "libc.so", SymlinkDest: "libc.so.6"},
+					}},
+				}},
+				{Filename: "etc", Dirents: []*FileInfo{
+					// Duplicates smaller than minDuplicateSize are kept.
+					{Filename: "hostname", FromLiteral: "gokrazy"},
+					{Filename: "hostname.orig", FromLiteral: "gokrazy"},
+				}},
+			},
+		}
+	}
+
+	t.Run("off", func(t *testing.T) {
+		root := tree()
+		// Files are not even read without dedup.
+		root.Dirents = append(root.Dirents, &FileInfo{
+			Filename: "missing",
+			FromHost: filepath.Join(t.TempDir(), "missing"),
+		})
+		want := tree()
+		want.Dirents = append(want.Dirents, root.Dirents[len(root.Dirents)-1])
+		if err := reportDuplicates(root, false); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, root); diff != "" {
+			t.Errorf("reportDuplicates: unexpected root (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("on", func(t *testing.T) {
+		root := tree()
+		want := tree()
+		want.Dirents[1].Dirents[0].Dirents[0] = &FileInfo{
+			Filename:    "libc.so.6",
+			SymlinkDest: "/lib/libc.so.6",
+		}
+		if err := reportDuplicates(root, true); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, root); diff != "" {
+			t.Errorf("reportDuplicates: unexpected root (-want +got):\n%s", diff)
+		}
+	})
+}
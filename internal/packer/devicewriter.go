@@ -0,0 +1,255 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/tools/internal/measure"
+)
+
+// DeviceSyncPolicies returns the supported values of Pack.DeviceSync.
+func DeviceSyncPolicies() []string {
+	return []string{"end", "buffer", "none"}
+}
+
+func checkDeviceSync(policy string) error {
+	switch policy {
+	case "", "end", "buffer", "none":
+		return nil
+	default:
+		return fmt.Errorf("unknown device sync policy %q (supported: %s)", policy, strings.Join(DeviceSyncPolicies(), ", "))
+	}
+}
+
+const (
+	minDeviceBuffer = 1 * MB
+	maxDeviceBuffer = 16 * MB
+
+	// deviceRetryBackoff is the delay before retrying a write which failed
+	// with an I/O error. It doubles with every retry of the same write.
+	deviceRetryBackoff = 100 * time.Millisecond
+
+	// deviceBufferTime is how long writing (and syncing) one buffer should
+	// take: long enough to amortize the per-write overhead of SD cards, short
+	// enough to keep the device busy while the next buffer is filled.
+	deviceBufferTime = 250 * time.Millisecond
+)
+
+type deviceBuffer struct {
+	b   []byte
+	off int64
+}
+
+// deviceWriter writes sequentially to a block device using two buffers: while
+// one buffer is written to the device (and synced, depending on the policy) in
+// a separate goroutine, the next one is filled. The buffer size adapts to the
+// measured throughput of the device, so that writing a buffer takes about
+// deviceBufferTime.
+//
+// The sync policy is one of DeviceSyncPolicies: end (the default) only syncs
+// the device once everything is written (see syncDevice); buffer additionally
+// calls fdatasync after each buffer, which keeps the amount of dirty data in
+// the page cache (and hence the time of the final sync) small; none leaves
+// flushing to the kernel.
+type deviceWriter struct {
+	f       *os.File
+	policy  string
+	retries int   // see writeBuffer
+	off     int64 // device offset of buf
+	buf     []byte
+
+	// writeAt is f.WriteAt, replaced in tests.
+	writeAt func([]byte, int64) (int, error)
+	// backoff is the delay before the first retry (deviceRetryBackoff).
+	backoff time.Duration
+	// retried lists the LBA ranges whose writes needed retries (only
+	// accessed by the writing goroutine until it finished).
+	retried []string
+
+	size  atomic.Int64 // buffer size, adjusted by the writing goroutine
+	err   atomic.Value // first error of the writing goroutine
+	free  chan []byte
+	queue chan deviceBuffer
+	done  chan struct{}
+}
+
+// newDeviceWriter returns a deviceWriter which writes to f, starting at offset
+// off. The current offset of f is not used or modified.
+func newDeviceWriter(f *os.File, off int64, policy string, retries int) *deviceWriter {
+	w := &deviceWriter{
+		f:       f,
+		policy:  policy,
+		retries: retries,
+		off:     off,
+		writeAt: f.WriteAt,
+		backoff: deviceRetryBackoff,
+		free:    make(chan []byte, 2),
+		queue:   make(chan deviceBuffer, 1),
+		done:    make(chan struct{}),
+	}
+	w.size.Store(4 * MB)
+	w.free <- make([]byte, 0, maxDeviceBuffer)
+	w.free <- make([]byte, 0, maxDeviceBuffer)
+	w.buf = <-w.free
+	go w.writeBuffers()
+	return w
+}
+
+func (w *deviceWriter) writeBuffers() {
+	defer close(w.done)
+	for db := range w.queue {
+		if w.err.Load() == nil {
+			start := time.Now()
+			if err := w.writeBuffer(db); err != nil {
+				w.err.Store(err)
+			}
+			w.adapt(len(db.b), time.Since(start))
+		}
+		w.free <- db.b[:0]
+	}
+}
+
+// writeBuffer writes db to the device. Cheap card readers sporadically fail
+// writes with EIO, so writes failing with EIO are retried (from where the
+// failed write stopped) up to w.retries times, with exponential backoff.
+func (w *deviceWriter) writeBuffer(db deviceBuffer) error {
+	b, off := db.b, db.off
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		n, err := w.writeOnce(b, off)
+		if err == nil {
+			return nil
+		}
+		b, off = b[n:], off+int64(n)
+		lbas := fmt.Sprintf("LBA %d-%d", off/512, (off+int64(len(b)))/512-1)
+		if !errors.Is(err, syscall.EIO) || attempt >= w.retries {
+			if attempt > 0 {
+				return fmt.Errorf("writing %s: %v (after %d retries)", lbas, err, attempt)
+			}
+			return fmt.Errorf("writing %s: %v", lbas, err)
+		}
+		log.Printf("writing %s failed: %v, retrying in %v (%d/%d)", lbas, err, backoff, attempt+1, w.retries)
+		if attempt == 0 {
+			w.retried = append(w.retried, lbas)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// writeOnce writes b to the device at off. If the write fails, it returns the
+// number of bytes which were written before the error.
+func (w *deviceWriter) writeOnce(b []byte, off int64) (int, error) {
+	if n, err := w.writeAt(b, off); err != nil {
+		return n, err
+	}
+	if w.policy == "buffer" {
+		if err := fdatasync(w.f); err != nil {
+			return 0, fmt.Errorf("fdatasync: %w", err)
+		}
+	}
+	return 0, nil
+}
+
+// adapt sets the size of the next buffers based on how long writing n bytes
+// took.
+func (w *deviceWriter) adapt(n int, took time.Duration) {
+	if took <= 0 {
+		took = time.Millisecond
+	}
+	size := int64(float64(n) * float64(deviceBufferTime) / float64(took))
+	size = size / minDeviceBuffer * minDeviceBuffer
+	if size < minDeviceBuffer {
+		size = minDeviceBuffer
+	}
+	if size > maxDeviceBuffer {
+		size = maxDeviceBuffer
+	}
+	w.size.Store(size)
+}
+
+// Err returns the first error encountered by the writing goroutine.
+func (w *deviceWriter) Err() error {
+	if err, ok := w.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (w *deviceWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	w.queue <- deviceBuffer{b: w.buf, off: w.off}
+	w.off += int64(len(w.buf))
+	w.buf = <-w.free
+}
+
+func (w *deviceWriter) Write(b []byte) (int, error) {
+	if err := w.Err(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(b) > 0 {
+		n := int(w.size.Load()) - len(w.buf)
+		if n <= 0 {
+			// The buffer size shrank below what is already buffered.
+			w.flush()
+			continue
+		}
+		if n > len(b) {
+			n = len(b)
+		}
+		w.buf = append(w.buf, b[:n]...)
+		b = b[n:]
+		written += n
+		if len(w.buf) >= int(w.size.Load()) {
+			w.flush()
+		}
+	}
+	return written, nil
+}
+
+// Close writes the remaining buffered data and waits for all writes to
+// finish. It neither syncs nor closes the underlying file, see syncDevice.
+func (w *deviceWriter) Close() error {
+	w.flush()
+	close(w.queue)
+	<-w.done
+	return w.Err()
+}
+
+// copyToDevice copies src (from its current offset, size bytes) to the device
+// f, starting at offset off, using a deviceWriter.
+func (p *Pack) copyToDevice(f *os.File, off int64, src io.Reader, size int64) error {
+	phase := measure.StartPhase("writing "+f.Name(), size)
+	defer phase.End()
+	dw := newDeviceWriter(f, off, p.DeviceSync, p.DeviceRetries)
+	_, err := io.Copy(dw, io.TeeReader(src, phase))
+	if closeErr := dw.Close(); err == nil {
+		err = closeErr
+	}
+	if len(dw.retried) > 0 {
+		log.Printf("warning: writes to %s needed retries (%s): the SD card or card reader might be faulty", f.Name(), strings.Join(dw.retried, ", "))
+	}
+	return err
+}
+
+// syncDevice flushes all data written to the device f (unless DeviceSync is
+// none), so that the device can be unplugged as soon as the packer exits.
+func (p *Pack) syncDevice(f *os.File) error {
+	if p.DeviceSync == "none" {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("fsync: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package packer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDeviceWriter(t *testing.T) {
+	want := make([]byte, 9*MB+123)
+	rand.New(rand.NewSource(1)).Read(want)
+	const off = 4096
+
+	for _, policy := range DeviceSyncPolicies() {
+		t.Run(policy, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			p := &Pack{DeviceSync: policy}
+			// Hiding WriteTo makes io.Copy write in small chunks, which
+			// straddle the buffer boundaries.
+			src := struct{ io.Reader }{bytes.NewReader(want)}
+			if err := p.copyToDevice(f, off, src, int64(len(want))); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.syncDevice(f); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != off+len(want) {
+				t.Fatalf("device has %d bytes, want %d", len(got), off+len(want))
+			}
+			if !bytes.Equal(got[off:], want) {
+				t.Errorf("device contents differ from the written data")
+			}
+		})
+	}
+}
+
+func TestDeviceWriterAdapt(t *testing.T) {
+	w := &deviceWriter{}
+	for _, tt := range []struct {
+		n    int
+		took time.Duration
+		want int64
+	}{
+		{4 * MB, 250 * time.Millisecond, 4 * MB},
+		{4 * MB, 125 * time.Millisecond, 8 * MB},
+		{4 * MB, time.Millisecond, maxDeviceBuffer},
+		{4 * MB, 0, maxDeviceBuffer},
+		{4 * MB, 10 * time.Second, minDeviceBuffer},
+	} {
+		w.adapt(tt.n, tt.took)
+		if got := w.size.Load(); got != tt.want {
+			t.Errorf("adapt(%d, %v): size = %d, want %d", tt.n, tt.took, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceWriterRetry(t *testing.T) {
+	want := make([]byte, 3*MB)
+	rand.New(rand.NewSource(1)).Read(want)
+
+	for _, tt := range []struct {
+		name      string
+		failures  int
+		retries   int
+		wantError string // prefix and suffix of the error message
+	}{
+		{name: "transient", failures: 2, retries: 3},
+		// Each retry continues where the failed write stopped.
+		{name: "persistent", failures: 5, retries: 3, wantError: "writing LBA 8-6143: … input/output error (after 3 retries)"},
+		{name: "no retries", failures: 1, retries: 0, wantError: "writing LBA 2-6143: … input/output error"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			dw := newDeviceWriter(f, 0, "none", tt.retries)
+			dw.backoff = 0
+			failures := tt.failures
+			dw.writeAt = func(b []byte, off int64) (int, error) {
+				if failures == 0 {
+					return f.WriteAt(b, off)
+				}
+				failures--
+				// The first 1024 bytes make it to the device.
+				n, err := f.WriteAt(b[:1024], off)
+				if err != nil {
+					return n, err
+				}
+				return n, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.EIO}
+			}
+			if _, err := dw.Write(want); err != nil {
+				t.Fatal(err)
+			}
+			err = dw.Close()
+			if tt.wantError != "" {
+				prefix, suffix, _ := strings.Cut(tt.wantError, " … ")
+				if err == nil || !strings.HasPrefix(err.Error(), prefix) || !strings.HasSuffix(err.Error(), suffix) {
+					t.Fatalf("Close() = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(dw.retried, ", "), "LBA 2-6143"; got != want {
+				t.Errorf("retried = %q, want %q", got, want)
+			}
+			got, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("device contents differ from the written data")
+			}
+		})
+	}
+}
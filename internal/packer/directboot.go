@@ -0,0 +1,146 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// Files of the direct kernel boot output (see OutputTypeDirectBoot).
+const (
+	directBootKernel    = "vmlinuz"
+	directBootCmdline   = "cmdline.txt"
+	directBootInitramfs = "initramfs.cpio"
+)
+
+// directBootConsole is the serial console of the usual direct kernel boot
+// VMs (QEMU and Firecracker) per architecture.
+var directBootConsole = map[string]string{
+	"amd64": "ttyS0",
+	"arm64": "ttyAMA0", // QEMU virt machine
+}
+
+// directBootCmdlineFor turns the kernel command line from the kernel package
+// into one for booting the initramfs: gokrazy init runs from the initramfs
+// instead of a root partition.
+func directBootCmdlineFor(kernelCmdline, arch string, initDebug bool) string {
+	var fields []string
+	for _, f := range strings.Fields(kernelCmdline) {
+		if strings.HasPrefix(f, "root=") ||
+			strings.HasPrefix(f, "rootfstype=") ||
+			strings.HasPrefix(f, "init=") ||
+			f == "rootwait" {
+			continue
+		}
+		if initDebug && (f == "quiet" || strings.HasPrefix(f, "loglevel=")) {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	// The last console= becomes /dev/console, i.e. the output of init.
+	if console, ok := directBootConsole[arch]; ok {
+		fields = append(fields, "console="+console)
+	}
+	if initDebug {
+		fields = append(fields, "loglevel=7")
+	}
+	fields = append(fields, "rdinit=/gokrazy/init")
+	return strings.Join(fields, " ")
+}
+
+// writeDirectBoot writes the kernel, its command line and the root file
+// system as initramfs into the directory p.Output.Path, for booting the
+// packed userland directly (without firmware, boot loader or disk) in e.g.
+// QEMU or Firecracker. The /perm partition is not available.
+func (p *Pack) writeDirectBoot(root *FileInfo) error {
+	dir := p.Output.Path
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	kernelDir, err := packer.PackageDir(p.Cfg.KernelPackageOrDefault())
+	if err != nil {
+		return err
+	}
+
+	if err := copyHostFile(filepath.Join(kernelDir, "vmlinuz"), filepath.Join(dir, directBootKernel)); err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(filepath.Join(kernelDir, "cmdline.txt"))
+	if err != nil {
+		return err
+	}
+	cmdline := directBootCmdlineFor(string(b), packer.TargetArch(), p.InitDebug)
+	if err := os.WriteFile(filepath.Join(dir, directBootCmdline), []byte(cmdline+"\n"), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("Creating initramfs\n")
+	initramfs := filepath.Join(dir, directBootInitramfs)
+	f, err := os.Create(initramfs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c := newCPIOWriter(f, p.now())
+	if err := writeFileInfoCPIO(c, "", root); err != nil {
+		return err
+	}
+	// Without /dev/console, the kernel starts init without stdin, stdout and
+	// stderr (devtmpfs is only mounted later, by init).
+	if err := c.header(cpioEntry{
+		name: "dev/console",
+		mode: cpioTypeChar | 0600,
+		rdev: [2]uint32{5, 1},
+	}); err != nil {
+		return err
+	}
+	if err := c.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	st, err := os.Stat(initramfs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s (%d MB)\n", initramfs, st.Size()/MB)
+	return nil
+}
+
+func copyHostFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// directBootQEMUCommand returns an example QEMU command line for booting the
+// direct kernel boot output in dir.
+func directBootQEMUCommand(dir, arch string) string {
+	qemu := "qemu-system-x86_64 -machine accel=kvm:tcg"
+	if arch == "arm64" {
+		qemu = "qemu-system-aarch64 -machine virt -cpu max"
+	}
+	return fmt.Sprintf("%s -m 1G -nographic -kernel %s -initrd %s -append \"$(cat %s)\" -nic user,model=virtio-net-pci",
+		qemu,
+		filepath.Join(dir, directBootKernel),
+		filepath.Join(dir, directBootInitramfs),
+		filepath.Join(dir, directBootCmdline))
+}
@@ -0,0 +1,116 @@
+package packer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDirectBootCmdline(t *testing.T) {
+	const kernelCmdline = "console=tty1 root=/dev/sda2 rootwait panic=10 oops=panic init=/gokrazy/init quiet\n"
+	for _, tt := range []struct {
+		arch      string
+		initDebug bool
+		want      string
+	}{
+		{
+			arch: "amd64",
+			want: "console=tty1 panic=10 oops=panic quiet console=ttyS0 rdinit=/gokrazy/init",
+		},
+		{
+			arch:      "arm64",
+			initDebug: true,
+			want:      "console=tty1 panic=10 oops=panic console=ttyAMA0 loglevel=7 rdinit=/gokrazy/init",
+		},
+	} {
+		t.Run(tt.arch, func(t *testing.T) {
+			if got := directBootCmdlineFor(kernelCmdline, tt.arch, tt.initDebug); got != tt.want {
+				t.Errorf("directBootCmdlineFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type cpioTestEntry struct {
+	Mode uint32
+	Rdev [2]uint32
+	Data string
+}
+
+// readCPIO parses a newc cpio archive, returning its entries by name.
+func readCPIO(t *testing.T, b []byte) map[string]cpioTestEntry {
+	t.Helper()
+	align := func(n int) int { return (n + 3) &^ 3 }
+	field := func(hdr []byte, i int) uint32 {
+		v, err := strconv.ParseUint(string(hdr[6+i*8:6+(i+1)*8]), 16, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint32(v)
+	}
+	entries := make(map[string]cpioTestEntry)
+	for off := 0; ; {
+		hdr := b[off : off+110]
+		if string(hdr[:6]) != "070701" {
+			t.Fatalf("offset %d: invalid magic %q", off, hdr[:6])
+		}
+		nameSize := int(field(hdr, 11))
+		name := string(b[off+110 : off+110+nameSize-1])
+		off = align(off + 110 + nameSize)
+		if name == "TRAILER!!!" {
+			if off != len(b) {
+				t.Errorf("%d bytes after the trailer", len(b)-off)
+			}
+			return entries
+		}
+		size := int(field(hdr, 6))
+		entries[name] = cpioTestEntry{
+			Mode: field(hdr, 1),
+			Rdev: [2]uint32{field(hdr, 9), field(hdr, 10)},
+			Data: string(b[off : off+size]),
+		}
+		off = align(off + size)
+	}
+}
+
+func TestWriteFileInfoCPIO(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(bin, []byte("ELF hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := &FileInfo{
+		Dirents: []*FileInfo{
+			{Filename: "user", Dirents: []*FileInfo{{Filename: "hello", FromHost: bin}}},
+			{Filename: "etc", Dirents: []*FileInfo{
+				{Filename: "hostname", FromLiteral: "gokrazy"},
+				{Filename: "localtime", SymlinkDest: "/usr/share/zoneinfo/UTC"},
+			}},
+			{Filename: "dev"},
+		},
+	}
+	var buf bytes.Buffer
+	c := newCPIOWriter(&buf, time.Now())
+	if err := writeFileInfoCPIO(c, "", root); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readCPIO(t, buf.Bytes())
+	want := map[string]cpioTestEntry{
+		"dev":           {Mode: cpioTypeDir | 0755},
+		"etc":           {Mode: cpioTypeDir | 0755},
+		"etc/hostname":  {Mode: cpioTypeRegular | 0444, Data: "gokrazy"},
+		"etc/localtime": {Mode: cpioTypeSymlink | 0777, Data: "/usr/share/zoneinfo/UTC"},
+		"user":          {Mode: cpioTypeDir | 0755},
+		"user/hello":    {Mode: cpioTypeRegular | 0755, Data: "ELF hello"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected cpio contents: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,150 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tmpSpaceReserve is the space which the packer needs in the temporary
+// directory besides the images, e.g. for the compiled binaries.
+const tmpSpaceReserve = 200 * MB
+
+// spaceRequirement is an estimate of the space which the packer needs in a
+// directory.
+type spaceRequirement struct {
+	dir   string
+	what  string // e.g. "temporary files"
+	bytes int64
+}
+
+// spaceRequirements estimates the space which the packer needs in the
+// temporary directory and at the output destinations. The estimates are upper
+// bounds: the file systems cannot exceed their partitions, and the images are
+// sparse.
+func (pack *Pack) spaceRequirements() []spaceRequirement {
+	flags := pack.Cfg.InternalCompatibilityFlags
+	images := pack.BootSize() + pack.RootSize()
+	tmp := tmpSpaceReserve + pack.RootSize()
+	switch target := flags.Overwrite; {
+	case target != "":
+		if IsStreamTarget(target) || pack.VMFormat != "" || pack.Compress != "" {
+			// The full image is assembled in a temporary file.
+			tmp += images
+		}
+		if st, err := os.Stat(target); (err == nil && st.Mode().IsRegular()) || os.IsNotExist(err) {
+			// The full image contains the boot and root file systems;
+			// VM images and compressed images are not larger. A previous
+			// image is only replaced once the new one is complete (see
+			// partialSuffix), so its space is not available.
+			reqs := []spaceRequirement{
+				{dir: os.TempDir(), what: "temporary files", bytes: tmp},
+				{dir: filepath.Dir(target), what: "the full image", bytes: images},
+			}
+			if pack.OutputDir != "" {
+				reqs = append(reqs, spaceRequirement{dir: pack.OutputDir, what: "the boot and root images", bytes: images})
+			}
+			return reqs
+		}
+
+	case flags.OverwriteBoot != "" || flags.OverwriteRoot != "":
+		var reqs []spaceRequirement
+		if flags.OverwriteBoot != "" {
+			reqs = append(reqs, spaceRequirement{dir: filepath.Dir(flags.OverwriteBoot), what: "the boot image", bytes: pack.BootSize()})
+		}
+		if flags.OverwriteRoot != "" {
+			reqs = append(reqs, spaceRequirement{dir: filepath.Dir(flags.OverwriteRoot), what: "the root image", bytes: pack.RootSize()})
+		}
+		return append(reqs, spaceRequirement{dir: os.TempDir(), what: "temporary files", bytes: tmp})
+
+	case pack.Output == nil || pack.Output.Type != OutputTypeGaf && pack.Output.Type != OutputTypeDirectBoot:
+		// The boot and root images for updates are written to temporary
+		// files.
+		tmp += pack.BootSize()
+	}
+	return []spaceRequirement{{dir: os.TempDir(), what: "temporary files", bytes: tmp}}
+}
+
+// freeSpace returns the space available to unprivileged users in the file
+// system of dir, and the ID of the file system.
+func freeSpace(dir string) (free int64, fs uint64, _ error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		fs = uint64(sys.Dev)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), fs, nil
+}
+
+// checkSpace verifies that the file systems of the requirements have enough
+// free space, adding up the requirements of directories on the same file
+// system.
+func checkSpace(reqs []spaceRequirement, free func(dir string) (int64, uint64, error)) error {
+	type fsSpace struct {
+		dirs      []string
+		whats     []string
+		required  int64
+		available int64
+	}
+	byFS := make(map[uint64]*fsSpace)
+	var order []uint64
+	for _, req := range reqs {
+		dir := req.dir
+		// The output directory might not exist yet; check its parent.
+		for {
+			if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		available, fs, err := free(dir)
+		if err != nil {
+			return fmt.Errorf("checking free space in %s: %v", dir, err)
+		}
+		s, ok := byFS[fs]
+		if !ok {
+			s = &fsSpace{available: available}
+			byFS[fs] = s
+			order = append(order, fs)
+		}
+		s.dirs = append(s.dirs, req.dir)
+		s.whats = append(s.whats, req.what)
+		s.required += req.bytes
+	}
+	var errs []string
+	for _, fs := range order {
+		s := byFS[fs]
+		if s.required <= s.available {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %d MB required for %s, but only %d MB available",
+			strings.Join(uniq(s.dirs), ", "), s.required/MB, strings.Join(uniq(s.whats), " and "), s.available/MB))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("not enough disk space (use --tmpdir to select another temporary directory, or skip this check with --skip_space_check):\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// uniq returns the distinct elements of s, in order.
+func uniq(s []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, e := range s {
+		if !seen[e] {
+			seen[e] = true
+			result = append(result, e)
+		}
+	}
+	return result
+}
@@ -0,0 +1,42 @@
+package packer
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSpace(t *testing.T) {
+	tmp := t.TempDir()
+	out := t.TempDir()
+	// tmp and out are on different file systems with 1000 MB free each,
+	// unless sameFS.
+	free := func(sameFS bool) func(string) (int64, uint64, error) {
+		return func(dir string) (int64, uint64, error) {
+			if sameFS || dir == tmp {
+				return 1000 * MB, 1, nil
+			}
+			return 1000 * MB, 2, nil
+		}
+	}
+	reqs := []spaceRequirement{
+		{dir: tmp, what: "temporary files", bytes: 700 * MB},
+		// The output directory does not exist yet.
+		{dir: filepath.Join(out, "build"), what: "the full image", bytes: 600 * MB},
+	}
+	if err := checkSpace(reqs, free(false)); err != nil {
+		t.Errorf("checkSpace(different file systems) = %v, want nil", err)
+	}
+	err := checkSpace(reqs, free(true))
+	if err == nil {
+		t.Fatalf("checkSpace(same file system) = nil, want error")
+	}
+	for _, want := range []string{
+		"1300 MB required for temporary files and the full image",
+		"only 1000 MB available",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("checkSpace(same file system) = %v, want error containing %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deviceImage is what the downgrade check knows about the image which a
+// device currently runs.
+type deviceImage struct {
+	// BuildTimestamp is reported in the status JSON of all gokrazy devices.
+	BuildTimestamp string
+	// Version is the IMAGE_VERSION of /etc/os-release, which is only
+	// available from devices packed with RemoteExec (and a version).
+	Version string
+}
+
+// fetchDeviceImage requests the build timestamp and, if remoteExec is true
+// (i.e. the instance is packed with RemoteExec), the image version (best
+// effort) of the device at updateBaseURL. Both requests are sent with hc,
+// which carries the password, so the image version is not requested from
+// devices which do not run remote-exec.
+func fetchDeviceImage(ctx context.Context, hc *http.Client, updateBaseURL *url.URL, remoteExec bool) (*deviceImage, error) {
+	ctx, canc := context.WithTimeout(ctx, 10*time.Second)
+	defer canc()
+	req, err := http.NewRequestWithContext(ctx, "GET", updateBaseURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return nil, fmt.Errorf("unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	var di deviceImage
+	if err := json.NewDecoder(resp.Body).Decode(&di); err != nil {
+		return nil, err
+	}
+	if !remoteExec {
+		return &di, nil
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", RemoteExecURL(updateBaseURL, RemoteExecOSReleasePath).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = hc.Do(req)
+	if err != nil {
+		return &di, nil // e.g. the device runs an image without remote-exec
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &di, nil // e.g. an older remote-exec
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	di.Version = osReleaseValue(b, "IMAGE_VERSION")
+	return &di, nil
+}
+
+// osReleaseValue returns the (unquoted) value of key in the os-release(5)
+// contents b.
+func osReleaseValue(b []byte, key string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || k != key {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			return unquoted
+		}
+		return v
+	}
+	return ""
+}
+
+// describeCommitRe matches the abbreviated commit hash of git describe
+// output, e.g. v1.2.0-3-g1a2b3c4.
+var describeCommitRe = regexp.MustCompile(`-g([0-9a-f]{4,})$`)
+
+// versionRevision returns the git revision (tag or commit) of an image
+// version as returned by ImageVersion.
+func versionRevision(version string) string {
+	version = strings.TrimSuffix(version, dirtySuffix)
+	if m := describeCommitRe.FindStringSubmatch(version); m != nil {
+		return m[1]
+	}
+	return version // a tag, or a commit hash (git describe --always)
+}
+
+// gitCommit resolves rev to a commit hash in the git repository containing
+// dir. It returns the empty string if rev is not in the repository.
+func gitCommit(dir, rev string) string {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// gitIsAncestor returns whether commit a is an ancestor of commit b.
+func gitIsAncestor(dir, a, b string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", a, b)
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// isVersionDowngrade returns why updating a device which runs the image
+// version device to the image version image (both from ImageVersion in the
+// git repository containing dir) is a downgrade, or the empty string if it is
+// not (or the versions cannot be compared).
+func isVersionDowngrade(dir, device, image string) string {
+	if device == "" || image == "" {
+		return ""
+	}
+	deviceRev, imageRev := versionRevision(device), versionRevision(image)
+	if deviceRev == imageRev {
+		return ""
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return ""
+	}
+	imageCommit := gitCommit(dir, imageRev)
+	if imageCommit == "" {
+		return "" // e.g. -image_version=<something not from git>
+	}
+	deviceCommit := gitCommit(dir, deviceRev)
+	if deviceCommit == "" {
+		return fmt.Sprintf("the device runs version %s, which is not in your git repository (is your checkout up to date?)", device)
+	}
+	if deviceCommit != imageCommit && gitIsAncestor(dir, imageCommit, deviceCommit) {
+		return fmt.Sprintf("version %s is older than version %s, which the device runs", image, device)
+	}
+	return ""
+}
+
+// checkDowngrade refuses to update the device at updateBaseURL to the image
+// of version (in the git repository containing dir) built at buildTimestamp,
+// if the device runs a newer image, unless AllowDowngrade is set.
+func (pack *Pack) checkDowngrade(ctx context.Context, hc *http.Client, updateBaseURL *url.URL, dir, buildTimestamp string) error {
+	di, err := fetchDeviceImage(ctx, hc, updateBaseURL, pack.RemoteExec)
+	if err != nil {
+		return fmt.Errorf("checking for downgrade: %v", err)
+	}
+	reason := isVersionDowngrade(dir, di.Version, pack.Version)
+	if reason == "" && di.BuildTimestamp != "" {
+		deviceBuilt, err1 := time.Parse(time.RFC3339, di.BuildTimestamp)
+		imageBuilt, err2 := time.Parse(time.RFC3339, buildTimestamp)
+		if err1 == nil && err2 == nil && deviceBuilt.After(imageBuilt) {
+			reason = fmt.Sprintf("the device runs an image built at %s, after this image (%s)", di.BuildTimestamp, buildTimestamp)
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	if pack.AllowDowngrade {
+		fmt.Printf("Downgrading as requested (-allow_downgrade): %s\n", reason)
+		return nil
+	}
+	return fmt.Errorf("refusing to downgrade: %s. Use -allow_downgrade to update anyway", reason)
+}
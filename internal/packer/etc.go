@@ -0,0 +1,304 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// EtcConfigFile is the name of the file in the instance directory from which
+// gok reads the EtcConfig, if present.
+const EtcConfigFile = "etc.json"
+
+// EtcConfig customizes the entries which the packer creates in /etc (e.g.
+// localtime, hosts and resolv.conf). Entry names are relative to /etc and may
+// refer to subdirectories (e.g. ssl/ca-bundle.pem). For example:
+//
+//	{
+//	  "Remove": ["localtime"],
+//	  "Files": {"hosts": "127.0.0.1 localhost\n10.0.0.2 broker.local\n"},
+//	  "Symlinks": {"resolv.conf": "/perm/resolv.conf"}
+//	}
+//
+// or, to keep the default entries but add host entries and search domains:
+//
+//	{
+//	  "Hosts": ["10.0.0.2 broker.local broker", "10.0.0.1 gateway"],
+//	  "SearchDomains": ["lan"]
+//	}
+type EtcConfig struct {
+	// Remove lists the entries to leave out.
+	Remove []string `json:",omitempty"`
+
+	// Files maps entry names to their contents, adding or replacing entries.
+	Files map[string]string `json:",omitempty"`
+
+	// FromHost maps entry names to the host file which is copied, adding or
+	// replacing entries.
+	FromHost map[string]string `json:",omitempty"`
+
+	// Symlinks maps entry names to their symlink destination, adding or
+	// replacing entries.
+	Symlinks map[string]string `json:",omitempty"`
+
+	// Hosts are additional static entries for /etc/hosts, each an address
+	// followed by one or more names (e.g. "10.0.0.2 broker.local broker").
+	Hosts []string `json:",omitempty"`
+
+	// SearchDomains are added as search domains to the DNS configuration
+	// which the DHCP client writes (see addDNSSearchProgram).
+	SearchDomains []string `json:",omitempty"`
+}
+
+// ReadEtcConfig reads the EtcConfig from the JSON file path.
+func ReadEtcConfig(path string) (*EtcConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ec EtcConfig
+	if err := json.Unmarshal(b, &ec); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := ec.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &ec, nil
+}
+
+// reservedEtcEntries are created from other configuration (e.g. the update
+// settings of config.json) and therefore cannot be customized.
+var reservedEtcEntries = map[string]string{
+	"hostname":                "Hostname",
+	"gokr-pw.txt":             "Update.HTTPPassword",
+	"http-port.txt":           "Update.HTTPPort",
+	"https-port.txt":          "Update.HTTPSPort",
+	"ssl/gokrazy-web.pem":     "Update.CertPEM",
+	"ssl/gokrazy-web.key.pem": "Update.KeyPEM",
+	"gokrazy":                 "",
+	"licenses":                "",
+}
+
+// Validate checks the entry names, Hosts entries and SearchDomains.
+func (ec *EtcConfig) Validate() error {
+	names := append([]string{}, ec.Remove...)
+	for _, m := range []map[string]string{ec.Files, ec.FromHost, ec.Symlinks} {
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid /etc entry %q: expected a relative path like hosts or ssl/ca-bundle.pem", name)
+		}
+		for reserved, setting := range reservedEtcEntries {
+			// Neither the entry itself, nor its contents or parent directory
+			// can be customized.
+			if name != reserved &&
+				!strings.HasPrefix(name, reserved+"/") &&
+				!strings.HasPrefix(reserved, name+"/") {
+				continue
+			}
+			if setting != "" {
+				return fmt.Errorf("/etc/%s cannot be customized: /etc/%s is created from the %s setting of config.json", name, reserved, setting)
+			}
+			return fmt.Errorf("/etc/%s cannot be customized: /etc/%s is generated by the packer", name, reserved)
+		}
+	}
+	for _, m := range []map[string]string{ec.FromHost, ec.Symlinks} {
+		for name := range m {
+			if _, ok := ec.Files[name]; ok {
+				return fmt.Errorf("/etc/%s is specified more than once", name)
+			}
+		}
+	}
+	for name := range ec.Symlinks {
+		if _, ok := ec.FromHost[name]; ok {
+			return fmt.Errorf("/etc/%s is specified more than once", name)
+		}
+	}
+	for _, entry := range ec.Hosts {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("invalid hosts entry %q: expected an address followed by names, e.g. 10.0.0.2 broker.local", entry)
+		}
+	}
+	if len(ec.Hosts) > 0 && ec.replaces("hosts") {
+		return fmt.Errorf("/etc/hosts is replaced, so Hosts entries cannot be added")
+	}
+	for _, domain := range ec.SearchDomains {
+		if domain == "" || strings.ContainsAny(domain, " \t\n") {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	if len(ec.SearchDomains) > 0 && ec.replaces("resolv.conf") {
+		return fmt.Errorf("/etc/resolv.conf is replaced, so SearchDomains cannot be added")
+	}
+	return nil
+}
+
+// replaces returns whether the entry name is removed or replaced.
+func (ec *EtcConfig) replaces(name string) bool {
+	for _, removed := range ec.Remove {
+		if removed == name {
+			return true
+		}
+	}
+	for _, m := range []map[string]string{ec.Files, ec.FromHost, ec.Symlinks} {
+		if _, ok := m[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseHostEntry parses a <name>[,<name>...]=<address> flag value (e.g.
+// broker.local=10.0.0.2) into a Hosts entry.
+func ParseHostEntry(s string) (string, error) {
+	names, addr, ok := strings.Cut(s, "=")
+	if !ok || names == "" || net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("invalid host entry %q: expected <name>[,<name>...]=<address>, e.g. broker.local=10.0.0.2", s)
+	}
+	return addr + " " + strings.Join(strings.Split(names, ","), " "), nil
+}
+
+// apply applies the customizations to etc, the /etc directory.
+func (ec *EtcConfig) apply(etc *FileInfo) error {
+	for _, name := range ec.Remove {
+		// Entries like localtime are not always present, which is fine.
+		if etc.Remove(name) {
+			fmt.Printf("Customized /etc/%s (removed)\n", name)
+		}
+	}
+	entries := make(map[string]*FileInfo)
+	for name, contents := range ec.Files {
+		entries[name] = &FileInfo{FromLiteral: contents}
+	}
+	for name, hostPath := range ec.FromHost {
+		if _, err := os.Stat(hostPath); err != nil {
+			return fmt.Errorf("/etc/%s: %v", name, err)
+		}
+		entries[name] = &FileInfo{FromHost: hostPath}
+	}
+	for name, dest := range ec.Symlinks {
+		entries[name] = &FileInfo{SymlinkDest: dest}
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ent := entries[name]
+		ent.Filename = path.Base(name)
+		if existing := etc.Find(name); existing != nil && !existing.IsFile() && existing.SymlinkDest == "" {
+			return fmt.Errorf("cannot replace directory /etc/%s", name)
+		}
+		verb := "added"
+		if etc.Remove(name) {
+			verb = "replaced"
+		}
+		dir := etc
+		if parent := path.Dir(name); parent != "." {
+			dir = etc.MkdirAll(parent)
+		}
+		dir.Dirents = append(dir.Dirents, ent)
+		fmt.Printf("Customized /etc/%s (%s)\n", name, verb)
+	}
+	if len(ec.Hosts) > 0 {
+		hosts := etc.Find("hosts")
+		if hosts == nil || hosts.FromLiteral == "" {
+			return fmt.Errorf("BUG: /etc/hosts not found")
+		}
+		hosts.FromLiteral += strings.Join(ec.Hosts, "\n") + "\n"
+		fmt.Printf("Customized /etc/hosts (%d entries added)\n", len(ec.Hosts))
+	}
+	if len(ec.SearchDomains) > 0 {
+		resolvConf := etc.Find("resolv.conf")
+		if resolvConf == nil {
+			return fmt.Errorf("BUG: /etc/resolv.conf not found")
+		}
+		resolvConf.SymlinkDest = dnsSearchResolvConf
+		fmt.Printf("Customized /etc/resolv.conf (search domains %s)\n", strings.Join(ec.SearchDomains, " "))
+	}
+	return nil
+}
+
+// dnsSearchResolvConf is the DNS configuration which the dns-search program
+// writes, to which /etc/resolv.conf points when adding search domains.
+const dnsSearchResolvConf = "/tmp/resolv-search.conf"
+
+// dnsSearchSource is the source of the dns-search program, which adds search
+// domains to the DNS configuration written by the DHCP client
+// (/tmp/resolv.conf), whenever it changes.
+const dnsSearchSource = `package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	source = "/tmp/resolv.conf"
+	dest   = %q
+	search = %q
+)
+
+func update(b []byte) error {
+	var buf bytes.Buffer
+	searched := false
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		// Search domains of the DHCP server are searched after ours.
+		if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain") {
+			line = "search " + search + " " + strings.Join(fields[1:], " ")
+			searched = true
+		}
+		buf.WriteString(line + "\n")
+	}
+	if !searched {
+		buf.WriteString("search " + search + "\n")
+	}
+	if err := os.WriteFile(dest+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(dest+".tmp", dest)
+}
+
+func main() {
+	log.Printf("adding search domains %%q to %%s", search, source)
+	var last []byte
+	for {
+		b, err := os.ReadFile(source)
+		if err == nil && (last == nil || !bytes.Equal(b, last)) {
+			if err := update(b); err != nil {
+				log.Print(err)
+			} else {
+				last = b
+			}
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+`
+
+// addDNSSearchProgram adds the dns-search program to /user. It needs to be
+// called before generating init, like for all other services.
+func addDNSSearchProgram(root *FileInfo, tmpdir string, domains []string) error {
+	bin, err := buildStandalone(tmpdir, "dns-search", fmt.Sprintf(dnsSearchSource, dnsSearchResolvConf, strings.Join(domains, " ")))
+	if err != nil {
+		return err
+	}
+	user := mustFindDirent(root, "user")
+	user.Dirents = append(user.Dirents, &FileInfo{
+		Filename: "dns-search",
+		FromHost: bin,
+	})
+	return nil
+}
@@ -0,0 +1,112 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEtcConfigApply(t *testing.T) {
+	etc := &FileInfo{Filename: "etc"}
+	etc.Dirents = []*FileInfo{
+		{Filename: "localtime", FromHost: "/etc/localtime"},
+		{Filename: "hosts", FromLiteral: "127.0.0.1 localhost\n"},
+		{Filename: "resolv.conf", SymlinkDest: "/tmp/resolv.conf"},
+		{Filename: "ssl", Dirents: []*FileInfo{
+			{Filename: "ca-bundle.pem", FromLiteral: "system"},
+		}},
+	}
+	ec := &EtcConfig{
+		Remove: []string{"localtime", "not-present"},
+		Files: map[string]string{
+			"hosts":             "127.0.0.1 localhost\n10.0.0.2 broker.local\n",
+			"ssl/ca-bundle.pem": "custom",
+			"app/app.conf":      "port=8080",
+		},
+		Symlinks: map[string]string{
+			"resolv.conf": "/perm/resolv.conf",
+		},
+	}
+	if err := ec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ec.apply(etc); err != nil {
+		t.Fatal(err)
+	}
+	if ent := etc.Find("localtime"); ent != nil {
+		t.Errorf("localtime was not removed")
+	}
+	for name, want := range map[string]string{
+		"hosts":             "10.0.0.2 broker.local",
+		"ssl/ca-bundle.pem": "custom",
+		"app/app.conf":      "port=8080",
+	} {
+		ent := etc.Find(name)
+		if ent == nil {
+			t.Errorf("%s not found", name)
+			continue
+		}
+		if !strings.Contains(ent.FromLiteral, want) {
+			t.Errorf("%s: got %q, want it to contain %q", name, ent.FromLiteral, want)
+		}
+	}
+	if ent := etc.Find("resolv.conf"); ent == nil || ent.SymlinkDest != "/perm/resolv.conf" {
+		t.Errorf("resolv.conf: got %+v, want symlink to /perm/resolv.conf", ent)
+	}
+	if got, want := len(etc.Dirents), 4; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+}
+
+func TestEtcConfigValidate(t *testing.T) {
+	for _, ec := range []*EtcConfig{
+		{Remove: []string{"/etc/hosts"}},
+		{Remove: []string{"../hosts"}},
+		{Remove: []string{"gokr-pw.txt"}},
+		{Remove: []string{"ssl"}},
+		{Files: map[string]string{"ssl/gokrazy-web.pem": ""}},
+		{Files: map[string]string{"gokrazy/sbom.json": ""}},
+		{Files: map[string]string{"hosts": ""}, Symlinks: map[string]string{"hosts": "/perm/hosts"}},
+		{Hosts: []string{"broker.local"}},
+		{Hosts: []string{"10.0.0.2 broker.local"}, Files: map[string]string{"hosts": ""}},
+		{SearchDomains: []string{"lan"}, Remove: []string{"resolv.conf"}},
+	} {
+		if err := ec.Validate(); err == nil {
+			t.Errorf("Validate(%+v) unexpectedly succeeded", ec)
+		}
+	}
+}
+
+func TestEtcConfigHosts(t *testing.T) {
+	entry, err := ParseHostEntry("broker.local,broker=10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entry, "10.0.0.2 broker.local broker"; got != want {
+		t.Errorf("ParseHostEntry: got %q, want %q", got, want)
+	}
+	if _, err := ParseHostEntry("broker.local"); err == nil {
+		t.Errorf("ParseHostEntry(broker.local) unexpectedly succeeded")
+	}
+
+	etc := &FileInfo{Filename: "etc"}
+	etc.Dirents = []*FileInfo{
+		{Filename: "hosts", FromLiteral: "127.0.0.1 localhost\n"},
+		{Filename: "resolv.conf", SymlinkDest: "/tmp/resolv.conf"},
+	}
+	ec := &EtcConfig{
+		Hosts:         []string{entry, "10.0.0.1 gateway"},
+		SearchDomains: []string{"lan"},
+	}
+	if err := ec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ec.apply(etc); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := etc.Find("hosts").FromLiteral, "127.0.0.1 localhost\n10.0.0.2 broker.local broker\n10.0.0.1 gateway\n"; got != want {
+		t.Errorf("/etc/hosts: got %q, want %q", got, want)
+	}
+	if got, want := etc.Find("resolv.conf").SymlinkDest, dnsSearchResolvConf; got != want {
+		t.Errorf("/etc/resolv.conf: got symlink to %q, want %q", got, want)
+	}
+}
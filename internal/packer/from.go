@@ -0,0 +1,72 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+)
+
+// ConfigFrom recovers the instance config of an existing gokrazy installation
+// (see RecoverConfig) for use as defaults when packing: from is either a disk
+// image or storage device, or the hostname of a running instance, whose boot
+// and root partitions are downloaded like in Backup (which requires packing
+// the instance with RemoteExec).
+func ConfigFrom(ctx context.Context, from string, stdout io.Writer) (*config.Struct, error) {
+	if _, err := os.Stat(from); err == nil {
+		f, err := os.Open(from)
+		if err != nil {
+			return nil, fmt.Errorf("%v (for storage devices, use gok clone to copy them into an image first)", err)
+		}
+		defer f.Close()
+		cfg, err := RecoverConfig(f, stdout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", from, err)
+		}
+		return cfg, nil
+	}
+
+	httpClient, _, baseURL, err := httpclient.For(config.NewStruct(from))
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "gokrazy-from")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	for _, what := range []string{"boot", "root"} {
+		fmt.Fprintf(stdout, "Downloading %s partition of %s\n", what, from)
+		u := RemoteExecURL(baseURL, RemoteExecBackupPath+what)
+		if _, err := download(ctx, httpClient, u.String(), filepath.Join(dir, what+".img")); err != nil {
+			return nil, fmt.Errorf("%s: %s partition: %v", from, what, err)
+		}
+	}
+	boot, err := os.Open(filepath.Join(dir, "boot.img"))
+	if err != nil {
+		return nil, err
+	}
+	defer boot.Close()
+	cmdline, err := readBootFile(boot, "/cmdline.txt")
+	if err != nil {
+		return nil, fmt.Errorf("%s: boot partition: %v", from, err)
+	}
+	rootf, err := os.Open(filepath.Join(dir, "root.img"))
+	if err != nil {
+		return nil, err
+	}
+	defer rootf.Close()
+	root, err := newSquashfsReader(rootf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: root partition: %v", from, err)
+	}
+	cfg, err := recoverConfig(boot, cmdline, root, stdout)
+	if err != nil {
+		return nil, fmt.Errorf("%s: root partition: %v", from, err)
+	}
+	return cfg, nil
+}
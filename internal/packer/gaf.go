@@ -2,9 +2,12 @@ package packer
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // overwriteGaf writes a gaf (gokrazy archive format) file
@@ -15,37 +18,33 @@ func (p *Pack) overwriteGaf(root *FileInfo) error {
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(dir)
+	defer p.removeTemp(dir)
 
 	tmpMBR, err := os.Create(filepath.Join(dir, "mbr.img"))
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpMBR.Name())
 
 	tmpBoot, err := os.Create(filepath.Join(dir, "boot.img"))
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpBoot.Name())
 
 	tmpRoot, err := os.Create(filepath.Join(dir, "root.img"))
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpRoot.Name())
 
 	tmpSBOM, err := os.Create(filepath.Join(dir, "sbom.json"))
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpSBOM.Name())
 
 	if err := p.writeBoot(tmpBoot, tmpMBR.Name()); err != nil {
 		return err
 	}
 
-	if err := writeRoot(tmpRoot, root); err != nil {
+	if err := p.writeRoot(tmpRoot, root); err != nil {
 		return err
 	}
 
@@ -63,18 +62,26 @@ func (p *Pack) overwriteGaf(root *FileInfo) error {
 	tmpRoot.Close()
 	tmpSBOM.Close()
 
-	if err := writeGafArchive(dir, p.Output.Path); err != nil {
+	if p.Version != "" {
+		if err := os.WriteFile(filepath.Join(dir, gafVersionFile), []byte(p.Version+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	defer abortPartial(p.Output.Path)
+	if err := writeGafArchive(dir, p.Output.Path+partialSuffix, p.fixedTime); err != nil {
 		return err
 	}
 
-	return nil
+	return p.commitPartial(p.Output.Path)
 }
 
 // writeGafArchive archives build artifacts into
 // a gaf (gokrazy archive format) file
 // by reading artifacts from a source directory
 // and storing them into a newly created, uncompressed zip.
-func writeGafArchive(sourceDir, targetFile string) error {
+// The files keep their modification time unless modTime is non-zero.
+func writeGafArchive(sourceDir, targetFile string, modTime time.Time) error {
 	f, err := os.Create(targetFile)
 	if err != nil {
 		return err
@@ -102,6 +109,9 @@ func writeGafArchive(sourceDir, targetFile string) error {
 		// Don't compress, just "Store" (archive),
 		// to allow direct file access and cheap unarchive.
 		header.Method = zip.Store
+		if !modTime.IsZero() {
+			header.Modified = modTime
+		}
 
 		header.Name, err = filepath.Rel(sourceDir, filePath)
 		if err != nil {
@@ -126,3 +136,52 @@ func writeGafArchive(sourceDir, targetFile string) error {
 		return nil
 	})
 }
+
+// gafImages are the files of gaf archives which make up the image, as opposed
+// to metadata like the version or the SBOM.
+var gafImages = []string{"mbr.img", "boot.img", "root.img"}
+
+// GafImageDigests returns the SHA256 hashes of the images (see gafImages) in
+// the gaf file at path.
+func GafImageDigests(path string) (map[string]string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	digests := make(map[string]string)
+	for _, name := range gafImages {
+		f, err := zr.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		digests[name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// IdenticalGafImages returns whether the gaf files a and b contain
+// bit-identical images, which is only the case for images built with
+// Pack.Reproducible from identical inputs.
+func IdenticalGafImages(a, b string) (bool, error) {
+	digestsA, err := GafImageDigests(a)
+	if err != nil {
+		return false, err
+	}
+	digestsB, err := GafImageDigests(b)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range gafImages {
+		if digestsA[name] != digestsB[name] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestGaf(t *testing.T, root, version string) string {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"mbr.img":      "mbr",
+		"boot.img":     "boot",
+		"root.img":     root,
+		gafVersionFile: version + "\n",
+		"sbom.json":    version, // metadata, not compared
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gaf := filepath.Join(t.TempDir(), "gokrazy.gaf")
+	if err := writeGafArchive(dir, gaf, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	return gaf
+}
+
+func TestIdenticalGafImages(t *testing.T) {
+	published := writeTestGaf(t, "root v1", "v1")
+	for _, tt := range []struct {
+		desc string
+		gaf  string
+		want bool
+	}{
+		{"identical", writeTestGaf(t, "root v1", "v1-rebuilt"), true},
+		{"different root", writeTestGaf(t, "root v2", "v2"), false},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := IdenticalGafImages(tt.gaf, published)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("IdenticalGafImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := IdenticalGafImages(published, filepath.Join(t.TempDir(), "missing.gaf")); err == nil {
+		t.Errorf("IdenticalGafImages(missing file) unexpectedly succeeded")
+	}
+}
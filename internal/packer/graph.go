@@ -0,0 +1,281 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/packer"
+)
+
+// BuildGraph is the graph of the packages of an image: the Go modules which
+// each package depends on, and the image files which it produces. It helps
+// understanding (and pruning) the dependencies of images with many services.
+type BuildGraph struct {
+	Hostname string         `json:"hostname,omitempty"`
+	Packages []GraphPackage `json:"packages"`
+}
+
+// GraphPackage is a package of the BuildGraph.
+type GraphPackage struct {
+	Path string `json:"path"`
+
+	// Kind is how the package ends up in the image: gokrazy, user or init
+	// for programs (in /gokrazy or /user), or kernel, firmware or eeprom for
+	// the packages whose files are copied to the boot file system.
+	Kind string `json:"kind"`
+
+	// Module is the module containing the package.
+	Module *ManifestModule `json:"module,omitempty"`
+
+	// Dependencies are the other modules which the programs of the package
+	// import (directly or indirectly), sorted by path.
+	Dependencies []ManifestModule `json:"dependencies,omitempty"`
+
+	// Files are the files of the image which the package produces: its
+	// programs and extra files, or the files copied to the boot file system.
+	Files []string `json:"files"`
+}
+
+// packageModules returns the module containing pkg and the other modules
+// which pkg imports (directly or indirectly) when built for the target.
+func packageModules(pkg string, tags []string) (*ManifestModule, []ManifestModule, error) {
+	buildDir, err := packer.BuildDirOrMigrate(pkg)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd, err := packer.GoCommand(buildDir, "list",
+		"-deps",
+		"-tags="+strings.Join(tags, ","),
+		"-f", "{{.DepOnly}}{{with .Module}} {{.Path}} {{.Version}}{{with .Replace}} {{.Path}} {{.Version}}{{end}}{{end}}",
+		pkg)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	var main *ManifestModule
+	seen := make(map[string]bool)
+	var deps []ManifestModule
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue // standard library
+		}
+		mm := ManifestModule{Path: fields[1]}
+		if len(fields) > 2 {
+			mm.Version = fields[2]
+		}
+		if len(fields) > 3 {
+			mm.Replace = strings.Join(fields[3:], " ")
+		}
+		if fields[0] == "false" {
+			main = &mm
+			continue
+		}
+		if key := mm.Path + "@" + mm.Version; !seen[key] {
+			seen[key] = true
+			deps = append(deps, mm)
+		}
+	}
+	if main != nil {
+		// The package itself is not a dependency, even if other packages of
+		// its module are.
+		filtered := deps[:0]
+		for _, dep := range deps {
+			if dep.Path != main.Path {
+				filtered = append(filtered, dep)
+			}
+		}
+		deps = filtered
+	}
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Path < deps[j].Path })
+	return main, deps, nil
+}
+
+// extraFilePaths returns the paths of the files in the extra file trees.
+func extraFilePaths(roots []*FileInfo) []string {
+	var paths []string
+	var walk func(dir string, fi *FileInfo)
+	walk = func(dir string, fi *FileInfo) {
+		name := path.Join(dir, fi.Filename)
+		if fi.FromHost != "" || fi.FromLiteral != "" || fi.SymlinkDest != "" {
+			paths = append(paths, name)
+		}
+		for _, ent := range fi.Dirents {
+			walk(name, ent)
+		}
+	}
+	for _, root := range roots {
+		walk("/", root)
+	}
+	return paths
+}
+
+// bootFilesOf returns the files which the packer copies from the package
+// directory dir to the boot file system for the globs.
+func bootFilesOf(dir string, globs []string) ([]string, error) {
+	var files []string
+	for _, glob := range globs {
+		matches, err := filepath.Glob(filepath.Join(dir, glob))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			files = append(files, "/"+filepath.Base(m))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// NewBuildGraph returns the BuildGraph of the image for cfg. It runs the go
+// tool, but does not build anything.
+func NewBuildGraph(cfg *config.Struct) (*BuildGraph, error) {
+	g := &BuildGraph{Hostname: cfg.Hostname}
+	extraFiles, err := FindExtraFiles(cfg)
+	if err != nil {
+		return nil, err
+	}
+	buildEnv := &packer.BuildEnv{
+		BuildDir: packer.BuildDirOrMigrate,
+	}
+	addPrograms := func(kind, dir string, pkgs []string) error {
+		for _, pkg := range pkgs {
+			tags := append(packer.DefaultTags(), cfg.PackageConfig[pkg].GoBuildTags...)
+			main, deps, err := packageModules(pkg, tags)
+			if err != nil {
+				return err
+			}
+			gp := GraphPackage{
+				Path:         pkg,
+				Kind:         kind,
+				Module:       main,
+				Dependencies: deps,
+			}
+			if kind == "init" {
+				// The init program is generated and imports pkg.
+				gp.Files = []string{"/gokrazy/init"}
+			} else {
+				mainPkgs, err := buildEnv.MainPackages([]string{pkg})
+				if err != nil {
+					return err
+				}
+				for _, mp := range mainPkgs {
+					gp.Files = append(gp.Files, path.Join(dir, mp.Basename()))
+				}
+			}
+			gp.Files = append(gp.Files, extraFilePaths(extraFiles[pkg])...)
+			g.Packages = append(g.Packages, gp)
+		}
+		return nil
+	}
+	if err := addPrograms("gokrazy", "/gokrazy", cfg.GokrazyPackagesOrDefault()); err != nil {
+		return nil, err
+	}
+	if err := addPrograms("init", "/gokrazy", packer.InitDeps(cfg.InternalCompatibilityFlags.InitPkg)); err != nil {
+		return nil, err
+	}
+	if err := addPrograms("user", "/user", cfg.Packages); err != nil {
+		return nil, err
+	}
+
+	addBootPackage := func(kind, pkg string, files func(dir string) ([]string, error)) error {
+		mm, err := packageModule(pkg)
+		if err != nil {
+			return err
+		}
+		dir, err := packer.PackageDir(pkg)
+		if err != nil {
+			return err
+		}
+		gp := GraphPackage{
+			Path:   pkg,
+			Kind:   kind,
+			Module: &mm,
+		}
+		if gp.Files, err = files(dir); err != nil {
+			return err
+		}
+		g.Packages = append(g.Packages, gp)
+		return nil
+	}
+	if err := addBootPackage("kernel", cfg.KernelPackageOrDefault(), func(dir string) ([]string, error) {
+		return bootFilesOf(dir, kernelGlobs)
+	}); err != nil {
+		return nil, err
+	}
+	if fw := cfg.FirmwarePackageOrDefault(); fw != "" {
+		if err := addBootPackage("firmware", fw, func(dir string) ([]string, error) {
+			return bootFilesOf(dir, firmwareGlobs)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if e := cfg.EEPROMPackageOrDefault(); e != "" {
+		if err := addBootPackage("eeprom", e, func(string) ([]string, error) {
+			return []string{"/pieeprom.upd", "/vl805.bin", "/recovery.bin"}, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// WriteJSON writes the graph as JSON to w.
+func (g *BuildGraph) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// WriteDOT writes the graph in the DOT language of Graphviz to w, e.g. for
+// rendering it with dot -Tsvg. Packages point to the modules they depend on
+// and to the image files they produce.
+func (g *BuildGraph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph gokrazy {\n")
+	b.WriteString("\trankdir=LR;\n")
+	modules := make(map[string]bool)
+	files := make(map[string]bool)
+	for _, gp := range g.Packages {
+		label := gp.Path
+		if gp.Module != nil && gp.Module.Version != "" {
+			label += "\n" + gp.Module.Version
+		}
+		fmt.Fprintf(&b, "\t%q [shape=box, label=%q];\n", "pkg "+gp.Path, label)
+		for _, dep := range gp.Dependencies {
+			id := "mod " + dep.Path + "@" + dep.Version
+			if !modules[id] {
+				modules[id] = true
+				label := dep.Path
+				if dep.Version != "" {
+					label += "\n" + dep.Version
+				}
+				fmt.Fprintf(&b, "\t%q [shape=ellipse, label=%q];\n", id, label)
+			}
+			fmt.Fprintf(&b, "\t%q -> %q;\n", "pkg "+gp.Path, id)
+		}
+		for _, f := range gp.Files {
+			id := "file " + f
+			if !files[id] {
+				files[id] = true
+				fmt.Fprintf(&b, "\t%q [shape=note, label=%q];\n", id, f)
+			}
+			fmt.Fprintf(&b, "\t%q -> %q [style=dashed];\n", "pkg "+gp.Path, id)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,71 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuildGraphWriteDOT(t *testing.T) {
+	g := &BuildGraph{
+		Packages: []GraphPackage{
+			{
+				Path:   "github.com/gokrazy/hello",
+				Kind:   "user",
+				Module: &ManifestModule{Path: "github.com/gokrazy/hello", Version: "v0.1.0"},
+				Dependencies: []ManifestModule{
+					{Path: "golang.org/x/sys", Version: "v0.5.0"},
+				},
+				Files: []string{"/user/hello", "/etc/hello.conf"},
+			},
+			{
+				Path: "github.com/gokrazy/gokrazy/cmd/dhcp",
+				Kind: "gokrazy",
+				Dependencies: []ManifestModule{
+					{Path: "golang.org/x/sys", Version: "v0.5.0"},
+				},
+				Files: []string{"/gokrazy/dhcp"},
+			},
+		},
+	}
+	var b strings.Builder
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph gokrazy {
+	rankdir=LR;
+	"pkg github.com/gokrazy/hello" [shape=box, label="github.com/gokrazy/hello\nv0.1.0"];
+	"mod golang.org/x/sys@v0.5.0" [shape=ellipse, label="golang.org/x/sys\nv0.5.0"];
+	"pkg github.com/gokrazy/hello" -> "mod golang.org/x/sys@v0.5.0";
+	"file /user/hello" [shape=note, label="/user/hello"];
+	"pkg github.com/gokrazy/hello" -> "file /user/hello" [style=dashed];
+	"file /etc/hello.conf" [shape=note, label="/etc/hello.conf"];
+	"pkg github.com/gokrazy/hello" -> "file /etc/hello.conf" [style=dashed];
+	"pkg github.com/gokrazy/gokrazy/cmd/dhcp" [shape=box, label="github.com/gokrazy/gokrazy/cmd/dhcp"];
+	"pkg github.com/gokrazy/gokrazy/cmd/dhcp" -> "mod golang.org/x/sys@v0.5.0";
+	"file /gokrazy/dhcp" [shape=note, label="/gokrazy/dhcp"];
+	"pkg github.com/gokrazy/gokrazy/cmd/dhcp" -> "file /gokrazy/dhcp" [style=dashed];
+}
+`
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("WriteDOT: unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestExtraFilePaths(t *testing.T) {
+	roots := []*FileInfo{
+		{Dirents: []*FileInfo{
+			{Filename: "etc", Dirents: []*FileInfo{
+				{Filename: "hello.conf", FromLiteral: "greeting=hi"},
+				{Filename: "ssl", Dirents: []*FileInfo{
+					{Filename: "cert.pem", FromHost: "/tmp/cert.pem"},
+				}},
+			}},
+		}},
+	}
+	want := []string{"/etc/hello.conf", "/etc/ssl/cert.pem"}
+	if diff := cmp.Diff(want, extraFilePaths(roots)); diff != "" {
+		t.Errorf("extraFilePaths: unexpected result (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,123 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// hashWriter computes the SHA256 hash of a file while it is being written, so
+// that the provenance and the audit log do not need to read the file again
+// afterwards. The hashing happens in a separate goroutine, concurrently with
+// writing.
+//
+// SHA256 can only hash data in order. Once a write is not at the end of the
+// data hashed so far (e.g. the SquashFS superblock, which is written last, at
+// offset 0), Sum hashes the rest of the file by reading it back.
+type hashWriter struct {
+	f      *os.File
+	off    int64 // current offset in f
+	hashed int64 // number of bytes sent to the hashing goroutine
+
+	// sequential is true as long as all writes appended to the hashed data.
+	sequential bool
+	// rehash is true if a write modified data which was already hashed.
+	rehash bool
+
+	blocks chan []byte
+	done   chan hash.Hash
+}
+
+func newHashWriter(f *os.File) *hashWriter {
+	w := &hashWriter{
+		f:          f,
+		sequential: true,
+		blocks:     make(chan []byte, 16),
+		done:       make(chan hash.Hash),
+	}
+	go func() {
+		h := sha256.New()
+		for b := range w.blocks {
+			h.Write(b)
+		}
+		w.done <- h
+	}()
+	return w
+}
+
+func (w *hashWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	switch {
+	case w.sequential && w.off == w.hashed:
+		// b is re-used by the caller, so the hashing goroutine needs a copy.
+		w.blocks <- append([]byte(nil), b[:n]...)
+		w.hashed += int64(n)
+	case w.off < w.hashed:
+		w.sequential = false
+		w.rehash = true
+	default:
+		w.sequential = false
+	}
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *hashWriter) Read(b []byte) (int, error) {
+	n, err := w.f.Read(b)
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *hashWriter) Seek(offset int64, whence int) (int64, error) {
+	off, err := w.f.Seek(offset, whence)
+	if err != nil {
+		return off, err
+	}
+	w.off = off
+	return off, nil
+}
+
+// Sum returns the hex-encoded SHA256 hash of the file. The hashWriter must
+// not be written to after calling Sum.
+func (w *hashWriter) Sum() (string, error) {
+	close(w.blocks)
+	h := <-w.done
+	st, err := w.f.Stat()
+	if err != nil {
+		return "", err
+	}
+	from := w.hashed
+	if w.rehash || from > st.Size() {
+		h.Reset()
+		from = 0
+	}
+	if _, err := io.Copy(h, io.NewSectionReader(w.f, from, st.Size()-from)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// writeHashed calls write with f. If the hashes of the output files are needed
+// (for the provenance or the audit log, see outputSubjects), f is wrapped into
+// a hashWriter and the hash is recorded for outputSubjects.
+func (p *Pack) writeHashed(f *os.File, write func(w io.ReadWriteSeeker) error) error {
+	if p.Provenance == "" && !auditEnabled() {
+		return write(f)
+	}
+	hw := newHashWriter(f)
+	err := write(hw)
+	sum, sumErr := hw.Sum() // also stops the hashing goroutine
+	if err != nil {
+		return err
+	}
+	if sumErr != nil {
+		return sumErr
+	}
+	if p.digests == nil {
+		p.digests = make(map[string]string)
+	}
+	p.digests[f.Name()] = sum
+	return nil
+}
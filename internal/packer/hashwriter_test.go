@@ -0,0 +1,86 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashWriter(t *testing.T) {
+	block := bytes.Repeat([]byte("gokrazy"), 1000)
+	for _, tt := range []struct {
+		name  string
+		write func(w io.WriteSeeker) error
+	}{
+		{
+			name: "sequential",
+			write: func(w io.WriteSeeker) error {
+				for i := 0; i < 10; i++ {
+					if _, err := w.Write(block); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+
+		{
+			// like the SquashFS writer: the superblock is written last
+			name: "header written last",
+			write: func(w io.WriteSeeker) error {
+				if _, err := w.Seek(96, io.SeekStart); err != nil {
+					return err
+				}
+				if _, err := w.Write(block); err != nil {
+					return err
+				}
+				if _, err := w.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				_, err := w.Write(bytes.Repeat([]byte{0xff}, 96))
+				return err
+			},
+		},
+
+		{
+			name: "gap",
+			write: func(w io.WriteSeeker) error {
+				if _, err := w.Write(block); err != nil {
+					return err
+				}
+				if _, err := w.Seek(4096, io.SeekCurrent); err != nil {
+					return err
+				}
+				_, err := w.Write(block)
+				return err
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "img"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			hw := newHashWriter(f)
+			if err := tt.write(hw); err != nil {
+				t.Fatal(err)
+			}
+			got, err := hw.Sum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%x", sha256.Sum256(b)); got != want {
+				t.Errorf("Sum() = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package packer
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/gokrazy/tools/internal/healthcheck"
+)
+
+// validateHealthChecks verifies that the services with health checks exist in
+// the root file system.
+func validateHealthChecks(checks map[string][]healthcheck.Check, root *FileInfo) error {
+	programs := make(map[string]bool)
+	for _, p := range flattenFiles("/", root) {
+		programs[filepath.Base(p)] = true
+	}
+	for service := range checks {
+		if !programs[filepath.Base(service)] {
+			return fmt.Errorf("health checks: service %s not found in the root file system", service)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package packer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// imageCompressor compresses the full image, see Pack.Compress.
+type imageCompressor struct {
+	// ext is the file name extension of the compressed format, which tools
+	// like the Raspberry Pi Imager use to detect it.
+	ext string
+
+	// command is the program (and its arguments) which compresses stdin to
+	// stdout. If empty, the image is compressed in-process.
+	command []string
+
+	// decompress is the command which writes the decompressed image to
+	// stdout, for the hint on how to write the image to an SD card.
+	decompress string
+}
+
+var imageCompressors = map[string]imageCompressor{
+	"gzip": {
+		ext:        ".gz",
+		decompress: "zcat",
+	},
+
+	// There is no xz or zstd implementation in the standard library, so
+	// these use the commands, which are installed on most systems.
+	"xz": {
+		ext:        ".xz",
+		command:    []string{"xz", "--compress", "--stdout", "--threads=0"},
+		decompress: "xzcat",
+	},
+	"zstd": {
+		ext:        ".zst",
+		command:    []string{"zstd", "--compress", "--stdout", "--quiet", "-T0"},
+		decompress: "zstdcat",
+	},
+}
+
+// ImageCompressions returns the names of the supported full image
+// compression formats.
+func ImageCompressions() []string {
+	names := make([]string, 0, len(imageCompressors))
+	for name := range imageCompressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkCompress verifies that the full image can be written compressed.
+func (p *Pack) checkCompress() error {
+	c, ok := imageCompressors[p.Compress]
+	if !ok {
+		return fmt.Errorf("unknown image compression %q, expected one of %s", p.Compress, strings.Join(ImageCompressions(), ", "))
+	}
+	if p.Shrink {
+		return fmt.Errorf("--compress cannot be combined with --shrink, because gok flash needs to read the uncompressed image")
+	}
+	if p.VMFormat != "" {
+		return fmt.Errorf("--compress cannot be combined with --vm_format")
+	}
+	if len(c.command) > 0 {
+		if _, err := exec.LookPath(c.command[0]); err != nil {
+			return fmt.Errorf("--compress=%s: %v (install %s, or use --compress=gzip)", p.Compress, err, c.command[0])
+		}
+	}
+	return nil
+}
+
+// writeCompressedImage compresses the full image in raw (of size bytes) and
+// writes it to target.
+func (p *Pack) writeCompressedImage(raw *os.File, size int64, target string) error {
+	c := imageCompressors[p.Compress]
+	if !strings.HasSuffix(target, c.ext) {
+		log.Printf("warning: %s does not end in %s, tools like the Raspberry Pi Imager will not recognize it as %s-compressed", target, c.ext, p.Compress)
+	}
+	out, err := createPartial(target)
+	if err != nil {
+		return err
+	}
+	defer abortPartial(target)
+	defer out.Close()
+	if err := c.compress(out, io.NewSectionReader(raw, 0, size)); err != nil {
+		return fmt.Errorf("compressing image %s: %v", target, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := p.commitPartial(target); err != nil {
+		return err
+	}
+	st, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s-compressed image %s (%d MB, uncompressed %d MB)\n", p.Compress, target, st.Size()/MB, size/MB)
+	return nil
+}
+
+func (c imageCompressor) compress(w io.Writer, r io.Reader) error {
+	if len(c.command) == 0 {
+		zw := gzip.NewWriter(w)
+		if _, err := io.Copy(zw, r); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return nil
+}
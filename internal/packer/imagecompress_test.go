@@ -0,0 +1,78 @@
+package packer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCompressedImage(t *testing.T) {
+	raw, err := os.CreateTemp(t.TempDir(), "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	want := append(bytes.Repeat([]byte{0}, 1<<20), []byte("gokrazy")...)
+	if _, err := raw.Write(want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range ImageCompressions() {
+		t.Run(compression, func(t *testing.T) {
+			c := imageCompressors[compression]
+			p := &Pack{Compress: compression}
+			if err := p.checkCompress(); err != nil {
+				t.Skip(err)
+			}
+			target := filepath.Join(t.TempDir(), "gokrazy.img"+c.ext)
+			if err := p.writeCompressedImage(raw, int64(len(want)), target); err != nil {
+				t.Fatal(err)
+			}
+			var got []byte
+			if compression == "gzip" {
+				f, err := os.Open(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				zr, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				got, err = exec.Command(c.decompress, target).Output()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decompressed image differs: got %d bytes, want %d bytes", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestCheckCompress(t *testing.T) {
+	for _, tt := range []struct {
+		pack Pack
+		want string
+	}{
+		{Pack{Compress: "bzip2"}, "unknown image compression"},
+		{Pack{Compress: "gzip", Shrink: true}, "--shrink"},
+		{Pack{Compress: "gzip", VMFormat: "qcow2"}, "--vm_format"},
+	} {
+		err := tt.pack.checkCompress()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("checkCompress(%q) = %v, want error containing %q", tt.pack.Compress, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package packer
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// gafVersionFile is the name of the file in gaf archives which contains the
+// image version (see Pack.Version).
+const gafVersionFile = "version.txt"
+
+// dirtySuffix is appended to the image version by git describe --dirty when
+// the working tree has uncommitted changes.
+const dirtySuffix = "-dirty"
+
+// ImageVersion derives an image version from the git repository containing
+// dir (using git describe, e.g. v1.2.0-3-g1a2b3c4, or v1.2.0-dirty if there
+// are uncommitted changes). The version is empty if dir is not in a git
+// repository (or git is not installed).
+func ImageVersion(dir string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", nil
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "describe", "--tags", "--always", "--dirty="+dirtySuffix)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// e.g. not a git repository, or no commits yet
+			return "", nil
+		}
+		return "", fmt.Errorf("%v: %v: %s", cmd.Args, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// IsDirtyVersion returns whether the image version was built from a working
+// tree with uncommitted changes.
+func IsDirtyVersion(version string) bool {
+	return strings.HasSuffix(version, dirtySuffix)
+}
+
+// osReleaseContents returns the contents of /etc/os-release (see
+// os-release(5)) for an image of the version.
+func osReleaseContents(version, buildTimestamp string) string {
+	return fmt.Sprintf(`NAME="gokrazy"
+ID=gokrazy
+PRETTY_NAME="gokrazy %s"
+HOME_URL="https://gokrazy.org/"
+IMAGE_ID=gokrazy
+IMAGE_VERSION=%q
+BUILD_ID=%q
+`, version, version, buildTimestamp)
+}
+
+// GafVersion returns the image version stored in the gaf (gokrazy archive
+// format) file at path, or the empty string if the image has no version.
+func GafVersion(path string) (string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	f, err := zr.Open(gafVersionFile)
+	if err != nil {
+		return "", nil // gaf files without version
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
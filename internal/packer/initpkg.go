@@ -0,0 +1,245 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/packer"
+	"golang.org/x/mod/semver"
+)
+
+// initGeneratedSuffix is appended to the -overwrite_init path for the copy of
+// the generated init, which is compared against the currently generated init
+// when building with -init_pkg to detect drift.
+const initGeneratedSuffix = ".generated"
+
+const gokrazyModule = "github.com/gokrazy/gokrazy"
+
+// buildTimestampRe matches the line of the generated init which changes with
+// every build.
+var buildTimestampRe = regexp.MustCompile(`(?m)^var buildTimestamp = .*$`)
+
+// checkInitPkg verifies that the -init_pkg package imports the gokrazy
+// package in a version which is not older than the one used by the rest of
+// the image, and that the init it was dumped from did not drift from the
+// init which gokrazy generates now.
+func (g *gokrazyInit) checkInitPkg(cfg *config.Struct) error {
+	initPkg := cfg.InternalCompatibilityFlags.InitPkg
+	initVersion, err := gokrazyVersionOf(initPkg)
+	if err != nil {
+		return err
+	}
+	if initVersion == "" {
+		return fmt.Errorf("-init_pkg=%q does not import %s, which init needs to boot and supervise services", initPkg, gokrazyModule)
+	}
+	imageVersion, err := imageGokrazyVersion(cfg)
+	if err != nil {
+		return err
+	}
+	if semver.IsValid(initVersion) && semver.IsValid(imageVersion) && semver.Compare(initVersion, imageVersion) < 0 {
+		return fmt.Errorf("-init_pkg=%q uses %s@%s, which is older than %s@%s used by the rest of the image; update it with: go get %s@%s",
+			initPkg,
+			gokrazyModule, initVersion,
+			gokrazyModule, imageVersion,
+			gokrazyModule, imageVersion)
+	}
+
+	dir, err := packer.PackageDir(initPkg)
+	if err != nil {
+		return err
+	}
+	generated, err := g.generate()
+	if err != nil {
+		return err
+	}
+	return checkInitDrift(dir, generated)
+}
+
+// gokrazyVersionOf returns the version of the gokrazy module which pkg
+// imports (directly or indirectly), or the empty string if pkg does not import
+// the gokrazy package.
+func gokrazyVersionOf(pkg string) (string, error) {
+	buildDir, err := packer.BuildDirOrMigrate(pkg)
+	if err != nil {
+		return "", err
+	}
+	cmd, err := packer.GoCommand(buildDir, "list",
+		"-deps",
+		"-tags", strings.Join(packer.DefaultTags(), ","),
+		"-f", "{{ .ImportPath }} {{ with .Module }}{{ .Version }}{{ end }}",
+		pkg)
+	if err != nil {
+		return "", err
+	}
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		importPath, version, _ := strings.Cut(line, " ")
+		if importPath == gokrazyModule {
+			if version == "" {
+				// e.g. replaced with a local working copy
+				version = "(devel)"
+			}
+			return version, nil
+		}
+	}
+	return "", nil
+}
+
+// imageGokrazyVersion returns the version of the gokrazy module which the
+// gokrazy packages of the image are built with, or the empty string if the
+// image contains none.
+func imageGokrazyVersion(cfg *config.Struct) (string, error) {
+	for _, pkg := range cfg.GokrazyPackagesOrDefault() {
+		if !strings.HasPrefix(pkg, gokrazyModule+"/") {
+			continue
+		}
+		buildDir, err := packer.BuildDirOrMigrate(pkg)
+		if err != nil {
+			return "", err
+		}
+		cmd, err := packer.GoCommand(buildDir, "list", "-m", "-f", "{{ .Version }}", gokrazyModule)
+		if err != nil {
+			return "", err
+		}
+		b, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", nil
+}
+
+// checkInitDrift compares the copies of the generated init in dir (written
+// by gokrazyInit.dump) with the currently generated init.
+func checkInitDrift(dir string, generated []byte) error {
+	copies, err := filepath.Glob(filepath.Join(dir, "*.go"+initGeneratedSuffix))
+	if err != nil {
+		return err
+	}
+	for _, fn := range copies {
+		dumped, err := os.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		before := buildTimestampRe.ReplaceAll(dumped, nil)
+		after := buildTimestampRe.ReplaceAll(generated, nil)
+		if bytes.Equal(before, after) {
+			continue
+		}
+		initGo := strings.TrimSuffix(fn, initGeneratedSuffix)
+		return fmt.Errorf("the generated init changed since %s was dumped (e.g. because of config changes or a gokrazy update). Apply these changes to %s (or dump it again with -overwrite_init=%s), then update %s:\n%s",
+			initGo,
+			initGo,
+			initGo,
+			fn,
+			unifiedDiff(fn, "generated init", string(before), string(after)))
+	}
+	return nil
+}
+
+// unifiedDiff returns the differences between a and b in unified diff format
+// (with 3 lines of context).
+func unifiedDiff(aName, bName, a, b string) string {
+	lines := func(s string) []string {
+		l := strings.SplitAfter(s, "\n")
+		if l[len(l)-1] == "" {
+			l = l[:len(l)-1]
+		}
+		return l
+	}
+	al, bl := lines(a), lines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of al[i:] and
+	// bl[j:].
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type op struct {
+		kind byte // ' ', '-' or '+'
+		line string
+		a, b int // line numbers (0-based) before this op
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			ops = append(ops, op{' ', al[i], i, j})
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', al[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', bl[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+	prevTo := 0
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk until more than 2*context unchanged lines follow.
+		end := start
+		for k := start; k < len(ops) && k-end-1 <= 2*context; k++ {
+			if ops[k].kind != ' ' {
+				end = k
+			}
+		}
+		from := start - context
+		if from < prevTo {
+			from = prevTo
+		}
+		to := end + context + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+		var aCount, bCount int
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				aCount++
+			}
+			if o.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", ops[from].a+1, aCount, ops[from].b+1, bCount)
+		for _, o := range ops[from:to] {
+			buf.WriteByte(o.kind)
+			buf.WriteString(o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start, prevTo = to, to
+	}
+	return buf.String()
+}
@@ -0,0 +1,53 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\n"
+	b := "one\nTWO\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\ntwelve\n"
+	got := unifiedDiff("a", "b", a, b)
+	want := `--- a
++++ b
+@@ -1,5 +1,5 @@
+ one
+-two
++TWO
+ three
+ four
+ five
+@@ -9,3 +9,4 @@
+ nine
+ ten
+ eleven
++twelve
+`
+	if got != want {
+		t.Errorf("unifiedDiff: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCheckInitDrift(t *testing.T) {
+	dir := t.TempDir()
+	const dumped = "package main\n\nvar buildTimestamp = \"2023-01-01\"\n\nfunc main() {}\n"
+	if err := os.WriteFile(filepath.Join(dir, "init.go"+initGeneratedSuffix), []byte(dumped), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the build timestamp changed:
+	if err := checkInitDrift(dir, []byte(strings.Replace(dumped, "2023-01-01", "2023-02-02", 1))); err != nil {
+		t.Errorf("checkInitDrift: %v", err)
+	}
+
+	err := checkInitDrift(dir, []byte(strings.Replace(dumped, "func main() {}", "func main() { boot() }", 1)))
+	if err == nil {
+		t.Fatal("checkInitDrift unexpectedly succeeded")
+	}
+	if !strings.Contains(err.Error(), "-func main() {}\n+func main() { boot() }\n") {
+		t.Errorf("checkInitDrift error does not contain the diff: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// integrityManifestPath is the path of the manifest containing the SHA256
+// hash of each file in the root file system.
+const integrityManifestPath = "/etc/gokrazy/integrity.json"
+
+type integrityManifest struct {
+	// Files maps absolute paths to hex-encoded SHA256 hashes.
+	Files map[string]string
+}
+
+// integrityCheckSource is the source of the integrity-check program, which
+// gokrazy starts on boot (like all programs in /user). It verifies the files
+// of the root file system against the integrity manifest. Results are visible
+// in the gokrazy web interface (the status and log of the integrity-check
+// service).
+const integrityCheckSource = `package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const manifestPath = %q
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%%x", h.Sum(nil)), nil
+}
+
+func main() {
+	b, err := os.ReadFile(manifestPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var manifest struct {
+		Files map[string]string
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		log.Fatalf("%%s: %%v", manifestPath, err)
+	}
+	paths := make([]string, 0, len(manifest.Files))
+	for path := range manifest.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var corrupt int
+	for _, path := range paths {
+		got, err := hashFile(path)
+		if err != nil {
+			log.Printf("CORRUPT: %%v", err)
+			corrupt++
+			continue
+		}
+		if want := manifest.Files[path]; got != want {
+			log.Printf("CORRUPT: %%s: sha256 %%s, want %%s", path, got, want)
+			corrupt++
+		}
+	}
+	if corrupt > 0 {
+		log.Printf("root file system integrity check FAILED: %%d of %%d files corrupt, re-flash the SD card (or replace it)", corrupt, len(paths))
+		// Stay running so that the failure remains visible in the web
+		// interface instead of being restarted over and over.
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+	log.Printf("root file system integrity check passed: %%d files verified", len(paths))
+	os.Exit(125) // do not restart
+}
+`
+
+// addIntegrityCheckProgram adds the integrity-check program to /user.
+func addIntegrityCheckProgram(root *FileInfo, tmpdir string) error {
+	bin, err := buildStandalone(tmpdir, "integrity-check", fmt.Sprintf(integrityCheckSource, integrityManifestPath))
+	if err != nil {
+		return err
+	}
+	user := mustFindDirent(root, "user")
+	user.Dirents = append(user.Dirents, &FileInfo{
+		Filename: "integrity-check",
+		FromHost: bin,
+	})
+	return nil
+}
+
+// addIntegrityManifest adds the integrity manifest of all files in the root
+// file system to /etc/gokrazy. It must be called once the root file system is
+// complete.
+func addIntegrityManifest(root *FileInfo) error {
+	manifest := integrityManifest{Files: make(map[string]string)}
+	var walk func(dir string, fi *FileInfo) error
+	walk = func(dir string, fi *FileInfo) error {
+		for _, ent := range fi.Dirents {
+			p := path.Join(dir, ent.Filename)
+			if ent.SymlinkDest != "" {
+				continue
+			}
+			if !ent.IsFile() {
+				if err := walk(p, ent); err != nil {
+					return err
+				}
+				continue
+			}
+			hash, _, err := hashFileInfo(ent)
+			if err != nil {
+				return err
+			}
+			manifest.Files[p] = hash
+		}
+		return nil
+	}
+	if err := walk("/", root); err != nil {
+		return err
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	etcGokrazy := mustFindDirent(mustFindDirent(root, "etc"), "gokrazy")
+	etcGokrazy.Dirents = append(etcGokrazy.Dirents, &FileInfo{
+		Filename:    path.Base(integrityManifestPath),
+		FromLiteral: string(b),
+	})
+	fmt.Printf("Integrity manifest: %d files\n", len(manifest.Files))
+	return nil
+}
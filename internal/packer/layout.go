@@ -0,0 +1,284 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/gokrazy/tools/internal/exfat"
+	"github.com/gokrazy/tools/internal/ext4"
+	"github.com/gokrazy/tools/packer"
+)
+
+// parseSize parses a size in bytes with an optional K, M or G suffix (powers
+// of 1024, optionally followed by B or iB), e.g. 512M or 2GiB.
+func parseSize(s string) (uint64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(num, "K"):
+		mult = 1024
+	case strings.HasSuffix(num, "M"):
+		mult = MB
+	case strings.HasSuffix(num, "G"):
+		mult = 1024 * MB
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: expected e.g. 512M or 2G", s)
+	}
+	return n * mult, nil
+}
+
+// ParsePartitionSize parses a boot or root partition size flag value, e.g.
+// 256M. The empty string selects the default size.
+func ParsePartitionSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return parseSize(s)
+}
+
+// ParseExtraPartition parses a <name>:<size>:<type>[:<source>] flag value,
+// e.g. data:2G:fat or db:512M:raw:/tmp/db.img
+func ParseExtraPartition(s string) (packer.ExtraPartition, error) {
+	parts := strings.SplitN(s, ":", 4)
+	if len(parts) < 3 {
+		return packer.ExtraPartition{}, fmt.Errorf("invalid extra partition %q: expected <name>:<size>:<type>[:<source>], e.g. data:2G:fat", s)
+	}
+	size, err := parseSize(parts[1])
+	if err != nil {
+		return packer.ExtraPartition{}, fmt.Errorf("invalid extra partition %q: %v", s, err)
+	}
+	e := packer.ExtraPartition{
+		Name: parts[0],
+		Size: size,
+		Type: parts[2],
+	}
+	if len(parts) == 4 {
+		e.Source = parts[3]
+	}
+	if err := e.Validate(); err != nil {
+		return packer.ExtraPartition{}, err
+	}
+	return e, nil
+}
+
+// layoutFile is the format of --layout files: packer.Layout with sizes as
+// strings like in the flags (e.g. 2G).
+type layoutFile struct {
+	BootSize       string
+	RootSize       string
+	BootFileSystem string
+	SingleSlot     bool
+	Extra          []struct {
+		Name   string
+		Size   string
+		Type   string
+		Source string
+	}
+	Expose string
+}
+
+// ReadLayout reads a partition layout from the JSON file path, e.g.:
+//
+//	{
+//	  "RootSize": "1G",
+//	  "Extra": [
+//	    {"Name": "datastore", "Size": "4G", "Type": "linux", "Source": "datastore.img"}
+//	  ]
+//	}
+//
+// Relative Source paths are relative to the directory containing the file.
+func ReadLayout(path string) (packer.Layout, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return packer.Layout{}, err
+	}
+	defer f.Close()
+	var lf layoutFile
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&lf); err != nil {
+		return packer.Layout{}, fmt.Errorf("%s: %v", path, err)
+	}
+	layout := packer.Layout{
+		BootFileSystem: lf.BootFileSystem,
+		SingleSlot:     lf.SingleSlot,
+		Expose:         lf.Expose,
+	}
+	if layout.BootSize, err = ParsePartitionSize(lf.BootSize); err != nil {
+		return packer.Layout{}, fmt.Errorf("%s: BootSize: %v", path, err)
+	}
+	if layout.RootSize, err = ParsePartitionSize(lf.RootSize); err != nil {
+		return packer.Layout{}, fmt.Errorf("%s: RootSize: %v", path, err)
+	}
+	for _, e := range lf.Extra {
+		size, err := parseSize(e.Size)
+		if err != nil {
+			return packer.Layout{}, fmt.Errorf("%s: extra partition %q: %v", path, e.Name, err)
+		}
+		source := e.Source
+		if source != "" && !filepath.IsAbs(source) {
+			source = filepath.Join(filepath.Dir(path), source)
+		}
+		layout.Extra = append(layout.Extra, packer.ExtraPartition{
+			Name:   e.Name,
+			Size:   size,
+			Type:   e.Type,
+			Source: source,
+		})
+	}
+	if err := layout.Validate(); err != nil {
+		return packer.Layout{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return layout, nil
+}
+
+// writeExtraPartitions copies the source image of each extra partition (if
+// any) into the partition on f, a device of devsize bytes.
+func (p *Pack) writeExtraPartitions(f io.WriteSeeker, devsize uint64) error {
+	for i, first := range p.ExtraPartitionLBAs(devsize) {
+		e := p.Layout.Extra[i]
+		if e.Source == "" {
+			continue
+		}
+		src, err := os.Open(e.Source)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		st, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		if uint64(st.Size()) > e.Size {
+			return fmt.Errorf("extra partition %q: source %s (%d bytes) does not fit into the partition (%d bytes)", e.Name, e.Source, st.Size(), e.Size)
+		}
+		if _, err := f.Seek(int64(first*512), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, src); err != nil {
+			return err
+		}
+		if err := src.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printExtraPartitions prints where the extra partitions (if any) are
+// located, so that they can be formatted and used by applications.
+func (p *Pack) printExtraPartitions(devsize uint64) {
+	if len(p.Layout.Extra) == 0 {
+		return
+	}
+	fmt.Printf("Extra partitions:\n")
+	for i, first := range p.ExtraPartitionLBAs(devsize) {
+		e := p.Layout.Extra[i]
+		content := "empty"
+		if e.Source != "" {
+			content = "from " + e.Source
+		}
+		fmt.Printf("\t%d. %s (%s, %d MB, %s): /dev/disk/by-partuuid/%s, offset %d\n",
+			5+i, e.Name, e.Type, e.Size/MB, content, p.GPTPARTUUID(uint16(5+i)), first*512)
+	}
+	fmt.Printf("\n")
+}
+
+// SetPermFileSystem validates PermFileSystem and PermLabel. A perm partition
+// formatted as exFAT uses the exFAT partition type, which requires it to be
+// the exposed partition.
+func (p *Pack) SetPermFileSystem() error {
+	switch p.PermFileSystem {
+	case "":
+		return nil
+	case "ext4":
+		if len(p.PermLabel) > 16 {
+			return fmt.Errorf("perm label %q too long: ext4 volume labels are at most 16 bytes", p.PermLabel)
+		}
+		if p.Layout.Expose == "perm" {
+			return fmt.Errorf("formatting the perm partition as ext4 conflicts with exposing it: Windows and macOS cannot read ext4, use exFAT instead")
+		}
+		return nil
+	case "exfat":
+		if n := len(utf16.Encode([]rune(p.PermLabel))); n > 11 {
+			return fmt.Errorf("perm label %q too long: exFAT volume labels are at most 11 characters", p.PermLabel)
+		}
+		if p.Layout.Expose == "" {
+			p.Layout.Expose = "perm"
+		}
+		if p.Layout.Expose != "perm" {
+			return fmt.Errorf("formatting the perm partition as exFAT requires exposing the perm partition, but partition %q is exposed", p.Layout.Expose)
+		}
+		return nil
+	default:
+		return fmt.Errorf("formatting the perm partition as %q is not supported (supported: exfat, ext4)", p.PermFileSystem)
+	}
+}
+
+// PartitionTables returns the supported values of Pack.PartitionTable.
+func PartitionTables() []string {
+	return []string{"hybrid", "gpt", "mbr"}
+}
+
+// SetPartitionTable validates PartitionTable and configures the partition
+// table of p.Pack accordingly. mbrOnly is true if the board or device type
+// requires an MBR-only partition table; a board booting via UEFI defaults to
+// gpt.
+func (p *Pack) SetPartitionTable(mbrOnly bool) error {
+	uefi := p.Board != nil && p.Board.UEFI
+	table := p.PartitionTable
+	switch table {
+	case "":
+		table = "hybrid"
+		if mbrOnly {
+			table = "mbr"
+		} else if uefi {
+			table = "gpt"
+		}
+	case "hybrid", "gpt", "mbr":
+	default:
+		return fmt.Errorf("unknown partition table %q (supported: %s)", table, strings.Join(PartitionTables(), ", "))
+	}
+	if mbrOnly && table != "mbr" {
+		return fmt.Errorf("partition table %s: this device requires an MBR-only partition table (the GPT would overwrite its bootloader)", table)
+	}
+	if uefi && table != "gpt" {
+		return fmt.Errorf("partition table %s: booting via UEFI requires a GPT with a protective MBR", table)
+	}
+	if table == "gpt" && p.Layout.Expose != "" {
+		return fmt.Errorf("cannot expose partition %q: only the hybrid partition table has room for it in the MBR", p.Layout.Expose)
+	}
+	p.Pack.UseGPT = table != "mbr"
+	p.Pack.ProtectiveMBR = table == "gpt"
+	return nil
+}
+
+// formatPerm creates the PermFileSystem (if any) on the perm partition of f, a
+// device of devsize bytes.
+func (p *Pack) formatPerm(f io.WriterAt, devsize uint64) error {
+	size := int64(p.PermSizeInKB(devsize)) * 1024
+	switch p.PermFileSystem {
+	case "exfat":
+		if err := exfat.Format(f, p.PermOffset(), size, p.PermLabel, p.Partuuid); err != nil {
+			return err
+		}
+		fmt.Printf("Formatted the perm partition (%d MB) as exFAT, label %q\n\n", size/MB, p.PermLabel)
+	case "ext4":
+		if err := ext4.Format(f, p.PermOffset(), size, p.PermLabel, p.now()); err != nil {
+			return fmt.Errorf("formatting the perm partition: %v", err)
+		}
+		fmt.Printf("Formatted the perm partition (%d MB) as ext4, label %q\n\n", size/MB, p.PermLabel)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+func TestSetPartitionTable(t *testing.T) {
+	uefi := &Board{Name: "amd64", UEFI: true}
+	for _, tt := range []struct {
+		name      string
+		table     string
+		board     *Board
+		mbrOnly   bool
+		expose    string
+		wantGPT   bool
+		wantPMBR  bool
+		wantError bool
+	}{
+		{name: "default", wantGPT: true},
+		{name: "hybrid", table: "hybrid", wantGPT: true},
+		{name: "gpt", table: "gpt", wantGPT: true, wantPMBR: true},
+		{name: "mbr", table: "mbr"},
+		{name: "mbr-only device", mbrOnly: true},
+		{name: "mbr-only device with gpt", table: "gpt", mbrOnly: true, wantError: true},
+		{name: "uefi board", board: uefi, wantGPT: true, wantPMBR: true},
+		{name: "uefi board with hybrid", table: "hybrid", board: uefi, wantError: true},
+		{name: "gpt with exposed partition", table: "gpt", expose: "perm", wantError: true},
+		{name: "unknown", table: "apm", wantError: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pack{
+				Pack:           packer.NewPackForHost("parttabletest"),
+				PartitionTable: tt.table,
+				Board:          tt.board,
+			}
+			p.Layout.Expose = tt.expose
+			err := p.SetPartitionTable(tt.mbrOnly)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("SetPartitionTable(%v) = nil, want error", tt.mbrOnly)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.UseGPT != tt.wantGPT || p.ProtectiveMBR != tt.wantPMBR {
+				t.Errorf("SetPartitionTable(%v): UseGPT=%v ProtectiveMBR=%v, want UseGPT=%v ProtectiveMBR=%v",
+					tt.mbrOnly, p.UseGPT, p.ProtectiveMBR, tt.wantGPT, tt.wantPMBR)
+			}
+		})
+	}
+}
+
+func TestSetPermFileSystem(t *testing.T) {
+	for _, tt := range []struct {
+		fs, label, expose string
+		wantError         bool
+	}{
+		{fs: "exfat", label: "GOKRAZY"},
+		{fs: "exfat", label: "TWELVE_CHARS", wantError: true},
+		{fs: "ext4", label: "GOKRAZY"},
+		{fs: "ext4", label: "seventeen-bytes!!", wantError: true},
+		{fs: "ext4", label: "GOKRAZY", expose: "perm", wantError: true},
+		{fs: "btrfs", wantError: true},
+	} {
+		p := &Pack{PermFileSystem: tt.fs, PermLabel: tt.label}
+		p.Layout.Expose = tt.expose
+		err := p.SetPermFileSystem()
+		if gotError := err != nil; gotError != tt.wantError {
+			t.Errorf("SetPermFileSystem(%q, label %q, expose %q) = %v, want error: %v", tt.fs, tt.label, tt.expose, err, tt.wantError)
+		}
+	}
+}
+
+func TestReadLayout(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name      string
+		json      string
+		want      packer.Layout
+		wantError bool
+	}{
+		{
+			name: "extra",
+			json: `{"RootSize": "1G", "SingleSlot": true, "Extra": [{"Name": "datastore", "Size": "4G", "Type": "linux", "Source": "datastore.img"}]}`,
+			want: packer.Layout{
+				RootSize:   1024 * MB,
+				SingleSlot: true,
+				Extra: []packer.ExtraPartition{
+					{Name: "datastore", Size: 4096 * MB, Type: "linux", Source: filepath.Join(dir, "datastore.img")},
+				},
+			},
+		},
+		{name: "empty", json: `{}`},
+		{name: "unknown field", json: `{"Partitions": []}`, wantError: true},
+		{name: "invalid size", json: `{"BootSize": "lots"}`, wantError: true},
+		{name: "invalid type", json: `{"Extra": [{"Name": "db", "Size": "1G", "Type": "zfs"}]}`, wantError: true},
+		{name: "unknown expose", json: `{"Expose": "db"}`, wantError: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "layout.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadLayout(path)
+			if gotError := err != nil; gotError != tt.wantError {
+				t.Fatalf("ReadLayout() = %v, want error: %v", err, tt.wantError)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadLayout() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
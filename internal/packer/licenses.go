@@ -0,0 +1,314 @@
+package packer
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/gokrazy/tools/packer"
+	"golang.org/x/mod/module"
+)
+
+// licenseFileNames are the file names which are searched for license texts in
+// the root directory of each module, in order of preference.
+var licenseFileNames = []string{
+	"LICENSE",
+	"LICENSE.md",
+	"LICENSE.txt",
+	"LICENCE",
+	"COPYING",
+	"COPYING.md",
+	"COPYING.txt",
+}
+
+// licenseSignatures identify common licenses by characteristic phrases. All
+// phrases of an entry must be present in the (whitespace-normalized) license
+// text. Entries are checked in order, more specific licenses first.
+var licenseSignatures = []struct {
+	spdx    string
+	phrases []string
+}{
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"MPL-2.0", []string{"mozilla public license", "version 2.0"}},
+	{"AGPL-3.0", []string{"gnu affero general public license", "version 3"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license", "version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license", "version 2.1"}},
+	{"GPL-3.0", []string{"gnu general public license", "version 3"}},
+	{"GPL-2.0", []string{"gnu general public license", "version 2"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"ISC", []string{"permission to use, copy, modify, and", "distribute this software for any purpose"}},
+	{"MIT", []string{"permission is hereby granted, free of charge"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+}
+
+// identifyLicense returns the SPDX identifier of the license text, or
+// "unknown" if the license could not be identified.
+func identifyLicense(text []byte) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(string(text)), " "))
+	for _, sig := range licenseSignatures {
+		matches := true
+		for _, phrase := range sig.phrases {
+			if !strings.Contains(normalized, phrase) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return sig.spdx
+		}
+	}
+	return "unknown"
+}
+
+// ModuleLicense is the license information for one Go module which was built
+// into (or, for kernel and firmware packages, copied into) the image.
+type ModuleLicense struct {
+	Path    string
+	Version string
+
+	// SPDX is the SPDX identifier of the license, "unknown" if it could not be
+	// identified, or "none" if no license file was found.
+	SPDX string
+
+	// LicenseFile is the path to the license file on the host, if found.
+	LicenseFile string
+}
+
+func findLicenseFile(dir string) string {
+	for _, fn := range licenseFileNames {
+		path := filepath.Join(dir, fn)
+		if st, err := os.Stat(path); err == nil && st.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+func newModuleLicense(path, version, dir string) ModuleLicense {
+	ml := ModuleLicense{
+		Path:    path,
+		Version: version,
+		SPDX:    "none",
+	}
+	if dir == "" {
+		return ml
+	}
+	ml.LicenseFile = findLicenseFile(dir)
+	if ml.LicenseFile == "" {
+		return ml
+	}
+	b, err := os.ReadFile(ml.LicenseFile)
+	if err != nil {
+		ml.SPDX = "unknown"
+		return ml
+	}
+	ml.SPDX = identifyLicense(b)
+	return ml
+}
+
+func goEnvDirs() (modCache, goroot string, _ error) {
+	cmd := exec.Command("go", "env", "GOMODCACHE", "GOROOT")
+	cmd.Env = packer.Env()
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return "", "", fmt.Errorf("%v: unexpected output %q", cmd.Args, out)
+	}
+	return lines[0], lines[1], nil
+}
+
+// moduleDir returns the directory of the specified module version in the
+// module cache, or the empty string if it cannot be located.
+func moduleDir(modCache, path, version string) string {
+	escPath, err := module.EscapePath(path)
+	if err != nil {
+		return ""
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Join(modCache, escPath+"@"+escVersion)
+	if _, err := os.Stat(dir); err != nil {
+		return ""
+	}
+	return dir
+}
+
+// goModules returns the modules (after applying replace directives) which
+// were compiled into the Go binaries of root, in order of appearance, and the
+// Go version which was used to build the binaries.
+func goModules(root *FileInfo) (modules []*debug.Module, goVersion string) {
+	seen := make(map[string]bool)
+	var walk func(fi *FileInfo)
+	walk = func(fi *FileInfo) {
+		if fi.FromHost != "" {
+			info, err := buildinfo.ReadFile(fi.FromHost)
+			if err != nil {
+				return // not a Go binary
+			}
+			goVersion = info.GoVersion
+			for _, dep := range info.Deps {
+				mod := dep
+				if dep.Replace != nil {
+					mod = dep.Replace
+				}
+				key := mod.Path + "@" + mod.Version
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				modules = append(modules, dep)
+			}
+		}
+		for _, ent := range fi.Dirents {
+			walk(ent)
+		}
+	}
+	walk(root)
+	return modules, goVersion
+}
+
+// collectLicenses returns the licenses of all modules which were compiled into
+// the Go binaries of root, plus the modules of the noBuildPkgs (kernel and
+// firmware) and the Go standard library, sorted by module path. The license
+// report is best-effort and never fails a build: modules whose directory
+// cannot be located are listed without license (SPDX "none").
+func collectLicenses(root *FileInfo, noBuildPkgs []string) []ModuleLicense {
+	modCache, goroot, err := goEnvDirs()
+	if err != nil {
+		log.Printf("warning: license report: %v", err)
+	}
+	modules, goVersion := goModules(root)
+	var licenses []ModuleLicense
+	for _, dep := range modules {
+		mod := dep
+		if dep.Replace != nil {
+			mod = dep.Replace
+		}
+		var dir string
+		if mod.Version == "" {
+			// replace directive that references a FilePath
+			if filepath.IsAbs(mod.Path) {
+				dir = mod.Path
+			}
+		} else if modCache != "" {
+			dir = moduleDir(modCache, mod.Path, mod.Version)
+		}
+		licenses = append(licenses, newModuleLicense(dep.Path, dep.Version, dir))
+	}
+
+	for _, pkg := range noBuildPkgs {
+		dir, err := packer.PackageDir(pkg)
+		if err != nil {
+			log.Printf("warning: license report: %v", err)
+		}
+		licenses = append(licenses, newModuleLicense(pkg, "", dir))
+	}
+
+	if goVersion != "" {
+		licenses = append(licenses, newModuleLicense("std", goVersion, goroot))
+	}
+
+	sort.Slice(licenses, func(i, j int) bool {
+		if licenses[i].Path != licenses[j].Path {
+			return licenses[i].Path < licenses[j].Path
+		}
+		return licenses[i].Version < licenses[j].Version
+	})
+	return licenses
+}
+
+// licenseReport formats licenses as a plain text table.
+func licenseReport(licenses []ModuleLicense) string {
+	var buf bytes.Buffer
+	buf.WriteString("# Licenses of the Go modules included in this gokrazy image.\n")
+	buf.WriteString("# module\tversion\tSPDX identifier\n")
+	for _, ml := range licenses {
+		version := ml.Version
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", ml.Path, version, ml.SPDX)
+	}
+	return buf.String()
+}
+
+// licenseSummary returns a one-line summary like "MIT (3), BSD-3-Clause (2)".
+func licenseSummary(licenses []ModuleLicense) string {
+	counts := make(map[string]int)
+	for _, ml := range licenses {
+		counts[ml.SPDX]++
+	}
+	ids := make([]string, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if counts[ids[i]] != counts[ids[j]] {
+			return counts[ids[i]] > counts[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	parts := make([]string, len(ids))
+	for idx, id := range ids {
+		parts[idx] = fmt.Sprintf("%s (%d)", id, counts[id])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func findOrCreateDir(parent *FileInfo, name string) *FileInfo {
+	for _, ent := range parent.Dirents {
+		if ent.Filename == name && !ent.IsFile() {
+			return ent
+		}
+	}
+	dir := &FileInfo{Filename: name}
+	parent.Dirents = append(parent.Dirents, dir)
+	return dir
+}
+
+// licensesDir returns the /etc/licenses directory for the image, containing
+// the license report and, if withTexts is true, the license text of each
+// module (in <module>@<version>/<license file name>).
+func licensesDir(licenses []ModuleLicense, withTexts bool) *FileInfo {
+	dir := &FileInfo{Filename: "licenses"}
+	dir.Dirents = append(dir.Dirents, &FileInfo{
+		Filename:    "LICENSES.txt",
+		FromLiteral: licenseReport(licenses),
+	})
+	if !withTexts {
+		return dir
+	}
+	for _, ml := range licenses {
+		if ml.LicenseFile == "" {
+			continue
+		}
+		name := ml.Path
+		if ml.Version != "" {
+			name += "@" + ml.Version
+		}
+		parent := dir
+		for _, part := range strings.Split(name, "/") {
+			parent = findOrCreateDir(parent, part)
+		}
+		parent.Dirents = append(parent.Dirents, &FileInfo{
+			Filename: filepath.Base(ml.LicenseFile),
+			FromHost: ml.LicenseFile,
+		})
+	}
+	return dir
+}
@@ -0,0 +1,93 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// loopTargetPrefix selects a disk image file (e.g. the disk of a VM) as target
+// of the full image, which is attached as loop device for the duration of the
+// build, e.g. -overwrite=loop:/var/lib/vms/gokrazy.img. Contrary to writing to
+// the file directly, the file keeps its size and the partitions are available
+// as loop device partitions while packing.
+const loopTargetPrefix = "loop:"
+
+// AbsTarget turns the path of the full image target into an absolute path,
+// leaving targets which are not paths (e.g. -, fd:3 or ssh://flasher:/dev/sdb)
+// unchanged.
+func AbsTarget(target string) (string, error) {
+	if target == streamStdout {
+		return target, nil
+	}
+	for _, prefix := range []string{streamFDPrefix, sshTargetPrefix, nbdTargetPrefix} {
+		if strings.HasPrefix(target, prefix) {
+			return target, nil
+		}
+	}
+	if target == usbbootTargetPrefix {
+		return target, nil
+	}
+	for _, prefix := range []string{loopTargetPrefix, usbbootTargetPrefix} {
+		if !strings.HasPrefix(target, prefix) {
+			continue
+		}
+		abs, err := filepath.Abs(strings.TrimPrefix(target, prefix))
+		if err != nil {
+			return "", err
+		}
+		return prefix + abs, nil
+	}
+	return filepath.Abs(target)
+}
+
+// losetup returns a losetup command, which runs with sudo unless running as
+// root or sudo is never.
+func losetup(sudo string, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 || sudo == "never" {
+		return exec.Command("losetup", args...)
+	}
+	return exec.Command("sudo", append([]string{"losetup"}, args...)...)
+}
+
+// attachLoop attaches the disk image file as loop device (with partition
+// scanning), creating a sparse file of size bytes if it does not exist yet.
+func attachLoop(file string, size int64, sudo string) (dev string, detach func() error, _ error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if size == 0 {
+			return "", nil, fmt.Errorf("%s does not exist; specify --target_storage_bytes to create it", file)
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return "", nil, err
+		}
+		if err := f.Close(); err != nil {
+			return "", nil, err
+		}
+		fmt.Printf("Created %s (%d MB)\n", file, size/MB)
+	}
+	cmd := losetup(sudo, "--find", "--show", "--partscan", file)
+	cmd.Stderr = os.Stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	dev = strings.TrimSpace(string(b))
+	fmt.Printf("Attached %s as loop device %s\n", file, dev)
+	detach = func() error {
+		cmd := losetup(sudo, "--detach", dev)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%v: %v", cmd.Args, err)
+		}
+		fmt.Printf("Detached loop device %s\n", dev)
+		return nil
+	}
+	return dev, detach, nil
+}
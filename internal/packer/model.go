@@ -0,0 +1,167 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// raspberryPiModel describes which boot files one Raspberry Pi model needs.
+type raspberryPiModel struct {
+	// name is used in messages, e.g. Raspberry Pi 4.
+	name string
+
+	// firmware is the prefix (with start/fixup) of the GPU firmware files the
+	// model boots: "" for start.elf and fixup.dat, "4" for start4.elf and
+	// fixup4.dat, or "none" for models which boot without them.
+	firmware string
+
+	// dtb is the device tree file which the kernel package needs to contain.
+	dtb string
+
+	// eeprom is true for models whose bootloader EEPROM can be updated with
+	// the EEPROM package.
+	eeprom bool
+
+	// goarch and goarm are the GOARCH and GOARM values for the model's CPU,
+	// if it cannot run the default arm64 (see packer.TargetArch).
+	goarch, goarm string
+}
+
+var raspberryPiModels = map[string]raspberryPiModel{
+	"pi3":   {name: "Raspberry Pi 3", firmware: "", dtb: "bcm2710-rpi-3-b.dtb"},
+	"pi3+":  {name: "Raspberry Pi 3B+", firmware: "", dtb: "bcm2710-rpi-3-b-plus.dtb"},
+	"pi0":   {name: "Raspberry Pi Zero", firmware: "", dtb: "bcm2708-rpi-zero.dtb", goarch: "arm", goarm: "6"},
+	"pi0w":  {name: "Raspberry Pi Zero W", firmware: "", dtb: "bcm2708-rpi-zero-w.dtb", goarch: "arm", goarm: "6"},
+	"pi02":  {name: "Raspberry Pi Zero 2 W", firmware: "", dtb: "bcm2710-rpi-zero-2-w.dtb"},
+	"pi4":   {name: "Raspberry Pi 4", firmware: "4", dtb: "bcm2711-rpi-4-b.dtb", eeprom: true},
+	"pi400": {name: "Raspberry Pi 400", firmware: "4", dtb: "bcm2711-rpi-400.dtb", eeprom: true},
+	"cm4":   {name: "Compute Module 4", firmware: "4", dtb: "bcm2711-rpi-cm4.dtb", eeprom: true},
+	"pi5":   {name: "Raspberry Pi 5", firmware: "none", dtb: "bcm2712-rpi-5-b.dtb"},
+}
+
+// Models returns the Raspberry Pi models which Pack.Model accepts.
+func Models() []string {
+	models := make([]string, 0, len(raspberryPiModels))
+	for model := range raspberryPiModels {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// model returns the Raspberry Pi model of Pack.Model, or nil if the image
+// should boot on all supported models.
+func (p *Pack) model() (*raspberryPiModel, error) {
+	if p.Model == "" {
+		return nil, nil
+	}
+	m, ok := raspberryPiModels[p.Model]
+	if !ok {
+		return nil, fmt.Errorf("unknown model %q, expected one of %s", p.Model, strings.Join(Models(), ", "))
+	}
+	return &m, nil
+}
+
+// setGoEnv makes the go tool build for the model's CPU: it sets GOARCH and
+// GOARM unless they are already set, and returns an error if they conflict
+// with the model.
+func (m *raspberryPiModel) setGoEnv() error {
+	if m == nil {
+		return nil
+	}
+	return setGoEnv(m.name, m.goarch, m.goarm)
+}
+
+// setGoEnv sets GOARCH and GOARM (if non-empty) for the target what, returning
+// an error if the environment already specifies different values.
+func setGoEnv(what, goarch, goarm string) error {
+	if goarch == "" {
+		return nil
+	}
+	for _, kv := range []struct{ key, value string }{
+		{"GOARCH", goarch},
+		{"GOARM", goarm},
+	} {
+		if kv.value == "" {
+			continue
+		}
+		if v := os.Getenv(kv.key); v != "" && v != kv.value {
+			return fmt.Errorf("the %s requires %s=%s, but %s=%s is set", what, kv.key, kv.value, kv.key, v)
+		}
+		if err := os.Setenv(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configTxt adapts the config.txt of the kernel package to the model.
+func (m *raspberryPiModel) configTxt(config string) string {
+	if m == nil || m.goarch != "arm" {
+		return config
+	}
+	// 32-bit models cannot boot a kernel in 64-bit mode.
+	lines := strings.Split(config, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "arm_64bit=1" {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n")
+}
+
+// firmwareFile returns whether the model boots the firmware file base
+// (bootcode.bin, start*.elf or fixup*.dat). Other files are always used.
+func (m *raspberryPiModel) firmwareFile(base string) bool {
+	if m == nil {
+		return true
+	}
+	if base == "bootcode.bin" {
+		// Only models before the Raspberry Pi 4 load bootcode.bin from the SD
+		// card, newer ones have their bootloader in the EEPROM.
+		return m.firmware == ""
+	}
+	var rest string
+	switch {
+	case strings.HasPrefix(base, "start") && strings.HasSuffix(base, ".elf"):
+		rest = strings.TrimSuffix(strings.TrimPrefix(base, "start"), ".elf")
+	case strings.HasPrefix(base, "fixup") && strings.HasSuffix(base, ".dat"):
+		rest = strings.TrimSuffix(strings.TrimPrefix(base, "fixup"), ".dat")
+	default:
+		return true
+	}
+	// e.g. start.elf, start_x.elf (Raspberry Pi 3) or start4.elf, start4x.elf
+	// (Raspberry Pi 4)
+	is4 := strings.HasPrefix(rest, "4")
+	switch m.firmware {
+	case "4":
+		return is4
+	case "":
+		return !is4
+	}
+	return false
+}
+
+// checkKernel returns an error if the kernel package in kernelDir cannot boot
+// the model.
+func (m *raspberryPiModel) checkKernel(kernelDir, kernelPackage string) error {
+	if m == nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(kernelDir, m.dtb)); err != nil {
+		if os.IsNotExist(err) {
+			err := fmt.Errorf("kernel package %s does not support the %s: %s not found", kernelPackage, m.name, m.dtb)
+			if m.goarch == "arm" {
+				err = fmt.Errorf("%v (the %s needs a 32-bit kernel package)", err, m.name)
+			}
+			return err
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModelFirmwareFile(t *testing.T) {
+	files := []string{
+		"bootcode.bin",
+		"start.elf",
+		"start_x.elf",
+		"fixup.dat",
+		"fixup_cd.dat",
+		"start4.elf",
+		"start4x.elf",
+		"fixup4.dat",
+		"fixup4db.dat",
+		"overlay_map.dtb",
+	}
+	for _, tt := range []struct {
+		model string
+		want  string
+	}{
+		{"", strings.Join(files, " ")},
+		{"pi3", "bootcode.bin start.elf start_x.elf fixup.dat fixup_cd.dat overlay_map.dtb"},
+		{"pi4", "start4.elf start4x.elf fixup4.dat fixup4db.dat overlay_map.dtb"},
+		{"pi5", "overlay_map.dtb"},
+	} {
+		p := &Pack{Model: tt.model}
+		m, err := p.model()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range files {
+			if m.firmwareFile(f) {
+				got = append(got, f)
+			}
+		}
+		if got := strings.Join(got, " "); got != tt.want {
+			t.Errorf("model %q: firmware files = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+
+	if _, err := (&Pack{Model: "pi6"}).model(); err == nil {
+		t.Errorf("unknown model pi6 unexpectedly accepted")
+	}
+}
+
+func TestModelCheckKernel(t *testing.T) {
+	kernelDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(kernelDir, "bcm2711-rpi-4-b.dtb"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pi4 := raspberryPiModels["pi4"]
+	if err := pi4.checkKernel(kernelDir, "example.com/kernel"); err != nil {
+		t.Errorf("checkKernel(pi4) = %v", err)
+	}
+	pi5 := raspberryPiModels["pi5"]
+	if err := pi5.checkKernel(kernelDir, "example.com/kernel"); err == nil {
+		t.Errorf("checkKernel(pi5) unexpectedly succeeded without bcm2712-rpi-5-b.dtb")
+	}
+}
+
+func TestModelGoEnv(t *testing.T) {
+	t.Setenv("GOARCH", "")
+	t.Setenv("GOARM", "")
+	pi0w := raspberryPiModels["pi0w"]
+	if err := pi0w.setGoEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := os.Getenv("GOARCH")+"/"+os.Getenv("GOARM"), "arm/6"; got != want {
+		t.Errorf("GOARCH/GOARM = %q, want %q", got, want)
+	}
+
+	t.Setenv("GOARCH", "arm64")
+	if err := pi0w.setGoEnv(); err == nil {
+		t.Errorf("setGoEnv() unexpectedly succeeded with GOARCH=arm64")
+	}
+
+	const config = "arm_64bit=1\nenable_uart=1\n"
+	if got, want := pi0w.configTxt(config), "enable_uart=1\n"; got != want {
+		t.Errorf("configTxt(pi0w) = %q, want %q", got, want)
+	}
+	pi02 := raspberryPiModels["pi02"]
+	if got := pi02.configTxt(config); got != config {
+		t.Errorf("configTxt(pi02) = %q, want %q", got, config)
+	}
+}
@@ -0,0 +1,136 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ModelImage is one of the images which a multi-model build (see
+// Pack.ModelImages) produces: one per Raspberry Pi model, each with the
+// kernel and firmware packages pinned for the model, if any.
+type ModelImage struct {
+	// Model is the Raspberry Pi model, see Pack.Model.
+	Model string
+
+	// KernelPackage and FirmwarePackage override the kernel and firmware
+	// packages of the instance config for this model, if non-empty.
+	KernelPackage   string
+	FirmwarePackage string
+}
+
+// ParseModelImages parses a comma-separated list of
+// <model>[=<kernel package>[:<firmware package>]] entries, e.g.
+// pi3,pi4,pi5=github.com/gokrazy/kernel.rpi
+func ParseModelImages(s string) ([]ModelImage, error) {
+	var images []ModelImage
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		model, pins, _ := strings.Cut(entry, "=")
+		if _, ok := raspberryPiModels[model]; !ok {
+			return nil, fmt.Errorf("invalid model %q: expected one of %s", entry, strings.Join(Models(), ", "))
+		}
+		if seen[model] {
+			return nil, fmt.Errorf("model %s specified more than once", model)
+		}
+		seen[model] = true
+		kernel, firmware, _ := strings.Cut(pins, ":")
+		images = append(images, ModelImage{
+			Model:           model,
+			KernelPackage:   kernel,
+			FirmwarePackage: firmware,
+		})
+	}
+	return images, nil
+}
+
+// forModelImage returns a copy of pack which builds the image of mi. The copy
+// has its own instance config, as logic modifies it.
+func (pack *Pack) forModelImage(mi ModelImage) *Pack {
+	p := *pack
+	p.ModelImages = nil
+	p.Model = mi.Model
+	cfg := *pack.Cfg
+	if cfg.InternalCompatibilityFlags != nil {
+		flags := *cfg.InternalCompatibilityFlags
+		cfg.InternalCompatibilityFlags = &flags
+	}
+	if cfg.Update != nil {
+		update := *cfg.Update
+		cfg.Update = &update
+	}
+	if mi.KernelPackage != "" {
+		kernel := mi.KernelPackage
+		cfg.KernelPackage = &kernel
+	}
+	if mi.FirmwarePackage != "" {
+		firmware := mi.FirmwarePackage
+		cfg.FirmwarePackage = &firmware
+	}
+	p.Cfg = &cfg
+	if pack.Output != nil {
+		output := *pack.Output
+		p.Output = &output
+	}
+	return &p
+}
+
+// mainModelImages builds one image per ModelImages entry. The go tool caches
+// the compiled packages, so only the first image of each GOARCH builds them.
+func (pack *Pack) mainModelImages(programName string) error {
+	cfg := pack.Cfg
+	if cfg.InternalCompatibilityFlags.Update != "" {
+		return fmt.Errorf("-models builds images, it cannot be used for updating a device")
+	}
+	if pack.Model != "" {
+		return fmt.Errorf("-models conflicts with -model")
+	}
+	paths := []string{
+		cfg.InternalCompatibilityFlags.Overwrite,
+		cfg.InternalCompatibilityFlags.OverwriteBoot,
+		cfg.InternalCompatibilityFlags.OverwriteRoot,
+		cfg.InternalCompatibilityFlags.OverwriteMBR,
+		pack.Provenance,
+	}
+	if pack.Output != nil {
+		paths = append(paths, pack.Output.Path)
+	}
+	outputs := 0
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		outputs++
+		if !strings.Contains(path, ".Model") {
+			return fmt.Errorf("output path %q needs to contain {{.Model}} with -models, so that each image gets its own path", path)
+		}
+	}
+	if outputs == 0 {
+		return fmt.Errorf("-models requires an output path containing {{.Model}}")
+	}
+
+	// Models like the pi0 set GOARCH and GOARM, which the next model must
+	// not inherit.
+	goarch, goarm := os.Getenv("GOARCH"), os.Getenv("GOARM")
+	restoreGoEnv := func() {
+		for _, kv := range []struct{ key, value string }{
+			{"GOARCH", goarch},
+			{"GOARM", goarm},
+		} {
+			if kv.value == "" {
+				os.Unsetenv(kv.key)
+			} else {
+				os.Setenv(kv.key, kv.value)
+			}
+		}
+	}
+	defer restoreGoEnv()
+	for idx, mi := range pack.ModelImages {
+		restoreGoEnv()
+		fmt.Printf("\n=== Building image %d of %d: %s\n", idx+1, len(pack.ModelImages), raspberryPiModels[mi.Model].name)
+		if err := pack.forModelImage(mi).run(programName); err != nil {
+			return fmt.Errorf("%s: %v", mi.Model, err)
+		}
+	}
+	return nil
+}
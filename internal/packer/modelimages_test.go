@@ -0,0 +1,63 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseModelImages(t *testing.T) {
+	got, err := ParseModelImages("pi3,pi4=:example.com/firmware,pi5=github.com/gokrazy/kernel.rpi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ModelImage{
+		{Model: "pi3"},
+		{Model: "pi4", FirmwarePackage: "example.com/firmware"},
+		{Model: "pi5", KernelPackage: "github.com/gokrazy/kernel.rpi"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseModelImages: unexpected result (-want +got):\n%s", diff)
+	}
+
+	for _, tt := range []struct {
+		s       string
+		wantErr string
+	}{
+		{"pi3,rpi4", "invalid model"},
+		{"pi3,pi3", "more than once"},
+		{"", "invalid model"},
+	} {
+		if _, err := ParseModelImages(tt.s); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseModelImages(%q) = %v, want error containing %q", tt.s, err, tt.wantErr)
+		}
+	}
+}
+
+func TestForModelImage(t *testing.T) {
+	cfg := config.NewStruct("scanner")
+	cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{
+		Overwrite: "/tmp/gokrazy-{{.Model}}.img",
+	}
+	pack := &Pack{
+		Cfg:         cfg,
+		ModelImages: []ModelImage{{Model: "pi5", KernelPackage: "github.com/gokrazy/kernel.rpi"}},
+	}
+	p := pack.forModelImage(pack.ModelImages[0])
+	if p.Model != "pi5" || p.ModelImages != nil {
+		t.Errorf("forModelImage: Model = %q, ModelImages = %v, want pi5 and none", p.Model, p.ModelImages)
+	}
+	if got, want := p.Cfg.KernelPackageOrDefault(), "github.com/gokrazy/kernel.rpi"; got != want {
+		t.Errorf("kernel package = %q, want %q", got, want)
+	}
+	// Expanding the output paths of one image must not modify the others.
+	p.Cfg.InternalCompatibilityFlags.Overwrite = "/tmp/gokrazy-pi5.img"
+	if got := cfg.InternalCompatibilityFlags.Overwrite; got != "/tmp/gokrazy-{{.Model}}.img" {
+		t.Errorf("original output path modified: %q", got)
+	}
+	if cfg.KernelPackage != nil {
+		t.Errorf("original kernel package modified: %q", *cfg.KernelPackage)
+	}
+}
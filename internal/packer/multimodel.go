@@ -0,0 +1,123 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// ExtraKernel is an additional kernel package which the Raspberry Pi firmware
+// boots on the models matching Filter, instead of the kernel package of the
+// instance config. All models share the same (arm64) root file system.
+type ExtraKernel struct {
+	// Filter is a Raspberry Pi config.txt conditional filter, see
+	// https://www.raspberrypi.com/documentation/computers/config_txt.html#model-filters
+	Filter string
+
+	// Package is the Go package containing vmlinuz and *.dtb files, e.g.
+	// github.com/gokrazy/kernel.rpi
+	Package string
+}
+
+var modelFilters = map[string]bool{
+	"pi1":   true,
+	"pi2":   true,
+	"pi3":   true,
+	"pi3+":  true,
+	"pi4":   true,
+	"pi400": true,
+	"pi5":   true,
+	"pi500": true,
+	"cm4":   true,
+	"cm4s":  true,
+	"cm5":   true,
+	"pi0":   true,
+	"pi0w":  true,
+	"pi02":  true,
+}
+
+// ParseExtraKernel parses a <filter>=<package> flag value, e.g.
+// pi5=github.com/gokrazy/kernel.rpi
+func ParseExtraKernel(s string) (ExtraKernel, error) {
+	filter, pkg, ok := strings.Cut(s, "=")
+	if !ok || pkg == "" {
+		return ExtraKernel{}, fmt.Errorf("invalid extra kernel %q: expected <model filter>=<go package>, e.g. pi5=github.com/gokrazy/kernel.rpi", s)
+	}
+	if !modelFilters[filter] {
+		return ExtraKernel{}, fmt.Errorf("invalid extra kernel %q: unknown model filter %q", s, filter)
+	}
+	return ExtraKernel{Filter: filter, Package: pkg}, nil
+}
+
+func (ek ExtraKernel) vmlinuz() string {
+	return "vmlinuz-" + ek.Filter
+}
+
+// extraKernelPackages returns the packages of the extra kernels, so that they
+// are downloaded along with the other kernel and firmware packages.
+func (p *Pack) extraKernelPackages() []string {
+	pkgs := make([]string, 0, len(p.ExtraKernels))
+	for _, ek := range p.ExtraKernels {
+		pkgs = append(pkgs, ek.Package)
+	}
+	return pkgs
+}
+
+// writeExtraKernels copies the vmlinuz of each extra kernel as
+// vmlinuz-<filter> and its device tree files to the boot file system. Device
+// tree files which are already present (written is keyed by destination path)
+// are not overwritten.
+func (p *Pack) writeExtraKernels(fw *bootFS, written map[string]bool) error {
+	for _, ek := range p.ExtraKernels {
+		kernelDir, err := packer.PackageDir(ek.Package)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Kernel directory for [%s]: %s\n", ek.Filter, kernelDir)
+		src, err := os.Open(filepath.Join(kernelDir, "vmlinuz"))
+		if err != nil {
+			return err
+		}
+		if err := copyFile(fw, "/"+ek.vmlinuz(), src); err != nil {
+			return err
+		}
+		written["/"+ek.vmlinuz()] = true
+		matches, err := filepath.Glob(filepath.Join(kernelDir, "*.dtb"))
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			dest := "/" + filepath.Base(m)
+			if written[dest] {
+				continue
+			}
+			src, err := os.Open(m)
+			if err != nil {
+				return err
+			}
+			if err := copyFile(fw, dest, src); err != nil {
+				return err
+			}
+			written[dest] = true
+		}
+	}
+	return nil
+}
+
+// extraKernelConfig returns the config.txt sections which select the extra
+// kernels on the matching models.
+func (p *Pack) extraKernelConfig() string {
+	if len(p.ExtraKernels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n# added by gokrazy for --extra_kernel\n")
+	for _, ek := range p.ExtraKernels {
+		fmt.Fprintf(&sb, "[%s]\nkernel=%s\n", ek.Filter, ek.vmlinuz())
+	}
+	sb.WriteString("[all]\n")
+	return sb.String()
+}
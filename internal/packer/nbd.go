@@ -0,0 +1,242 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// nbdTargetPrefix selects an export of a network block device server (e.g.
+// qemu-nbd serving a VM disk) as target of the full image, e.g.
+// -overwrite=nbd://localhost:10809/disk
+const nbdTargetPrefix = "nbd://"
+
+const nbdDefaultPort = "10809"
+
+// Constants of the NBD protocol, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic        = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic     = 0x49484156454f5054 // "IHAVEOPT"
+	nbdRequestMagic = 0x25609513
+	nbdReplyMagic   = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdOptExportName = 1
+
+	nbdFlagReadOnly        = 1 << 1
+	nbdFlagSendFlush       = 1 << 2
+	nbdFlagSendWriteZeroes = 1 << 6
+
+	nbdCmdWrite       = 1
+	nbdCmdDisc        = 2
+	nbdCmdFlush       = 3
+	nbdCmdWriteZeroes = 6
+)
+
+// nbdChunkSize is the number of bytes written per request.
+const nbdChunkSize = 1 << 20
+
+// nbdTarget is an export of a network block device server.
+type nbdTarget struct {
+	addr   string // host:port
+	export string
+}
+
+// parseNBDTarget parses an nbd://<host>[:<port>][/<export>] target.
+func parseNBDTarget(target string) (nbdTarget, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || u.Scheme+"://" != nbdTargetPrefix {
+		return nbdTarget{}, fmt.Errorf("invalid target %q: expected nbd://<host>[:<port>][/<export>], e.g. nbd://localhost/disk", target)
+	}
+	port := u.Port()
+	if port == "" {
+		port = nbdDefaultPort
+	}
+	return nbdTarget{
+		addr:   net.JoinHostPort(u.Hostname(), port),
+		export: strings.TrimPrefix(u.Path, "/"),
+	}, nil
+}
+
+// nbdConn is a connection in the transmission phase.
+type nbdConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	size   uint64
+	flags  uint16
+	handle uint64
+}
+
+// dial connects to the server and negotiates the export (fixed newstyle
+// handshake with NBD_OPT_EXPORT_NAME).
+func (t nbdTarget) dial() (*nbdConn, error) {
+	conn, err := net.Dial("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &nbdConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.handshake(t.export); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nbd://%s/%s: %v", t.addr, t.export, err)
+	}
+	return c, nil
+}
+
+func (c *nbdConn) handshake(export string) error {
+	var greeting struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &greeting); err != nil {
+		return err
+	}
+	if greeting.Magic != nbdMagic || greeting.OptMagic != nbdOptMagic {
+		return fmt.Errorf("not an NBD server, or only supporting the oldstyle handshake")
+	}
+	if greeting.Flags&nbdFlagFixedNewstyle == 0 {
+		return fmt.Errorf("server does not support the fixed newstyle handshake")
+	}
+	clientFlags := uint32(nbdFlagFixedNewstyle)
+	noZeroes := greeting.Flags&nbdFlagNoZeroes != 0
+	if noZeroes {
+		clientFlags |= nbdFlagNoZeroes
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, clientFlags)
+	binary.Write(&buf, binary.BigEndian, uint64(nbdOptMagic))
+	binary.Write(&buf, binary.BigEndian, uint32(nbdOptExportName))
+	binary.Write(&buf, binary.BigEndian, uint32(len(export)))
+	buf.WriteString(export)
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	var reply struct {
+		Size  uint64
+		Flags uint16
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &reply); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("server closed the connection (unknown export %q?)", export)
+		}
+		return err
+	}
+	if !noZeroes {
+		if _, err := io.CopyN(io.Discard, c.r, 124); err != nil {
+			return err
+		}
+	}
+	if reply.Flags&nbdFlagReadOnly != 0 {
+		return fmt.Errorf("export %q is read-only", export)
+	}
+	c.size, c.flags = reply.Size, reply.Flags
+	return nil
+}
+
+// request sends a request and waits for its (simple) reply.
+func (c *nbdConn) request(typ uint16, offset uint64, length uint32, data []byte) error {
+	c.handle++
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, struct {
+		Magic  uint32
+		Flags  uint16
+		Type   uint16
+		Handle uint64
+		Offset uint64
+		Length uint32
+	}{nbdRequestMagic, 0, typ, c.handle, offset, length})
+	buf.Write(data)
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if typ == nbdCmdDisc {
+		return nil // no reply
+	}
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &reply); err != nil {
+		return err
+	}
+	if reply.Magic != nbdReplyMagic || reply.Handle != c.handle {
+		return fmt.Errorf("unexpected reply (magic %#x, handle %d)", reply.Magic, reply.Handle)
+	}
+	if reply.Error != 0 {
+		return fmt.Errorf("request (type %d, offset %d, length %d) failed with error %d", typ, offset, length, reply.Error)
+	}
+	return nil
+}
+
+func (c *nbdConn) Close() error {
+	c.request(nbdCmdDisc, 0, 0, nil)
+	return c.conn.Close()
+}
+
+// size returns the size of the export in bytes.
+func (t nbdTarget) size() (int64, error) {
+	c, err := t.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	return int64(c.size), nil
+}
+
+// write writes the image in f to the export. All-zero chunks are written with
+// NBD_CMD_WRITE_ZEROES if the server supports it, which is much faster for
+// the mostly empty image.
+func (t nbdTarget) write(f *os.File) error {
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(st.Size()) > c.size {
+		return fmt.Errorf("image (%d bytes) does not fit into nbd://%s/%s (%d bytes)", st.Size(), t.addr, t.export, c.size)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fmt.Printf("Writing image (%d MB) to nbd://%s/%s\n", st.Size()/MB, t.addr, t.export)
+	zero := make([]byte, nbdChunkSize)
+	chunk := make([]byte, nbdChunkSize)
+	for offset := uint64(0); ; {
+		n, err := io.ReadFull(f, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if c.flags&nbdFlagSendWriteZeroes != 0 && bytes.Equal(chunk[:n], zero[:n]) {
+			err = c.request(nbdCmdWriteZeroes, offset, uint32(n), nil)
+		} else {
+			err = c.request(nbdCmdWrite, offset, uint32(n), chunk[:n])
+		}
+		if err != nil {
+			return fmt.Errorf("nbd://%s/%s: %v", t.addr, t.export, err)
+		}
+		offset += uint64(n)
+	}
+	if c.flags&nbdFlagSendFlush != 0 {
+		if err := c.request(nbdCmdFlush, 0, 0, nil); err != nil {
+			return fmt.Errorf("nbd://%s/%s: %v", t.addr, t.export, err)
+		}
+	}
+	return nil
+}
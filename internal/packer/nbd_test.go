@@ -0,0 +1,150 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveNBD handles one connection of the fixed newstyle protocol for an
+// export of disk, supporting writes, write zeroes and flushes.
+func serveNBD(t *testing.T, conn net.Conn, export string, disk []byte) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	binary.Write(conn, binary.BigEndian, struct {
+		Magic    uint64
+		OptMagic uint64
+		Flags    uint16
+	}{nbdMagic, nbdOptMagic, nbdFlagFixedNewstyle | nbdFlagNoZeroes})
+	var opt struct {
+		ClientFlags uint32
+		Magic       uint64
+		Option      uint32
+		Length      uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &opt); err != nil {
+		t.Error(err)
+		return
+	}
+	name := make([]byte, opt.Length)
+	if _, err := io.ReadFull(r, name); err != nil {
+		t.Error(err)
+		return
+	}
+	if opt.Option != nbdOptExportName || string(name) != export {
+		return // closing the connection rejects the export
+	}
+	binary.Write(conn, binary.BigEndian, struct {
+		Size  uint64
+		Flags uint16
+	}{uint64(len(disk)), 1 | nbdFlagSendFlush | nbdFlagSendWriteZeroes})
+	for {
+		var req struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(r, binary.BigEndian, &req); err != nil {
+			t.Error(err)
+			return
+		}
+		switch req.Type {
+		case nbdCmdDisc:
+			return
+		case nbdCmdWrite:
+			if _, err := io.ReadFull(r, disk[req.Offset:req.Offset+uint64(req.Length)]); err != nil {
+				t.Error(err)
+				return
+			}
+		case nbdCmdWriteZeroes:
+			copy(disk[req.Offset:], make([]byte, req.Length))
+		}
+		binary.Write(conn, binary.BigEndian, struct {
+			Magic  uint32
+			Error  uint32
+			Handle uint64
+		}{nbdReplyMagic, 0, req.Handle})
+	}
+}
+
+func TestNBDTargetWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	disk := bytes.Repeat([]byte{0xff}, 3*nbdChunkSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serveNBD(t, conn, "disk", disk)
+		}
+	}()
+
+	target := "nbd://" + ln.Addr().String() + "/disk"
+	if size, err := streamTargetSize(target); err != nil || size != int64(len(disk)) {
+		t.Fatalf("streamTargetSize(%q) = %d, %v, want %d", target, size, err, len(disk))
+	}
+	if _, err := streamTargetSize("nbd://" + ln.Addr().String() + "/other"); err == nil || !strings.Contains(err.Error(), "unknown export") {
+		t.Errorf("streamTargetSize(<unknown export>) = %v, want unknown export error", err)
+	}
+
+	// An image with data, an all-zero chunk and a partial chunk.
+	contents := append(bytes.Repeat([]byte("gokrazy!"), nbdChunkSize/8), make([]byte, nbdChunkSize)...)
+	contents = append(contents, []byte("end")...)
+	img, err := os.Create(filepath.Join(t.TempDir(), "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if _, err := img.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := streamImage(target, img); err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	<-done
+	if !bytes.Equal(disk[:len(contents)], contents) {
+		t.Errorf("export contents differ from the image")
+	}
+	if disk[len(contents)] != 0xff {
+		t.Errorf("bytes after the image were modified")
+	}
+}
+
+func TestAbsTarget(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{
+		"fd:3":                   "fd:3",
+		"ssh://flasher:/dev/sdb": "ssh://flasher:/dev/sdb",
+		"nbd://localhost/disk":   "nbd://localhost/disk",
+		"loop:vm.img":            "loop:" + filepath.Join(wd, "vm.img"),
+		"gokrazy.img":            filepath.Join(wd, "gokrazy.img"),
+	} {
+		got, err := AbsTarget(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("AbsTarget(%q) = %q, want %q", target, got, want)
+		}
+	}
+}
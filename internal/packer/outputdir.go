@@ -0,0 +1,55 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gokrazy/internal/updateflag"
+)
+
+// The names of the files which are written to Pack.OutputDir.
+const (
+	outputDirFull = "disk.img"
+	outputDirBoot = "boot.img"
+	outputDirRoot = "root.img"
+	outputDirMBR  = "mbr.bin"
+	outputDirInit = "init.go"
+)
+
+// setOutputDir points the output paths to the files in OutputDir, so that
+// one run writes the full image, the boot and root file systems, the MBR and
+// the init source. Without TargetStorageBytes (and Shrink), the full image is
+// sized for the smallest device (see MinDeviceSize).
+func (pack *Pack) setOutputDir() error {
+	flags := pack.Cfg.InternalCompatibilityFlags
+	if !updateflag.NewInstallation() {
+		return fmt.Errorf("--output_dir cannot be combined with updating an installation")
+	}
+	if flags.Overwrite != "" || flags.OverwriteBoot != "" || flags.OverwriteRoot != "" || flags.OverwriteMBR != "" || flags.OverwriteInit != "" ||
+		(pack.Output != nil && pack.Output.Path != "") {
+		return fmt.Errorf("--output_dir cannot be combined with other output paths (full image, boot, root, MBR, init or gaf)")
+	}
+	if err := os.MkdirAll(pack.OutputDir, 0755); err != nil {
+		return err
+	}
+	flags.Overwrite = filepath.Join(pack.OutputDir, outputDirFull)
+	flags.OverwriteBoot = filepath.Join(pack.OutputDir, outputDirBoot)
+	flags.OverwriteRoot = filepath.Join(pack.OutputDir, outputDirRoot)
+	flags.OverwriteMBR = filepath.Join(pack.OutputDir, outputDirMBR)
+	if flags.TargetStorageBytes == 0 && !pack.Shrink {
+		flags.TargetStorageBytes = int(pack.MinDeviceSize())
+		fmt.Printf("Sizing %s for the smallest device (%d MB), use --target_storage_bytes to select another size\n", flags.Overwrite, flags.TargetStorageBytes/MB)
+	}
+	return nil
+}
+
+// outputDirInitPath returns the path to which the init source is written in
+// OutputDir, or the empty string if there is no init source because it is
+// not generated (see InitPkg).
+func (pack *Pack) outputDirInitPath() string {
+	if pack.OutputDir == "" || pack.Cfg.InternalCompatibilityFlags.InitPkg != "" {
+		return ""
+	}
+	return filepath.Join(pack.OutputDir, outputDirInit)
+}
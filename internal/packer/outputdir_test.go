@@ -0,0 +1,47 @@
+package packer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/packer"
+)
+
+func TestSetOutputDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	p := &Pack{
+		Pack: packer.NewPackForHost("outputdirtest"),
+		Cfg: &config.Struct{
+			InternalCompatibilityFlags: &config.InternalCompatibilityFlags{},
+		},
+		OutputDir: dir,
+	}
+	if err := p.setOutputDir(); err != nil {
+		t.Fatal(err)
+	}
+	flags := p.Cfg.InternalCompatibilityFlags
+	for _, tt := range []struct {
+		flag, got, want string
+	}{
+		{"Overwrite", flags.Overwrite, filepath.Join(dir, "disk.img")},
+		{"OverwriteBoot", flags.OverwriteBoot, filepath.Join(dir, "boot.img")},
+		{"OverwriteRoot", flags.OverwriteRoot, filepath.Join(dir, "root.img")},
+		{"OverwriteMBR", flags.OverwriteMBR, filepath.Join(dir, "mbr.bin")},
+		{"init", p.outputDirInitPath(), filepath.Join(dir, "init.go")},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.flag, tt.got, tt.want)
+		}
+	}
+	if got, want := uint64(flags.TargetStorageBytes), p.MinDeviceSize(); got != want {
+		t.Errorf("TargetStorageBytes = %d, want %d (MinDeviceSize)", got, want)
+	}
+
+	p.Cfg.InternalCompatibilityFlags = &config.InternalCompatibilityFlags{
+		OverwriteBoot: "/tmp/boot.img",
+	}
+	if err := p.setOutputDir(); err == nil {
+		t.Errorf("setOutputDir(with -overwrite_boot) unexpectedly succeeded")
+	}
+}
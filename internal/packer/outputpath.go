@@ -0,0 +1,101 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// outputPathData is the data available to output path templates, e.g.
+// -overwrite=build/gokrazy-{{.Hostname}}-{{.Version}}-{{.Date}}.img
+type outputPathData struct {
+	Hostname   string
+	DeviceType string
+	Arch       string
+
+	// Model is the Raspberry Pi model (see Pack.Model), e.g. pi4, or the
+	// empty string for images which boot on all models.
+	Model string
+
+	// Date is the build date, e.g. 2024-05-01.
+	Date string
+
+	// Timestamp is the build time (UTC), e.g. 20240501T142300Z.
+	Timestamp string
+
+	version string
+}
+
+// Version returns the image version, or an error if the image has no
+// version.
+func (d outputPathData) Version() (string, error) {
+	if d.version == "" {
+		return "", fmt.Errorf("the image has no version (the instance directory is not in a git repository); specify one with --image_version")
+	}
+	return d.version, nil
+}
+
+// expandOutputPath renders path as template if it contains an action.
+func expandOutputPath(path string, data outputPathData) (string, error) {
+	if !strings.Contains(path, "{{") {
+		return path, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("output path %q: %v", path, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("output path %q: %v", path, err)
+	}
+	expanded := buf.String()
+	if strings.TrimSpace(expanded) == "" {
+		return "", fmt.Errorf("output path %q expands to an empty path", path)
+	}
+	return expanded, nil
+}
+
+// expandOutputPaths expands the templates in the output paths, so that CI can
+// produce well-named artifacts.
+func (pack *Pack) expandOutputPaths(buildStart time.Time) error {
+	data := outputPathData{
+		Hostname:   pack.Cfg.Hostname,
+		DeviceType: pack.Cfg.DeviceType,
+		Arch:       packer.TargetArch(),
+		Model:      pack.Model,
+		Date:       buildStart.Format("2006-01-02"),
+		Timestamp:  buildStart.UTC().Format("20060102T150405Z"),
+		version:    pack.Version,
+	}
+	flags := pack.Cfg.InternalCompatibilityFlags
+	paths := []*string{
+		&flags.Overwrite,
+		&flags.OverwriteBoot,
+		&flags.OverwriteRoot,
+		&flags.OverwriteMBR,
+		&pack.OutputDir,
+		&pack.Provenance,
+		&pack.BuildManifest,
+		&pack.SHA256Sums,
+	}
+	if pack.Output != nil {
+		paths = append(paths, &pack.Output.Path)
+	}
+	printed := make(map[string]bool)
+	for _, p := range paths {
+		expanded, err := expandOutputPath(*p, data)
+		if err != nil {
+			return err
+		}
+		if expanded != *p && !printed[expanded] {
+			fmt.Printf("Output path: %s\n", expanded)
+			printed[expanded] = true
+		}
+		*p = expanded
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandOutputPath(t *testing.T) {
+	data := outputPathData{
+		Hostname: "scanner",
+		Arch:     "arm64",
+		Model:    "pi4",
+		Date:     "2024-05-01",
+		version:  "v1.2.0",
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/dev/sdx", "/dev/sdx"},
+		{"build/gokrazy-{{.Hostname}}-{{.Version}}-{{.Date}}.img", "build/gokrazy-scanner-v1.2.0-2024-05-01.img"},
+		{"/tmp/{{.Hostname}}-{{.Arch}}.gaf", "/tmp/scanner-arm64.gaf"},
+		{"gokrazy-{{.Model}}.img", "gokrazy-pi4.img"},
+	} {
+		got, err := expandOutputPath(tt.path, data)
+		if err != nil {
+			t.Errorf("expandOutputPath(%q): %v", tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandOutputPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		path string
+		data outputPathData
+		want string
+	}{
+		{"{{.Version}}.img", outputPathData{}, "has no version"},
+		{"{{.Nope}}.img", data, "Nope"},
+		{"{{.Hostname", data, "unclosed action"},
+		{"{{ if false }}x{{ end }}", data, "empty path"},
+	} {
+		_, err := expandOutputPath(tt.path, tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("expandOutputPath(%q) = %v, want error containing %q", tt.path, err, tt.want)
+		}
+	}
+}
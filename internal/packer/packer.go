@@ -30,14 +30,21 @@ import (
 	"github.com/gokrazy/internal/progress"
 	"github.com/gokrazy/internal/tlsflag"
 	"github.com/gokrazy/internal/updateflag"
+	"github.com/gokrazy/tools/internal/healthcheck"
+	"github.com/gokrazy/tools/internal/i18n"
 	"github.com/gokrazy/tools/internal/measure"
 	"github.com/gokrazy/tools/internal/version"
+	"github.com/gokrazy/tools/manifest"
 	"github.com/gokrazy/tools/packer"
-	"github.com/gokrazy/updater"
+	"github.com/gokrazy/tools/updateclient"
 )
 
 const MB = 1024 * 1024
 
+// embeddedConfigPath is where the instance config is stored in the root file
+// system, see RecoverConfig.
+const embeddedConfigPath = "/etc/gokrazy/config.json"
+
 type filePathAndModTime struct {
 	path    string
 	modTime time.Time
@@ -571,6 +578,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 					dir.Dirents = append(dir.Dirents, &FileInfo{
 						Filename: filepath.Base(dest),
 						FromHost: path,
+						Template: strings.HasSuffix(path, templateSuffix),
 					})
 					packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
 						kind:         "include extra files in the root file system",
@@ -585,6 +593,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 					}
 				}
 
+				markTemplates(root)
 				fileInfos = append(fileInfos, root)
 			}
 
@@ -598,6 +607,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 				packageConfigFiles[pkg] = append(packageConfigFiles[pkg], packageConfigFile{
 					kind: "include extra files in the root file system",
 				})
+				markTemplates(root)
 				fileInfos = append(fileInfos, root)
 			}
 
@@ -619,6 +629,7 @@ func FindExtraFiles(cfg *config.Struct) (map[string][]*FileInfo, error) {
 			if err := findExtraFilesInDir(pkg, dir, root); err != nil {
 				return nil, err
 			}
+			markTemplates(root)
 			extraFiles[pkg] = append(extraFiles[pkg], root)
 		}
 		{
@@ -738,27 +749,15 @@ func (cw *countingWriter) Write(p []byte) (n int, err error) {
 }
 
 func (p *Pack) writeBootFile(bootfilename, mbrfilename string) error {
-	f, err := os.Create(bootfilename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if err := p.writeBoot(f, mbrfilename); err != nil {
-		return err
-	}
-	return f.Close()
+	return p.writeOutputFile(bootfilename, func(w io.ReadWriteSeeker) error {
+		return p.writeBoot(w, mbrfilename)
+	})
 }
 
-func writeRootFile(filename string, root *FileInfo) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if err := writeRoot(f, root); err != nil {
-		return err
-	}
-	return f.Close()
+func (p *Pack) writeRootFile(filename string, root *FileInfo) error {
+	return p.writeOutputFile(filename, func(w io.ReadWriteSeeker) error {
+		return p.writeRoot(w, root)
+	})
 }
 
 func partitionPath(base, num string) string {
@@ -797,6 +796,9 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 		return err
 	}
 	parttable := "GPT + Hybrid MBR"
+	if p.ProtectiveMBR {
+		parttable = "GPT + protective MBR"
+	}
 	if !p.UseGPT {
 		parttable = "no GPT, only MBR"
 	}
@@ -808,7 +810,7 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 	}
 	defer f.Close()
 
-	if _, err := f.Seek(8192*512, io.SeekStart); err != nil {
+	if _, err := f.Seek(p.BootOffset(), io.SeekStart); err != nil {
 		return err
 	}
 
@@ -816,11 +818,7 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 		return err
 	}
 
-	if err := writeMBR(&offsetReadSeeker{f, 8192 * 512}, f, p.Partuuid); err != nil {
-		return err
-	}
-
-	if _, err := f.Seek((8192+(100*MB/512))*512, io.SeekStart); err != nil {
+	if err := writeMBR(&offsetReadSeeker{f, p.BootOffset()}, f, p.BootOffset(), p.Partuuid); err != nil {
 		return err
 	}
 
@@ -828,17 +826,21 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmp.Name())
+	defer p.removeTemp(tmp.Name())
 	defer tmp.Close()
 
-	if err := writeRoot(tmp, root); err != nil {
+	if err := p.writeRoot(tmp, root); err != nil {
+		return err
+	}
+	rootSize, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
 		return err
 	}
 	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(f, tmp); err != nil {
+	if err := p.copyToDevice(f, p.RootOffset(), tmp, rootSize); err != nil {
 		return err
 	}
 
@@ -846,22 +848,44 @@ func (p *Pack) overwriteDevice(dev string, root *FileInfo, rootDeviceFiles []dev
 		return err
 	}
 
+	devsize, err := fileDeviceSize(f)
+	if err != nil {
+		return err
+	}
+	if err := p.writeExtraPartitions(f, devsize); err != nil {
+		return err
+	}
+	if !p.PreservePerm {
+		if err := p.formatPerm(f, devsize); err != nil {
+			return err
+		}
+	}
+
+	if err := p.syncDevice(f); err != nil {
+		return err
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
 
-	fmt.Printf("If your applications need to store persistent data, unplug and re-plug the SD card, then create a file system using e.g.:\n")
-	fmt.Printf("\n")
-	partition := partitionPath(dev, "4")
-	if p.ModifyCmdlineRoot() {
-		partition = fmt.Sprintf("/dev/disk/by-partuuid/%s", p.PermUUID())
-	} else {
-		if target, err := filepath.EvalSymlinks(dev); err == nil {
-			partition = partitionPath(target, "4")
+	if p.PermFileSystem == "" && !p.PreservePerm {
+		hint := i18n.Sprintf("If your applications need to store persistent data, unplug and re-plug the SD card, then create a file system using e.g.:\n") + "\n"
+		partition := partitionPath(dev, "4")
+		if p.ModifyCmdlineRoot() {
+			partition = fmt.Sprintf("/dev/disk/by-partuuid/%s", p.PermUUID())
+		} else {
+			if target, err := filepath.EvalSymlinks(dev); err == nil {
+				partition = partitionPath(target, "4")
+			}
 		}
+		if p.Layout.Expose == "perm" {
+			hint += fmt.Sprintf("\tmkfs.exfat %s\n", partition)
+		} else {
+			hint += fmt.Sprintf("\tmkfs.ext4 %s\n", partition)
+		}
+		p.hint(hint + "\n")
 	}
-	fmt.Printf("\tmkfs.ext4 %s\n", partition)
-	fmt.Printf("\n")
+	p.printExtraPartitions(devsize)
 
 	return nil
 }
@@ -873,39 +897,84 @@ type offsetReadSeeker struct {
 
 func (ors *offsetReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	if whence == io.SeekStart {
-		// github.com/gokrazy/internal/fat.Reader only uses io.SeekStart
+		// fatReader (via seekReaderAt) only uses io.SeekStart
 		return ors.ReadSeeker.Seek(offset+ors.offset, io.SeekStart)
 	}
 	return ors.ReadSeeker.Seek(offset, whence)
 }
 
 func (p *Pack) overwriteFile(filename string, root *FileInfo, rootDeviceFiles []deviceconfig.RootFile) (bootSize int64, rootSize int64, err error) {
-	f, err := os.Create(p.Cfg.InternalCompatibilityFlags.Overwrite)
-	if err != nil {
-		return 0, 0, err
+	devsize := uint64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)
+	if p.Shrink {
+		if err := p.checkShrink(); err != nil {
+			return 0, 0, err
+		}
+		devsize = p.MinDeviceSize()
+	}
+	if p.VMFormat != "" {
+		if err := p.checkVMFormat(); err != nil {
+			return 0, 0, err
+		}
+		if rem := devsize % vmImageAlignment; rem != 0 {
+			devsize += vmImageAlignment - rem
+			fmt.Printf("Rounded the VM disk size up to %d MB (whole GiB, as required by cloud providers)\n", devsize/MB)
+		}
+	}
+	if p.Compress != "" {
+		if err := p.checkCompress(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	target := p.Cfg.InternalCompatibilityFlags.Overwrite
+	stream := IsStreamTarget(target)
+	var f *os.File
+	if stream || p.VMFormat != "" || p.Compress != "" {
+		if p.Shrink {
+			return 0, 0, fmt.Errorf("--shrink cannot be combined with streaming the image to %s, because shrunk images need metadata next to them", target)
+		}
+		// The (sparse) image is assembled in a temporary file first.
+		f, err = os.CreateTemp("", "gokr-packer-image")
+		if err != nil {
+			return 0, 0, err
+		}
+		defer p.removeTemp(f.Name())
+	} else {
+		f, err = createPartial(target)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer abortPartial(target)
 	}
 
-	if err := f.Truncate(int64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)); err != nil {
+	if err := f.Truncate(int64(devsize)); err != nil {
 		return 0, 0, err
 	}
 
-	if err := p.Partition(f, uint64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)); err != nil {
+	// The file was just created (or truncated) with the image size, so it
+	// reads as zeros: skip writing zeros, keeping the image sparse.
+	sf := newSparseFile(f)
+
+	if err := p.Partition(f, devsize); err != nil {
 		return 0, 0, err
 	}
+	// The partition tables at the start and (GPT backup) end of the image.
+	sf.markWritten(0, p.BootOffset())
+	sf.markWritten(int64(devsize)-MB, MB)
 
-	if _, err := f.Seek(8192*512, io.SeekStart); err != nil {
+	if _, err := f.Seek(p.BootOffset(), io.SeekStart); err != nil {
 		return 0, 0, err
 	}
 	var bs countingWriter
-	if err := p.writeBoot(io.MultiWriter(f, &bs), ""); err != nil {
+	if err := p.writeBoot(io.MultiWriter(sf, &bs), ""); err != nil {
 		return 0, 0, err
 	}
 
-	if err := writeMBR(&offsetReadSeeker{f, 8192 * 512}, f, p.Partuuid); err != nil {
+	if err := writeMBR(&offsetReadSeeker{f, p.BootOffset()}, sf, p.BootOffset(), p.Partuuid); err != nil {
 		return 0, 0, err
 	}
 
-	if _, err := f.Seek(8192*512+100*MB, io.SeekStart); err != nil {
+	if _, err := f.Seek(p.RootOffset(), io.SeekStart); err != nil {
 		return 0, 0, err
 	}
 
@@ -913,30 +982,97 @@ func (p *Pack) overwriteFile(filename string, root *FileInfo, rootDeviceFiles []
 	if err != nil {
 		return 0, 0, err
 	}
-	defer os.Remove(tmp.Name())
+	defer p.removeTemp(tmp.Name())
 	defer tmp.Close()
 
-	if err := writeRoot(tmp, root); err != nil {
+	if err := p.writeRoot(tmp, root); err != nil {
 		return 0, 0, err
 	}
 	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
 		return 0, 0, err
 	}
 
-	var rs countingWriter
-	if _, err := io.Copy(io.MultiWriter(f, &rs), tmp); err != nil {
+	var rs int64
+	if p.RootFileSystem == "ext4" {
+		// The ext4 root file system contains zero blocks (e.g. its free
+		// space), which the sparse file skips.
+		rs, err = io.Copy(sf, tmp)
+	} else {
+		rs, err = copyImage(f, tmp)
+		sf.markWritten(p.RootOffset(), rs)
+	}
+	if err != nil {
 		return 0, 0, err
 	}
 
-	if err := p.writeRootDeviceFiles(f, rootDeviceFiles); err != nil {
+	if err := p.writeRootDeviceFiles(sf, rootDeviceFiles); err != nil {
 		return 0, 0, err
 	}
 
-	fmt.Printf("If your applications need to store persistent data, create a file system using e.g.:\n")
-	fmt.Printf("\t/sbin/mkfs.ext4 -F -E offset=%v %s %v\n", 8192*512+1100*MB, p.Cfg.InternalCompatibilityFlags.Overwrite, packer.PermSizeInKB(uint64(p.Cfg.InternalCompatibilityFlags.TargetStorageBytes)))
-	fmt.Printf("\n")
+	if p.Shrink {
+		if err := p.shrinkFile(f, target, rs); err != nil {
+			return 0, 0, err
+		}
+		if err := f.Close(); err != nil {
+			return 0, 0, err
+		}
+		return int64(bs), rs, p.commitPartial(target)
+	}
 
-	return int64(bs), int64(rs), f.Close()
+	if err := p.writeExtraPartitions(sf, devsize); err != nil {
+		return 0, 0, err
+	}
+	if err := p.formatPerm(sf, devsize); err != nil {
+		return 0, 0, err
+	}
+
+	if p.VMFormat != "" {
+		if stream {
+			return 0, 0, fmt.Errorf("VM images cannot be streamed to %s, write them to a file instead", target)
+		}
+		if err := p.writeVMImage(f, int64(devsize), target); err != nil {
+			return 0, 0, err
+		}
+		p.printExtraPartitions(devsize)
+		return int64(bs), rs, f.Close()
+	}
+
+	if p.Compress != "" {
+		if stream {
+			return 0, 0, fmt.Errorf("compressed images cannot be streamed to %s, write them to a file instead", target)
+		}
+		if err := p.writeCompressedImage(f, int64(devsize), target); err != nil {
+			return 0, 0, err
+		}
+		p.printExtraPartitions(devsize)
+		return int64(bs), rs, f.Close()
+	}
+
+	if stream {
+		p.streamedSHA256, err = streamImage(target, f)
+		if err != nil {
+			return 0, 0, err
+		}
+		p.printExtraPartitions(devsize)
+		return int64(bs), rs, f.Close()
+	}
+
+	if p.PermFileSystem == "" {
+		hint := i18n.Sprintf("If your applications need to store persistent data, create a file system using e.g.:\n")
+		if p.Layout.Expose == "perm" {
+			hint += fmt.Sprintf("\tloop=$(sudo losetup --find --show --offset=%v --sizelimit=%v %s)\n", p.PermOffset(), uint64(p.PermSizeInKB(devsize))*1024, p.Cfg.InternalCompatibilityFlags.Overwrite)
+			hint += "\tsudo mkfs.exfat $loop && sudo losetup -d $loop\n"
+		} else {
+			hint += fmt.Sprintf("\t/sbin/mkfs.ext4 -F -E offset=%v %s %v\n", p.PermOffset(), p.Cfg.InternalCompatibilityFlags.Overwrite, p.PermSizeInKB(devsize))
+		}
+		p.hint(hint + "\n")
+	}
+	p.printExtraPartitions(devsize)
+
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+	return int64(bs), rs, p.commitPartial(target)
 }
 
 const usage = `
@@ -968,6 +1104,11 @@ type OutputType string
 const (
 	OutputTypeGaf  OutputType = "gaf"
 	OutputTypeFull OutputType = "full"
+
+	// OutputTypeDirectBoot writes the kernel, its command line and the root
+	// file system as initramfs into the directory Path, for direct kernel
+	// boot in QEMU or Firecracker.
+	OutputTypeDirectBoot OutputType = "directboot"
 )
 
 type OutputStruct struct {
@@ -980,6 +1121,297 @@ type Pack struct {
 
 	Cfg    *config.Struct
 	Output *OutputStruct
+
+	// EmbedLicenseTexts includes the license text of each module in
+	// /etc/licenses, in addition to the LICENSES.txt report.
+	EmbedLicenseTexts bool
+
+	// CompressBinaries stores the binaries in /user gzip-compressed and starts
+	// them via an exec shim which decompresses them into memory.
+	CompressBinaries bool
+
+	// Model restricts the boot file system to the firmware (and EEPROM update)
+	// files of one Raspberry Pi model (e.g. pi4, see Models) and verifies that
+	// the kernel package supports it. For 32-bit models like the pi0w, the
+	// programs are built with GOARCH=arm and GOARM=6. By default, images boot on all models
+	// supported by the firmware and kernel packages.
+	Model string
+
+	// ModelImages makes the packer build one image per Raspberry Pi model
+	// (each as if Model was set to it, with its pinned kernel and firmware
+	// packages) in one run, see ParseModelImages. The output paths need to
+	// contain {{.Model}}.
+	ModelImages []ModelImage
+
+	// Arch is the architecture (GOARCH) to build the userland for: arm64
+	// (the default, for the Raspberry Pi 3 and newer), arm or amd64. It also
+	// selects the default kernel package for the architecture, see
+	// Architectures.
+	Arch string
+
+	// GOOS, GOARCH and GOARM are passed to the go tool when building init
+	// and the packages (overriding the environment), if non-empty, e.g. to
+	// build one instance for different device generations with GOARM=7 or
+	// GOARCH=arm64. Unlike Arch, they do not change the kernel package.
+	GOOS   string
+	GOARCH string
+	GOARM  string
+
+	// Board selects a board profile (see ReadBoard) for computers other than
+	// the Raspberry Pi (e.g. amd64 for UEFI PCs), which determines the default
+	// kernel and firmware packages, the bootloader files written before the
+	// boot partition, the partition table type and the kernel command line.
+	Board *Board
+
+	// ExtraKernels are booted instead of the kernel package of Cfg on the
+	// Raspberry Pi models matching their filter, so that one image works
+	// across different models.
+	ExtraKernels []ExtraKernel
+
+	// DedupFiles replaces identical copies of large files in the root file
+	// system with symlinks to the first copy.
+	DedupFiles bool
+
+	// IntegrityCheck adds a program which verifies the files of the root file
+	// system against a manifest of their hashes on boot.
+	IntegrityCheck bool
+
+	// RemoteExec adds a remote-exec program, which runs single commands
+	// (authenticated with the gokrazy password) received on RemoteExecPort,
+	// as a recovery escape hatch. It also serves the partitions for Backup.
+	RemoteExec bool
+
+	// Etc customizes the entries in /etc, if non-nil.
+	Etc *EtcConfig
+
+	// RootManifest is added to the root file system like the extra files of
+	// packages, if non-nil, e.g. for files generated by other tools.
+	RootManifest *manifest.RootManifest
+
+	// WriteRootManifest is the path to which the manifest of the complete
+	// root file system is written, if non-empty, e.g. for comparing images
+	// with manifest.Diff.
+	WriteRootManifest string
+
+	// Volumes are persistent directories on the perm partition, at most one
+	// per service, which init creates on boot (see Volume).
+	Volumes []Volume
+
+	// CPUProfile, MemProfile and Trace are paths to which the CPU profile,
+	// the memory (heap) profile and the execution trace of the packer are
+	// written, if non-empty, for diagnosing slow builds with go tool pprof
+	// and go tool trace. The trace shows the build and imaging phases.
+	CPUProfile string
+	MemProfile string
+	Trace      string
+
+	// KeepBackup keeps the previous output image files as <file>.bak when
+	// replacing them. Output files are written to <file>.partial and only
+	// renamed once they are complete.
+	KeepBackup bool
+
+	// TempDir is the directory in which the temporary files (e.g. the
+	// compiled binaries and the file system images) are created, if
+	// non-empty, instead of $TMPDIR (often a small tmpfs). It is passed on to
+	// the go tool as TMPDIR.
+	TempDir string
+
+	// SkipSpaceCheck skips verifying that the temporary directory and the
+	// output destinations have enough free space before building.
+	SkipSpaceCheck bool
+
+	// Reproducible makes the output byte-identical for identical inputs: all
+	// timestamps (in the file systems, /etc/os-release and the build
+	// timestamp) are set to $SOURCE_DATE_EPOCH or the git commit time (see
+	// sourceDateEpoch), and the Go binaries are built with -trimpath and
+	// without build ID. VM images (see VMFormat) still get unique disk IDs.
+	Reproducible bool
+
+	// fixedTime is the time used for all timestamps with Reproducible.
+	fixedTime time.Time
+
+	// KeepTemp keeps the temporary files and directories (e.g. the generated
+	// init source, the built binaries and the boot and root file system
+	// images) instead of deleting them, and prints their paths, so that
+	// failures can be investigated.
+	KeepTemp bool
+
+	// ArtifactCache is a directory in which the files of the root file system
+	// are stored content-addressed, if non-empty. Builds for multiple hosts
+	// (e.g. by gok fleet update) which share the directory store identical
+	// build artifacts only once.
+	ArtifactCache string
+
+	// RunTargetTests runs the tests of the packages (go test) for the target
+	// architecture before creating the image, so that architecture-specific
+	// bugs (e.g. alignment or syscalls) fail the build. Unless the host runs
+	// the target architecture, the tests run under qemu-user emulation.
+	RunTargetTests bool
+
+	// CrashLogSize makes all services run under a wrapper which records their
+	// exits, including the stderr output of crashes (e.g. Go panics), into
+	// rotating log files of this size in /perm/crashes, if non-zero. A
+	// crash-logs service serves the files on CrashLogsPort.
+	CrashLogSize uint64
+
+	// InitDebug makes the generated init log mount steps, services and their
+	// processes to the console and the kernel ring buffer, and boots the
+	// kernel with verbose logging, to diagnose devices which do not come up.
+	InitDebug bool
+
+	// Shrink makes the full image (written to a file) as small as possible:
+	// it ends after the first root file system. The partition table for the
+	// actual device size is created when writing the image with Flash.
+	Shrink bool
+
+	// PermFileSystem is the file system (exfat or ext4) with which
+	// the perm partition is formatted at pack time, if non-empty. PermLabel is
+	// its volume label.
+	PermFileSystem string
+	PermLabel      string
+
+	// PreservePerm keeps the perm partition of the gokrazy installation on
+	// the storage device which is overwritten: the new partition table must
+	// put it at the same place (see checkPreservePerm), and neither its
+	// contents nor its file system are touched.
+	PreservePerm bool
+
+	// DeviceSync is the sync policy when writing to a storage device (see
+	// DeviceSyncPolicies and deviceWriter): end (the default), buffer or
+	// none.
+	DeviceSync string
+
+	// DeviceRetries is how often a write to a storage device which failed
+	// with an I/O error is retried before giving up.
+	DeviceRetries int
+
+	// RootFileSystem is the file system of the root partitions (see
+	// RootFileSystems): squashfs (the default, compressed) or ext4
+	// (uncompressed).
+	RootFileSystem string
+
+	// PartitionTable is the partition table created on new installations
+	// (see PartitionTables): hybrid (GPT with a hybrid MBR, which all
+	// Raspberry Pi models boot from), gpt (GPT with a protective MBR, for
+	// boot media and boards which require a pure GPT) or mbr (MBR only). If
+	// empty, the default of the board or device type is used.
+	PartitionTable string
+
+	// Workspace is the path of a go.work file whose modules are used for
+	// building, so that local working copies are packed instead of the
+	// published versions, if non-empty.
+	Workspace string
+
+	// Provenance is the path to which an in-toto statement with SLSA
+	// provenance about the produced image files will be written, if
+	// non-empty.
+	Provenance string
+
+	// SignProvenance signs the Provenance statement with Sigstore keyless
+	// signing (see signProvenance).
+	SignProvenance bool
+
+	// OutputDir is a directory to which all artifacts are written in one
+	// run, if non-empty: the full image (disk.img), the boot and root file
+	// systems (boot.img, root.img), the MBR (mbr.bin) and the generated init
+	// source (init.go), see setOutputDir.
+	OutputDir string
+
+	// BuildManifest is the path to which the BuildManifest of the image is
+	// written as JSON, if non-empty.
+	BuildManifest string
+
+	// Policy is checked against the BuildManifest of the image before any
+	// image is written, failing the build on violations, if non-nil.
+	Policy *Policy
+
+	// bootFiles are the files of the boot file system written by writeBoot,
+	// for the BuildManifest.
+	bootFiles []ManifestFile
+
+	// SHA256Sums is the path to which the SHA256 hashes of the produced image
+	// files are written in the format of sha256sum, if non-empty, so that
+	// they can be verified before flashing them.
+	SHA256Sums string
+
+	// SignGPGKey and SignMinisignKey select the key with which the SHA256Sums
+	// file is signed, if any: a gpg key ID (the signature is written to
+	// SHA256Sums.asc) or a minisign secret key file (SHA256Sums.minisig).
+	SignGPGKey      string
+	SignMinisignKey string
+
+	// VMFormat is the format (e.g. qcow2 or vhdx, see VMFormats) in which the
+	// full image is written to a file for running it in a VM (e.g. a cloud
+	// arm64 instance booting via UEFI), if non-empty. The disk size is
+	// rounded up to whole GiB.
+	VMFormat string
+
+	// Compress is the format (gzip, xz or zstd, see ImageCompressions) in
+	// which the full image is compressed when writing it to a file, if
+	// non-empty, e.g. for distributing it or writing it with the Raspberry Pi
+	// Imager.
+	Compress string
+
+	// streamedSHA256 is the hash of the full image which was streamed to a
+	// file descriptor or named pipe (see IsStreamTarget), if any.
+	streamedSHA256 string
+
+	// digests maps the paths of the output files which were hashed while
+	// writing them (see writeHashed) to their SHA256 hash.
+	digests map[string]string
+
+	// audit is the audit event of the packer run, recorded by Main (see
+	// AuditLogPath).
+	audit *AuditEvent
+
+	// HideHints suppresses the instructions for the user which are printed
+	// after writing, e.g. how to boot the image or create a file system on
+	// the perm partition, so that scripts get a quiet stdout. The hints are
+	// still recorded in the summary.
+	HideHints bool
+
+	// QRCode prints the URL of the web interface (including the password)
+	// as QR code in the terminal after a successful flash or update, so that
+	// it can be opened on a phone.
+	QRCode bool
+
+	// Summary is the path to which a BuildSummary of the packer run is
+	// written as JSON, if non-empty.
+	Summary string
+
+	// summary is written to Summary by run.
+	summary BuildSummary
+
+	// Version is the image version (see ImageVersion), which is stored in
+	// /etc/os-release, gaf files, the shrink metadata and the provenance, if
+	// non-empty.
+	Version string
+
+	// AllowDowngrade updates devices which run a newer image than the one
+	// being packed: one of a later version (in the git repository of the
+	// working directory, or one which is not in it at all, e.g. because the
+	// checkout is stale) or with a later build timestamp. Such updates are
+	// refused by default.
+	AllowDowngrade bool
+
+	// HealthChecks are the health checks per service (program name or
+	// package), which need to pass after the device rebooted into the update
+	// (see the healthcheck package). The update fails otherwise.
+	HealthChecks map[string][]healthcheck.Check
+
+	// HealthCheckTimeout is how long to wait for the HealthChecks to pass,
+	// default 2 minutes.
+	HealthCheckTimeout time.Duration
+}
+
+// removeTemp removes the temporary file or directory path, or prints its path
+// when keeping temporary files (see KeepTemp).
+func (p *Pack) removeTemp(path string) {
+	if p.KeepTemp {
+		fmt.Printf("Keeping temporary %s\n", path)
+		return
+	}
+	os.RemoveAll(path)
 }
 
 func filterGoEnv(env []string) []string {
@@ -1005,10 +1437,37 @@ func (pack *Pack) logic(programName string) error {
 		return fmt.Errorf("both -update and -overwrite are specified; use either one, not both")
 	}
 
+	if !updateflag.NewInstallation() && pack.Layout.SingleSlot {
+		return fmt.Errorf("--single_slot installations have no inactive root partition to update: write a new image instead")
+	}
+
 	if cfg.InternalCompatibilityFlags.Sudo == "" {
 		cfg.InternalCompatibilityFlags.Sudo = "auto"
 	}
 
+	if err := pack.checkSigning(); err != nil {
+		return err
+	}
+
+	if err := pack.checkProvenanceSigning(); err != nil {
+		return err
+	}
+
+	if pack.TempDir != "" {
+		if err := os.MkdirAll(pack.TempDir, 0755); err != nil {
+			return err
+		}
+		// os.TempDir (and thereby all temporary files of the packer) and the
+		// go tool use $TMPDIR.
+		os.Setenv("TMPDIR", pack.TempDir)
+	}
+
+	if pack.Reproducible {
+		if err := pack.setUpReproducible("."); err != nil {
+			return err
+		}
+	}
+
 	var mbrOnlyWithoutGpt bool
 	var rootDeviceFiles []deviceconfig.RootFile
 	if cfg.DeviceType != "" {
@@ -1019,11 +1478,55 @@ func (pack *Pack) logic(programName string) error {
 			return fmt.Errorf("unknown device slug %q", cfg.DeviceType)
 		}
 	}
+	if err := pack.applyGoEnv(); err != nil {
+		return err
+	}
+	model, err := pack.model()
+	if err != nil {
+		return err
+	}
+	if err := model.setGoEnv(); err != nil {
+		return err
+	}
+	if pack.Model != "" && cfg.DeviceType != "" {
+		return fmt.Errorf("-model selects a Raspberry Pi model, which conflicts with -device_type=%s", cfg.DeviceType)
+	}
+	if board := pack.Board; board != nil {
+		if cfg.DeviceType != "" || pack.Model != "" {
+			return fmt.Errorf("-board=%s conflicts with -device_type and -model", board.Name)
+		}
+		if err := board.Validate(); err != nil {
+			return fmt.Errorf("board %s: %v", board.Name, err)
+		}
+		rootDeviceFiles = board.BootloaderFiles
+		mbrOnlyWithoutGpt = board.MBROnly
+		board.applyDefaults(cfg)
+		if cfg.KernelPackage == nil && board.GOARCH != "" {
+			return fmt.Errorf("board %s has no default kernel package: set KernelPackage in the instance config", board.Name)
+		}
+		if err := setGoEnv(board.Name, board.GOARCH, board.GOARM); err != nil {
+			return err
+		}
+	}
+	if err := pack.applyArch(); err != nil {
+		return err
+	}
 
+	layout := pack.Layout
 	pack.Pack = packer.NewPackForHost(cfg.Hostname)
+	pack.Pack.Layout = layout
+	if err := pack.SetPartitionTable(mbrOnlyWithoutGpt); err != nil {
+		return err
+	}
+	if err := pack.checkRootFileSystem(); err != nil {
+		return err
+	}
+	if err := checkDeviceSync(pack.DeviceSync); err != nil {
+		return err
+	}
 
 	newInstallation := updateflag.NewInstallation()
-	useGPT := newInstallation && !mbrOnlyWithoutGpt
+	useGPT := newInstallation && pack.Pack.UseGPT
 
 	pack.Pack.UsePartuuid = newInstallation
 	pack.Pack.UseGPTPartuuid = useGPT
@@ -1036,6 +1539,55 @@ func (pack *Pack) logic(programName string) error {
 		os.Exit(0)
 	}
 
+	buildStart := time.Now()
+	pack.audit = pack.newAuditEvent(buildStart)
+	pack.summary.Instance = pack.audit.Instance
+	pack.summary.Hostname = pack.audit.Hostname
+	if err := pack.expandOutputPaths(buildStart); err != nil {
+		return err
+	}
+	if pack.OutputDir != "" {
+		if err := pack.setOutputDir(); err != nil {
+			return err
+		}
+	}
+
+	if target := cfg.InternalCompatibilityFlags.Overwrite; strings.HasPrefix(target, loopTargetPrefix) {
+		dev, detach, err := attachLoop(
+			strings.TrimPrefix(target, loopTargetPrefix),
+			int64(cfg.InternalCompatibilityFlags.TargetStorageBytes),
+			cfg.InternalCompatibilityFlags.Sudo)
+		if err != nil {
+			return err
+		}
+		defer detach()
+		cfg.InternalCompatibilityFlags.Overwrite = dev
+	}
+
+	if target := cfg.InternalCompatibilityFlags.Overwrite; strings.HasPrefix(target, usbbootTargetPrefix) {
+		dev, err := usbbootDisk(
+			strings.TrimPrefix(target, usbbootTargetPrefix),
+			cfg.InternalCompatibilityFlags.Sudo)
+		if err != nil {
+			return err
+		}
+		cfg.InternalCompatibilityFlags.Overwrite = dev
+	}
+
+	if dev := cfg.InternalCompatibilityFlags.Overwrite; dev != "" {
+		if st, err := os.Stat(dev); err == nil && st.Mode()&os.ModeDevice != 0 {
+			if err := CheckDeviceWritable(dev, cfg.InternalCompatibilityFlags.Sudo); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !pack.SkipSpaceCheck {
+		if err := checkSpace(pack.spaceRequirements(), freeSpace); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("%s %s on GOARCH=%s GOOS=%s\n\n",
 		programName,
 		version.ReadBrief(),
@@ -1048,9 +1600,22 @@ func (pack *Pack) logic(programName string) error {
 	}
 
 	fmt.Printf("Build target: %s\n", strings.Join(filterGoEnv(packer.Env()), " "))
+	if gopath := packer.IsolatedGOPATHDir(); gopath != "" {
+		fmt.Printf("Isolated GOPATH: %s\n", gopath)
+	}
+	if pack.Workspace != "" {
+		fmt.Printf("Go workspace: %s\n", pack.Workspace)
+		packer.UseWorkspace(pack.Workspace)
+	}
 
-	buildTimestamp := time.Now().Format(time.RFC3339)
+	buildTimestamp := buildStart.Format(time.RFC3339)
+	if pack.Reproducible {
+		buildTimestamp = pack.fixedTime.Format(time.RFC3339)
+	}
 	fmt.Printf("Build timestamp: %s\n", buildTimestamp)
+	if pack.Version != "" {
+		fmt.Printf("Image version: %s\n", pack.Version)
+	}
 
 	dnsCheck := make(chan error)
 	go func() {
@@ -1076,7 +1641,7 @@ func (pack *Pack) logic(programName string) error {
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(bindir)
+	defer pack.removeTemp(bindir)
 
 	packageBuildFlags, err := findBuildFlagsFiles(cfg)
 	if err != nil {
@@ -1124,27 +1689,22 @@ func (pack *Pack) logic(programName string) error {
 		fmt.Printf("\n")
 	}
 
-	pkgs := append([]string{}, cfg.GokrazyPackagesOrDefault()...)
-	pkgs = append(pkgs, cfg.Packages...)
-	pkgs = append(pkgs, packer.InitDeps(cfg.InternalCompatibilityFlags.InitPkg)...)
-	noBuildPkgs := []string{
-		cfg.KernelPackageOrDefault(),
-	}
-	if fw := cfg.FirmwarePackageOrDefault(); fw != "" {
-		noBuildPkgs = append(noBuildPkgs, fw)
-	}
-	if e := cfg.EEPROMPackageOrDefault(); e != "" {
-		noBuildPkgs = append(noBuildPkgs, e)
-	}
+	pkgs, noBuildPkgs := imagePackages(cfg)
+	noBuildPkgs = append(noBuildPkgs, pack.extraKernelPackages()...)
 	// Ensure all build processes use umask 022. Programs like ntp which do
 	// privilege separation need the o+x bit.
 	syscall.Umask(0022)
 	buildEnv := &packer.BuildEnv{
 		BuildDir: packer.BuildDirOrMigrate,
 	}
+	goBuildStart := time.Now()
 	if err := buildEnv.Build(bindir, pkgs, packageBuildFlags, packageBuildTags, noBuildPkgs); err != nil {
 		return err
 	}
+	stats := &BuildStats{
+		Time:          buildStart,
+		BuildDuration: time.Since(goBuildStart),
+	}
 
 	fmt.Println()
 
@@ -1152,6 +1712,12 @@ func (pack *Pack) logic(programName string) error {
 		return err
 	}
 
+	if pack.RunTargetTests {
+		if err := pack.runTargetTests(cfg.Packages, packageBuildTags); err != nil {
+			return err
+		}
+	}
+
 	root, err := findBins(cfg, buildEnv, bindir)
 	if err != nil {
 		return err
@@ -1194,30 +1760,85 @@ func (pack *Pack) logic(programName string) error {
 		}
 	}
 
-	if cfg.InternalCompatibilityFlags.InitPkg == "" {
-		gokrazyInit := &gokrazyInit{
-			root:             root,
-			flagFileContents: flagFileContents,
-			envFileContents:  envFileContents,
-			buildTimestamp:   buildTimestamp,
-			dontStart:        dontStart,
-			waitForClock:     waitForClock,
+	tmpdir, err := ioutil.TempDir("", "gokrazy")
+	if err != nil {
+		return err
+	}
+	defer pack.removeTemp(tmpdir)
+
+	if pack.IntegrityCheck {
+		// The program needs to be present before generating init, which
+		// starts all programs of the root file system.
+		if err := addIntegrityCheckProgram(root, tmpdir); err != nil {
+			return err
+		}
+	}
+
+	if pack.RemoteExec {
+		if err := addRemoteExecProgram(root, tmpdir); err != nil {
+			return err
+		}
+	}
+
+	if pack.Etc != nil && len(pack.Etc.SearchDomains) > 0 {
+		if err := addDNSSearchProgram(root, tmpdir, pack.Etc.SearchDomains); err != nil {
+			return err
+		}
+	}
+
+	var captureServices []string
+	if pack.CrashLogSize > 0 {
+		// Only capture the services which init supervises.
+		captureServices = flattenFiles("/", root)
+		if err := addCrashLogsProgram(root, tmpdir); err != nil {
+			return err
 		}
+	}
+
+	if err := validateVolumes(pack.Volumes, root); err != nil {
+		return err
+	}
+
+	if err := validateHealthChecks(pack.HealthChecks, root); err != nil {
+		return err
+	}
+	gokrazyInit := &gokrazyInit{
+		root:             root,
+		flagFileContents: flagFileContents,
+		envFileContents:  envFileContents,
+		buildTimestamp:   buildTimestamp,
+		dontStart:        dontStart,
+		waitForClock:     waitForClock,
+		debug:            pack.InitDebug,
+		keepTemp:         pack.KeepTemp,
+		volumes:          pack.Volumes,
+	}
+	if cfg.InternalCompatibilityFlags.InitPkg != "" {
+		if err := gokrazyInit.checkInitPkg(cfg); err != nil {
+			return err
+		}
+	} else {
 		if cfg.InternalCompatibilityFlags.OverwriteInit != "" {
 			return gokrazyInit.dump(cfg.InternalCompatibilityFlags.OverwriteInit)
 		}
+		if fn := pack.outputDirInitPath(); fn != "" {
+			if err := gokrazyInit.dump(fn); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote init source to %s\n", fn)
+		}
 
 		tmpdir, err := gokrazyInit.build()
 		if err != nil {
 			return err
 		}
-		defer os.RemoveAll(tmpdir)
+		defer pack.removeTemp(tmpdir)
 
 		initPath := filepath.Join(tmpdir, "init")
 
 		fileIsELFOrFatal(initPath)
 
-		gokrazy := root.mustFindDirent("gokrazy")
+		gokrazy := mustFindDirent(root, "gokrazy")
 		gokrazy.Dirents = append(gokrazy.Dirents, &FileInfo{
 			Filename: "init",
 			FromHost: initPath,
@@ -1226,6 +1847,7 @@ func (pack *Pack) logic(programName string) error {
 
 	defaultPassword, updateHostname := updateflag.GetUpdateTarget(cfg.Hostname)
 	update, err := cfg.Update.WithFallbackToHostSpecific(cfg.Hostname)
+	pack.summary.secrets = append(pack.summary.secrets, update.HTTPPassword)
 	if err != nil {
 		return err
 	}
@@ -1271,16 +1893,11 @@ func (pack *Pack) logic(programName string) error {
 		if err != nil {
 			return err
 		}
-		lib := root.mustFindDirent("lib")
+		lib := mustFindDirent(root, "lib")
 		lib.Dirents = append(lib.Dirents, modules)
 	}
 
-	etc := root.mustFindDirent("etc")
-	tmpdir, err := ioutil.TempDir("", "gokrazy")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tmpdir)
+	etc := mustFindDirent(root, "etc")
 	hostLocaltime, err := hostLocaltime(tmpdir)
 	if err != nil {
 		return err
@@ -1305,6 +1922,12 @@ func (pack *Pack) logic(programName string) error {
 		Filename:    "hostname",
 		FromLiteral: cfg.Hostname,
 	})
+	if pack.Version != "" {
+		etc.Dirents = append(etc.Dirents, &FileInfo{
+			Filename:    "os-release",
+			FromLiteral: osReleaseContents(pack.Version, buildTimestamp),
+		})
+	}
 
 	ssl := &FileInfo{Filename: "ssl"}
 	ssl.Dirents = append(ssl.Dirents, &FileInfo{
@@ -1370,22 +1993,80 @@ func (pack *Pack) logic(programName string) error {
 		FromLiteral: update.HTTPSPort,
 	})
 
-	sbom, _, err := GenerateSBOM(cfg)
+	sbom, sbomWithHash, err := GenerateSBOM(cfg)
 	if err != nil {
 		return err
 	}
+	pack.audit.SBOMHash = sbomWithHash.SBOMHash
 	etcGokrazy := &FileInfo{Filename: "gokrazy"}
 	etcGokrazy.Dirents = append(etcGokrazy.Dirents, &FileInfo{
 		Filename:    "sbom.json",
 		FromLiteral: string(sbom),
 	})
+	// The instance config is embedded so that gok clone and -from can recover
+	// it exactly. It contains the update password, hence mode 0400 like
+	// /etc/gokr-pw.txt.
+	embedded := *cfg
+	embedded.InternalCompatibilityFlags = nil
+	embeddedConfig, err := embedded.FormatForFile()
+	if err != nil {
+		return err
+	}
+	etcGokrazy.Dirents = append(etcGokrazy.Dirents, &FileInfo{
+		Filename:    filepath.Base(embeddedConfigPath),
+		Mode:        0400,
+		FromLiteral: string(embeddedConfig),
+	})
 	etc.Dirents = append(etc.Dirents, etcGokrazy)
 
+	licenses := collectLicenses(root, noBuildPkgs)
+	fmt.Printf("Licenses of %d included modules: %s\n", len(licenses), licenseSummary(licenses))
+	etc.Dirents = append(etc.Dirents, licensesDir(licenses, pack.EmbedLicenseTexts))
+
+	if pack.Etc != nil {
+		if err := pack.Etc.apply(etc); err != nil {
+			return err
+		}
+	}
+
+	// Read the module information before binaries are replaced with
+	// compressed versions.
+	goMods, goVersion := goModules(root)
+
+	if pack.CompressBinaries {
+		if err := compressBinaries(root, tmpdir); err != nil {
+			return err
+		}
+	}
+
+	if pack.CrashLogSize > 0 {
+		if err := captureCrashes(root, tmpdir, captureServices, pack.CrashLogSize); err != nil {
+			return err
+		}
+	}
+
 	empty := &FileInfo{Filename: ""}
 	if paths := getDuplication(root, empty); len(paths) > 0 {
 		return fmt.Errorf("root file system contains duplicate files: your config contains multiple packages that install %s", paths)
 	}
 
+	tr := &templateRenderer{
+		data: extraFileTemplateData{
+			Hostname:  cfg.Hostname,
+			HTTPPort:  update.HTTPPort,
+			HTTPSPort: update.HTTPSPort,
+		},
+		flags: flagFileContents,
+		env:   envFileContents,
+	}
+	for pkg, fs := range extraFiles {
+		for _, fi := range fs {
+			if err := tr.render(pkg, "/", fi); err != nil {
+				return err
+			}
+		}
+	}
+
 	for pkg1, fs := range extraFiles {
 		for _, fs1 := range fs {
 			// check against root fs
@@ -1407,17 +2088,66 @@ func (pack *Pack) logic(programName string) error {
 			}
 
 			// add extra files to rootfs
-			if err := root.combine(fs1); err != nil {
+			if err := root.Combine(fs1); err != nil {
 				return fmt.Errorf("failed to add extra files from package %s: %v", pkg1, err)
 			}
 		}
 	}
 
+	if pack.RootManifest != nil {
+		if err := tr.render("", "/", pack.RootManifest.Root); err != nil {
+			return err
+		}
+		if paths := getDuplication(root, pack.RootManifest.Root); len(paths) > 0 {
+			return fmt.Errorf("root manifest collides with root file system: %v", paths)
+		}
+		if err := root.Combine(pack.RootManifest.Root); err != nil {
+			return fmt.Errorf("failed to add root manifest: %v", err)
+		}
+	}
+
+	if err := reportDuplicates(root, pack.DedupFiles); err != nil {
+		return err
+	}
+
+	if pack.IntegrityCheck {
+		if err := addIntegrityManifest(root); err != nil {
+			return err
+		}
+	}
+
+	if pack.ArtifactCache != "" {
+		cacheStats, err := cacheArtifacts(pack.ArtifactCache, root, []string{bindir, tmpdir})
+		if err != nil {
+			return fmt.Errorf("artifact cache %s: %v", pack.ArtifactCache, err)
+		}
+		fmt.Printf("\nArtifact cache: %v\n", cacheStats)
+	}
+
+	if pack.WriteRootManifest != "" {
+		if err := writeRootManifest(pack.WriteRootManifest, root); err != nil {
+			return err
+		}
+	}
+
+	// The policy is checked once the root file system is complete, but before
+	// any image is written.
+	var buildManifest *BuildManifest
+	if pack.Policy != nil {
+		if buildManifest, err = pack.buildManifest(root, goMods, goVersion, buildTimestamp); err != nil {
+			return fmt.Errorf("checking policy: %v", err)
+		}
+		if violations := pack.Policy.Check(buildManifest); len(violations) > 0 {
+			return fmt.Errorf("image violates the policy:\n\t%s", strings.Join(violations, "\n\t"))
+		}
+		fmt.Printf("Image complies with the policy\n")
+	}
+
 	var (
 		updateHttpClient         *http.Client
 		foundMatchingCertificate bool
 		updateBaseUrl            *url.URL
-		target                   *updater.Target
+		target                   *updateclient.Client
 	)
 
 	if !updateflag.NewInstallation() {
@@ -1457,7 +2187,7 @@ func (pack *Pack) logic(programName string) error {
 		}
 		updateBaseUrl.Path = "/"
 
-		target, err = updater.NewTarget(updateBaseUrl.String(), updateHttpClient)
+		target, err = updateclient.New(context.Background(), updateBaseUrl.String(), updateHttpClient)
 		if err != nil {
 			return fmt.Errorf("checking target partuuid support: %v", err)
 		}
@@ -1465,6 +2195,10 @@ func (pack *Pack) logic(programName string) error {
 		pack.UseGPTPartuuid = target.Supports("gpt")
 		pack.UseGPT = target.Supports("gpt")
 		pack.ExistingEEPROM = target.InstalledEEPROM()
+
+		if err := pack.checkDowngrade(context.Background(), updateHttpClient, updateBaseUrl, ".", buildTimestamp); err != nil {
+			return err
+		}
 	}
 	fmt.Printf("\n")
 	fmt.Printf("Feature summary:\n")
@@ -1489,23 +2223,69 @@ func (pack *Pack) logic(programName string) error {
 
 		isDev = err == nil && st.Mode()&os.ModeDevice == os.ModeDevice
 
+		if isDev && pack.Shrink {
+			return fmt.Errorf("--shrink requires writing the full image to a file, not to device %s (use gok flash to write shrunk images to devices)", cfg.InternalCompatibilityFlags.Overwrite)
+		}
+
+		if !isDev && pack.PreservePerm {
+			return fmt.Errorf("--preserve_perm requires overwriting a storage device, not %s", cfg.InternalCompatibilityFlags.Overwrite)
+		}
+
+		if pack.PreservePerm && pack.PermFileSystem != "" {
+			return fmt.Errorf("--preserve_perm cannot be combined with --perm_fs, which formats the perm partition")
+		}
+
+		if isDev && pack.VMFormat != "" {
+			return fmt.Errorf("--vm_format requires writing the full image to a file, not to device %s", cfg.InternalCompatibilityFlags.Overwrite)
+		}
+
+		if isDev && pack.Compress != "" {
+			return fmt.Errorf("--compress requires writing the full image to a file, not to device %s", cfg.InternalCompatibilityFlags.Overwrite)
+		}
+
+		pack.audit.Target = cfg.InternalCompatibilityFlags.Overwrite
 		if isDev {
+			pack.audit.Operation = "flash"
 			if err := pack.overwriteDevice(cfg.InternalCompatibilityFlags.Overwrite, root, rootDeviceFiles); err != nil {
 				return err
 			}
-			fmt.Printf("To boot gokrazy, plug the SD card into a supported device (see https://gokrazy.org/platforms/)\n")
-			fmt.Printf("\n")
+			pack.hint(i18n.Sprintf("To boot gokrazy, plug the SD card into a supported device (see https://gokrazy.org/platforms/)\n") + "\n")
+			stats.Target = "device"
 		} else {
-			lower := 1200*MB + 8192
+			lower := int(pack.MinDeviceSize())
 
 			if cfg.InternalCompatibilityFlags.TargetStorageBytes == 0 {
-				return fmt.Errorf("--target_storage_bytes is required (e.g. --target_storage_bytes=%d) when using overwrite with a file", lower)
+				size, err := streamTargetSize(cfg.InternalCompatibilityFlags.Overwrite)
+				if err != nil {
+					return err
+				}
+				if size > 0 {
+					fmt.Printf("Target %s: %d bytes\n", cfg.InternalCompatibilityFlags.Overwrite, size)
+					cfg.InternalCompatibilityFlags.TargetStorageBytes = int(size)
+				}
 			}
-			if cfg.InternalCompatibilityFlags.TargetStorageBytes%512 != 0 {
-				return fmt.Errorf("--target_storage_bytes must be a multiple of 512 (sector size), use e.g. %d", lower)
+
+			if !pack.Shrink { // shrunk images are sized for the smallest device
+				if cfg.InternalCompatibilityFlags.TargetStorageBytes == 0 {
+					return fmt.Errorf("--target_storage_bytes is required (e.g. --target_storage_bytes=%d) when using overwrite with a file", lower)
+				}
+				if cfg.InternalCompatibilityFlags.TargetStorageBytes%512 != 0 {
+					return fmt.Errorf("--target_storage_bytes must be a multiple of 512 (sector size), use e.g. %d", lower)
+				}
+				if cfg.InternalCompatibilityFlags.TargetStorageBytes < lower {
+					return fmt.Errorf("--target_storage_bytes must be at least %d (for the boot and root partitions, 100 MB /perm and extra partitions)", lower)
+				}
 			}
-			if cfg.InternalCompatibilityFlags.TargetStorageBytes < lower {
-				return fmt.Errorf("--target_storage_bytes must be at least %d (for boot + 2 root file systems + 100 MB /perm)", lower)
+
+			if pack.OutputDir != "" {
+				// The output directory also contains the boot and root file
+				// systems and the MBR as separate files.
+				if err := pack.writeBootFile(cfg.InternalCompatibilityFlags.OverwriteBoot, cfg.InternalCompatibilityFlags.OverwriteMBR); err != nil {
+					return err
+				}
+				if err := pack.writeRootFile(cfg.InternalCompatibilityFlags.OverwriteRoot, root); err != nil {
+					return err
+				}
 			}
 
 			bootSize, rootSize, err = pack.overwriteFile(cfg.InternalCompatibilityFlags.Overwrite, root, rootDeviceFiles)
@@ -1513,14 +2293,36 @@ func (pack *Pack) logic(programName string) error {
 				return err
 			}
 
-			fmt.Printf("To boot gokrazy, copy %s to an SD card and plug it into a supported device (see https://gokrazy.org/platforms/)\n", cfg.InternalCompatibilityFlags.Overwrite)
-			fmt.Printf("\n")
+			var hint string
+			if pack.VMFormat != "" {
+				hint = i18n.Sprintf("To boot gokrazy, import %s into your hypervisor or cloud provider and boot it via UEFI\n", cfg.InternalCompatibilityFlags.Overwrite)
+			} else if pack.Compress != "" {
+				hint = i18n.Sprintf("To boot gokrazy, write %s to an SD card (e.g. using the Raspberry Pi Imager) and plug it into a supported device (see https://gokrazy.org/platforms/)\n", cfg.InternalCompatibilityFlags.Overwrite) +
+					fmt.Sprintf("\t%s %s | sudo dd of=/dev/sdx bs=4M conv=fsync\n", imageCompressors[pack.Compress].decompress, cfg.InternalCompatibilityFlags.Overwrite)
+			} else if pack.Board != nil && pack.Board.qemuCommand(cfg.InternalCompatibilityFlags.Overwrite) != "" {
+				hint = i18n.Sprintf("To boot gokrazy, run e.g.:\n  %s\n", pack.Board.qemuCommand(cfg.InternalCompatibilityFlags.Overwrite))
+			} else if IsStreamTarget(cfg.InternalCompatibilityFlags.Overwrite) {
+				hint = i18n.Sprintf("To boot gokrazy, plug the SD card written from the stream into a supported device (see https://gokrazy.org/platforms/)\n")
+			} else {
+				hint = i18n.Sprintf("To boot gokrazy, copy %s to an SD card and plug it into a supported device (see https://gokrazy.org/platforms/)\n", cfg.InternalCompatibilityFlags.Overwrite)
+			}
+			pack.hint(hint + "\n")
+			stats.Target = "full"
+			stats.BootBytes, stats.RootBytes = bootSize, rootSize
 		}
 
 	case pack.Output != nil && pack.Output.Type == OutputTypeGaf && pack.Output.Path != "":
 		if err := pack.overwriteGaf(root); err != nil {
 			return err
 		}
+		stats.Target = "gaf"
+
+	case pack.Output != nil && pack.Output.Type == OutputTypeDirectBoot && pack.Output.Path != "":
+		if err := pack.writeDirectBoot(root); err != nil {
+			return err
+		}
+		pack.hint(i18n.Sprintf("To boot gokrazy, run e.g.:\n  %s\n", directBootQEMUCommand(pack.Output.Path, packer.TargetArch())) + "\n")
+		stats.Target = "directboot"
 
 	default:
 		if cfg.InternalCompatibilityFlags.OverwriteBoot != "" {
@@ -1530,7 +2332,7 @@ func (pack *Pack) logic(programName string) error {
 				if err != nil {
 					return err
 				}
-				defer os.Remove(tmpMBR.Name())
+				defer pack.removeTemp(tmpMBR.Name())
 				mbrfn = tmpMBR.Name()
 			}
 			if err := pack.writeBootFile(cfg.InternalCompatibilityFlags.OverwriteBoot, mbrfn); err != nil {
@@ -1539,7 +2341,7 @@ func (pack *Pack) logic(programName string) error {
 		}
 
 		if cfg.InternalCompatibilityFlags.OverwriteRoot != "" {
-			if err := writeRootFile(cfg.InternalCompatibilityFlags.OverwriteRoot, root); err != nil {
+			if err := pack.writeRootFile(cfg.InternalCompatibilityFlags.OverwriteRoot, root); err != nil {
 				return err
 			}
 		}
@@ -1549,15 +2351,17 @@ func (pack *Pack) logic(programName string) error {
 			if err != nil {
 				return err
 			}
-			defer os.Remove(tmpMBR.Name())
+			defer pack.removeTemp(tmpMBR.Name())
 
 			tmpBoot, err = ioutil.TempFile("", "gokrazy")
 			if err != nil {
 				return err
 			}
-			defer os.Remove(tmpBoot.Name())
+			defer pack.removeTemp(tmpBoot.Name())
 
-			if err := pack.writeBoot(tmpBoot, tmpMBR.Name()); err != nil {
+			if err := pack.writeHashed(tmpBoot, func(w io.ReadWriteSeeker) error {
+				return pack.writeBoot(w, tmpMBR.Name())
+			}); err != nil {
 				return err
 			}
 
@@ -1565,9 +2369,11 @@ func (pack *Pack) logic(programName string) error {
 			if err != nil {
 				return err
 			}
-			defer os.Remove(tmpRoot.Name())
+			defer pack.removeTemp(tmpRoot.Name())
 
-			if err := writeRoot(tmpRoot, root); err != nil {
+			if err := pack.writeHashed(tmpRoot, func(w io.ReadWriteSeeker) error {
+				return pack.writeRoot(w, root)
+			}); err != nil {
 				return err
 			}
 		}
@@ -1575,6 +2381,71 @@ func (pack *Pack) logic(programName string) error {
 
 	fmt.Printf("\nBuild complete!\n")
 
+	if stats.Target == "" {
+		stats.Target = "boot+root"
+		if tmpBoot != nil && tmpRoot != nil {
+			stats.Target = "update"
+			if st, err := tmpBoot.Stat(); err == nil {
+				stats.BootBytes = st.Size()
+			}
+			if st, err := tmpRoot.Stat(); err == nil {
+				stats.RootBytes = st.Size()
+			}
+		}
+	}
+	stats.TotalDuration = time.Since(buildStart)
+	recordStats(stats, bindir)
+
+	subjects := pack.outputSubjects(tmpBoot, tmpRoot)
+	pack.summary.Target = stats.Target
+	if pack.Summary != "" {
+		if pack.summary.Digests, err = subjectDigests(subjects); err != nil {
+			return fmt.Errorf("writing summary: %v", err)
+		}
+	}
+	if auditEnabled() {
+		if err := pack.audit.addDigests(subjects); err != nil {
+			fmt.Fprintf(os.Stderr, "recording audit event: %v\n", err)
+		}
+	}
+	if pack.Provenance != "" {
+		if err := pack.writeProvenance(subjects, goMods, goVersion, buildStart, time.Now()); err != nil {
+			return fmt.Errorf("writing provenance: %v", err)
+		}
+		fmt.Printf("Wrote provenance attestation to %s\n", pack.Provenance)
+		if pack.SignProvenance {
+			bundle, err := pack.signProvenance()
+			if err != nil {
+				return fmt.Errorf("signing %s: %v", pack.Provenance, err)
+			}
+			fmt.Printf("Wrote Sigstore bundle to %s\n", bundle)
+		}
+	}
+	if pack.BuildManifest != "" {
+		if buildManifest == nil {
+			if buildManifest, err = pack.buildManifest(root, goMods, goVersion, buildTimestamp); err != nil {
+				return fmt.Errorf("writing build manifest: %v", err)
+			}
+		}
+		if err := pack.writeBuildManifest(buildManifest, subjects); err != nil {
+			return fmt.Errorf("writing build manifest: %v", err)
+		}
+		fmt.Printf("Wrote build manifest to %s\n", pack.BuildManifest)
+	}
+	if pack.SHA256Sums != "" {
+		if err := pack.writeSHA256Sums(subjects); err != nil {
+			return fmt.Errorf("writing %s: %v", pack.SHA256Sums, err)
+		}
+		fmt.Printf("Wrote SHA256 hashes to %s\n", pack.SHA256Sums)
+		sig, err := pack.signSHA256Sums()
+		if err != nil {
+			return fmt.Errorf("signing %s: %v", pack.SHA256Sums, err)
+		}
+		if sig != "" {
+			fmt.Printf("Wrote signature to %s\n", sig)
+		}
+	}
+
 	hostPort := update.Hostname
 	if hostPort == "" {
 		hostPort = cfg.Hostname
@@ -1586,39 +2457,42 @@ func (pack *Pack) logic(programName string) error {
 		hostPort = fmt.Sprintf("%s:%s", hostPort, update.HTTPSPort)
 	}
 
-	fmt.Printf("\nTo interact with the device, gokrazy provides a web interface reachable at:\n")
-	fmt.Printf("\n")
-	fmt.Printf("\t%s://gokrazy:%s@%s/\n", schema, update.HTTPPassword, hostPort)
-	fmt.Printf("\n")
-	fmt.Printf("In addition, the following Linux consoles are set up:\n")
-	fmt.Printf("\n")
+	webURL := fmt.Sprintf("%s://gokrazy:%s@%s/", schema, update.HTTPPassword, hostPort)
+	var hint strings.Builder
+	fmt.Fprintf(&hint, "\nTo interact with the device, gokrazy provides a web interface reachable at:\n")
+	fmt.Fprintf(&hint, "\n")
+	fmt.Fprintf(&hint, "\t%s\n", webURL)
+	fmt.Fprintf(&hint, "\n")
+	fmt.Fprintf(&hint, "In addition, the following Linux consoles are set up:\n")
+	fmt.Fprintf(&hint, "\n")
 	if cfg.SerialConsoleOrDefault() != "disabled" {
-		fmt.Printf("\t1. foreground Linux console on the serial port (115200n8, pin 6, 8, 10 for GND, TX, RX), accepting input\n")
-		fmt.Printf("\t2. secondary Linux framebuffer console on HDMI; shows Linux kernel message but no init system messages\n")
+		fmt.Fprintf(&hint, "\t1. foreground Linux console on the serial port (115200n8, pin 6, 8, 10 for GND, TX, RX), accepting input\n")
+		fmt.Fprintf(&hint, "\t2. secondary Linux framebuffer console on HDMI; shows Linux kernel message but no init system messages\n")
 	} else {
-		fmt.Printf("\t1. foreground Linux framebuffer console on HDMI\n")
+		fmt.Fprintf(&hint, "\t1. foreground Linux framebuffer console on HDMI\n")
 	}
 
 	if cfg.SerialConsoleOrDefault() != "disabled" {
-		fmt.Printf("\n")
-		fmt.Printf("Use -serial_console=disabled to make gokrazy not touch the serial port,\nand instead make the framebuffer console on HDMI the foreground console\n")
+		fmt.Fprintf(&hint, "\n")
+		fmt.Fprintf(&hint, "Use -serial_console=disabled to make gokrazy not touch the serial port,\nand instead make the framebuffer console on HDMI the foreground console\n")
 	}
-	fmt.Printf("\n")
+	fmt.Fprintf(&hint, "\n")
 	if schema == "https" {
 		certObj, err := getCertificateFromString(update.CertPEM)
 		if err != nil {
 			return fmt.Errorf("error loading certificate: %v", err)
 		} else {
-			fmt.Printf("\n")
-			fmt.Printf("The TLS Certificate of the gokrazy web interface is located under\n")
-			fmt.Printf("\t%s\n", cfg.Meta.Path)
-			fmt.Printf("The fingerprint of the Certificate is\n")
-			fmt.Printf("\t%x\n", getCertificateFingerprintSHA1(certObj))
-			fmt.Printf("The certificate is valid until\n")
-			fmt.Printf("\t%s\n", certObj.NotAfter.String())
-			fmt.Printf("Please verify the certificate, before adding an exception to your browser!\n")
+			fmt.Fprintf(&hint, "\n")
+			fmt.Fprintf(&hint, "The TLS Certificate of the gokrazy web interface is located under\n")
+			fmt.Fprintf(&hint, "\t%s\n", cfg.Meta.Path)
+			fmt.Fprintf(&hint, "The fingerprint of the Certificate is\n")
+			fmt.Fprintf(&hint, "\t%x\n", getCertificateFingerprintSHA1(certObj))
+			fmt.Fprintf(&hint, "The certificate is valid until\n")
+			fmt.Fprintf(&hint, "\t%s\n", certObj.NotAfter.String())
+			fmt.Fprintf(&hint, "Please verify the certificate, before adding an exception to your browser!\n")
 		}
 	}
+	pack.hint(hint.String())
 
 	if err := <-dnsCheck; err != nil {
 		fmt.Printf("\nWARNING: if the above URL does not work, perhaps name resolution (DNS) is broken\n")
@@ -1627,6 +2501,7 @@ func (pack *Pack) logic(programName string) error {
 	}
 
 	if updateflag.NewInstallation() {
+		pack.printQRCode(webURL)
 		return nil
 	}
 
@@ -1650,7 +2525,7 @@ func (pack *Pack) logic(programName string) error {
 			if err != nil {
 				return err
 			}
-			if _, err := bootFile.Seek(8192*512, io.SeekStart); err != nil {
+			if _, err := bootFile.Seek(pack.BootOffset(), io.SeekStart); err != nil {
 				return err
 			}
 			bootReader = &io.LimitedReader{
@@ -1662,7 +2537,7 @@ func (pack *Pack) logic(programName string) error {
 			if err != nil {
 				return err
 			}
-			if _, err := rootFile.Seek(8192*512+100*MB, io.SeekStart); err != nil {
+			if _, err := rootFile.Seek(pack.RootOffset(), io.SeekStart); err != nil {
 				return err
 			}
 			rootReader = &io.LimitedReader{
@@ -1750,7 +2625,7 @@ func (pack *Pack) logic(programName string) error {
 			prog, f, target, fmt.Sprintf("root device file %s", rootDeviceFile.Name),
 			filepath.Join("device-specific", rootDeviceFile.Name),
 		); err != nil {
-			if errors.Is(err, updater.ErrUpdateHandlerNotImplemented) {
+			if errors.Is(err, updateclient.ErrNotSupported) {
 				log.Printf("target does not support updating device file %s yet, ignoring", rootDeviceFile.Name)
 				continue
 			}
@@ -1762,21 +2637,21 @@ func (pack *Pack) logic(programName string) error {
 		return err
 	}
 
-	if err := target.StreamTo("mbr", mbrReader); err != nil {
-		if err == updater.ErrUpdateHandlerNotImplemented {
+	if err := target.UpdateMBR(context.Background(), mbrReader); err != nil {
+		if errors.Is(err, updateclient.ErrNotSupported) {
 			log.Printf("target does not support updating MBR yet, ignoring")
 		} else {
-			return fmt.Errorf("updating MBR: %v", err)
+			return err
 		}
 	}
 
 	if cfg.InternalCompatibilityFlags.Testboot {
-		if err := target.Testboot(); err != nil {
-			return fmt.Errorf("enable testboot of non-active partition: %v", err)
+		if err := target.Testboot(context.Background()); err != nil {
+			return err
 		}
 	} else {
-		if err := target.Switch(); err != nil {
-			return fmt.Errorf("switching to non-active partition: %v", err)
+		if err := target.Switch(context.Background()); err != nil {
+			return err
 		}
 	}
 
@@ -1784,12 +2659,8 @@ func (pack *Pack) logic(programName string) error {
 	canc()
 
 	fmt.Printf("Triggering reboot\n")
-	if err := target.Reboot(); err != nil {
-		if errors.Is(err, syscall.ECONNRESET) {
-			fmt.Printf("ignoring reboot error: %v\n", err)
-		} else {
-			return fmt.Errorf("reboot: %v", err)
-		}
+	if err := target.Reboot(context.Background()); err != nil {
+		return err
 	}
 
 	const polltimeout = 5 * time.Minute
@@ -1797,26 +2668,32 @@ func (pack *Pack) logic(programName string) error {
 
 	pollctx, canc := context.WithTimeout(context.Background(), polltimeout)
 	defer canc()
-	for {
-		if err := pollctx.Err(); err != nil {
-			return fmt.Errorf("device did not become healthy after update (%v)", err)
+	if err := target.WaitForBuild(pollctx, buildTimestamp, func(err error) {
+		log.Printf("device not yet reachable: %v", err)
+	}); err != nil {
+		return fmt.Errorf("device did not become healthy after update (%v)", err)
+	}
+
+	if len(pack.HealthChecks) > 0 {
+		timeout := pack.HealthCheckTimeout
+		if timeout == 0 {
+			timeout = 2 * time.Minute
 		}
-		if err := pollUpdated1(pollctx, updateHttpClient, updateBaseUrl.String(), buildTimestamp); err != nil {
-			log.Printf("device not yet reachable: %v", err)
-			time.Sleep(1 * time.Second)
-			continue
+		fmt.Printf("Waiting %v for the health checks to pass\n", timeout)
+		if _, err := healthcheck.WaitHealthy(context.Background(), update.Hostname, pack.HealthChecks, timeout, log.Printf); err != nil {
+			return fmt.Errorf("device unhealthy after update: %v", err)
 		}
-
-		fmt.Printf("Device ready to use!\n")
-		break
 	}
 
+	fmt.Printf("Device ready to use!\n")
+	pack.printQRCode(webURL)
+
 	return nil
 }
 
 // kernelGoarch returns the GOARCH value that corresponds to the provided
-// vmlinuz header. It returns one of "arm64", "arm", "amd64", or the empty
-// string if not detected.
+// vmlinuz header. It returns one of "arm64", "arm", "amd64", "riscv64", or the
+// empty string if not detected.
 func kernelGoarch(hdr []byte) string {
 	// Some constants from the file(1) command's magic.
 	const (
@@ -1829,10 +2706,16 @@ func kernelGoarch(hdr []byte) string {
 		// x86: https://github.com/file/file/blob/65be1904/magic/Magdir/linux#L137-L152
 		x86Magic       = 0xaa55
 		x86MagicOffset = 0x1fe
+		// riscv64 (the magic2 field of the Image header): https://docs.kernel.org/arch/riscv/boot-image-header.html
+		riscv64Magic       = 0x05435352
+		riscv64MagicOffset = 0x38
 	)
 	if len(hdr) >= arm64MagicOffset+4 && binary.LittleEndian.Uint32(hdr[arm64MagicOffset:]) == arm64Magic {
 		return "arm64"
 	}
+	if len(hdr) >= riscv64MagicOffset+4 && binary.LittleEndian.Uint32(hdr[riscv64MagicOffset:]) == riscv64Magic {
+		return "riscv64"
+	}
 	if len(hdr) >= arm64MagicOffset+4 && binary.LittleEndian.Uint32(hdr[arm32MagicOffset:]) == arm32Magic {
 		return "arm"
 	}
@@ -1871,7 +2754,7 @@ func (pack *Pack) validateTargetArchMatchesKernel() error {
 	}
 	targetArch := packer.TargetArch()
 	if kernelArch != targetArch {
-		return fmt.Errorf("target architecture %q (GOARCH) doesn't match the %s kernel type %q",
+		return fmt.Errorf("target architecture %q (GOARCH, see -arch) doesn't match the %s kernel type %q",
 			targetArch,
 			cfg.KernelPackageOrDefault(),
 			kernelArch)
@@ -1879,18 +2762,22 @@ func (pack *Pack) validateTargetArchMatchesKernel() error {
 	return nil
 }
 
-func updateWithProgress(prog *progress.Reporter, reader io.Reader, target *updater.Target, logStr string, stream string) error {
+func updateWithProgress(prog *progress.Reporter, reader io.Reader, target *updateclient.Client, logStr string, stream string) error {
 	start := time.Now()
 	prog.SetStatus(fmt.Sprintf("update %s", logStr))
 	prog.SetTotal(0)
 
+	var total int64
 	if stater, ok := reader.(interface{ Stat() (os.FileInfo, error) }); ok {
 		if st, err := stater.Stat(); err == nil {
-			prog.SetTotal(uint64(st.Size()))
+			total = st.Size()
+			prog.SetTotal(uint64(total))
 		}
 	}
-	if err := target.StreamTo(stream, io.TeeReader(reader, &progress.Writer{})); err != nil {
-		return fmt.Errorf("updating %s: %w", logStr, err)
+	phase := measure.StartPhase("update "+logStr, total)
+	defer phase.End()
+	if err := target.Stream(context.Background(), stream, io.TeeReader(reader, io.MultiWriter(&progress.Writer{}, phase))); err != nil {
+		return fmt.Errorf("updating %s: %w", logStr, errors.Unwrap(err))
 	}
 	duration := time.Since(start)
 	transferred := progress.Reset()
@@ -1903,8 +2790,73 @@ func updateWithProgress(prog *progress.Reporter, reader io.Reader, target *updat
 	return nil
 }
 
+// outputSubjects returns the images which logic wrote, for the provenance
+// and the audit log.
+func (pack *Pack) outputSubjects(tmpBoot, tmpRoot *os.File) []provenanceSubject {
+	cfg := pack.Cfg
+	var subjects []provenanceSubject
+	for _, fn := range []string{
+		cfg.InternalCompatibilityFlags.Overwrite,
+		cfg.InternalCompatibilityFlags.OverwriteBoot,
+		cfg.InternalCompatibilityFlags.OverwriteRoot,
+		cfg.InternalCompatibilityFlags.OverwriteMBR,
+	} {
+		if fn == cfg.InternalCompatibilityFlags.Overwrite && pack.streamedSHA256 != "" {
+			subjects = append(subjects, provenanceSubject{name: fn, sha256: pack.streamedSHA256})
+			continue
+		}
+		if fn != "" {
+			subjects = append(subjects, provenanceSubject{name: filepath.Base(fn), path: fn, sha256: pack.digests[fn]})
+		}
+	}
+	if pack.Output != nil && pack.Output.Type == OutputTypeGaf && pack.Output.Path != "" {
+		subjects = append(subjects, provenanceSubject{name: filepath.Base(pack.Output.Path), path: pack.Output.Path})
+	}
+	if pack.Output != nil && pack.Output.Type == OutputTypeDirectBoot && pack.Output.Path != "" {
+		for _, fn := range []string{directBootKernel, directBootCmdline, directBootInitramfs} {
+			subjects = append(subjects, provenanceSubject{name: fn, path: filepath.Join(pack.Output.Path, fn)})
+		}
+	}
+	if tmpBoot != nil {
+		subjects = append(subjects, provenanceSubject{name: "boot.img", path: tmpBoot.Name(), sha256: pack.digests[tmpBoot.Name()]})
+	}
+	if tmpRoot != nil {
+		subjects = append(subjects, provenanceSubject{name: "root.img", path: tmpRoot.Name(), sha256: pack.digests[tmpRoot.Name()]})
+	}
+	return subjects
+}
+
+// run runs logic and records the run in the audit log and the summary.
+func (pack *Pack) run(programName string) error {
+	err := pack.logic(programName)
+	if pack.audit != nil {
+		recordAudit(pack.audit, err)
+	}
+	if summaryErr := pack.writeSummary(err); summaryErr != nil && err == nil {
+		err = fmt.Errorf("writing summary: %v", summaryErr)
+	}
+	return err
+}
+
 func (pack *Pack) Main(programName string) {
-	if err := pack.logic(programName); err != nil {
+	if pack.Cfg.InternalCompatibilityFlags.Overwrite == streamStdout {
+		if err := redirectStdout(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	run := pack.run
+	if len(pack.ModelImages) > 0 {
+		run = pack.mainModelImages
+	}
+	stop, err := pack.startProfiling()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = run(programName)
+	if stopErr := stop(); stopErr != nil && err == nil {
+		err = fmt.Errorf("profiling: %v", stopErr)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
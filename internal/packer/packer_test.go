@@ -6,7 +6,7 @@ import (
 )
 
 func TestKernelGoarch(t *testing.T) {
-	for _, arch := range []string{"arm", "arm64", "amd64"} {
+	for _, arch := range []string{"arm", "arm64", "amd64", "riscv64"} {
 		t.Run(arch, func(t *testing.T) {
 			k, err := os.ReadFile("testdata/kernel." + arch)
 			if err != nil {
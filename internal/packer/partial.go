@@ -0,0 +1,88 @@
+package packer
+
+import (
+	"io"
+	"os"
+)
+
+// partialSuffix is appended to the names of output files while they are
+// being written, so that an interrupted build never leaves a truncated image
+// under the final name, which someone might flash later.
+const partialSuffix = ".partial"
+
+// backupSuffix is appended to the name of the previous output file with
+// Pack.KeepBackup.
+const backupSuffix = ".bak"
+
+// createPartial creates the file <target>.partial, which commitPartial renames
+// to target once it is complete.
+func createPartial(target string) (*os.File, error) {
+	return os.Create(target + partialSuffix)
+}
+
+// abortPartial removes <target>.partial, if it still exists, i.e. if writing
+// it failed. Callers defer it after createPartial.
+func abortPartial(target string) {
+	os.Remove(target + partialSuffix)
+}
+
+// commitPartial renames the completely written <target>.partial to target.
+// With KeepBackup, a previous target is kept as <target>.bak.
+func (p *Pack) commitPartial(target string) error {
+	partial := target + partialSuffix
+	if p.KeepBackup {
+		if err := os.Rename(target, target+backupSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(partial, target); err != nil {
+		return err
+	}
+	// The hash was recorded under the name of the partial file (see
+	// writeHashed).
+	if sum, ok := p.digests[partial]; ok {
+		delete(p.digests, partial)
+		p.digests[target] = sum
+	}
+	return nil
+}
+
+// isPartialTarget returns whether target is written via createPartial and
+// commitPartial, i.e. whether it is a regular file or does not exist yet.
+// Other targets, e.g. block devices like --boot=/dev/sdx1, are written in
+// place, as renaming the partial file would replace the device node.
+func isPartialTarget(target string) bool {
+	st, err := os.Stat(target)
+	return err != nil || st.Mode().IsRegular()
+}
+
+// writeOutputFile calls write with the output file target (see writeHashed),
+// which is written via <target>.partial unless it is a device (see
+// isPartialTarget).
+func (p *Pack) writeOutputFile(target string, write func(w io.ReadWriteSeeker) error) error {
+	if !isPartialTarget(target) {
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := p.writeHashed(f, write); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	f, err := createPartial(target)
+	if err != nil {
+		return err
+	}
+	defer abortPartial(target)
+	defer f.Close()
+	if err := p.writeHashed(f, write); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return p.commitPartial(target)
+}
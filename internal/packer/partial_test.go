@@ -0,0 +1,93 @@
+package packer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommitPartial(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "gokrazy.img")
+	if err := os.WriteFile(target, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(contents string) {
+		t.Helper()
+		f, err := createPartial(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readFile := func(fn string) string {
+		t.Helper()
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// An interrupted build leaves the previous image untouched.
+	write("trunc")
+	abortPartial(target)
+	if _, err := os.Stat(target + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after abortPartial", target+partialSuffix)
+	}
+	if got, want := readFile(target), "previous"; got != want {
+		t.Errorf("%s = %q, want %q", target, got, want)
+	}
+
+	write("new")
+	p := &Pack{
+		KeepBackup: true,
+		digests:    map[string]string{target + partialSuffix: "cafe"},
+	}
+	if err := p.commitPartial(target); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFile(target), "new"; got != want {
+		t.Errorf("%s = %q, want %q", target, got, want)
+	}
+	if got, want := readFile(target+backupSuffix), "previous"; got != want {
+		t.Errorf("%s = %q, want %q", target+backupSuffix, got, want)
+	}
+	if got, want := p.digests[target], "cafe"; got != want {
+		t.Errorf("digest of %s = %q, want %q", target, got, want)
+	}
+}
+
+func TestWriteOutputFileDevice(t *testing.T) {
+	st, err := os.Stat(os.DevNull)
+	if err != nil || st.Mode()&os.ModeDevice == 0 {
+		t.Skipf("%s is not a device", os.DevNull)
+	}
+	// A symlink to the device, like the /dev/disk/by-id/ symlinks.
+	target := filepath.Join(t.TempDir(), "boot")
+	if err := os.Symlink(os.DevNull, target); err != nil {
+		t.Fatal(err)
+	}
+	p := &Pack{KeepBackup: true}
+	if err := p.writeOutputFile(target, func(w io.ReadWriteSeeker) error {
+		_, err := io.WriteString(w, "boot file system")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.Readlink(target); err != nil || got != os.DevNull {
+		t.Errorf("Readlink(%s) = %q, %v, want %q (device written in place)", target, got, err, os.DevNull)
+	}
+	for _, fn := range []string{target + partialSuffix, target + backupSuffix} {
+		if _, err := os.Lstat(fn); !os.IsNotExist(err) {
+			t.Errorf("%s unexpectedly exists (%v)", fn, err)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package packer
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"strconv"
 	"syscall"
+
+	"github.com/gokrazy/internal/humanize"
 )
 
 func (p *Pack) partitionDevice(o *os.File, path string) error {
@@ -15,10 +18,22 @@ func (p *Pack) partitionDevice(o *os.File, path string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("device holds %d bytes", devsize)
 	if devsize == 0 {
 		return fmt.Errorf("path %s does not seem to be a device", path)
 	}
+	// The perm partition grows to fill the device, minus extra partitions.
+	log.Printf("device holds %d bytes (%s), perm partition: %s",
+		devsize,
+		humanize.Bytes(devsize),
+		humanize.Bytes(uint64(p.PermSizeInKB(devsize))*1024))
+
+	if p.PreservePerm {
+		if err := p.checkPreservePerm(o, devsize); err != nil {
+			return err
+		}
+		offset, size := p.PermExtent(devsize)
+		log.Printf("preserving the existing perm partition (offset %d, %s)", offset, humanize.Bytes(uint64(size)))
+	}
 
 	if err := p.Partition(o, devsize); err != nil {
 		return err
@@ -27,6 +42,25 @@ func (p *Pack) partitionDevice(o *os.File, path string) error {
 	return p.RereadPartitions(o)
 }
 
+// fileDeviceSize returns the size of the device f in bytes as reported by the
+// kernel (see deviceSize), so that the perm partition and its file system span
+// the whole device. For regular files (e.g. in tests), and where the ioctl is
+// not supported, it falls back to the offset of the end of f, which is 0 for
+// raw disk devices on macOS.
+func fileDeviceSize(f *os.File) (uint64, error) {
+	if devsize, err := deviceSize(f.Fd()); err == nil && devsize > 0 {
+		return devsize, nil
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if end == 0 {
+		return 0, fmt.Errorf("could not determine the size of %s", f.Name())
+	}
+	return uint64(end), nil
+}
+
 func mustUnixConn(fd uintptr) *net.UnixConn {
 	fc, err := net.FileConn(os.NewFile(fd, ""))
 	if err != nil {
@@ -39,6 +73,10 @@ func (p *Pack) SudoPartition(path string) (*os.File, error) {
 	if fd, err := strconv.Atoi(os.Getenv("GOKR_PACKER_FD")); err == nil {
 		// child process
 		conn := mustUnixConn(uintptr(fd))
+		if dev := os.Getenv("GOKR_PACKER_DEV"); dev != "" {
+			// e.g. the loop device attached for the loop: target
+			path = dev
+		}
 		f, err := os.Create(path)
 		if err != nil {
 			return nil, err
@@ -66,6 +104,7 @@ func (p *Pack) SudoPartition(path string) (*os.File, error) {
 	// descriptors but stdin, stdout and stderr.
 	cmd.Env = []string{
 		"GOKR_PACKER_FD=1",
+		"GOKR_PACKER_DEV=" + path,
 		fmt.Sprintf("HOME=%s", os.Getenv("HOME")), // for instance config detection
 	}
 	cmd.Stdout = os.NewFile(uintptr(pair[1]), "")
@@ -127,9 +166,11 @@ func (p *Pack) partition(path string) (*os.File, error) {
 			log.Printf("If you prefer, cancel and use: sudo setfacl -m u:${USER}:rw %s", path)
 			return p.SudoPartition(path)
 		}
+		if ok && pe.Err == syscall.EACCES {
+			return nil, permissionError(path)
+		}
 		if ok && pe.Err == syscall.EROFS {
-			log.Printf("%s read-only; check if you have a physical write-protect switch on your SD card?", path)
-			return nil, err
+			return nil, writeProtectedError(path)
 		}
 		return nil, err
 	}
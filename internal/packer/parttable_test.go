@@ -0,0 +1,29 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDeviceSize(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fileDeviceSize(f); err == nil {
+		t.Errorf("fileDeviceSize(empty file) = nil error, want error")
+	}
+	const size = 64 * MB
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fileDeviceSize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != size {
+		t.Errorf("fileDeviceSize() = %d, want %d", got, size)
+	}
+}
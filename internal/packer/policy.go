@@ -0,0 +1,148 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// PolicyFile is the name of the file in the instance directory from which gok
+// reads the Policy, if present.
+const PolicyFile = "policy.json"
+
+// Policy are rules which the contents of an image (see BuildManifest) need to
+// satisfy, e.g. for organizations which standardize the images of their
+// fleet. For example:
+//
+//	{
+//	  "Hostname": "^site-",
+//	  "MaxFileSize": "50M",
+//	  "MinModuleVersions": {"golang.org/x/net": "v0.17.0"},
+//	  "ForbiddenModules": ["github.com/example/unvetted"]
+//	}
+type Policy struct {
+	// Hostname is a regular expression which the hostname needs to match,
+	// if non-empty.
+	Hostname string `json:",omitempty"`
+
+	// MaxFileSize is the maximum size (e.g. 50M) of each file of the root
+	// file system, if non-empty.
+	MaxFileSize string `json:",omitempty"`
+
+	// MinModuleVersions maps Go module paths to the minimum (semantic)
+	// version which the programs may be built with.
+	MinModuleVersions map[string]string `json:",omitempty"`
+
+	// ForbiddenModules are Go module paths (or prefixes ending in /) which
+	// the programs must not be built with.
+	ForbiddenModules []string `json:",omitempty"`
+
+	hostname    *regexp.Regexp
+	maxFileSize uint64
+}
+
+// ReadPolicy reads the Policy from the JSON file path.
+func ReadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pol Policy
+	if err := json.Unmarshal(b, &pol); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := pol.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &pol, nil
+}
+
+// Validate returns an error if a rule of the policy is invalid.
+func (pol *Policy) Validate() error {
+	if pol.Hostname != "" {
+		re, err := regexp.Compile(pol.Hostname)
+		if err != nil {
+			return fmt.Errorf("Hostname: %v", err)
+		}
+		pol.hostname = re
+	}
+	if pol.MaxFileSize != "" {
+		size, err := parseSize(pol.MaxFileSize)
+		if err != nil {
+			return fmt.Errorf("MaxFileSize: %v", err)
+		}
+		pol.maxFileSize = size
+	}
+	for mod, version := range pol.MinModuleVersions {
+		if !semver.IsValid(version) {
+			return fmt.Errorf("MinModuleVersions: module %s: invalid version %q, expected e.g. v1.2.3", mod, version)
+		}
+	}
+	for _, mod := range pol.ForbiddenModules {
+		if mod == "" {
+			return fmt.Errorf("ForbiddenModules: empty module path")
+		}
+	}
+	return nil
+}
+
+// forbidden returns whether the module path is one of the ForbiddenModules.
+func (pol *Policy) forbidden(path string) bool {
+	for _, mod := range pol.ForbiddenModules {
+		if path == mod || (strings.HasSuffix(mod, "/") && strings.HasPrefix(path, mod)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the violations of the policy by the image described by m,
+// sorted, or nil if the image complies with the policy. The boot files are
+// not checked, as the policy is checked before the images are written. The
+// policy needs to be validated first (see Validate).
+func (pol *Policy) Check(m *BuildManifest) []string {
+	var violations []string
+	if pol.hostname != nil && !pol.hostname.MatchString(m.Hostname) {
+		violations = append(violations, fmt.Sprintf("hostname %q does not match %q", m.Hostname, pol.Hostname))
+	}
+
+	// The main modules of the programs are not among the dependencies in
+	// m.Modules.
+	modules := append([]ManifestModule(nil), m.Modules...)
+	for _, f := range m.Root {
+		if pol.maxFileSize > 0 && uint64(f.Size) > pol.maxFileSize {
+			violations = append(violations, fmt.Sprintf("file %s: size %d bytes exceeds the maximum of %s", f.Path, f.Size, pol.MaxFileSize))
+		}
+		if f.Module != nil {
+			modules = append(modules, *f.Module)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, mod := range modules {
+		key := mod.Path + "@" + mod.Version
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if pol.forbidden(mod.Path) {
+			violations = append(violations, fmt.Sprintf("module %s is forbidden", key))
+		}
+		min, ok := pol.MinModuleVersions[mod.Path]
+		if !ok {
+			continue
+		}
+		// Modules without a (valid) version, e.g. (devel) builds of local
+		// working copies, are older than any minimum version.
+		if !semver.IsValid(mod.Version) || semver.Compare(mod.Version, min) < 0 {
+			violations = append(violations, fmt.Sprintf("module %s is older than the minimum version %s", key, min))
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
@@ -0,0 +1,93 @@
+package packer
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	m := &BuildManifest{
+		Hostname: "lab-scanner",
+		Modules: []ManifestModule{
+			{Path: "golang.org/x/net", Version: "v0.10.0"},
+			{Path: "golang.org/x/sys", Version: "v0.8.0"},
+			{Path: "github.com/example/unvetted/lib", Version: "v1.0.0"},
+		},
+		Root: []ManifestFile{
+			{Path: "/etc/hostname", Size: 11},
+			{
+				Path:    "/user/scan2drive",
+				Size:    60 * MB,
+				Package: "github.com/stapelberg/scan2drive/cmd/scan2drive",
+				Module:  &ManifestModule{Path: "github.com/stapelberg/scan2drive", Version: "(devel)"},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy Policy
+		want   []string
+	}{
+		{
+			name: "empty",
+		},
+
+		{
+			name:   "hostname",
+			policy: Policy{Hostname: "^site-"},
+			want:   []string{`hostname "lab-scanner" does not match "^site-"`},
+		},
+
+		{
+			name:   "max file size",
+			policy: Policy{MaxFileSize: "50M"},
+			want:   []string{"file /user/scan2drive: size 62914560 bytes exceeds the maximum of 50M"},
+		},
+
+		{
+			name: "min module versions",
+			policy: Policy{MinModuleVersions: map[string]string{
+				"golang.org/x/net":                 "v0.17.0",
+				"golang.org/x/sys":                 "v0.8.0",
+				"github.com/stapelberg/scan2drive": "v1.0.0",
+			}},
+			want: []string{
+				"module github.com/stapelberg/scan2drive@(devel) is older than the minimum version v1.0.0",
+				"module golang.org/x/net@v0.10.0 is older than the minimum version v0.17.0",
+			},
+		},
+
+		{
+			name: "forbidden modules",
+			policy: Policy{ForbiddenModules: []string{
+				"github.com/example/",
+				"golang.org/x/sy", // not a prefix ending in /
+			}},
+			want: []string{"module github.com/example/unvetted/lib@v1.0.0 is forbidden"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, tt.policy.Check(m)); diff != "" {
+				t.Errorf("Check: unexpected violations (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, pol := range []Policy{
+		{Hostname: "^site-("},
+		{MaxFileSize: "50 apples"},
+		{MinModuleVersions: map[string]string{"golang.org/x/net": "0.17"}},
+		{ForbiddenModules: []string{""}},
+	} {
+		if err := pol.Validate(); err == nil {
+			t.Errorf("Validate(%+v) unexpectedly succeeded", pol)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package packer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/httpclient"
+	"github.com/gokrazy/tools/updateclient"
+)
+
+// PowerAction is a power management request of the gokrazy device API.
+type PowerAction string
+
+const (
+	// Reboot restarts the device, like after an update.
+	Reboot PowerAction = "reboot"
+
+	// Poweroff shuts the device down. It stays off until power-cycled.
+	Poweroff PowerAction = "poweroff"
+)
+
+// Power sends the action to the running gokrazy instance configured in cfg,
+// using the same address and credentials as gok update.
+func Power(ctx context.Context, cfg *config.Struct, action PowerAction) error {
+	httpClient, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return err
+	}
+	baseURL.Path = "/" + string(action)
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected HTTP status code: got %d, want %d (body %q)", action, got, want, string(body))
+	}
+	return nil
+}
+
+// SwitchRoot makes the running gokrazy instance configured in cfg boot from
+// its inactive root partition (only for the next boot if testboot is true,
+// like gok update --testboot) and reboots it. This flips between the current and the
+// previous image without packing a new one, e.g. to roll back an update.
+func SwitchRoot(ctx context.Context, cfg *config.Struct, testboot bool) error {
+	httpClient, _, baseURL, err := httpclient.For(cfg)
+	if err != nil {
+		return err
+	}
+	target, err := updateclient.New(ctx, baseURL.String(), httpClient)
+	if err != nil {
+		return err
+	}
+	if testboot {
+		err = target.Testboot(ctx)
+	} else {
+		err = target.Switch(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return target.Reboot(ctx)
+}
@@ -0,0 +1,82 @@
+package packer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/updateflag"
+)
+
+func TestPower(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/poweroff" {
+			http.Error(w, "not supported", http.StatusNotFound)
+			return
+		}
+		got = append(got, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	updateflag.SetUpdate(srv.URL + "/")
+	defer updateflag.SetUpdate("")
+	cfg := &config.Struct{Hostname: "gokrazy-power-test"}
+	if err := Power(context.Background(), cfg, Reboot); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "/reboot" {
+		t.Errorf("requests = %q, want [/reboot]", got)
+	}
+	if err := Power(context.Background(), cfg, Poweroff); err == nil {
+		t.Errorf("Power(Poweroff) unexpectedly succeeded despite HTTP 404")
+	}
+}
+
+func TestSwitchRoot(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/update/features" {
+			http.NotFound(w, r)
+			return
+		}
+		got = append(got, r.Method+" "+r.URL.Path)
+	}))
+	defer srv.Close()
+
+	updateflag.SetUpdate(srv.URL + "/")
+	defer updateflag.SetUpdate("")
+	cfg := &config.Struct{Hostname: "gokrazy-power-test"}
+	for _, tt := range []struct {
+		testboot bool
+		want     string
+	}{
+		{false, "POST /update/switch, POST /reboot"},
+		{true, "POST /update/testboot, POST /reboot"},
+	} {
+		got = nil
+		if err := SwitchRoot(context.Background(), cfg, tt.testboot); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(got, ", "); got != tt.want {
+			t.Errorf("SwitchRoot(testboot=%v): requests = %q, want %q", tt.testboot, got, tt.want)
+		}
+	}
+
+	got = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := SwitchRoot(ctx, cfg, false); err == nil {
+		t.Errorf("SwitchRoot unexpectedly succeeded despite a canceled context")
+	}
+	if len(got) != 0 {
+		t.Errorf("SwitchRoot with a canceled context: requests = %q, want none", got)
+	}
+}
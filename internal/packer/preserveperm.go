@@ -0,0 +1,28 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+)
+
+// checkPreservePerm verifies that the device r (of devsize bytes) holds a
+// gokrazy installation whose perm partition (partition 4) is exactly where the
+// new partition table puts it, so that PreservePerm can leave its contents
+// untouched. Otherwise, re-partitioning would silently cut off or misplace the
+// file system.
+func (p *Pack) checkPreservePerm(r io.ReaderAt, devsize uint64) error {
+	parts, err := readPartitions(r)
+	if err != nil {
+		return fmt.Errorf("--preserve_perm: no existing gokrazy installation found: %v", err)
+	}
+	if len(parts) < 4 || parts[3].size == 0 || parts[0].offset != p.BootOffset() {
+		return fmt.Errorf("--preserve_perm: no existing gokrazy installation found (expected a boot partition at %d MB and a perm partition 4)", p.BootOffset()/MB)
+	}
+	old := parts[3]
+	offset, size := p.PermExtent(devsize)
+	if old.offset != offset || old.size != size {
+		return fmt.Errorf("--preserve_perm: the existing perm partition (offset %d, %d bytes) does not match the new layout (offset %d, %d bytes): keep the partition sizes, partition table and extra partitions of the existing installation, or back up /perm (e.g. with gok backup --perm) and write the image without --preserve_perm",
+			old.offset, old.size, offset, size)
+	}
+	return nil
+}
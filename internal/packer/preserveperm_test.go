@@ -0,0 +1,65 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+func TestCheckPreservePerm(t *testing.T) {
+	const devsize = 4 * 1024 * MB
+	newPack := func(gpt bool) *Pack {
+		p := &Pack{Pack: packer.NewPackForHost("preservetest")}
+		p.UseGPT = gpt
+		return p
+	}
+	for _, tt := range []struct {
+		name      string
+		existing  *Pack // nil: blank device
+		modify    func(p *Pack)
+		wantError bool
+	}{
+		{name: "gpt", existing: newPack(true)},
+		{name: "mbr", existing: newPack(false)},
+		{name: "blank device", wantError: true},
+		{name: "partition table changed", existing: newPack(true), modify: func(p *Pack) { p.UseGPT = false }, wantError: true},
+		{name: "root size changed", existing: newPack(true), modify: func(p *Pack) { p.Layout.RootSize = 1000 * MB }, wantError: true},
+		{name: "single slot", existing: newPack(true), modify: func(p *Pack) { p.Layout.SingleSlot = true }, wantError: true},
+		{name: "extra partition added", existing: newPack(true), modify: func(p *Pack) {
+			p.Layout.Extra = []packer.ExtraPartition{{Name: "data", Size: 100 * MB, Type: "linux"}}
+		}, wantError: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := f.Truncate(devsize); err != nil {
+				t.Fatal(err)
+			}
+			p := newPack(true)
+			if tt.existing != nil {
+				if err := tt.existing.Partition(f, devsize); err != nil {
+					t.Fatal(err)
+				}
+				p = newPack(tt.existing.UseGPT)
+			}
+			if tt.modify != nil {
+				tt.modify(p)
+			}
+			err = p.checkPreservePerm(f, devsize)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("checkPreservePerm() = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
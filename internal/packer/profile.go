@@ -0,0 +1,70 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfiling starts writing the CPU profile and the execution trace of
+// the packer (see Pack.CPUProfile and Pack.Trace), if requested. The returned
+// function stops them and writes the memory profile (see Pack.MemProfile).
+func (p *Pack) startProfiling() (stop func() error, _ error) {
+	var stops []func() error
+	stop = func() error {
+		var firstErr error
+		for _, s := range stops {
+			if err := s(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	if p.CPUProfile != "" {
+		f, err := os.Create(p.CPUProfile)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("starting CPU profile: %v", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+	if p.Trace != "" {
+		f, err := os.Create(p.Trace)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stop()
+			return nil, fmt.Errorf("starting trace: %v", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+	if p.MemProfile != "" {
+		stops = append(stops, func() error {
+			f, err := os.Create(p.MemProfile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			runtime.GC() // up-to-date statistics
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				return fmt.Errorf("writing memory profile: %v", err)
+			}
+			return f.Close()
+		})
+	}
+	return stop, nil
+}
@@ -0,0 +1,240 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/gokrazy/tools/internal/version"
+	"github.com/gokrazy/tools/packer"
+)
+
+// The types below implement the subset of the in-toto attestation framework
+// (https://github.com/in-toto/attestation) and the SLSA provenance predicate
+// (https://slsa.dev/spec/v1.0/provenance) that the packer fills in.
+
+type digestSet map[string]string
+
+type intotoSubject struct {
+	Name   string    `json:"name"`
+	Digest digestSet `json:"digest"`
+}
+
+type resourceDescriptor struct {
+	Name   string    `json:"name,omitempty"`
+	URI    string    `json:"uri,omitempty"`
+	Digest digestSet `json:"digest,omitempty"`
+}
+
+type provenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type provenanceMetadata struct {
+	StartedOn  string `json:"startedOn"`
+	FinishedOn string `json:"finishedOn"`
+}
+
+type provenanceRunDetails struct {
+	Builder  provenanceBuilder  `json:"builder"`
+	Metadata provenanceMetadata `json:"metadata"`
+}
+
+type provenanceBuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]any       `json:"externalParameters"`
+	InternalParameters   map[string]any       `json:"internalParameters,omitempty"`
+	ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition provenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      provenanceRunDetails      `json:"runDetails"`
+}
+
+type intotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []intotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// provenanceSubject is one file which the packer produced.
+type provenanceSubject struct {
+	name string // e.g. boot.img
+	path string // on the host
+
+	// sha256 is the hash of subjects which were streamed instead of written
+	// to path, or which were hashed while writing them (see writeHashed).
+	sha256 string
+}
+
+// writeProvenance writes an in-toto statement containing a SLSA
+// provenance predicate about the produced files to pack.Provenance.
+//
+// The statement is signed separately, see signProvenance.
+func (pack *Pack) writeProvenance(subjects []provenanceSubject, modules []*debug.Module, goVersion string, started, finished time.Time) error {
+	cfg := pack.Cfg
+	stmt := intotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+	for _, subj := range subjects {
+		if subj.sha256 != "" {
+			stmt.Subject = append(stmt.Subject, intotoSubject{
+				Name:   subj.name,
+				Digest: digestSet{"sha256": subj.sha256},
+			})
+			continue
+		}
+		st, err := os.Stat(subj.path)
+		if err != nil {
+			return err
+		}
+		if !st.Mode().IsRegular() {
+			continue // e.g. a block device
+		}
+		sum, err := sha256File(subj.path)
+		if err != nil {
+			return err
+		}
+		stmt.Subject = append(stmt.Subject, intotoSubject{
+			Name:   subj.name,
+			Digest: digestSet{"sha256": sum},
+		})
+	}
+
+	_, sbom, err := GenerateSBOM(cfg)
+	if err != nil {
+		return err
+	}
+	var deps []resourceDescriptor
+	for _, fh := range append(append([]FileHash{sbom.SBOM.ConfigHash}, sbom.SBOM.GoModHashes...), sbom.SBOM.ExtraFileHashes...) {
+		path := fh.Path
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		deps = append(deps, resourceDescriptor{
+			URI:    "file://" + path,
+			Digest: digestSet{"sha256": fh.Hash},
+		})
+	}
+	for _, mod := range modules {
+		rd := resourceDescriptor{
+			URI: "pkg:golang/" + mod.Path + "@" + mod.Version,
+		}
+		if mod.Replace != nil {
+			rd.Name = "replaced by " + mod.Replace.Path + " " + mod.Replace.Version
+		}
+		if mod.Sum != "" {
+			// go.sum hash (dirhash) of the module contents, see
+			// https://go.dev/ref/mod#go-sum-files
+			rd.Digest = digestSet{"dirHash1": mod.Sum}
+		}
+		deps = append(deps, rd)
+	}
+	if goVersion != "" {
+		deps = append(deps, resourceDescriptor{
+			Name: "go toolchain",
+			URI:  "pkg:golang/std@" + goVersion,
+		})
+	}
+
+	externalParameters := map[string]any{
+		"hostname":   cfg.Hostname,
+		"deviceType": cfg.DeviceType,
+		"packages":   cfg.Packages,
+		"sbomHash":   sbom.SBOMHash,
+	}
+	if pack.Version != "" {
+		externalParameters["version"] = pack.Version
+	}
+
+	stmt.Predicate = slsaProvenance{
+		BuildDefinition: provenanceBuildDefinition{
+			BuildType:          "https://gokrazy.org/provenance/pack/v1",
+			ExternalParameters: externalParameters,
+			InternalParameters: map[string]any{
+				"goEnv": filterGoEnv(packer.Env()),
+			},
+			ResolvedDependencies: deps,
+		},
+		RunDetails: provenanceRunDetails{
+			Builder: provenanceBuilder{
+				ID: "https://github.com/gokrazy/tools",
+				Version: map[string]string{
+					"gokrazy/tools": version.Read(),
+					"host":          runtime.GOOS + "/" + runtime.GOARCH,
+				},
+			},
+			Metadata: provenanceMetadata{
+				StartedOn:  started.UTC().Format(time.RFC3339),
+				FinishedOn: finished.UTC().Format(time.RFC3339),
+			},
+		},
+	}
+	b, err := json.MarshalIndent(stmt, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	return os.WriteFile(pack.Provenance, b, 0644)
+}
+
+// checkProvenanceSigning verifies that the provenance can be signed as
+// requested.
+func (pack *Pack) checkProvenanceSigning() error {
+	if !pack.SignProvenance {
+		return nil
+	}
+	if pack.Provenance == "" {
+		return fmt.Errorf("--sign_provenance requires --provenance, as the provenance statement is what gets signed")
+	}
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return fmt.Errorf("signing the provenance: %v (install cosign, see https://docs.sigstore.dev/)", err)
+	}
+	return nil
+}
+
+// signProvenance signs the provenance statement with Sigstore keyless signing
+// and returns the path of the resulting bundle (<provenance>.sigstore.json).
+// cosign obtains a short-lived certificate for the OIDC identity of the user
+// (interactively in the browser) or of the CI job, and records the signature
+// in the Rekor transparency log. Consumers verify the statement with cosign
+// verify-blob --bundle.
+func (pack *Pack) signProvenance() (string, error) {
+	bundle := pack.Provenance + ".sigstore.json"
+	cmd := exec.Command("cosign",
+		"sign-blob",
+		"--yes", // consent to uploading the identity to the transparency log
+		"--bundle", bundle,
+		pack.Provenance)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	return bundle, nil
+}
@@ -0,0 +1,23 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckProvenanceSigning(t *testing.T) {
+	if err := (&Pack{Provenance: "provenance.json"}).checkProvenanceSigning(); err != nil {
+		t.Errorf("checkProvenanceSigning() without --sign_provenance = %v, want nil", err)
+	}
+
+	err := (&Pack{SignProvenance: true}).checkProvenanceSigning()
+	if want := "requires --provenance"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("checkProvenanceSigning() = %v, want error containing %q", err, want)
+	}
+
+	t.Setenv("PATH", t.TempDir()) // no cosign
+	err = (&Pack{Provenance: "provenance.json", SignProvenance: true}).checkProvenanceSigning()
+	if want := "install cosign"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("checkProvenanceSigning() = %v, want error containing %q", err, want)
+	}
+}
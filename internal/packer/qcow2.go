@@ -0,0 +1,151 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Constants of the qcow2 format (version 2), see
+// https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+const (
+	qcow2Magic       = 0x514649fb // "QFI\xfb"
+	qcow2ClusterBits = 16
+	qcow2ClusterSize = 1 << qcow2ClusterBits
+
+	// qcow2Copied marks L1 and L2 entries of clusters with refcount 1.
+	qcow2Copied = 1 << 63
+
+	// 16 bit refcounts (the only width supported by version 2).
+	qcow2RefcountsPerBlock = qcow2ClusterSize / 2
+	qcow2EntriesPerTable   = qcow2ClusterSize / 8
+)
+
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+// writeQcow2 converts the raw disk image of size bytes into a qcow2 image,
+// which only contains the clusters which are not all zero. The image is written
+// sequentially: the header, the L1, refcount and L2 tables, then the data.
+func writeQcow2(w io.Writer, raw io.ReaderAt, size int64) error {
+	clusters := divRoundUp(size, qcow2ClusterSize)
+	allocated, err := allocatedBlocks(raw, size, qcow2ClusterSize)
+	if err != nil {
+		return err
+	}
+
+	// Lay out the metadata.
+	l1Entries := divRoundUp(clusters, qcow2EntriesPerTable)
+	l1Clusters := divRoundUp(l1Entries*8, qcow2ClusterSize)
+	l2Index := make(map[int64]int64) // L1 index → position among the L2 tables
+	for _, c := range allocated {
+		if _, ok := l2Index[c/qcow2EntriesPerTable]; !ok {
+			l2Index[c/qcow2EntriesPerTable] = int64(len(l2Index))
+		}
+	}
+	l2Tables := int64(len(l2Index))
+	data := int64(len(allocated))
+	// The refcount blocks need to cover all clusters, including themselves.
+	var refBlocks, refTableClusters int64
+	for {
+		total := 1 + l1Clusters + refTableClusters + refBlocks + l2Tables + data
+		needBlocks := divRoundUp(total, qcow2RefcountsPerBlock)
+		needTable := divRoundUp(needBlocks*8, qcow2ClusterSize)
+		if needBlocks == refBlocks && needTable == refTableClusters {
+			break
+		}
+		refBlocks, refTableClusters = needBlocks, needTable
+	}
+	l1Offset := int64(1)
+	refTableOffset := l1Offset + l1Clusters
+	refBlocksOffset := refTableOffset + refTableClusters
+	l2Offset := refBlocksOffset + refBlocks
+	dataOffset := l2Offset + l2Tables
+	total := dataOffset + data
+
+	bw := bufio.NewWriterSize(w, qcow2ClusterSize)
+	// writeTable writes the uint64 entries, padded to whole clusters.
+	writeTable := func(entries []uint64, numClusters int64) error {
+		table := make([]byte, numClusters*qcow2ClusterSize)
+		for i, e := range entries {
+			binary.BigEndian.PutUint64(table[i*8:], e)
+		}
+		_, err := bw.Write(table)
+		return err
+	}
+
+	header := make([]byte, qcow2ClusterSize)
+	var hdr bytes.Buffer
+	binary.Write(&hdr, binary.BigEndian, qcow2Header{
+		Magic:                 qcow2Magic,
+		Version:               2,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Entries),
+		L1TableOffset:         uint64(l1Offset * qcow2ClusterSize),
+		RefcountTableOffset:   uint64(refTableOffset * qcow2ClusterSize),
+		RefcountTableClusters: uint32(refTableClusters),
+	})
+	copy(header, hdr.Bytes())
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	l1 := make([]uint64, l1Entries)
+	for idx, pos := range l2Index {
+		l1[idx] = uint64((l2Offset+pos)*qcow2ClusterSize) | qcow2Copied
+	}
+	if err := writeTable(l1, l1Clusters); err != nil {
+		return err
+	}
+
+	refTable := make([]uint64, refBlocks)
+	for i := range refTable {
+		refTable[i] = uint64((refBlocksOffset + int64(i)) * qcow2ClusterSize)
+	}
+	if err := writeTable(refTable, refTableClusters); err != nil {
+		return err
+	}
+
+	refcounts := make([]byte, refBlocks*qcow2ClusterSize)
+	for c := int64(0); c < total; c++ {
+		binary.BigEndian.PutUint16(refcounts[c*2:], 1)
+	}
+	if _, err := bw.Write(refcounts); err != nil {
+		return err
+	}
+
+	l2 := make([]uint64, l2Tables*qcow2EntriesPerTable)
+	for i, c := range allocated {
+		pos := l2Index[c/qcow2EntriesPerTable]
+		l2[pos*qcow2EntriesPerTable+c%qcow2EntriesPerTable] = uint64((dataOffset+int64(i))*qcow2ClusterSize) | qcow2Copied
+	}
+	if err := writeTable(l2, l2Tables); err != nil {
+		return err
+	}
+
+	buf := make([]byte, qcow2ClusterSize)
+	for _, c := range allocated {
+		if err := readBlock(raw, size, c, buf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,29 @@
+package packer
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gokrazy/tools/internal/i18n"
+	"github.com/gokrazy/tools/internal/qrcode"
+)
+
+// printQRCode prints url as QR code, if enabled (see QRCode).
+func (p *Pack) printQRCode(url string) {
+	if !p.QRCode {
+		return
+	}
+	code, err := qrcode.Encode(url)
+	if err != nil {
+		log.Printf("not printing the QR code: %v", err)
+		return
+	}
+	fmt.Printf("\n")
+	i18n.Printf("Scan the QR code to open the web interface:\n")
+	fmt.Printf("\n")
+	if err := code.WriteTerminal(os.Stdout); err != nil {
+		log.Printf("printing the QR code: %v", err)
+	}
+	fmt.Printf("\n")
+}
@@ -0,0 +1,451 @@
+package packer
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+const (
+	// RemoteExecPort is the TCP port on which the remote-exec program accepts
+	// commands.
+	RemoteExecPort = "8078"
+
+	// RemoteExecStatusTrailer is the HTTP trailer in which remote-exec returns
+	// the exit status of the command.
+	RemoteExecStatusTrailer = "X-Exit-Status"
+
+	// RemoteExecDigestTrailer is the HTTP trailer in which remote-exec returns
+	// the hex-encoded SHA-256 digest of a backup, so that the download can be
+	// verified.
+	RemoteExecDigestTrailer = "X-Content-Sha256"
+
+	// RemoteExecBackupPath is the path prefix under which remote-exec serves
+	// the current boot and root partitions (…/boot and …/root, raw) and the
+	// contents of /perm (…/perm, as tar archive).
+	RemoteExecBackupPath = "/backup/"
+
+	// RemoteExecRestorePermPath is the path to which a tar archive (as
+	// created by RemoteExecBackupPath/perm) is POSTed to extract it into
+	// /perm.
+	RemoteExecRestorePermPath = "/restore/perm"
+
+	// RemoteExecOSReleasePath is the path at which remote-exec serves
+	// /etc/os-release, which contains the image version (see Pack.Version).
+	RemoteExecOSReleasePath = "/os-release"
+
+	// webCertPath and webKeyPath are the TLS certificate and key of the
+	// gokrazy web interface (see Update.CertPEM). When present, remote-exec
+	// and crash-logs serve HTTPS with them, too.
+	webCertPath = "/etc/ssl/gokrazy-web.pem"
+	webKeyPath  = "/etc/ssl/gokrazy-web.key.pem"
+)
+
+// remoteExecSource is the source of the remote-exec program, a recovery
+// escape hatch for devices on which nothing else (e.g. breakglass) is
+// reachable: it runs one command per POST /exec request (with the repeated
+// arg form value as its command line, protected with the gokrazy password)
+// and streams its combined stdout and stderr output, followed by its exit
+// status in a trailer. For backups, it also serves the partitions the device
+// currently runs from under RemoteExecBackupPath (with their digest in a
+// trailer), and restores /perm from
+// archives POSTed to RemoteExecRestorePermPath. It serves /etc/os-release
+// under RemoteExecOSReleasePath for the downgrade check of updates. Like the
+// gokrazy web interface, it serves HTTPS if the instance uses TLS.
+const remoteExecSource = `package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	port          = %q
+	statusTrailer = %q
+	digestTrailer = %q
+	backupPath    = %q
+	restorePath   = %q
+	osReleasePath = %q
+	certFile      = %q
+	keyFile       = %q
+)
+
+// flushWriter flushes each write so that the output of long-running commands
+// arrives immediately.
+type flushWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// writtenWriter records whether the response was started and hashes it.
+type writtenWriter struct {
+	http.ResponseWriter
+	written bool
+	hash    hash.Hash
+}
+
+func (w *writtenWriter) Write(p []byte) (int, error) {
+	w.written = true
+	n, err := w.ResponseWriter.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// partitionDevice returns the device node of the partition with the specified
+// number on the disk from which the root file system is mounted, or of the
+// root partition itself for number 0.
+func partitionDevice(number int) (string, error) {
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	var majorMinor string
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		if f := strings.Fields(line); len(f) > 4 && f[4] == "/" {
+			majorMinor = f[2]
+		}
+	}
+	if majorMinor == "" {
+		return "", fmt.Errorf("root file system not found in /proc/self/mountinfo")
+	}
+	root, err := filepath.EvalSymlinks("/sys/dev/block/" + majorMinor)
+	if err != nil {
+		return "", err
+	}
+	if number == 0 {
+		return "/dev/" + filepath.Base(root), nil
+	}
+	disk := filepath.Dir(root)
+	entries, err := os.ReadDir(disk)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(disk, e.Name(), "partition"))
+		if err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(number) {
+			return "/dev/" + e.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("partition %%d not found in %%s", number, disk)
+}
+
+// servePartition streams the raw contents of the partition. There is no
+// Content-Length header, as trailers require chunked encoding.
+func servePartition(w http.ResponseWriter, number int) error {
+	dev, err := partitionDevice(number)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(dev)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// servePerm streams the contents of /perm as tar archive.
+func servePerm(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "application/x-tar")
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir("/perm", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel("/perm", path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return nil // e.g. sockets cannot be archived, skip them
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// restorePerm extracts the tar archive r into /perm, overwriting existing
+// files, and returns the number of extracted entries. The archive is trusted,
+// as restoring requires the gokrazy password.
+func restorePerm(r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dest := filepath.Join("/perm", name)
+		mode := fs.FileMode(hdr.Mode) & fs.ModePerm
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return n, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, mode); err != nil {
+				return n, err
+			}
+			if err := os.Chmod(dest, mode); err != nil {
+				return n, err
+			}
+		case tar.TypeReg:
+			// Replace the file instead of truncating it, in case it is
+			// still open.
+			tmp := dest + ".restore"
+			f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return n, err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return n, err
+			}
+			if err := f.Close(); err != nil {
+				return n, err
+			}
+			if err := os.Chmod(tmp, mode); err != nil {
+				return n, err
+			}
+			if err := os.Rename(tmp, dest); err != nil {
+				return n, err
+			}
+		case tar.TypeSymlink:
+			if err := os.RemoveAll(dest); err != nil {
+				return n, err
+			}
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return n, err
+			}
+		default:
+			log.Printf("restore: skipping %%s (unsupported type %%c)", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		if err := os.Lchown(dest, hdr.Uid, hdr.Gid); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func main() {
+	pw, err := os.ReadFile("/etc/gokr-pw.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	password := strings.TrimSpace(string(pw))
+	authorized := func(w http.ResponseWriter, r *http.Request) bool {
+		if _, got, ok := r.BasicAuth(); !ok || subtle.ConstantTimeCompare([]byte(got), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"gokrazy\"")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	http.HandleFunc(backupPath, func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		w.Header().Set("Trailer", digestTrailer)
+		ww := &writtenWriter{ResponseWriter: w, hash: sha256.New()}
+		var err error
+		switch what := strings.TrimPrefix(r.URL.Path, backupPath); what {
+		case "boot":
+			err = servePartition(ww, 1)
+		case "root":
+			err = servePartition(ww, 0)
+		case "perm":
+			err = servePerm(ww)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("%%s: backup of %%s: %%v", r.RemoteAddr, r.URL.Path, err)
+			if ww.written {
+				// Abort the connection so that the client notices the
+				// truncated response.
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(digestTrailer, hex.EncodeToString(ww.hash.Sum(nil)))
+		log.Printf("%%s: served backup of %%s", r.RemoteAddr, r.URL.Path)
+	})
+	http.HandleFunc(restorePath, func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := restorePerm(r.Body)
+		if err != nil {
+			log.Printf("%%s: restore of /perm failed after %%d entries: %%v", r.RemoteAddr, n, err)
+			http.Error(w, fmt.Sprintf("restore failed after %%d entries: %%v", n, err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%%s: restored %%d entries into /perm", r.RemoteAddr, n)
+		fmt.Fprintf(w, "restored %%d entries into /perm\n", n)
+	})
+	http.HandleFunc(osReleasePath, func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		http.ServeFile(w, r, "/etc/os-release")
+	})
+	http.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		args := r.PostForm["arg"]
+		if len(args) == 0 {
+			http.Error(w, "no command specified", http.StatusBadRequest)
+			return
+		}
+		timeout := time.Minute
+		if t := r.PostFormValue("timeout"); t != "" {
+			timeout, err = time.ParseDuration(t)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		log.Printf("%%s: running %%q (timeout %%v)", r.RemoteAddr, args, timeout)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Trailer", statusTrailer)
+		out := &flushWriter{w: w}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		status := 0
+		if err := cmd.Run(); err != nil {
+			status = -1
+			if ee, ok := err.(*exec.ExitError); ok {
+				if ws := ee.Sys().(syscall.WaitStatus); ws.Exited() {
+					status = ws.ExitStatus()
+				}
+			}
+			if ctx.Err() != nil {
+				err = fmt.Errorf("%%v (timeout %%v)", err, timeout)
+			}
+			if status == -1 {
+				fmt.Fprintf(out, "remote-exec: %%v\n", err)
+			}
+		}
+		log.Printf("%%s: %%q exited with status %%d", r.RemoteAddr, args, status)
+		w.Header().Set(statusTrailer, fmt.Sprint(status))
+	})
+	if _, err := os.Stat(certFile); err == nil {
+		log.Printf("accepting commands on port %%s (TLS)", port)
+		log.Fatal(http.ListenAndServeTLS(":"+port, certFile, keyFile, nil))
+	}
+	log.Printf("accepting commands on port %%s", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
+`
+
+// RemoteExecURL returns the URL of path on the remote-exec program of the
+// gokrazy instance at baseURL (the update URL, see httpclient.For).
+// remote-exec serves on its own port, using the same scheme as the gokrazy web
+// interface, so requests need to be sent with the httpclient.For client.
+func RemoteExecURL(baseURL *url.URL, path string) *url.URL {
+	return &url.URL{
+		Scheme: baseURL.Scheme,
+		User:   baseURL.User,
+		Host:   net.JoinHostPort(baseURL.Hostname(), RemoteExecPort),
+		Path:   path,
+	}
+}
+
+// addRemoteExecProgram adds the remote-exec program to /user. It needs to be
+// called before generating init, like for all other services.
+func addRemoteExecProgram(root *FileInfo, tmpdir string) error {
+	bin, err := buildStandalone(tmpdir, "remote-exec", fmt.Sprintf(remoteExecSource, RemoteExecPort, RemoteExecStatusTrailer, RemoteExecDigestTrailer, RemoteExecBackupPath, RemoteExecRestorePermPath, RemoteExecOSReleasePath, webCertPath, webKeyPath))
+	if err != nil {
+		return err
+	}
+	user := mustFindDirent(root, "user")
+	user.Dirents = append(user.Dirents, &FileInfo{
+		Filename: "remote-exec",
+		FromHost: bin,
+	})
+	return nil
+}
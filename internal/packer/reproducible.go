@@ -0,0 +1,77 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gokrazy/tools/packer"
+)
+
+// minFATTime is the earliest time which FAT file systems can represent.
+var minFATTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// sourceDateEpoch returns the time which reproducible builds use for all
+// timestamps: $SOURCE_DATE_EPOCH (see
+// https://reproducible-builds.org/specs/source-date-epoch/) or, if unset, the
+// commit time of the git repository containing dir. Using the commit time
+// (instead of a fixed time) keeps build timestamps increasing, which the
+// downgrade check relies on.
+func sourceDateEpoch(dir string) (t time.Time, source string, _ error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	source = "$SOURCE_DATE_EPOCH"
+	if epoch == "" {
+		var stderr bytes.Buffer
+		cmd := exec.Command("git", "log", "-1", "--format=%ct")
+		cmd.Dir = dir
+		cmd.Stderr = &stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("reproducible builds need $SOURCE_DATE_EPOCH or a git repository for their timestamps: %v: %v: %s", cmd.Args, err, strings.TrimSpace(stderr.String()))
+		}
+		epoch = strings.TrimSpace(string(b))
+		source = "git commit time"
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%s: %v", source, err)
+	}
+	t = time.Unix(sec, 0).UTC()
+	if t.Before(minFATTime) {
+		return time.Time{}, "", fmt.Errorf("%s: %s is before %s, which the FAT boot file system cannot represent", source, t.Format(time.RFC3339), minFATTime.Format(time.RFC3339))
+	}
+	return t, source, nil
+}
+
+// setUpReproducible fixes all timestamps to the source date (see
+// sourceDateEpoch) and makes the Go binaries reproducible.
+func (p *Pack) setUpReproducible(dir string) error {
+	t, source, err := sourceDateEpoch(dir)
+	if err != nil {
+		return err
+	}
+	p.fixedTime = t
+	packer.UseReproducibleBuilds()
+	fmt.Printf("Reproducible build, all timestamps set to %s (%s)\n", t.Format(time.RFC3339), source)
+	return nil
+}
+
+// now returns the time for files created by the packer.
+func (p *Pack) now() time.Time {
+	if !p.fixedTime.IsZero() {
+		return p.fixedTime
+	}
+	return time.Now()
+}
+
+// modTime returns the modification time for a copy of the host file st.
+func (p *Pack) modTime(st os.FileInfo) time.Time {
+	if !p.fixedTime.IsZero() {
+		return p.fixedTime
+	}
+	return st.ModTime()
+}
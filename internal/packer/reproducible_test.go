@@ -0,0 +1,53 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	got, source, err := sourceDateEpoch(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1700000000, 0); !got.Equal(want) {
+		t.Errorf("sourceDateEpoch() = %v, want %v", got, want)
+	}
+	if source != "$SOURCE_DATE_EPOCH" {
+		t.Errorf("sourceDateEpoch() source = %q, want $SOURCE_DATE_EPOCH", source)
+	}
+
+	for _, epoch := range []string{"0", "yesterday"} {
+		t.Setenv("SOURCE_DATE_EPOCH", epoch)
+		if _, _, err := sourceDateEpoch(t.TempDir()); err == nil {
+			t.Errorf("sourceDateEpoch(SOURCE_DATE_EPOCH=%s) unexpectedly succeeded", epoch)
+		}
+	}
+}
+
+func TestPackFixedTime(t *testing.T) {
+	fixed := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	p := &Pack{fixedTime: fixed}
+	if got := p.now(); !got.Equal(fixed) {
+		t.Errorf("now() = %v, want %v", got, fixed)
+	}
+	bin := filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(bin, []byte("ELF"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := &FileInfo{
+		Dirents: []*FileInfo{
+			{Filename: "hello", FromHost: bin},
+		},
+	}
+	dir, err := p.ext4File(root, p.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dir.Entries[0].ModTime; !got.Equal(fixed) {
+		t.Errorf("ext4 mtime of host file = %v, want %v", got, fixed)
+	}
+}
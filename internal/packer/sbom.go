@@ -49,12 +49,21 @@ type SBOMWithHash struct {
 // GenerateSBOM generates a Software Bills Of Material (SBOM) for the
 // local gokrazy instance.
 func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
+	return GenerateInstanceSBOM(instanceflag.ParentDir(), instanceflag.Instance(), cfg)
+}
+
+// GenerateInstanceSBOM is like GenerateSBOM, but for the instance in parentDir
+// (which contains one subdirectory per instance) instead of the instance
+// selected by the --instance and --parent_dir flags, e.g. for each instance
+// of a fleet.
+func GenerateInstanceSBOM(parentDir, instance string, cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, SBOMWithHash{}, err
 	}
 	defer os.Chdir(wd)
-	instancePath := config.InstancePath()
+	instanceDir := filepath.Join(parentDir, instance)
+	instancePath := instanceDir
 	if err := os.Chdir(instancePath); err != nil {
 		if os.IsNotExist(err) {
 			// best-effort compatibility for old setups
@@ -71,7 +80,7 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 
 	result := SBOM{
 		ConfigHash: FileHash{
-			Path: config.InstanceConfigPath(),
+			Path: filepath.Join(instanceDir, "config.json"),
 			Hash: fmt.Sprintf("%x", sha256.Sum256([]byte(formattedCfg))),
 		},
 	}
@@ -97,7 +106,7 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 			if os.IsNotExist(err) {
 				wd, _ := os.Getwd()
 				errStr := fmt.Sprintf("Error: build directory %q does not exist in %q\n", buildDir, wd)
-				errStr += fmt.Sprintf("Try 'gok -i %s add %s' followed by an update.\n", instanceflag.Instance(), pkg)
+				errStr += fmt.Sprintf("Try 'gok -i %s add %s' followed by an update.\n", instance, pkg)
 				errStr += fmt.Sprintf("Afterwards, your 'gok sbom' command should work")
 				return nil, SBOMWithHash{}, fmt.Errorf("%s: %w", errStr, err)
 			} else {
@@ -153,7 +162,7 @@ func GenerateSBOM(cfg *config.Struct) ([]byte, SBOMWithHash, error) {
 			continue
 		}
 
-		if err := os.Chdir(config.InstancePath()); err != nil {
+		if err := os.Chdir(instanceDir); err != nil {
 			if os.IsNotExist(err) {
 				// best-effort compatibility for old setups
 			} else {
@@ -0,0 +1,202 @@
+package packer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/tools/internal/i18n"
+	"github.com/gokrazy/tools/packer"
+)
+
+// shrinkMetadata is stored next to images created with Shrink, so that Flash
+// can create the partition table for the size of the target device.
+type shrinkMetadata struct {
+	Pack           packer.Pack
+	PermFileSystem string `json:",omitempty"`
+	PermLabel      string `json:",omitempty"`
+	Version        string `json:",omitempty"`
+
+	// Size is the number of bytes of the image: the partition table, the boot
+	// partition and the used part of the first root partition.
+	Size int64
+}
+
+// ShrinkMetadataPath returns the path of the metadata file of the shrunk image
+// at path.
+func ShrinkMetadataPath(image string) string {
+	return image + ".json"
+}
+
+func (p *Pack) checkShrink() error {
+	for _, e := range p.Layout.Extra {
+		if e.Source != "" {
+			return fmt.Errorf("--shrink cannot be combined with extra partition sources (extra partition %q)", e.Name)
+		}
+	}
+	return nil
+}
+
+// shrinkFile truncates the image f after the used part of the first root
+// partition (rootSize bytes) and writes the metadata which Flash needs.
+func (p *Pack) shrinkFile(f *os.File, target string, rootSize int64) error {
+	size := p.RootOffset() + rootSize
+	if rem := size % 512; rem != 0 {
+		size += 512 - rem
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	md := shrinkMetadata{
+		Pack:           p.Pack,
+		PermFileSystem: p.PermFileSystem,
+		PermLabel:      p.PermLabel,
+		Version:        p.Version,
+		Size:           size,
+	}
+	b, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if err := os.WriteFile(ShrinkMetadataPath(target), b, 0644); err != nil {
+		return err
+	}
+	i18n.Printf("Wrote shrunk image (%d MB) and %s\n", size/MB, ShrinkMetadataPath(target))
+	p.hint(i18n.Sprintf("To write the image to an SD card, creating partitions for its size, use:\n") + fmt.Sprintf("\tgok flash %s /dev/sdx\n", target) + "\n")
+	return nil
+}
+
+// Flash writes an image created with Shrink to the device dev. The partition
+// table is created for the size of dev, so that the perm partition fills the
+// device. deviceSync is the sync policy (see DeviceSyncPolicies), deviceRetries
+// the number of retries of writes failing with an I/O error. hideHints
+// suppresses the mkfs instructions (see Pack.HideHints).
+func Flash(image, dev, sudo, deviceSync string, deviceRetries int, hideHints bool) error {
+	b, err := os.ReadFile(ShrinkMetadataPath(image))
+	if err != nil {
+		return fmt.Errorf("%v (was %s created with --shrink?)", err, image)
+	}
+	var md shrinkMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return fmt.Errorf("%s: %v", ShrinkMetadataPath(image), err)
+	}
+	if sudo == "" {
+		sudo = "auto"
+	}
+	p := &Pack{
+		Pack: md.Pack,
+		Cfg: &config.Struct{
+			InternalCompatibilityFlags: &config.InternalCompatibilityFlags{
+				Sudo: sudo,
+			},
+		},
+		PermFileSystem: md.PermFileSystem,
+		PermLabel:      md.PermLabel,
+		DeviceSync:     deviceSync,
+		DeviceRetries:  deviceRetries,
+		HideHints:      hideHints,
+	}
+	if err := checkDeviceSync(deviceSync); err != nil {
+		return err
+	}
+
+	if os.Getenv("GOKR_PACKER_FD") != "" { // partitioning child process
+		if _, err := p.SudoPartition(dev); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	img, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	st, err := img.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() != md.Size {
+		return fmt.Errorf("%s: unexpected size: got %d bytes, metadata says %d bytes", image, st.Size(), md.Size)
+	}
+
+	boot := io.NewSectionReader(img, p.BootOffset(), p.RootOffset()-p.BootOffset())
+	verified, err := VerifyBootManifest(boot)
+	switch {
+	case errors.Is(err, ErrNoBootManifest):
+		log.Printf("warning: %s: %v, not verifying boot files", image, err)
+	case err != nil:
+		return fmt.Errorf("%s: %v", image, err)
+	default:
+		log.Printf("verified %d boot files against the boot manifest", verified)
+	}
+
+	if strings.HasPrefix(dev, usbbootTargetPrefix) {
+		dev, err = usbbootDisk(strings.TrimPrefix(dev, usbbootTargetPrefix), sudo)
+		if err != nil {
+			return err
+		}
+	}
+	if err := verifyNotMounted(dev); err != nil {
+		return err
+	}
+	if err := CheckDeviceWritable(dev, sudo); err != nil {
+		return err
+	}
+	log.Printf("partitioning %s", dev)
+	f, err := p.partition(dev)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The boot code of the MBR (the partition table is at offset 446).
+	bootCode := make([]byte, 440)
+	if _, err := img.ReadAt(bootCode, 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(bootCode, 0); err != nil {
+		return err
+	}
+
+	// Copy everything after the partition table, which includes device
+	// specific files in front of the boot partition.
+	start := int64(512)
+	if p.UseGPT {
+		start = 34 * 512 // MBR, GPT header and partition entries
+	}
+	log.Printf("writing %d MB to %s", (md.Size-start)/MB, dev)
+	if err := p.copyToDevice(f, start, io.NewSectionReader(img, start, md.Size-start), md.Size-start); err != nil {
+		return err
+	}
+
+	devsize, err := fileDeviceSize(f)
+	if err != nil {
+		return err
+	}
+	if err := p.formatPerm(f, devsize); err != nil {
+		return err
+	}
+	if err := p.syncDevice(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if p.PermFileSystem == "" {
+		mkfs := "mkfs.ext4"
+		if p.Layout.Expose == "perm" {
+			mkfs = "mkfs.exfat"
+		}
+		p.hint(i18n.Sprintf("If your applications need to store persistent data, unplug and re-plug the SD card, then create a file system using e.g.:\n") + "\n" +
+			fmt.Sprintf("\t%s /dev/disk/by-partuuid/%s\n", mkfs, p.PermUUID()) + "\n")
+	}
+	p.printExtraPartitions(devsize)
+	return nil
+}
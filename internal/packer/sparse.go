@@ -0,0 +1,126 @@
+package packer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+)
+
+// sparseBlockSize is the granularity in which sparseFile skips zeros, the
+// block size of common file systems.
+const sparseBlockSize = 4096
+
+// sparseFile writes to a file which was newly created with its final size
+// (so that it reads as zeros), skipping blocks which only contain zeros: they
+// remain holes, so that the image is sparse on disk and far faster to create
+// for large targets (e.g. the perm partition's ext4 journal).
+//
+// Zeros which overwrite previously written data are written, so sparseFile
+// needs to know about all writes which bypass it (see markWritten).
+type sparseFile struct {
+	f *os.File
+
+	// written are the sorted, non-overlapping [start, end) ranges which were
+	// written with data.
+	written [][2]int64
+}
+
+func newSparseFile(f *os.File) *sparseFile {
+	return &sparseFile{f: f}
+}
+
+// markWritten records that the range [off, off+n) of the file was written
+// without going through s.
+func (s *sparseFile) markWritten(off, n int64) {
+	if n <= 0 {
+		return
+	}
+	start, end := off, off+n
+	i := sort.Search(len(s.written), func(i int) bool { return s.written[i][1] >= start })
+	j := i
+	for j < len(s.written) && s.written[j][0] <= end {
+		if s.written[j][0] < start {
+			start = s.written[j][0]
+		}
+		if s.written[j][1] > end {
+			end = s.written[j][1]
+		}
+		j++
+	}
+	switch {
+	case j == i: // no overlap: insert
+		s.written = append(s.written, [2]int64{})
+		copy(s.written[i+1:], s.written[i:])
+	case j > i+1: // merged multiple ranges
+		s.written = append(s.written[:i+1], s.written[j:]...)
+	}
+	s.written[i] = [2]int64{start, end}
+}
+
+// overlapsWritten returns whether [start, end) overlaps previously written
+// data.
+func (s *sparseFile) overlapsWritten(start, end int64) bool {
+	i := sort.Search(len(s.written), func(i int) bool { return s.written[i][1] > start })
+	return i < len(s.written) && s.written[i][0] < end
+}
+
+var zeroBlock [sparseBlockSize]byte
+
+// isZero returns whether b (at most sparseBlockSize bytes) only contains
+// zeros.
+func isZero(b []byte) bool {
+	return bytes.Equal(b, zeroBlock[:len(b)])
+}
+
+func (s *sparseFile) WriteAt(b []byte, off int64) (int, error) {
+	// runStart is the index in b where the current run of blocks which need
+	// to be written starts, or -1.
+	runStart := -1
+	flush := func(end int) error {
+		if runStart == -1 {
+			return nil
+		}
+		if _, err := s.f.WriteAt(b[runStart:end], off+int64(runStart)); err != nil {
+			return err
+		}
+		s.markWritten(off+int64(runStart), int64(end-runStart))
+		runStart = -1
+		return nil
+	}
+	for i := 0; i < len(b); {
+		// Segments end at block boundaries of the file.
+		end := i + int(sparseBlockSize-(off+int64(i))%sparseBlockSize)
+		if end > len(b) {
+			end = len(b)
+		}
+		if isZero(b[i:end]) && !s.overlapsWritten(off+int64(i), off+int64(end)) {
+			if err := flush(i); err != nil {
+				return i, err
+			}
+		} else if runStart == -1 {
+			runStart = i
+		}
+		i = end
+	}
+	if err := flush(len(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *sparseFile) Write(b []byte) (int, error) {
+	off, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.WriteAt(b, off)
+	if _, serr := s.f.Seek(off+int64(n), io.SeekStart); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (s *sparseFile) Seek(offset int64, whence int) (int64, error) {
+	return s.f.Seek(offset, whence)
+}
@@ -0,0 +1,102 @@
+package packer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSparseFile(t *testing.T) {
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(t.TempDir(), "full.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	sf := newSparseFile(f)
+
+	want := make([]byte, size)
+	write := func(off int64, b []byte) {
+		t.Helper()
+		if _, err := sf.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sf.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[off:], b)
+	}
+	// Data surrounded by zeros, not aligned to blocks.
+	data := append(append(make([]byte, 3*sparseBlockSize+100), bytes.Repeat([]byte("gokrazy"), 1000)...), make([]byte, 1<<20)...)
+	write(1000, data)
+	// 32 MB of zeros (like an ext4 journal).
+	write(8<<20, make([]byte, 32<<20))
+	// Zeros overwriting data need to be written.
+	write(1000+3*sparseBlockSize+200, make([]byte, 500))
+	// Data written without the sparse file.
+	if _, err := f.WriteAt([]byte("bypass"), 50<<20); err != nil {
+		t.Fatal(err)
+	}
+	sf.markWritten(50<<20, 6)
+	copy(want[50<<20:], "bypass")
+	write(50<<20+2, []byte{0, 0})
+
+	got := make([]byte, size)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file contents differ from the written data")
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// st_blocks counts 512 byte units.
+	if allocated := st.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 1<<20 {
+		t.Errorf("file occupies %d bytes on disk, want at most 1 MB (sparse)", allocated)
+	}
+}
+
+func TestSparseFileMarkWritten(t *testing.T) {
+	sf := &sparseFile{}
+	sf.markWritten(100, 10)
+	sf.markWritten(0, 10)
+	sf.markWritten(200, 10)
+	sf.markWritten(105, 100) // merges [100,110) and [200,210)
+	if got, want := sf.written, [][2]int64{{0, 10}, {100, 210}}; !equalRanges(got, want) {
+		t.Errorf("written = %v, want %v", got, want)
+	}
+	for _, tt := range []struct {
+		start, end int64
+		want       bool
+	}{
+		{10, 100, false},
+		{9, 11, true},
+		{209, 300, true},
+		{210, 300, false},
+	} {
+		if got := sf.overlapsWritten(tt.start, tt.end); got != tt.want {
+			t.Errorf("overlapsWritten(%d, %d) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func equalRanges(a, b [][2]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// sshTargetPrefix selects a device on another machine (e.g. a lab machine with
+// the card reader) as target of the full image, e.g.
+// -overwrite=ssh://flasher:/dev/sdb or -overwrite=ssh://root@flasher:/dev/sdb
+const sshTargetPrefix = "ssh://"
+
+// sshTarget is a device on a machine reachable via ssh.
+type sshTarget struct {
+	host   string // passed to ssh, e.g. root@flasher
+	device string // e.g. /dev/sdb
+}
+
+// parseSSHTarget parses an ssh://<host>:<device> target.
+func parseSSHTarget(target string) (sshTarget, error) {
+	host, device, ok := strings.Cut(strings.TrimPrefix(target, sshTargetPrefix), ":")
+	if !ok || host == "" || !strings.HasPrefix(device, "/") {
+		return sshTarget{}, fmt.Errorf("invalid target %q: expected ssh://<host>:<device>, e.g. ssh://flasher:/dev/sdb", target)
+	}
+	return sshTarget{host: host, device: device}, nil
+}
+
+// shellQuote quotes s for the POSIX shell which runs the remote command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// command returns the ssh command running the shell command remote.
+func (t sshTarget) command(remote string) *exec.Cmd {
+	// Compression helps with the (mostly zero) unused parts of the image.
+	cmd := exec.Command("ssh", "-C", "-o", "BatchMode=yes", t.host, remote)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// size returns the size of the remote device in bytes.
+func (t sshTarget) size() (int64, error) {
+	cmd := t.command("blockdev --getsize64 " + shellQuote(t.device))
+	b, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v: unexpected output %q", cmd.Args, b)
+	}
+	return size, nil
+}
+
+// write writes the image in f to the remote device, then reads it back to
+// verify the hash, and returns the hash.
+func (t sshTarget) write(f *os.File) (string, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	dev := shellQuote(t.device)
+	remote := fmt.Sprintf("dd of=%s bs=4M conv=fsync 2>/dev/null && sync && head -c %d %s | (sha256sum 2>/dev/null || shasum -a 256)",
+		dev,
+		st.Size(),
+		dev)
+	cmd := t.command(remote)
+	h := sha256.New()
+	cmd.Stdin = io.TeeReader(f, h)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	fmt.Printf("Writing image (%d MB) to %s on %s via ssh\n", st.Size()/MB, t.device, t.host)
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("verifying %s on %s: no hash received", t.device, t.host)
+	}
+	if fields[0] != sum {
+		return "", fmt.Errorf("verifying %s on %s: read back sha256 %s, but wrote %s", t.device, t.host, fields[0], sum)
+	}
+	fmt.Printf("Verified image on %s on %s (sha256 %s)\n", t.device, t.host, sum)
+	return sum, nil
+}
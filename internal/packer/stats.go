@@ -0,0 +1,137 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gokrazy/internal/config"
+	"github.com/gokrazy/internal/instanceflag"
+)
+
+// BuildStats is one record of the local usage statistics file. Statistics are
+// only recorded when the file exists (see StatsPath), and never leave the
+// local machine.
+type BuildStats struct {
+	Time     time.Time
+	Instance string
+	Target   string // full, device, boot+root, gaf, directboot or update
+
+	// BuildDuration is the time spent building Go packages, TotalDuration the
+	// time from starting the build until the images were written (excluding
+	// the update transfer).
+	BuildDuration time.Duration
+	TotalDuration time.Duration
+
+	// Binaries maps the path of each built program (relative to the bin
+	// directory) to a shortened SHA256 hash of its contents. Comparing
+	// against the previous build of the same instance shows how many
+	// programs were unchanged, i.e. came from the build cache.
+	Binaries map[string]string `json:",omitempty"`
+
+	BootBytes int64 `json:",omitempty"`
+	RootBytes int64 `json:",omitempty"`
+}
+
+// Unchanged returns how many of the binaries of s have the same contents as in
+// prev.
+func (s *BuildStats) Unchanged(prev *BuildStats) int {
+	if prev == nil {
+		return 0
+	}
+	var unchanged int
+	for path, hash := range s.Binaries {
+		if prev.Binaries[path] == hash {
+			unchanged++
+		}
+	}
+	return unchanged
+}
+
+// StatsPath returns the path of the local usage statistics file. Recording
+// statistics is opt-in: gok stats --enable creates the file, deleting the file
+// disables recording.
+func StatsPath() string {
+	return filepath.Join(config.Gokrazy(), "stats.jsonl")
+}
+
+// ReadStats returns all records of the statistics file, oldest first.
+func ReadStats() ([]*BuildStats, error) {
+	f, err := os.Open(StatsPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var stats []*BuildStats
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var s BuildStats
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", StatsPath(), line, err)
+		}
+		stats = append(stats, &s)
+	}
+	return stats, scanner.Err()
+}
+
+func hashBinaries(bindir string) (map[string]string, error) {
+	binaries := make(map[string]string)
+	err := filepath.Walk(bindir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(bindir, path)
+		if err != nil {
+			return err
+		}
+		binaries[filepath.ToSlash(rel)] = fmt.Sprintf("%x", h.Sum(nil))[:16]
+		return nil
+	})
+	return binaries, err
+}
+
+// recordStats appends s to the statistics file if the user enabled recording
+// statistics. Errors are only logged, as statistics are not essential.
+func recordStats(s *BuildStats, bindir string) {
+	f, err := os.OpenFile(StatsPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return // not enabled
+	}
+	defer f.Close()
+	if s.Instance == "" {
+		s.Instance = instanceflag.Instance()
+	}
+	if s.Binaries, err = hashBinaries(bindir); err != nil {
+		fmt.Fprintf(os.Stderr, "recording stats: %v\n", err)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "recording stats: %v\n", err)
+		return
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "recording stats: %v\n", err)
+	}
+}
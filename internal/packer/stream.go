@@ -0,0 +1,154 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// streamFDPrefix selects an already-open file descriptor as target of the full
+// image, e.g. -overwrite=fd:3 with 3>&1 >&2 | ssh flasher dd of=/dev/sdx
+const streamFDPrefix = "fd:"
+
+// streamStdout selects stdout as target of the full image, e.g.
+// -overwrite=- | xz > gokrazy.img.xz. The packer then prints its progress to
+// stderr (see redirectStdout).
+const streamStdout = "-"
+
+// imageStdout is the original stdout of the process, to which the image is
+// streamed for the streamStdout target.
+var imageStdout *os.File
+
+// IsStreamTarget returns whether the full image target is stdout (-), a file
+// descriptor (fd:N), a named pipe or a remote device (see sshTargetPrefix and
+// nbdTargetPrefix), to which the image is written sequentially.
+func IsStreamTarget(target string) bool {
+	if target == streamStdout ||
+		strings.HasPrefix(target, streamFDPrefix) ||
+		strings.HasPrefix(target, sshTargetPrefix) ||
+		strings.HasPrefix(target, nbdTargetPrefix) {
+		return true
+	}
+	st, err := os.Stat(target)
+	return err == nil && st.Mode()&os.ModeNamedPipe != 0
+}
+
+// redirectStdout makes the file descriptor 1 refer to stderr, so that the
+// progress output of the packer and of the commands it runs (e.g. the go
+// compiler) does not end up in the image streamed to stdout. The original
+// stdout is kept as imageStdout.
+func redirectStdout() error {
+	if isTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("refusing to write the image to a terminal: redirect stdout to a file or pipe it into a program, e.g. -overwrite=- | xz > gokrazy.img.xz")
+	}
+	fd, err := unix.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return err
+	}
+	if err := unix.Dup2(int(os.Stderr.Fd()), int(os.Stdout.Fd())); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	unix.CloseOnExec(fd)
+	imageStdout = os.NewFile(uintptr(fd), "stdout")
+	return nil
+}
+
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// openStreamTarget opens the stdout, fd:N or named pipe target for writing.
+func openStreamTarget(target string) (*os.File, error) {
+	if target == streamStdout {
+		if imageStdout == nil {
+			return nil, fmt.Errorf("BUG: stdout was not redirected for streaming the image")
+		}
+		return imageStdout, nil
+	}
+	if !strings.HasPrefix(target, streamFDPrefix) {
+		return os.OpenFile(target, os.O_WRONLY, 0)
+	}
+	fd, err := strconv.Atoi(strings.TrimPrefix(target, streamFDPrefix))
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid target %q: expected fd:<file descriptor number>, e.g. fd:3", target)
+	}
+	switch fd {
+	case 0:
+		return nil, fmt.Errorf("invalid target %q: file descriptor 0 is stdin", target)
+	case 1, 2:
+		return nil, fmt.Errorf("invalid target %q: the packer prints its progress to stdout and stderr; use - to stream the image to stdout, or redirect another file descriptor instead, e.g. fd:3 with 3>&1 >&2", target)
+	}
+	f := os.NewFile(uintptr(fd), target)
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("target %q: file descriptor %d is not open: %v", target, fd, err)
+	}
+	return f, nil
+}
+
+// streamImage writes the image in f (assembled in a temporary file, because
+// partitioning and writing the file systems needs to seek) sequentially to
+// the stream target, and returns its SHA256 hash.
+func streamImage(target string, f *os.File) (string, error) {
+	if strings.HasPrefix(target, sshTargetPrefix) {
+		t, err := parseSSHTarget(target)
+		if err != nil {
+			return "", err
+		}
+		return t.write(f)
+	}
+	if strings.HasPrefix(target, nbdTargetPrefix) {
+		t, err := parseNBDTarget(target)
+		if err != nil {
+			return "", err
+		}
+		if err := t.write(f); err != nil {
+			return "", err
+		}
+		return sha256File(f.Name())
+	}
+	w, err := openStreamTarget(target)
+	if err != nil {
+		return "", err
+	}
+	defer w.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), f)
+	if err != nil {
+		return "", fmt.Errorf("streaming image to %s: %v", target, err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("streaming image to %s: %v", target, err)
+	}
+	fmt.Printf("Streamed image (%d MB) to %s\n", n/MB, target)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// streamTargetSize returns the size in bytes of remote device targets, or 0
+// if the target has no fixed size (e.g. a pipe).
+func streamTargetSize(target string) (int64, error) {
+	switch {
+	case strings.HasPrefix(target, sshTargetPrefix):
+		t, err := parseSSHTarget(target)
+		if err != nil {
+			return 0, err
+		}
+		return t.size()
+	case strings.HasPrefix(target, nbdTargetPrefix):
+		t, err := parseNBDTarget(target)
+		if err != nil {
+			return 0, err
+		}
+		return t.size()
+	}
+	return 0, nil
+}
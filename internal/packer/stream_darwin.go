@@ -0,0 +1,5 @@
+package packer
+
+import "golang.org/x/sys/unix"
+
+const ioctlGetTermios = unix.TIOCGETA
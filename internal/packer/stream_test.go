@@ -0,0 +1,150 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenStreamTarget(t *testing.T) {
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{"fd:x", "expected fd:<file descriptor number>"},
+		{"fd:-1", "expected fd:<file descriptor number>"},
+		{"fd:0", "stdin"},
+		{"fd:1", "progress"},
+		{"fd:987", "not open"},
+	} {
+		if !IsStreamTarget(tt.target) {
+			t.Errorf("IsStreamTarget(%q) = false, want true", tt.target)
+		}
+		_, err := openStreamTarget(tt.target)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("openStreamTarget(%q) = %v, want error containing %q", tt.target, err, tt.want)
+		}
+	}
+	if IsStreamTarget("/tmp/gokrazy.img") {
+		t.Errorf("IsStreamTarget(/tmp/gokrazy.img) = true, want false")
+	}
+}
+
+func TestStreamImage(t *testing.T) {
+	dir := t.TempDir()
+	img, err := os.Create(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	contents := []byte(strings.Repeat("gokrazy", 1000))
+	if _, err := img.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	// The target needs to exist, like a named pipe.
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := streamImage(target, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(contents)); sum != want {
+		t.Errorf("streamImage() = %s, want %s", sum, want)
+	}
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(contents) {
+		t.Errorf("streamed %d bytes, want %d bytes", len(got), len(contents))
+	}
+}
+
+func TestStreamImageStdout(t *testing.T) {
+	if !IsStreamTarget(streamStdout) {
+		t.Errorf("IsStreamTarget(%q) = false, want true", streamStdout)
+	}
+	dir := t.TempDir()
+	img, err := os.Create(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	contents := []byte(strings.Repeat("gokrazy", 1000))
+	if _, err := img.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	// Stand in for the original stdout, which redirectStdout keeps.
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageStdout = stdout
+	defer func() { imageStdout = nil }()
+	if _, err := streamImage(streamStdout, img); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(contents) {
+		t.Errorf("streamed %d bytes to stdout, want %d bytes", len(got), len(contents))
+	}
+}
+
+func TestParseSSHTarget(t *testing.T) {
+	got, err := parseSSHTarget("ssh://root@flasher:/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (sshTarget{host: "root@flasher", device: "/dev/sdb"}); got != want {
+		t.Errorf("parseSSHTarget() = %+v, want %+v", got, want)
+	}
+	for _, target := range []string{"ssh://flasher", "ssh://:/dev/sdb", "ssh://flasher:sdb"} {
+		if _, err := parseSSHTarget(target); err == nil {
+			t.Errorf("parseSSHTarget(%q) unexpectedly succeeded", target)
+		}
+	}
+}
+
+func TestSSHTargetWrite(t *testing.T) {
+	// A fake ssh runs the remote command locally.
+	bin := t.TempDir()
+	fakeSSH := "#!/bin/sh\nfor last; do :; done\nexec sh -c \"$last\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(fakeSSH), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	img, err := os.Create(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	contents := []byte(strings.Repeat("gokrazy", 1000))
+	if _, err := img.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	device := filepath.Join(dir, "it's a device")
+	sum, err := streamImage("ssh://flasher:"+device, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(contents)); sum != want {
+		t.Errorf("streamImage() = %s, want %s", sum, want)
+	}
+	got, err := os.ReadFile(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(contents) {
+		t.Errorf("wrote %d bytes, want %d bytes", len(got), len(contents))
+	}
+}
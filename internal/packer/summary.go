@@ -0,0 +1,63 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// BuildSummary is written to Pack.Summary as JSON after the packer ran, so
+// that scripts do not need to parse the output.
+type BuildSummary struct {
+	Instance string `json:",omitempty"`
+	Hostname string `json:",omitempty"`
+
+	// Target is what was written: full, device, boot+root, gaf, directboot
+	// or update (see BuildStats).
+	Target string `json:",omitempty"`
+
+	// Digests maps the written images (e.g. boot.img) to their SHA256 hash.
+	Digests map[string]string `json:",omitempty"`
+
+	// Hints are the instructions for the user, e.g. how to boot the written
+	// image or how to create a file system on the perm partition, as printed
+	// unless Pack.HideHints is set.
+	Hints []string `json:",omitempty"`
+
+	// Error is the reason the packer failed, empty if it succeeded.
+	Error string `json:",omitempty"`
+
+	// secrets (e.g. the update password) are redacted from Hints.
+	secrets []string
+}
+
+// hint prints the instructions s for the user (unless HideHints is set) and
+// records them in the summary.
+func (p *Pack) hint(s string) {
+	recorded := strings.TrimSpace(s)
+	for _, secret := range p.summary.secrets {
+		if secret != "" {
+			recorded = strings.ReplaceAll(recorded, secret, "<redacted>")
+		}
+	}
+	p.summary.Hints = append(p.summary.Hints, recorded)
+	if !p.HideHints {
+		fmt.Print(s)
+	}
+}
+
+// writeSummary writes the summary (with the result err) to p.Summary, if set.
+func (p *Pack) writeSummary(err error) error {
+	if p.Summary == "" {
+		return nil
+	}
+	if err != nil {
+		p.summary.Error = err.Error()
+	}
+	b, err := json.MarshalIndent(p.summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.Summary, append(b, '\n'), 0644)
+}
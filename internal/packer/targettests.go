@@ -0,0 +1,100 @@
+package packer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/gokrazy/tools/internal/measure"
+	"github.com/gokrazy/tools/packer"
+)
+
+// qemuArchs maps GOARCH values to the architecture names of the QEMU user
+// mode emulators (qemu-<arch>), which run Linux programs of another
+// architecture.
+var qemuArchs = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm":     "arm",
+	"arm64":   "aarch64",
+	"riscv64": "riscv64",
+}
+
+// binfmtRegistered returns whether a binfmt_misc handler for the QEMU
+// architecture is registered, i.e. whether the kernel runs its programs
+// transparently.
+func binfmtRegistered(qemuArch string) bool {
+	b, err := os.ReadFile("/proc/sys/fs/binfmt_misc/qemu-" + qemuArch)
+	return err == nil && strings.HasPrefix(string(b), "enabled")
+}
+
+// testExecutor returns the program with which go test -exec needs to run test
+// binaries for goos/goarch on this host, or "" if they run directly: natively
+// or via a registered binfmt_misc handler.
+func testExecutor(goos, goarch string, lookPath func(string) (string, error), binfmt func(string) bool) (string, error) {
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return "", nil
+	}
+	if goos == "linux" && runtime.GOOS == "linux" &&
+		(goarch == "386" && runtime.GOARCH == "amd64" || goarch == "arm" && runtime.GOARCH == "arm64") {
+		// The CPU runs these programs natively (the packages are built with
+		// CGO_ENABLED=0, so no libraries of the architecture are needed).
+		return "", nil
+	}
+	qemuArch, ok := qemuArchs[goarch]
+	if !ok || goos != "linux" || runtime.GOOS != "linux" {
+		return "", fmt.Errorf("cannot run %s/%s tests on %s/%s: emulation requires a Linux host (e.g. a Linux VM or CI runner) with qemu-user-static",
+			goos, goarch, runtime.GOOS, runtime.GOARCH)
+	}
+	// Prefer the statically linked emulators, which the qemu-user-static
+	// packages install.
+	for _, name := range []string{"qemu-" + qemuArch + "-static", "qemu-" + qemuArch} {
+		if path, err := lookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	if binfmt(qemuArch) {
+		return "", nil
+	}
+	return "", fmt.Errorf("cannot run %s tests on %s: neither qemu-%s-static nor qemu-%s found in $PATH, and no binfmt_misc handler is registered (install qemu-user-static, e.g. apt install qemu-user-static)",
+		goarch, runtime.GOARCH, qemuArch, qemuArch)
+}
+
+// runTargetTests runs the tests of the packages for the target architecture
+// (see Pack.RunTargetTests), emulating it with qemu-user if needed.
+func (p *Pack) runTargetTests(pkgs []string, packageBuildTags map[string][]string) error {
+	goarch := packer.TargetArch()
+	executor, err := testExecutor("linux", goarch, exec.LookPath, binfmtRegistered)
+	if err != nil {
+		return err
+	}
+	if executor != "" {
+		log.Printf("running %s tests with %s", goarch, executor)
+	}
+	done := measure.Interactively("running target tests")
+	defer done("")
+	for _, pkg := range pkgs {
+		buildDir, err := packer.BuildDirOrMigrate(pkg)
+		if err != nil {
+			return fmt.Errorf("buildDir(%s): %v", pkg, err)
+		}
+		tags := append(packer.DefaultTags(), packageBuildTags[pkg]...)
+		args := []string{"-tags=" + strings.Join(tags, ",")}
+		if executor != "" {
+			args = append(args, "-exec="+executor)
+		}
+		args = append(args, pkg)
+		cmd, err := packer.GoCommand(buildDir, "test", args...)
+		if err != nil {
+			return err
+		}
+		cmd.Stdout = os.Stdout
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s tests of %s failed: %v: %v", goarch, pkg, cmd.Args, err)
+		}
+	}
+	return nil
+}
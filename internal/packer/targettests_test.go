@@ -0,0 +1,78 @@
+package packer
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestTestExecutor(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("qemu-user emulation requires a Linux host")
+	}
+	// A foreign architecture which the host cannot run natively.
+	foreign := "riscv64"
+	if runtime.GOARCH == "riscv64" {
+		foreign = "arm64"
+	}
+	qemuArch := qemuArchs[foreign]
+
+	for _, tt := range []struct {
+		desc    string
+		goarch  string
+		inPath  []string
+		binfmt  bool
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:   "native",
+			goarch: runtime.GOARCH,
+			want:   "",
+		},
+		{
+			desc:   "static emulator preferred",
+			goarch: foreign,
+			inPath: []string{"qemu-" + qemuArch, "qemu-" + qemuArch + "-static"},
+			want:   "/usr/bin/qemu-" + qemuArch + "-static",
+		},
+		{
+			desc:   "dynamic emulator",
+			goarch: foreign,
+			inPath: []string{"qemu-" + qemuArch},
+			want:   "/usr/bin/qemu-" + qemuArch,
+		},
+		{
+			desc:   "binfmt_misc",
+			goarch: foreign,
+			binfmt: true,
+			want:   "",
+		},
+		{
+			desc:    "no emulation",
+			goarch:  foreign,
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			lookPath := func(name string) (string, error) {
+				for _, p := range tt.inPath {
+					if p == name {
+						return "/usr/bin/" + name, nil
+					}
+				}
+				return "", fmt.Errorf("%s: not found", name)
+			}
+			binfmt := func(arch string) bool {
+				return tt.binfmt && arch == qemuArch
+			}
+			got, err := testExecutor("linux", tt.goarch, lookPath, binfmt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("testExecutor(%s) = %v, want error: %v", tt.goarch, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("testExecutor(%s) = %q, want %q", tt.goarch, got, tt.want)
+			}
+		})
+	}
+}
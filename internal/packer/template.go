@@ -0,0 +1,172 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// templateSuffix marks extra files of the instance configuration (from
+// ExtraFilePaths, ExtraFileContents or the extrafiles directory) as templates,
+// which are rendered into the image without the suffix, e.g.
+// /etc/mqtt/broker.yaml.gotmpl becomes /etc/mqtt/broker.yaml. Files from
+// ExtraFilePaths are also templates if their host path has the suffix, e.g.
+// "/etc/mqtt/broker.yaml": "broker.yaml.gotmpl".
+//
+// Templates are rendered with text/template, the data is an
+// extraFileTemplateData, and the following functions are available:
+//
+//	flag "listen"                   value of the -listen flag of the package
+//	packageFlag "<pkg>" "listen"    value of the -listen flag of another package
+//	env "NAME"                      value of $NAME in the environment of the package
+//	hostEnv "NAME"                  value of $NAME on the host (at pack time)
+//	readFile "path"                 contents of a file on the host (at pack time)
+//
+// Extra files of Go packages (in _gokrazy/extrafiles) are never rendered, so
+// that they cannot read host files or environment variables.
+const templateSuffix = ".gotmpl"
+
+// extraFileTemplateData is the data available to extra file templates.
+type extraFileTemplateData struct {
+	Hostname  string
+	HTTPPort  string
+	HTTPSPort string
+
+	// Package is the package to which the extra file belongs.
+	Package string
+}
+
+// markTemplates marks all files with the templateSuffix in fi as templates.
+func markTemplates(fi *FileInfo) {
+	for _, ent := range fi.Dirents {
+		if ent.IsFile() && strings.HasSuffix(ent.Filename, templateSuffix) {
+			ent.Template = true
+		}
+		markTemplates(ent)
+	}
+}
+
+// flagValue returns the value of the flag name in flags (specified as -name,
+// --name, -name=value or -name value).
+func flagValue(flags []string, name string) (string, bool) {
+	for i, f := range flags {
+		trimmed := strings.TrimPrefix(strings.TrimPrefix(f, "-"), "-")
+		if trimmed == f {
+			continue // not a flag
+		}
+		if k, v, ok := strings.Cut(trimmed, "="); ok {
+			if k == name {
+				return v, true
+			}
+			continue
+		}
+		if trimmed != name {
+			continue
+		}
+		if i+1 < len(flags) && !strings.HasPrefix(flags[i+1], "-") {
+			return flags[i+1], true
+		}
+		return "true", true // boolean flag
+	}
+	return "", false
+}
+
+// templateRenderer renders the extra file templates.
+type templateRenderer struct {
+	data  extraFileTemplateData
+	flags map[string][]string
+	env   map[string][]string
+}
+
+func (tr *templateRenderer) funcs(pkg string) template.FuncMap {
+	packageFlag := func(pkg, name string) (string, error) {
+		v, ok := flagValue(tr.flags[pkg], name)
+		if !ok {
+			return "", fmt.Errorf("package %s has no -%s flag in its CommandLineFlags", pkg, name)
+		}
+		return v, nil
+	}
+	return template.FuncMap{
+		"flag": func(name string) (string, error) {
+			return packageFlag(pkg, name)
+		},
+		"packageFlag": packageFlag,
+		"env": func(name string) (string, error) {
+			for _, kv := range tr.env[pkg] {
+				if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+					return v, nil
+				}
+			}
+			return "", fmt.Errorf("package %s has no %s variable in its Environment", pkg, name)
+		},
+		"hostEnv": func(name string) (string, error) {
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			return v, nil
+		},
+		"readFile": func(path string) (string, error) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return string(b), nil
+		},
+	}
+}
+
+// render renders all templates in fi, which contains extra files of pkg.
+func (tr *templateRenderer) render(pkg, dir string, fi *FileInfo) error {
+	for _, ent := range fi.Dirents {
+		p := path.Join(dir, ent.Filename)
+		if !ent.Template {
+			if err := tr.render(pkg, p, ent); err != nil {
+				return err
+			}
+			continue
+		}
+		src := ent.FromLiteral
+		mode := ent.Mode
+		if ent.FromHost != "" {
+			b, err := os.ReadFile(ent.FromHost)
+			if err != nil {
+				return err
+			}
+			src = string(b)
+			if mode == 0 {
+				st, err := os.Stat(ent.FromHost)
+				if err != nil {
+					return err
+				}
+				mode = st.Mode().Perm()
+			}
+		}
+		tmpl, err := template.New(p).
+			Option("missingkey=error").
+			Funcs(tr.funcs(pkg)).
+			Parse(src)
+		if err != nil {
+			return fmt.Errorf("extra file template of package %s: %v", pkg, err)
+		}
+		data := tr.data
+		data.Package = pkg
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("extra file template of package %s: %v", pkg, err)
+		}
+		if buf.Len() == 0 {
+			return fmt.Errorf("extra file template %s of package %s rendered to an empty file", p, pkg)
+		}
+		ent.Filename = strings.TrimSuffix(ent.Filename, templateSuffix)
+		ent.FromHost = ""
+		ent.FromLiteral = buf.String()
+		ent.Mode = mode
+		ent.Template = false
+		fmt.Printf("Rendered template %s for package %s\n", strings.TrimSuffix(p, templateSuffix), pkg)
+	}
+	return nil
+}
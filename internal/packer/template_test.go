@@ -0,0 +1,60 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	hostTmpl := filepath.Join(t.TempDir(), "broker.yaml.gotmpl")
+	if err := os.WriteFile(hostTmpl, []byte("listen: :{{ flag \"port\" }}\nhost: {{ .Hostname }}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := &FileInfo{}
+	etc := mkdirp(root, "/etc/mqtt")
+	etc.Dirents = append(etc.Dirents,
+		&FileInfo{Filename: "broker.yaml", FromHost: hostTmpl, Template: true},
+		&FileInfo{Filename: "client.json.gotmpl", FromLiteral: `{"broker": "localhost:{{ packageFlag "example.com/broker" "port" }}", "debug": "{{ env "DEBUG" }}"}`},
+		&FileInfo{Filename: "literal.gotmpl", FromLiteral: "{{ not rendered }}"})
+	markTemplates(root)
+	etc.Dirents[2].Template = false // e.g. shipped by a Go package
+
+	tr := &templateRenderer{
+		data: extraFileTemplateData{Hostname: "scanner"},
+		flags: map[string][]string{
+			"example.com/broker": {"--port", "1883", "-verbose"},
+		},
+		env: map[string][]string{
+			"example.com/broker": {"DEBUG=1"},
+		},
+	}
+	if err := tr.render("example.com/broker", "/", root); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"etc/mqtt/broker.yaml":    "listen: :1883\nhost: scanner\n",
+		"etc/mqtt/client.json":    `{"broker": "localhost:1883", "debug": "1"}`,
+		"etc/mqtt/literal.gotmpl": "{{ not rendered }}",
+	} {
+		ent := root.Find(name)
+		if ent == nil {
+			t.Errorf("%s not found", name)
+			continue
+		}
+		if got := ent.FromLiteral; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if got, want := root.Find("etc/mqtt/broker.yaml").Mode, os.FileMode(0600); got != want {
+		t.Errorf("broker.yaml: got mode %v, want %v", got, want)
+	}
+
+	// Unknown flags are an error:
+	root = &FileInfo{Dirents: []*FileInfo{
+		{Filename: "x.gotmpl", FromLiteral: `{{ flag "missing" }}`, Template: true},
+	}}
+	if err := tr.render("example.com/broker", "/", root); err == nil {
+		t.Errorf("render unexpectedly succeeded with an unknown flag")
+	}
+}
@@ -0,0 +1,407 @@
+package packer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// squashfsReader is a minimal SquashFS reader, which only aims to be
+// compatible with the root file systems created by the
+// github.com/gokrazy/internal/squashfs writer: zlib compression, no
+// fragments, no xattrs. It is used to inspect existing installations, e.g. by
+// Clone.
+type squashfsReader struct {
+	r         io.ReaderAt
+	sb        squashfsSuperblock
+	inodes    *squashfsMetadata
+	dirs      *squashfsMetadata
+	blockSize uint32
+}
+
+// squashfsSuperblock is the on-disk SquashFS 4.0 superblock.
+type squashfsSuperblock struct {
+	Magic               uint32
+	Inodes              uint32
+	MkfsTime            int32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	NoIds               uint16
+	Major               uint16
+	Minor               uint16
+	RootInode           uint64
+	BytesUsed           int64
+	IdTableStart        int64
+	XattrIdTableStart   int64
+	InodeTableStart     int64
+	DirectoryTableStart int64
+	FragmentTableStart  int64
+	LookupTableStart    int64
+}
+
+const (
+	squashfsMagic           = 0x73717368
+	squashfsZlib            = 1
+	squashfsDirType         = 1
+	squashfsFileType        = 2
+	squashfsSymlinkType     = 3
+	squashfsLdirType        = 8
+	squashfsLregType        = 9
+	squashfsLsymlinkType    = 10
+	squashfsNoFragment      = 0xFFFFFFFF
+	squashfsUncompressedBit = 1 << 24
+)
+
+// squashfsMetadata is a decoded metadata table (inodes or directories).
+type squashfsMetadata struct {
+	data []byte
+	// blocks maps the on-disk offset of each metadata block (relative to the
+	// start of the table) to its offset in data.
+	blocks map[uint32]uint32
+}
+
+func newSquashfsReader(r io.ReaderAt) (*squashfsReader, error) {
+	var sb squashfsSuperblock
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != squashfsMagic {
+		return nil, fmt.Errorf("not a SquashFS file system (magic %#x)", sb.Magic)
+	}
+	if sb.Major != 4 {
+		return nil, fmt.Errorf("unsupported SquashFS version %d.%d", sb.Major, sb.Minor)
+	}
+	if sb.Compression != squashfsZlib {
+		return nil, fmt.Errorf("unsupported SquashFS compression %d, only zlib is supported", sb.Compression)
+	}
+	inodes, err := readSquashfsMetadata(r, sb.InodeTableStart, sb.DirectoryTableStart)
+	if err != nil {
+		return nil, fmt.Errorf("inode table: %v", err)
+	}
+	dirs, err := readSquashfsMetadata(r, sb.DirectoryTableStart, sb.FragmentTableStart)
+	if err != nil {
+		return nil, fmt.Errorf("directory table: %v", err)
+	}
+	return &squashfsReader{
+		r:         r,
+		sb:        sb,
+		inodes:    inodes,
+		dirs:      dirs,
+		blockSize: sb.BlockSize,
+	}, nil
+}
+
+func readSquashfsMetadata(r io.ReaderAt, start, end int64) (*squashfsMetadata, error) {
+	if end < start {
+		return nil, fmt.Errorf("invalid table bounds [%d, %d)", start, end)
+	}
+	raw := make([]byte, end-start)
+	if _, err := r.ReadAt(raw, start); err != nil {
+		return nil, err
+	}
+	m := &squashfsMetadata{blocks: make(map[uint32]uint32)}
+	for off := 0; off+2 <= len(raw); {
+		header := binary.LittleEndian.Uint16(raw[off:])
+		size := int(header & 0x7fff)
+		if off+2+size > len(raw) {
+			return nil, fmt.Errorf("metadata block at %d exceeds table", off)
+		}
+		block := raw[off+2 : off+2+size]
+		m.blocks[uint32(off)] = uint32(len(m.data))
+		if header&0x8000 == 0 { // compressed
+			zr, err := zlib.NewReader(bytes.NewReader(block))
+			if err != nil {
+				return nil, err
+			}
+			b, err := io.ReadAll(zr)
+			if err != nil {
+				return nil, err
+			}
+			block = b
+		}
+		m.data = append(m.data, block...)
+		off += 2 + size
+	}
+	return m, nil
+}
+
+// at returns the metadata starting at offset within the metadata block at
+// the on-disk position block.
+func (m *squashfsMetadata) at(block uint32, offset uint16) ([]byte, error) {
+	start, ok := m.blocks[block]
+	if !ok {
+		return nil, fmt.Errorf("no metadata block at %d", block)
+	}
+	if int(start)+int(offset) > len(m.data) {
+		return nil, fmt.Errorf("metadata offset %d in block %d out of bounds", offset, block)
+	}
+	return m.data[start+uint32(offset):], nil
+}
+
+type squashfsInode struct {
+	typ  uint16
+	mode uint16
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+	dirSize   uint32
+
+	// regular files
+	startBlock uint64
+	fileSize   uint64
+	blockSizes []uint32
+
+	// symlinks
+	target string
+}
+
+func (i *squashfsInode) isDir() bool {
+	return i.typ == squashfsDirType || i.typ == squashfsLdirType
+}
+
+func (i *squashfsInode) isRegular() bool {
+	return i.typ == squashfsFileType || i.typ == squashfsLregType
+}
+
+// inode decodes the inode referenced by ref (the on-disk position of the
+// metadata block in the upper bits, the offset within in the lower 16 bits).
+func (r *squashfsReader) inode(ref uint64) (*squashfsInode, error) {
+	b, err := r.inodes.at(uint32(ref>>16), uint16(ref))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 16 {
+		return nil, fmt.Errorf("truncated inode")
+	}
+	le := binary.LittleEndian
+	ino := &squashfsInode{
+		typ:  le.Uint16(b[0:]),
+		mode: le.Uint16(b[2:]),
+	}
+	b = b[16:] // skip the common header
+	need := func(n int) error {
+		if len(b) < n {
+			return fmt.Errorf("truncated inode of type %d", ino.typ)
+		}
+		return nil
+	}
+	var fragment uint32
+	switch ino.typ {
+	case squashfsDirType:
+		if err := need(16); err != nil {
+			return nil, err
+		}
+		ino.dirBlock = le.Uint32(b[0:])
+		ino.dirSize = uint32(le.Uint16(b[8:]))
+		ino.dirOffset = le.Uint16(b[10:])
+		return ino, nil
+
+	case squashfsLdirType:
+		if err := need(24); err != nil {
+			return nil, err
+		}
+		ino.dirSize = le.Uint32(b[4:])
+		ino.dirBlock = le.Uint32(b[8:])
+		ino.dirOffset = le.Uint16(b[18:])
+		return ino, nil
+
+	case squashfsSymlinkType, squashfsLsymlinkType:
+		if err := need(8); err != nil {
+			return nil, err
+		}
+		size := int(le.Uint32(b[4:]))
+		if err := need(8 + size); err != nil {
+			return nil, err
+		}
+		ino.target = string(b[8 : 8+size])
+		return ino, nil
+
+	case squashfsFileType:
+		if err := need(16); err != nil {
+			return nil, err
+		}
+		ino.startBlock = uint64(le.Uint32(b[0:]))
+		fragment = le.Uint32(b[4:])
+		ino.fileSize = uint64(le.Uint32(b[12:]))
+		b = b[16:]
+
+	case squashfsLregType:
+		if err := need(40); err != nil {
+			return nil, err
+		}
+		ino.startBlock = le.Uint64(b[0:])
+		ino.fileSize = le.Uint64(b[8:])
+		fragment = le.Uint32(b[28:])
+		b = b[40:]
+
+	default:
+		return nil, fmt.Errorf("unsupported inode type %d", ino.typ)
+	}
+
+	if fragment != squashfsNoFragment {
+		return nil, fmt.Errorf("fragments are not supported")
+	}
+	blocks := int((ino.fileSize + uint64(r.blockSize) - 1) / uint64(r.blockSize))
+	if err := need(4 * blocks); err != nil {
+		return nil, err
+	}
+	ino.blockSizes = make([]uint32, blocks)
+	for n := range ino.blockSizes {
+		ino.blockSizes[n] = le.Uint32(b[4*n:])
+	}
+	return ino, nil
+}
+
+type squashfsDirEntry struct {
+	name string
+	ref  uint64
+	typ  uint16
+}
+
+// readDirInode returns the entries of the directory ino.
+func (r *squashfsReader) readDirInode(ino *squashfsInode) ([]squashfsDirEntry, error) {
+	if !ino.isDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+	b, err := r.dirs.at(ino.dirBlock, ino.dirOffset)
+	if err != nil {
+		return nil, err
+	}
+	// The size includes 3 bytes for the (virtual) . and .. entries.
+	size := int(ino.dirSize) - 3
+	if size < 0 {
+		size = 0
+	}
+	if size > len(b) {
+		return nil, fmt.Errorf("directory listing out of bounds")
+	}
+	b = b[:size]
+	le := binary.LittleEndian
+	var entries []squashfsDirEntry
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated directory header")
+		}
+		count := le.Uint32(b[0:]) + 1
+		start := le.Uint32(b[4:])
+		b = b[12:]
+		for ; count > 0; count-- {
+			if len(b) < 8 {
+				return nil, fmt.Errorf("truncated directory entry")
+			}
+			offset := le.Uint16(b[0:])
+			typ := le.Uint16(b[4:])
+			nameLen := int(le.Uint16(b[6:])) + 1
+			if len(b) < 8+nameLen {
+				return nil, fmt.Errorf("truncated directory entry name")
+			}
+			entries = append(entries, squashfsDirEntry{
+				name: string(b[8 : 8+nameLen]),
+				ref:  uint64(start)<<16 | uint64(offset),
+				typ:  typ,
+			})
+			b = b[8+nameLen:]
+		}
+	}
+	return entries, nil
+}
+
+// lookup returns the inode of path (e.g. /etc/hostname), without following
+// symlinks.
+func (r *squashfsReader) lookup(path string) (*squashfsInode, error) {
+	ino, err := r.inode(r.sb.RootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range strings.Split(strings.Trim(path, "/"), "/") {
+		if component == "" {
+			continue
+		}
+		entries, err := r.readDirInode(ino)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		var found bool
+		for _, e := range entries {
+			if e.name == component {
+				ino, err = r.inode(e.ref)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", path, err)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: not found", path)
+		}
+	}
+	return ino, nil
+}
+
+// readDir returns the entries of the directory path.
+func (r *squashfsReader) readDir(path string) ([]squashfsDirEntry, error) {
+	ino, err := r.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := r.readDirInode(ino)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// readFile returns the contents of the regular file path.
+func (r *squashfsReader) readFile(path string) ([]byte, error) {
+	ino, err := r.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ino.isRegular() {
+		return nil, fmt.Errorf("%s: not a regular file", path)
+	}
+	contents := make([]byte, 0, ino.fileSize)
+	off := int64(ino.startBlock)
+	for _, bs := range ino.blockSizes {
+		want := int(ino.fileSize) - len(contents)
+		if want > int(r.blockSize) {
+			want = int(r.blockSize)
+		}
+		if bs == 0 { // sparse block
+			contents = append(contents, make([]byte, want)...)
+			continue
+		}
+		size := bs &^ squashfsUncompressedBit
+		block := make([]byte, size)
+		if _, err := r.r.ReadAt(block, off); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		off += int64(size)
+		if bs&squashfsUncompressedBit == 0 {
+			zr, err := zlib.NewReader(bytes.NewReader(block))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			block, err = io.ReadAll(zr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		if len(block) > want {
+			block = block[:want]
+		}
+		contents = append(contents, block...)
+	}
+	if uint64(len(contents)) != ino.fileSize {
+		return nil, fmt.Errorf("%s: read %d bytes, want %d", path, len(contents), ino.fileSize)
+	}
+	return contents, nil
+}
@@ -0,0 +1,178 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// usbbootTargetPrefix selects the eMMC of a Raspberry Pi Compute Module in
+// usbboot mode (e.g. a CM4 with the nRPIBOOT jumper fitted, connected via
+// USB) as target of the full image: rpiboot (from
+// https://github.com/raspberrypi/usbboot) makes the Compute Module expose its
+// eMMC as USB mass storage device, which is then overwritten. The remainder
+// of the target is passed to rpiboot -d, e.g.
+// -overwrite=usbboot:/usr/share/rpiboot/mass-storage-gadget64, and defaults to
+// the built-in boot files of rpiboot.
+const usbbootTargetPrefix = "usbboot:"
+
+// broadcomUSBVendor is the USB vendor ID of the boot ROM of the Compute
+// Modules in usbboot mode and of the mass storage device which rpiboot starts.
+const broadcomUSBVendor = "0a5c"
+
+// usbbootProducts are the USB product IDs of the Compute Module boot ROMs.
+var usbbootProducts = map[string]string{
+	"2763": "BCM2835",
+	"2764": "BCM2837 (Compute Module 3)",
+	"2711": "BCM2711 (Compute Module 4)",
+	"2712": "BCM2712 (Compute Module 5)",
+}
+
+// usbbootTimeout is how long to wait for the Compute Module to appear, first
+// in usbboot mode, then as mass storage device.
+const usbbootTimeout = 2 * time.Minute
+
+// usbbootDevices returns the Compute Modules in usbboot mode (as USB device
+// directories in sysfs, e.g. /sys/bus/usb/devices/1-2) and their SoC.
+func usbbootDevices(sysfs string) (map[string]string, error) {
+	dir := filepath.Join(sysfs, "bus", "usb", "devices")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for _, e := range entries {
+		vendor, err := os.ReadFile(filepath.Join(dir, e.Name(), "idVendor"))
+		if err != nil || strings.TrimSpace(string(vendor)) != broadcomUSBVendor {
+			continue
+		}
+		product, err := os.ReadFile(filepath.Join(dir, e.Name(), "idProduct"))
+		if err != nil {
+			continue
+		}
+		if soc, ok := usbbootProducts[strings.TrimSpace(string(product))]; ok {
+			devices[filepath.Join(dir, e.Name())] = soc
+		}
+	}
+	return devices, nil
+}
+
+// usbbootDisks returns the block devices (e.g. sda) which are connected via a
+// Broadcom USB device, i.e. the eMMC of Compute Modules exposed by rpiboot.
+func usbbootDisks(sysfs string) ([]string, error) {
+	dir := filepath.Join(sysfs, "block")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var disks []string
+	for _, e := range entries {
+		path, err := filepath.EvalSymlinks(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		// Walk up the device hierarchy (…/usb1/1-2/1-2:1.0/host0/…/block/sda)
+		// to the USB device.
+		for p := filepath.Dir(path); len(p) > len(sysfs); p = filepath.Dir(p) {
+			vendor, err := os.ReadFile(filepath.Join(p, "idVendor"))
+			if err != nil {
+				continue
+			}
+			if strings.TrimSpace(string(vendor)) == broadcomUSBVendor {
+				disks = append(disks, e.Name())
+			}
+			break
+		}
+	}
+	sort.Strings(disks)
+	return disks, nil
+}
+
+// rpiboot returns an rpiboot command, which runs with sudo unless running as
+// root or sudo is never: accessing the USB device requires privileges.
+func rpiboot(sudo string, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 || sudo == "never" {
+		return exec.Command("rpiboot", args...)
+	}
+	return exec.Command("sudo", append([]string{"rpiboot"}, args...)...)
+}
+
+// waitFor calls found until it returns true, an error or the timeout expires.
+func waitFor(timeout time.Duration, found func() (bool, error)) error {
+	for start := time.Now(); ; time.Sleep(250 * time.Millisecond) {
+		ok, err := found()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timeout after %v", timeout)
+		}
+	}
+}
+
+// usbbootDisk waits for a Compute Module in usbboot mode, runs rpiboot (with
+// the boot files in bootDir, if non-empty) to expose its eMMC and returns the
+// device node of the eMMC once it appears.
+func usbbootDisk(bootDir, sudo string) (string, error) {
+	const sysfs = "/sys"
+	before, err := usbbootDisks(sysfs)
+	if err != nil {
+		return "", err
+	}
+	if len(before) > 0 {
+		// e.g. rpiboot was already run before
+		fmt.Printf("Compute Module eMMC already exposed as /dev/%s\n", before[0])
+		return "/dev/" + before[0], nil
+	}
+
+	fmt.Printf("Waiting for a Compute Module in usbboot mode (fit the nRPIBOOT jumper, connect the USB port and power it on)…\n")
+	if err := waitFor(usbbootTimeout, func() (bool, error) {
+		devices, err := usbbootDevices(sysfs)
+		for dev, soc := range devices {
+			fmt.Printf("Found %s in usbboot mode at %s\n", soc, dev)
+		}
+		return len(devices) > 0, err
+	}); err != nil {
+		return "", fmt.Errorf("no Compute Module in usbboot mode found: %v", err)
+	}
+
+	var args []string
+	if bootDir != "" {
+		args = append(args, "-d", bootDir)
+	}
+	cmd := rpiboot(sudo, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+
+	fmt.Printf("Waiting for the eMMC to appear as mass storage device…\n")
+	var disk string
+	if err := waitFor(usbbootTimeout, func() (bool, error) {
+		disks, err := usbbootDisks(sysfs)
+		if len(disks) > 0 {
+			disk = disks[0]
+		}
+		return disk != "", err
+	}); err != nil {
+		return "", fmt.Errorf("eMMC did not appear: %v", err)
+	}
+	dev := "/dev/" + disk
+	// The device node is created by udev shortly after the sysfs entry.
+	if err := waitFor(10*time.Second, func() (bool, error) {
+		_, err := os.Stat(dev)
+		return err == nil, nil
+	}); err != nil {
+		return "", fmt.Errorf("%s did not appear: %v", dev, err)
+	}
+	fmt.Printf("Compute Module eMMC exposed as %s\n", dev)
+	return dev, nil
+}
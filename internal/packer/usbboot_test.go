@@ -0,0 +1,68 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUSBBootSysfs(t *testing.T) {
+	sysfs := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		path = filepath.Join(sysfs, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, link string) {
+		t.Helper()
+		link = filepath.Join(sysfs, link)
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(sysfs, target), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A CM4 in usbboot mode and a USB keyboard.
+	write("devices/usb1/1-1/idVendor", "0a5c\n")
+	write("devices/usb1/1-1/idProduct", "2711\n")
+	write("devices/usb1/1-2/idVendor", "046d\n")
+	write("devices/usb1/1-2/idProduct", "c31c\n")
+	symlink("devices/usb1/1-1", "bus/usb/devices/1-1")
+	symlink("devices/usb1/1-2", "bus/usb/devices/1-2")
+	// An NVMe disk, a USB stick and the eMMC exposed by rpiboot.
+	write("devices/pci0000:00/nvme/nvme0n1/size", "0")
+	write("devices/usb2/2-1/idVendor", "0781\n")
+	write("devices/usb2/2-1/2-1:1.0/host0/target0:0:0/0:0:0:0/block/sda/size", "0")
+	write("devices/usb2/2-2/idVendor", "0a5c\n")
+	write("devices/usb2/2-2/2-2:1.0/host1/target1:0:0/1:0:0:0/block/sdb/size", "0")
+	symlink("devices/pci0000:00/nvme/nvme0n1", "block/nvme0n1")
+	symlink("devices/usb2/2-1/2-1:1.0/host0/target0:0:0/0:0:0:0/block/sda", "block/sda")
+	symlink("devices/usb2/2-2/2-2:1.0/host1/target1:0:0/1:0:0:0/block/sdb", "block/sdb")
+
+	devices, err := usbbootDevices(sysfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		filepath.Join(sysfs, "bus/usb/devices/1-1"): "BCM2711 (Compute Module 4)",
+	}
+	if !reflect.DeepEqual(devices, want) {
+		t.Errorf("usbbootDevices() = %v, want %v", devices, want)
+	}
+
+	disks, err := usbbootDisks(sysfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sdb"}; !reflect.DeepEqual(disks, want) {
+		t.Errorf("usbbootDisks() = %v, want %v", disks, want)
+	}
+}
@@ -0,0 +1,115 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Constants of the VirtualBox disk image format (version 1.1), see
+// src/VBox/Storage/VDICore.h in the VirtualBox sources.
+const (
+	vdiSignature    = 0xbeda107f
+	vdiVersion      = 0x00010001
+	vdiHeaderSize   = 400 // of vdiHeader, excluding the pre-header
+	vdiImageNormal  = 1   // dynamically allocated
+	vdiBlockSize    = 1 << 20
+	vdiBlockFree    = 0xffffffff
+	vdiSectorSize   = 512
+	vdiDataAlign    = 1 << 20
+	vdiPreHeaderStr = "<<< Oracle VM VirtualBox Disk Image >>>\n"
+)
+
+type vdiGeometry struct {
+	Cylinders uint32
+	Heads     uint32
+	Sectors   uint32
+	SectorLen uint32
+}
+
+type vdiHeader struct {
+	// pre-header
+	FileInfo  [64]byte
+	Signature uint32
+	Version   uint32
+
+	HeaderSize      uint32
+	ImageType       uint32
+	Flags           uint32
+	Comment         [256]byte
+	BlocksOffset    uint32
+	DataOffset      uint32
+	LegacyGeometry  vdiGeometry
+	Unused          uint32
+	DiskSize        uint64
+	BlockSize       uint32
+	BlockExtra      uint32
+	Blocks          uint32
+	BlocksAllocated uint32
+	CreateUUID      [16]byte
+	ModifyUUID      [16]byte
+	LinkageUUID     [16]byte
+	ParentModUUID   [16]byte
+	Geometry        vdiGeometry
+}
+
+// writeVDI converts the raw disk image of size bytes into a dynamically
+// allocated VirtualBox disk image, which only contains the blocks which are
+// not all zero. The layout is: the header, the block map and the data blocks.
+func writeVDI(w io.Writer, raw io.ReaderAt, size int64) error {
+	allocated, err := allocatedBlocks(raw, size, vdiBlockSize)
+	if err != nil {
+		return err
+	}
+	blocks := divRoundUp(size, vdiBlockSize)
+	blocksOffset := int64(vdiDataAlign)
+	dataOffset := blocksOffset + divRoundUp(blocks*4, vdiDataAlign)*vdiDataAlign
+
+	hdr := vdiHeader{
+		Signature:       vdiSignature,
+		Version:         vdiVersion,
+		HeaderSize:      vdiHeaderSize,
+		ImageType:       vdiImageNormal,
+		BlocksOffset:    uint32(blocksOffset),
+		DataOffset:      uint32(dataOffset),
+		LegacyGeometry:  vdiGeometry{SectorLen: vdiSectorSize},
+		DiskSize:        uint64(size),
+		BlockSize:       vdiBlockSize,
+		Blocks:          uint32(blocks),
+		BlocksAllocated: uint32(len(allocated)),
+		Geometry:        vdiGeometry{SectorLen: vdiSectorSize},
+	}
+	copy(hdr.FileInfo[:], vdiPreHeaderStr)
+	// VirtualBox identifies disks by their UUID, so every image gets a new one.
+	if hdr.CreateUUID, err = randomGUID(); err != nil {
+		return err
+	}
+	if hdr.ModifyUUID, err = randomGUID(); err != nil {
+		return err
+	}
+
+	img := make([]byte, dataOffset)
+	copy(img, marshalPadded(binary.LittleEndian, hdr, int(blocksOffset)))
+	blockMap := img[blocksOffset:]
+	for i := int64(0); i < blocks; i++ {
+		binary.LittleEndian.PutUint32(blockMap[i*4:], vdiBlockFree)
+	}
+	for i, idx := range allocated {
+		binary.LittleEndian.PutUint32(blockMap[idx*4:], uint32(i))
+	}
+
+	bw := bufio.NewWriterSize(w, vdiBlockSize)
+	if _, err := bw.Write(img); err != nil {
+		return err
+	}
+	buf := make([]byte, vdiBlockSize)
+	for _, idx := range allocated {
+		if err := readBlock(raw, size, idx, buf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
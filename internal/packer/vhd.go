@@ -0,0 +1,184 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Constants of the (dynamic) VHD format, see the Virtual Hard Disk Image
+// Format Specification (https://www.microsoft.com/download/details.aspx?id=23850)
+const (
+	vhdFooterSize    = 512
+	vhdDynHeaderSize = 1024
+	vhdSectorSize    = 512
+	vhdBlockSize     = 2 << 20
+	vhdUnusedBlock   = 0xffffffff
+	vhdDiskDynamic   = 3
+	vhdVersion       = 0x00010000
+	// vhdNoOffset is the data offset of the dynamic disk header.
+	vhdNoOffset = 0xffffffffffffffff
+)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	Timestamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+}
+
+type vhdDynHeader struct {
+	Cookie          [8]byte
+	DataOffset      uint64
+	TableOffset     uint64
+	HeaderVersion   uint32
+	MaxTableEntries uint32
+	BlockSize       uint32
+	Checksum        uint32
+}
+
+// vhdChecksum is the one’s complement of the sum of all bytes of a VHD footer
+// or dynamic disk header (with a zero checksum field).
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// vhdGeometry calculates the CHS geometry of the disk as described in the
+// appendix of the specification, which Hyper-V derives the disk size from.
+func vhdGeometry(size int64) (cylinders uint16, heads, sectorsPerTrack uint8) {
+	totalSectors := size / vhdSectorSize
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+	var spt, h, cth int64
+	if totalSectors >= 65535*16*63 {
+		spt, h = 255, 16
+		cth = totalSectors / spt
+	} else {
+		spt = 17
+		cth = totalSectors / spt
+		h = (cth + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cth >= h*1024 || h > 16 {
+			spt, h = 31, 16
+			cth = totalSectors / spt
+		}
+		if cth >= h*1024 {
+			spt, h = 63, 16
+			cth = totalSectors / spt
+		}
+	}
+	return uint16(cth / h), uint8(h), uint8(spt)
+}
+
+// marshalPadded encodes the struct with the byte order, padded to size bytes.
+func marshalPadded(order binary.ByteOrder, v any, size int) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, order, v)
+	b := make([]byte, size)
+	copy(b, buf.Bytes())
+	return b
+}
+
+// writeVHD converts the raw disk image of size bytes into a dynamic VHD image
+// (as used by Hyper-V generation 1 VMs and Virtual PC), which only contains
+// the blocks which are not all zero. The layout is: a copy of the footer, the
+// dynamic disk header, the block allocation table, the data blocks (each
+// preceded by its sector bitmap) and the footer.
+func writeVHD(w io.Writer, raw io.ReaderAt, size int64) error {
+	allocated, err := allocatedBlocks(raw, size, vhdBlockSize)
+	if err != nil {
+		return err
+	}
+	blocks := divRoundUp(size, vhdBlockSize)
+	tableOffset := int64(vhdFooterSize + vhdDynHeaderSize)
+	tableSize := divRoundUp(blocks*4, vhdSectorSize) * vhdSectorSize
+	bitmapSize := int64(vhdSectorSize) // 4096 sectors per block, one bit each
+	dataOffset := tableOffset + tableSize
+
+	footer := vhdFooter{
+		Cookie:             [8]byte{'c', 'o', 'n', 'e', 'c', 't', 'i', 'x'},
+		Features:           2, // reserved, must always be set
+		FileFormatVersion:  vhdVersion,
+		DataOffset:         uint64(vhdFooterSize),
+		Timestamp:          uint32(time.Since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)) / time.Second),
+		CreatorApplication: [4]byte{'g', 'o', 'k', 'r'},
+		CreatorVersion:     vhdVersion,
+		CreatorHostOS:      [4]byte{'W', 'i', '2', 'k'},
+		OriginalSize:       uint64(size),
+		CurrentSize:        uint64(size),
+		DiskType:           vhdDiskDynamic,
+	}
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = vhdGeometry(size)
+	if _, err := rand.Read(footer.UniqueID[:]); err != nil {
+		return err
+	}
+	footerBytes := marshalPadded(binary.BigEndian, footer, vhdFooterSize)
+	binary.BigEndian.PutUint32(footerBytes[64:], vhdChecksum(footerBytes))
+
+	header := marshalPadded(binary.BigEndian, vhdDynHeader{
+		Cookie:          [8]byte{'c', 'x', 's', 'p', 'a', 'r', 's', 'e'},
+		DataOffset:      vhdNoOffset,
+		TableOffset:     uint64(tableOffset),
+		HeaderVersion:   vhdVersion,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       vhdBlockSize,
+	}, vhdDynHeaderSize)
+	binary.BigEndian.PutUint32(header[36:], vhdChecksum(header))
+
+	table := make([]byte, tableSize)
+	for i := int64(0); i < tableSize/4; i++ {
+		binary.BigEndian.PutUint32(table[i*4:], vhdUnusedBlock)
+	}
+	for i, idx := range allocated {
+		sector := (dataOffset + int64(i)*(bitmapSize+vhdBlockSize)) / vhdSectorSize
+		binary.BigEndian.PutUint32(table[idx*4:], uint32(sector))
+	}
+
+	bw := bufio.NewWriterSize(w, vhdBlockSize)
+	for _, b := range [][]byte{footerBytes, header, table} {
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	// All sectors of allocated blocks are present.
+	bitmap := bytes.Repeat([]byte{0xff}, int(bitmapSize))
+	buf := make([]byte, vhdBlockSize)
+	for _, idx := range allocated {
+		if err := readBlock(raw, size, idx, buf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(bitmap); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	if _, err := bw.Write(footerBytes); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
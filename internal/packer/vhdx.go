@@ -0,0 +1,226 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Constants of the VHDX format, see
+// https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx/
+const (
+	vhdxAlignment  = 1 << 20 // regions and payload blocks are MB aligned
+	vhdxBlockSize  = 2 << 20
+	vhdxSectorSize = 512
+
+	vhdxHeaderSize      = 4 << 10
+	vhdxRegionTableSize = 64 << 10
+	vhdxHeader1Offset   = 64 << 10
+	vhdxHeader2Offset   = 128 << 10
+	vhdxRegion1Offset   = 192 << 10
+	vhdxRegion2Offset   = 256 << 10
+	vhdxLogOffset       = 1 * vhdxAlignment
+	vhdxLogSize         = 1 * vhdxAlignment
+	vhdxMetadataOffset  = 2 * vhdxAlignment
+	vhdxMetadataSize    = 1 * vhdxAlignment
+	vhdxBATOffset       = 3 * vhdxAlignment
+
+	// vhdxMetadataItems is the offset of the first metadata item within
+	// the metadata region, following the metadata table.
+	vhdxMetadataItems = 64 << 10
+
+	vhdxPayloadBlockFullyPresent = 6
+
+	vhdxMetadataIsVirtualDisk = 1 << 1
+	vhdxMetadataIsRequired    = 1 << 2
+)
+
+// Well-known GUIDs of the VHDX regions and metadata items.
+var (
+	vhdxBATRegion          = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion     = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters     = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize    = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxVirtualDiskID      = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxLogicalSectorSize  = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxPhysicalSectorSize = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// vhdxGUID encodes the GUID in the mixed-endian layout used by Windows: the
+// first three fields are little-endian, the rest is in byte order.
+func vhdxGUID(s string) [16]byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + s)
+	}
+	var g [16]byte
+	g[0], g[1], g[2], g[3] = b[3], b[2], b[1], b[0]
+	g[4], g[5] = b[5], b[4]
+	g[6], g[7] = b[7], b[6]
+	copy(g[8:], b[8:])
+	return g
+}
+
+// randomGUID returns a random (version 4) GUID.
+func randomGUID() ([16]byte, error) {
+	var g [16]byte
+	if _, err := rand.Read(g[:]); err != nil {
+		return g, err
+	}
+	g[7] = g[7]&0x0f | 0x40 // version 4 (in the little-endian third field)
+	g[8] = g[8]&0x3f | 0x80 // variant 1
+	return g, nil
+}
+
+var vhdxCRC = crc32.MakeTable(crc32.Castagnoli)
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// writeVHDX converts the raw disk image of size bytes into a dynamic VHDX
+// image (as required by Hyper-V generation 2 VMs, which boot via UEFI), which
+// only contains the blocks which are not all zero. The image has an empty log,
+// so it is valid without log replay.
+func writeVHDX(w io.Writer, raw io.ReaderAt, size int64) error {
+	allocated, err := allocatedBlocks(raw, size, vhdxBlockSize)
+	if err != nil {
+		return err
+	}
+	blocks := divRoundUp(size, vhdxBlockSize)
+	// Every chunkRatio payload block entries, the BAT contains a sector bitmap
+	// block entry, which is unused (not present) for disks without parent.
+	chunkRatio := int64((1 << 23) * vhdxSectorSize / vhdxBlockSize)
+	batEntries := blocks + (blocks-1)/chunkRatio
+	batSize := divRoundUp(batEntries*8, vhdxAlignment) * vhdxAlignment
+	dataOffset := int64(vhdxBATOffset) + batSize
+
+	img := make([]byte, dataOffset)
+
+	// File type identifier
+	copy(img, "vhdxfile")
+	for i, c := range utf16.Encode([]rune("gokrazy")) {
+		binary.LittleEndian.PutUint16(img[8+i*2:], c)
+	}
+
+	// Headers: the one with the higher sequence number is current, but both
+	// are identical apart from that.
+	fileWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	dataWrite, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	for i, off := range []int{vhdxHeader1Offset, vhdxHeader2Offset} {
+		h := marshalPadded(binary.LittleEndian, vhdxHeader{
+			Signature:      [4]byte{'h', 'e', 'a', 'd'},
+			SequenceNumber: uint64(i + 1),
+			FileWriteGUID:  fileWrite,
+			DataWriteGUID:  dataWrite,
+			Version:        1,
+			LogLength:      vhdxLogSize,
+			LogOffset:      vhdxLogOffset,
+		}, vhdxHeaderSize)
+		binary.LittleEndian.PutUint32(h[4:], crc32.Checksum(h, vhdxCRC))
+		copy(img[off:], h)
+	}
+
+	// Region tables (two identical copies)
+	regions := make([]byte, vhdxRegionTableSize)
+	copy(regions, "regi")
+	binary.LittleEndian.PutUint32(regions[8:], 2) // entry count
+	copy(regions[16:], marshalPadded(binary.LittleEndian, []vhdxRegionEntry{
+		{GUID: vhdxBATRegion, FileOffset: vhdxBATOffset, Length: uint32(batSize), Required: 1},
+		{GUID: vhdxMetadataRegion, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataSize, Required: 1},
+	}, 64))
+	binary.LittleEndian.PutUint32(regions[4:], crc32.Checksum(regions, vhdxCRC))
+	copy(img[vhdxRegion1Offset:], regions)
+	copy(img[vhdxRegion2Offset:], regions)
+
+	// Metadata region: the table, followed by the items.
+	diskID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	virtualDisk := uint32(vhdxMetadataIsVirtualDisk | vhdxMetadataIsRequired)
+	items := []struct {
+		id    [16]byte
+		flags uint32
+		value any
+	}{
+		{vhdxFileParameters, vhdxMetadataIsRequired, [2]uint32{vhdxBlockSize, 0}},
+		{vhdxVirtualDiskSize, virtualDisk, uint64(size)},
+		{vhdxVirtualDiskID, virtualDisk, diskID},
+		{vhdxLogicalSectorSize, virtualDisk, uint32(vhdxSectorSize)},
+		{vhdxPhysicalSectorSize, virtualDisk, uint32(4096)},
+	}
+	metadata := img[vhdxMetadataOffset:]
+	copy(metadata, "metadata")
+	binary.LittleEndian.PutUint16(metadata[10:], uint16(len(items)))
+	itemOffset := vhdxMetadataItems
+	for i, item := range items {
+		length := binary.Size(item.value)
+		copy(metadata[32+i*32:], marshalPadded(binary.LittleEndian, vhdxMetadataEntry{
+			ItemID: item.id,
+			Offset: uint32(itemOffset),
+			Length: uint32(length),
+			Flags:  item.flags,
+		}, 32))
+		copy(metadata[itemOffset:], marshalPadded(binary.LittleEndian, item.value, length))
+		itemOffset += length
+	}
+
+	// Block allocation table
+	bat := img[vhdxBATOffset:]
+	for i, idx := range allocated {
+		offsetMB := (dataOffset + int64(i)*vhdxBlockSize) / vhdxAlignment
+		entry := uint64(offsetMB)<<20 | vhdxPayloadBlockFullyPresent
+		binary.LittleEndian.PutUint64(bat[(idx+idx/chunkRatio)*8:], entry)
+	}
+
+	bw := bufio.NewWriterSize(w, vhdxBlockSize)
+	if _, err := bw.Write(img); err != nil {
+		return err
+	}
+	buf := make([]byte, vhdxBlockSize)
+	for _, idx := range allocated {
+		if err := readBlock(raw, size, idx, buf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,143 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Constants of the hosted sparse extent format of VMware (version 1), see the
+// VMware Virtual Disk Format 5.0 specification.
+const (
+	vmdkMagic          = 0x564d444b // "KDMV"
+	vmdkVersion        = 1
+	vmdkValidNewline   = 1 << 0 // the newline detection characters are valid
+	vmdkSectorSize     = 512
+	vmdkGrainSectors   = 128 // 64 KB grains, like VMware and qemu-img
+	vmdkGrainSize      = vmdkGrainSectors * vmdkSectorSize
+	vmdkGTEsPerGT      = 512
+	vmdkDescriptorSize = 20 // sectors, reserved for the embedded descriptor
+)
+
+type vmdkHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64 // sectors
+	GrainSize          uint64 // sectors
+	DescriptorOffset   uint64 // sectors
+	DescriptorSize     uint64 // sectors
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64 // sectors
+	GDOffset           uint64 // sectors
+	OverHead           uint64 // sectors
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+}
+
+// vmdkDescriptor returns the descriptor embedded in monolithic sparse VMDK
+// images of capacity sectors.
+func vmdkDescriptor(capacity int64) (string, error) {
+	// VMware identifies disks by their content ID, so every image gets a new
+	// one.
+	var cid [4]byte
+	if _, err := rand.Read(cid[:]); err != nil {
+		return "", err
+	}
+	const heads, sectors = 255, 63
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW %d SPARSE "gokrazy.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "%d"
+ddb.geometry.sectors = "%d"
+ddb.adapterType = "lsilogic"
+`, binary.BigEndian.Uint32(cid[:]), capacity, capacity/(heads*sectors), heads, sectors), nil
+}
+
+// writeVMDK converts the raw disk image of size bytes into a monolithic
+// sparse VMDK image (as used by VMware Workstation, Fusion and ESXi), which
+// only contains the grains which are not all zero. The layout is: the header,
+// the embedded descriptor, the grain directory, all grain tables and the
+// grains.
+func writeVMDK(w io.Writer, raw io.ReaderAt, size int64) error {
+	allocated, err := allocatedBlocks(raw, size, vmdkGrainSize)
+	if err != nil {
+		return err
+	}
+	capacity := divRoundUp(size, vmdkSectorSize)
+	grains := divRoundUp(size, vmdkGrainSize)
+	tables := divRoundUp(grains, vmdkGTEsPerGT)
+	const gdOffset = 1 + vmdkDescriptorSize
+	gdSectors := divRoundUp(tables*4, vmdkSectorSize)
+	gtOffset := gdOffset + gdSectors
+	gtSectors := int64(vmdkGTEsPerGT * 4 / vmdkSectorSize)
+	overHead := divRoundUp(gtOffset+tables*gtSectors, vmdkGrainSectors) * vmdkGrainSectors
+
+	descriptor, err := vmdkDescriptor(capacity)
+	if err != nil {
+		return err
+	}
+	if len(descriptor) > vmdkDescriptorSize*vmdkSectorSize {
+		return fmt.Errorf("BUG: VMDK descriptor exceeds %d sectors", vmdkDescriptorSize)
+	}
+	hdr := vmdkHeader{
+		Magic:              vmdkMagic,
+		Version:            vmdkVersion,
+		Flags:              vmdkValidNewline,
+		Capacity:           uint64(capacity),
+		GrainSize:          vmdkGrainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     vmdkDescriptorSize,
+		NumGTEsPerGT:       vmdkGTEsPerGT,
+		GDOffset:           gdOffset,
+		OverHead:           uint64(overHead),
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+
+	img := make([]byte, overHead*vmdkSectorSize)
+	copy(img, marshalPadded(binary.LittleEndian, hdr, vmdkSectorSize))
+	copy(img[vmdkSectorSize:], descriptor)
+	gd := img[gdOffset*vmdkSectorSize:]
+	for t := int64(0); t < tables; t++ {
+		binary.LittleEndian.PutUint32(gd[t*4:], uint32(gtOffset+t*gtSectors))
+	}
+	gt := img[gtOffset*vmdkSectorSize:]
+	for i, idx := range allocated {
+		binary.LittleEndian.PutUint32(gt[idx*4:], uint32(overHead+int64(i)*vmdkGrainSectors))
+	}
+
+	bw := bufio.NewWriterSize(w, 1<<20)
+	if _, err := bw.Write(img); err != nil {
+		return err
+	}
+	buf := make([]byte, vmdkGrainSize)
+	for _, idx := range allocated {
+		if err := readBlock(raw, size, idx, buf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,156 @@
+package packer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// vmImageAlignment is the size granularity of disk images which cloud
+// providers accept (e.g. Google Compute Engine requires whole GiB).
+const vmImageAlignment = 1 << 30
+
+// vmFormats are the formats in which the full image can be written to a file
+// for running it in a VM, see Pack.VMFormat.
+var vmFormats = map[string]func(w io.Writer, raw io.ReaderAt, size int64) error{
+	// raw is the plain image, as accepted by e.g. aws ec2 import-snapshot.
+	"raw": func(w io.Writer, raw io.ReaderAt, size int64) error {
+		_, err := io.Copy(w, io.NewSectionReader(raw, 0, size))
+		return err
+	},
+
+	// qcow2 is the native (sparse) format of QEMU/KVM.
+	"qcow2": writeQcow2,
+
+	// vhd and vhdx are the (dynamic) formats of Hyper-V generation 1 and 2
+	// VMs; vdi is the native format of VirtualBox.
+	"vhd":  writeVHD,
+	"vhdx": writeVHDX,
+	"vdi":  writeVDI,
+
+	// vmdk is the (monolithic sparse) format of VMware Workstation, Fusion
+	// and ESXi.
+	"vmdk": writeVMDK,
+
+	// gce is a tarball containing disk.raw, as expected by
+	// gcloud compute images create --source-uri.
+	"gce": writeGCEImage,
+}
+
+func writeGCEImage(w io.Writer, raw io.ReaderAt, size int64) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    "disk.raw",
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+		Format:  tar.FormatGNU,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, io.NewSectionReader(raw, 0, size)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// allocatedBlocks returns the indexes of the blocks (of blockSize bytes) of
+// the raw image which are not all zero, i.e. which need to be stored in
+// sparse VM image formats.
+func allocatedBlocks(raw io.ReaderAt, size, blockSize int64) ([]int64, error) {
+	var allocated []int64
+	buf := make([]byte, blockSize)
+	zero := make([]byte, blockSize)
+	for idx := int64(0); idx < divRoundUp(size, blockSize); idx++ {
+		if err := readBlock(raw, size, idx, buf); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(buf, zero) {
+			allocated = append(allocated, idx)
+		}
+	}
+	return allocated, nil
+}
+
+// readBlock reads the block idx (of len(buf) bytes) of the raw image of size
+// bytes into buf, padding the partial last block with zeros.
+func readBlock(raw io.ReaderAt, size, idx int64, buf []byte) error {
+	off := idx * int64(len(buf))
+	n := int64(len(buf))
+	if off+n > size {
+		n = size - off
+	}
+	if _, err := raw.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < int64(len(buf)); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+func divRoundUp(n, d int64) int64 {
+	return (n + d - 1) / d
+}
+
+// VMFormats returns the names of the supported VM image formats.
+func VMFormats() []string {
+	names := make([]string, 0, len(vmFormats))
+	for name := range vmFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkVMFormat verifies that the image can be written in the VM format.
+func (p *Pack) checkVMFormat() error {
+	if _, ok := vmFormats[p.VMFormat]; !ok {
+		return fmt.Errorf("unknown VM image format %q, expected one of %s", p.VMFormat, strings.Join(VMFormats(), ", "))
+	}
+	if p.Shrink {
+		return fmt.Errorf("--shrink cannot be combined with VM image formats")
+	}
+	if !p.UseGPT {
+		// VMs (in particular arm64 cloud instances) boot via UEFI, which
+		// needs the GPT to find the EFI system partition.
+		return fmt.Errorf("VM images require a GPT partition table for UEFI boot, but the device type only supports MBR")
+	}
+	return nil
+}
+
+// writeVMImage converts the full image in raw (of size bytes) into the
+// VM format and writes it to target.
+func (p *Pack) writeVMImage(raw *os.File, size int64, target string) error {
+	out, err := createPartial(target)
+	if err != nil {
+		return err
+	}
+	defer abortPartial(target)
+	defer out.Close()
+	if err := vmFormats[p.VMFormat](out, raw, size); err != nil {
+		return fmt.Errorf("writing %s image %s: %v", p.VMFormat, target, err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := p.commitPartial(target); err != nil {
+		return err
+	}
+	st, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s VM image %s (%d MB, disk size %d MB)\n", p.VMFormat, target, st.Size()/MB, size/MB)
+	return nil
+}
@@ -0,0 +1,276 @@
+package packer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readQcow2 reads back the disk contents of a qcow2 image written by
+// writeQcow2 and verifies the refcounts.
+func readQcow2(t *testing.T, img []byte) []byte {
+	t.Helper()
+	var hdr qcow2Header
+	if err := binary.Read(bytes.NewReader(img), binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Magic != qcow2Magic || hdr.Version != 2 || hdr.ClusterBits != qcow2ClusterBits {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	if len(img)%qcow2ClusterSize != 0 {
+		t.Fatalf("image size %d is not a multiple of the cluster size", len(img))
+	}
+	for c := 0; c < len(img)/qcow2ClusterSize; c++ {
+		table := binary.BigEndian.Uint64(img[hdr.RefcountTableOffset+uint64(c/qcow2RefcountsPerBlock)*8:])
+		refcount := binary.BigEndian.Uint16(img[table+uint64(c%qcow2RefcountsPerBlock)*2:])
+		if refcount != 1 {
+			t.Errorf("cluster %d: refcount %d, want 1", c, refcount)
+		}
+	}
+	disk := make([]byte, hdr.Size)
+	for c := uint64(0); c*qcow2ClusterSize < hdr.Size; c++ {
+		l1 := binary.BigEndian.Uint64(img[hdr.L1TableOffset+(c/qcow2EntriesPerTable)*8:])
+		if l1 == 0 {
+			continue
+		}
+		l2 := binary.BigEndian.Uint64(img[l1&^qcow2Copied+(c%qcow2EntriesPerTable)*8:])
+		if l2 == 0 {
+			continue
+		}
+		data := l2 &^ qcow2Copied
+		copy(disk[c*qcow2ClusterSize:], img[data:data+qcow2ClusterSize])
+	}
+	return disk
+}
+
+func TestWriteQcow2(t *testing.T) {
+	// Data in the first cluster, in the middle of the second L2 table and in
+	// the partial last cluster.
+	raw := make([]byte, 2*qcow2EntriesPerTable*qcow2ClusterSize+1000)
+	copy(raw, "gokrazy boot")
+	copy(raw[(qcow2EntriesPerTable+5)*qcow2ClusterSize:], "gokrazy root")
+	copy(raw[len(raw)-3:], "end")
+	var buf bytes.Buffer
+	if err := writeQcow2(&buf, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	// header, L1, refcount table, refcount block, 3 L2 tables, 3 data clusters
+	if got, want := buf.Len(), 10*qcow2ClusterSize; got != want {
+		t.Errorf("qcow2 image is %d bytes, want %d bytes", got, want)
+	}
+	if disk := readQcow2(t, buf.Bytes()); !bytes.Equal(disk, raw) {
+		t.Errorf("qcow2 image contents differ from the raw image")
+	}
+}
+
+func TestWriteGCEImage(t *testing.T) {
+	raw := []byte("gokrazy disk")
+	var buf bytes.Buffer
+	if err := writeGCEImage(&buf, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "disk.raw" {
+		t.Errorf("tarball contains %s, want disk.raw", hdr.Name)
+	}
+	b, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, raw) {
+		t.Errorf("disk.raw = %q, want %q", b, raw)
+	}
+}
+
+// sparseTestImage returns a raw image with data in the first block, in the
+// middle of the image and in the partial last block of blockSize bytes.
+func sparseTestImage(blockSize int) []byte {
+	raw := make([]byte, 10*blockSize+1000)
+	copy(raw, "gokrazy boot")
+	copy(raw[5*blockSize+17:], "gokrazy root")
+	copy(raw[len(raw)-3:], "end")
+	return raw
+}
+
+func TestWriteVHD(t *testing.T) {
+	raw := sparseTestImage(vhdBlockSize)
+	var buf bytes.Buffer
+	if err := writeVHD(&buf, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	footer := img[len(img)-vhdFooterSize:]
+	if !bytes.Equal(footer, img[:vhdFooterSize]) {
+		t.Errorf("footer copy differs from footer")
+	}
+	c := append([]byte{}, footer...)
+	binary.BigEndian.PutUint32(c[64:], 0)
+	if got, want := binary.BigEndian.Uint32(footer[64:]), vhdChecksum(c); got != want {
+		t.Errorf("footer checksum = %#x, want %#x", got, want)
+	}
+	var hdr vhdDynHeader
+	if err := binary.Read(bytes.NewReader(img[vhdFooterSize:]), binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	disk := make([]byte, len(raw))
+	for b := int64(0); b < int64(hdr.MaxTableEntries); b++ {
+		sector := binary.BigEndian.Uint32(img[int64(hdr.TableOffset)+b*4:])
+		if sector == vhdUnusedBlock {
+			continue
+		}
+		data := int64(sector)*vhdSectorSize + vhdSectorSize // skip the bitmap
+		copy(disk[b*vhdBlockSize:], img[data:data+vhdBlockSize])
+	}
+	if !bytes.Equal(disk, raw) {
+		t.Errorf("VHD image contents differ from the raw image")
+	}
+	// footer copy, header, BAT, 3 blocks with bitmaps, footer
+	if got, want := len(img), 512+1024+512+3*(512+vhdBlockSize)+512; got != want {
+		t.Errorf("VHD image is %d bytes, want %d bytes", got, want)
+	}
+}
+
+func TestWriteVHDX(t *testing.T) {
+	raw := sparseTestImage(vhdxBlockSize)
+	var buf bytes.Buffer
+	if err := writeVHDX(&buf, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	if string(img[:8]) != "vhdxfile" {
+		t.Fatalf("missing file type identifier")
+	}
+	verifyCRC := func(name string, b []byte) {
+		t.Helper()
+		c := append([]byte{}, b...)
+		binary.LittleEndian.PutUint32(c[4:], 0)
+		if got, want := binary.LittleEndian.Uint32(b[4:]), crc32.Checksum(c, vhdxCRC); got != want {
+			t.Errorf("%s checksum = %#x, want %#x", name, got, want)
+		}
+	}
+	verifyCRC("header 1", img[vhdxHeader1Offset:vhdxHeader1Offset+vhdxHeaderSize])
+	verifyCRC("header 2", img[vhdxHeader2Offset:vhdxHeader2Offset+vhdxHeaderSize])
+	verifyCRC("region table", img[vhdxRegion1Offset:vhdxRegion1Offset+vhdxRegionTableSize])
+	var region vhdxRegionEntry
+	if err := binary.Read(bytes.NewReader(img[vhdxRegion1Offset+16:]), binary.LittleEndian, &region); err != nil {
+		t.Fatal(err)
+	}
+	if region.GUID != vhdxBATRegion {
+		t.Fatalf("first region is not the BAT")
+	}
+	metadata := img[vhdxMetadataOffset:]
+	var entry vhdxMetadataEntry
+	if err := binary.Read(bytes.NewReader(metadata[32+32:]), binary.LittleEndian, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.ItemID != vhdxVirtualDiskSize {
+		t.Fatalf("second metadata item is not the virtual disk size")
+	}
+	if got := binary.LittleEndian.Uint64(metadata[entry.Offset:]); got != uint64(len(raw)) {
+		t.Errorf("virtual disk size = %d, want %d", got, len(raw))
+	}
+	disk := make([]byte, len(raw))
+	for b := int64(0); b*vhdxBlockSize < int64(len(raw)); b++ {
+		entry := binary.LittleEndian.Uint64(img[int64(region.FileOffset)+b*8:])
+		if entry&7 != vhdxPayloadBlockFullyPresent {
+			continue
+		}
+		data := int64(entry>>20) * vhdxAlignment
+		copy(disk[b*vhdxBlockSize:], img[data:data+vhdxBlockSize])
+	}
+	if !bytes.Equal(disk, raw) {
+		t.Errorf("VHDX image contents differ from the raw image")
+	}
+}
+
+func TestWriteVDI(t *testing.T) {
+	raw := sparseTestImage(vdiBlockSize)
+	var buf bytes.Buffer
+	if err := writeVDI(&buf, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	var hdr vdiHeader
+	if err := binary.Read(bytes.NewReader(img), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Signature != vdiSignature || hdr.Version != vdiVersion || hdr.HeaderSize != vdiHeaderSize {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	if got, want := binary.Size(hdr)-72, vdiHeaderSize; got != want {
+		t.Errorf("header is %d bytes, want %d bytes", got, want)
+	}
+	if hdr.BlocksAllocated != 3 {
+		t.Errorf("%d blocks allocated, want 3", hdr.BlocksAllocated)
+	}
+	disk := make([]byte, hdr.DiskSize)
+	for b := int64(0); b < int64(hdr.Blocks); b++ {
+		idx := binary.LittleEndian.Uint32(img[int64(hdr.BlocksOffset)+b*4:])
+		if idx == vdiBlockFree {
+			continue
+		}
+		data := int64(hdr.DataOffset) + int64(idx)*vdiBlockSize
+		copy(disk[b*vdiBlockSize:], img[data:data+vdiBlockSize])
+	}
+	if !bytes.Equal(disk, raw) {
+		t.Errorf("VDI image contents differ from the raw image")
+	}
+}
+
+func TestWriteVMDK(t *testing.T) {
+	// Data in grains of the first, second and third grain table.
+	raw := sparseTestImage(vmdkGTEsPerGT * vmdkGrainSize / 4)
+	var buf bytes.Buffer
+	if err := writeVMDK(&buf, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	var hdr vmdkHeader
+	if err := binary.Read(bytes.NewReader(img), binary.LittleEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Magic != vmdkMagic || hdr.Version != vmdkVersion || hdr.GrainSize != vmdkGrainSectors {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	if got, want := binary.Size(hdr), 79; got != want {
+		t.Errorf("header is %d bytes, want %d bytes", got, want)
+	}
+	descriptor := string(img[hdr.DescriptorOffset*vmdkSectorSize:][:hdr.DescriptorSize*vmdkSectorSize])
+	if want := fmt.Sprintf("RW %d SPARSE", hdr.Capacity); !strings.Contains(descriptor, want) {
+		t.Errorf("descriptor does not contain %q:\n%s", want, descriptor)
+	}
+	disk := make([]byte, hdr.Capacity*vmdkSectorSize)
+	for g := uint64(0); g*vmdkGrainSize < uint64(len(raw)); g++ {
+		gt := binary.LittleEndian.Uint32(img[hdr.GDOffset*vmdkSectorSize+(g/vmdkGTEsPerGT)*4:])
+		sector := binary.LittleEndian.Uint32(img[uint64(gt)*vmdkSectorSize+(g%vmdkGTEsPerGT)*4:])
+		if sector == 0 {
+			continue
+		}
+		if uint64(sector) < hdr.OverHead {
+			t.Fatalf("grain %d at sector %d, before the overhead of %d sectors", g, sector, hdr.OverHead)
+		}
+		data := uint64(sector) * vmdkSectorSize
+		copy(disk[g*vmdkGrainSize:], img[data:data+vmdkGrainSize])
+	}
+	if !bytes.Equal(disk[:len(raw)], raw) {
+		t.Errorf("VMDK image contents differ from the raw image")
+	}
+	// 3 grains with data: the first, the middle one and the partial last one
+	if got, want := uint64(len(img)), hdr.OverHead*vmdkSectorSize+3*vmdkGrainSize; got != want {
+		t.Errorf("VMDK image is %d bytes, want %d bytes", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Volume is a persistent directory on the perm partition for one service,
+// which init creates (and sets the permissions of) on boot, before starting
+// the services. The service finds the directory in $STATE_DIRECTORY (like
+// with systemd’s StateDirectory=).
+type Volume struct {
+	// Service is the import path of the package (or the program name).
+	Service string
+
+	// Dir is the absolute path of the directory, below /perm.
+	Dir string
+
+	// Mode is the permission of the directory.
+	Mode os.FileMode
+
+	// UID and GID are the owner of the directory, or -1 to leave the owner
+	// unchanged (root for new directories).
+	UID int
+	GID int
+}
+
+// programName returns the name of the service program.
+func (v Volume) programName() string {
+	return filepath.Base(v.Service)
+}
+
+// ParseVolume parses a <service>=<dir>[:<mode>[:<uid>[:<gid>]]] flag value,
+// e.g. github.com/gokrazy/scan2drive/cmd/scan2drive=scan2drive:0700:1000,
+// where dir is relative to /perm.
+func ParseVolume(s string) (Volume, error) {
+	service, spec, ok := strings.Cut(s, "=")
+	if !ok || service == "" || spec == "" {
+		return Volume{}, fmt.Errorf("invalid volume %q: expected <service>=<dir>[:<mode>[:<uid>[:<gid>]]], e.g. scan2drive=scan2drive:0700:1000", s)
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) > 4 {
+		return Volume{}, fmt.Errorf("invalid volume %q: too many fields, expected <service>=<dir>[:<mode>[:<uid>[:<gid>]]]", s)
+	}
+	v := Volume{
+		Service: service,
+		Dir:     parts[0],
+		Mode:    0755,
+		UID:     -1,
+		GID:     -1,
+	}
+	if !path.IsAbs(v.Dir) {
+		v.Dir = path.Join("/perm", v.Dir)
+	}
+	if v.Dir = path.Clean(v.Dir); !strings.HasPrefix(v.Dir, "/perm/") {
+		return Volume{}, fmt.Errorf("invalid volume %q: directory %s is not below /perm", s, v.Dir)
+	}
+	if len(parts) > 1 {
+		mode, err := strconv.ParseUint(parts[1], 8, 32)
+		if err != nil || mode > 0777 {
+			return Volume{}, fmt.Errorf("invalid volume %q: invalid mode %q, expected e.g. 0700", s, parts[1])
+		}
+		v.Mode = os.FileMode(mode)
+	}
+	if len(parts) > 2 {
+		uid, err := strconv.Atoi(parts[2])
+		if err != nil || uid < 0 {
+			return Volume{}, fmt.Errorf("invalid volume %q: invalid uid %q", s, parts[2])
+		}
+		v.UID, v.GID = uid, uid
+	}
+	if len(parts) > 3 {
+		gid, err := strconv.Atoi(parts[3])
+		if err != nil || gid < 0 {
+			return Volume{}, fmt.Errorf("invalid volume %q: invalid gid %q", s, parts[3])
+		}
+		v.GID = gid
+	}
+	return v, nil
+}
+
+// validateVolumes verifies that each volume belongs to a different service of
+// the root file system, and that no directories are shared.
+func validateVolumes(volumes []Volume, root *FileInfo) error {
+	programs := make(map[string]bool)
+	for _, p := range flattenFiles("/", root) {
+		programs[filepath.Base(p)] = true
+	}
+	services := make(map[string]string)
+	dirs := make(map[string]string)
+	for _, v := range volumes {
+		name := v.programName()
+		if !programs[name] {
+			return fmt.Errorf("volume %s: service %s not found in the root file system", v.Dir, v.Service)
+		}
+		if other, ok := services[name]; ok {
+			return fmt.Errorf("service %s has more than one volume: %s and %s", v.Service, other, v.Dir)
+		}
+		services[name] = v.Dir
+		for dir, other := range dirs {
+			if dir == v.Dir || strings.HasPrefix(dir, v.Dir+"/") || strings.HasPrefix(v.Dir, dir+"/") {
+				return fmt.Errorf("volume %s of service %s overlaps with volume %s of service %s", v.Dir, v.Service, dir, other)
+			}
+		}
+		dirs[v.Dir] = v.Service
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package packer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Volume
+	}{
+		{"scan2drive=scan2drive", Volume{Service: "scan2drive", Dir: "/perm/scan2drive", Mode: 0755, UID: -1, GID: -1}},
+		{"github.com/gokrazy/scan2drive/cmd/scan2drive=/perm/scans:0700:1000", Volume{Service: "github.com/gokrazy/scan2drive/cmd/scan2drive", Dir: "/perm/scans", Mode: 0700, UID: 1000, GID: 1000}},
+		{"mqtt=data/mqtt/:0750:1000:100", Volume{Service: "mqtt", Dir: "/perm/data/mqtt", Mode: 0750, UID: 1000, GID: 100}},
+	} {
+		got, err := ParseVolume(tt.in)
+		if err != nil {
+			t.Errorf("ParseVolume(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseVolume(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{
+		"scan2drive",
+		"=scan2drive",
+		"scan2drive=../etc",
+		"scan2drive=/tmp/scans",
+		"scan2drive=/perm",
+		"scan2drive=scans:0800",
+		"scan2drive=scans:rw",
+		"scan2drive=scans:0700:-1",
+		"scan2drive=scans:0700:1000:1000:1",
+	} {
+		if _, err := ParseVolume(in); err == nil {
+			t.Errorf("ParseVolume(%q) unexpectedly succeeded", in)
+		}
+	}
+}
+
+func TestValidateVolumes(t *testing.T) {
+	root := &FileInfo{Dirents: []*FileInfo{
+		{Filename: "user", Dirents: []*FileInfo{
+			{Filename: "scan2drive", FromHost: "/tmp/scan2drive"},
+			{Filename: "mqtt", FromHost: "/tmp/mqtt"},
+		}},
+	}}
+	scans := Volume{Service: "github.com/gokrazy/scan2drive/cmd/scan2drive", Dir: "/perm/scans"}
+	if err := validateVolumes([]Volume{scans, {Service: "mqtt", Dir: "/perm/mqtt"}}, root); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		volumes []Volume
+		want    string
+	}{
+		{[]Volume{{Service: "missing", Dir: "/perm/missing"}}, "not found"},
+		{[]Volume{scans, {Service: "scan2drive", Dir: "/perm/other"}}, "more than one volume"},
+		{[]Volume{scans, {Service: "mqtt", Dir: "/perm/scans"}}, "overlaps"},
+		{[]Volume{scans, {Service: "mqtt", Dir: "/perm/scans/mqtt"}}, "overlaps"},
+	} {
+		err := validateVolumes(tt.volumes, root)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("validateVolumes(%+v) = %v, want error containing %q", tt.volumes, err, tt.want)
+		}
+	}
+}
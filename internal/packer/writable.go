@@ -0,0 +1,64 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrWriteProtected is returned when the device is marked read-only by the
+// kernel, which for SD cards usually means the lock tab is in the lock
+// position.
+var ErrWriteProtected = errors.New("device is write-protected")
+
+func writeProtectedError(dev string) error {
+	return fmt.Errorf("%s: %w: if this is an SD card, slide the lock tab on the side of the card (or adapter) up, away from “LOCK”, then unplug and re-plug the card", dev, ErrWriteProtected)
+}
+
+// readOnly reports whether the kernel marked the block device dev as
+// read-only. On platforms without /sys/class/block, readOnly returns false.
+func readOnly(dev string) bool {
+	if target, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = target
+	}
+	b, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(dev), "ro"))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(b)) == "1"
+}
+
+// CheckDeviceWritable verifies that the device dev can be written to before
+// starting to build, so that we can print actionable messages instead of
+// failing after building.
+func CheckDeviceWritable(dev, sudo string) error {
+	if readOnly(dev) {
+		return writeProtectedError(dev)
+	}
+	err := unix.Access(dev, unix.W_OK)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EROFS):
+		return writeProtectedError(dev)
+	case errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM):
+		if sudo != "never" {
+			return nil // we will use sudo to partition the device
+		}
+		return permissionError(dev)
+	default:
+		return fmt.Errorf("%s: %v", dev, err)
+	}
+}
+
+func permissionError(dev string) error {
+	return fmt.Errorf("%s: permission denied. To fix, either:\n"+
+		"\t- grant your user access: sudo setfacl -m u:${USER}:rw %s\n"+
+		"\t- add your user to the group owning the device (e.g. disk): sudo usermod -aG disk ${USER}, then log in again\n"+
+		"\t- allow using sudo: --sudo=auto",
+		dev, dev)
+}
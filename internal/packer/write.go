@@ -10,7 +10,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -22,12 +21,15 @@ import (
 	"github.com/gokrazy/internal/humanize"
 	"github.com/gokrazy/internal/mbr"
 	"github.com/gokrazy/internal/squashfs"
+	"github.com/gokrazy/tools/internal/ext4"
+	"github.com/gokrazy/tools/internal/fat32"
 	"github.com/gokrazy/tools/internal/measure"
+	"github.com/gokrazy/tools/manifest"
 	"github.com/gokrazy/tools/packer"
 	"github.com/gokrazy/tools/third_party/systemd-250.5-1"
 )
 
-func copyFile(fw *fat.Writer, dest string, src fs.File) error {
+func copyFile(fw *bootFS, dest string, src fs.File) error {
 	st, err := src.Stat()
 	if err != nil {
 		return err
@@ -42,7 +44,7 @@ func copyFile(fw *fat.Writer, dest string, src fs.File) error {
 	return src.Close()
 }
 
-func copyFileSquash(d *squashfs.Directory, dest, src string) error {
+func (p *Pack) copyFileSquash(d *squashfs.Directory, dest, src string) error {
 	f, err := os.Open(src)
 	if err != nil {
 		return err
@@ -52,7 +54,7 @@ func copyFileSquash(d *squashfs.Directory, dest, src string) error {
 	if err != nil {
 		return err
 	}
-	w, err := d.File(filepath.Base(dest), st.ModTime(), st.Mode()&os.ModePerm)
+	w, err := d.File(filepath.Base(dest), p.modTime(st), st.Mode()&os.ModePerm)
 	if err != nil {
 		return err
 	}
@@ -62,10 +64,16 @@ func copyFileSquash(d *squashfs.Directory, dest, src string) error {
 	return w.Close()
 }
 
-func (p *Pack) writeCmdline(fw *fat.Writer, src string) error {
-	b, err := ioutil.ReadFile(src)
-	if err != nil {
-		return err
+func (p *Pack) writeCmdline(fw *bootFS, src string) error {
+	var b []byte
+	if p.Board != nil && p.Board.Cmdline != "" {
+		b = []byte(p.Board.Cmdline)
+	} else {
+		var err error
+		b, err = ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
 	}
 	cmdline := "console=tty1 "
 	serialConsole := p.Cfg.SerialConsoleOrDefault()
@@ -80,6 +88,32 @@ func (p *Pack) writeCmdline(fw *fat.Writer, src string) error {
 	}
 	cmdline += string(b)
 
+	if p.InitDebug {
+		// Show all kernel messages on the console.
+		fields := strings.Fields(cmdline)
+		cmdline = ""
+		for _, f := range fields {
+			if f == "quiet" || strings.HasPrefix(f, "loglevel=") {
+				continue
+			}
+			cmdline += f + " "
+		}
+		cmdline += "loglevel=7"
+	}
+
+	if p.RootFileSystem == "ext4" {
+		// The kernel packages specify rootfstype=squashfs.
+		fields := strings.Fields(cmdline)
+		cmdline = ""
+		for _, f := range fields {
+			if strings.HasPrefix(f, "rootfstype=") || f == "rw" {
+				continue
+			}
+			cmdline += f + " "
+		}
+		cmdline += "rootfstype=ext4 ro"
+	}
+
 	// TODO: change {gokrazy,rtr7}/kernel/cmdline.txt to contain a dummy PARTUUID=
 	if p.ModifyCmdlineRoot() {
 		root := "root=" + p.Root()
@@ -95,11 +129,16 @@ func (p *Pack) writeCmdline(fw *fat.Writer, src string) error {
 	const pad = 64
 	padded := append([]byte(cmdline), bytes.Repeat([]byte{' '}, pad)...)
 
-	w, err := fw.File("/cmdline.txt", time.Now())
+	w, err := fw.File("/cmdline.txt", p.now())
 	if err != nil {
 		return err
 	}
-	if _, err := w.Write(padded); err != nil {
+	content := padded
+	if p.Board != nil && p.Board.BootScript != "" {
+		// The boot script imports cmdline.txt into the U-Boot environment.
+		content = append([]byte("bootargs="), padded...)
+	}
+	if _, err := w.Write(content); err != nil {
 		return err
 	}
 
@@ -107,7 +146,7 @@ func (p *Pack) writeCmdline(fw *fat.Writer, src string) error {
 		// In addition to the cmdline.txt for the Raspberry Pi bootloader, also
 		// write a systemd-boot entries configuration file as per
 		// https://systemd.io/BOOT_LOADER_SPECIFICATION/
-		w, err = fw.File("/loader/entries/gokrazy.conf", time.Now())
+		w, err = fw.File("/loader/entries/gokrazy.conf", p.now())
 		if err != nil {
 			return err
 		}
@@ -122,16 +161,25 @@ linux /vmlinuz
 	return nil
 }
 
-func (p *Pack) writeConfig(fw *fat.Writer, src string) error {
+func (p *Pack) writeConfig(fw *bootFS, src string) error {
 	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		if p.Board != nil && os.IsNotExist(err) {
+			// config.txt is only used by the Raspberry Pi firmware.
+			return nil
+		}
+		return err
+	}
+	model, err := p.model()
 	if err != nil {
 		return err
 	}
-	config := string(b)
+	config := model.configTxt(string(b))
 	if p.Cfg.SerialConsoleOrDefault() != "off" {
 		config = strings.ReplaceAll(config, "enable_uart=0", "enable_uart=1")
 	}
-	w, err := fw.File("/config.txt", time.Now())
+	config += p.extraKernelConfig()
+	w, err := fw.File("/config.txt", p.now())
 	if err != nil {
 		return err
 	}
@@ -162,6 +210,11 @@ var (
 	}
 )
 
+// maxFAT16Size is the size of the largest FAT16 file system which fat.Writer
+// can write: beyond 0xFFF4 clusters of 2 KB, its 16-bit cluster numbers
+// overflow.
+const maxFAT16Size = 0xFFF4 * 2048
+
 func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 	fmt.Printf("\n")
 	fmt.Printf("Creating boot file system\n")
@@ -181,8 +234,12 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 			globs = append(globs, filepath.Join(firmwareDir, glob))
 		}
 	}
+	model, err := p.model()
+	if err != nil {
+		return err
+	}
 	var eepromDir string
-	if eeprom := p.Cfg.EEPROMPackageOrDefault(); eeprom != "" {
+	if eeprom := p.Cfg.EEPROMPackageOrDefault(); eeprom != "" && (model == nil || model.eeprom) {
 		var err error
 		eepromDir, err = packer.PackageDir(eeprom)
 		if err != nil {
@@ -195,21 +252,36 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 	}
 
 	fmt.Printf("\nKernel directory: %s\n", kernelDir)
+	if err := model.checkKernel(kernelDir, p.Cfg.KernelPackageOrDefault()); err != nil {
+		return err
+	}
 	for _, glob := range kernelGlobs {
 		globs = append(globs, filepath.Join(kernelDir, glob))
 	}
 
-	bufw := bufio.NewWriter(f)
-	fw, err := fat.NewWriter(bufw)
+	var size countingWriter
+	bufw := bufio.NewWriter(io.MultiWriter(f, &size))
+	var fatw fatWriter
+	if p.Layout.BootFileSystem == "fat32" {
+		fatw, err = fat32.NewWriter(bufw, p.BootSize())
+	} else {
+		fatw, err = fat.NewWriter(bufw)
+	}
 	if err != nil {
 		return err
 	}
+	fw := newBootFS(fatw)
+	fw.modTime = p.fixedTime
+	written := make(map[string]bool)
 	for _, pattern := range globs {
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
 			return err
 		}
 		for _, m := range matches {
+			if !model.firmwareFile(filepath.Base(m)) {
+				continue
+			}
 			src, err := os.Open(m)
 			if err != nil {
 				return err
@@ -217,9 +289,14 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 			if err := copyFile(fw, "/"+filepath.Base(m), src); err != nil {
 				return err
 			}
+			written["/"+filepath.Base(m)] = true
 		}
 	}
 
+	if err := p.writeExtraKernels(fw, written); err != nil {
+		return err
+	}
+
 	// EEPROM update procedure. See also:
 	// https://news.ycombinator.com/item?id=21674550
 	writeEepromUpdateFile := func(globPattern, target string) (sig string, _ error) {
@@ -306,6 +383,13 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 		return err
 	}
 
+	if p.Board != nil && p.Board.BootScript != "" && written["/boot.scr"] {
+		return fmt.Errorf("kernel package %s contains a boot.scr, which conflicts with the boot script of board %s", p.Cfg.KernelPackageOrDefault(), p.Board.Name)
+	}
+	if err := p.writeBootScript(fw); err != nil {
+		return err
+	}
+
 	if p.UseGPTPartuuid {
 		srcX86, err := systemd.SystemdBootX64.Open("systemd-bootx64.efi")
 		if err != nil {
@@ -324,12 +408,23 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 		}
 	}
 
+	if err := fw.writeManifest(); err != nil {
+		return err
+	}
+	p.bootFiles = fw.files()
+
 	if err := fw.Flush(); err != nil {
 		return err
 	}
 	if err := bufw.Flush(); err != nil {
 		return err
 	}
+	if p.Layout.BootFileSystem != "fat32" && int64(size) > maxFAT16Size {
+		return fmt.Errorf("boot file system (%d MB) exceeds the %d MB which FAT16 can hold: use --boot_fs=fat32 with a larger --boot_size", int64(size)/MB, maxFAT16Size/MB)
+	}
+	if max := p.BootSize(); int64(size) > max {
+		return fmt.Errorf("boot file system (%d MB) does not fit into the boot partition (%d MB): increase its size with --boot_size", int64(size)/MB, max/MB)
+	}
 	if seeker, ok := f.(io.Seeker); ok {
 		off, err := seeker.Seek(0, io.SeekCurrent)
 		if err != nil {
@@ -346,7 +441,7 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 			return err
 		}
 		defer fmbr.Close()
-		if err := writeMBR(f.(io.ReadSeeker), fmbr, p.Partuuid); err != nil {
+		if err := writeMBR(f.(io.ReadSeeker), fmbr, p.BootOffset(), p.Partuuid); err != nil {
 			return err
 		}
 		if err := fmbr.Close(); err != nil {
@@ -356,72 +451,34 @@ func (p *Pack) writeBoot(f io.Writer, mbrfilename string) error {
 	return nil
 }
 
-type FileInfo struct {
-	Filename string
-	Mode     os.FileMode
-
-	FromHost    string
-	FromLiteral string
-	SymlinkDest string
-
-	Dirents []*FileInfo
-}
-
-func (fi *FileInfo) isFile() bool {
-	return fi.FromHost != "" || fi.FromLiteral != ""
-}
-
-func (fi *FileInfo) pathList() (paths []string) {
-	for _, ent := range fi.Dirents {
-		if ent.isFile() {
-			paths = append(paths, ent.Filename)
-			continue
-		}
-
-		for _, e := range ent.pathList() {
-			paths = append(paths, path.Join(ent.Filename, e))
-		}
-	}
-	return paths
-}
-
-func (fi *FileInfo) combine(fi2 *FileInfo) error {
-	for _, ent2 := range fi2.Dirents {
-		// get existing file info
-		var f *FileInfo
-		for _, ent := range fi.Dirents {
-			if ent.Filename == ent2.Filename {
-				f = ent
-				break
-			}
-		}
-
-		// if not found add complete subtree directly
-		if f == nil {
-			fi.Dirents = append(fi.Dirents, ent2)
-			continue
-		}
-
-		// file overwrite is not supported -> return error
-		if f.isFile() || ent2.isFile() {
-			return fmt.Errorf("file already exist: %s", ent2.Filename)
-		}
+// FileInfo is an entry of the root file system tree, see package manifest.
+type FileInfo = manifest.Entry
 
-		if err := f.combine(ent2); err != nil {
-			return err
-		}
+// mustFindDirent returns the directory entry name of fi, which must exist.
+func mustFindDirent(fi *FileInfo, name string) *FileInfo {
+	if ent := fi.Find(name); ent != nil {
+		return ent
 	}
+	log.Panicf("mustFindDirent(%q) did not find directory entry", name)
 	return nil
 }
 
-func (fi *FileInfo) mustFindDirent(path string) *FileInfo {
-	for _, ent := range fi.Dirents {
-		// TODO: split path into components and compare piecemeal
-		if ent.Filename == path {
-			return ent
-		}
+// writeRootManifest writes the manifest of the root file system root to the
+// file path.
+func writeRootManifest(path string, root *FileInfo) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
 	}
-	log.Panicf("mustFindDirent(%q) did not find directory entry", path)
+	defer f.Close()
+	m := &manifest.RootManifest{Root: root}
+	if err := m.Write(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote root manifest %s\n", path)
 	return nil
 }
 
@@ -450,10 +507,12 @@ func findBins(cfg *config.Struct, buildEnv *packer.BuildEnv, bindir string) (*Fi
 		if err != nil {
 			return nil, err
 		}
+		if len(initMainPkgs) == 0 {
+			return nil, fmt.Errorf("-init_pkg=%q is not a main package", cfg.InternalCompatibilityFlags.InitPkg)
+		}
 		for _, pkg := range initMainPkgs {
 			if got, want := pkg.Basename(), "init"; got != want {
-				log.Printf("Error: -init_pkg=%q produced unexpected binary name: got %q, want %q", cfg.InternalCompatibilityFlags.InitPkg, got, want)
-				continue
+				return nil, fmt.Errorf("-init_pkg=%q produced unexpected binary name: got %q, want %q", cfg.InternalCompatibilityFlags.InitPkg, got, want)
 			}
 			binPath := filepath.Join(bindir, pkg.Basename())
 			fileIsELFOrFatal(binPath)
@@ -482,16 +541,16 @@ func findBins(cfg *config.Struct, buildEnv *packer.BuildEnv, bindir string) (*Fi
 	return &result, nil
 }
 
-func writeFileInfo(dir *squashfs.Directory, fi *FileInfo) error {
+func (p *Pack) writeFileInfo(dir *squashfs.Directory, fi *FileInfo, now time.Time) error {
 	if fi.FromHost != "" { // copy a regular file
-		return copyFileSquash(dir, fi.Filename, fi.FromHost)
+		return p.copyFileSquash(dir, fi.Filename, fi.FromHost)
 	}
 	if fi.FromLiteral != "" { // write a regular file
 		mode := fi.Mode
 		if mode == 0 {
 			mode = 0444
 		}
-		w, err := dir.File(fi.Filename, time.Now(), mode)
+		w, err := dir.File(fi.Filename, now, mode)
 		if err != nil {
 			return err
 		}
@@ -502,27 +561,45 @@ func writeFileInfo(dir *squashfs.Directory, fi *FileInfo) error {
 	}
 
 	if fi.SymlinkDest != "" { // create a symlink
-		return dir.Symlink(fi.SymlinkDest, fi.Filename, time.Now(), 0444)
+		return dir.Symlink(fi.SymlinkDest, fi.Filename, now, 0444)
 	}
 	// subdir
 	var d *squashfs.Directory
 	if fi.Filename == "" { // root
 		d = dir
 	} else {
-		d = dir.Directory(fi.Filename, time.Now())
+		d = dir.Directory(fi.Filename, now)
 	}
 	sort.Slice(fi.Dirents, func(i, j int) bool {
 		return fi.Dirents[i].Filename < fi.Dirents[j].Filename
 	})
 	for _, ent := range fi.Dirents {
-		if err := writeFileInfo(d, ent); err != nil {
+		if err := p.writeFileInfo(d, ent, now); err != nil {
 			return err
 		}
 	}
 	return d.Flush()
 }
 
-func writeRoot(f io.WriteSeeker, root *FileInfo) error {
+// RootFileSystems returns the supported values of Pack.RootFileSystem.
+func RootFileSystems() []string {
+	return []string{"squashfs", "ext4"}
+}
+
+func (p *Pack) checkRootFileSystem() error {
+	switch p.RootFileSystem {
+	case "", "squashfs", "ext4":
+		return nil
+	default:
+		return fmt.Errorf("unknown root file system %q (supported: %s)", p.RootFileSystem, strings.Join(RootFileSystems(), ", "))
+	}
+}
+
+func (p *Pack) writeRoot(f io.WriteSeeker, root *FileInfo) error {
+	if p.RootFileSystem == "ext4" {
+		return p.writeRootExt4(f, root)
+	}
+
 	fmt.Printf("\n")
 	fmt.Printf("Creating root file system\n")
 	done := measure.Interactively("creating root file system")
@@ -532,16 +609,110 @@ func writeRoot(f io.WriteSeeker, root *FileInfo) error {
 
 	// TODO: make fw.Flush() report the size of the root fs
 
-	fw, err := squashfs.NewWriter(f, time.Now())
+	now := p.now()
+	fw, err := squashfs.NewWriter(f, now)
 	if err != nil {
 		return err
 	}
 
-	if err := writeFileInfo(fw.Root, root); err != nil {
+	if err := p.writeFileInfo(fw.Root, root, now); err != nil {
+		return err
+	}
+
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
 		return err
 	}
+	if max := p.RootSize(); size > max {
+		return fmt.Errorf("root file system (%d MB) does not fit into the root partition (%d MB): increase its size with --root_size", size/MB, max/MB)
+	}
+	return nil
+}
 
-	return fw.Flush()
+// ext4File converts fi into the ext4 package's representation. Regular files
+// from the host keep their mode, including the setuid, setgid and sticky bits.
+func (p *Pack) ext4File(fi *FileInfo, modTime time.Time) (*ext4.File, error) {
+	switch {
+	case fi.FromHost != "":
+		st, err := os.Stat(fi.FromHost)
+		if err != nil {
+			return nil, err
+		}
+		src := fi.FromHost
+		return &ext4.File{
+			Name:    filepath.Base(fi.Filename),
+			Mode:    st.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+			ModTime: p.modTime(st),
+			Open:    func() (io.ReadCloser, error) { return os.Open(src) },
+			Size:    st.Size(),
+		}, nil
+
+	case fi.FromLiteral != "":
+		mode := fi.Mode
+		if mode == 0 {
+			mode = 0444
+		}
+		content := fi.FromLiteral
+		return &ext4.File{
+			Name:    fi.Filename,
+			Mode:    mode,
+			ModTime: modTime,
+			Open:    func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(content)), nil },
+			Size:    int64(len(content)),
+		}, nil
+
+	case fi.SymlinkDest != "":
+		return &ext4.File{
+			Name:    fi.Filename,
+			ModTime: modTime,
+			Target:  fi.SymlinkDest,
+		}, nil
+	}
+	dir := &ext4.File{
+		Name:    fi.Filename,
+		Mode:    0755,
+		ModTime: modTime,
+		Dir:     true,
+	}
+	for _, ent := range fi.Dirents {
+		f, err := p.ext4File(ent, modTime)
+		if err != nil {
+			return nil, err
+		}
+		dir.Entries = append(dir.Entries, f)
+	}
+	return dir, nil
+}
+
+// writeRootExt4 writes the root file system as ext4 instead of SquashFS. The
+// ext4 file system is not compressed, so it needs to fit into the root
+// partition uncompressed.
+func (p *Pack) writeRootExt4(f io.Writer, root *FileInfo) error {
+	fmt.Printf("\n")
+	fmt.Printf("Creating root file system (ext4)\n")
+	done := measure.Interactively("creating root file system")
+	fragment := ""
+	defer func() {
+		done(fragment)
+	}()
+
+	now := p.now()
+	dir, err := p.ext4File(root, now)
+	if err != nil {
+		return err
+	}
+	size, err := ext4.Write(f, dir, now)
+	if err != nil {
+		return err
+	}
+	fragment = ", " + humanize.Bytes(uint64(size))
+	if max := p.RootSize(); size > max {
+		return fmt.Errorf("ext4 root file system (%d MB) does not fit into the root partition (%d MB): increase its size with --root_size, or use the default SquashFS root file system, which is compressed", size/MB, max/MB)
+	}
+	return nil
 }
 
 func (p *Pack) writeRootDeviceFiles(f io.WriteSeeker, rootDeviceFiles []deviceconfig.RootFile) error {
@@ -568,16 +739,21 @@ func (p *Pack) writeRootDeviceFiles(f io.WriteSeeker, rootDeviceFiles []deviceco
 	return nil
 }
 
-func writeMBR(f io.ReadSeeker, fw io.WriteSeeker, partuuid uint32) error {
-	rd, err := fat.NewReader(f)
+// writeMBR writes the boot code of the MBR, which loads the kernel from the
+// boot file system f, to fw. bootOffset is the offset of the boot partition on
+// the disk. Only the boot code and the disk signature are written, so the
+// partition entries of the (hybrid, protective or MBR-only) partition table
+// are left untouched.
+func writeMBR(f io.ReadSeeker, fw io.WriteSeeker, bootOffset int64, partuuid uint32) error {
+	rd, err := newFATReader(seekReaderAt{f})
 	if err != nil {
 		return err
 	}
-	vmlinuzOffset, _, err := rd.Extents("/vmlinuz")
+	vmlinuzOffset, _, err := rd.extents("/vmlinuz")
 	if err != nil {
 		return err
 	}
-	cmdlineOffset, _, err := rd.Extents("/cmdline.txt")
+	cmdlineOffset, _, err := rd.extents("/cmdline.txt")
 	if err != nil {
 		return err
 	}
@@ -585,8 +761,9 @@ func writeMBR(f io.ReadSeeker, fw io.WriteSeeker, partuuid uint32) error {
 	if _, err := fw.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	vmlinuzLba := uint32((vmlinuzOffset / 512) + 8192)
-	cmdlineTxtLba := uint32((cmdlineOffset / 512) + 8192)
+	bootLBA := bootOffset / 512
+	vmlinuzLba := uint32((vmlinuzOffset / 512) + bootLBA)
+	cmdlineTxtLba := uint32((cmdlineOffset / 512) + bootLBA)
 
 	fmt.Printf("MBR summary:\n")
 	fmt.Printf("  LBAs: vmlinuz=%d cmdline.txt=%d\n", vmlinuzLba, cmdlineTxtLba)
@@ -601,7 +778,7 @@ func writeMBR(f io.ReadSeeker, fw io.WriteSeeker, partuuid uint32) error {
 
 // getDuplication between the two given filesystems
 func getDuplication(fiA, fiB *FileInfo) (paths []string) {
-	allPaths := append(fiA.pathList(), fiB.pathList()...)
+	allPaths := append(fiA.Paths(), fiB.Paths()...)
 	checkMap := make(map[string]bool, len(allPaths))
 	for _, p := range allPaths {
 		if _, ok := checkMap[p]; ok {
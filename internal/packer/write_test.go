@@ -0,0 +1,47 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExt4File(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "ping")
+	if err := os.WriteFile(bin, []byte("ELF"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(bin, 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	root := &FileInfo{
+		Dirents: []*FileInfo{
+			{Filename: "user", Dirents: []*FileInfo{
+				{Filename: "ping", FromHost: bin},
+			}},
+			{Filename: "hostname", FromLiteral: "gokrazy"},
+			{Filename: "localtime", SymlinkDest: "/tmp/localtime"},
+		},
+	}
+	dir, err := (&Pack{}).ext4File(root, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dir.Dir || len(dir.Entries) != 3 {
+		t.Fatalf("root = %+v, want a directory with 3 entries", dir)
+	}
+	ping := dir.Entries[0].Entries[0]
+	if got, want := ping.Mode, 0755|os.ModeSetuid; got != want {
+		t.Errorf("ping mode = %v, want %v", got, want)
+	}
+	if got, want := ping.Size, int64(3); got != want {
+		t.Errorf("ping size = %d, want %d", got, want)
+	}
+	if got, want := dir.Entries[1].Mode, os.FileMode(0444); got != want {
+		t.Errorf("hostname mode = %v, want %v", got, want)
+	}
+	if got, want := dir.Entries[2].Target, "/tmp/localtime"; got != want {
+		t.Errorf("localtime target = %q, want %q", got, want)
+	}
+}
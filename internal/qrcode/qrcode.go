@@ -0,0 +1,443 @@
+// Package qrcode encodes short texts (e.g. the URL of a gokrazy web interface)
+// as QR codes (ISO/IEC 18004) and renders them in a terminal.
+//
+// Only what the packer needs is implemented: byte mode, error correction
+// level M and versions 1 to 10, i.e. up to 213 bytes.
+package qrcode
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// version describes the error correction of a QR code version at level M.
+type version struct {
+	ecPerBlock int
+	// blocks holds the number of data codewords of each block.
+	blocks []int
+	// align holds the centers of the alignment patterns.
+	align []int
+}
+
+func repeat(n, dataCodewords int) []int {
+	blocks := make([]int, n)
+	for i := range blocks {
+		blocks[i] = dataCodewords
+	}
+	return blocks
+}
+
+// versions are the supported versions, starting at version 1.
+var versions = []version{
+	{10, repeat(1, 16), nil},
+	{16, repeat(1, 28), []int{6, 18}},
+	{26, repeat(1, 44), []int{6, 22}},
+	{18, repeat(2, 32), []int{6, 26}},
+	{24, repeat(2, 43), []int{6, 30}},
+	{16, repeat(4, 27), []int{6, 34}},
+	{18, repeat(4, 31), []int{6, 22, 38}},
+	{22, append(repeat(2, 38), repeat(2, 39)...), []int{6, 24, 42}},
+	{22, append(repeat(3, 36), repeat(2, 37)...), []int{6, 26, 46}},
+	{26, append(repeat(4, 43), repeat(1, 44)...), []int{6, 28, 50}},
+}
+
+func (v version) dataCodewords() int {
+	var n int
+	for _, b := range v.blocks {
+		n += b
+	}
+	return n
+}
+
+// Code is an encoded QR code.
+type Code struct {
+	// Size is the width and height in modules (without quiet zone).
+	Size int
+
+	version  int
+	modules  [][]bool // [y][x], true is dark
+	function [][]bool // finder, timing, alignment, format and version
+}
+
+// Dark reports whether the module at column x and row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false // quiet zone
+	}
+	return c.modules[y][x]
+}
+
+// Encode encodes text in byte mode using the smallest version which fits.
+func Encode(text string) (*Code, error) {
+	for i, v := range versions {
+		countBits := 8
+		if i+1 >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) > 8*v.dataCodewords() {
+			continue
+		}
+		var bb bitBuffer
+		bb.append(0x4, 4) // byte mode
+		bb.append(len(text), countBits)
+		for j := 0; j < len(text); j++ {
+			bb.append(int(text[j]), 8)
+		}
+		return newCode(i+1, v, bb), nil
+	}
+	return nil, fmt.Errorf("text too long for a QR code: %d bytes, at most %d", len(text), versions[len(versions)-1].dataCodewords()-3)
+}
+
+type bitBuffer []bool
+
+func (bb *bitBuffer) append(val, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		*bb = append(*bb, (val>>i)&1 != 0)
+	}
+}
+
+// codewords returns the data codewords of bb: terminated, padded to whole
+// bytes and filled up with the alternating pad codewords.
+func (bb bitBuffer) codewords(capacity int) []byte {
+	for i := 0; i < 4 && len(bb) < capacity*8; i++ {
+		bb = append(bb, false)
+	}
+	for len(bb)%8 != 0 {
+		bb = append(bb, false)
+	}
+	data := make([]byte, 0, capacity)
+	for i := 0; i < len(bb); i += 8 {
+		var b byte
+		for _, bit := range bb[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+	return data
+}
+
+// interleave splits data into the blocks of v, computes their error
+// correction codewords and interleaves all codewords.
+func interleave(v version, data []byte) []byte {
+	var blocks, ecBlocks [][]byte
+	divisor := rsDivisor(v.ecPerBlock)
+	for _, n := range v.blocks {
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+	var result []byte
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				result = append(result, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, b := range ecBlocks {
+			result = append(result, b[i])
+		}
+	}
+	return result
+}
+
+func newCode(ver int, v version, bb bitBuffer) *Code {
+	size := 17 + 4*ver
+	c := &Code{
+		Size:     size,
+		version:  ver,
+		modules:  make([][]bool, size),
+		function: make([][]bool, size),
+	}
+	for y := range c.modules {
+		c.modules[y] = make([]bool, size)
+		c.function[y] = make([]bool, size)
+	}
+	c.drawFunctionPatterns(v)
+	c.drawCodewords(interleave(v, bb.codewords(v.dataCodewords())))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // undo
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c *Code) drawFunctionPatterns(v version) {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	// Finder patterns, including their separators.
+	for _, center := range [][2]int{{3, 3}, {c.Size - 4, 3}, {3, c.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				c.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+	last := len(v.align) - 1
+	for i, cy := range v.align {
+		for j, cx := range v.align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // overlaps a finder pattern
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	c.drawFormat(0) // reserves the area, drawn again after masking
+	if c.version >= 7 {
+		bits := versionBits(c.version)
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := c.Size-11+i%3, i/3
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+}
+
+// versionBits returns the 18 bit version information of version 7 and up.
+func versionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+// formatBits returns the 15 bit format information for error correction
+// level M and mask.
+func formatBits(mask int) int {
+	const levelM = 0
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	c.set(8, c.Size-8, true) // the dark module
+}
+
+// drawCodewords places data in the zigzag pattern, from the bottom right
+// corner in two-module wide columns, skipping the function patterns.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			y := vert
+			if upward {
+				y = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] || i >= len(data)*8 {
+					continue // remainder bits stay light
+				}
+				c.modules[y][x] = (data[i/8]>>(7-i%8))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask inverts the data modules selected by mask. Applying a mask twice
+// undoes it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.function[y][x] && masked(mask, x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read (lower is better), following
+// the rules of the specification.
+func (c *Code) penalty() int {
+	var penalty int
+	line := func(get func(i int) bool) {
+		// Runs of five or more modules of the same color.
+		run := 1
+		for i := 1; i < c.Size; i++ {
+			if get(i) == get(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+			run = 1
+		}
+		if run >= 5 {
+			penalty += run - 2
+		}
+		// Patterns looking like finder patterns: 1:1:3:1:1 with four light
+		// modules before or after.
+		finder := []bool{true, false, true, true, true, false, true}
+		for i := 0; i+7 <= c.Size; i++ {
+			match := true
+			for j, dark := range finder {
+				if get(i+j) != dark {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			light := func(from, to int) bool {
+				for k := from; k < to; k++ {
+					if k >= 0 && k < c.Size && get(k) {
+						return false
+					}
+				}
+				return true
+			}
+			if light(i-4, i) || light(i+7, i+11) {
+				penalty += 40
+			}
+		}
+	}
+	for y := 0; y < c.Size; y++ {
+		line(func(x int) bool { return c.modules[y][x] })
+	}
+	for x := 0; x < c.Size; x++ {
+		line(func(y int) bool { return c.modules[y][x] })
+	}
+	// 2x2 blocks of the same color.
+	var dark int
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size {
+				m := c.modules[y][x]
+				if c.modules[y][x+1] == m && c.modules[y+1][x] == m && c.modules[y+1][x+1] == m {
+					penalty += 3
+				}
+			}
+		}
+	}
+	// Deviation of the proportion of dark modules from 50%.
+	total := c.Size * c.Size
+	penalty += abs(dark*20-total*10) / total * 10
+	return penalty
+}
+
+// WriteTerminal renders the code with a quiet zone using Unicode half blocks
+// (two modules per character), with dark modules on a light background
+// regardless of the terminal colors.
+func (c *Code) WriteTerminal(w io.Writer) error {
+	const quiet = 2
+	var sb strings.Builder
+	for y := -quiet; y < c.Size+quiet; y += 2 {
+		sb.WriteString("\x1b[30;107m") // black on bright white
+		for x := -quiet; x < c.Size+quiet; x++ {
+			top, bottom := c.Dark(x, y), c.Dark(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,308 @@
+// Package manifest describes the contents of a gokrazy root file system as a
+// tree of entries, which the packer writes into the root file system image.
+//
+// Root manifests can be written to and read from JSON, compared with Diff,
+// and constructed programmatically, e.g. by tools which generate files for
+// the root file system:
+//
+//	m := manifest.New()
+//	dir := m.Root.MkdirAll("etc/myapp")
+//	dir.Dirents = append(dir.Dirents, &manifest.Entry{
+//		Filename:    "config.json",
+//		FromLiteral: `{"debug": false}`,
+//	})
+//	if err := m.Write(f); err != nil { // for gok overwrite --root_manifest
+//		return err
+//	}
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Entry is a file, symlink or directory in the root file system. Exactly one
+// of FromHost, FromLiteral and SymlinkDest is set for files and symlinks;
+// entries without them are directories.
+type Entry struct {
+	Filename string
+
+	// Mode is the permission of files (default 0444 for FromLiteral, the
+	// host file permission for FromHost).
+	Mode os.FileMode `json:",omitempty"`
+
+	// FromHost is the path of a file on the host which is copied into the
+	// root file system.
+	FromHost string `json:",omitempty"`
+
+	// FromLiteral is the content of the file.
+	FromLiteral string `json:",omitempty"`
+
+	// SymlinkDest is the target of a symlink.
+	SymlinkDest string `json:",omitempty"`
+
+	Dirents []*Entry `json:",omitempty"`
+
+	// Template marks files which the packer renders as Go templates (extra
+	// files ending in .gotmpl).
+	Template bool `json:",omitempty"`
+}
+
+// IsFile returns whether the entry is a regular file.
+func (e *Entry) IsFile() bool {
+	return e.FromHost != "" || e.FromLiteral != ""
+}
+
+// Paths returns the paths of all files below the directory e, relative to
+// e.
+func (e *Entry) Paths() (paths []string) {
+	for _, ent := range e.Dirents {
+		if ent.IsFile() {
+			paths = append(paths, ent.Filename)
+			continue
+		}
+
+		for _, p := range ent.Paths() {
+			paths = append(paths, path.Join(ent.Filename, p))
+		}
+	}
+	return paths
+}
+
+// Combine adds the entries of the directory e2 to the directory e, merging
+// subdirectories. Files which exist in both are an error.
+func (e *Entry) Combine(e2 *Entry) error {
+	for _, ent2 := range e2.Dirents {
+		// get existing file info
+		var f *Entry
+		for _, ent := range e.Dirents {
+			if ent.Filename == ent2.Filename {
+				f = ent
+				break
+			}
+		}
+
+		// if not found add complete subtree directly
+		if f == nil {
+			e.Dirents = append(e.Dirents, ent2)
+			continue
+		}
+
+		// file overwrite is not supported -> return error
+		if f.IsFile() || ent2.IsFile() {
+			return fmt.Errorf("file already exist: %s", ent2.Filename)
+		}
+
+		if err := f.Combine(ent2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find returns the entry at the path p (relative to the directory e), or
+// nil.
+func (e *Entry) Find(p string) *Entry {
+	cur := e
+	for _, component := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		var next *Entry
+		for _, ent := range cur.Dirents {
+			if ent.Filename == component {
+				next = ent
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+// MkdirAll returns the directory at the path p (relative to the directory
+// e), creating it and its parents as needed.
+func (e *Entry) MkdirAll(p string) *Entry {
+	cur := e
+	for _, component := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+		var next *Entry
+		for _, ent := range cur.Dirents {
+			if ent.Filename == component {
+				next = ent
+				break
+			}
+		}
+		if next == nil {
+			next = &Entry{Filename: component}
+			cur.Dirents = append(cur.Dirents, next)
+		}
+		cur = next
+	}
+	return cur
+}
+
+// Remove removes the entry at the path p (relative to the directory e),
+// returning whether it was found.
+func (e *Entry) Remove(p string) bool {
+	dir := e
+	if parent := path.Dir(p); parent != "." {
+		dir = e.Find(parent)
+		if dir == nil {
+			return false
+		}
+	}
+	for i, ent := range dir.Dirents {
+		if ent.Filename == path.Base(p) {
+			dir.Dirents = append(dir.Dirents[:i], dir.Dirents[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RootManifest describes the contents of a root file system.
+type RootManifest struct {
+	// Root is the root directory, with an empty Filename.
+	Root *Entry
+}
+
+// New returns an empty root manifest.
+func New() *RootManifest {
+	return &RootManifest{Root: &Entry{}}
+}
+
+// Read reads a root manifest in JSON format from r.
+func Read(r io.Reader) (*RootManifest, error) {
+	var m RootManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.Root == nil {
+		return nil, fmt.Errorf("root manifest has no Root")
+	}
+	if m.Root.Filename != "" || m.Root.IsFile() || m.Root.SymlinkDest != "" {
+		return nil, fmt.Errorf("root manifest: Root must be a directory without Filename")
+	}
+	return &m, nil
+}
+
+// ReadFile reads the root manifest in JSON format from the file path.
+func ReadFile(path string) (*RootManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Write writes the root manifest in (indented) JSON format to w, with the
+// directory entries sorted by name.
+func (m *RootManifest) Write(w io.Writer) error {
+	sortEntries(m.Root)
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+func sortEntries(e *Entry) {
+	sort.Slice(e.Dirents, func(i, j int) bool {
+		return e.Dirents[i].Filename < e.Dirents[j].Filename
+	})
+	for _, ent := range e.Dirents {
+		sortEntries(ent)
+	}
+}
+
+// Walk calls fn for each entry below the root directory (in depth-first
+// order, with the directory entries in their manifest order), with its
+// absolute path.
+func (m *RootManifest) Walk(fn func(path string, e *Entry) error) error {
+	return walk("/", m.Root, fn)
+}
+
+func walk(dir string, e *Entry, fn func(path string, e *Entry) error) error {
+	for _, ent := range e.Dirents {
+		p := path.Join(dir, ent.Filename)
+		if err := fn(p, ent); err != nil {
+			return err
+		}
+		if err := walk(p, ent, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Change is a difference between two root manifests, see Diff.
+type Change struct {
+	// Path is the absolute path of the entry.
+	Path string
+
+	// Old is the entry in the old manifest (nil if it was added), New the
+	// entry in the new manifest (nil if it was removed).
+	Old, New *Entry
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return "added " + c.Path
+	case c.New == nil:
+		return "removed " + c.Path
+	default:
+		return "modified " + c.Path
+	}
+}
+
+// Diff returns the entries which were added, removed or modified (in their
+// type, mode or contents, i.e. source) from the manifest from to to, sorted
+// by path. Directories are only reported if they were added or removed, and
+// the entries below them are reported as well.
+func Diff(from, to *RootManifest) []Change {
+	oldEntries := make(map[string]*Entry)
+	from.Walk(func(p string, e *Entry) error {
+		oldEntries[p] = e
+		return nil
+	})
+	var changes []Change
+	to.Walk(func(p string, e *Entry) error {
+		o, ok := oldEntries[p]
+		delete(oldEntries, p)
+		switch {
+		case !ok:
+			changes = append(changes, Change{Path: p, New: e})
+		case !sameEntry(o, e):
+			changes = append(changes, Change{Path: p, Old: o, New: e})
+		}
+		return nil
+	})
+	for p, e := range oldEntries {
+		changes = append(changes, Change{Path: p, Old: e})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func sameEntry(a, b *Entry) bool {
+	return a.Mode == b.Mode &&
+		a.FromHost == b.FromHost &&
+		a.FromLiteral == b.FromLiteral &&
+		a.SymlinkDest == b.SymlinkDest &&
+		a.Template == b.Template
+}
@@ -0,0 +1,110 @@
+package manifest_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gokrazy/tools/manifest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testManifest() *manifest.RootManifest {
+	m := manifest.New()
+	user := m.Root.MkdirAll("user")
+	user.Dirents = append(user.Dirents, &manifest.Entry{Filename: "scanner", FromHost: "/tmp/bin/scanner"})
+	etc := m.Root.MkdirAll("etc/scanner")
+	etc.Dirents = append(etc.Dirents,
+		&manifest.Entry{Filename: "config.json", FromLiteral: "{}", Mode: 0600},
+		&manifest.Entry{Filename: "current", SymlinkDest: "config.json"})
+	return m
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := testManifest()
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := manifest.Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(m, got); diff != "" {
+		t.Errorf("Read(Write(m)): unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		json string
+		want string
+	}{
+		{`{}`, "no Root"},
+		{`{"Root": {"Filename": "x"}}`, "Root must be a directory"},
+		{`{"Root": {"FromLiteral": "x"}}`, "Root must be a directory"},
+	} {
+		_, err := manifest.Read(strings.NewReader(tt.json))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Read(%s) = %v, want error containing %q", tt.json, err, tt.want)
+		}
+	}
+}
+
+func TestEntry(t *testing.T) {
+	m := testManifest()
+	if got := m.Root.Find("/etc/scanner/config.json"); got == nil || got.FromLiteral != "{}" {
+		t.Errorf("Find(/etc/scanner/config.json) = %+v, want the config file", got)
+	}
+	if got := m.Root.Find("etc/missing"); got != nil {
+		t.Errorf("Find(etc/missing) = %+v, want nil", got)
+	}
+	if got, want := m.Root.Paths(), []string{"user/scanner", "etc/scanner/config.json"}; !cmp.Equal(got, want) {
+		t.Errorf("Paths() = %q, want %q", got, want)
+	}
+	if !m.Root.Remove("etc/scanner/current") {
+		t.Errorf("Remove(etc/scanner/current) = false, want true")
+	}
+	if m.Root.Remove("etc/scanner/current") {
+		t.Errorf("second Remove(etc/scanner/current) = true, want false")
+	}
+
+	other := manifest.New()
+	other.Root.MkdirAll("etc/scanner").Dirents = []*manifest.Entry{{Filename: "config.json", FromLiteral: "[]"}}
+	if err := m.Root.Combine(other.Root); err == nil {
+		t.Errorf("Combine with a conflicting file succeeded unexpectedly")
+	}
+	other.Root.Find("etc/scanner").Dirents[0].Filename = "extra.json"
+	if err := m.Root.Combine(other.Root); err != nil {
+		t.Fatal(err)
+	}
+	if m.Root.Find("etc/scanner/extra.json") == nil {
+		t.Errorf("Combine did not add etc/scanner/extra.json")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := testManifest()
+	updated := testManifest()
+	updated.Root.Find("etc/scanner/config.json").Mode = 0644
+	updated.Root.Remove("etc/scanner/current")
+	lib := updated.Root.MkdirAll("lib")
+	lib.Dirents = append(lib.Dirents, &manifest.Entry{Filename: "libc.so", FromHost: "/tmp/libc.so"})
+
+	var got []string
+	for _, c := range manifest.Diff(old, updated) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"modified /etc/scanner/config.json",
+		"removed /etc/scanner/current",
+		"added /lib",
+		"added /lib/libc.so",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Diff: unexpected changes (-want +got):\n%s", diff)
+	}
+	if changes := manifest.Diff(old, testManifest()); len(changes) != 0 {
+		t.Errorf("Diff of identical manifests = %v, want none", changes)
+	}
+}
@@ -36,10 +36,32 @@ func TargetArch() string {
 }
 
 var (
-	envOnce sync.Once
-	env     []string
+	envMu  sync.Mutex
+	env    []string
+	envKey string // GOOS/GOARCH/GOARM which env was computed for
 )
 
+// IsolatedGOPATH is the name of the directory which, if present in the
+// instance directory (next to builddir), is used as GOPATH and module cache of
+// all go tool invocations. This keeps the modules of different instances (say,
+// work and hobby projects) apart, and allows pruning the module cache of a
+// single instance.
+const IsolatedGOPATH = "gopath"
+
+// IsolatedGOPATHDir returns the absolute path of the IsolatedGOPATH directory
+// in the current working directory, or the empty string if there is none.
+func IsolatedGOPATHDir() string {
+	st, err := os.Stat(IsolatedGOPATH)
+	if err != nil || !st.IsDir() {
+		return ""
+	}
+	abs, err := filepath.Abs(IsolatedGOPATH)
+	if err != nil {
+		return ""
+	}
+	return abs
+}
+
 func goEnv() []string {
 	goarch := TargetArch()
 
@@ -48,19 +70,31 @@ func goEnv() []string {
 		goos = e
 	}
 
+	gopath := IsolatedGOPATHDir()
+
 	cgoEnabledFound := false
-	env := os.Environ()
-	for idx, e := range env {
+	var env []string
+	for _, e := range os.Environ() {
 		if strings.HasPrefix(e, "CGO_ENABLED=") {
 			cgoEnabledFound = true
 		}
 		if strings.HasPrefix(e, "GOBIN=") {
-			env[idx] = "GOBIN="
+			e = "GOBIN="
+		}
+		if gopath != "" &&
+			(strings.HasPrefix(e, "GOPATH=") || strings.HasPrefix(e, "GOMODCACHE=")) {
+			continue
 		}
+		env = append(env, e)
 	}
 	if !cgoEnabledFound {
 		env = append(env, "CGO_ENABLED=0")
 	}
+	if gopath != "" {
+		env = append(env,
+			"GOPATH="+gopath,
+			"GOMODCACHE="+filepath.Join(gopath, "pkg", "mod"))
+	}
 	return append(env,
 		fmt.Sprintf("GOARCH=%s", goarch),
 		fmt.Sprintf("GOOS=%s", goos),
@@ -68,9 +102,15 @@ func goEnv() []string {
 }
 
 func Env() []string {
-	envOnce.Do(func() {
+	envMu.Lock()
+	defer envMu.Unlock()
+	// Recompute the environment when the target changes, e.g. between the
+	// images of a multi-model build.
+	key := os.Getenv("GOOS") + "/" + os.Getenv("GOARCH") + "/" + os.Getenv("GOARM")
+	if env == nil || key != envKey {
 		env = goEnv()
-	})
+		envKey = key
+	}
 	return env
 }
 
@@ -198,6 +238,11 @@ func getIncomplete(buildDir string, incomplete []string) error {
 		}, incomplete...)...)
 	cmd.Dir = buildDir
 	cmd.Env = Env()
+	if workspace != "" {
+		// Record the requirements in the build directory go.mod, not in the
+		// modules of the workspace.
+		cmd.Env = append(append([]string{}, cmd.Env...), "GOWORK=off")
+	}
 	cmd.Stderr = os.Stderr
 	if logExec {
 		log.Printf("getIncomplete: %v (in %s)", cmd.Args, buildDir)
@@ -210,16 +255,13 @@ func getIncomplete(buildDir string, incomplete []string) error {
 
 func getPkg(buildDir string, pkg string) error {
 	// run “go get” for incomplete packages (most likely just not present)
-	cmd := exec.Command("go",
-		append([]string{
-			"list",
-			"-mod=mod",
-			"-e",
-			"-f", "{{ .ImportPath }} {{ if .Incomplete }}error{{ else }}ok{{ end }}",
-		}, pkg)...)
-	cmd.Env = Env()
-	cmd.Dir = buildDir
-	cmd.Stderr = os.Stderr
+	cmd, err := GoCommand(buildDir, "list",
+		"-e",
+		"-f", "{{ .ImportPath }} {{ if .Incomplete }}error{{ else }}ok{{ end }}",
+		pkg)
+	if err != nil {
+		return err
+	}
 	if logExec {
 		log.Printf("getPkg: %v (in %s)", cmd.Args, buildDir)
 	}
@@ -296,8 +338,6 @@ func (be *BuildEnv) Build(bindir string, packages []string, packageBuildFlags, p
 			pkg := pkg // copy
 			eg.Go(func() error {
 				args := []string{
-					"build",
-					"-mod=mod",
 					"-o", filepath.Join(bindir, filepath.Base(pkg.Target)),
 				}
 				tags := append(DefaultTags(), packageBuildTags[pkg.ImportPath]...)
@@ -306,10 +346,10 @@ func (be *BuildEnv) Build(bindir string, packages []string, packageBuildFlags, p
 					args = append(args, buildFlags...)
 				}
 				args = append(args, pkg.ImportPath)
-				cmd := exec.Command("go", args...)
-				cmd.Env = Env()
-				cmd.Dir = buildDir
-				cmd.Stderr = os.Stderr
+				cmd, err := GoCommand(buildDir, "build", args...)
+				if err != nil {
+					return err
+				}
 				if logExec {
 					log.Printf("Build: %v (in %s)", cmd.Args, buildDir)
 				}
@@ -339,10 +379,14 @@ func (be *BuildEnv) mainPackage(pkg string) ([]Pkg, error) {
 		return nil, fmt.Errorf("BuildDir(%s): %v", pkg, err)
 	}
 
+	env, err := buildDirEnv(buildDir)
+	if err != nil {
+		return nil, err
+	}
 	var buf bytes.Buffer
 	cmd := exec.Command("go", append([]string{"list", "-tags", "gokrazy", "-json"}, pkg)...)
 	cmd.Dir = buildDir
-	cmd.Env = Env()
+	cmd.Env = env
 	cmd.Stdout = &buf
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -400,10 +444,10 @@ func PackageDir(pkg string) (string, error) {
 		return "", fmt.Errorf("PackageDirs(%s): %v", pkg, err)
 	}
 
-	cmd := exec.Command("go", "list", "-mod=mod", "-tags", "gokrazy", "-f", "{{ .Dir }}", pkg)
-	cmd.Env = Env()
-	cmd.Dir = buildDir
-	cmd.Stderr = os.Stderr
+	cmd, err := GoCommand(buildDir, "list", "-tags", "gokrazy", "-f", "{{ .Dir }}", pkg)
+	if err != nil {
+		return "", err
+	}
 	if logExec {
 		log.Printf("PackageDir: %v (in %s)", cmd.Args, buildDir)
 	}
@@ -0,0 +1,323 @@
+package packer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Layout describes the partitions of a gokrazy disk. The zero value describes
+// the default layout: a 100 MB boot partition (1), two 500 MB root partitions
+// (2 and 3, see SingleSlot) and a perm partition (4) spanning the rest of the
+// disk.
+type Layout struct {
+	// BootSize is the size of the boot partition in bytes, and RootSize the
+	// size of each of the two root partitions. Both are rounded up to whole
+	// MB; zero selects the default size. As updates replace the contents of
+	// the existing partitions, the sizes only take effect when creating the
+	// partition table.
+	BootSize uint64 `json:",omitempty"`
+	RootSize uint64 `json:",omitempty"`
+
+	// BootFileSystem is the file system of the boot partition: fat16 (the
+	// default, for at most 128 MB of boot files) or fat32, e.g. for custom
+	// kernels with many device tree overlays. The FAT32 file system spans
+	// the whole boot partition (at least 33 MB), so when updating, BootSize
+	// must match the boot partition of the installation.
+	BootFileSystem string `json:",omitempty"`
+
+	// SingleSlot omits the second root partition, e.g. for read-only kiosks
+	// on small SD cards. Without it, the device cannot be updated over the
+	// network (updates write into the inactive root partition), only by
+	// writing a new image. Partition 3 is left unused, so that the perm
+	// partition remains partition 4.
+	SingleSlot bool `json:",omitempty"`
+
+	// Extra partitions are placed at the end of the disk, after the perm
+	// partition, and are numbered starting at 5. Extra partitions require a
+	// GPT partition table.
+	Extra []ExtraPartition `json:",omitempty"`
+
+	// Expose is the partition which is additionally entered into the hybrid
+	// MBR with a Windows partition type, so that Windows and macOS mount it
+	// automatically when the SD card is plugged in: either "perm" (which then
+	// uses the exFAT partition type) or the name of a fat, exfat or ntfs extra
+	// partition.
+	Expose string `json:",omitempty"`
+}
+
+// Validate returns an error if the layout cannot be created.
+func (l *Layout) Validate() error {
+	if l.BootSize != 0 && l.BootSize < minBootSize {
+		return fmt.Errorf("boot partition size %d MB too small (at least %d MB)", l.BootSize/MB, minBootSize/MB)
+	}
+	if l.RootSize != 0 && l.RootSize < minRootSize {
+		return fmt.Errorf("root partition size %d MB too small (at least %d MB)", l.RootSize/MB, minRootSize/MB)
+	}
+	switch l.BootFileSystem {
+	case "", "fat16":
+	case "fat32":
+		if size := l.bootSectors() * 512; size < minFAT32BootSize {
+			return fmt.Errorf("boot partition size %d MB too small for fat32 (at least %d MB)", size/MB, minFAT32BootSize/MB)
+		}
+	default:
+		return fmt.Errorf("unknown boot file system %q: expected fat16 or fat32", l.BootFileSystem)
+	}
+	names := make(map[string]bool)
+	for _, e := range l.Extra {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		if names[e.Name] {
+			return fmt.Errorf("extra partition %q: specified more than once", e.Name)
+		}
+		names[e.Name] = true
+	}
+	if l.Expose == "" || l.Expose == "perm" {
+		return nil
+	}
+	for _, e := range l.Extra {
+		if e.Name != l.Expose {
+			continue
+		}
+		if e.partitionType().gpt != partitionTypeMicrosoftBasicData {
+			return fmt.Errorf("cannot expose extra partition %q: type %q is not readable by Windows/macOS, use fat, exfat or ntfs", e.Name, e.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot expose partition %q: no such extra partition (use perm or the name of an extra partition)", l.Expose)
+}
+
+// ExtraPartition is an additional partition, e.g. a FAT data partition which
+// Windows can read, or a raw partition for a database.
+type ExtraPartition struct {
+	// Name is the GPT partition name (at most 36 characters).
+	Name string
+
+	// Size is the size of the partition in bytes. It is rounded up to whole
+	// MB.
+	Size uint64
+
+	// Type is fat, exfat, ntfs, linux or raw, or a GPT
+	// partition type GUID.
+	Type string
+
+	// Source is the path to an image file on the host whose contents are
+	// written to the partition, e.g. a pre-formatted file system. If empty,
+	// the partition contents are left untouched.
+	Source string `json:",omitempty"`
+}
+
+type partitionType struct {
+	mbr byte
+	gpt string
+}
+
+const (
+	partitionTypeEFISystemPartition        = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	partitionTypeLinuxFilesystemData       = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	partitionTypeLinuxRootPartitionAMD64   = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+	partitionTypeLinuxRootPartitionARM64   = "B921B045-1DF0-41C3-AF44-4C6F280D3FAE"
+	partitionTypeLinuxRootPartitionRISCV64 = "72EC70A6-CF74-40E6-BD49-4BDA08E8F224"
+	partitionTypeMicrosoftBasicData        = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+)
+
+// partitionTypes maps the partition type names which can be used for extra
+// partitions to their MBR partition type and GPT partition type GUID.
+var partitionTypes = map[string]partitionType{
+	"fat":   {mbr: FAT, gpt: partitionTypeMicrosoftBasicData},
+	"exfat": {mbr: 0x07, gpt: partitionTypeMicrosoftBasicData},
+	"ntfs":  {mbr: 0x07, gpt: partitionTypeMicrosoftBasicData},
+	"linux": {mbr: Linux, gpt: partitionTypeLinuxFilesystemData},
+	"raw":   {mbr: 0xda, gpt: partitionTypeLinuxFilesystemData}, // non-FS data
+}
+
+func isGUID(s string) bool {
+	var a uint32
+	var b, c uint16
+	var d, e uint8
+	var node []byte
+	_, err := fmt.Sscanf(s, "%08x-%04x-%04x-%02x%02x-%012x", &a, &b, &c, &d, &e, &node)
+	return err == nil && len(s) == 36
+}
+
+// Validate returns an error if the extra partition cannot be created.
+func (e ExtraPartition) Validate() error {
+	if e.Name == "" {
+		return fmt.Errorf("extra partition: name must not be empty")
+	}
+	if n := len([]rune(e.Name)); n > 36 {
+		return fmt.Errorf("extra partition %q: name too long (%d characters, at most 36)", e.Name, n)
+	}
+	if e.Size == 0 {
+		return fmt.Errorf("extra partition %q: size must not be 0", e.Name)
+	}
+	if _, ok := partitionTypes[strings.ToLower(e.Type)]; !ok && !isGUID(e.Type) {
+		return fmt.Errorf("extra partition %q: unknown type %q (known types: fat, exfat, ntfs, linux, raw, or a GPT partition type GUID)", e.Name, e.Type)
+	}
+	return nil
+}
+
+func (e ExtraPartition) partitionType() partitionType {
+	if pt, ok := partitionTypes[strings.ToLower(e.Type)]; ok {
+		return pt
+	}
+	return partitionType{mbr: 0xda, gpt: e.Type}
+}
+
+func (e ExtraPartition) sectors() uint64 {
+	return ((e.Size + MB - 1) / MB) * (MB / 512)
+}
+
+// permType returns the partition type of the perm partition.
+func (p *Pack) permType() partitionType {
+	if p.Layout.Expose == "perm" {
+		return partitionTypes["exfat"]
+	}
+	return partitionTypes["linux"]
+}
+
+// exposedPartition returns the first LBA, the number of sectors and the MBR
+// partition type of the partition which should be entered into the hybrid
+// MBR, if any.
+func (p *Pack) exposedPartition(devsize uint64) (first, sectors uint64, mbrType byte, ok bool) {
+	if p.Layout.Expose == "perm" {
+		return uint64(p.PermOffset() / 512), uint64(p.permSize(devsize)), p.permType().mbr, true
+	}
+	for i, first := range p.ExtraPartitionLBAs(devsize) {
+		if e := p.Layout.Extra[i]; e.Name == p.Layout.Expose {
+			return first, e.sectors(), e.partitionType().mbr, true
+		}
+	}
+	return 0, 0, 0, false
+}
+
+const (
+	bootFirstLBA = 8192
+
+	defaultBootSize = 100 * MB
+	defaultRootSize = 500 * MB
+	minBootSize     = 16 * MB
+	minRootSize     = 64 * MB
+
+	// minFAT32BootSize fits the 65525 clusters of the smallest FAT32 file
+	// system.
+	minFAT32BootSize = 33 * MB
+
+	// alignSectors is the alignment of extra partitions (1 MB).
+	alignSectors = MB / 512
+)
+
+// mbSectors returns the number of sectors of size bytes rounded up to whole
+// MB, or of def if size is zero.
+func mbSectors(size, def uint64) uint64 {
+	if size == 0 {
+		size = def
+	}
+	return ((size + MB - 1) / MB) * (MB / 512)
+}
+
+func (l *Layout) bootSectors() uint64 { return mbSectors(l.BootSize, defaultBootSize) }
+func (l *Layout) rootSectors() uint64 { return mbSectors(l.RootSize, defaultRootSize) }
+
+// rootSlots returns the number of root partitions.
+func (l *Layout) rootSlots() int64 {
+	if l.SingleSlot {
+		return 1
+	}
+	return 2
+}
+
+// BootOffset returns the offset of the boot partition in bytes.
+func (p *Pack) BootOffset() int64 {
+	return bootFirstLBA * 512
+}
+
+// BootSize returns the size of the boot partition in bytes.
+func (p *Pack) BootSize() int64 {
+	return int64(p.Layout.bootSectors()) * 512
+}
+
+// RootOffset returns the offset of the first (with Layout.SingleSlot, the only)
+// root partition in bytes.
+func (p *Pack) RootOffset() int64 {
+	return p.BootOffset() + p.BootSize()
+}
+
+// RootSize returns the size of each root partition in bytes.
+func (p *Pack) RootSize() int64 {
+	return int64(p.Layout.rootSectors()) * 512
+}
+
+// PermOffset returns the offset of the perm partition in bytes.
+func (p *Pack) PermOffset() int64 {
+	return p.RootOffset() + p.Layout.rootSlots()*p.RootSize()
+}
+
+// extraSize returns the number of bytes occupied by the extra partitions,
+// including alignment.
+func (p *Pack) extraSize() uint64 {
+	var size uint64
+	for _, e := range p.Layout.Extra {
+		size += (e.sectors() + alignSectors) * 512
+	}
+	return size
+}
+
+// MinDeviceSize returns the size in bytes of the smallest device which fits
+// the layout with a perm partition of about 100 MB.
+func (p *Pack) MinDeviceSize() uint64 {
+	return uint64(p.PermOffset()-p.BootOffset()) + 100*MB + 8192 + p.extraSize()
+}
+
+// lastLBA returns the first LBA which must remain unused for the secondary
+// GPT header (LBA -33 to LBA -1).
+func lastLBA(devsize uint64) uint64 {
+	lastAddressable := (devsize / 512) - 1 // 0-indexed
+	return lastAddressable - 33
+}
+
+// ExtraPartitionLBAs returns the first LBA of each extra partition on a
+// device of devsize bytes.
+func (p *Pack) ExtraPartitionLBAs(devsize uint64) []uint64 {
+	extra := p.Layout.Extra
+	firsts := make([]uint64, len(extra))
+	end := lastLBA(devsize)
+	for i := len(extra) - 1; i >= 0; i-- {
+		first := end - extra[i].sectors()
+		first -= first % alignSectors
+		firsts[i] = first
+		end = first
+	}
+	return firsts
+}
+
+func (p *Pack) permSize(devsize uint64) uint32 {
+	permStart := uint32(p.PermOffset() / 512)
+	permSize := uint32((devsize / 512) - uint64(permStart))
+	end := uint32(lastLBA(devsize))
+	if firsts := p.ExtraPartitionLBAs(devsize); len(firsts) > 0 {
+		end = uint32(firsts[0])
+	}
+	if permStart+permSize >= end {
+		permSize -= (permStart + permSize) - end
+	}
+	return permSize
+}
+
+// PermExtent returns the offset and size in bytes of the perm partition which
+// Partition creates on a device of devsize bytes.
+func (p *Pack) PermExtent(devsize uint64) (offset, size int64) {
+	offset = p.PermOffset()
+	if !p.UseGPT {
+		// The MBR-only partition table has no extra partitions and no
+		// secondary GPT, see writeMBRPartitionTable.
+		return offset, int64(uint32(devsize/512-uint64(offset/512))) * 512
+	}
+	return offset, int64(p.permSize(devsize)) * 512
+}
+
+// PermSizeInKB returns the size of the perm partition on a device of devsize
+// bytes in KB.
+func (p *Pack) PermSizeInKB(devsize uint64) uint32 {
+	return uint32(uint64(p.permSize(devsize)) * 512 / 1024)
+}
@@ -0,0 +1,215 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestExtraPartitionLBAs(t *testing.T) {
+	const devsize = 4 * 1024 * MB
+	p := NewPackForHost("layouttest")
+	p.Layout.Extra = []ExtraPartition{
+		{Name: "data", Size: 512 * MB, Type: "fat"},
+		{Name: "db", Size: 100*MB - 1, Type: "raw"},
+	}
+	firsts := p.ExtraPartitionLBAs(devsize)
+	if got, want := len(firsts), 2; got != want {
+		t.Fatalf("ExtraPartitionLBAs: got %d partitions, want %d", got, want)
+	}
+	permEnd := uint64(p.PermOffset()/512) + uint64(p.permSize(devsize))
+	if permEnd > firsts[0] {
+		t.Errorf("perm partition ends at LBA %d, overlapping extra partition 5 (LBA %d)", permEnd, firsts[0])
+	}
+	if end := firsts[0] + p.Layout.Extra[0].sectors(); end > firsts[1] {
+		t.Errorf("extra partition 5 ends at LBA %d, overlapping extra partition 6 (LBA %d)", end, firsts[1])
+	}
+	if end := firsts[1] + p.Layout.Extra[1].sectors(); end > lastLBA(devsize) {
+		t.Errorf("extra partition 6 ends at LBA %d, overlapping the secondary GPT header (LBA %d)", end, lastLBA(devsize))
+	}
+	for i, first := range firsts {
+		if first%alignSectors != 0 {
+			t.Errorf("extra partition %d starts at unaligned LBA %d", 5+i, first)
+		}
+	}
+}
+
+func TestExtraPartitionValidate(t *testing.T) {
+	for _, e := range []ExtraPartition{
+		{Name: "", Size: MB, Type: "fat"},
+		{Name: "data", Size: 0, Type: "fat"},
+		{Name: "data", Size: MB, Type: "zfs"},
+	} {
+		if err := e.Validate(); err == nil {
+			t.Errorf("%+v.Validate() = nil, want error", e)
+		}
+	}
+	for _, typ := range []string{"fat", "Linux", "0FC63DAF-8483-4772-8E79-3D69D8477DE4"} {
+		e := ExtraPartition{Name: "data", Size: MB, Type: typ}
+		if err := e.Validate(); err != nil {
+			t.Errorf("%+v.Validate() = %v, want nil", e, err)
+		}
+	}
+}
+
+func TestExposePartition(t *testing.T) {
+	const devsize = 4 * 1024 * MB
+	p := NewPackForHost("layouttest")
+	p.Layout.Extra = []ExtraPartition{
+		{Name: "media", Size: 512 * MB, Type: "exfat"},
+	}
+	p.Layout.Expose = "media"
+	var buf bytes.Buffer
+	if err := p.writePartitionTable(&buf, devsize); err != nil {
+		t.Fatal(err)
+	}
+	mbr := buf.Bytes()
+	if got, want := len(mbr), 512; got != want {
+		t.Fatalf("MBR is %d bytes, want %d", got, want)
+	}
+	entry := mbr[446+2*16 : 446+3*16]
+	if got, want := entry[4], byte(0x07); got != want {
+		t.Errorf("partition 3 type = %#x, want %#x", got, want)
+	}
+	first := p.ExtraPartitionLBAs(devsize)[0]
+	if got, want := binary.LittleEndian.Uint32(entry[8:12]), uint32(first); got != want {
+		t.Errorf("partition 3 first LBA = %d, want %d", got, want)
+	}
+
+	p.Layout.Expose = "boot"
+	if err := p.Layout.Validate(); err == nil {
+		t.Errorf("Validate() with Expose=boot = nil, want error")
+	}
+}
+
+func TestProtectiveMBR(t *testing.T) {
+	const devsize = 4 * 1024 * MB
+	p := NewPackForHost("layouttest")
+	p.ProtectiveMBR = true
+	var buf bytes.Buffer
+	if err := p.writePartitionTable(&buf, devsize); err != nil {
+		t.Fatal(err)
+	}
+	mbr := buf.Bytes()
+	if got, want := len(mbr), 512; got != want {
+		t.Fatalf("MBR is %d bytes, want %d", got, want)
+	}
+	entry := mbr[446 : 446+16]
+	if got, want := entry[4], byte(0xEE); got != want {
+		t.Errorf("partition 1 type = %#x, want %#x", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint32(entry[12:16]), uint32(devsize/512-1); got != want {
+		t.Errorf("protective partition sectors = %d, want %d", got, want)
+	}
+	if !bytes.Equal(mbr[446+16:510], make([]byte, 3*16)) {
+		t.Errorf("partitions 2-4 are not empty")
+	}
+
+	p.Layout.Extra = []ExtraPartition{{Name: "media", Size: 512 * MB, Type: "exfat"}}
+	p.Layout.Expose = "media"
+	if err := p.writePartitionTable(&buf, devsize); err == nil {
+		t.Errorf("writePartitionTable with Expose and ProtectiveMBR = nil, want error")
+	}
+}
+
+func TestPartitionSizes(t *testing.T) {
+	const devsize = 4 * 1024 * MB
+	p := NewPackForHost("layouttest")
+	if got, want := p.PermOffset(), int64(8192*512+1100*MB); got != want {
+		t.Errorf("default PermOffset() = %d, want %d", got, want)
+	}
+
+	p.Layout.BootSize = 256 * MB
+	p.Layout.RootSize = 1024*MB - 1 // rounded up to 1 GB
+	if err := p.Layout.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.RootOffset(), int64(8192*512+256*MB); got != want {
+		t.Errorf("RootOffset() = %d, want %d", got, want)
+	}
+	if got, want := p.PermOffset(), int64(8192*512+(256+2048)*MB); got != want {
+		t.Errorf("PermOffset() = %d, want %d", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := p.writeMBRPartitionTable(&buf, devsize); err != nil {
+		t.Fatal(err)
+	}
+	mbr := buf.Bytes()
+	for i, want := range []struct{ first, sectors int64 }{
+		{p.BootOffset() / 512, p.BootSize() / 512},
+		{p.RootOffset() / 512, p.RootSize() / 512},
+		{p.RootOffset()/512 + p.RootSize()/512, p.RootSize() / 512},
+		{p.PermOffset() / 512, devsize/512 - p.PermOffset()/512},
+	} {
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		first := int64(binary.LittleEndian.Uint32(entry[8:12]))
+		sectors := int64(binary.LittleEndian.Uint32(entry[12:16]))
+		if first != want.first || sectors != want.sectors {
+			t.Errorf("partition %d: first LBA %d, %d sectors, want first LBA %d, %d sectors", i+1, first, sectors, want.first, want.sectors)
+		}
+	}
+
+	p.Layout.RootSize = MB
+	if err := p.Layout.Validate(); err == nil {
+		t.Errorf("Validate() with a 1 MB root partition = nil, want error")
+	}
+}
+
+func TestBootFileSystem(t *testing.T) {
+	for _, tt := range []struct {
+		fs        string
+		bootSize  uint64
+		wantError bool
+	}{
+		{fs: ""},
+		{fs: "fat16"},
+		{fs: "fat32"},
+		{fs: "fat32", bootSize: 1024 * MB},
+		{fs: "fat32", bootSize: 32 * MB, wantError: true},
+		{fs: "exfat", wantError: true},
+	} {
+		l := Layout{BootFileSystem: tt.fs, BootSize: tt.bootSize}
+		err := l.Validate()
+		if gotError := err != nil; gotError != tt.wantError {
+			t.Errorf("Validate(%q, %d MB) = %v, want error: %v", tt.fs, tt.bootSize/MB, err, tt.wantError)
+		}
+	}
+}
+
+func TestSingleSlot(t *testing.T) {
+	const devsize = 4 * 1024 * MB
+	p := NewPackForHost("layouttest")
+	defaultMin := p.MinDeviceSize()
+	p.Layout.SingleSlot = true
+	if got, want := p.PermOffset(), int64(8192*512+600*MB); got != want {
+		t.Errorf("PermOffset() = %d, want %d", got, want)
+	}
+	if got, want := p.MinDeviceSize(), defaultMin-500*MB; got != want {
+		t.Errorf("MinDeviceSize() = %d, want %d", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := p.writeMBRPartitionTable(&buf, devsize); err != nil {
+		t.Fatal(err)
+	}
+	mbr := buf.Bytes()
+	if !bytes.Equal(mbr[446+2*16:446+3*16], make([]byte, 16)) {
+		t.Errorf("MBR partition 3 is not empty")
+	}
+	if got, want := binary.LittleEndian.Uint32(mbr[446+3*16+8:]), uint32(p.PermOffset()/512); got != want {
+		t.Errorf("MBR partition 4 first LBA = %d, want %d", got, want)
+	}
+
+	buf.Reset()
+	if err := p.writeGPT(&buf, devsize, true); err != nil {
+		t.Fatal(err)
+	}
+	entries := buf.Bytes()[512:]
+	if !bytes.Equal(entries[2*128:3*128], make([]byte, 128)) {
+		t.Errorf("GPT partition 3 is not empty")
+	}
+	if got, want := binary.LittleEndian.Uint64(entries[3*128+32:]), uint64(p.PermOffset()/512); got != want {
+		t.Errorf("GPT partition 4 first LBA = %d, want %d", got, want)
+	}
+}
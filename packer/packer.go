@@ -22,10 +22,17 @@ type Pack struct {
 	UsePartuuid    bool
 	UseGPTPartuuid bool
 	UseGPT         bool
+	// ProtectiveMBR makes Partition write a protective MBR (containing only
+	// the GPT protective partition, as the UEFI specification requires)
+	// instead of the hybrid MBR which the Raspberry Pi bootloader needs. Used
+	// for booting PCs via UEFI from the EFI system partition, and for boot
+	// media and boards which require a pure GPT (-partition_table=gpt).
+	ProtectiveMBR  bool
 	ExistingEEPROM struct {
 		PieepromSHA256 string // pieeprom.sig
 		VL805SHA256    string // vl805.sig
 	}
+	Layout Layout
 }
 
 func NewPackForHost(hostname string) Pack {
@@ -94,27 +101,45 @@ var (
 
 const MB = 1024 * 1024
 
-func permSize(devsize uint64) uint32 {
-	permStart := uint32(8192 + (1100 * MB / 512))
-	permSize := uint32((devsize / 512) - 8192 - (1100 * MB / 512))
-	// LBA -33 to LBA -1 need to remain unused for the secondary GPT header
-	lastAddressable := uint32((devsize / 512) - 1) // 0-indexed
-	if lastLBA := uint32(lastAddressable - 33); permStart+permSize >= lastLBA {
-		permSize -= (permStart + permSize) - lastLBA
-	}
-	return permSize
+// PermSizeInKB returns the size of the perm partition of the default layout on
+// a device of devsize bytes in KB.
+func PermSizeInKB(devsize uint64) uint32 {
+	return (&Pack{}).PermSizeInKB(devsize)
 }
 
-func PermSizeInKB(devsize uint64) uint32 {
-	permSizeLBA := permSize(devsize)
-	permSizeBytes := permSizeLBA * 512
-	return permSizeBytes / 1024
+// mbrPartitionEntry is an entry of the MBR partition table.
+type mbrPartitionEntry struct {
+	Status   byte
+	FirstCHS [3]byte
+	Type     byte
+	LastCHS  [3]byte
+	FirstLBA uint32
+	Sectors  uint32
 }
 
 // writePartitionTable writes a Hybrid MBR: it contains the GPT protective
 // partition so that the Linux kernel recognizes the disk as GPT, but it also
 // contains the FAT32 partition so that the Raspberry Pi bootloader still works.
-func writePartitionTable(w io.Writer, devsize uint64) error {
+// If Layout.Expose is set, the exposed partition is entered as partition 3.
+// With ProtectiveMBR, it writes a protective MBR instead.
+func (p *Pack) writePartitionTable(w io.Writer, devsize uint64) error {
+	if p.ProtectiveMBR {
+		return p.writeProtectiveMBR(w, devsize)
+	}
+	var partition3 interface{} = [16]byte{}
+	if first, sectors, mbrType, ok := p.exposedPartition(devsize); ok {
+		if first+sectors > 1<<32 {
+			return fmt.Errorf("cannot expose partition %q in the MBR: it ends beyond 2 TB", p.Layout.Expose)
+		}
+		partition3 = mbrPartitionEntry{
+			Status:   inactive,
+			FirstCHS: invalidCHS,
+			Type:     mbrType,
+			LastCHS:  invalidCHS,
+			FirstLBA: uint32(first),
+			Sectors:  uint32(sectors),
+		}
+	}
 	for _, v := range []interface{}{
 		[446]byte{}, // boot code
 
@@ -123,8 +148,8 @@ func writePartitionTable(w io.Writer, devsize uint64) error {
 		invalidCHS,
 		FAT,
 		invalidCHS,
-		uint32(8192),           // start at 8192 sectors
-		uint32(100 * MB / 512), // 100MB in size
+		uint32(bootFirstLBA),           // start at 8192 sectors
+		uint32(p.Layout.bootSectors()), // 100MB in size by default
 
 		// Partition 2 is the protective GPT partition so that the Linux kernel
 		// will recognize the disk as GPT.
@@ -135,7 +160,7 @@ func writePartitionTable(w io.Writer, devsize uint64) error {
 		uint32(1),
 		uint32(8191),
 
-		[16]byte{}, // partition 3
+		partition3,
 		[16]byte{}, // partition 4
 
 		signature,
@@ -148,12 +173,57 @@ func writePartitionTable(w io.Writer, devsize uint64) error {
 	return nil
 }
 
+// writeProtectiveMBR writes an MBR which only contains the GPT protective
+// partition, covering the entire disk (or as much of it as an MBR can
+// describe).
+func (p *Pack) writeProtectiveMBR(w io.Writer, devsize uint64) error {
+	if p.Layout.Expose != "" {
+		return fmt.Errorf("cannot expose partition %q in the MBR: UEFI requires a protective MBR", p.Layout.Expose)
+	}
+	sectors := devsize/512 - 1
+	if sectors > 0xFFFFFFFF {
+		sectors = 0xFFFFFFFF
+	}
+	for _, v := range []interface{}{
+		[446]byte{}, // boot code
+
+		inactive,
+		[3]byte{0x00, 0x02, 0x00}, // CHS of LBA 1
+		byte(0xEE),
+		invalidCHS,
+		uint32(1),
+		uint32(sectors),
+
+		[16]byte{}, // partition 2
+		[16]byte{}, // partition 3
+		[16]byte{}, // partition 4
+
+		signature,
+	} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // writeMBRPartitionTable writes an MBR-only partition table. This is useful
 // when the device requires blobs to be present in disk sectors otherwise occupied
 // by GPT metadata. For example, Odroid HC2 clobbers sectors 1-2046 with binary blobs
 // required for booting - these devices are incompatible with GPT. See
 // https://wiki.odroid.com/odroid-xu4/software/partition_table#ubuntu_partition_table.
-func writeMBRPartitionTable(w io.Writer, devsize uint64) error {
+func (p *Pack) writeMBRPartitionTable(w io.Writer, devsize uint64) error {
+	var partition3 interface{} = [16]byte{} // unused with Layout.SingleSlot
+	if !p.Layout.SingleSlot {
+		partition3 = mbrPartitionEntry{
+			Status:   inactive,
+			FirstCHS: invalidCHS,
+			Type:     Linux,
+			LastCHS:  invalidCHS,
+			FirstLBA: uint32(p.RootOffset()/512) + uint32(p.Layout.rootSectors()),
+			Sectors:  uint32(p.Layout.rootSectors()),
+		}
+	}
 	for _, v := range []interface{}{
 		[446]byte{}, // boot code
 
@@ -162,32 +232,27 @@ func writeMBRPartitionTable(w io.Writer, devsize uint64) error {
 		invalidCHS,
 		FAT,
 		invalidCHS,
-		uint32(8192),           // start at 8192 sectors
-		uint32(100 * MB / 512), // 100MB in size
+		uint32(bootFirstLBA),           // start at 8192 sectors
+		uint32(p.Layout.bootSectors()), // 100MB in size by default
 
 		// Partition 2 is squash partition 1.
 		inactive,
 		invalidCHS,
 		Linux,
 		invalidCHS,
-		uint32(8192 + 100*MB/512),
-		uint32(500 * MB / 512),
+		uint32(p.RootOffset() / 512),
+		uint32(p.Layout.rootSectors()),
 
 		// Partition 3 is squash partition 2.
-		inactive,
-		invalidCHS,
-		Linux,
-		invalidCHS,
-		uint32(8192 + 600*MB/512),
-		uint32(500 * MB / 512),
+		partition3,
 
 		// Partition 4 is the perm partition.
 		inactive,
 		invalidCHS,
-		Linux,
+		p.permType().mbr,
 		invalidCHS,
-		uint32(8192 + 1100*MB/512),
-		uint32(devsize/512 - 8192 - 1100*MB/512),
+		uint32(p.PermOffset() / 512),
+		uint32(devsize/512 - uint64(p.PermOffset()/512)),
 
 		signature,
 	} {
@@ -255,13 +320,6 @@ func partitionName(name string) [72]byte {
 }
 
 func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
-	const (
-		partitionTypeEFISystemPartition      = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
-		partitionTypeLinuxFilesystemData     = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
-		partitionTypeLinuxRootPartitionAMD64 = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
-		partitionTypeLinuxRootPartitionARM64 = "B921B045-1DF0-41C3-AF44-4C6F280D3FAE"
-	)
-
 	type partitionEntry struct {
 		TypeGUID   [16]byte
 		GUID       [16]byte
@@ -270,21 +328,28 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 		Attributes uint64
 		Name       [72]byte
 	}
-	partition0First := uint64(8192)
-	partition0Last := partition0First + (100 * MB / 512) - 1
+	partition0First := uint64(bootFirstLBA)
+	partition0Last := partition0First + p.Layout.bootSectors() - 1
 
 	partition1First := partition0Last + 1
-	partition1Last := partition1First + (500 * MB / 512) - 1
+	partition1Last := partition1First + p.Layout.rootSectors() - 1
 
 	partition2First := partition1Last + 1
-	partition2Last := partition2First + (500 * MB / 512) - 1
+	partition2Last := partition2First + p.Layout.rootSectors() - 1
 
-	partition3First := partition2Last + 1
-	partition3Last := partition3First + uint64(permSize(devsize)) - 1
+	partition3First := uint64(p.PermOffset() / 512)
+	partition3Last := partition3First + uint64(p.permSize(devsize)) - 1
 
 	rootType := mustParseGUID(partitionTypeLinuxRootPartitionARM64)
-	if os.Getenv("GOARCH") == "amd64" {
+	switch os.Getenv("GOARCH") {
+	case "amd64":
 		rootType = mustParseGUID(partitionTypeLinuxRootPartitionAMD64)
+	case "riscv64":
+		rootType = mustParseGUID(partitionTypeLinuxRootPartitionRISCV64)
+	}
+	bootName := "Microsoft basic data"
+	if p.ProtectiveMBR {
+		bootName = "EFI system partition"
 	}
 	partitionEntries := []partitionEntry{
 		{
@@ -293,7 +358,7 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 			FirstLBA:   partition0First,
 			LastLBA:    partition0Last,
 			Attributes: 0,
-			Name:       partitionName("Microsoft basic data"),
+			Name:       partitionName(bootName),
 		},
 
 		{
@@ -315,7 +380,7 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 		},
 
 		{
-			TypeGUID:   mustParseGUID(partitionTypeLinuxFilesystemData),
+			TypeGUID:   mustParseGUID(p.permType().gpt),
 			GUID:       mustParseGUID(p.GPTPARTUUID(4)),
 			FirstLBA:   partition3First,
 			LastLBA:    partition3Last,
@@ -323,6 +388,20 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 			Name:       partitionName("Linux filesystem"),
 		},
 	}
+	if p.Layout.SingleSlot {
+		partitionEntries[2] = partitionEntry{} // unused
+	}
+	for i, first := range p.ExtraPartitionLBAs(devsize) {
+		e := p.Layout.Extra[i]
+		partitionEntries = append(partitionEntries, partitionEntry{
+			TypeGUID:   mustParseGUID(e.partitionType().gpt),
+			GUID:       mustParseGUID(p.GPTPARTUUID(uint16(5 + i))),
+			FirstLBA:   first,
+			LastLBA:    first + e.sectors() - 1,
+			Attributes: 0,
+			Name:       partitionName(e.Name),
+		})
+	}
 	var pbuf bytes.Buffer
 	if err := binary.Write(&pbuf, binary.LittleEndian, partitionEntries); err != nil {
 		return err
@@ -422,15 +501,21 @@ func (p *Pack) writeGPT(w io.Writer, devsize uint64, primary bool) error {
 }
 
 func (p *Pack) Partition(o *os.File, devsize uint64) error {
-	minsize := uint64(1100 * MB)
+	minsize := uint64(p.PermOffset()-p.BootOffset()) + p.extraSize()
 	if devsize < minsize {
 		return fmt.Errorf("device is too small (at least %d MB needed, %d MB available)", minsize/MB, devsize/MB)
 	}
+	if err := p.Layout.Validate(); err != nil {
+		return err
+	}
 	if !p.UseGPT {
-		return writeMBRPartitionTable(o, devsize)
+		if len(p.Layout.Extra) > 0 {
+			return fmt.Errorf("extra partitions require a GPT partition table, but this device uses an MBR-only partition table")
+		}
+		return p.writeMBRPartitionTable(o, devsize)
 	}
 
-	if err := writePartitionTable(o, devsize); err != nil {
+	if err := p.writePartitionTable(o, devsize); err != nil {
 		return err
 	}
 
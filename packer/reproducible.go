@@ -0,0 +1,42 @@
+package packer
+
+import "strings"
+
+// reproducible is set with UseReproducibleBuilds.
+var reproducible bool
+
+// UseReproducibleBuilds makes all go build invocations produce byte-identical
+// binaries for identical inputs: file system paths are removed from the
+// binaries (-trimpath) and so is the build ID (-ldflags=-buildid=), which
+// depends on the build environment. It must be called before building.
+func UseReproducibleBuilds() {
+	reproducible = true
+}
+
+// reproducibleBuildArgs returns the go build arguments args with -trimpath
+// and an empty build ID added. The build ID is appended to existing -ldflags
+// (e.g. from a package's GoBuildFlags), as only the last -ldflags takes
+// effect.
+func reproducibleBuildArgs(args []string) []string {
+	result := []string{"-trimpath"}
+	ldflags := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "-ldflags="):
+			arg += " -buildid="
+			ldflags = true
+
+		case arg == "-ldflags" && i+1 < len(args):
+			result = append(result, arg)
+			i++
+			arg = args[i] + " -buildid="
+			ldflags = true
+		}
+		result = append(result, arg)
+	}
+	if !ldflags {
+		result = append([]string{"-trimpath", "-ldflags=-buildid="}, args...)
+	}
+	return result
+}
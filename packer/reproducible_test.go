@@ -0,0 +1,32 @@
+package packer
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReproducibleBuildArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"-o", "/tmp/bin/hello", "-tags=gokrazy", "example.com/hello"},
+			want: []string{"-trimpath", "-ldflags=-buildid=", "-o", "/tmp/bin/hello", "-tags=gokrazy", "example.com/hello"},
+		},
+		{
+			args: []string{"-tags=gokrazy", "-ldflags=-X main.version=1", "example.com/hello"},
+			want: []string{"-trimpath", "-tags=gokrazy", "-ldflags=-X main.version=1 -buildid=", "example.com/hello"},
+		},
+		{
+			args: []string{"-ldflags", "-s -w", "example.com/hello"},
+			want: []string{"-trimpath", "-ldflags", "-s -w -buildid=", "example.com/hello"},
+		},
+	} {
+		got := reproducibleBuildArgs(tt.args)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("reproducibleBuildArgs(%q): unexpected result (-want +got):\n%s", tt.args, diff)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+)
+
+// workspace is the absolute path of the go.work file set with UseWorkspace.
+var workspace string
+
+var (
+	buildDirWorkspacesMu sync.Mutex
+	buildDirWorkspaces   = make(map[string]string)
+)
+
+// FindWorkspace returns the go.work file which the go tool would use in the
+// current working directory: $GOWORK, or the first go.work file found in the
+// current directory or its parents. FindWorkspace returns the empty string
+// when not in a workspace.
+func FindWorkspace() (string, error) {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return "", nil
+	case "":
+	default:
+		return filepath.Abs(gowork)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		fn := filepath.Join(dir, "go.work")
+		if _, err := os.Stat(fn); err == nil {
+			return fn, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// UseWorkspace makes all go tool invocations in build directories use the
+// modules of the go.work file gowork (its use and replace directives), so that
+// local working copies are packed instead of the published versions which the
+// build directory go.mod files require. It must be called before building.
+func UseWorkspace(gowork string) {
+	buildDirWorkspacesMu.Lock()
+	defer buildDirWorkspacesMu.Unlock()
+	workspace = gowork
+	buildDirWorkspaces = make(map[string]string)
+}
+
+// buildDirWorkspace returns the path of a go.work file for buildDir, which
+// uses the build directory module in addition to all modules of the
+// workspace.
+func buildDirWorkspace(buildDir string) (string, error) {
+	buildDirWorkspacesMu.Lock()
+	defer buildDirWorkspacesMu.Unlock()
+	if fn, ok := buildDirWorkspaces[buildDir]; ok {
+		return fn, nil
+	}
+
+	b, err := os.ReadFile(workspace)
+	if err != nil {
+		return "", err
+	}
+	wf, err := modfile.ParseWork(workspace, b, nil)
+	if err != nil {
+		return "", err
+	}
+	absBuildDir, err := filepath.Abs(buildDir)
+	if err != nil {
+		return "", err
+	}
+	// Turn relative paths into absolute ones to keep them working from within
+	// the build directory.
+	workspaceDir := filepath.Dir(workspace)
+	abs := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(workspaceDir, path)
+	}
+	out := &modfile.WorkFile{Syntax: &modfile.FileSyntax{}}
+	if wf.Go != nil {
+		if err := out.AddGoStmt(wf.Go.Version); err != nil {
+			return "", err
+		}
+	}
+	out.AddNewUse(absBuildDir, "")
+	for _, u := range wf.Use {
+		out.AddNewUse(abs(u.Path), u.ModulePath)
+	}
+	for _, r := range wf.Replace {
+		newPath := r.New.Path
+		if r.New.Version == "" {
+			newPath = abs(newPath)
+		}
+		if err := out.AddReplace(r.Old.Path, r.Old.Version, newPath, r.New.Version); err != nil {
+			return "", err
+		}
+	}
+	out.Cleanup()
+
+	// Not named go.work so that go commands in the build directory (e.g. gok
+	// get) do not pick it up implicitly.
+	fn := filepath.Join(absBuildDir, "gokrazy.go.work")
+	if err := os.WriteFile(fn, modfile.Format(out.Syntax), 0644); err != nil {
+		return "", err
+	}
+	buildDirWorkspaces[buildDir] = fn
+	return fn, nil
+}
+
+// buildDirEnv returns the environment for go tool invocations in buildDir,
+// which selects the workspace (see UseWorkspace), if any.
+func buildDirEnv(buildDir string) ([]string, error) {
+	if workspace == "" {
+		return Env(), nil
+	}
+	gowork, err := buildDirWorkspace(buildDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", workspace, err)
+	}
+	env := make([]string, 0, len(Env())+1)
+	for _, e := range Env() {
+		if strings.HasPrefix(e, "GOFLAGS=") {
+			// Workspace mode does not support e.g. GOFLAGS=-mod=mod.
+			var flags []string
+			for _, f := range strings.Fields(strings.TrimPrefix(e, "GOFLAGS=")) {
+				if !strings.HasPrefix(f, "-mod=") {
+					flags = append(flags, f)
+				}
+			}
+			e = "GOFLAGS=" + strings.Join(flags, " ")
+		}
+		env = append(env, e)
+	}
+	return append(env, "GOWORK="+gowork), nil
+}
+
+// GoCommand returns a go tool command which runs the subcommand (e.g. build)
+// in buildDir. The command uses the workspace (see UseWorkspace), if any, and
+// otherwise passes -mod=mod (which workspace mode does not support). Builds
+// are reproducible after UseReproducibleBuilds.
+func GoCommand(buildDir, subcommand string, args ...string) (*exec.Cmd, error) {
+	env, err := buildDirEnv(buildDir)
+	if err != nil {
+		return nil, err
+	}
+	flags := []string{subcommand}
+	if workspace == "" {
+		flags = append(flags, "-mod=mod")
+	}
+	if reproducible && subcommand == "build" {
+		args = reproducibleBuildArgs(args)
+	}
+	cmd := exec.Command("go", append(flags, args...)...)
+	cmd.Env = env
+	cmd.Dir = buildDir
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
@@ -0,0 +1,64 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/modfile"
+)
+
+func TestBuildDirWorkspace(t *testing.T) {
+	tmp := t.TempDir()
+	gowork := filepath.Join(tmp, "go.work")
+	const content = `go 1.19
+
+use (
+	./app
+	/src/lib
+)
+
+replace example.com/dep => ../dep
+`
+	if err := os.WriteFile(gowork, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buildDir := filepath.Join(tmp, "instance", "builddir", "example.com", "app")
+	if err := os.MkdirAll(buildDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer UseWorkspace("")
+	UseWorkspace(gowork)
+	fn, err := buildDirWorkspace(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf, err := modfile.ParseWork(fn, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uses []string
+	for _, u := range wf.Use {
+		uses = append(uses, u.Path)
+	}
+	want := []string{buildDir, filepath.Join(tmp, "app"), "/src/lib"}
+	if len(uses) != len(want) {
+		t.Fatalf("use directives: got %q, want %q", uses, want)
+	}
+	for i := range want {
+		if uses[i] != want[i] {
+			t.Errorf("use directive %d: got %q, want %q", i, uses[i], want[i])
+		}
+	}
+	if got, want := len(wf.Replace), 1; got != want {
+		t.Fatalf("got %d replace directives, want %d", got, want)
+	}
+	if got, want := wf.Replace[0].New.Path, filepath.Join(filepath.Dir(tmp), "dep"); got != want {
+		t.Errorf("replace directive: got %q, want %q", got, want)
+	}
+}
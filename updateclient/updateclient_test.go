@@ -0,0 +1,86 @@
+package updateclient_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gokrazy/tools/fakedevice"
+	"github.com/gokrazy/tools/updateclient"
+)
+
+func TestUpdate(t *testing.T) {
+	dev := fakedevice.New("test")
+	dev.Features = []string{"partuuid", "gpt"}
+	dev.Unsupported = []string{"mbr"}
+	dev.BuildTimestamp = "old"
+	dev.RootBuildTimestamp = func([]byte) string { return "new" }
+	srv := httptest.NewServer(dev)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := updateclient.New(ctx, srv.URL, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Supports("gpt") {
+		t.Errorf("Supports(gpt) = false, want true")
+	}
+	c.PollInterval = time.Millisecond
+	var progress []updateclient.Progress
+	c.Progress = func(p updateclient.Progress) { progress = append(progress, p) }
+
+	root := bytes.Repeat([]byte("root"), 1024)
+	if err := c.UpdateRoot(ctx, bytes.NewReader(root)); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev.Root(3); !bytes.Equal(got, root) {
+		t.Errorf("device received %d bytes of root, want %d", len(got), len(root))
+	}
+	if len(progress) == 0 {
+		t.Fatalf("Progress not called")
+	}
+	if got, want := progress[len(progress)-1], (updateclient.Progress{Dest: "root", Done: int64(len(root)), Total: int64(len(root))}); got != want {
+		t.Errorf("last progress = %+v, want %+v", got, want)
+	}
+
+	err = c.UpdateMBR(ctx, strings.NewReader("mbr"))
+	if !errors.Is(err, updateclient.ErrNotSupported) {
+		t.Errorf("UpdateMBR() = %v, want ErrNotSupported", err)
+	}
+	var uerr *updateclient.Error
+	if !errors.As(err, &uerr) || uerr.Op != "updating mbr" {
+		t.Errorf("UpdateMBR() = %#v, want *Error with Op %q", err, "updating mbr")
+	}
+
+	if err := c.Switch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reboot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForBuild(ctx, "new", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device never runs this build, so WaitForBuild gives up once the
+	// context is done.
+	var polls int
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = c.WaitForBuild(timeoutCtx, "newer", func(error) { polls++ })
+	if !errors.As(err, &uerr) {
+		t.Errorf("WaitForBuild() = %v, want *Error", err)
+	}
+	if polls == 0 {
+		t.Errorf("WaitForBuild did not poll")
+	}
+
+	if got, want := dev.ActiveRoot(), 3; got != want {
+		t.Errorf("device runs from root partition %d, want %d", got, want)
+	}
+}